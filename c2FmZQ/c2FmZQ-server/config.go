@@ -0,0 +1,245 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2" // cli
+
+	"c2FmZQ/internal/kms"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+)
+
+const (
+	tlsModeAuto     = "auto"
+	tlsModeOff      = "off"
+	tlsModeFile     = "file"
+	tlsModeAutocert = "autocert"
+)
+
+// secretFlags are the flags whose values are never shown.
+var secretFlags = map[string]bool{
+	"passphrase":      true,
+	"smtp-password":   true,
+	"billing-api-key": true,
+	"setup-token":     true,
+}
+
+// urlFlags are the flags whose values are URLs that can contain a password.
+var urlFlags = map[string]bool{
+	"lock-url":       true,
+	"blob-store-url": true,
+	"snapshot-url":   true,
+}
+
+// tlsMode returns the effective TLS mode. With auto, the mode depends on
+// which of --tlscert and --autocert-domain is set.
+func tlsMode() string {
+	if flagTLSMode != tlsModeAuto {
+		return flagTLSMode
+	}
+	switch {
+	case flagAutocertDomain != "":
+		return tlsModeAutocert
+	case flagTLSCert != "":
+		return tlsModeFile
+	default:
+		return tlsModeOff
+	}
+}
+
+// validateFlags checks that the flags, which can also be set with environment
+// variables, are consistent. All the problems are reported at once.
+func validateFlags() error {
+	var errs []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(flagDatabase != "", "--database must be set")
+	check(flagAddress != "", "--address must be set")
+	check(flagLogLevel >= log.ErrorLevel && flagLogLevel <= log.DebugLevel, "--verbose must be between %d and %d", log.ErrorLevel, log.DebugLevel)
+	check((flagTLSCert == "") == (flagTLSKey == ""), "--tlscert and --tlskey must either both be set or unset")
+
+	switch flagTLSMode {
+	case tlsModeAuto:
+	case tlsModeOff:
+		check(flagTLSCert == "" && flagAutocertDomain == "", "--tls-mode=off doesn't use --tlscert or --autocert-domain")
+	case tlsModeFile:
+		check(flagTLSCert != "", "--tls-mode=file requires --tlscert and --tlskey")
+	case tlsModeAutocert:
+		check(flagAutocertDomain != "", "--tls-mode=autocert requires --autocert-domain")
+	default:
+		errs = append(errs, fmt.Sprintf("--tls-mode: invalid value %q", flagTLSMode))
+	}
+	if tlsMode() == tlsModeFile {
+		for _, f := range []string{flagTLSCert, flagTLSKey} {
+			if _, err := os.Stat(f); err != nil && f != "" {
+				errs = append(errs, fmt.Sprintf("--tlscert/--tlskey: %v", err))
+			}
+		}
+	}
+	check(!flagTLSOCSPStapling || tlsMode() == tlsModeFile, "--tls-ocsp-stapling requires --tlscert")
+
+	if flagMasterKeyBackend != "passphrase" {
+		check(flagEncryptMetadata, "--masterkey-backend requires --encrypt-metadata")
+		check(flagPassphraseCmd == "" && flagPassphraseFile == "" && flagPassphrase == "", "--masterkey-backend can't be used with a passphrase")
+		if _, err := kms.New(flagMasterKeyBackend); err != nil {
+			errs = append(errs, fmt.Sprintf("--masterkey-backend: %v", err))
+		}
+	}
+	if flagEncryptMetadata && flagPassphraseFile != "" && flagPassphraseCmd == "" {
+		if _, err := os.Stat(flagPassphraseFile); err != nil {
+			errs = append(errs, fmt.Sprintf("--passphrase-file: %v", err))
+		}
+	}
+	check(flagMaxConcurrentRequests > 0, "--max-concurrent-requests must be positive")
+	check(flagMaxParallelUploads > 0, "--max-parallel-uploads must be positive")
+	check(flagMaxConcurrentUploads > 0, "--max-concurrent-uploads must be positive")
+	check(flagMaxSessions >= 0, "--max-sessions can't be negative")
+	check(flagSessionLimitPolicy == server.SessionLimitReject || flagSessionLimitPolicy == server.SessionLimitEvict, "--session-limit-policy: invalid value %q", flagSessionLimitPolicy)
+	check(flagLoginLockoutThreshold >= 0, "--login-lockout-threshold can't be negative")
+	check(flagLoginLockoutThreshold == 0 || flagLoginLockoutDuration > 0, "--login-lockout-duration must be positive")
+	check(flagRecoveryDelay >= 0, "--recovery-delay can't be negative")
+	check(flagSlowRequestThreshold >= 0, "--slow-request-threshold can't be negative")
+	check(flagMinPollInterval >= 0, "--min-poll-interval can't be negative")
+	check(flagPurgeDelay >= 0, "--purge-delay can't be negative")
+	check(flagTrashRetentionDays >= 0, "--trash-retention-days can't be negative")
+	check(flagPrefetchMemory >= 0, "--prefetch-memory can't be negative")
+	check(flagGCInterval >= 0, "--gc-interval can't be negative")
+	check(flagStorageMetricsInterval >= 0, "--storage-metrics-interval can't be negative")
+	check(!flagUsageReports || flagSMTPServer != "", "--usage-reports requires --smtp-server")
+	check(!flagVerifyEmails || flagSMTPServer != "", "--require-email-verification requires --smtp-server")
+	check(flagBillingWebhookURL == "" || flagBillingAPIKey != "", "--billing-webhook-url requires --billing-api-key")
+	check(!flagReadOnly || !flagFirstRunSetup, "--first-run-setup can't be used with --read-only")
+	if flagSnapshotURL != "" {
+		check(flagEncryptMetadata, "--snapshot-url requires --encrypt-metadata")
+		check(flagSnapshotInterval > 0, "--snapshot-interval must be positive")
+		check(flagSnapshotRetention > 0, "--snapshot-retention must be positive")
+	}
+	if _, err := server.NewTLSPolicy(flagTLSMinVersion, flagTLSCipherSuites, flagTLSCurves, flagTLSOCSPStapling); err != nil {
+		errs = append(errs, fmt.Sprintf("TLS policy: %v", err))
+	}
+	if _, err := server.NewRateLimitPolicy(flagRateLimits, flagRateLimitExempt); err != nil {
+		errs = append(errs, fmt.Sprintf("Rate limits: %v", err))
+	}
+	if flagWebAppDir != "" {
+		check(flagEnableWebApp, "--webapp-dir requires --enable-webapp")
+		if _, err := os.Stat(filepath.Join(flagWebAppDir, "index.html")); err != nil {
+			errs = append(errs, fmt.Sprintf("--webapp-dir: %v", err))
+		}
+	}
+	if _, err := server.NewAccessPolicy(flagIPAllow, flagIPDeny, flagTrustedProxies); err != nil {
+		errs = append(errs, fmt.Sprintf("Access policy: %v", err))
+	}
+	if _, err := server.ParseAllowedOrigins(flagAllowedOrigins); err != nil {
+		errs = append(errs, fmt.Sprintf("--allowed-origins: %v", err))
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// printConfig shows the effective configuration, i.e. the value of each flag
+// and where it comes from, with the secrets redacted.
+func printConfig(c *cli.Context) error {
+	type line struct {
+		name, value, source string
+	}
+	var lines []line
+	width := 0
+	for _, f := range c.App.Flags {
+		name := f.Names()[0]
+		if name == "licenses" {
+			continue
+		}
+		l := line{
+			name:   name,
+			value:  redactValue(name, fmt.Sprint(c.Value(name))),
+			source: flagSource(c, f),
+		}
+		if name == "tls-mode" {
+			l.value = fmt.Sprintf("%s (%s)", flagTLSMode, tlsMode())
+		}
+		if len(name) > width {
+			width = len(name)
+		}
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].name < lines[j].name })
+	for _, l := range lines {
+		fmt.Fprintf(c.App.Writer, "%-*s = %s [%s]\n", width, l.name, l.value, l.source)
+	}
+	return nil
+}
+
+// flagSource returns where the value of flag f comes from: the command line,
+// an environment variable, or the default value.
+func flagSource(c *cli.Context, f cli.Flag) string {
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		arg = strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		for _, n := range f.Names() {
+			if arg == n {
+				return "flag"
+			}
+		}
+	}
+	if ef, ok := f.(interface{ GetEnvVars() []string }); ok {
+		for _, env := range ef.GetEnvVars() {
+			if _, ok := os.LookupEnv(env); ok {
+				return "$" + env
+			}
+		}
+	}
+	if c.IsSet(f.Names()[0]) {
+		return "flag"
+	}
+	return "default"
+}
+
+// redactValue hides the secrets in the value of a flag, and quotes empty
+// values.
+func redactValue(name, value string) string {
+	if value == "" {
+		return `""`
+	}
+	if secretFlags[name] {
+		return "REDACTED"
+	}
+	if urlFlags[name] {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "REDACTED"
+		}
+		return u.Redacted()
+	}
+	return value
+}
@@ -19,38 +19,40 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"crypto/subtle"
 	"encoding/base32"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mdp/qrterminal"
 	"github.com/pquerna/otp/totp"
 	"github.com/urfave/cli/v2" // cli
 	"golang.org/x/term"
 
+	"c2FmZQ/internal/cluster"
 	"c2FmZQ/internal/crypto"
 	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/kms"
 	"c2FmZQ/internal/log"
-	"c2FmZQ/internal/secure"
 	"c2FmZQ/internal/stingle"
 )
 
 var (
-	flagDatabase        string
-	flagLogLevel        int
-	flagEncryptMetadata bool
-	flagPassphraseFile  string
-	flagPassphraseCmd   string
-	flagPassphrase      string
+	flagDatabase         string
+	flagLogLevel         int
+	flagEncryptMetadata  bool
+	flagPassphraseFile   string
+	flagPassphraseCmd    string
+	flagPassphrase       string
+	flagMasterKeyBackend string
 )
 
 func main() {
@@ -107,6 +109,13 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_PASSPHRASE"},
 				Destination: &flagPassphrase,
 			},
+			&cli.StringFlag{
+				Name:        "masterkey-backend",
+				Value:       "passphrase",
+				Usage:       "What protects the database's master key: passphrase, or the `URL` of a key management service, awskms:KEYID, gcpkms:projects/P/locations/L/keyRings/R/cryptoKeys/K, or vault:MOUNT/KEY.",
+				EnvVars:     []string{"C2FMZQ_MASTERKEY_BACKEND"},
+				Destination: &flagMasterKeyBackend,
+			},
 		},
 		Commands: []*cli.Command{
 			&cli.Command{
@@ -128,6 +137,12 @@ func main() {
 				Aliases:  []string{"show", "dump"},
 				Usage:    "Show the content of database files.",
 				Action:   catFile,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "canonical",
+						Usage: "Show metadata files in a canonical form that can be compared byte for byte, e.g. between two replicas.",
+					},
+				},
 			},
 			&cli.Command{
 				Name:     "edit",
@@ -216,6 +231,59 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:     "gc",
+				Category: "System",
+				Usage:    "Fix the reference counts of the files' content, and delete the content that isn't referenced anymore.",
+				Action:   collectGarbage,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "min-age",
+						Value: time.Hour,
+						Usage: "Only delete the unreferenced content older than this, so that uploads in progress are left alone.",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be fixed and deleted.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "purge",
+				Category: "System",
+				Usage:    "Purge the files deleted from the trash whose purge delay expired. See --purge-delay.",
+				Action:   purgeDeletedFiles,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:     "purge-delay",
+						Usage:    "The server's --purge-delay.",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be purged.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "migrate-blobs",
+				Category: "System",
+				Usage:    "Move the blob files to a new directory layout. This can run while the server is running, and can take a while.",
+				Action:   migrateBlobs,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "fan-out",
+						Value: 1,
+						Usage: "The number of directory levels for blob files. The server must use the same --blob-fan-out.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "index-blobs",
+				Category: "System",
+				Usage:    "Add the existing blob files to the content hash index, so that identical uploads reuse them. This can run while the server is running, and can take a while.",
+				Action:   indexBlobs,
+			},
 			&cli.Command{
 				Name:     "change-passphrase",
 				Category: "System",
@@ -237,18 +305,187 @@ func main() {
 						Value: "",
 						Usage: "Change database passphrase to value.",
 					},
+					&cli.StringFlag{
+						Name:  "new-masterkey-backend",
+						Value: "",
+						Usage: "Protect the master key with the key management service at `URL` instead of a passphrase, e.g. vault:transit/c2fmzq. Use 'passphrase' to go back to a passphrase.",
+					},
+					&cli.BoolFlag{
+						Name:  "keep-passphrase",
+						Value: false,
+						Usage: "Keep the same passphrase, e.g. to change only the key derivation function.",
+					},
+					&cli.StringFlag{
+						Name:  "kdf",
+						Value: "",
+						Usage: "The key derivation function: pbkdf2 or argon2id. The default is pbkdf2 for AES256 master keys, and argon2id for Chacha20Poly1305.",
+					},
+					&cli.UintFlag{
+						Name:  "kdf-time",
+						Value: 0,
+						Usage: "The number of iterations of pbkdf2, or the number of passes of argon2id. Zero means the default.",
+					},
+					&cli.UintFlag{
+						Name:  "kdf-memory",
+						Value: 0,
+						Usage: "The amount of memory used by argon2id, in KiB. Zero means the default.",
+					},
 				},
 			},
 			&cli.Command{
 				Name:     "change-master-key",
 				Category: "System",
-				Usage:    "Re-encrypt all the data with a new master key. This can take a while.",
+				Aliases:  []string{"re-encrypt"},
+				Usage:    "Re-encrypt all the data with a new master key. This can take a while. When interrupted, run it again to resume. The metadata snapshots must then go to a new location.",
 				Action:   changeMasterKey,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:  "format",
 						Value: "auto",
-						Usage: "The format of the new master key ('auto', 'aes', 'chacha20poly1305')",
+						Usage: "The format of the new master key ('auto', 'fastest', 'aes256', 'chacha20poly1305')",
+					},
+					&cli.IntFlag{
+						Name:  "rate-limit",
+						Value: 0,
+						Usage: "The maximum rate of re-encryption, in MiB per second. 0 means no limit.",
+					},
+					&cli.IntFlag{
+						Name:  "workers",
+						Value: 10,
+						Usage: "The number of files to re-encrypt concurrently.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "snapshot",
+				Category: "System",
+				Usage:    "Upload an encrypted snapshot of the metadata. This can run while the server is running.",
+				Action:   createSnapshot,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "The `URL` of the snapshots, e.g. s3://bucket/prefix, webdavs://host/path, scp://user@host/path, or file:///path.",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "retention",
+						Value: 7,
+						Usage: "The number of snapshots to keep.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "list-snapshots",
+				Category: "System",
+				Usage:    "List the metadata snapshots.",
+				Action:   listSnapshots,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "The `URL` of the snapshots.",
+						Required: true,
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "restore-snapshot",
+				Category: "System",
+				Usage:    "Restore a metadata snapshot into an empty --database directory. The content of the files isn't included.",
+				Action:   restoreSnapshot,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "The `URL` of the snapshots.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "snapshot",
+						Value: "",
+						Usage: "The `NAME` of the snapshot to restore. The default is the most recent one.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "restore-user",
+				Category: "Users",
+				Usage:    "Roll back a user's files and albums to a metadata snapshot, e.g. after an accidental mass delete.",
+				Action:   restoreUser,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "The userid to restore.",
+						Aliases: []string{"u"},
+					},
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "The `URL` of the snapshots.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "snapshot",
+						Value: "",
+						Usage: "The `NAME` of the snapshot to use.",
+					},
+					&cli.TimestampFlag{
+						Name:   "time",
+						Layout: time.RFC3339,
+						Usage:  "Use the most recent snapshot created at or before `TIME`, e.g. 2022-06-01T12:00:00Z.",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be restored.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "delete-user",
+				Category: "Users",
+				Usage:    "Delete a user account, with its files and the albums that it owns.",
+				Action:   deleteUser,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "The userid to delete.",
+						Aliases: []string{"u"},
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be deleted.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "undelete",
+				Category: "Users",
+				Usage:    "Restore the files that a user deleted from the trash, if they weren't purged yet. See --purge-delay.",
+				Action:   undeleteFiles,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "The userid to update.",
+						Aliases: []string{"u"},
+					},
+					&cli.TimestampFlag{
+						Name:   "since",
+						Layout: time.RFC3339,
+						Usage:  "Only restore the files deleted at or after `TIME`, e.g. 2022-06-01T12:00:00Z.",
+					},
+					&cli.BoolFlag{
+						Name:  "list",
+						Usage: "Only list the files that can be restored.",
+					},
+				},
+			},
+			&cli.Command{
+				Name:     "rotate-token-keys",
+				Category: "Users",
+				Usage:    "Replace the keys used to encrypt the users' tokens. The tokens that were already issued remain valid.",
+				Action:   rotateTokenKeys,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "The userid to update. The default is all users.",
+						Aliases: []string{"u"},
 					},
 				},
 			},
@@ -265,6 +502,37 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:     "limited",
+				Category: "Users",
+				Usage:    "Make a user account limited, e.g. a child's account.",
+				Action:   limitedUser,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "The userid to update.",
+						Aliases: []string{"u"},
+					},
+					&cli.StringFlag{
+						Name:  "parent",
+						Usage: "The email address of the account that manages this one.",
+					},
+					&cli.Int64Flag{
+						Name:  "quota",
+						Value: -1,
+						Usage: "The fixed quota of the account. The default is the current quota.",
+					},
+					&cli.StringFlag{
+						Name:  "quota-unit",
+						Value: "GB",
+						Usage: "The unit of --quota, e.g. MB, GB, TB.",
+					},
+					&cli.BoolFlag{
+						Name:  "clear",
+						Usage: "Make the account a regular account again.",
+					},
+				},
+			},
 			&cli.Command{
 				Name:     "rename",
 				Category: "Users",
@@ -340,12 +608,25 @@ func main() {
 	}
 }
 
+// passphrase returns the passphrase of the database's master key, from the
+// key management service of --masterkey-backend or from the passphrase flags.
+func passphrase() ([]byte, error) {
+	if flagMasterKeyBackend == "passphrase" {
+		return crypto.Passphrase(flagPassphraseCmd, flagPassphraseFile, flagPassphrase)
+	}
+	w, err := kms.New(flagMasterKeyBackend)
+	if err != nil {
+		return nil, err
+	}
+	return kms.Passphrase(w, flagDatabase)
+}
+
 func initDB(c *cli.Context) (*database.Database, error) {
 	log.Level = flagLogLevel
 	var pp []byte
 	if flagEncryptMetadata {
 		var err error
-		if pp, err = crypto.Passphrase(flagPassphraseCmd, flagPassphraseFile, flagPassphrase); err != nil {
+		if pp, err = passphrase(); err != nil {
 			return nil, err
 		}
 	}
@@ -392,8 +673,12 @@ func catFile(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	dump := db.DumpFile
+	if c.Bool("canonical") {
+		dump = func(f string) error { return db.ExportFile(f, os.Stdout) }
+	}
 	for _, f := range c.Args().Slice() {
-		if err := db.DumpFile(f); err != nil {
+		if err := dump(f); err != nil {
 			log.Errorf("%s: %v", f, err)
 		}
 	}
@@ -408,270 +693,347 @@ func findOrphanFiles(c *cli.Context) error {
 	return db.FindOrphanFiles(c.Bool("delete"))
 }
 
-func changeMasterKey(c *cli.Context) error {
-	log.Level = flagLogLevel
-	log.Infof("Working on %s", flagDatabase)
-
-	pp, err := crypto.Passphrase(flagPassphraseCmd, flagPassphraseFile, flagPassphrase)
+func collectGarbage(c *cli.Context) error {
+	db, err := initDB(c)
 	if err != nil {
 		return err
 	}
-	mkFile := filepath.Join(flagDatabase, "master.key")
-	mk1, err := crypto.ReadMasterKey(pp, mkFile)
+	if c.Bool("dry-run") {
+		report, err := db.CollectGarbageDryRun(c.Duration("min-age"))
+		if err != nil {
+			return err
+		}
+		showRemovalReport(report)
+		return nil
+	}
+	stats, err := db.CollectGarbage(c.Duration("min-age"))
 	if err != nil {
 		return err
 	}
+	log.Infof("%d reference counts fixed, %d unreferenced blobs deleted (%d bytes), %d blobs missing", stats.RefCountsFixed, stats.OrphansDeleted, stats.ReclaimedBytes, stats.Missing)
+	return nil
+}
 
-	var alg int
-	switch f := strings.ToLower(c.String("format")); f {
-	case "auto":
-		alg = crypto.PickFastest
-	case "aes", "aes256":
-		alg = crypto.AES256
-	case "chacha20poly1305":
-		alg = crypto.Chacha20Poly1305
-	default:
-		log.Fatalf("Invalid format %q", f)
+func purgeDeletedFiles(c *cli.Context) error {
+	log.Level = flagLogLevel
+	var pp []byte
+	if flagEncryptMetadata {
+		var err error
+		if pp, err = passphrase(); err != nil {
+			return err
+		}
+	}
+	db := database.NewWithOptions(flagDatabase, pp, database.Options{PurgeDelay: c.Duration("purge-delay")})
+	if c.Bool("dry-run") {
+		report, err := db.PurgeDeletedFilesDryRun()
+		if err != nil {
+			return err
+		}
+		showRemovalReport(report)
+		return nil
 	}
+	n, err := db.PurgeDeletedFiles()
+	log.Infof("Purged %d deleted files", n)
+	return err
+}
 
-	mk2, err := crypto.CreateMasterKey(alg)
+func showRemovalReport(r *database.RemovalReport) {
+	if r.DryRun {
+		fmt.Println("Dry run. Nothing was changed.")
+	}
+	if r.Users > 0 {
+		fmt.Printf("Users:     %d\n", r.Users)
+	}
+	if r.Albums > 0 {
+		fmt.Printf("Albums:    %d\n", r.Albums)
+	}
+	if r.RefCountsFixed > 0 {
+		fmt.Printf("RefCounts: %d\n", r.RefCountsFixed)
+	}
+	fmt.Printf("Files:     %d\n", r.Files)
+	fmt.Printf("Blobs:     %d (%d bytes)\n", r.Blobs, r.Bytes)
+	for _, item := range r.Items {
+		fmt.Printf("  %s\n", item)
+	}
+	if r.Truncated {
+		fmt.Printf("  ... (only the first %d are shown)\n", database.MaxReportItems)
+	}
+}
+
+func migrateBlobs(c *cli.Context) error {
+	log.Level = flagLogLevel
+	var pp []byte
+	if flagEncryptMetadata {
+		var err error
+		if pp, err = passphrase(); err != nil {
+			return err
+		}
+	}
+	db := database.NewWithOptions(flagDatabase, pp, database.Options{BlobFanOut: c.Int("fan-out")})
+	stats, err := db.MigrateBlobs()
+	log.Infof("Moved %d blobs, updated %d references", stats.Blobs, stats.Refs)
+	return err
+}
+
+func indexBlobs(c *cli.Context) error {
+	db, err := initDB(c)
 	if err != nil {
 		return err
 	}
+	n, err := db.IndexBlobHashes()
+	log.Infof("Indexed %d blobs", n)
+	return err
+}
 
-	if ans := prompt("\nMake sure you have a backup of the database before proceeding.\nType CHANGE-MASTER-KEY to continue: "); ans != "CHANGE-MASTER-KEY" {
-		log.Fatal("Aborted.")
+func snapshotPassphrase() ([]byte, error) {
+	if !flagEncryptMetadata {
+		return nil, errors.New("metadata snapshots require --encrypt-metadata")
 	}
+	return passphrase()
+}
 
-	if err := mk2.Save(pp, mkFile+".new"); err != nil {
+func createSnapshot(c *cli.Context) error {
+	log.Level = flagLogLevel
+	pp, err := snapshotPassphrase()
+	if err != nil {
 		return err
 	}
-
-	context := func(s string) []byte {
-		h := sha1.Sum([]byte(s))
-		return h[:]
+	remote, err := cluster.NewRemoteStore(c.String("url"))
+	if err != nil {
+		return err
+	}
+	db := database.NewWithOptions(flagDatabase, pp, database.Options{ReadOnly: true})
+	defer db.Wipe()
+	snap, err := db.CreateMetadataSnapshot(remote, c.Int("retention"))
+	if err != nil {
+		return err
 	}
+	log.Infof("Snapshot %s: %d files (%d bytes), %d new files (%d bytes)", snap.Name, snap.Files, snap.Bytes, snap.NewFiles, snap.NewBytes)
+	return nil
+}
 
-	db := database.New(flagDatabase, pp)
+func listSnapshots(c *cli.Context) error {
+	log.Level = flagLogLevel
+	pp, err := snapshotPassphrase()
+	if err != nil {
+		return err
+	}
+	remote, err := cluster.NewRemoteStore(c.String("url"))
+	if err != nil {
+		return err
+	}
+	list, err := database.ListMetadataSnapshots(remote, pp)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		fmt.Printf("%s  %s  %6d files  %10d bytes\n", s.Name, s.Time.Local().Format(time.RFC3339), s.Files, s.Bytes)
+	}
+	return nil
+}
 
-	reEncryptFile := func(path database.DFile) (err error) {
-		defer func() {
-			if err != nil {
-				log.Infof("%s: %v", path, err)
-			}
-		}()
-		rel := path.RelativePath
-		newRel := rel
-		if path.LogicalPath != "" {
-			h := mk2.Hash([]byte(path.LogicalPath))
-			dir := fmt.Sprintf("%02X", h[0])
-			newRel = filepath.Join(dir, base64.RawURLEncoding.EncodeToString(h))
-		}
+func restoreSnapshot(c *cli.Context) error {
+	log.Level = flagLogLevel
+	pp, err := snapshotPassphrase()
+	if err != nil {
+		return err
+	}
+	remote, err := cluster.NewRemoteStore(c.String("url"))
+	if err != nil {
+		return err
+	}
+	snap, err := database.RestoreMetadataSnapshot(remote, c.String("snapshot"), flagDatabase, pp)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored snapshot %s (%d files) into %s", snap.Name, snap.Files, flagDatabase)
+	log.Info("The content of the files and thumbnails must be restored separately, unless it is in a blob store.")
+	return nil
+}
 
-		oldPath := filepath.Join(db.Dir(), rel)
-		in, err := os.Open(oldPath)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
-		hdr := make([]byte, 5)
-		if _, err := io.ReadFull(in, hdr); err != nil {
-			log.Infof("%s Skipped", path)
-			return nil
-		}
-		if string(hdr[:4]) != "KRIN" {
-			log.Infof("%s Skipped", path)
-			return nil
-		}
-		k1, err := mk1.ReadEncryptedKey(in)
-		if err != nil {
-			return err
-		}
-		defer k1.Wipe()
-		r, err := k1.StartReader(context(rel), in)
+func restoreUser(c *cli.Context) error {
+	id := c.Int64("userid")
+	if id <= 0 || (c.String("snapshot") == "") == (c.Timestamp("time") == nil) {
+		return cli.ShowSubcommandHelp(c)
+	}
+	remote, err := cluster.NewRemoteStore(c.String("url"))
+	if err != nil {
+		return err
+	}
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Wipe()
+	user, err := db.UserByID(id)
+	if err != nil {
+		return err
+	}
+	name := c.String("snapshot")
+	if t := c.Timestamp("time"); t != nil {
+		snap, err := db.FindMetadataSnapshot(remote, *t)
 		if err != nil {
 			return err
 		}
-		defer r.Close()
-
-		// Read the header again.
-		h := make([]byte, 5)
-		if _, err := io.ReadFull(r, h); err != nil {
-			return err
-		}
-		if bytes.Compare(hdr, h) != 0 {
-			return errors.New("wrong encrypted header")
+		name = snap.Name
+	}
+	dryRun := c.Bool("dry-run")
+	if !dryRun {
+		if ans := prompt(fmt.Sprintf("\nThe files of %s will be rolled back to snapshot %s.\nType RESTORE to continue: ", user.Email, name)); ans != "RESTORE" {
+			log.Fatal("Aborted.")
 		}
-		if hdr[4]&0x40 != 0 {
-			if err := secure.SkipPadding(r); err != nil {
-				return err
-			}
+	}
+	report, err := db.RestoreUserFromSnapshot(user, remote, name, dryRun)
+	if err != nil {
+		return err
+	}
+	setName := func(set, albumID string) string {
+		switch set {
+		case stingle.GallerySet:
+			return "Gallery"
+		case stingle.TrashSet:
+			return "Trash"
+		default:
+			return "Album " + albumID
 		}
-		hdr[4] |= 0x40 // padded
-
-		maxPadding := 64 * 1024
-		if hdr[4]&0x04 != 0 { // raw bytes (blob)
-			maxPadding = 1024 * 1024
+	}
+	if dryRun {
+		fmt.Println("Dry run. Nothing was changed.")
+	}
+	fmt.Printf("Snapshot:        %s\n", report.Snapshot)
+	fmt.Printf("Restored files:  %d\n", report.RestoredFiles)
+	fmt.Printf("Removed files:   %d\n", report.RemovedFiles)
+	fmt.Printf("Restored albums: %d %s\n", len(report.RestoredAlbums), strings.Join(report.RestoredAlbums, " "))
+	fmt.Printf("Unrecoverable:   %d\n", len(report.Unrecoverable))
+	for _, u := range report.Unrecoverable {
+		if u.File == "" {
+			fmt.Printf("  %s: %s\n", setName(u.Set, u.AlbumID), u.Reason)
+			continue
 		}
+		fmt.Printf("  %s: %s: %s\n", setName(u.Set, u.AlbumID), u.File, u.Reason)
+	}
+	return nil
+}
 
-		newPath := filepath.Join(db.Dir(), newRel)
-		createParent(newPath)
-		out, err := os.OpenFile(newPath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
-		if err != nil {
-			return err
-		}
-		if _, err := out.Write(hdr); err != nil {
-			out.Close()
-			return err
-		}
+func deleteUser(c *cli.Context) error {
+	id := c.Int64("userid")
+	if id <= 0 {
+		return cli.ShowSubcommandHelp(c)
+	}
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	user, err := db.UserByID(id)
+	if err != nil {
+		return err
+	}
+	report, err := db.DeleteUserDryRun(user)
+	if err != nil {
+		return err
+	}
+	showRemovalReport(report)
+	if c.Bool("dry-run") {
+		return nil
+	}
+	if ans := prompt(fmt.Sprintf("\nThe account of %s will be deleted.\nType DELETE to continue: ", user.Email)); ans != "DELETE" {
+		log.Fatal("Aborted.")
+	}
+	if err := db.DeleteUser(user); err != nil {
+		return err
+	}
+	log.Infof("Deleted user %d", id)
+	return nil
+}
 
-		k2, err := mk2.NewKey()
-		if err != nil {
-			out.Close()
-			return err
-		}
-		defer k2.Wipe()
-		if err := k2.WriteEncryptedKey(out); err != nil {
-			out.Close()
-			return err
-		}
-		w, err := k2.StartWriter(context(newRel), out)
+func undeleteFiles(c *cli.Context) error {
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	id := c.Int64("userid")
+	if id <= 0 {
+		return cli.ShowSubcommandHelp(c)
+	}
+	user, err := db.UserByID(id)
+	if err != nil {
+		return err
+	}
+	var since int64
+	if t := c.Timestamp("since"); t != nil {
+		since = t.UnixMilli()
+	}
+	if c.Bool("list") {
+		pending, err := db.PendingPurges(user)
 		if err != nil {
-			out.Close()
-			return err
-		}
-		if _, err := w.Write(hdr); err != nil {
-			out.Close()
-			return err
-		}
-		if err := secure.AddPadding(w, maxPadding); err != nil {
-			return err
-		}
-		var buf [4096]byte
-		for {
-			n, err := r.Read(buf[:])
-			if n > 0 {
-				if _, err := w.Write(buf[:n]); err != nil {
-					w.Close()
-					return err
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				w.Close()
-				return err
-			}
-		}
-		if err := w.Close(); err != nil {
 			return err
 		}
-		if err := os.Rename(newPath+".tmp", newPath); err != nil {
-			return err
-		}
-		if oldPath != newPath {
-			if err := os.Remove(oldPath); err != nil {
-				return err
+		for _, p := range pending {
+			if p.DateDeleted < since {
+				continue
 			}
+			fmt.Printf("%s  %s  %d bytes\n", time.UnixMilli(p.DateDeleted).Format(time.RFC3339), p.Name, p.File.StoreFileSize)
 		}
 		return nil
 	}
-
-	type result struct {
-		path string
-		err  error
+	n, err := db.UndeleteFiles(user, since)
+	if err != nil {
+		return err
 	}
+	log.Infof("Restored %d files to the trash of %s", n, user.Email)
+	return nil
+}
 
-	fileChan := db.FileIterator()
-	errChan := make(chan result)
-	var wg sync.WaitGroup
+func changeMasterKey(c *cli.Context) error {
+	log.Level = flagLogLevel
+	log.Infof("Working on %s", flagDatabase)
 
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func(in <-chan database.DFile, out chan<- result) {
-			defer wg.Done()
-			for path := range in {
-				err := reEncryptFile(path)
-				out <- result{path.RelativePath, err}
-			}
-		}(fileChan, errChan)
+	pp, err := passphrase()
+	if err != nil {
+		return err
 	}
-
-	go func() {
-		wg.Wait()
-		close(errChan)
-	}()
-
-	errCount := 0
-	doneCount := 0
-	for res := range errChan {
-		if res.err != nil {
-			errCount++
-			log.Infof("%s: %v", res.path, res.err)
-			continue
-		}
-		doneCount++
-		if doneCount%100 == 0 {
-			log.Infof("%d done", doneCount)
-		}
+	alg, err := crypto.ParseAlgo(c.String("format"))
+	if err != nil {
+		log.Fatalf("Invalid format %q", c.String("format"))
 	}
-	log.Infof("%d done", doneCount)
-	if errCount == 0 {
-		log.Info("All files re-encrypted successfully")
-	} else {
-		log.Infof("Re-encryption error count: %d", errCount)
+
+	if database.ReEncryptInProgress(flagDatabase) {
+		log.Info("Resuming the interrupted re-encryption. The --format flag is ignored.")
+	} else if ans := prompt("\nMake sure you have a backup of the database before proceeding.\nType CHANGE-MASTER-KEY to continue: "); ans != "CHANGE-MASTER-KEY" {
+		log.Fatal("Aborted.")
 	}
 
-	if err := os.Rename(mkFile+".new", mkFile); err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	opts := database.ReEncryptOptions{
+		Algorithm:      alg,
+		BytesPerSecond: c.Int("rate-limit") << 20,
+		Workers:        c.Int("workers"),
+	}
+	if err := database.ReEncrypt(ctx, flagDatabase, pp, opts); err != nil {
+		log.Errorf("Re-encryption stopped: %v", err)
+		log.Info("Run the same command again to resume.")
 		return err
 	}
-	db.Wipe()
-	db = database.New(flagDatabase, pp)
-	defer db.Wipe()
-	uids, err := db.UserIDs()
+	return nil
+}
+
+func rotateTokenKeys(c *cli.Context) error {
+	db, err := initDB(c)
 	if err != nil {
 		return err
 	}
-	reEncryptString := func(s string) (string, error) {
-		b, err := base64.StdEncoding.DecodeString(s)
-		if err != nil {
-			return "", err
-		}
-		k, err := mk1.Decrypt(b)
-		if err != nil {
-			return "", err
-		}
-		e, err := mk2.Encrypt(k)
-		if err != nil {
-			return "", err
+	uids := []int64{c.Int64("userid")}
+	if uids[0] <= 0 {
+		if uids, err = db.UserIDs(); err != nil {
+			return err
 		}
-		return base64.StdEncoding.EncodeToString(e), nil
 	}
 	for _, uid := range uids {
-		u, err := db.UserByID(uid)
-		if err != nil {
-			return err
-		}
-		u.ServerSecretKey, err = reEncryptString(u.ServerSecretKey)
-		if err != nil {
-			return err
-		}
-		u.TokenKey, err = reEncryptString(u.TokenKey)
-		if err != nil {
-			return err
-		}
-		for _, v := range u.Decoys {
-			np, err := reEncryptString(v.Password)
-			if err != nil {
-				return err
-			}
-			v.Password = np
-		}
-		if err := db.UpdateUser(u); err != nil {
+		if err := db.RotateTokenKey(uid); err != nil {
 			return err
 		}
-		log.Infof("Updated user %d", uid)
+		log.Infof("Rotated token key for user %d", uid)
 	}
 	return nil
 }
@@ -688,6 +1050,33 @@ func approveUser(c *cli.Context) error {
 	return db.ApproveUser(id)
 }
 
+func limitedUser(c *cli.Context) error {
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	id := c.Int64("userid")
+	if id <= 0 {
+		return cli.ShowSubcommandHelp(c)
+	}
+	if c.Bool("clear") {
+		return db.SetLimitedAccount(id, nil, nil)
+	}
+	limited := &database.LimitedAccount{}
+	if email := c.String("parent"); email != "" {
+		parent, err := db.User(email)
+		if err != nil {
+			return err
+		}
+		limited.ParentID = parent.UserID
+	}
+	var quota *database.Limit
+	if q := c.Int64("quota"); q >= 0 {
+		quota = &database.Limit{Value: q, Unit: c.String("quota-unit")}
+	}
+	return db.SetLimitedAccount(id, limited, quota)
+}
+
 func renameUser(c *cli.Context) error {
 	db, err := initDB(c)
 	if err != nil {
@@ -796,6 +1185,7 @@ func changeUserOTPKey(c *cli.Context) error {
 			log.Infof("User's OTP Key is not set")
 		} else {
 			user.OTPKey = ""
+			user.OTPBackupCodes = nil
 			changed = true
 		}
 	}
@@ -1018,7 +1408,7 @@ func changePassphrase(c *cli.Context) error {
 	}
 	mkFile := filepath.Join(flagDatabase, "master.key")
 
-	oldPass, err := crypto.Passphrase(flagPassphraseCmd, flagPassphraseFile, flagPassphrase)
+	oldPass, err := passphrase()
 	if err != nil {
 		return err
 	}
@@ -1028,16 +1418,48 @@ func changePassphrase(c *cli.Context) error {
 	}
 	defer mk.Wipe()
 
-	newPass, err := crypto.NewPassphrase(c.String("new-passphrase-command"), c.String("new-passphrase-file"), c.String("new-passphrase"))
-	if err != nil {
-		return err
+	wrappedFile := filepath.Join(flagDatabase, kms.WrappedFile)
+	newPass := oldPass
+	newBackend := c.String("new-masterkey-backend")
+	switch {
+	case newBackend != "" && newBackend != "passphrase":
+		w, err := kms.New(newBackend)
+		if err != nil {
+			return err
+		}
+		if newPass, err = kms.NewPassphrase(w, wrappedFile+".new"); err != nil {
+			return err
+		}
+	case !c.Bool("keep-passphrase"):
+		if newPass, err = crypto.NewPassphrase(c.String("new-passphrase-command"), c.String("new-passphrase-file"), c.String("new-passphrase")); err != nil {
+			return err
+		}
 	}
-	if err := mk.Save(newPass, mkFile+".new"); err != nil {
+	opts := crypto.KDF{
+		Name:   c.String("kdf"),
+		Time:   uint32(c.Uint("kdf-time")),
+		Memory: uint32(c.Uint("kdf-memory")),
+	}
+	if err := mk.SaveWithKDF(newPass, mkFile+".new", opts); err != nil {
 		return err
 	}
 	if err := os.Rename(mkFile+".new", mkFile); err != nil {
 		return err
 	}
-	log.Infof("Passphrase changed successfully [%s].", mkFile)
+	switch {
+	case newBackend != "" && newBackend != "passphrase":
+		if err := os.Rename(wrappedFile+".new", wrappedFile); err != nil {
+			return err
+		}
+	case !c.Bool("keep-passphrase"):
+		if err := os.Remove(wrappedFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	kdf, err := crypto.ReadMasterKeyKDF(mkFile)
+	if err != nil {
+		return err
+	}
+	log.Infof("Passphrase changed successfully [%s] (%s).", mkFile, kdf.Name)
 	return nil
 }
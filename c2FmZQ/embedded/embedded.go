@@ -0,0 +1,210 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package embedded runs a c2FmZQ server inside another Go program, e.g. a NAS
+// app, without executing the c2FmZQ-server binary.
+//
+//	s, err := embedded.New(embedded.Options{
+//		DataDir:    "/var/lib/c2FmZQ",
+//		Passphrase: passphrase,
+//		Address:    "127.0.0.1:8080",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := s.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer s.Stop(ctx)
+//
+// Alternatively, the server's http.Handler can be added to an existing HTTP
+// server with Handler, in which case Start and Stop aren't used.
+package embedded
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/server"
+)
+
+// Mailer sends email messages, e.g. the usage reports and the shared album
+// digests.
+type Mailer = server.Mailer
+
+// Locker coordinates updates to the metadata files when multiple server
+// instances share the same data directory.
+type Locker = secure.Locker
+
+// BlobStore stores the content of the files and thumbnails outside of the data
+// directory, e.g. in an object store.
+type BlobStore = secure.BlobStore
+
+// Options contains the settings of an embedded server. Only DataDir is
+// required.
+type Options struct {
+	// DataDir is the directory where the data is stored.
+	DataDir string
+	// Passphrase is used to encrypt the metadata. When it is empty, the
+	// metadata isn't encrypted. It can't change after the data directory
+	// is created.
+	Passphrase []byte
+	// Address is the address that Start listens on, e.g. "127.0.0.1:8080".
+	// It isn't used with Listener or Handler.
+	Address string
+	// Listener, when set, is used by Start instead of Address.
+	Listener net.Listener
+	// TLSConfig, when set, is used to serve HTTPS instead of HTTP.
+	TLSConfig *tls.Config
+	// PathPrefix is the prefix of the API endpoints, e.g. "/c2FmZQ".
+	PathPrefix string
+	// BaseURL is the base URL of the generated download links. When empty,
+	// the links use the Host headers of the incoming requests.
+	BaseURL string
+	// AllowCreateAccount allows new account registrations.
+	AllowCreateAccount bool
+	// AutoApproveNewAccounts lets new accounts be used without an admin's
+	// approval.
+	AutoApproveNewAccounts bool
+	// FirstRunSetup requires a setup token to create the first account,
+	// see SetupToken.
+	FirstRunSetup bool
+	// SetupToken is the token of the first-run setup. A random token is
+	// logged when it is empty.
+	SetupToken string
+	// EnableWebApp enables the progressive web app.
+	EnableWebApp bool
+	// MaxConcurrentRequests is the maximum number of requests processed
+	// at the same time. The default is 10.
+	MaxConcurrentRequests int
+	// MaxConcurrentUploads is the maximum number of uploads processed at
+	// the same time. The default is 5.
+	MaxConcurrentUploads int
+	// Mailer is used to send email messages. It is optional.
+	Mailer Mailer
+	// Locker is used instead of lock files in the data directory, when
+	// set.
+	Locker Locker
+	// BlobStore is used instead of the data directory for the content of
+	// the files, when set.
+	BlobStore BlobStore
+}
+
+// Server is an embedded c2FmZQ server.
+type Server struct {
+	opts   Options
+	server *server.Server
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	done    chan error
+}
+
+// New opens the data directory and returns a new server. The database is
+// ready to use when New returns.
+func New(opts Options) (*Server, error) {
+	if opts.DataDir == "" {
+		return nil, errors.New("DataDir must be set")
+	}
+	if opts.Listener == nil && opts.Address == "" {
+		opts.Address = "127.0.0.1:8080"
+	}
+	db := database.NewWithOptions(opts.DataDir, opts.Passphrase, database.Options{
+		Locker:    opts.Locker,
+		BlobStore: opts.BlobStore,
+	})
+	s := server.New(db, opts.Address, "", opts.PathPrefix)
+	s.BaseURL = opts.BaseURL
+	s.AllowCreateAccount = opts.AllowCreateAccount
+	s.AutoApproveNewAccounts = opts.AutoApproveNewAccounts
+	s.FirstRunSetup = opts.FirstRunSetup
+	s.SetupToken = opts.SetupToken
+	s.EnableWebApp = opts.EnableWebApp
+	if opts.MaxConcurrentRequests > 0 {
+		s.MaxConcurrentRequests = opts.MaxConcurrentRequests
+	}
+	if opts.MaxConcurrentUploads > 0 {
+		s.MaxConcurrentUploads = opts.MaxConcurrentUploads
+	}
+	s.Mailer = opts.Mailer
+	return &Server{opts: opts, server: s}, nil
+}
+
+// Handler returns the server's http.Handler, for programs that run their own
+// HTTP server. It must not be used with Start.
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler()
+}
+
+// Start starts serving in the background. It returns when the server is
+// listening, or when ctx is done. The context only applies to the startup. A
+// server can only be started once.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	l := s.opts.Listener
+	if l == nil {
+		var lc net.ListenConfig
+		var err error
+		if l, err = lc.Listen(ctx, "tcp", s.opts.Address); err != nil {
+			return err
+		}
+	}
+	if s.opts.TLSConfig != nil {
+		l = tls.NewListener(l, s.opts.TLSConfig)
+	}
+	s.started = true
+	s.done = make(chan error, 1)
+	go func() {
+		err := s.server.Serve(l)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		s.done <- err
+	}()
+	return nil
+}
+
+// Stop stops the server that was started with Start. It waits for the active
+// requests to finish, or until ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started || s.stopped {
+		return errors.New("server not running")
+	}
+	s.stopped = true
+	if err := s.server.ShutdownContext(ctx); err != nil {
+		return err
+	}
+	select {
+	case err := <-s.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
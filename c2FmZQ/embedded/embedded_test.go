@@ -0,0 +1,81 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package embedded_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/embedded"
+	"c2FmZQ/internal/log"
+)
+
+func TestStartStop(t *testing.T) {
+	log.Record = t.Log
+	defer func() { log.Record = nil }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	s, err := embedded.New(embedded.Options{
+		DataDir:    filepath.Join(t.TempDir(), "data"),
+		Passphrase: []byte("foo"),
+		Listener:   l,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := s.Start(ctx); err == nil {
+		t.Error("Start succeeded twice")
+	}
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/v2x/health")
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("StatusCode = %d, want %d", got, want)
+	}
+
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := s.Stop(ctx); err == nil {
+		t.Error("Stop succeeded twice")
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/v2x/health"); err == nil {
+		t.Error("http.Get succeeded after Stop")
+	}
+}
+
+func TestNewWithoutDataDir(t *testing.T) {
+	if _, err := embedded.New(embedded.Options{}); err == nil {
+		t.Error("New succeeded without DataDir")
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/go-test/deep v1.0.7
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jamesruan/sodium v1.0.14
+	github.com/klauspost/compress v1.15.12
 	github.com/mattn/go-shellwords v1.0.12
 	github.com/mdp/qrterminal v1.0.1
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1
@@ -22,6 +23,7 @@ require (
 	github.com/urfave/cli/v2 v2.23.7
 	golang.org/x/crypto v0.4.0
 	golang.org/x/image v0.2.0
+	golang.org/x/net v0.4.0
 	golang.org/x/sys v0.3.0
 	golang.org/x/term v0.3.0
 	golang.org/x/time v0.3.0
@@ -41,7 +43,6 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
-	golang.org/x/net v0.4.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	rsc.io/qr v0.2.0 // indirect
@@ -0,0 +1,107 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/url"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// ActivityEntry is an event in the account activity log.
+type ActivityEntry struct {
+	// The time of the event, in milliseconds.
+	Date int64 `json:"date"`
+	// The type of event, e.g. login, share, or delete-files.
+	Type string `json:"type"`
+	// A human readable description of the event.
+	Detail string `json:"detail,omitempty"`
+}
+
+// AccountActivity returns the activity log of our account, oldest first.
+func (c *Client) AccountActivity() ([]ActivityEntry, error) {
+	sr, err := c.sendActivityRequest(OutputJSON)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ActivityEntry
+	if err := copyJSON(sr.Part("activity"), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExportAccountActivity returns the activity log of our account as CSV text,
+// as produced by the server.
+func (c *Client) ExportAccountActivity() (string, error) {
+	sr, err := c.sendActivityRequest(OutputCSV)
+	if err != nil {
+		return "", err
+	}
+	var csv string
+	if err := copyJSON(sr.Part("csv"), &csv); err != nil {
+		return "", err
+	}
+	return csv, nil
+}
+
+// ShowAccountActivity shows the activity log of our account, e.g. logins,
+// shares, and deletions, in the current output format.
+func (c *Client) ShowAccountActivity() error {
+	if c.output == OutputCSV {
+		csv, err := c.ExportAccountActivity()
+		if err != nil {
+			return err
+		}
+		_, err = c.writer.Write([]byte(csv))
+		return err
+	}
+	entries, err := c.AccountActivity()
+	if err != nil {
+		return err
+	}
+	if c.output == OutputJSON {
+		return c.writeRecords(entries, nil, nil)
+	}
+	if len(entries) == 0 {
+		c.Print("No activity.")
+		return nil
+	}
+	for _, e := range entries {
+		c.Printf("%s %-13s %s\n", time.UnixMilli(e.Date).Format("2006-01-02 15:04:05"), e.Type, e.Detail)
+	}
+	return nil
+}
+
+func (c *Client) sendActivityRequest(format string) (*stingle.Response, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("format", format)
+	sr, err := c.sendRequest("/v2x/config/activity", form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
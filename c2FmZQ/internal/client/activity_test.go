@@ -0,0 +1,127 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestAccountActivity(t *testing.T) {
+	alice, url, done := startServer(t)
+	defer done()
+	if err := alice.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("alice.CreateAccount: %v", err)
+	}
+	bob, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := bob.CreateAccount(url, "bob@", "pass", true); err != nil {
+		t.Fatalf("bob.CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := alice.AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("alice.AddAlbums: %v", err)
+	}
+	if _, err := alice.ImportFiles([]string{filepath.Join(testdir, "*")}, "alpha", false); err != nil {
+		t.Fatalf("alice.ImportFiles: %v", err)
+	}
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	alice.SetPrompt(func(string) (string, error) { return "YES", nil })
+	if err := alice.Share("alpha", []string{"bob@"}, nil); err != nil {
+		t.Fatalf("alice.Share: %v", err)
+	}
+	if err := alice.Unshare([]string{"alpha"}); err != nil {
+		t.Fatalf("alice.Unshare: %v", err)
+	}
+	if err := alice.Delete([]string{"alpha/*"}, false); err != nil {
+		t.Fatalf("alice.Delete: %v", err)
+	}
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	if err := alice.Delete([]string{".trash/*"}, false); err != nil {
+		t.Fatalf("alice.Delete: %v", err)
+	}
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	if err := alice.Logout(); err != nil {
+		t.Fatalf("alice.Logout: %v", err)
+	}
+	if err := alice.Login(url, "alice@", "wrong"); err == nil {
+		t.Fatal("alice.Login succeeded with the wrong password")
+	}
+	if err := alice.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("alice.Login: %v", err)
+	}
+
+	entries, err := alice.AccountActivity()
+	if err != nil {
+		t.Fatalf("alice.AccountActivity: %v", err)
+	}
+	var types []string
+	for _, e := range entries {
+		types = append(types, e.Type)
+	}
+	want := []string{"login", "share", "unshare", "delete-files", "login-failed", "login"}
+	if got := types; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected activity. Want %v, got %v", want, got)
+	}
+
+	if err := alice.SetOutputFormat(client.OutputCSV); err != nil {
+		t.Fatalf("alice.SetOutputFormat: %v", err)
+	}
+	var buf bytes.Buffer
+	alice.SetWriter(&buf)
+	if err := alice.ShowAccountActivity(); err != nil {
+		t.Fatalf("alice.ShowAccountActivity: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("csv.ReadAll: %v", err)
+	}
+	if len(rows) != len(want)+1 || !reflect.DeepEqual(rows[0], []string{"date", "type", "detail"}) {
+		t.Fatalf("Unexpected CSV: %q", rows)
+	}
+	for i, row := range rows[1:] {
+		if row[1] != want[i] {
+			t.Errorf("CSV row %d: type = %q, want %q", i, row[1], want[i])
+		}
+	}
+
+	entries, err = bob.AccountActivity()
+	if err != nil {
+		t.Fatalf("bob.AccountActivity: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Type != "login" {
+		t.Errorf("Unexpected activity for bob: %+v", entries)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -41,21 +42,36 @@ import (
 )
 
 const (
-	configFile   = "config"
-	galleryFile  = "gallery"
-	trashFile    = "trash"
-	albumList    = "albums"
-	albumPrefix  = "album/"
-	contactsFile = "contacts"
-	cacheFile    = "autocert-cache.dat"
+	configFile       = "config"
+	galleryFile      = "gallery"
+	trashFile        = "trash"
+	albumList        = "albums"
+	albumPrefix      = "album/"
+	contactsFile     = "contacts"
+	cacheFile        = "autocert-cache.dat"
+	pendingFile      = "pending"
+	versionsFile     = "versions"
+	mirrorFile       = "mirror"
+	fingerprintsFile = "fingerprints"
+	watchFile        = "watch"
 
 	userAgent = "Dalvik/2.1.0 (Linux; U; Android 9; moto x4 Build/PPWS29.69-39-6-4)"
 )
 
 var (
 	ErrNotLoggedIn = errors.New("not logged in")
+	ErrUnreachable = errors.New("server unreachable")
+
+	// RetryDelay is the delay before the first retry of a request that
+	// failed because of a network error. It doubles with each retry.
+	RetryDelay = 500 * time.Millisecond
+	// MaxRetryAfter is the longest delay before a retry that the client
+	// accepts from the server's Retry-After header.
+	MaxRetryAfter = 2 * time.Minute
 )
 
+const maxAttempts = 3
+
 // Create creates a new client configuration, if one doesn't exist already.
 func Create(m crypto.MasterKey, s *secure.Storage) (*Client, error) {
 	var c Client
@@ -87,7 +103,12 @@ func Load(m crypto.MasterKey, s *secure.Storage) (*Client, error) {
 	if c.WebServerConfig == nil {
 		c.WebServerConfig = NewWebServerConfig()
 	}
-	c.hc = &http.Client{}
+	hc, err := newHTTPClient(c.ProxyURL)
+	if err != nil {
+		log.Errorf("Ignoring proxy %s: %v", redactedProxyURL(c.ProxyURL), err)
+		hc = &http.Client{}
+	}
+	c.hc = hc
 	c.writer = os.Stdout
 	c.prompt = prompt
 	c.createEmptyFiles()
@@ -99,12 +120,27 @@ type Client struct {
 	Account         *AccountInfo     `json:"accountInfo"`
 	WebServerConfig *WebServerConfig `json:"webServerConfig"`
 	LocalSecretKey  []byte           `json:"localSecretKey"`
-
-	hc *http.Client
+	// ProxyURL is the proxy used to connect to the server. See SetProxy.
+	ProxyURL string `json:"proxyURL,omitempty"`
+	// SyncSchedule restricts when scheduled syncs upload files. See
+	// SetSyncSchedule.
+	SyncSchedule *SyncSchedule `json:"syncSchedule,omitempty"`
+	// WatchDirs are the local directories that Watch monitors. See
+	// AddWatchDir.
+	WatchDirs []WatchDir `json:"watchDirs,omitempty"`
+
+	hc            *http.Client
+	isMetered     func() (bool, error)
+	downloadConns int
+	transfers     int
+	// pollInterval is the minimum time before the next update check
+	// suggested by the server. See PollInterval.
+	pollInterval time.Duration
 
 	masterKey crypto.MasterKey
 	storage   *secure.Storage
 	writer    io.Writer
+	output    string
 	prompt    func(msg string) (string, error)
 }
 
@@ -119,6 +155,10 @@ type AccountInfo struct {
 	UserID          int64             `json:"userID"`
 	ServerPublicKey stingle.PublicKey `json:"serverPublicKey"`
 	Token           string            `json:"token"`
+	LastSync        int64             `json:"lastSync,omitempty"`
+	// Storage is the storage usage reported by the server on login and
+	// with each update.
+	Storage *StorageUsage `json:"storage,omitempty"`
 }
 
 // NewWebServerConfig returns a new WebServerConfig with default values.
@@ -192,22 +232,6 @@ func (c *Client) SKForAlbum(a *stingle.Album) (*stingle.SecretKey, error) {
 	return sk, nil
 }
 
-// Status returns the client's current status.
-func (c *Client) Status() error {
-	if c.Account == nil {
-		c.Print("Not logged in.")
-	} else {
-		c.Printf("Logged in as %s on %s.\n", c.Account.Email, c.Account.ServerBaseURL)
-		if c.Account.IsBackedUp {
-			c.Printf("Secret key is backed up.\n")
-		} else {
-			c.Printf("Secret key is NOT backed up.\n")
-		}
-	}
-	c.Printf("Public key: % X\n", c.PublicKey().ToBytes())
-	return nil
-}
-
 func (c *Client) encryptSK(sk *stingle.SecretKey) []byte {
 	defer sk.Wipe()
 	b, err := c.masterKey.Encrypt(sk.ToBytes())
@@ -237,8 +261,12 @@ func (c *Client) Print(args ...interface{}) {
 	fmt.Fprintln(c.writer, args...)
 }
 
+func nowInMS() int64 {
+	return time.Now().UnixNano() / 1000000
+}
+
 func nowString() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano()/1000000)
+	return fmt.Sprintf("%d", nowInMS())
 }
 
 func nowJSON() json.Number {
@@ -271,13 +299,7 @@ func (c *Client) sendRequest(uri string, form url.Values, server string) (*sting
 	log.Debugf("SEND POST %s", url)
 	log.Debugf(" %v", form)
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := c.hc.Do(req)
+	resp, err := c.postWithRetry(url, form.Encode())
 	if err != nil {
 		return nil, err
 	}
@@ -314,6 +336,68 @@ func (c *Client) sendRequest(uri string, form url.Values, server string) (*sting
 	return &sr, nil
 }
 
+// postWithRetry sends a POST request, retrying when the server can't be
+// reached, returns a server error, or asks to retry later. When the server
+// sets a Retry-After header, it is used instead of the exponential delay.
+// When the server can't be reached after all the attempts, the returned error
+// wraps ErrUnreachable.
+func (c *Client) postWithRetry(url, body string) (*http.Response, error) {
+	delay := RetryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := c.hc.Do(req)
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if attempt >= maxAttempts {
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+			}
+			return resp, nil
+		}
+		wait := delay
+		if err != nil {
+			log.Debugf("POST %s failed: %v (attempt %d)", url, err, attempt)
+		} else {
+			log.Debugf("POST %s returned status code %d (attempt %d)", url, resp.StatusCode, attempt)
+			if d := retryAfter(resp); d > 0 {
+				wait = d
+			}
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// retryAfter returns the delay requested by the server with the Retry-After
+// header, in seconds, capped at MaxRetryAfter. It returns 0 when there is no
+// valid header.
+func retryAfter(resp *http.Response) time.Duration {
+	n, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if d := time.Duration(n) * time.Second; d < MaxRetryAfter {
+		return d
+	}
+	return MaxRetryAfter
+}
+
+// PollInterval returns how long to wait before the next update check. It is
+// def, or the longer interval suggested by the server with the last updates.
+func (c *Client) PollInterval(def time.Duration) time.Duration {
+	if c.pollInterval > def {
+		return c.pollInterval
+	}
+	return def
+}
+
 func (c *Client) download(file, set, thumb string) (io.ReadCloser, error) {
 	if c.Account == nil {
 		return nil, ErrNotLoggedIn
@@ -351,11 +435,21 @@ func (c *Client) download(file, set, thumb string) (io.ReadCloser, error) {
 
 // DownloadGet returns a seekable download stream for the remote file.
 func (c *Client) DownloadGet(file, set string, thumb bool) (*SeekDownloader, error) {
+	url, err := c.downloadURL(file, set, thumb)
+	if err != nil {
+		return nil, err
+	}
+	return &SeekDownloader{hc: c.hc, url: url}, nil
+}
+
+// downloadURL returns a signed URL that can be used to download the remote
+// file with HTTP GET.
+func (c *Client) downloadURL(file, set string, thumb bool) (string, error) {
 	if c.Account == nil {
-		return nil, ErrNotLoggedIn
+		return "", ErrNotLoggedIn
 	}
 	if c.Account.ServerBaseURL == "" {
-		return nil, errors.New("ServerBaseURL is not set")
+		return "", errors.New("ServerBaseURL is not set")
 	}
 	form := url.Values{}
 	form.Set("token", c.Account.Token)
@@ -366,16 +460,16 @@ func (c *Client) DownloadGet(file, set string, thumb bool) (*SeekDownloader, err
 	}
 	sr, err := c.sendRequest("/v2/sync/getUrl", form, "")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if sr.Status != "ok" {
-		return nil, sr
+		return "", sr
 	}
 	url, ok := sr.Part("url").(string)
 	if !ok {
-		return nil, fmt.Errorf("server did not return a url: %v", sr.Part("url"))
+		return "", fmt.Errorf("server did not return a url: %v", sr.Part("url"))
 	}
-	return &SeekDownloader{hc: c.hc, url: url}, nil
+	return url, nil
 }
 
 // SeekDownloader uses HTTP GET with a Range header to make the download
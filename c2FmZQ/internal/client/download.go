@@ -0,0 +1,213 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// minDownloadPartSize is the smallest byte range that is fetched with its own
+// request when a file is downloaded with several connections.
+const minDownloadPartSize = 1 << 20
+
+var contentRangeRE = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// SetDownloadConnections sets the number of connections used to download
+// each file. When n is more than 1, files that are larger than 1 MiB are
+// split into byte ranges that are downloaded in parallel, and the file is
+// verified after it is reassembled. This can make downloads much faster on
+// links with a high latency. The setting only applies to the current
+// session.
+func (c *Client) SetDownloadConnections(n int) {
+	c.downloadConns = n
+}
+
+// parallelDownload downloads the content of a file using several connections
+// at the same time, each one fetching a different byte range. The first range
+// also tells us the size of the file and its ETag, which is used to make sure
+// that all the ranges come from the same file.
+func (c *Client) parallelDownload(li ListItem, fn string) error {
+	url, err := c.downloadURL(li.FSFile.File, li.Set, false)
+	if err != nil {
+		return err
+	}
+	tmp := fn + "-parallel"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	n, size, etag, err := c.downloadRange(url, "", f, 0, minDownloadPartSize-1)
+	if err != nil {
+		return err
+	}
+	partSize := (size - n + int64(c.downloadConns) - 1) / int64(c.downloadConns)
+	if partSize < minDownloadPartSize {
+		partSize = minDownloadPartSize
+	}
+	var parts [][2]int64
+	for off := n; off < size; off += partSize {
+		end := off + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		parts = append(parts, [2]int64{off, end})
+	}
+	log.Debugf("Downloading %s in %d parts", li.Filename, len(parts)+1)
+
+	ch := make(chan [2]int64)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < c.downloadConns && i < len(parts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				if _, _, _, err := c.downloadRange(url, etag, f, p[0], p[1]); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range parts {
+		ch <- p
+	}
+	close(ch)
+	wg.Wait()
+	if errs != nil {
+		return errs[0]
+	}
+
+	if err := c.verifyBlob(li, f, size); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// downloadRange downloads the byte range start-end of url and writes it at the
+// same offset in f. When etag is set, the range must come from the file with
+// this ETag. It returns the number of bytes received, the size of the file,
+// and its ETag. When the server doesn't support ranges, the whole file is
+// received with the first range.
+func (c *Client) downloadRange(url, etag string, f *os.File, start, end int64) (n, size int64, respETag string, err error) {
+	log.Debugf("SEND GET %v range: %d-%d", url, start, end)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+	respETag = resp.Header.Get("ETag")
+
+	if resp.StatusCode == http.StatusOK && start == 0 && etag == "" {
+		n, err := io.Copy(&offsetWriter{f: f}, resp.Body)
+		return n, n, respETag, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, "", fmt.Errorf("request returned status code %d for range %d-%d", resp.StatusCode, start, end)
+	}
+	if etag != "" && respETag != etag {
+		return 0, 0, "", fmt.Errorf("file changed during download: etag %q != %q", respETag, etag)
+	}
+	m := contentRangeRE.FindStringSubmatch(resp.Header.Get("Content-Range"))
+	if m == nil {
+		return 0, 0, "", fmt.Errorf("invalid content-range %q", resp.Header.Get("Content-Range"))
+	}
+	rStart, _ := strconv.ParseInt(m[1], 10, 64)
+	rEnd, _ := strconv.ParseInt(m[2], 10, 64)
+	size, _ = strconv.ParseInt(m[3], 10, 64)
+	if end >= size {
+		end = size - 1
+	}
+	if rStart != start || rEnd != end {
+		return 0, 0, "", fmt.Errorf("unexpected content-range %q for range %d-%d", m[0], start, end)
+	}
+	if n, err = io.CopyN(&offsetWriter{f: f, off: start}, resp.Body, end-start+1); err != nil {
+		return 0, 0, "", err
+	}
+	return n, size, respETag, nil
+}
+
+// verifyBlob checks that the reassembled blob file can be decrypted and that
+// it has the expected size. Each chunk is authenticated when it is decrypted,
+// so any byte that was corrupted or misplaced is detected.
+func (c *Client) verifyBlob(li ListItem, f *os.File, size int64) error {
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() != size {
+		return fmt.Errorf("downloaded %d bytes, expected %d", fi.Size(), size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := stingle.SkipHeader(f); err != nil {
+		return err
+	}
+	sk := c.SecretKey()
+	hdr, err := li.Header(sk)
+	sk.Wipe()
+	if err != nil {
+		return err
+	}
+	defer hdr.Wipe()
+	n, err := io.Copy(io.Discard, stingle.DecryptFile(f, hdr))
+	if err != nil {
+		return fmt.Errorf("verification of %s failed: %w", li.Filename, err)
+	}
+	if n != hdr.DataSize {
+		return fmt.Errorf("verification of %s failed: decrypted %d bytes, expected %d", li.Filename, n, hdr.DataSize)
+	}
+	return nil
+}
+
+// offsetWriter writes to f at increasing offsets.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestParallelDownload(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	fn := filepath.Join(testdir, "data.bin")
+	content := make([]byte, 5<<20+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	if err := os.WriteFile(fn, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{fn}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	c.SetDownloadConnections(4)
+
+	// A corrupted range is detected when the file is reassembled.
+	c.SetHTTPClient(&http.Client{Transport: &rangeTransport{rt: hc.Transport, corrupt: true}})
+	if n, err := c.Pull([]string{"gallery/*"}, client.GlobOptions{}); err == nil {
+		t.Fatalf("c.Pull() = %d, %v, want error", n, err)
+	}
+	if li, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{}); err != nil || len(li) != 1 || !li[0].RemoteOnly {
+		t.Fatalf("Corrupted file was saved: %v, %v", li, err)
+	}
+
+	rt := &rangeTransport{rt: hc.Transport}
+	c.SetHTTPClient(&http.Client{Transport: rt})
+	if n, err := c.Pull([]string{"gallery/*"}, client.GlobOptions{}); err != nil || n != 1 {
+		t.Fatalf("c.Pull() = %d, %v, want 1, nil", n, err)
+	}
+	if want := 5; rt.ranges != want {
+		t.Errorf("Unexpected number of ranges. Got %d, want %d", rt.ranges, want)
+	}
+	c.SetHTTPClient(hc)
+
+	exportDir := filepath.Join(testdir, "export")
+	if err := os.Mkdir(exportDir, 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, true); err != nil || n != 1 {
+		t.Fatalf("c.ExportFiles() = %d, %v", n, err)
+	}
+	got, err := os.ReadFile(filepath.Join(exportDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("Exported file doesn't match the original")
+	}
+}
+
+// rangeTransport counts the range requests, and optionally corrupts the
+// responses to the ranges that don't start at 0.
+type rangeTransport struct {
+	rt      http.RoundTripper
+	corrupt bool
+	mu      sync.Mutex
+	ranges  int
+}
+
+func (t *rangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		return resp, err
+	}
+	t.mu.Lock()
+	t.ranges++
+	t.mu.Unlock()
+	if t.corrupt && req.Header.Get("If-Range") != "" {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b[len(b)/2] ^= 0xff
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	return resp, nil
+}
@@ -19,10 +19,18 @@ package client_test
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/tyler-smith/go-bip39"
@@ -179,6 +187,308 @@ func TestImportExportSync(t *testing.T) {
 	}
 }
 
+func TestMetadataOnlySync(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT CreateAccount")
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 5); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	t.Log("CLIENT2 Login")
+	c2, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c2.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	var buf bytes.Buffer
+	c2.SetWriter(&buf)
+	if err := c2.Sync(false); err != nil {
+		t.Fatalf("c2.Sync: %v", err)
+	}
+	if want, got := "5 of 5 files are remote-only", buf.String(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected sync output. Want %q, got %q", want, got)
+	}
+	buf.Reset()
+	if err := c2.ListFiles([]string{"gallery/image000.jpg"}, client.GlobOptions{Long: true}); err != nil {
+		t.Fatalf("c2.ListFiles: %v", err)
+	}
+	if got := buf.String(); !strings.HasSuffix(got, " Remote\n") {
+		t.Errorf("Unexpected list output: %q", got)
+	}
+
+	t.Log("CLIENT2 Pull gallery/image000.jpg")
+	if n, err := c2.Pull([]string{"gallery/image000.jpg"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c2.Pull: %v", err)
+	} else if want, got := 1, n; want != got {
+		t.Errorf("Unexpected Pull result. Want %d, got %d", want, got)
+	}
+	total, remote, err := c2.RemoteOnlyCount()
+	if err != nil {
+		t.Fatalf("c2.RemoteOnlyCount: %v", err)
+	}
+	if total != 5 || remote != 4 {
+		t.Errorf("RemoteOnlyCount() = %d, %d, want 5, 4", total, remote)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	si, err := c.StatusInfo()
+	if err != nil {
+		t.Fatalf("c.StatusInfo: %v", err)
+	}
+	if si.Email != "alice@" || si.ServerURL != url || si.LastSync != 0 {
+		t.Errorf("Unexpected account status: %+v", si)
+	}
+	if si.Files != 3 || si.LocalOnlyFiles != 3 || si.RemoteOnlyFiles != 0 || si.PendingUploads != 3 || si.CacheSize == 0 || si.InSync {
+		t.Errorf("Unexpected file status: %+v", si)
+	}
+
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"gallery/image000.jpg"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+	if err := c.SetOutputFormat(client.OutputJSON); err != nil {
+		t.Fatalf("c.SetOutputFormat: %v", err)
+	}
+	if err := c.Status(); err != nil {
+		t.Fatalf("c.Status: %v", err)
+	}
+	si = &client.StatusInfo{}
+	if err := json.Unmarshal(buf.Bytes(), si); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+	}
+	if si.LastSync == 0 {
+		t.Errorf("LastSync not set: %+v", si)
+	}
+	if si.Files != 3 || si.LocalOnlyFiles != 0 || si.RemoteOnlyFiles != 1 || si.PendingUploads != 0 || !si.InSync {
+		t.Errorf("Unexpected file status: %+v", si)
+	}
+	if su := si.Storage; su == nil || su.GalleryFiles != 3 || su.SpaceUsed == 0 || su.Quota == 0 {
+		t.Errorf("Unexpected storage usage: %+v", su)
+	}
+
+	buf.Reset()
+	if err := c.SetOutputFormat(client.OutputCSV); err != nil {
+		t.Fatalf("c.SetOutputFormat: %v", err)
+	}
+	if err := c.Status(); err != nil {
+		t.Fatalf("c.Status: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("csv.ReadAll(%q): %v", buf.String(), err)
+	}
+	if len(rows) != 2 || len(rows[0]) != len(rows[1]) {
+		t.Fatalf("Unexpected CSV status: %q", rows)
+	}
+	status := make(map[string]string)
+	for i, h := range rows[0] {
+		status[h] = rows[1][i]
+	}
+	if status["email"] != "alice@" || status["files"] != "3" || status["galleryFiles"] != "3" || status["inSync"] != "true" {
+		t.Errorf("Unexpected CSV status: %v", status)
+	}
+}
+
+func TestSyncMachineOutput(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.SetOutputFormat(client.OutputJSON); err != nil {
+		t.Fatalf("SetOutputFormat: %v", err)
+	}
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+
+	sync := func(dryrun bool) client.SyncRecord {
+		t.Helper()
+		buf.Reset()
+		if err := c.Sync(dryrun); err != nil {
+			t.Fatalf("c.Sync(%v): %v", dryrun, err)
+		}
+		var rec client.SyncRecord
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+		}
+		return rec
+	}
+	rec := sync(true)
+	if !rec.DryRun || rec.Synced || len(rec.AlbumsToCreate) != 1 || len(rec.FilesToUpload) != 2 {
+		t.Fatalf("Unexpected dry-run record: %+v", rec)
+	}
+	albumID := rec.AlbumsToCreate[0].AlbumID
+	if rec.AlbumsToCreate[0].Name != "album" || albumID == "" {
+		t.Errorf("Unexpected album record: %+v", rec.AlbumsToCreate[0])
+	}
+	// The files are uploaded in no particular order.
+	sort.Slice(rec.FilesToUpload, func(i, j int) bool {
+		return rec.FilesToUpload[i].Path < rec.FilesToUpload[j].Path
+	})
+	for i, f := range rec.FilesToUpload {
+		if want := fmt.Sprintf("album/image%03d.jpg", i); f.Path != want || f.AlbumID != albumID || f.Size <= 0 || f.Created == "" {
+			t.Errorf("Unexpected file record: %+v, want path %q in album %q", f, want, albumID)
+		}
+	}
+
+	rec = sync(false)
+	if rec.DryRun || !rec.Synced || rec.LastSync == "" || len(rec.FilesToUpload) != 2 || rec.Files != 2 {
+		t.Errorf("Unexpected sync record: %+v", rec)
+	}
+	rec = sync(false)
+	if !rec.Synced || len(rec.AlbumsToCreate) != 0 || len(rec.FilesToUpload) != 0 {
+		t.Errorf("Unexpected sync record: %+v", rec)
+	}
+
+	buf.Reset()
+	if err := c.ListFiles([]string{"album"}, client.GlobOptions{Directory: true}); err != nil {
+		t.Fatalf("c.ListFiles: %v", err)
+	}
+	var records []client.FileRecord
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+	}
+	if len(records) != 1 || records[0].AlbumID != albumID {
+		t.Errorf("Unexpected list records: %+v", records)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT CreateAccount")
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+
+	// The first download is interrupted after 100 bytes.
+	ft := &flakyTransport{rt: hc.Transport, failAfter: 100}
+	c.SetHTTPClient(&http.Client{Transport: ft})
+	t.Log("CLIENT Pull gallery/*")
+	if n, err := c.Pull([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Pull: %v", err)
+	} else if want, got := 1, n; want != got {
+		t.Errorf("Unexpected Pull result. Want %d, got %d", want, got)
+	}
+	if diff := deep.Equal([]string{"", "bytes=100-"}, ft.ranges); diff != nil {
+		t.Errorf("Unexpected Range headers: %v", diff)
+	}
+
+	exportDir := filepath.Join(testdir, "export")
+	if err := os.Mkdir(exportDir, 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, true); err != nil {
+		t.Fatalf("c.ExportFiles: %v", err)
+	} else if want, got := 1, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	want, err := os.ReadFile(filepath.Join(testdir, "image000.jpg"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(exportDir, "image000.jpg"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Error("Exported file doesn't match original")
+	}
+}
+
+// flakyTransport interrupts the first file download after failAfter bytes,
+// and records the Range header of all file downloads.
+type flakyTransport struct {
+	rt        http.RoundTripper
+	failAfter int64
+	failed    bool
+	ranges    []string
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/v2/download/") {
+		return t.rt.RoundTrip(req)
+	}
+	t.ranges = append(t.ranges, req.Header.Get("Range"))
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || t.failed {
+		return resp, err
+	}
+	t.failed = true
+	resp.Body = &failingReader{ReadCloser: resp.Body, n: t.failAfter}
+	return resp, nil
+}
+
+type failingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(b)) > r.n {
+		b = b[:r.n]
+	}
+	n, err := r.ReadCloser.Read(b)
+	r.n -= int64(n)
+	return n, err
+}
+
 func TestCopyMoveDeleteFiles(t *testing.T) {
 	c, url, done := startServer(t)
 	defer done()
@@ -864,6 +1174,87 @@ func TestSharing(t *testing.T) {
 	}
 }
 
+func TestOfflineQueue(t *testing.T) {
+	_, url, done := startServer(t)
+	defer done()
+	client.RetryDelay = time.Millisecond
+
+	c := make(map[string]*client.Client)
+	for _, n := range []string{"alice", "bob"} {
+		var err error
+		if c[n], err = newClient(t.TempDir()); err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		if err := c[n].CreateAccount(url, n+"@", n+"-pass", true); err != nil {
+			t.Fatalf("CreateAccount(%s): %v", n, err)
+		}
+	}
+	alice := c["alice"]
+	alice.SetPrompt(func(string) (string, error) { return "YES", nil })
+	if err := alice.AddAlbums([]string{"alpha", "beta"}); err != nil {
+		t.Fatalf("alice.AddAlbums: %v", err)
+	}
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	if err := alice.Share("alpha", []string{"bob@"}, nil); err != nil {
+		t.Fatalf("alice.Share: %v", err)
+	}
+	if err := alice.GetUpdates(false); err != nil {
+		t.Fatalf("alice.GetUpdates: %v", err)
+	}
+
+	t.Log("alice goes offline")
+	alice.Account.ServerBaseURL = "http://127.0.0.1:1"
+	var buf bytes.Buffer
+	alice.SetWriter(&buf)
+	if err := alice.Share("beta", []string{"bob@"}, nil); err != nil {
+		t.Fatalf("alice.Share: %v", err)
+	}
+	if want, got := "Now sharing beta with bob@. (pending)", buf.String(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected share output. Want %q, got %q", want, got)
+	}
+	buf.Reset()
+	if err := alice.ListFiles([]string{"beta"}, client.GlobOptions{Long: true, Directory: true}); err != nil {
+		t.Fatalf("alice.ListFiles: %v", err)
+	}
+	if want, got := "Pending: share", buf.String(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected list output. Want %q, got %q", want, got)
+	}
+	if err := alice.Sync(false); !errors.Is(err, client.ErrUnreachable) {
+		t.Errorf("alice.Sync() = %v, want %v", err, client.ErrUnreachable)
+	}
+
+	t.Log("alice goes online")
+	alice.Account.ServerBaseURL = url
+	buf.Reset()
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	if want, got := "* Share beta with bob@ (synced)", buf.String(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected sync output. Want %q, got %q", want, got)
+	}
+	buf.Reset()
+	if err := alice.ListFiles([]string{"beta"}, client.GlobOptions{Long: true, Directory: true}); err != nil {
+		t.Fatalf("alice.ListFiles: %v", err)
+	}
+	if got := buf.String(); strings.Contains(got, "Pending") || !strings.Contains(got, "shared by me") {
+		t.Errorf("Unexpected list output: %q", got)
+	}
+
+	if err := c["bob"].GetUpdates(false); err != nil {
+		t.Fatalf("bob.GetUpdates: %v", err)
+	}
+	got, err := globAll(c["bob"])
+	if err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	want := []string{".trash", "gallery", "shared LOCAL", "shared/alpha", "shared/beta"}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("Unexpected file list: %v", diff)
+	}
+}
+
 func TestCopyPermission(t *testing.T) {
 	_, url, done := startServer(t)
 	defer done()
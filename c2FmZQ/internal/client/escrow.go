@@ -0,0 +1,287 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// RecoveryInfo is the state of an album key escrow, as reported by the
+// server. The album keys in escrow are encrypted for the recovery contact,
+// who can recover the owner's albums if the owner loses access to all their
+// devices.
+type RecoveryInfo struct {
+	OwnerID           int64    `json:"ownerId"`
+	OwnerEmail        string   `json:"ownerEmail"`
+	ContactID         int64    `json:"contactId"`
+	ContactEmail      string   `json:"contactEmail"`
+	ContactPublicKey  string   `json:"contactPublicKey"`
+	Accepted          bool     `json:"accepted"`
+	DateCreated       int64    `json:"dateCreated"`
+	Albums            []string `json:"albums"`
+	RecoveryRequested int64    `json:"recoveryRequested,omitempty"`
+	RecoveryAvailable int64    `json:"recoveryAvailable,omitempty"`
+	// The inactivity trigger. See SetInactivityTrigger.
+	InactivityMonths    int   `json:"inactivityMonths,omitempty"`
+	LastActivity        int64 `json:"lastActivity,omitempty"`
+	Reminders           int   `json:"reminders,omitempty"`
+	InactivityTriggered int64 `json:"inactivityTriggered,omitempty"`
+	// The audit log of the escrow, oldest first.
+	Events []EscrowEvent `json:"events"`
+}
+
+// EscrowEvent is an entry in the audit log of an escrow.
+type EscrowEvent struct {
+	Date   int64  `json:"date"`
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// The number of events shown by ShowRecoveryStatus.
+const shownEscrowEvents = 10
+
+// SetRecoveryContact designates the user with email as our recovery contact.
+// The contact has to accept with AnswerRecoveryContact before the album keys
+// can be added with EscrowAlbumKeys. When email is empty, the recovery
+// contact and the escrowed keys are removed.
+func (c *Client) SetRecoveryContact(email string) error {
+	_, err := c.sendEscrowRequest("setContact", map[string]string{"email": email})
+	return err
+}
+
+// AnswerRecoveryContact accepts or declines to be the recovery contact of the
+// user with ownerEmail.
+func (c *Client) AnswerRecoveryContact(ownerEmail string, accept bool) error {
+	owner, err := c.recoveryOwner(ownerEmail)
+	if err != nil {
+		return err
+	}
+	params := map[string]string{
+		"ownerId": strconv.FormatInt(owner.OwnerID, 10),
+		"accept":  "0",
+	}
+	if accept {
+		params["accept"] = "1"
+	}
+	_, err = c.sendEscrowRequest("answer", params)
+	return err
+}
+
+// EscrowAlbumKeys adds the keys of all the albums that we own to the escrow,
+// encrypted for the recovery contact. It returns the number of albums added.
+func (c *Client) EscrowAlbumKeys() (int, error) {
+	escrow, _, err := c.RecoveryStatus()
+	if err != nil {
+		return 0, err
+	}
+	if escrow == nil {
+		return 0, errors.New("no recovery contact")
+	}
+	if !escrow.Accepted {
+		return 0, fmt.Errorf("%s hasn't accepted to be the recovery contact yet", escrow.ContactEmail)
+	}
+	b, err := base64.StdEncoding.DecodeString(escrow.ContactPublicKey)
+	if err != nil {
+		return 0, err
+	}
+	pk := stingle.PublicKeyFromBytes(b)
+	inEscrow := make(map[string]bool)
+	for _, albumID := range escrow.Albums {
+		inEscrow[albumID] = true
+	}
+
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return 0, err
+	}
+	keys := make(map[string]string)
+	for albumID, album := range al.RemoteAlbums {
+		if album.IsOwner != "1" || inEscrow[albumID] {
+			continue
+		}
+		sk, err := c.SKForAlbum(album)
+		if err != nil {
+			return 0, err
+		}
+		keys[albumID] = pk.SealBoxBase64(sk.ToBytes())
+		sk.Wipe()
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	kj, err := json.Marshal(keys)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.sendEscrowRequest("addKeys", map[string]string{"keys": string(kj)}); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// SetInactivityTrigger lets our recovery contact recover our albums without
+// waiting for the recovery delay if we don't log in for months, despite the
+// reminders that the server sends. Zero months disables the trigger.
+func (c *Client) SetInactivityTrigger(months int) error {
+	_, err := c.sendEscrowRequest("setInactivity", map[string]string{"months": strconv.Itoa(months)})
+	return err
+}
+
+// RecoveryStatus returns our album key escrow, if any, and the escrows for
+// which we are the recovery contact.
+func (c *Client) RecoveryStatus() (*RecoveryInfo, []RecoveryInfo, error) {
+	sr, err := c.sendEscrowRequest("status", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var escrow *RecoveryInfo
+	if sr.Part("escrow") != nil {
+		escrow = &RecoveryInfo{}
+		if err := copyJSON(sr.Part("escrow"), escrow); err != nil {
+			return nil, nil, err
+		}
+	}
+	var contactFor []RecoveryInfo
+	if err := copyJSON(sr.Part("contactFor"), &contactFor); err != nil {
+		return nil, nil, err
+	}
+	return escrow, contactFor, nil
+}
+
+// ShowRecoveryStatus shows our recovery contact, and the users for whom we
+// are the recovery contact.
+func (c *Client) ShowRecoveryStatus() error {
+	escrow, contactFor, err := c.RecoveryStatus()
+	if err != nil {
+		return err
+	}
+	if escrow == nil {
+		c.Print("No recovery contact.")
+	} else {
+		state := "accepted"
+		if !escrow.Accepted {
+			state = "not accepted yet"
+		}
+		c.Printf("Recovery contact: %s (%s), %d albums in escrow\n", escrow.ContactEmail, state, len(escrow.Albums))
+		if escrow.RecoveryRequested > 0 {
+			c.Printf("WARNING: %s asked to recover your albums. They will be shared with %s on %s unless you deny the request.\n",
+				escrow.ContactEmail, escrow.ContactEmail, time.UnixMilli(escrow.RecoveryAvailable).Format("2006-01-02 15:04:05"))
+		}
+		if escrow.InactivityMonths > 0 {
+			c.Printf("Inactivity trigger: %d months without login, last login on %s\n", escrow.InactivityMonths, time.UnixMilli(escrow.LastActivity).Format("2006-01-02 15:04:05"))
+		}
+		c.showEscrowEvents(escrow.Events)
+	}
+	for _, e := range contactFor {
+		state := "accepted"
+		if !e.Accepted {
+			state = "not accepted yet"
+		}
+		c.Printf("Recovery contact for %s (%s)\n", e.OwnerEmail, state)
+		if e.InactivityTriggered > 0 {
+			c.Printf("* %s has been inactive since %s. The albums can be recovered now.\n", e.OwnerEmail, time.UnixMilli(e.LastActivity).Format("2006-01-02 15:04:05"))
+		} else if e.RecoveryRequested > 0 {
+			c.Printf("* Recovery requested, available on %s\n", time.UnixMilli(e.RecoveryAvailable).Format("2006-01-02 15:04:05"))
+		}
+		c.showEscrowEvents(e.Events)
+	}
+	return nil
+}
+
+// showEscrowEvents shows the most recent events of an escrow.
+func (c *Client) showEscrowEvents(events []EscrowEvent) {
+	if len(events) > shownEscrowEvents {
+		events = events[len(events)-shownEscrowEvents:]
+	}
+	for _, ev := range events {
+		c.Printf("    %s %s %s\n", time.UnixMilli(ev.Date).Format("2006-01-02 15:04:05"), ev.Type, ev.Detail)
+	}
+}
+
+// RequestRecovery asks to recover the albums of the user with ownerEmail. The
+// owner is notified, and the albums are shared with us if the owner doesn't
+// deny the request before the time that is returned. Then, RequestRecovery
+// has to be called again. It returns the number of albums that were shared.
+func (c *Client) RequestRecovery(ownerEmail string) (int, time.Time, error) {
+	owner, err := c.recoveryOwner(ownerEmail)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	sr, err := c.sendEscrowRequest("recover", map[string]string{"ownerId": strconv.FormatInt(owner.OwnerID, 10)})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var n, availableAt int64
+	if err := copyJSON(sr.Part("recovered"), &n); err != nil {
+		return 0, time.Time{}, err
+	}
+	if err := copyJSON(sr.Part("availableAt"), &availableAt); err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(n), time.UnixMilli(availableAt), nil
+}
+
+// DenyRecovery denies a pending request from our recovery contact to recover
+// our albums.
+func (c *Client) DenyRecovery() error {
+	_, err := c.sendEscrowRequest("deny", nil)
+	return err
+}
+
+// recoveryOwner returns the escrow of ownerEmail for which we are the
+// recovery contact.
+func (c *Client) recoveryOwner(ownerEmail string) (*RecoveryInfo, error) {
+	_, contactFor, err := c.RecoveryStatus()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range contactFor {
+		if e.OwnerEmail == ownerEmail {
+			return &e, nil
+		}
+	}
+	return nil, fmt.Errorf("not the recovery contact of %s", ownerEmail)
+}
+
+func (c *Client) sendEscrowRequest(endpoint string, params map[string]string) (*stingle.Response, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+	sr, err := c.sendRequest("/v2x/escrow/"+endpoint, form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
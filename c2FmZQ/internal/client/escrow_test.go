@@ -0,0 +1,110 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/server"
+)
+
+func TestAlbumEscrow(t *testing.T) {
+	alice, url, done := startServerWithOptions(t, func(s *server.Server) {
+		s.RecoveryDelay = 0
+	})
+	defer done()
+	if err := alice.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("alice.CreateAccount: %v", err)
+	}
+	bob, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := bob.CreateAccount(url, "bob@", "pass", true); err != nil {
+		t.Fatalf("bob.CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := alice.AddAlbums([]string{"family"}); err != nil {
+		t.Fatalf("alice.AddAlbums: %v", err)
+	}
+	if _, err := alice.ImportFiles([]string{filepath.Join(testdir, "*")}, "family", false); err != nil {
+		t.Fatalf("alice.ImportFiles: %v", err)
+	}
+	if err := alice.Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+
+	if err := alice.SetRecoveryContact("bob@"); err != nil {
+		t.Fatalf("alice.SetRecoveryContact: %v", err)
+	}
+	if _, err := alice.EscrowAlbumKeys(); err == nil {
+		t.Error("alice.EscrowAlbumKeys succeeded before bob accepted")
+	}
+	if err := bob.AnswerRecoveryContact("alice@", true); err != nil {
+		t.Fatalf("bob.AnswerRecoveryContact: %v", err)
+	}
+	if n, err := alice.EscrowAlbumKeys(); err != nil || n != 1 {
+		t.Fatalf("alice.EscrowAlbumKeys() = %d, %v", n, err)
+	}
+	if n, err := alice.EscrowAlbumKeys(); err != nil || n != 0 {
+		t.Fatalf("alice.EscrowAlbumKeys() = %d, %v", n, err)
+	}
+	if err := alice.SetInactivityTrigger(-1); err == nil {
+		t.Error("alice.SetInactivityTrigger(-1) succeeded unexpectedly")
+	}
+	if err := alice.SetInactivityTrigger(12); err != nil {
+		t.Fatalf("alice.SetInactivityTrigger: %v", err)
+	}
+	escrow, _, err := alice.RecoveryStatus()
+	if err != nil {
+		t.Fatalf("alice.RecoveryStatus: %v", err)
+	}
+	if escrow.InactivityMonths != 12 || escrow.LastActivity == 0 || len(escrow.Events) != 1 {
+		t.Errorf("Unexpected escrow: %+v", escrow)
+	}
+
+	if n, _, err := bob.RequestRecovery("alice@"); err != nil || n != 1 {
+		t.Fatalf("bob.RequestRecovery() = %d, %v", n, err)
+	}
+	if err := bob.GetUpdates(true); err != nil {
+		t.Fatalf("bob.GetUpdates: %v", err)
+	}
+	files, err := globAll(bob)
+	if err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	var recovered []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".jpg") {
+			recovered = append(recovered, f)
+		}
+	}
+	if len(recovered) != 2 {
+		t.Fatalf("Unexpected files: %v", files)
+	}
+	if n, err := bob.Pull([]string{"*"}, client.GlobOptions{Recursive: true}); err != nil || n != 2 {
+		t.Errorf("bob.Pull() = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,324 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// precheckBatchSize is the maximum number of fingerprints sent in one
+// /v2x/import/precheck request.
+const precheckBatchSize = 1000
+
+// TransferEstimate is an estimate of the amount of data that a sync or a pull
+// would transfer, and of the resulting change in server storage.
+type TransferEstimate struct {
+	UploadFiles int   `json:"uploadFiles"`
+	UploadBytes int64 `json:"uploadBytes"`
+	// DeltaFiles is the number of uploads that are new versions of files
+	// already on the server. Only their changed chunks are sent.
+	DeltaFiles int `json:"deltaFiles"`
+	// DuplicateFiles is the number of uploads whose content is already on
+	// the server, according to /v2x/import/precheck. Only files imported
+	// with this version of the client have fingerprints to check.
+	DuplicateFiles int   `json:"duplicateFiles"`
+	DuplicateBytes int64 `json:"duplicateBytes"`
+
+	DownloadFiles int   `json:"downloadFiles"`
+	DownloadBytes int64 `json:"downloadBytes"`
+
+	// StorageChange is the number of bytes that the uploads add to the
+	// server storage. The space freed by deleted files is not included.
+	StorageChange int64 `json:"storageChange"`
+	// Storage is the storage usage reported by the server at the last
+	// sync.
+	Storage *StorageUsage `json:"storage,omitempty"`
+}
+
+// Fingerprints are keyed hashes of the content of the files that were
+// imported locally and not uploaded yet. They are sent with the uploads so
+// that the server can detect duplicate content, without learning anything
+// about the content.
+type Fingerprints struct {
+	Files map[string]string `json:"files"`
+}
+
+// EstimateSync returns an estimate of the amount of data that Sync would
+// upload. Only metadata is fetched from the server.
+func (c *Client) EstimateSync() (*TransferEstimate, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	if err := c.GetUpdates(true); err != nil {
+		return nil, err
+	}
+	d, err := c.diff()
+	if err != nil {
+		return nil, err
+	}
+	fps, err := c.fingerprints()
+	if err != nil {
+		return nil, err
+	}
+	e := &TransferEstimate{Storage: c.Account.Storage}
+	type upload struct {
+		files int
+		bytes int64
+	}
+	uploads := make(map[string]*upload)
+	for _, f := range d.FilesToAdd {
+		size, err := c.uploadSize(f.File.File)
+		if err != nil {
+			return nil, err
+		}
+		e.UploadFiles++
+		e.StorageChange += size
+		vb, err := c.versionBase(f.File.File)
+		if err != nil {
+			return nil, err
+		}
+		if vb != nil {
+			if n, err := c.deltaSize(f.File.File, vb); err == nil {
+				e.DeltaFiles++
+				size = n
+			}
+		}
+		e.UploadBytes += size
+		if fp := fps[f.File.File]; fp != "" {
+			if uploads[fp] == nil {
+				uploads[fp] = &upload{}
+			}
+			uploads[fp].files++
+			uploads[fp].bytes += size
+		}
+	}
+	if len(uploads) == 0 {
+		return e, nil
+	}
+	var list []string
+	for fp := range uploads {
+		list = append(list, fp)
+	}
+	dups, err := c.sendImportPrecheck(list)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range dups {
+		if u := uploads[fp]; u != nil {
+			e.DuplicateFiles += u.files
+			e.DuplicateBytes += u.bytes
+		}
+	}
+	return e, nil
+}
+
+// EstimatePull returns an estimate of the amount of data that Pull would
+// download.
+func (c *Client) EstimatePull(patterns []string, opt GlobOptions) (*TransferEstimate, error) {
+	files, err := c.filesToPull(patterns, opt)
+	if err != nil {
+		return nil, err
+	}
+	e := &TransferEstimate{}
+	if c.Account != nil {
+		e.Storage = c.Account.Storage
+	}
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	for _, item := range files {
+		hdr, err := item.Header(sk)
+		if err != nil {
+			return nil, err
+		}
+		e.DownloadFiles++
+		e.DownloadBytes += encryptedSize(hdr)
+		hdr.Wipe()
+	}
+	return e, nil
+}
+
+// ShowEstimate shows a transfer estimate, in human readable or JSON format.
+func (c *Client) ShowEstimate(e *TransferEstimate, asJSON bool) error {
+	if asJSON || c.output == OutputJSON {
+		b, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return err
+		}
+		c.Print(string(b))
+		return nil
+	}
+	if e.UploadFiles > 0 {
+		c.Printf("Upload: %d files, %d bytes (%d sent as deltas)\n", e.UploadFiles, e.UploadBytes, e.DeltaFiles)
+		if e.DuplicateFiles > 0 {
+			c.Printf("Duplicates: %d of these files, %d bytes, have the same content as files already on the server\n", e.DuplicateFiles, e.DuplicateBytes)
+		}
+	}
+	if e.DownloadFiles > 0 {
+		c.Printf("Download: %d files, %d bytes\n", e.DownloadFiles, e.DownloadBytes)
+	}
+	if e.UploadFiles == 0 && e.DownloadFiles == 0 {
+		c.Print("Nothing to transfer.")
+		return nil
+	}
+	if e.UploadFiles == 0 {
+		return nil
+	}
+	if su := e.Storage; su != nil && su.Quota > 0 {
+		used := su.SpaceUsed + e.StorageChange
+		c.Printf("Server storage: +%d bytes, %d of %d bytes used after sync (%d%%)\n", e.StorageChange, used, su.Quota, 100*used/su.Quota)
+	} else {
+		c.Printf("Server storage: +%d bytes\n", e.StorageChange)
+	}
+	return nil
+}
+
+// uploadSize returns the number of bytes of file and its thumbnail.
+func (c *Client) uploadSize(file string) (int64, error) {
+	var size int64
+	for _, thumb := range []bool{false, true} {
+		fi, err := os.Stat(c.blobPath(file, thumb))
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// deltaSize returns the number of bytes that uploadDelta would send for file,
+// including its thumbnail.
+func (c *Client) deltaSize(file string, vb *VersionBase) (int64, error) {
+	newBlob, baseBlob := c.blobPath(file, false), c.blobPath(vb.File, false)
+	if _, err := os.Stat(baseBlob); err != nil {
+		return 0, err
+	}
+	var w countingWriter
+	if err := writeDelta(&w, newBlob, baseBlob, vb.ChunkSize); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(c.blobPath(file, true))
+	if err != nil {
+		return 0, err
+	}
+	return int64(w) + fi.Size(), nil
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
+
+// sendImportPrecheck returns the fingerprints that match files that are
+// already on the server.
+func (c *Client) sendImportPrecheck(fingerprints []string) ([]string, error) {
+	var dups []string
+	for len(fingerprints) > 0 {
+		n := len(fingerprints)
+		if n > precheckBatchSize {
+			n = precheckBatchSize
+		}
+		params := make(map[string]string)
+		params["fingerprints"] = strings.Join(fingerprints[:n], ",")
+		fingerprints = fingerprints[n:]
+
+		form := url.Values{}
+		form.Set("token", c.Account.Token)
+		form.Set("params", c.encodeParams(params))
+		sr, err := c.sendRequest("/v2x/import/precheck", form, "")
+		if err != nil {
+			return nil, err
+		}
+		if sr.Status != "ok" {
+			return nil, sr
+		}
+		var d []string
+		if err := copyJSON(sr.Part("duplicates"), &d); err != nil {
+			return nil, err
+		}
+		dups = append(dups, d...)
+	}
+	return dups, nil
+}
+
+// fingerprintHash returns the hash used to compute the fingerprints of the
+// content of files. It is keyed with the user's secret key.
+func (c *Client) fingerprintHash() hash.Hash {
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	h := sha256.New()
+	h.Write([]byte("c2FmZQ fingerprint\x00"))
+	h.Write(sk.ToBytes())
+	return hmac.New(sha256.New, h.Sum(nil))
+}
+
+// fingerprintReader returns a reader that computes the fingerprint of
+// everything read from in. The fingerprint is returned by the second
+// function.
+func (c *Client) fingerprintReader(in io.Reader) (io.Reader, func() string) {
+	h := c.fingerprintHash()
+	return io.TeeReader(in, h), func() string {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// fingerprints returns the fingerprints of the files that weren't uploaded
+// yet.
+func (c *Client) fingerprints() (map[string]string, error) {
+	var fps Fingerprints
+	if err := c.storage.ReadDataFile(c.fileHash(fingerprintsFile), &fps); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fps.Files, nil
+}
+
+// setFingerprint records the fingerprint of file, or removes it when fp is
+// empty.
+func (c *Client) setFingerprint(file, fp string) (retErr error) {
+	var fps Fingerprints
+	if err := c.storage.CreateEmptyFile(c.fileHash(fingerprintsFile), &Fingerprints{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	commit, err := c.storage.OpenForUpdate(c.fileHash(fingerprintsFile), &fps)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if fps.Files == nil {
+		fps.Files = make(map[string]string)
+	}
+	if fp == "" {
+		delete(fps.Files, file)
+	} else {
+		fps.Files[file] = fp
+	}
+	return commit(true, nil)
+}
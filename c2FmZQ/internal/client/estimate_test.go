@@ -0,0 +1,96 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestEstimate(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	for _, n := range []string{"file1", "file2"} {
+		if err := os.WriteFile(filepath.Join(testdir, n), content[:5000], 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		content = content[5000:]
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	e, err := c.EstimateSync()
+	if err != nil {
+		t.Fatalf("c.EstimateSync: %v", err)
+	}
+	if e.UploadFiles != 2 || e.DuplicateFiles != 0 || e.DeltaFiles != 0 {
+		t.Errorf("Unexpected estimate: %+v", e)
+	}
+	// Each file has 5000 bytes of content, plus a header, a thumbnail, and
+	// the encryption overhead.
+	if e.UploadBytes <= 10000 || e.UploadBytes != e.StorageChange {
+		t.Errorf("Unexpected estimate: %+v", e)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if e, err := c.EstimateSync(); err != nil || e.UploadFiles != 0 {
+		t.Errorf("c.EstimateSync() = %+v, %v", e, err)
+	}
+
+	// The same content imported again is a duplicate.
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "file1")}, "album", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if e, err = c.EstimateSync(); err != nil {
+		t.Fatalf("c.EstimateSync: %v", err)
+	}
+	if e.UploadFiles != 1 || e.DuplicateFiles != 1 || e.DuplicateBytes != e.UploadBytes {
+		t.Errorf("Unexpected estimate: %+v", e)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	if _, err := c.Free([]string{"*"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	if e, err = c.EstimatePull([]string{"*"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.EstimatePull: %v", err)
+	}
+	if e.DownloadFiles != 3 || e.DownloadBytes < 15000 {
+		t.Errorf("Unexpected estimate: %+v", e)
+	}
+}
@@ -18,13 +18,20 @@
 package client
 
 import (
+	"archive/tar"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -181,3 +188,219 @@ func (c *Client) exportFile(item ListItem, dir string, hdr *stingle.Header) (err
 	}
 	return os.Rename(tmp, fn)
 }
+
+// exportedFile is an entry of files.json in the account export.
+type exportedFile struct {
+	stingle.File
+	Set string `json:"set"`
+}
+
+// ExportAccount downloads a complete export of our account from the server,
+// and decrypts it in dir. The files are in the gallery, .trash, and album
+// subdirectories. The shared albums are in the shared subdirectory, and the
+// contacts are in contacts.json. Returns the number of files exported.
+func (c *Client) ExportAccount(dir string) (int, error) {
+	if c.Account == nil {
+		return 0, ErrNotLoggedIn
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return 0, fmt.Errorf("%s is not a directory", dir)
+	}
+	body, err := c.downloadAccountExport()
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	albums := make(map[string]*stingle.Album)
+	albumDirs := make(map[string]string)
+	files := make(map[string]exportedFile)
+	usedDirs := make(map[string]bool)
+	count := 0
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		switch name := hdr.Name; {
+		case name == "contacts.json":
+			var contacts []stingle.Contact
+			if err := json.NewDecoder(tr).Decode(&contacts); err != nil {
+				return count, err
+			}
+			b, err := json.MarshalIndent(contacts, "", "  ")
+			if err != nil {
+				return count, err
+			}
+			if err := os.WriteFile(filepath.Join(dir, "contacts.json"), b, 0600); err != nil {
+				return count, err
+			}
+		case name == "albums.json":
+			var list []*stingle.Album
+			if err := json.NewDecoder(tr).Decode(&list); err != nil {
+				return count, err
+			}
+			for _, a := range list {
+				albumName, err := c.exportAlbumName(a)
+				if err != nil {
+					return count, err
+				}
+				d := albumName
+				for i := 2; usedDirs[d]; i++ {
+					d = fmt.Sprintf("%s (%d)", albumName, i)
+				}
+				usedDirs[d] = true
+				albums[a.AlbumID] = a
+				albumDirs[a.AlbumID] = d
+			}
+		case name == "files.json":
+			var list []exportedFile
+			if err := json.NewDecoder(tr).Decode(&list); err != nil {
+				return count, err
+			}
+			for _, f := range list {
+				p := path.Join("blobs", f.Set, f.File.File)
+				if f.Set == stingle.AlbumSet {
+					p = path.Join("blobs", f.Set, f.AlbumID, f.File.File)
+				}
+				files[p] = f
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			f, ok := files[name]
+			if !ok {
+				log.Errorf("ExportAccount: unexpected file %s", name)
+				continue
+			}
+			var album *stingle.Album
+			var d string
+			switch f.Set {
+			case stingle.GallerySet:
+				d = "gallery"
+			case stingle.TrashSet:
+				d = ".trash"
+			case stingle.AlbumSet:
+				if album, ok = albums[f.AlbumID]; !ok {
+					log.Errorf("ExportAccount: unknown album %s", f.AlbumID)
+					continue
+				}
+				d = albumDirs[f.AlbumID]
+			}
+			if err := c.exportAccountFile(tr, f, album, filepath.Join(dir, d)); err != nil {
+				return count, fmt.Errorf("%s: %w", name, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// exportAlbumName returns the relative path of an album in the account export.
+func (c *Client) exportAlbumName(a *stingle.Album) (string, error) {
+	ask, err := c.SKForAlbum(a)
+	if err != nil {
+		return "", err
+	}
+	md, err := stingle.DecryptAlbumMetadata(a.Metadata, ask)
+	ask.Wipe()
+	if err != nil {
+		return "", err
+	}
+	_, name := filepath.Split(sanitize(md.Name))
+	if name == "gallery" || name == ".trash" || name == "shared" || name == "contacts.json" {
+		name = "(" + name + ")"
+	}
+	if a.IsShared == "1" && a.IsOwner != "1" {
+		name = filepath.Join("shared", name)
+	}
+	return name, nil
+}
+
+// exportAccountFile decrypts one file of the account export in dir.
+func (c *Client) exportAccountFile(in io.Reader, f exportedFile, album *stingle.Album, dir string) error {
+	ask, err := c.SKForAlbum(album)
+	if err != nil {
+		return err
+	}
+	hdrs, err := stingle.DecryptBase64Headers(f.Headers, ask)
+	ask.Wipe()
+	if err != nil {
+		return err
+	}
+	hdrs[1].Wipe()
+	hdr := hdrs[0]
+	defer hdr.Wipe()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := stingle.SkipHeader(in); err != nil {
+		return err
+	}
+	_, fn := filepath.Split(sanitize(string(hdr.Filename)))
+	if fn == "" {
+		_, fn = filepath.Split(sanitize(f.File.File))
+		fn = "decrypted-" + fn
+	}
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	var out *os.File
+	for i := 1; ; i++ {
+		if i > 1 {
+			fn = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		if out, err = os.OpenFile(filepath.Join(dir, fn), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); !errors.Is(err, os.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, stingle.DecryptFile(in, hdr)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if ms, err := f.DateModified.Int64(); err == nil {
+		mt := time.UnixMilli(ms)
+		return os.Chtimes(filepath.Join(dir, fn), mt, mt)
+	}
+	return nil
+}
+
+// downloadAccountExport requests the account export from the server, and
+// returns the tar stream.
+func (c *Client) downloadAccountExport() (io.ReadCloser, error) {
+	if c.Account.ServerBaseURL == "" {
+		return nil, errors.New("ServerBaseURL is not set")
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	url := strings.TrimSuffix(c.Account.ServerBaseURL, "/") + "/v2x/config/exportAccount"
+	log.Debugf("SEND POST %v", url)
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-tar" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response type %q", ct)
+	}
+	return resp.Body, nil
+}
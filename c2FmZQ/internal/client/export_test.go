@@ -0,0 +1,97 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExportAccount(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := c.AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image000.jpg")}, "gallery", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image00[12].jpg")}, "alpha", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	exportdir := t.TempDir()
+	n, err := c.ExportAccount(exportdir)
+	if err != nil {
+		t.Fatalf("ExportAccount: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("ExportAccount() = %d, want 3", n)
+	}
+	var got []string
+	if err := filepath.Walk(exportdir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(exportdir, p)
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	sort.Strings(got)
+	want := []string{
+		"alpha/image001.jpg",
+		"alpha/image002.jpg",
+		"contacts.json",
+		"gallery/image000.jpg",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Exported files = %v, want %v", got, want)
+	}
+	for _, f := range []struct{ exported, orig string }{
+		{"gallery/image000.jpg", "image000.jpg"},
+		{"alpha/image002.jpg", "image002.jpg"},
+	} {
+		a, err := os.ReadFile(filepath.Join(exportdir, f.exported))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		b, err := os.ReadFile(filepath.Join(testdir, f.orig))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s doesn't match the original", f.exported)
+		}
+	}
+}
@@ -72,12 +72,12 @@ func Mount(c *client.Client, mnt string, readOnly bool) error {
 		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, unix.SIGINT)
 		signal.Notify(ch, unix.SIGTERM)
-		c.Sync(false)
+		c.ScheduledSync()
 	L:
 		for {
 			select {
-			case <-time.After(time.Minute):
-				c.Sync(false)
+			case <-time.After(c.PollInterval(time.Minute)):
+				c.ScheduledSync()
 			case sig := <-ch:
 				log.Infof("Received signal %d (%s)", sig, sig)
 				break L
@@ -18,6 +18,7 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
@@ -54,7 +55,11 @@ type toImport struct {
 
 // ImportFiles encrypts and imports files. Returns the number of files imported.
 func (c *Client) ImportFiles(patterns []string, dest string, recursive bool) (int, error) {
-	files, err := c.findFilesToImport(patterns, dest, recursive)
+	return c.importFiles(patterns, dest, recursive, false)
+}
+
+func (c *Client) importFiles(patterns []string, dest string, recursive, update bool) (int, error) {
+	files, err := c.findFilesToImport(patterns, dest, recursive, update)
 	if err != nil {
 		return 0, err
 	}
@@ -119,8 +124,33 @@ func (c *Client) ImportFiles(patterns []string, dest string, recursive bool) (in
 			if dd, _ := filepath.Split(f.dst); dir != strings.TrimSuffix(dd, "/") {
 				continue
 			}
+			if update {
+				base, err := c.glob(f.dst, GlobOptions{ExactMatch: true})
+				if err != nil {
+					return count, err
+				}
+				if len(base) != 1 || base[0].IsDir {
+					return count, fmt.Errorf("%s is not a file", f.dst)
+				}
+				if a := base[0].Album; a != nil && a.IsOwner != "1" {
+					return count, fmt.Errorf("only the album owner can update files: %s", f.dst)
+				}
+				same, err := c.sameContent(f.src, base[0])
+				if err != nil {
+					return count, err
+				}
+				if same {
+					continue
+				}
+				c.Printf("Updating %s -> %s (not synced)\n", f.src, f.dst)
+				if err := c.importFile(f.src, li[0], pk, &base[0]); err != nil {
+					return count, err
+				}
+				count++
+				continue
+			}
 			c.Printf("Importing %s -> %s (not synced)\n", f.src, f.dst)
-			if err := c.importFile(f.src, li[0], pk); err != nil {
+			if err := c.importFile(f.src, li[0], pk, nil); err != nil {
 				return count, err
 			}
 			count++
@@ -139,7 +169,9 @@ func importedFileName(s string) string {
 	return filepath.Join(parts...)
 }
 
-func (c *Client) findFilesToImport(patterns []string, dest string, recursive bool) ([]toImport, error) {
+// findFilesToImport returns the files to import, i.e. those that don't exist
+// in dest yet. With update, it returns those that already exist instead.
+func (c *Client) findFilesToImport(patterns []string, dest string, recursive, update bool) ([]toImport, error) {
 	dest = strings.TrimSuffix(dest, "/")
 	li, err := c.glob(dest, GlobOptions{})
 	if err != nil {
@@ -176,8 +208,10 @@ func (c *Client) findFilesToImport(patterns []string, dest string, recursive boo
 			if !fi.IsDir() {
 				_, file := filepath.Split(f)
 				df := filepath.Join(dest, importedFileName(file))
-				if exist[df] {
-					c.Printf("Skipping %s (already exists)\n", df)
+				if update != exist[df] {
+					if !update {
+						c.Printf("Skipping %s (already exists)\n", df)
+					}
 					continue
 				}
 				files = append(files, toImport{src: f, dst: df})
@@ -201,8 +235,10 @@ func (c *Client) findFilesToImport(patterns []string, dest string, recursive boo
 					return nil
 				}
 				df := filepath.Join(dest, importedFileName(rel))
-				if exist[df] {
-					c.Printf("Skipping %s (already exists)\n", df)
+				if update != exist[df] {
+					if !update {
+						c.Printf("Skipping %s (already exists)\n", df)
+					}
 					return nil
 				}
 				files = append(files, toImport{src: p, dst: df})
@@ -227,7 +263,9 @@ func fileTypeForExt(ext string) uint8 {
 	}
 }
 
-func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) error {
+// importFile encrypts and imports one file. When base is set, the file is a
+// new version of base, which is moved to trash.
+func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey, base *ListItem) error {
 	fi, err := os.Stat(file)
 	if err != nil {
 		return err
@@ -284,6 +322,25 @@ func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) err
 	if err != nil {
 		return err
 	}
+	var baseBlob string
+	var chunkSize int32
+	if base != nil {
+		// The new version uses the same key as the base, so that the
+		// encrypted chunks that didn't change can be reused.
+		sk := c.SecretKey()
+		bh, err := base.Header(sk)
+		sk.Wipe()
+		if err != nil {
+			return err
+		}
+		copy(hdrs[0].FileID, bh.FileID)
+		copy(hdrs[0].SymmetricKey, bh.SymmetricKey)
+		hdrs[0].ChunkSize = bh.ChunkSize
+		chunkSize = bh.ChunkSize
+		copy(hdrs[1].FileID, bh.FileID)
+		bh.Wipe()
+		baseBlob = base.FilePath
+	}
 	hdrs[1].DataSize = int64(len(thumbnail))
 	hdrs[1].FileType = hdrs[0].FileType
 	hdrs[1].VideoDuration = hdrs[0].VideoDuration
@@ -306,18 +363,35 @@ func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) err
 	if _, err := in.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	if err := c.encryptFile(in, sFile.File, hdrs[0], pk, false); err != nil {
+	r, fingerprint := c.fingerprintReader(in)
+	reused, err := c.encryptBlob(r, c.blobPath(sFile.File, false), hdrs[0], pk, baseBlob)
+	if err != nil {
 		return err
 	}
 	if err := c.encryptFile(bytes.NewBuffer(thumbnail), sFile.File, hdrs[1], pk, true); err != nil {
 		return err
 	}
+	if err := c.setFingerprint(sFile.File, fingerprint()); err != nil {
+		return err
+	}
 	commit, fs, err := c.fileSetForUpdate(dst.FileSet)
 	if err != nil {
 		return err
 	}
 	fs.Files[sFile.File] = &sFile
-	return commit(true, nil)
+	if err := commit(true, nil); err != nil || base == nil {
+		return err
+	}
+	if reused > 0 && !base.LocalOnly {
+		if err := c.addVersion(sFile.File, base, chunkSize); err != nil {
+			return err
+		}
+	}
+	trash, err := c.glob(".trash", GlobOptions{})
+	if err != nil || len(trash) != 1 {
+		return err
+	}
+	return c.moveFiles([]ListItem{*base}, trash[0], "", true)
 }
 
 func makeSPFilename() string {
@@ -441,27 +515,47 @@ func videoMetadata(file io.Reader) (duration int32, creationTime time.Time, err
 }
 
 func (c *Client) encryptFile(in io.Reader, file string, hdr *stingle.Header, pk stingle.PublicKey, thumb bool) error {
-	fn := c.blobPath(file, thumb)
+	_, err := c.encryptBlob(in, c.blobPath(file, thumb), hdr, pk, "")
+	return err
+}
+
+// encryptBlob encrypts in and writes it to fn. When base is set, the
+// encrypted chunks of base are reused when their content is unchanged. It
+// returns the number of reused chunks.
+func (c *Client) encryptBlob(in io.Reader, fn string, hdr *stingle.Header, pk stingle.PublicKey, base string) (int, error) {
 	dir, _ := filepath.Split(fn)
 	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
+		return 0, err
 	}
 	tmp := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
 	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := stingle.EncryptHeader(out, hdr, pk); err != nil {
 		out.Close()
-		return err
+		return 0, err
 	}
 	w := stingle.EncryptFile(out, hdr)
+	if base != "" {
+		b, err := os.Open(base)
+		if err != nil {
+			w.Close()
+			return 0, err
+		}
+		defer b.Close()
+		if err := stingle.SkipHeader(b); err != nil {
+			w.Close()
+			return 0, err
+		}
+		w.ReuseChunks(bufio.NewReader(b))
+	}
 	if _, err := io.Copy(w, in); err != nil {
 		w.Close()
-		return err
+		return 0, err
 	}
 	if err := w.Close(); err != nil {
-		return err
+		return 0, err
 	}
-	return os.Rename(tmp, fn)
+	return w.ReusedChunks(), os.Rename(tmp, fn)
 }
@@ -60,7 +60,7 @@ func TestFindFilesToImport(t *testing.T) {
 		{src: testDir + "/file2", dst: "dest/file2"},
 	}
 
-	got, err := c.findFilesToImport([]string{filepath.Join(testDir, "*")}, dest, true)
+	got, err := c.findFilesToImport([]string{filepath.Join(testDir, "*")}, dest, true, false)
 	if err != nil {
 		t.Fatalf("c.findFilesToImport('*'): %v", err)
 	}
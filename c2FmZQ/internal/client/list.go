@@ -37,17 +37,18 @@ import (
 
 // ListItem is the information returned by GlobFiles() for each item.
 type ListItem struct {
-	Filename  string         // c2FmZQ representation, e.g. album/ or album/file.jpg
-	IsDir     bool           // Whether this is a directory, i.e. gallery, trash, or album.
-	FilePath  string         // Path where the file content is stored.
-	ThumbPath string         // Path where the file thumbnail is stored.
-	FileSet   string         // Path where the FileSet is stored.
-	FSFile    stingle.File   // The stingle.File object for this item.
-	Size      int64          // The file size.
-	DirSize   int            // The number of items in the directory.
-	Set       string         // The Set value, i.e. "0" for gallery, "1" for trash, "2" for albums.
-	Album     *stingle.Album // Pointer to stingle.Album if this is part of an album.
-	LocalOnly bool           // Indicates that this item only exists locally.
+	Filename   string         // c2FmZQ representation, e.g. album/ or album/file.jpg
+	IsDir      bool           // Whether this is a directory, i.e. gallery, trash, or album.
+	FilePath   string         // Path where the file content is stored.
+	ThumbPath  string         // Path where the file thumbnail is stored.
+	FileSet    string         // Path where the FileSet is stored.
+	FSFile     stingle.File   // The stingle.File object for this item.
+	Size       int64          // The file size.
+	DirSize    int            // The number of items in the directory.
+	Set        string         // The Set value, i.e. "0" for gallery, "1" for trash, "2" for albums.
+	Album      *stingle.Album // Pointer to stingle.Album if this is part of an album.
+	LocalOnly  bool           // Indicates that this item only exists locally.
+	RemoteOnly bool           // Indicates that the file content hasn't been downloaded.
 }
 
 // GlobOptions contains options for GlobFiles and ListFiles.
@@ -399,16 +400,23 @@ func (c *Client) globStep(parent string, g *glob, n *node, li *[]ListItem) error
 				LocalOnly: n.local,
 			})
 		} else if n.file != nil {
+			fp := c.blobPath(n.file.f.File, false)
+			remoteOnly := false
+			if !n.local {
+				_, err := os.Stat(fp)
+				remoteOnly = errors.Is(err, os.ErrNotExist)
+			}
 			*li = append(*li, ListItem{
-				Filename:  filepath.Join(parent, n.name),
-				Size:      n.file.size,
-				FilePath:  c.blobPath(n.file.f.File, false),
-				ThumbPath: c.blobPath(n.file.f.File, true),
-				FileSet:   n.file.fileSet,
-				FSFile:    *n.file.f,
-				Set:       n.file.set,
-				Album:     n.file.album,
-				LocalOnly: n.local,
+				Filename:   filepath.Join(parent, n.name),
+				Size:       n.file.size,
+				FilePath:   fp,
+				ThumbPath:  c.blobPath(n.file.f.File, true),
+				FileSet:    n.file.fileSet,
+				FSFile:     *n.file.f,
+				Set:        n.file.set,
+				Album:      n.file.album,
+				LocalOnly:  n.local,
+				RemoteOnly: remoteOnly,
 			})
 		} else {
 			*li = append(*li, ListItem{
@@ -448,6 +456,9 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 			patterns[i] = p
 		}
 	}
+	if c.machineOutput() {
+		return c.listRecords(patterns, opt)
+	}
 	li, err := c.GlobFiles(patterns, opt)
 	if err != nil {
 		return err
@@ -467,6 +478,10 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
 		return err
 	}
+	pending, err := c.pendingByAlbum()
+	if err != nil {
+		return err
+	}
 
 	var expand []string
 	fileCount := 0
@@ -507,6 +522,9 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 				if item.LocalOnly {
 					s += ", Local"
 				}
+				if item.Album != nil && pending[item.Album.AlbumID] != nil {
+					s += ", Pending: " + strings.Join(pending[item.Album.AlbumID], ",")
+				}
 				c.Print(s)
 			}
 			continue
@@ -544,6 +562,9 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 		if item.LocalOnly {
 			local = " Local"
 		}
+		if item.RemoteOnly {
+			local = " Remote"
+		}
 		ms, _ := item.FSFile.DateCreated.Int64()
 		c.Printf("%*s %*d %s %s%s%s%s\n", -maxFilenameWidth,
 			strings.TrimPrefix(item.Filename, opt.trimPrefix), maxSizeWidth, item.Size,
@@ -19,10 +19,13 @@ package client_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/client"
 )
@@ -132,3 +135,60 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestListMachineOutput(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 1, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+
+	if err := c.SetOutputFormat("xml"); err == nil {
+		t.Error("SetOutputFormat(xml) didn't fail")
+	}
+	if err := c.SetOutputFormat(client.OutputJSON); err != nil {
+		t.Fatalf("SetOutputFormat: %v", err)
+	}
+	if err := c.ListFiles([]string{"gallery"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.ListFiles: %v", err)
+	}
+	var records []client.FileRecord
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Unexpected number of records: %#v", records)
+	}
+	for i, r := range records {
+		if want, got := fmt.Sprintf("gallery/image%03d.jpg", i+1), r.Path; want != got {
+			t.Errorf("Unexpected path. Want %q, got %q", want, got)
+		}
+		if r.Type != "file" || r.FileType != "photo" || r.Size != 789 || !r.LocalOnly {
+			t.Errorf("Unexpected record: %#v", r)
+		}
+		if _, err := time.Parse(time.RFC3339, r.Created); err != nil {
+			t.Errorf("Unexpected created time %q: %v", r.Created, err)
+		}
+	}
+
+	buf.Reset()
+	if err := c.SetOutputFormat(client.OutputCSV); err != nil {
+		t.Fatalf("SetOutputFormat: %v", err)
+	}
+	if err := c.ListFiles([]string{""}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.ListFiles: %v", err)
+	}
+	want := "path,type,size,files,fileType,created,localOnly,remoteOnly,shared,owner,members,permissions,pending,albumId\n" +
+		"gallery,dir,0,2,,,false,false,false,false,,,,\n"
+	if got := buf.String(); want != got {
+		t.Errorf("Unexpected CSV output. Want %q, got %q", want, got)
+	}
+}
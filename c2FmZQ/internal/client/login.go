@@ -44,6 +44,40 @@ const (
 
 // CreateAccount creates a new account on the remote server.
 func (c *Client) CreateAccount(server, email, password string, doBackup bool) error {
+	return c.createAccount("/v2/register/createAccount", server, email, password, doBackup, url.Values{})
+}
+
+// SetupOptions contains the instance options of the server's first-run setup.
+type SetupOptions struct {
+	// AllowCreateAccount, when set, controls whether new accounts can be
+	// created.
+	AllowCreateAccount *bool
+	// AutoApproveNewAccounts, when set, controls whether new accounts need
+	// an admin's approval.
+	AutoApproveNewAccounts *bool
+	// DefaultQuota, when set, is the default quota of the accounts, e.g.
+	// "100GB".
+	DefaultQuota string
+}
+
+// CompleteSetup creates the admin account of a server that is waiting for its
+// first-run setup. The setup token is logged by the server when it starts.
+func (c *Client) CompleteSetup(server, email, password, setupToken string, doBackup bool, opts SetupOptions) error {
+	form := url.Values{}
+	form.Set("setupToken", setupToken)
+	if v := opts.AllowCreateAccount; v != nil {
+		form.Set("allowCreateAccount", strconv.FormatBool(*v))
+	}
+	if v := opts.AutoApproveNewAccounts; v != nil {
+		form.Set("autoApproveNewAccounts", strconv.FormatBool(*v))
+	}
+	if opts.DefaultQuota != "" {
+		form.Set("defaultQuota", opts.DefaultQuota)
+	}
+	return c.createAccount("/v2x/setup/complete", server, email, password, doBackup, form)
+}
+
+func (c *Client) createAccount(endpoint, server, email, password string, doBackup bool, form url.Values) error {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
@@ -55,7 +89,6 @@ func (c *Client) CreateAccount(server, email, password string, doBackup bool) er
 		bundle = stingle.MakeSecretKeyBundle([]byte(password), sk)
 	}
 	pw := stingle.PasswordHashForLogin([]byte(password), salt)
-	form := url.Values{}
 	form.Set("email", email)
 	form.Set("password", pw)
 	form.Set("salt", strings.ToUpper(hex.EncodeToString(salt)))
@@ -65,7 +98,7 @@ func (c *Client) CreateAccount(server, email, password string, doBackup bool) er
 		form.Set("isBackup", "1")
 	}
 
-	sr, err := c.sendRequest("/v2/register/createAccount", form, server)
+	sr, err := c.sendRequest(endpoint, form, server)
 	if err != nil {
 		return err
 	}
@@ -187,6 +220,7 @@ func (c *Client) sendLogin(email, hashedPassword string) (*stingle.Response, err
 	form := url.Values{}
 	form.Set("email", email)
 	form.Set("password", hashedPassword)
+	form.Set("deviceName", deviceName())
 	sr, err := c.sendRequest("/v2/login/login", form, "")
 	if err != nil {
 		return nil, err
@@ -221,6 +255,7 @@ func (c *Client) sendLogin(email, hashedPassword string) (*stingle.Response, err
 	c.Account.UserID = id
 	c.Account.ServerPublicKey = stingle.PublicKeyFromBytes(pk)
 	c.Account.IsBackedUp = true
+	c.setStorageUsage(sr)
 	return sr, nil
 }
 
@@ -280,6 +315,7 @@ func (c *Client) ChangePassword(password, newPassword string, doBackup bool) err
 	form := url.Values{}
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
+	form.Set("deviceName", deviceName())
 
 	sr, err := c.sendRequest("/v2/login/changePass", form, "")
 	if err != nil {
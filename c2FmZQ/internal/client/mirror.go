@@ -0,0 +1,443 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// MirrorOptions contains the options of Mirror.
+type MirrorOptions struct {
+	// DryRun only shows what would be changed.
+	DryRun bool
+	// MaxDelete is the maximum number of remote files that can be moved to
+	// trash. A negative value means no limit.
+	MaxDelete int
+	// MaxDeletePercent is the maximum percentage of the remote files that
+	// can be moved to trash. 100 means no limit.
+	MaxDeletePercent int
+}
+
+// MirrorHashes contains the SHA256 hashes of the content of the files that
+// Mirror has seen, by file name. The content of a file never changes, so the
+// hashes only need to be computed once.
+type MirrorHashes struct {
+	Hashes map[string]string `json:"hashes"`
+}
+
+// mirrorSource is a local file to mirror.
+type mirrorSource struct {
+	src  string
+	dst  string
+	size int64
+	hash string
+}
+
+// Mirror makes dest exactly reflect the content of the local directory dir,
+// recursively. New files are imported, files that changed are updated, files
+// that were moved or renamed locally are moved, and files that no longer
+// exist locally are moved to trash. Files are matched by content, so moving
+// a file doesn't upload it again. Nothing is synced until the next sync.
+func (c *Client) Mirror(dir, dest string, opts MirrorOptions) (retErr error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	dest = strings.TrimSuffix(strings.ReplaceAll(dest, "\\", "/"), "/")
+	li, err := c.glob(dest, GlobOptions{ExactMatch: true})
+	if err != nil {
+		return err
+	}
+	if len(li) > 1 || (len(li) == 1 && !li[0].IsDir) {
+		return fmt.Errorf("destination must be a directory: %s", dest)
+	}
+	if len(li) == 1 && li[0].Set == stingle.TrashSet {
+		return fmt.Errorf("cannot mirror to trash: %s", dest)
+	}
+	remote := make(map[string]ListItem)
+	if len(li) == 1 {
+		dest = li[0].Filename
+		items, err := c.glob(dest+"/*", GlobOptions{ExactMatchExceptLast: true, MatchDot: true, Recursive: true})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.IsDir {
+				continue
+			}
+			if item.Album != nil && item.Album.IsOwner != "1" {
+				return fmt.Errorf("only the album owner can mirror to it: %s", item.Filename)
+			}
+			remote[item.Filename] = item
+		}
+	}
+
+	var local []*mirrorSource
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		local = append(local, &mirrorSource{
+			src:  p,
+			dst:  filepath.Join(dest, importedFileName(rel)),
+			size: fi.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hashes, err := c.mirrorHashes()
+	if err != nil {
+		return err
+	}
+	newHashes := make(map[string]string)
+	remoteHash := func(item ListItem) (string, error) {
+		if h, ok := hashes[item.FSFile.File]; ok {
+			return h, nil
+		}
+		h, err := c.contentHash(item)
+		if err != nil {
+			return "", err
+		}
+		hashes[item.FSFile.File] = h
+		newHashes[item.FSFile.File] = h
+		return h, nil
+	}
+	defer func() {
+		if len(newHashes) == 0 || opts.DryRun {
+			return
+		}
+		if err := c.saveMirrorHashes(newHashes); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	// The files that exist locally and remotely are unchanged or updated.
+	// The other local files are either moved from a remote file with the
+	// same content, or imported.
+	wanted := make(map[string]bool)
+	sizes := make(map[int64]bool)
+	var unchanged int
+	var toUpdate, toAdd []*mirrorSource
+	for _, f := range local {
+		wanted[f.dst] = true
+		item, ok := remote[f.dst]
+		if !ok {
+			sizes[f.size] = true
+			toAdd = append(toAdd, f)
+			continue
+		}
+		if item.Size == f.size {
+			if f.hash, err = localContentHash(f.src); err != nil {
+				return err
+			}
+			h, err := remoteHash(item)
+			if err != nil {
+				return err
+			}
+			if h == f.hash {
+				unchanged++
+				continue
+			}
+		}
+		toUpdate = append(toUpdate, f)
+	}
+	candidates := make(map[string][]ListItem)
+	var names []string
+	for name := range remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		item := remote[name]
+		if wanted[name] || !sizes[item.Size] {
+			continue
+		}
+		h, err := remoteHash(item)
+		if err != nil {
+			return err
+		}
+		candidates[h] = append(candidates[h], item)
+	}
+	type move struct {
+		item ListItem
+		dst  string
+	}
+	var toMove []move
+	var toImport []*mirrorSource
+	moved := make(map[string]bool)
+	for _, f := range toAdd {
+		if f.hash == "" && len(candidates) > 0 {
+			if f.hash, err = localContentHash(f.src); err != nil {
+				return err
+			}
+		}
+		if cand := candidates[f.hash]; len(cand) > 0 {
+			toMove = append(toMove, move{item: cand[0], dst: f.dst})
+			moved[cand[0].Filename] = true
+			candidates[f.hash] = cand[1:]
+			continue
+		}
+		toImport = append(toImport, f)
+	}
+	var toTrash []ListItem
+	for _, name := range names {
+		if !wanted[name] && !moved[name] {
+			toTrash = append(toTrash, remote[name])
+		}
+	}
+
+	if n := len(toTrash); n > 0 {
+		if opts.MaxDelete >= 0 && n > opts.MaxDelete {
+			return fmt.Errorf("mirror would move %d files to trash, more than the maximum of %d", n, opts.MaxDelete)
+		}
+		if opts.MaxDeletePercent < 100 && n*100 > opts.MaxDeletePercent*len(remote) {
+			return fmt.Errorf("mirror would move %d of %d files to trash, more than the maximum of %d%%", n, len(remote), opts.MaxDeletePercent)
+		}
+	}
+
+	if opts.DryRun {
+		for _, m := range toMove {
+			c.Printf("Would move %s -> %s\n", m.item.Filename, m.dst)
+		}
+		for _, f := range toUpdate {
+			c.Printf("Would update %s -> %s\n", f.src, f.dst)
+		}
+		for _, f := range toImport {
+			c.Printf("Would import %s -> %s\n", f.src, f.dst)
+		}
+		for _, item := range toTrash {
+			c.Printf("Would move %s to trash\n", item.Filename)
+		}
+		c.Printf("Mirror: %d unchanged, %d to move, %d to update, %d to import, %d to trash. Dry-run mode, nothing changed.\n", unchanged, len(toMove), len(toUpdate), len(toImport), len(toTrash))
+		return nil
+	}
+
+	for _, m := range toMove {
+		d, file := filepath.Split(m.dst)
+		di, err := c.mirrorDir(strings.TrimSuffix(d, "/"))
+		if err != nil {
+			return err
+		}
+		if err := c.moveFiles([]ListItem{m.item}, di, file, true); err != nil {
+			return err
+		}
+	}
+	for _, f := range toUpdate {
+		d, _ := filepath.Split(f.dst)
+		di, err := c.mirrorDir(strings.TrimSuffix(d, "/"))
+		if err != nil {
+			return err
+		}
+		pk, err := c.dirPK(di)
+		if err != nil {
+			return err
+		}
+		base := remote[f.dst]
+		c.Printf("Updating %s -> %s (not synced)\n", f.src, f.dst)
+		if err := c.importFile(f.src, di, pk, &base); err != nil {
+			return err
+		}
+	}
+	for _, f := range toImport {
+		d, _ := filepath.Split(f.dst)
+		di, err := c.mirrorDir(strings.TrimSuffix(d, "/"))
+		if err != nil {
+			return err
+		}
+		pk, err := c.dirPK(di)
+		if err != nil {
+			return err
+		}
+		c.Printf("Importing %s -> %s (not synced)\n", f.src, f.dst)
+		if err := c.importFile(f.src, di, pk, nil); err != nil {
+			return err
+		}
+	}
+	if len(toTrash) > 0 {
+		trash, err := c.glob(".trash", GlobOptions{})
+		if err != nil || len(trash) != 1 {
+			return err
+		}
+		groups := make(map[string][]ListItem)
+		for _, item := range toTrash {
+			groups[item.FileSet] = append(groups[item.FileSet], item)
+		}
+		for _, li := range groups {
+			if err := c.moveFiles(li, trash[0], "", true); err != nil {
+				return err
+			}
+		}
+	}
+	c.Printf("Mirror: %d unchanged, %d moved, %d updated, %d imported, %d trashed.\n", unchanged, len(toMove), len(toUpdate), len(toImport), len(toTrash))
+	return nil
+}
+
+// mirrorDir returns the directory with the given name. The album is created
+// if it doesn't exist yet.
+func (c *Client) mirrorDir(name string) (ListItem, error) {
+	li, err := c.glob(name, GlobOptions{ExactMatch: true})
+	if err != nil {
+		return ListItem{}, err
+	}
+	if len(li) > 1 || (len(li) == 1 && !li[0].IsDir) {
+		return ListItem{}, fmt.Errorf("%s is not a directory", name)
+	}
+	if len(li) == 1 && li[0].Set != "" {
+		return li[0], nil
+	}
+	if len(li) == 1 {
+		name = li[0].Filename
+	}
+	if _, err := c.addAlbum(name); err != nil {
+		return ListItem{}, err
+	}
+	if li, err = c.glob(name, GlobOptions{ExactMatch: true}); err != nil {
+		return ListItem{}, err
+	}
+	if len(li) != 1 {
+		return ListItem{}, fmt.Errorf("%s is not a directory", name)
+	}
+	return li[0], nil
+}
+
+// dirPK returns the public key to use for files in dir.
+func (c *Client) dirPK(dir ListItem) (stingle.PublicKey, error) {
+	if dir.Album != nil {
+		return dir.Album.PK()
+	}
+	return c.PublicKey(), nil
+}
+
+// mirrorHashes returns the content hashes that were already computed.
+func (c *Client) mirrorHashes() (map[string]string, error) {
+	var h MirrorHashes
+	if err := c.storage.ReadDataFile(c.fileHash(mirrorFile), &h); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if h.Hashes == nil {
+		h.Hashes = make(map[string]string)
+	}
+	return h.Hashes, nil
+}
+
+// saveMirrorHashes adds hashes to the content hashes. The hashes of the files
+// that no longer exist are removed.
+func (c *Client) saveMirrorHashes(hashes map[string]string) (retErr error) {
+	all, err := c.allFiles()
+	if err != nil {
+		return err
+	}
+	var h MirrorHashes
+	if err := c.storage.CreateEmptyFile(c.fileHash(mirrorFile), &MirrorHashes{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	commit, err := c.storage.OpenForUpdate(c.fileHash(mirrorFile), &h)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if h.Hashes == nil {
+		h.Hashes = make(map[string]string)
+	}
+	for k, v := range hashes {
+		h.Hashes[k] = v
+	}
+	for k := range h.Hashes {
+		if !all[k] {
+			delete(h.Hashes, k)
+		}
+	}
+	return commit(true, nil)
+}
+
+// contentHash returns the SHA256 hash of the content of item. The content is
+// downloaded if necessary.
+func (c *Client) contentHash(item ListItem) (string, error) {
+	sk := c.SecretKey()
+	hdr, err := item.Header(sk)
+	sk.Wipe()
+	if err != nil {
+		return "", err
+	}
+	defer hdr.Wipe()
+	if _, err := os.Stat(item.FilePath); errors.Is(err, os.ErrNotExist) {
+		if err := c.downloadFile(item); err != nil {
+			return "", err
+		}
+	}
+	in, err := os.Open(item.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if err := stingle.SkipHeader(in); err != nil {
+		return "", err
+	}
+	r := stingle.DecryptFile(bufio.NewReader(in), hdr)
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		log.Debugf("%s: %v", item.Filename, err)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localContentHash returns the SHA256 hash of the content of a local file.
+func localContentHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,148 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestMirror(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	write := func(name, content string) {
+		fn := filepath.Join(testdir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatalf("os.MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+	}
+	write("file1", "content of file1")
+	write("file3", "content of file3")
+	write("sub/file2", "content of file2")
+
+	opts := client.MirrorOptions{MaxDelete: -1, MaxDeletePercent: 10}
+	if err := c.Mirror(testdir, "backup", opts); err != nil {
+		t.Fatalf("c.Mirror: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	want := []string{
+		".trash",
+		"backup",
+		"backup/file1",
+		"backup/file3",
+		"backup/sub",
+		"backup/sub/file2",
+		"gallery",
+	}
+	if got, err := globAll(c); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected files: %v, %v, want %v", got, err, want)
+	}
+	li, err := c.GlobFiles([]string{"backup/file1"}, client.GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("c.GlobFiles: %v, %v", li, err)
+	}
+	file1 := li[0].FSFile.File
+	// Remote files are downloaded to compute their hashes.
+	if _, err := c.Free([]string{"backup/*"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+
+	if err := os.Rename(filepath.Join(testdir, "file1"), filepath.Join(testdir, "sub", "renamed")); err != nil {
+		t.Fatalf("os.Rename: %v", err)
+	}
+	write("file3", "CONTENT OF FILE3")
+	write("file4", "content of file4")
+	if err := os.Remove(filepath.Join(testdir, "sub", "file2")); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+
+	// One of the 3 files would be moved to trash.
+	if err := c.Mirror(testdir, "backup", opts); err == nil {
+		t.Fatal("c.Mirror succeeded with max-delete-percent=10")
+	}
+	opts.MaxDeletePercent = 100
+	opts.MaxDelete = 0
+	if err := c.Mirror(testdir, "backup", opts); err == nil {
+		t.Fatal("c.Mirror succeeded with max-delete=0")
+	}
+	opts.MaxDelete = 1
+	opts.DryRun = true
+	if err := c.Mirror(testdir, "backup", opts); err != nil {
+		t.Fatalf("c.Mirror(dryrun): %v", err)
+	}
+	if got, err := globAll(c); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Dry-run changed files: %v, %v, want %v", got, err, want)
+	}
+	opts.DryRun = false
+	if err := c.Mirror(testdir, "backup", opts); err != nil {
+		t.Fatalf("c.Mirror: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	want = []string{
+		".trash",
+		".trash/file2",
+		".trash/file3",
+		"backup",
+		"backup/file3",
+		"backup/file4",
+		"backup/sub",
+		"backup/sub/renamed",
+		"gallery",
+	}
+	if got, err := globAll(c); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected files: %v, %v, want %v", got, err, want)
+	}
+	// The renamed file was moved, not uploaded again.
+	if li, err := c.GlobFiles([]string{"backup/sub/renamed"}, client.GlobOptions{}); err != nil || len(li) != 1 || li[0].FSFile.File != file1 {
+		t.Errorf("backup/sub/renamed is not the same file: %v, %v", li, err)
+	}
+	exportDir := filepath.Join(t.TempDir(), "export")
+	if err := os.Mkdir(exportDir, 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	if _, err := c.ExportFiles([]string{"backup/file3"}, exportDir, false); err != nil {
+		t.Fatalf("c.ExportFiles: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(exportDir, "file3")); err != nil || string(got) != "CONTENT OF FILE3" {
+		t.Errorf("Unexpected content of file3: %q, %v", got, err)
+	}
+
+	// Nothing changed.
+	if err := c.Mirror(testdir, "backup", client.MirrorOptions{MaxDelete: 0, MaxDeletePercent: 0}); err != nil {
+		t.Fatalf("c.Mirror: %v", err)
+	}
+	if got, err := globAll(c); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected files: %v, %v, want %v", got, err, want)
+	}
+}
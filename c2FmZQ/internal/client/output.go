@@ -0,0 +1,301 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// Output formats.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputCSV  = "csv"
+)
+
+// FileRecord is the machine-readable representation of a file or directory
+// returned by ListFiles.
+type FileRecord struct {
+	Path        string   `json:"path"`
+	Type        string   `json:"type"`
+	Size        int64    `json:"size"`
+	Files       int      `json:"files"`
+	FileType    string   `json:"fileType,omitempty"`
+	Created     string   `json:"created,omitempty"`
+	LocalOnly   bool     `json:"localOnly"`
+	RemoteOnly  bool     `json:"remoteOnly"`
+	Shared      bool     `json:"shared"`
+	Owner       bool     `json:"owner"`
+	Members     []string `json:"members,omitempty"`
+	Permissions string   `json:"permissions,omitempty"`
+	Pending     []string `json:"pending,omitempty"`
+	AlbumID     string   `json:"albumId,omitempty"`
+}
+
+var fileRecordHeader = []string{"path", "type", "size", "files", "fileType", "created", "localOnly", "remoteOnly", "shared", "owner", "members", "permissions", "pending", "albumId"}
+
+func (r FileRecord) csv() []string {
+	return []string{
+		r.Path,
+		r.Type,
+		strconv.FormatInt(r.Size, 10),
+		strconv.Itoa(r.Files),
+		r.FileType,
+		r.Created,
+		strconv.FormatBool(r.LocalOnly),
+		strconv.FormatBool(r.RemoteOnly),
+		strconv.FormatBool(r.Shared),
+		strconv.FormatBool(r.Owner),
+		strings.Join(r.Members, ";"),
+		r.Permissions,
+		strings.Join(r.Pending, ";"),
+		r.AlbumID,
+	}
+}
+
+// ContactRecord is the machine-readable representation of a contact.
+type ContactRecord struct {
+	Email     string `json:"email"`
+	UserID    int64  `json:"userId"`
+	PublicKey string `json:"publicKey"`
+}
+
+var contactRecordHeader = []string{"email", "userId", "publicKey"}
+
+func (r ContactRecord) csv() []string {
+	return []string{r.Email, strconv.FormatInt(r.UserID, 10), r.PublicKey}
+}
+
+// SyncRecord is the machine-readable summary of a sync, written by Sync when
+// the output format is json.
+type SyncRecord struct {
+	DryRun bool `json:"dryRun"`
+	// The operations that were queued while the server was unreachable,
+	// and what happened to them.
+	PendingOperations []string `json:"pendingOperations"`
+	// The changes that were synced, or would be synced in dry-run mode.
+	AlbumsToCreate     []SyncAlbumRecord `json:"albumsToCreate"`
+	AlbumsToRename     []SyncAlbumRecord `json:"albumsToRename"`
+	AlbumPermsToChange []SyncAlbumRecord `json:"albumPermsToChange"`
+	AlbumsToDelete     []SyncAlbumRecord `json:"albumsToDelete"`
+	FilesToUpload      []SyncFileRecord  `json:"filesToUpload"`
+	FilesToMove        []SyncMoveRecord  `json:"filesToMove"`
+	FilesToDelete      []string          `json:"filesToDelete"`
+	// The uploads that were deferred by the sync schedule, and why.
+	DeferredUploads int    `json:"deferredUploads,omitempty"`
+	DeferReason     string `json:"deferReason,omitempty"`
+	// Whether the changes were synced, and when.
+	Synced   bool   `json:"synced"`
+	LastSync string `json:"lastSync,omitempty"`
+	// The number of files, and how many of them are remote-only.
+	Files           int `json:"files"`
+	RemoteOnlyFiles int `json:"remoteOnlyFiles"`
+}
+
+// SyncAlbumRecord is an album in a SyncRecord.
+type SyncAlbumRecord struct {
+	Name    string `json:"name"`
+	AlbumID string `json:"albumId"`
+}
+
+// SyncFileRecord is a file to upload in a SyncRecord.
+type SyncFileRecord struct {
+	Path    string `json:"path"`
+	AlbumID string `json:"albumId,omitempty"`
+	Size    int64  `json:"size"`
+	Created string `json:"created,omitempty"`
+}
+
+// SyncMoveRecord is a file to rename, move, or copy in a SyncRecord.
+type SyncMoveRecord struct {
+	Op          string `json:"op"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	AlbumIDFrom string `json:"albumIdFrom,omitempty"`
+	AlbumIDTo   string `json:"albumIdTo,omitempty"`
+}
+
+// SetOutputFormat sets the output format of the list, sync, and status
+// commands: text, json, or csv.
+func (c *Client) SetOutputFormat(f string) error {
+	switch f {
+	case "", OutputText:
+		c.output = OutputText
+	case OutputJSON, OutputCSV:
+		c.output = f
+	default:
+		return fmt.Errorf("invalid output format %q", f)
+	}
+	return nil
+}
+
+func (c *Client) machineOutput() bool {
+	return c.output == OutputJSON || c.output == OutputCSV
+}
+
+// writeRecords writes records in the current output format. records is
+// marshaled to JSON, and header and rows are used for CSV.
+func (c *Client) writeRecords(records interface{}, header []string, rows [][]string) error {
+	if c.output == OutputCSV {
+		w := csv.NewWriter(c.writer)
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		if err := w.WriteAll(rows); err != nil {
+			return err
+		}
+		return w.Error()
+	}
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	c.Print(string(b))
+	return nil
+}
+
+// isoTime converts a timestamp in milliseconds to ISO 8601 format.
+func isoTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+func fileTypeName(t uint8) string {
+	switch t {
+	case stingle.FileTypeGeneral:
+		return "general"
+	case stingle.FileTypePhoto:
+		return "photo"
+	case stingle.FileTypeVideo:
+		return "video"
+	default:
+		return "unknown"
+	}
+}
+
+// listRecords is like ListFiles, but writes the results in a machine-readable
+// format.
+func (c *Client) listRecords(patterns []string, opt GlobOptions) error {
+	li, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return err
+	}
+	if !opt.Directory && !opt.Recursive {
+		// Like ls, show the content of directories.
+		var expanded []ListItem
+		dopt := opt
+		dopt.Directory = true
+		dopt.Quiet = true
+		for _, item := range li {
+			if !item.IsDir {
+				expanded = append(expanded, item)
+				continue
+			}
+			sub, err := c.GlobFiles([]string{filepath.Join(item.Filename, "*")}, dopt)
+			if err != nil {
+				return err
+			}
+			expanded = append(expanded, sub...)
+		}
+		li = expanded
+	}
+	var cl ContactList
+	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
+		return err
+	}
+	pending, err := c.pendingByAlbum()
+	if err != nil {
+		return err
+	}
+	records := []FileRecord{}
+	var rows [][]string
+	for _, item := range li {
+		r := FileRecord{
+			Path:       item.Filename,
+			LocalOnly:  item.LocalOnly,
+			RemoteOnly: item.RemoteOnly,
+		}
+		if item.IsDir {
+			r.Type = "dir"
+			r.Files = item.DirSize
+		} else {
+			r.Type = "file"
+			r.Size = item.Size
+			sk := c.SecretKey()
+			hdr, err := item.Header(sk)
+			sk.Wipe()
+			if err != nil {
+				return err
+			}
+			r.FileType = fileTypeName(hdr.FileType)
+			hdr.Wipe()
+			if ms, err := item.FSFile.DateCreated.Int64(); err == nil {
+				r.Created = isoTime(ms)
+			}
+		}
+		if item.Album != nil {
+			r.AlbumID = item.Album.AlbumID
+		}
+		if a := item.Album; a != nil && item.IsDir {
+			r.Shared = a.IsShared == "1"
+			r.Owner = a.IsOwner == "1"
+			r.Permissions = a.Permissions
+			r.Pending = pending[a.AlbumID]
+			if r.Shared {
+				for _, m := range strings.Split(a.Members, ",") {
+					id, _ := strconv.ParseInt(m, 10, 64)
+					if c.Account != nil && id == c.Account.UserID {
+						r.Members = append(r.Members, c.Account.Email)
+						continue
+					}
+					if ct := cl.Contacts[id]; ct != nil {
+						r.Members = append(r.Members, ct.Email)
+					}
+				}
+				sort.Strings(r.Members)
+			}
+		}
+		records = append(records, r)
+		rows = append(rows, r.csv())
+	}
+	return c.writeRecords(records, fileRecordHeader, rows)
+}
+
+func (c *Client) contactRecords(show []*stingle.Contact) error {
+	records := []ContactRecord{}
+	var rows [][]string
+	for _, contact := range show {
+		r := ContactRecord{Email: contact.Email}
+		r.UserID, _ = contact.UserID.Int64()
+		if pk, err := contact.PK(); err == nil {
+			r.PublicKey = hex.EncodeToString(pk.ToBytes())
+		}
+		records = append(records, r)
+		rows = append(rows, r.csv())
+	}
+	return c.writeRecords(records, contactRecordHeader, rows)
+}
@@ -0,0 +1,193 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// Operations that can be queued while the server is unreachable.
+const (
+	opShare        = "share"
+	opUnshare      = "unshare"
+	opLeave        = "leave"
+	opRemoveMember = "remove-member"
+)
+
+// PendingOps is the list of operations that couldn't be sent to the server.
+// They are sent, in order, on the next sync.
+type PendingOps struct {
+	Ops []*PendingOp `json:"ops"`
+}
+
+// PendingOp is an operation that couldn't be sent to the server.
+type PendingOp struct {
+	Op          string            `json:"op"`
+	Desc        string            `json:"desc"`
+	AlbumID     string            `json:"albumId"`
+	Album       *stingle.Album    `json:"album,omitempty"`
+	SharingKeys map[string]string `json:"sharingKeys,omitempty"`
+	MemberID    int64             `json:"memberId,omitempty"`
+}
+
+// pendingOps returns the operations that are waiting to be sent to the
+// server.
+func (c *Client) pendingOps() (*PendingOps, error) {
+	var p PendingOps
+	if err := c.storage.ReadDataFile(c.fileHash(pendingFile), &p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// pendingByAlbum returns the names of the pending operations for each album.
+func (c *Client) pendingByAlbum() (map[string][]string, error) {
+	p, err := c.pendingOps()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]string)
+	for _, op := range p.Ops {
+		out[op.AlbumID] = append(out[op.AlbumID], op.Op)
+	}
+	return out, nil
+}
+
+// queueOp adds an operation to the pending queue.
+func (c *Client) queueOp(op *PendingOp) (retErr error) {
+	var p PendingOps
+	if err := c.storage.CreateEmptyFile(c.fileHash(pendingFile), &PendingOps{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	commit, err := c.storage.OpenForUpdate(c.fileHash(pendingFile), &p)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	p.Ops = append(p.Ops, op)
+	return commit(true, nil)
+}
+
+// syncStatus returns the status to show after an operation that was either
+// sent to the server or queued.
+func syncStatus(queued bool) string {
+	if queued {
+		return "pending"
+	}
+	return "synced"
+}
+
+// sendOrQueue sends an operation to the server. If the server is unreachable,
+// the operation is queued and sent on the next sync. Returns true if the
+// operation was queued.
+func (c *Client) sendOrQueue(op *PendingOp) (bool, error) {
+	p, err := c.pendingOps()
+	if err != nil {
+		return false, err
+	}
+	// Operations must be sent in order. If some are already queued, queue
+	// this one too.
+	if len(p.Ops) == 0 {
+		err := c.sendOp(op)
+		if err == nil || !errors.Is(err, ErrUnreachable) {
+			return false, err
+		}
+	}
+	return true, c.queueOp(op)
+}
+
+func (c *Client) sendOp(op *PendingOp) error {
+	switch op.Op {
+	case opShare:
+		return c.sendShare(op.Album, op.SharingKeys)
+	case opUnshare:
+		return c.sendUnshareAlbum(op.AlbumID)
+	case opLeave:
+		return c.sendLeaveAlbum(op.AlbumID)
+	case opRemoveMember:
+		return c.sendRemoveAlbumMember(op.Album, op.MemberID)
+	default:
+		return fmt.Errorf("unexpected operation %q", op.Op)
+	}
+}
+
+// flushPending sends all the pending operations to the server. Operations
+// that the server rejects are dropped. If the server becomes unreachable, the
+// remaining operations stay in the queue. In dryrun mode, the operations are
+// only shown. When rec isn't nil, the operations are recorded in it instead of
+// being shown.
+func (c *Client) flushPending(dryrun bool, rec *SyncRecord) (retErr error) {
+	var p PendingOps
+	commit, err := c.storage.OpenForUpdate(c.fileHash(pendingFile), &p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if len(p.Ops) == 0 {
+		return nil
+	}
+	show := func(desc string) {
+		if rec != nil {
+			rec.PendingOperations = append(rec.PendingOperations, desc)
+			return
+		}
+		c.Printf("* %s\n", desc)
+	}
+	if rec == nil {
+		c.Print("Pending operations:")
+	}
+	if dryrun {
+		for _, op := range p.Ops {
+			show(op.Desc)
+		}
+		return nil
+	}
+	var errList []string
+	for len(p.Ops) > 0 {
+		op := p.Ops[0]
+		err := c.sendOp(op)
+		if errors.Is(err, ErrUnreachable) {
+			if cerr := commit(true, nil); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		p.Ops = p.Ops[1:]
+		if err != nil {
+			show(fmt.Sprintf("%s: %v (dropped)", op.Desc, err))
+			errList = append(errList, err.Error())
+			continue
+		}
+		show(op.Desc + " (synced)")
+	}
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	if errList != nil {
+		return fmt.Errorf("pending operations failed: %s", strings.Join(errList, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server"
+)
+
+func TestPollInterval(t *testing.T) {
+	c, url, done := startServerWithOptions(t, func(s *server.Server) {
+		s.MinPollInterval = 5 * time.Minute
+	})
+	defer done()
+
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if got, want := c.PollInterval(time.Minute), time.Minute; got != want {
+		t.Errorf("PollInterval() = %s before updates, want %s", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.GetUpdates(true); err != nil {
+			t.Fatalf("GetUpdates: %v", err)
+		}
+		if got, want := c.PollInterval(time.Minute), 5*time.Minute; got != want {
+			t.Errorf("PollInterval() = %s, want %s", got, want)
+		}
+	}
+	if got, want := c.PollInterval(time.Hour), time.Hour; got != want {
+		t.Errorf("PollInterval() = %s, want %s", got, want)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	tt := &throttlingTransport{rt: hc.Transport, path: "/v2/sync/getUpdates", n: 1}
+	c.SetHTTPClient(&http.Client{Transport: tt})
+
+	start := time.Now()
+	if err := c.GetUpdates(true); err != nil {
+		t.Fatalf("GetUpdates: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("GetUpdates returned after %s, want at least 1s", elapsed)
+	}
+	if got, want := tt.calls, 2; got != want {
+		t.Errorf("Number of calls = %d, want %d", got, want)
+	}
+}
+
+// throttlingTransport rejects the first n requests to path with status 429
+// and a Retry-After header.
+type throttlingTransport struct {
+	rt   http.RoundTripper
+	path string
+
+	mu    sync.Mutex
+	n     int
+	calls int
+}
+
+func (t *throttlingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != t.path {
+		return t.rt.RoundTrip(req)
+	}
+	t.mu.Lock()
+	t.calls++
+	throttle := t.n > 0
+	t.n--
+	t.mu.Unlock()
+	if !throttle {
+		return t.rt.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return &http.Response{
+		Status:     "429 Too Many Requests",
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"1"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
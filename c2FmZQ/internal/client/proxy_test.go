@@ -0,0 +1,198 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+
+	var count int32
+	px := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:secret"))
+		if got := req.Header.Get("Proxy-Authorization"); got != want {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		atomic.AddInt32(&count, 1)
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer px.Close()
+
+	if err := c.SetProxy("http://bob:wrong@" + px.Listener.Addr().String()); err != nil {
+		t.Fatalf("SetProxy: %v", err)
+	}
+	if err := c.CreateAccount(url, "alice@", "pass", true); err == nil {
+		t.Fatal("CreateAccount with wrong proxy password succeeded")
+	}
+	if err := c.SetProxy("http://bob:secret@" + px.Listener.Addr().String()); err != nil {
+		t.Fatalf("SetProxy: %v", err)
+	}
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if n := atomic.LoadInt32(&count); n == 0 {
+		t.Error("No requests went through the proxy")
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	var count int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&count, 1)
+			go socks5Serve(conn, "bob", "secret")
+		}
+	}()
+
+	if err := c.SetProxy("socks5://bob:secret@" + l.Addr().String()); err != nil {
+		t.Fatalf("SetProxy: %v", err)
+	}
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if n := atomic.LoadInt32(&count); n == 0 {
+		t.Error("No connections went through the proxy")
+	}
+}
+
+func TestSetProxyErrors(t *testing.T) {
+	c, _, done := startServer(t)
+	defer done()
+
+	for _, u := range []string{"ftp://proxy:21", "socks5://", "http://%zz"} {
+		if err := c.SetProxy(u); err == nil {
+			t.Errorf("SetProxy(%q) succeeded", u)
+		}
+	}
+	if err := c.SetProxy(""); err != nil {
+		t.Errorf("SetProxy(\"\"): %v", err)
+	}
+}
+
+// socks5Serve implements just enough of RFC 1928 and RFC 1929 to serve one
+// CONNECT request with username/password authentication.
+func socks5Serve(conn net.Conn, user, pass string) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+	// Greeting: VER NMETHODS METHODS...
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// Auth: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	u := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, u); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	p := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return
+	}
+	if string(u) != user || string(p) != pass {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	dst, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer dst.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(dst, conn)
+	io.Copy(conn, dst)
+}
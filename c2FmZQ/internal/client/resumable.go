@@ -0,0 +1,199 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+var (
+	// ResumableUploadThreshold is the size above which the content of a
+	// file is uploaded in chunks, so that an interrupted upload can resume
+	// where it stopped.
+	ResumableUploadThreshold int64 = 32 << 20
+	// ResumableUploadChunkSize is the size of the chunks of resumable
+	// uploads.
+	ResumableUploadChunkSize int64 = 8 << 20
+)
+
+var errUploadNotFound = errors.New("upload session not found")
+
+// partialUpload is the state of a resumable upload. It is kept until the file
+// is added, so that the upload can resume after the client is restarted.
+type partialUpload struct {
+	// UploadID is the ID of the upload session on the server.
+	UploadID string `json:"uploadId"`
+	// Size is the size of the file content.
+	Size int64 `json:"size"`
+}
+
+// resumableUpload sends the content of file in chunks, continuing from where
+// a previous upload was interrupted, if possible. It returns the ID of the
+// complete upload session and the name of the state file, which the caller
+// should remove after the file is added.
+func (c *Client) resumableUpload(file string, size int64) (string, string, error) {
+	stateFile := c.fileHash(file + "-upload")
+	var state partialUpload
+	offset := int64(-1)
+	if err := c.storage.ReadDataFile(stateFile, &state); err == nil && state.UploadID != "" && state.Size == size {
+		if offset, err = c.uploadOffset(state.UploadID); err != nil {
+			log.Debugf("Can't resume upload of %s: %v", file, err)
+			offset = -1
+		}
+	}
+	if offset < 0 {
+		id, err := c.startUpload(size)
+		if err != nil {
+			return "", "", err
+		}
+		state = partialUpload{UploadID: id, Size: size}
+		if err := c.storage.SaveDataFile(stateFile, &state); err != nil {
+			return "", "", err
+		}
+		offset = 0
+	}
+
+	f, err := os.Open(c.blobPath(file, false))
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	for failures := 0; offset < size; {
+		n := ResumableUploadChunkSize
+		if n > size-offset {
+			n = size - offset
+		}
+		next, err := c.sendUploadChunk(state.UploadID, offset, io.NewSectionReader(f, offset, n))
+		if err != nil {
+			if failures++; failures >= maxAttempts {
+				return "", "", err
+			}
+			log.Debugf("Upload of chunk at offset %d failed: %v", offset, err)
+			// The server may have received some or all of the
+			// chunk. Ask where to resume.
+			if next, err = c.uploadOffset(state.UploadID); err != nil {
+				return "", "", err
+			}
+		} else {
+			failures = 0
+		}
+		offset = next
+	}
+	return state.UploadID, stateFile, nil
+}
+
+// startUpload starts a new resumable upload session.
+func (c *Client) startUpload(size int64) (string, error) {
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(map[string]string{
+		"size": strconv.FormatInt(size, 10),
+	}))
+	sr, err := c.sendRequest("/v2x/upload/create", form, "")
+	if err != nil {
+		return "", err
+	}
+	if sr.Status != "ok" {
+		return "", sr
+	}
+	id, ok := sr.Part("uploadId").(string)
+	if !ok || id == "" {
+		return "", fmt.Errorf("uploadId has unexpected type: %T", sr.Part("uploadId"))
+	}
+	return id, nil
+}
+
+// uploadOffset returns the offset where the next chunk of an upload session
+// must start.
+func (c *Client) uploadOffset(id string) (int64, error) {
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(map[string]string{
+		"uploadId": id,
+	}))
+	sr, err := c.sendRequest("/v2x/upload/status", form, "")
+	if err != nil {
+		return 0, err
+	}
+	if sr.Status != "ok" {
+		if sr.Part("notFound") == "1" {
+			return 0, errUploadNotFound
+		}
+		return 0, sr
+	}
+	return partInt64(sr, "offset")
+}
+
+// sendUploadChunk sends one chunk of an upload session, and returns the
+// offset where the next chunk must start.
+func (c *Client) sendUploadChunk(id string, offset int64, r io.Reader) (int64, error) {
+	sr, err := c.postMultipartResponse("/v2x/upload/chunk", func(w *multipart.Writer) error {
+		err := writeFormFields(w, []struct{ name, value string }{
+			{"token", c.Account.Token},
+			{"uploadId", id},
+			{"offset", strconv.FormatInt(offset, 10)},
+		})
+		if err != nil {
+			return err
+		}
+		pw, err := w.CreateFormFile("chunk", "chunk")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pw, r)
+		return err
+	})
+	// When the offset is wrong, the response is nok with the correct
+	// offset.
+	if sr != nil && sr.Part("offset") != nil {
+		return partInt64(sr, "offset")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, errors.New("server did not return an offset")
+}
+
+func partInt64(sr *stingle.Response, name string) (int64, error) {
+	switch v := sr.Part(name).(type) {
+	case json.Number:
+		return v.Int64()
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("%s has unexpected type: %T", name, v)
+	}
+}
+
+// removeUploadState removes the state file of a finished resumable upload.
+func (c *Client) removeUploadState(stateFile string) {
+	if err := os.Remove(filepath.Join(c.storage.Dir(), stateFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Remove(%q): %v", stateFile, err)
+	}
+}
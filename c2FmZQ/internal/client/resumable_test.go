@@ -0,0 +1,124 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestResumableUpload(t *testing.T) {
+	defer func(threshold, chunkSize int64) {
+		client.ResumableUploadThreshold = threshold
+		client.ResumableUploadChunkSize = chunkSize
+	}(client.ResumableUploadThreshold, client.ResumableUploadChunkSize)
+	client.ResumableUploadThreshold = 1 << 20
+	client.ResumableUploadChunkSize = 256 << 10
+
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	fn := filepath.Join(testdir, "video.bin")
+	content := make([]byte, 2<<20+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	if err := os.WriteFile(fn, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{fn}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	// The connection drops after 3 chunks.
+	ft := &failingTransport{rt: hc.Transport, path: "/v2x/upload/chunk", allow: 3}
+	c.SetHTTPClient(&http.Client{Transport: ft})
+	if err := c.Sync(false); err == nil {
+		t.Fatal("c.Sync should have failed")
+	}
+
+	// The upload resumes where it stopped.
+	ct := &countingTransport{rt: hc.Transport, sent: make(map[string]int64)}
+	c.SetHTTPClient(&http.Client{Transport: ct})
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	c.SetHTTPClient(hc)
+	if n := ct.sent["/v2x/upload/chunk"]; n == 0 || n > int64(len(content))-3*client.ResumableUploadChunkSize+10000 {
+		t.Errorf("Upload didn't resume: %v", ct.sent)
+	}
+	if n := ct.sent["/v2/sync/upload"]; n == 0 || n > 100000 {
+		t.Errorf("Unexpected upload size: %v", ct.sent)
+	}
+
+	// Download and export the file.
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	exportDir := filepath.Join(testdir, "export")
+	if err := os.Mkdir(exportDir, 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, true); err != nil || n != 1 {
+		t.Fatalf("c.ExportFiles() = %d, %v", n, err)
+	}
+	got, err := os.ReadFile(filepath.Join(exportDir, "video.bin"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("Exported file doesn't match the original")
+	}
+}
+
+// failingTransport fails all the requests to path after the first allow
+// requests.
+type failingTransport struct {
+	rt    http.RoundTripper
+	path  string
+	mu    sync.Mutex
+	allow int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == t.path {
+		t.mu.Lock()
+		ok := t.allow > 0
+		t.allow--
+		t.mu.Unlock()
+		if !ok {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, errors.New("connection reset")
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,163 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// SyncSchedule restricts when scheduled syncs upload files, e.g. to respect
+// a data cap. Metadata changes are always synced. Files that aren't uploaded
+// stay in the local storage and are uploaded by a later sync.
+type SyncSchedule struct {
+	// Windows are the daily time windows, in local time, during which files
+	// can be uploaded, e.g. "01:00-06:00". A window that ends before it
+	// starts wraps around midnight. When empty, files can be uploaded at any
+	// time.
+	Windows []string `json:"windows,omitempty"`
+	// MeteredCommand is a shell command that exits with status 0 when the
+	// network connection is metered, and with any other status when it
+	// isn't. Files are not uploaded on metered connections.
+	MeteredCommand string `json:"meteredCommand,omitempty"`
+}
+
+// SetSyncSchedule validates and sets the sync schedule. A nil schedule
+// removes all the restrictions. It is persisted with Save().
+func (c *Client) SetSyncSchedule(s *SyncSchedule) error {
+	if s != nil {
+		for _, w := range s.Windows {
+			if _, _, err := parseWindow(w); err != nil {
+				return err
+			}
+		}
+		if len(s.Windows) == 0 && s.MeteredCommand == "" {
+			s = nil
+		}
+	}
+	c.SyncSchedule = s
+	return nil
+}
+
+// SetMeteredFunc sets the function that tells whether the network connection
+// is metered. It replaces SyncSchedule.MeteredCommand.
+func (c *Client) SetMeteredFunc(f func() (bool, error)) {
+	c.isMetered = f
+}
+
+// ScheduledSync is like Sync, but files are only uploaded when the sync
+// schedule allows it.
+func (c *Client) ScheduledSync() error {
+	return c.sync(false, true)
+}
+
+// uploadsAllowed returns whether files can be uploaded now, and when they
+// can't, the reason why.
+func (c *Client) uploadsAllowed(now time.Time) (bool, string) {
+	s := c.SyncSchedule
+	if s == nil {
+		return true, ""
+	}
+	if len(s.Windows) > 0 {
+		var in bool
+		for _, w := range s.Windows {
+			if inWindow(w, now) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false, fmt.Sprintf("outside of sync windows %s", strings.Join(s.Windows, ", "))
+		}
+	}
+	isMetered := c.isMetered
+	if isMetered == nil && s.MeteredCommand != "" {
+		isMetered = func() (bool, error) {
+			return runMeteredCommand(s.MeteredCommand)
+		}
+	}
+	if isMetered != nil {
+		metered, err := isMetered()
+		if err != nil {
+			// Err on the side of caution. The data cap matters more than
+			// the delay.
+			log.Errorf("Metered connection check: %v", err)
+			return false, "metered connection check failed"
+		}
+		if metered {
+			return false, "metered connection"
+		}
+	}
+	return true, ""
+}
+
+func runMeteredCommand(cmd string) (bool, error) {
+	err := exec.Command("/bin/sh", "-c", cmd).Run()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return false, err
+}
+
+// parseWindow parses a time window like "22:30-06:00" and returns its start
+// and end as minutes since midnight.
+func parseWindow(w string) (start, end int, err error) {
+	from, to, ok := strings.Cut(w, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid sync window %q, want HH:MM-HH:MM", w)
+	}
+	if start, err = parseTimeOfDay(from); err != nil {
+		return 0, 0, fmt.Errorf("invalid sync window %q: %w", w, err)
+	}
+	if end, err = parseTimeOfDay(to); err != nil {
+		return 0, 0, fmt.Errorf("invalid sync window %q: %w", w, err)
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("invalid sync window %q: empty", w)
+	}
+	return start, end, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func inWindow(w string, now time.Time) bool {
+	start, end, err := parseWindow(w)
+	if err != nil {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
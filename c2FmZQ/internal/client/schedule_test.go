@@ -0,0 +1,117 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestScheduledSync(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	pendingUploads := func() int {
+		si, err := c.StatusInfo()
+		if err != nil {
+			t.Fatalf("c.StatusInfo: %v", err)
+		}
+		return si.PendingUploads
+	}
+
+	for _, w := range []string{"1:00", "01:00-01:00", "25:00-01:00", "01:00-xx"} {
+		if err := c.SetSyncSchedule(&client.SyncSchedule{Windows: []string{w}}); err == nil {
+			t.Errorf("SetSyncSchedule(%q) succeeded", w)
+		}
+	}
+
+	// A window that doesn't include the current time.
+	now := time.Now()
+	window := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	if err := c.SetSyncSchedule(&client.SyncSchedule{Windows: []string{window}}); err != nil {
+		t.Fatalf("SetSyncSchedule: %v", err)
+	}
+	if err := c.ScheduledSync(); err != nil {
+		t.Fatalf("c.ScheduledSync: %v", err)
+	}
+	if got, want := pendingUploads(), 3; got != want {
+		t.Errorf("Outside of window: pending uploads = %d, want %d", got, want)
+	}
+
+	// A window that includes the current time, on a metered connection.
+	window = now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	if err := c.SetSyncSchedule(&client.SyncSchedule{Windows: []string{window}}); err != nil {
+		t.Fatalf("SetSyncSchedule: %v", err)
+	}
+	metered := true
+	c.SetMeteredFunc(func() (bool, error) { return metered, nil })
+	if err := c.ScheduledSync(); err != nil {
+		t.Fatalf("c.ScheduledSync: %v", err)
+	}
+	if got, want := pendingUploads(), 3; got != want {
+		t.Errorf("Metered: pending uploads = %d, want %d", got, want)
+	}
+
+	metered = false
+	if err := c.ScheduledSync(); err != nil {
+		t.Fatalf("c.ScheduledSync: %v", err)
+	}
+	if got, want := pendingUploads(), 0; got != want {
+		t.Errorf("Unmetered: pending uploads = %d, want %d", got, want)
+	}
+}
+
+func TestSyncIgnoresSchedule(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.SetSyncSchedule(&client.SyncSchedule{MeteredCommand: "true"}); err != nil {
+		t.Fatalf("SetSyncSchedule: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	si, err := c.StatusInfo()
+	if err != nil {
+		t.Fatalf("c.StatusInfo: %v", err)
+	}
+	if si.PendingUploads != 0 {
+		t.Errorf("Pending uploads = %d, want 0", si.PendingUploads)
+	}
+}
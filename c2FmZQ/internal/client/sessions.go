@@ -0,0 +1,137 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Session is a device that is logged in to our account.
+type Session struct {
+	// The ID of the session, used to revoke it.
+	ID string `json:"id"`
+	// The name of the device, e.g. its user agent.
+	DeviceName string `json:"deviceName"`
+	// The IP address that the device used most recently.
+	IP string `json:"ip"`
+	// When the device logged in, in milliseconds.
+	Created int64 `json:"created"`
+	// When the device was last seen, in milliseconds.
+	LastSeen int64 `json:"lastSeen"`
+	// When the session expires, in milliseconds.
+	Expires int64 `json:"expires"`
+	// Whether this is our own session.
+	Current bool `json:"current"`
+}
+
+// deviceName returns the name of this device, sent to the server when we log
+// in.
+func deviceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "c2FmZQ-client"
+	}
+	return "c2FmZQ-client on " + host
+}
+
+// Sessions returns the devices that are logged in to our account, most
+// recently seen first.
+func (c *Client) Sessions() ([]Session, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	sr, err := c.sendRequest("/v2x/config/sessions/list", form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	var sessions []Session
+	if err := copyJSON(sr.Part("sessions"), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ShowSessions shows the devices that are logged in to our account, in the
+// current output format.
+func (c *Client) ShowSessions() error {
+	sessions, err := c.Sessions()
+	if err != nil {
+		return err
+	}
+	if c.output != OutputText {
+		var rows [][]string
+		for _, s := range sessions {
+			rows = append(rows, []string{s.ID, s.DeviceName, s.IP, isoTime(s.Created), isoTime(s.LastSeen), isoTime(s.Expires), fmt.Sprint(s.Current)})
+		}
+		return c.writeRecords(sessions, []string{"id", "deviceName", "ip", "created", "lastSeen", "expires", "current"}, rows)
+	}
+	if len(sessions) == 0 {
+		c.Print("No sessions.")
+		return nil
+	}
+	for _, s := range sessions {
+		var current string
+		if s.Current {
+			current = " (this device)"
+		}
+		c.Printf("%s %s %-15s %s%s\n", s.ID[:8], time.UnixMilli(s.LastSeen).Format("2006-01-02 15:04"), s.IP, s.DeviceName, current)
+	}
+	return nil
+}
+
+// RevokeSession logs out one of the devices that are logged in to our
+// account. id is the session ID, or a unique prefix of it.
+func (c *Client) RevokeSession(id string) error {
+	sessions, err := c.Sessions()
+	if err != nil {
+		return err
+	}
+	var match []Session
+	for _, s := range sessions {
+		if id != "" && strings.HasPrefix(s.ID, id) {
+			match = append(match, s)
+		}
+	}
+	if len(match) == 0 {
+		return fmt.Errorf("session not found: %s", id)
+	}
+	if len(match) > 1 {
+		return fmt.Errorf("ambiguous session ID: %s", id)
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("sessionId", match[0].ID)
+	sr, err := c.sendRequest("/v2x/config/sessions/revoke", form, "")
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	c.Printf("Session %s revoked.\n", match[0].ID[:8])
+	return nil
+}
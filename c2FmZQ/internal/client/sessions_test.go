@@ -0,0 +1,80 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	alice, url, done := startServer(t)
+	defer done()
+	if err := alice.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("alice.CreateAccount: %v", err)
+	}
+	phone, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := phone.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("phone.Login: %v", err)
+	}
+
+	sessions, err := alice.Sessions()
+	if err != nil {
+		t.Fatalf("alice.Sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("alice.Sessions() returned %d sessions, want 2: %+v", len(sessions), sessions)
+	}
+	var phoneID string
+	var current int
+	for _, s := range sessions {
+		if !strings.HasPrefix(s.DeviceName, "c2FmZQ-client") {
+			t.Errorf("DeviceName = %q", s.DeviceName)
+		}
+		if s.IP == "" || s.Created == 0 || s.LastSeen == 0 || s.Expires <= s.Created {
+			t.Errorf("Unexpected session: %+v", s)
+		}
+		if s.Current {
+			current++
+		} else {
+			phoneID = s.ID
+		}
+	}
+	if current != 1 {
+		t.Fatalf("%d current sessions, want 1", current)
+	}
+
+	if err := alice.RevokeSession("nonexistent"); err == nil {
+		t.Error("alice.RevokeSession(nonexistent) succeeded")
+	}
+	if err := alice.RevokeSession(phoneID[:8]); err != nil {
+		t.Fatalf("alice.RevokeSession: %v", err)
+	}
+	if _, err := phone.Sessions(); err == nil {
+		t.Error("phone.Sessions() succeeded after the session was revoked")
+	}
+	if sessions, err = alice.Sessions(); err != nil {
+		t.Fatalf("alice.Sessions: %v", err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("alice.Sessions() = %+v, want only the current session", sessions)
+	}
+}
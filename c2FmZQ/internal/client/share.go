@@ -18,6 +18,7 @@
 package client
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"c2FmZQ/internal/stingle"
 )
@@ -125,10 +127,12 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 			return err
 		}
 
-		if err := c.sendShare(album, sharingKeys); err != nil {
+		desc := fmt.Sprintf("Share %s with %s", item.Filename, strings.Join(shareWith, ", "))
+		queued, err := c.sendOrQueue(&PendingOp{Op: opShare, Desc: desc, AlbumID: album.AlbumID, Album: album, SharingKeys: sharingKeys})
+		if err != nil {
 			return err
 		}
-		c.Printf("Now sharing %s with %s. (synced)\n", item.Filename, strings.Join(shareWith, ", "))
+		c.Printf("Now sharing %s with %s. (%s)\n", item.Filename, strings.Join(shareWith, ", "), syncStatus(queued))
 	}
 	return nil
 }
@@ -157,14 +161,108 @@ func (c *Client) Unshare(patterns []string) error {
 		if !item.IsDir {
 			continue
 		}
-		if err := c.sendUnshareAlbum(item.Album.AlbumID); err != nil {
+		desc := fmt.Sprintf("Stop sharing %s", item.Filename)
+		queued, err := c.sendOrQueue(&PendingOp{Op: opUnshare, Desc: desc, AlbumID: item.Album.AlbumID})
+		if err != nil {
 			return err
 		}
-		c.Printf("Stopped sharing %s. (synced)\n", item.Filename)
+		c.Printf("Stopped sharing %s. (%s)\n", item.Filename, syncStatus(queued))
 	}
 	return nil
 }
 
+// ShareLink creates public share links for albums. Anyone with a link can see
+// the album, without an account, until the link expires. The album's secret key
+// is in the fragment of the link, which isn't sent to the server. Any previous
+// link for the album stops working.
+func (c *Client) ShareLink(patterns []string, ttl time.Duration) error {
+	li, err := c.ownedAlbums(patterns)
+	if err != nil {
+		return err
+	}
+	for _, item := range li {
+		params := map[string]string{"albumId": item.Album.AlbumID}
+		if ttl > 0 {
+			params["expires"] = strconv.FormatInt(time.Now().Add(ttl).UnixMilli(), 10)
+		}
+		sr, err := c.sendShareLink(params)
+		if err != nil {
+			return err
+		}
+		link, ok := sr.Part("url").(string)
+		if !ok {
+			return fmt.Errorf("url has unexpected type: %T", sr.Part("url"))
+		}
+		expires, err := partInt64(sr, "expires")
+		if err != nil {
+			return err
+		}
+		sk, err := c.SKForAlbum(item.Album)
+		if err != nil {
+			return err
+		}
+		link += "#" + base64.RawURLEncoding.EncodeToString(sk.ToBytes())
+		sk.Wipe()
+		c.Printf("%s: %s (expires %s)\n", item.Filename, link, time.UnixMilli(expires).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RevokeShareLink revokes the public share links of albums.
+func (c *Client) RevokeShareLink(patterns []string) error {
+	li, err := c.ownedAlbums(patterns)
+	if err != nil {
+		return err
+	}
+	for _, item := range li {
+		if _, err := c.sendShareLink(map[string]string{"albumId": item.Album.AlbumID, "revoke": "1"}); err != nil {
+			return err
+		}
+		c.Printf("Revoked the share link of %s.\n", item.Filename)
+	}
+	return nil
+}
+
+// ownedAlbums returns the albums matching patterns. They must all be owned by
+// the user.
+func (c *Client) ownedAlbums(patterns []string) ([]ListItem, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	li, err := c.GlobFiles(patterns, GlobOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var out []ListItem
+	for _, item := range li {
+		if !item.IsDir {
+			continue
+		}
+		if item.Album == nil {
+			return nil, fmt.Errorf("not an album: %s", item.Filename)
+		}
+		if item.Album.IsOwner != "1" {
+			return nil, fmt.Errorf("not owner: %s", item.Filename)
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+func (c *Client) sendShareLink(params map[string]string) (*stingle.Response, error) {
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+	sr, err := c.sendRequest("/v2x/sync/shareLink", form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
+
 // Leave removes an album that was shared with us.
 func (c *Client) Leave(patterns []string) error {
 	if c.Account == nil {
@@ -189,10 +287,12 @@ func (c *Client) Leave(patterns []string) error {
 		if !item.IsDir {
 			continue
 		}
-		if err := c.sendLeaveAlbum(item.Album.AlbumID); err != nil {
+		desc := fmt.Sprintf("Leave %s", item.Filename)
+		queued, err := c.sendOrQueue(&PendingOp{Op: opLeave, Desc: desc, AlbumID: item.Album.AlbumID})
+		if err != nil {
 			return err
 		}
-		c.Printf("Left %s. (synced)\n", item.Filename)
+		c.Printf("Left %s. (%s)\n", item.Filename, syncStatus(queued))
 	}
 	return nil
 }
@@ -253,10 +353,12 @@ func (c *Client) RemoveMembers(pattern string, toRemove []string) error {
 				continue
 			}
 			id, _ := strconv.ParseInt(sid, 10, 64)
-			if err := c.sendRemoveAlbumMember(album, id); err != nil {
+			desc := fmt.Sprintf("Remove %s from %s", cl.Contacts[id].Email, item.Filename)
+			queued, err := c.sendOrQueue(&PendingOp{Op: opRemoveMember, Desc: desc, AlbumID: album.AlbumID, Album: album, MemberID: id})
+			if err != nil {
 				return err
 			}
-			c.Printf("Removed %s from %s. (synced)\n", cl.Contacts[id].Email, item.Filename)
+			c.Printf("Removed %s from %s. (%s)\n", cl.Contacts[id].Email, item.Filename, syncStatus(queued))
 		}
 	}
 	return nil
@@ -326,11 +428,14 @@ L:
 			}
 		}
 	}
+	sort.Slice(show, func(i, j int) bool { return show[i].Email < show[j].Email })
+	if c.machineOutput() {
+		return c.contactRecords(show)
+	}
 	if show == nil {
 		c.Printf("No match.\n")
 		return nil
 	}
-	sort.Slice(show, func(i, j int) bool { return show[i].Email < show[j].Email })
 	c.Printf("Contacts:\n\n")
 	c.Printf("%*s %s\n", -maxSize, "Email", "Public Key")
 	for _, contact := range show {
@@ -0,0 +1,255 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// StorageUsage is the user's storage usage, as reported by the server.
+type StorageUsage struct {
+	SpaceUsed       int64 `json:"spaceUsed"`
+	SharedSpaceUsed int64 `json:"sharedSpaceUsed"`
+	Quota           int64 `json:"quota"`
+	GalleryFiles    int   `json:"galleryFiles"`
+	TrashFiles      int   `json:"trashFiles"`
+	AlbumFiles      int   `json:"albumFiles"`
+	Albums          int   `json:"albums"`
+}
+
+// setStorageUsage saves the storage usage from a server response, if it has
+// one.
+func (c *Client) setStorageUsage(sr *stingle.Response) {
+	if sr.Part("storage") == nil {
+		return
+	}
+	var su StorageUsage
+	if err := copyJSON(sr.Part("storage"), &su); err != nil {
+		log.Errorf("storage: %v", err)
+		return
+	}
+	c.Account.Storage = &su
+}
+
+// StatusInfo is a summary of the client's local and remote state.
+type StatusInfo struct {
+	LoggedIn    bool   `json:"loggedIn"`
+	Email       string `json:"email,omitempty"`
+	ServerURL   string `json:"serverUrl,omitempty"`
+	ProxyURL    string `json:"proxyUrl,omitempty"`
+	KeyBackedUp bool   `json:"keyBackedUp"`
+	PublicKey   string `json:"publicKey"`
+	// LastSync is the time of the last successful sync, in milliseconds.
+	LastSync int64 `json:"lastSync,omitempty"`
+	// Storage is the storage usage reported by the server at the last
+	// sync.
+	Storage *StorageUsage `json:"storage,omitempty"`
+
+	Files           int   `json:"files"`
+	LocalOnlyFiles  int   `json:"localOnlyFiles"`
+	RemoteOnlyFiles int   `json:"remoteOnlyFiles"`
+	CacheSize       int64 `json:"cacheSize"`
+
+	PendingUploads      int `json:"pendingUploads"`
+	PendingMoves        int `json:"pendingMoves"`
+	PendingDeletes      int `json:"pendingDeletes"`
+	PendingAlbumChanges int `json:"pendingAlbumChanges"`
+	PendingOperations   int `json:"pendingOperations"`
+	// InSync is true when the client is logged in, and has no local changes
+	// to sync.
+	InSync bool `json:"inSync"`
+}
+
+var statusInfoHeader = []string{"loggedIn", "email", "serverUrl", "proxyUrl", "keyBackedUp", "publicKey", "lastSync", "spaceUsed", "sharedSpaceUsed", "quota", "galleryFiles", "trashFiles", "albumFiles", "albums", "files", "localOnlyFiles", "remoteOnlyFiles", "cacheSize", "pendingUploads", "pendingMoves", "pendingDeletes", "pendingAlbumChanges", "pendingOperations", "inSync"}
+
+func (si StatusInfo) csv() []string {
+	var lastSync string
+	if si.LastSync != 0 {
+		lastSync = isoTime(si.LastSync)
+	}
+	var su StorageUsage
+	if si.Storage != nil {
+		su = *si.Storage
+	}
+	return []string{
+		strconv.FormatBool(si.LoggedIn),
+		si.Email,
+		si.ServerURL,
+		si.ProxyURL,
+		strconv.FormatBool(si.KeyBackedUp),
+		si.PublicKey,
+		lastSync,
+		strconv.FormatInt(su.SpaceUsed, 10),
+		strconv.FormatInt(su.SharedSpaceUsed, 10),
+		strconv.FormatInt(su.Quota, 10),
+		strconv.Itoa(su.GalleryFiles),
+		strconv.Itoa(su.TrashFiles),
+		strconv.Itoa(su.AlbumFiles),
+		strconv.Itoa(su.Albums),
+		strconv.Itoa(si.Files),
+		strconv.Itoa(si.LocalOnlyFiles),
+		strconv.Itoa(si.RemoteOnlyFiles),
+		strconv.FormatInt(si.CacheSize, 10),
+		strconv.Itoa(si.PendingUploads),
+		strconv.Itoa(si.PendingMoves),
+		strconv.Itoa(si.PendingDeletes),
+		strconv.Itoa(si.PendingAlbumChanges),
+		strconv.Itoa(si.PendingOperations),
+		strconv.FormatBool(si.InSync),
+	}
+}
+
+type fileStats struct {
+	total      int
+	localOnly  int
+	remoteOnly int
+	cacheSize  int64
+}
+
+// localFileStats counts the files, and the space used by their content in
+// the local storage.
+func (c *Client) localFileStats() (fileStats, error) {
+	var st fileStats
+	li, err := c.GlobFiles([]string{"*"}, GlobOptions{MatchDot: true, Recursive: true, Quiet: true})
+	if err != nil {
+		return st, err
+	}
+	seen := make(map[string]bool)
+	for _, item := range li {
+		if item.IsDir || seen[item.FSFile.File] {
+			continue
+		}
+		seen[item.FSFile.File] = true
+		st.total++
+		if item.LocalOnly {
+			st.localOnly++
+		}
+		if item.RemoteOnly {
+			st.remoteOnly++
+		}
+		for _, fn := range []string{item.FilePath, item.ThumbPath, item.FilePath + "-partial"} {
+			if fi, err := os.Stat(fn); err == nil {
+				st.cacheSize += fi.Size()
+			}
+		}
+	}
+	return st, nil
+}
+
+// StatusInfo returns a summary of the client's local and remote state.
+func (c *Client) StatusInfo() (*StatusInfo, error) {
+	si := &StatusInfo{
+		PublicKey: fmt.Sprintf("% X", c.PublicKey().ToBytes()),
+	}
+	if c.ProxyURL != "" {
+		si.ProxyURL = redactedProxyURL(c.ProxyURL)
+	}
+	if c.Account != nil {
+		si.LoggedIn = true
+		si.Email = c.Account.Email
+		si.ServerURL = c.Account.ServerBaseURL
+		si.KeyBackedUp = c.Account.IsBackedUp
+		si.LastSync = c.Account.LastSync
+		si.Storage = c.Account.Storage
+	}
+	st, err := c.localFileStats()
+	if err != nil {
+		return nil, err
+	}
+	si.Files = st.total
+	si.LocalOnlyFiles = st.localOnly
+	si.RemoteOnlyFiles = st.remoteOnly
+	si.CacheSize = st.cacheSize
+
+	d, err := c.diff()
+	if err != nil {
+		return nil, err
+	}
+	si.PendingUploads = len(d.FilesToAdd)
+	for _, m := range d.FilesToMove {
+		si.PendingMoves += len(m.files)
+	}
+	si.PendingDeletes = len(d.FilesToDelete)
+	si.PendingAlbumChanges = len(d.AlbumsToAdd) + len(d.AlbumsToRemove) + len(d.AlbumsToRename) + len(d.AlbumPermsToChange)
+
+	p, err := c.pendingOps()
+	if err != nil {
+		return nil, err
+	}
+	si.PendingOperations = len(p.Ops)
+	si.InSync = si.LoggedIn && si.PendingUploads+si.PendingMoves+si.PendingDeletes+si.PendingAlbumChanges+si.PendingOperations == 0
+	return si, nil
+}
+
+// Status shows the client's current status, in the current output format.
+func (c *Client) Status() error {
+	si, err := c.StatusInfo()
+	if err != nil {
+		return err
+	}
+	if c.machineOutput() {
+		return c.writeRecords(si, statusInfoHeader, [][]string{si.csv()})
+	}
+	if !si.LoggedIn {
+		c.Print("Not logged in.")
+	} else {
+		c.Printf("Logged in as %s on %s.\n", si.Email, si.ServerURL)
+		if si.ProxyURL != "" {
+			c.Printf("Proxy: %s\n", si.ProxyURL)
+		}
+		if si.KeyBackedUp {
+			c.Printf("Secret key is backed up.\n")
+		} else {
+			c.Printf("Secret key is NOT backed up.\n")
+		}
+		if si.LastSync == 0 {
+			c.Printf("Last sync: never\n")
+		} else {
+			c.Printf("Last sync: %s\n", time.UnixMilli(si.LastSync).Format("2006-01-02 15:04:05"))
+		}
+		if su := si.Storage; su != nil {
+			var pct int64
+			if su.Quota > 0 {
+				pct = 100 * su.SpaceUsed / su.Quota
+			}
+			c.Printf("Storage: %d of %d bytes used (%d%%), %d shared\n", su.SpaceUsed, su.Quota, pct, su.SharedSpaceUsed)
+			c.Printf("Remote files: %d in gallery, %d in trash, %d in %d albums\n", su.GalleryFiles, su.TrashFiles, su.AlbumFiles, su.Albums)
+		}
+	}
+	c.Printf("Public key: %s\n", si.PublicKey)
+	c.Printf("Files: %d, local-only: %d, remote-only: %d\n", si.Files, si.LocalOnlyFiles, si.RemoteOnlyFiles)
+	c.Printf("Cache size: %d bytes\n", si.CacheSize)
+	c.Printf("Pending changes: %d uploads, %d moves, %d deletes, %d album changes\n", si.PendingUploads, si.PendingMoves, si.PendingDeletes, si.PendingAlbumChanges)
+	if si.PendingOperations > 0 {
+		p, err := c.pendingOps()
+		if err != nil {
+			return err
+		}
+		c.Printf("Pending operations: %d\n", si.PendingOperations)
+		for _, op := range p.Ops {
+			c.Printf("* %s\n", op.Desc)
+		}
+	}
+	return nil
+}
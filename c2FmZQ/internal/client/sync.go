@@ -66,8 +66,24 @@ type MoveItem struct {
 }
 
 // Sync synchronizes all metadata changes that have been made locally with the
-// remote server.
+// remote server. Only metadata is fetched from the server. The content of the
+// files is downloaded when it is accessed, or with Pull. Operations that were
+// queued while the server was unreachable are sent first.
+//
+// With the json output format, a SyncRecord is written instead of the
+// human-readable output.
 func (c *Client) Sync(dryrun bool) error {
+	return c.sync(dryrun, false)
+}
+
+func (c *Client) sync(dryrun, scheduled bool) error {
+	var rec *SyncRecord
+	if c.output == OutputJSON {
+		rec = &SyncRecord{DryRun: dryrun}
+	}
+	if err := c.flushPending(dryrun, rec); err != nil {
+		return err
+	}
 	if err := c.GetUpdates(true); err != nil {
 		return err
 	}
@@ -75,66 +91,124 @@ func (c *Client) Sync(dryrun bool) error {
 	if err != nil {
 		return err
 	}
+	if scheduled && d.FilesToAdd != nil {
+		if ok, why := c.uploadsAllowed(time.Now()); !ok {
+			if rec != nil {
+				rec.DeferredUploads, rec.DeferReason = len(d.FilesToAdd), why
+			} else {
+				c.Printf("Deferring %d uploads: %s\n", len(d.FilesToAdd), why)
+			}
+			d.FilesToAdd = nil
+		}
+	}
 	if d.AlbumsToAdd == nil && d.AlbumsToRemove == nil && d.AlbumsToRename == nil && d.AlbumPermsToChange == nil &&
 		d.FilesToAdd == nil && d.FilesToMove == nil && d.FilesToDelete == nil {
-		c.Print("No changes to sync.")
-		return nil
+		if rec == nil {
+			c.Print("No changes to sync.")
+		}
+	} else {
+		if err := c.applyDiffs(d, dryrun, rec); err != nil {
+			return err
+		}
+		if dryrun && rec == nil {
+			c.Print("Dry-run mode, not synced.")
+			return nil
+		}
+		if !dryrun {
+			if err := c.GetUpdates(true); err != nil {
+				return err
+			}
+		}
+	}
+	if !dryrun {
+		c.Account.LastSync = nowInMS()
+		if err := c.Save(); err != nil {
+			return err
+		}
+	}
+	if rec == nil {
+		return c.showRemoteOnly()
+	}
+	if !dryrun {
+		rec.Synced = true
+		rec.LastSync = isoTime(c.Account.LastSync)
 	}
-	if err := c.applyDiffs(d, dryrun); err != nil {
+	if rec.Files, rec.RemoteOnlyFiles, err = c.RemoteOnlyCount(); err != nil {
 		return err
 	}
-	if dryrun {
-		c.Print("Dry-run mode, not synced.")
-		return nil
+	return c.writeRecords(rec, nil, nil)
+}
+
+// RemoteOnlyCount returns the number of files, and the number of files whose
+// content is only available on the remote server.
+func (c *Client) RemoteOnlyCount() (total, remote int, err error) {
+	st, err := c.localFileStats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return st.total, st.remoteOnly, nil
+}
+
+func (c *Client) showRemoteOnly() error {
+	total, remote, err := c.RemoteOnlyCount()
+	if err != nil {
+		return err
+	}
+	if remote > 0 {
+		c.Printf("%d of %d files are remote-only. They will be downloaded when accessed, or use pull to download them now.\n", remote, total)
 	}
-	return c.GetUpdates(true)
+	return nil
 }
 
-func (c *Client) applyDiffs(d *albumDiffs, dryrun bool) error {
+// applyDiffs shows the changes in d and, unless dryrun is true, applies them.
+// When rec isn't nil, the changes are recorded in it instead of being shown.
+func (c *Client) applyDiffs(d *albumDiffs, dryrun bool, rec *SyncRecord) error {
 	var al AlbumList
 	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
 		return err
 	}
 	if len(d.AlbumsToAdd) > 0 {
-		if err := c.applyAlbumsToAdd(d.AlbumsToAdd, dryrun); err != nil {
+		if err := c.applyAlbumsToAdd(d.AlbumsToAdd, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumsToRename) > 0 {
-		if err := c.applyAlbumsToRename(d.AlbumsToRename, dryrun); err != nil {
+		if err := c.applyAlbumsToRename(d.AlbumsToRename, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumPermsToChange) > 0 {
-		if err := c.applyAlbumPermsToChange(d.AlbumPermsToChange, dryrun); err != nil {
+		if err := c.applyAlbumPermsToChange(d.AlbumPermsToChange, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToAdd) > 0 {
-		if err := c.applyFilesToAdd(d.FilesToAdd, al, dryrun); err != nil {
+		if err := c.applyFilesToAdd(d.FilesToAdd, al, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToMove) > 0 {
-		if err := c.applyFilesToMove(d.FilesToMove, al, dryrun); err != nil {
+		if err := c.applyFilesToMove(d.FilesToMove, al, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToDelete) > 0 {
-		if err := c.applyFilesToDelete(d.FilesToDelete, al, dryrun); err != nil {
+		if err := c.applyFilesToDelete(d.FilesToDelete, al, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumsToRemove) > 0 {
-		if err := c.applyAlbumsToRemove(d.AlbumsToRemove, dryrun); err != nil {
+		if err := c.applyAlbumsToRemove(d.AlbumsToRemove, dryrun, rec); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyAlbumsToAdd(albums []*stingle.Album, dryrun bool) error {
-	c.showAlbumsToSync("Albums to create:", albums)
+func (c *Client) applyAlbumsToAdd(albums []*stingle.Album, dryrun bool, rec *SyncRecord) error {
+	if records, err := c.showAlbumsToSync("Albums to create:", albums, rec == nil); err == nil && rec != nil {
+		rec.AlbumsToCreate = records
+	}
 	if dryrun {
 		return nil
 	}
@@ -146,8 +220,10 @@ func (c *Client) applyAlbumsToAdd(albums []*stingle.Album, dryrun bool) error {
 	return nil
 }
 
-func (c *Client) applyAlbumsToRename(albums []*stingle.Album, dryrun bool) error {
-	c.showAlbumsToSync("Albums to rename:", albums)
+func (c *Client) applyAlbumsToRename(albums []*stingle.Album, dryrun bool, rec *SyncRecord) error {
+	if records, err := c.showAlbumsToSync("Albums to rename:", albums, rec == nil); err == nil && rec != nil {
+		rec.AlbumsToRename = records
+	}
 	if dryrun {
 		return nil
 	}
@@ -159,8 +235,10 @@ func (c *Client) applyAlbumsToRename(albums []*stingle.Album, dryrun bool) error
 	return nil
 }
 
-func (c *Client) applyAlbumPermsToChange(albums []*stingle.Album, dryrun bool) error {
-	c.showAlbumsToSync("Album permissions to change:", albums)
+func (c *Client) applyAlbumPermsToChange(albums []*stingle.Album, dryrun bool, rec *SyncRecord) error {
+	if records, err := c.showAlbumsToSync("Album permissions to change:", albums, rec == nil); err == nil && rec != nil {
+		rec.AlbumPermsToChange = records
+	}
 	if dryrun {
 		return nil
 	}
@@ -172,14 +250,16 @@ func (c *Client) applyAlbumPermsToChange(albums []*stingle.Album, dryrun bool) e
 	return nil
 }
 
-func (c *Client) applyFilesToAdd(files []FileLoc, al AlbumList, dryrun bool) error {
-	c.showFilesToSync("Files to upload:", files, al)
+func (c *Client) applyFilesToAdd(files []FileLoc, al AlbumList, dryrun bool, rec *SyncRecord) error {
+	if records, err := c.showFilesToSync("Files to upload:", files, al, rec == nil); err == nil && rec != nil {
+		rec.FilesToUpload = records
+	}
 	if dryrun {
 		return nil
 	}
 	qCh := make(chan FileLoc)
 	eCh := make(chan error)
-	for i := 0; i < 5; i++ {
+	for i := 0; i < c.numTransfers(len(files)); i++ {
 		go c.uploadWorker(qCh, eCh)
 	}
 	go func() {
@@ -200,8 +280,10 @@ func (c *Client) applyFilesToAdd(files []FileLoc, al AlbumList, dryrun bool) err
 	return nil
 }
 
-func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool) error {
-	c.Print("Files to move:")
+func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool, rec *SyncRecord) error {
+	if rec == nil {
+		c.Print("Files to move:")
+	}
 	for _, i := range moves {
 		src, err := c.translateSetAlbumIDToName(i.key.SetFrom, i.key.AlbumIDFrom, al)
 		if err != nil {
@@ -236,7 +318,12 @@ func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool) e
 			if err != nil {
 				n = f.File
 			}
-			c.Printf("* %s %s -> %s\n", op, filepath.Join(src, "["+f.File+"]"), filepath.Join(dst, sanitize(n)))
+			from, to := filepath.Join(src, "["+f.File+"]"), filepath.Join(dst, sanitize(n))
+			if rec != nil {
+				rec.FilesToMove = append(rec.FilesToMove, SyncMoveRecord{Op: op, From: from, To: to, AlbumIDFrom: i.key.AlbumIDFrom, AlbumIDTo: i.key.AlbumIDTo})
+				continue
+			}
+			c.Printf("* %s %s -> %s\n", op, from, to)
 		}
 	}
 	if dryrun {
@@ -250,10 +337,16 @@ func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool) e
 	return nil
 }
 
-func (c *Client) applyFilesToDelete(files []string, al AlbumList, dryrun bool) error {
-	c.Print("Files to delete:")
-	for _, f := range files {
-		c.Printf("* trash/%s\n", f)
+func (c *Client) applyFilesToDelete(files []string, al AlbumList, dryrun bool, rec *SyncRecord) error {
+	if rec != nil {
+		for _, f := range files {
+			rec.FilesToDelete = append(rec.FilesToDelete, "trash/"+f)
+		}
+	} else {
+		c.Print("Files to delete:")
+		for _, f := range files {
+			c.Printf("* trash/%s\n", f)
+		}
 	}
 	if dryrun {
 		return nil
@@ -264,8 +357,10 @@ func (c *Client) applyFilesToDelete(files []string, al AlbumList, dryrun bool) e
 	return nil
 }
 
-func (c *Client) applyAlbumsToRemove(albums []*stingle.Album, dryrun bool) error {
-	c.showAlbumsToSync("Albums to delete:", albums)
+func (c *Client) applyAlbumsToRemove(albums []*stingle.Album, dryrun bool, rec *SyncRecord) error {
+	if records, err := c.showAlbumsToSync("Albums to delete:", albums, rec == nil); err == nil && rec != nil {
+		rec.AlbumsToDelete = records
+	}
 	if dryrun {
 		return nil
 	}
@@ -283,35 +378,47 @@ func (c *Client) applyAlbumsToRemove(albums []*stingle.Album, dryrun bool) error
 	return nil
 }
 
-func (c *Client) showAlbumsToSync(label string, albums []*stingle.Album) error {
-	c.Print(label)
+// showAlbumsToSync returns the names of albums, and shows them if show is
+// true.
+func (c *Client) showAlbumsToSync(label string, albums []*stingle.Album, show bool) ([]SyncAlbumRecord, error) {
+	if show {
+		c.Print(label)
+	}
+	var records []SyncAlbumRecord
 	for _, a := range albums {
 		sk := c.SecretKey()
 		name, err := a.Name(sk)
 		sk.Wipe()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		records = append(records, SyncAlbumRecord{Name: sanitize(name), AlbumID: a.AlbumID})
+		if show {
+			c.Printf("* %s\n", sanitize(name))
 		}
-		c.Printf("* %s\n", sanitize(name))
 	}
-	return nil
+	return records, nil
 }
 
-func (c *Client) showFilesToSync(label string, files []FileLoc, al AlbumList) error {
-	c.Print(label)
+// showFilesToSync returns the paths of files, and shows them if show is true.
+func (c *Client) showFilesToSync(label string, files []FileLoc, al AlbumList, show bool) ([]SyncFileRecord, error) {
+	if show {
+		c.Print(label)
+	}
+	var records []SyncFileRecord
 	for _, f := range files {
 		sk := c.SecretKey()
 		if album, ok := al.Albums[f.AlbumID]; ok {
 			ask, err := album.SK(sk)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			sk.Wipe()
 			sk = ask
 		} else if album, ok := al.RemoteAlbums[f.AlbumID]; ok {
 			ask, err := album.SK(sk)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			sk.Wipe()
 			sk = ask
@@ -323,11 +430,21 @@ func (c *Client) showFilesToSync(label string, files []FileLoc, al AlbumList) er
 		}
 		d, err := c.translateSetAlbumIDToName(f.Set, f.AlbumID, al)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		r := SyncFileRecord{Path: sanitize(d) + "/" + sanitize(n), AlbumID: f.AlbumID}
+		if fi, err := os.Stat(c.blobPath(f.File.File, false)); err == nil {
+			r.Size = fi.Size()
+		}
+		if ms, err := f.File.DateCreated.Int64(); err == nil {
+			r.Created = isoTime(ms)
+		}
+		records = append(records, r)
+		if show {
+			c.Printf("* %s\n", r.Path)
 		}
-		c.Printf("* %s/%s\n", sanitize(d), sanitize(n))
 	}
-	return nil
+	return records, nil
 }
 
 func (c *Client) translateSetAlbumIDToName(set, albumID string, al AlbumList) (string, error) {
@@ -620,24 +737,14 @@ func (c *Client) diff() (*albumDiffs, error) {
 // Pull downloads all the files matching pattern that are not already present
 // in the local storage. Returns the number of files downloaded.
 func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
-	list, err := c.GlobFiles(patterns, opt)
+	files, err := c.filesToPull(patterns, opt)
 	if err != nil {
 		return 0, err
 	}
-	files := make(map[string]ListItem)
-	for _, item := range list {
-		if item.IsDir || item.LocalOnly {
-			continue
-		}
-		fn := c.blobPath(item.FSFile.File, false)
-		if _, err := os.Stat(fn); errors.Is(err, os.ErrNotExist) {
-			files[item.FSFile.File] = item
-		}
-	}
 
 	qCh := make(chan ListItem)
 	eCh := make(chan error)
-	for i := 0; i < 5; i++ {
+	for i := 0; i < c.numTransfers(len(files)); i++ {
 		go c.downloadWorker(qCh, eCh)
 	}
 	go func() {
@@ -663,6 +770,26 @@ func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
 	return count, nil
 }
 
+// filesToPull returns the files matching pattern whose content is not
+// already present in the local storage.
+func (c *Client) filesToPull(patterns []string, opt GlobOptions) (map[string]ListItem, error) {
+	list, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]ListItem)
+	for _, item := range list {
+		if item.IsDir || item.LocalOnly {
+			continue
+		}
+		fn := c.blobPath(item.FSFile.File, false)
+		if _, err := os.Stat(fn); errors.Is(err, os.ErrNotExist) {
+			files[item.FSFile.File] = item
+		}
+	}
+	return files, nil
+}
+
 // Free deletes all the files matching pattern that are already present in the
 // remote storage. Returns the number of files freed.
 func (c *Client) Free(patterns []string, opt GlobOptions) (int, error) {
@@ -716,117 +843,258 @@ func (c *Client) downloadWorker(ch <-chan ListItem, out chan<- error) {
 
 func (c *Client) uploadWorker(ch <-chan FileLoc, out chan<- error) {
 	for l := range ch {
-		out <- c.uploadFile(l)
+		out <- retryTransfer(l.File.File, func() error { return c.uploadFile(l) })
 	}
 }
 
+// partialDownload is the state of an interrupted download. The content that
+// was already received is in the blob file with a "-partial" suffix.
+type partialDownload struct {
+	// ETag is the entity tag of the remote file. It is used to make
+	// sure that the remote file didn't change before resuming.
+	ETag string `json:"etag"`
+}
+
 func (c *Client) downloadFile(li ListItem) error {
-	r, err := c.download(li.FSFile.File, li.Set, "0")
-	if err != nil {
-		return err
-	}
-	defer r.Close()
 	fn := c.blobPath(li.FSFile.File, false)
 	dir, _ := filepath.Split(fn)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
-	tmp := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
-	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	download := c.resumeDownload
+	if c.downloadConns > 1 {
+		download = c.parallelDownload
+	}
+	return retryTransfer(li.Filename, func() error { return download(li, fn) })
+}
+
+// resumeDownload downloads the content of a file, continuing from where a
+// previous download was interrupted, if possible.
+func (c *Client) resumeDownload(li ListItem, fn string) error {
+	partial := fn + "-partial"
+	stateFile := c.fileHash(li.FSFile.File + "-partial")
+	var state partialDownload
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil {
+		if err := c.storage.ReadDataFile(stateFile, &state); err == nil && state.ETag != "" {
+			offset = fi.Size()
+		}
+	}
+	url, err := c.downloadURL(li.FSFile.File, li.Set, false)
+	if err != nil {
+		return err
+	}
+	log.Debugf("SEND GET %v offset: %d", url, offset)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, r); err != nil {
+	req.Header.Set("User-Agent", userAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", state.ETag)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_SYNC
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset):
+		// The previous download was complete.
+		return c.finishDownload(partial, fn, stateFile)
+	default:
+		return fmt.Errorf("request returned status code %d for offset %d", resp.StatusCode, offset)
+	}
+	if etag := resp.Header.Get("ETag"); etag != state.ETag || resp.StatusCode == http.StatusOK {
+		state.ETag = etag
+		if err := c.storage.SaveDataFile(stateFile, &state); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(partial, flags, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
 		f.Close()
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	return os.Rename(tmp, fn)
+	return c.finishDownload(partial, fn, stateFile)
+}
+
+func (c *Client) finishDownload(partial, fn, stateFile string) error {
+	if err := os.Rename(partial, fn); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(c.storage.Dir(), stateFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
 func (c *Client) uploadFile(item FileLoc) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
-	pr, pw := io.Pipe()
-	w := multipart.NewWriter(pw)
-
-	go func() {
-		defer pw.Close()
-		for _, f := range []string{"file", "thumb"} {
-			pw, err := w.CreateFormFile(f, item.File.File)
-			if err != nil {
-				log.Errorf("multipart.CreateFormFile(%s): %v", item.File.File, err)
-				return
-			}
-			in, err := os.Open(c.blobPath(item.File.File, f == "thumb"))
-			if err != nil {
-				log.Errorf("Open(%s): %v", item.File.File, err)
-				return
-			}
-			if _, err := io.Copy(pw, in); err != nil {
-				log.Errorf("Read(%s): %v", item.File.File, err)
-				return
-			}
-			if err := in.Close(); err != nil {
-				log.Errorf("Close(%s): %v", item.File.File, err)
-				return
+	fps, err := c.fingerprints()
+	if err != nil {
+		return err
+	}
+	fp := fps[item.File.File]
+	vb, err := c.versionBase(item.File.File)
+	if err != nil {
+		return err
+	}
+	if vb != nil {
+		err := c.uploadDelta(item, vb, fp)
+		if err == nil {
+			if fp != "" {
+				if err := c.setFingerprint(item.File.File, ""); err != nil {
+					return err
+				}
 			}
+			return c.removeVersion(item.File.File)
+		}
+		log.Errorf("Delta upload of %s failed, uploading the whole file: %v", item.File.File, err)
+	}
+	// Large files are sent in chunks first, and then added with the ID of
+	// the upload session instead of the file content.
+	var uploadID, uploadState string
+	if fi, err := os.Stat(c.blobPath(item.File.File, false)); err == nil && fi.Size() > ResumableUploadThreshold {
+		if uploadID, uploadState, err = c.resumableUpload(item.File.File, fi.Size()); err != nil {
+			return err
 		}
-		for _, f := range []struct{ name, value string }{
+	}
+	sr, err := c.postMultipartResponse("/v2/sync/upload", func(w *multipart.Writer) error {
+		// The token and the file set come before the files, so that the
+		// server can reject the upload before receiving the content.
+		if err := writeFormFields(w, []struct{ name, value string }{
+			{"token", c.Account.Token},
 			{"headers", item.File.Headers},
 			{"set", item.Set},
 			{"albumId", item.AlbumID},
 			{"dateCreated", item.File.DateCreated.String()},
 			{"dateModified", item.File.DateModified.String()},
 			{"version", item.File.Version},
-			{"token", c.Account.Token},
-		} {
-			pw, err := w.CreateFormField(f.name)
-			if err != nil {
-				log.Errorf("Metadata(%s): %v", item.File.File, err)
-				return
-			}
-			if _, err := pw.Write([]byte(f.value)); err != nil {
-				log.Errorf("Metadata(%s): %v", item.File.File, err)
-				return
+			{"fingerprint", fp},
+		}); err != nil {
+			return err
+		}
+		if uploadID != "" {
+			if err := writeFormFields(w, []struct{ name, value string }{{"uploadId", uploadID}}); err != nil {
+				return err
 			}
+		} else if err := writeFormFile(w, "file", item.File.File, c.blobPath(item.File.File, false)); err != nil {
+			return err
 		}
-		if err := w.Close(); err != nil {
-			log.Errorf("multipart.Writer(%s): %v", item.File.File, err)
-			return
+		return writeFormFile(w, "thumb", item.File.File, c.blobPath(item.File.File, true))
+	})
+	if err == nil {
+		err = checkUploadDigests(sr, map[string]string{
+			"fileDigest":  c.blobPath(item.File.File, false),
+			"thumbDigest": c.blobPath(item.File.File, true),
+		})
+	}
+	if uploadState != "" && err == nil {
+		c.removeUploadState(uploadState)
+	}
+	if fp != "" && err == nil {
+		err = c.setFingerprint(item.File.File, "")
+	}
+	if err != nil || vb == nil {
+		return err
+	}
+	return c.removeVersion(item.File.File)
+}
+
+func writeFormFile(w *multipart.Writer, name, filename, path string) error {
+	pw, err := w.CreateFormFile(name, filename)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(pw, in)
+	return err
+}
+
+func writeFormFields(w *multipart.Writer, fields []struct{ name, value string }) error {
+	for _, f := range fields {
+		pw, err := w.CreateFormField(f.name)
+		if err != nil {
+			return err
 		}
+		if _, err := pw.Write([]byte(f.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postMultipart sends a multipart/form-data request to the server. The
+// content is streamed from the write function.
+func (c *Client) postMultipart(endpoint string, write func(w *multipart.Writer) error) error {
+	_, err := c.postMultipartResponse(endpoint, write)
+	return err
+}
+
+// postMultipartResponse is like postMultipart, but it also returns the
+// server's response, when there is one.
+func (c *Client) postMultipartResponse(endpoint string, write func(w *multipart.Writer) error) (*stingle.Response, error) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		err := write(w)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			log.Errorf("%s: %v", endpoint, err)
+		}
+		pw.CloseWithError(err)
 	}()
 
-	url := strings.TrimSuffix(c.Account.ServerBaseURL, "/") + "/v2/sync/upload"
+	url := strings.TrimSuffix(c.Account.ServerBaseURL, "/") + endpoint
 
 	req, err := http.NewRequest("POST", url, pr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", w.FormDataContentType())
 	req.Header.Set("User-Agent", userAgent)
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request returned status code %d", resp.StatusCode)
+		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
 	}
 	dec := json.NewDecoder(resp.Body)
 	dec.UseNumber()
 	var sr stingle.Response
 	if err := dec.Decode(&sr); err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("Response: %v", sr)
 	if sr.Status != "ok" {
-		return sr
+		return &sr, sr
 	}
-	return nil
+	return &sr, nil
 }
 
 func (c *Client) sendAddAlbum(album *stingle.Album) error {
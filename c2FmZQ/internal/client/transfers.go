@@ -0,0 +1,118 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// defaultTransfers is the number of files that are uploaded or downloaded at
+// the same time, unless it is changed with SetTransfers.
+const defaultTransfers = 5
+
+// SetTransfers sets the number of files that are uploaded or downloaded at
+// the same time by sync and pull. More transfers can use more of the
+// available bandwidth when there are many small files. The setting only
+// applies to the current session.
+func (c *Client) SetTransfers(n int) {
+	c.transfers = n
+}
+
+// numTransfers returns the number of workers to use to transfer n files.
+func (c *Client) numTransfers(n int) int {
+	t := c.transfers
+	if t <= 0 {
+		t = defaultTransfers
+	}
+	if t > n {
+		t = n
+	}
+	return t
+}
+
+// retryTransfer calls f until it succeeds, up to maxAttempts times, waiting
+// RetryDelay before the first retry, and twice as long before each following
+// one. The transfers that the server rejected aren't retried.
+func retryTransfer(name string, f func() error) error {
+	delay := RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		var sr stingle.Response
+		if attempt >= maxAttempts || errors.As(err, &sr) || errors.Is(err, ErrNotLoggedIn) {
+			return err
+		}
+		log.Debugf("Transfer of %s failed: %v (attempt %d)", name, err, attempt)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// errDigestMismatch means that the content that the server stored isn't the
+// same as the content that was uploaded, e.g. because it was corrupted in
+// transit. The upload is retried.
+var errDigestMismatch = errors.New("digest mismatch")
+
+// checkUploadDigests compares the digests returned by the server after an
+// upload with the digests of the local files, keyed by response part, e.g.
+// "fileDigest". Servers that don't return the digests aren't checked.
+func checkUploadDigests(sr *stingle.Response, files map[string]string) error {
+	for part, fn := range files {
+		want, ok := sr.Part(part).(string)
+		if !ok {
+			continue
+		}
+		got, err := fileDigest(fn)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("%s: %w", part, errDigestMismatch)
+		}
+	}
+	return nil
+}
+
+// fileDigest returns the BLAKE2b-256 digest of a file, hex encoded.
+func fileDigest(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
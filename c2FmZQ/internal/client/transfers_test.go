@@ -0,0 +1,160 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+)
+
+func TestParallelTransfersWithRetries(t *testing.T) {
+	testdir := t.TempDir()
+	log.Record = t.Log
+	log.Level = 2
+	client.RetryDelay = time.Millisecond
+	db := database.New(filepath.Join(testdir, "data"), nil)
+	s := server.New(db, "", "", "")
+	s.AllowCreateAccount = true
+	s.AutoApproveNewAccounts = true
+
+	// The first uploads and downloads fail. No file can fail more than
+	// twice.
+	var mu sync.Mutex
+	failed := make(map[string]int)
+	h := s.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" || strings.HasSuffix(req.URL.Path, "/v2/sync/upload") {
+			mu.Lock()
+			fail := failed[req.Method] < 2
+			if fail {
+				failed[req.Method]++
+			}
+			mu.Unlock()
+			if fail {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	s.BaseURL = srv.URL + "/"
+	hc = srv.Client()
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c.CreateAccount(srv.URL, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	c.SetTransfers(3)
+
+	imgdir := t.TempDir()
+	if err := makeImages(imgdir, 0, 10); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(imgdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if n, err := c.Free([]string{"gallery"}, client.GlobOptions{Recursive: true}); err != nil || n != 10 {
+		t.Fatalf("Free() = %d, %v", n, err)
+	}
+	if n, err := c.Pull([]string{"gallery"}, client.GlobOptions{Recursive: true}); err != nil || n != 10 {
+		t.Fatalf("Pull() = %d, %v", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if failed["GET"] != 2 || failed["POST"] != 2 {
+		t.Errorf("Unexpected failures: %v", failed)
+	}
+}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	testdir := t.TempDir()
+	log.Record = t.Log
+	log.Level = 2
+	client.RetryDelay = time.Millisecond
+	db := database.New(filepath.Join(testdir, "data"), nil)
+	s := server.New(db, "", "", "")
+	s.AllowCreateAccount = true
+	s.AutoApproveNewAccounts = true
+
+	// The digest returned for the first upload doesn't match, as if the
+	// content was corrupted on the way.
+	var mu sync.Mutex
+	uploads := 0
+	h := s.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, "/v2/sync/upload") {
+			h.ServeHTTP(w, req)
+			return
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.Bytes()
+		mu.Lock()
+		uploads++
+		if uploads == 1 {
+			body = bytes.Replace(body, []byte(`"fileDigest":"`), []byte(`"fileDigest":"00`), 1)
+		}
+		mu.Unlock()
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}))
+	defer srv.Close()
+	s.BaseURL = srv.URL + "/"
+	hc = srv.Client()
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c.CreateAccount(srv.URL, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	imgdir := t.TempDir()
+	if err := makeImages(imgdir, 0, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(imgdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if uploads != 2 {
+		t.Errorf("Uploads = %d, want 2", uploads)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
@@ -475,6 +476,12 @@ func (c *Client) GetUpdates(quiet bool) error {
 	if sr.Status != "ok" {
 		return sr
 	}
+	c.pollInterval = 0
+	if v, ok := sr.Part("pollInterval").(string); ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			c.pollInterval = time.Duration(n) * time.Second
+		}
+	}
 
 	var albums []stingle.Album
 	if err := copyJSON(sr.Part("albums"), &albums); err != nil {
@@ -523,6 +530,10 @@ func (c *Client) GetUpdates(quiet bool) error {
 	if err := c.processDeleteUpdates(deletes); err != nil {
 		return err
 	}
+	c.setStorageUsage(sr)
+	if err := c.Save(); err != nil {
+		return err
+	}
 
 	if !quiet {
 		fmt.Fprintln(c.writer, "Metadata synced successfully.")
@@ -41,6 +41,12 @@ var (
 )
 
 func startServer(t *testing.T) (*client.Client, string, func()) {
+	return startServerWithOptions(t, nil)
+}
+
+// startServerWithOptions is like startServer. If opts isn't nil, it is called
+// to change the server's options before it starts.
+func startServerWithOptions(t *testing.T, opts func(*server.Server)) (*client.Client, string, func()) {
 	testdir := t.TempDir()
 	log.Record = t.Log
 	log.Level = 2
@@ -48,8 +54,12 @@ func startServer(t *testing.T) (*client.Client, string, func()) {
 	s := server.New(db, "", "", "")
 	s.AllowCreateAccount = true
 	s.AutoApproveNewAccounts = true
+	if opts != nil {
+		opts(s)
+	}
 
 	srv := httptest.NewServer(s.Handler())
+	s.BaseURL = srv.URL + "/"
 	hc = srv.Client()
 	c, err := newClient(t.TempDir())
 	if err != nil {
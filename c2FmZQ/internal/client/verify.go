@@ -0,0 +1,225 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// RestoreReport is the result of VerifyLocal. It is signed with a key that is
+// derived from the account's secret key, so that it can be checked later with
+// CheckRestoreReport.
+type RestoreReport struct {
+	Account   string              `json:"account"`
+	Date      string              `json:"date"`
+	FullHash  bool                `json:"fullHash"`
+	Total     int                 `json:"total"`
+	OK        int                 `json:"ok"`
+	Failed    int                 `json:"failed"`
+	Files     []RestoreReportFile `json:"files"`
+	PublicKey string              `json:"publicKey"`
+	Signature string              `json:"signature,omitempty"`
+}
+
+// RestoreReportFile is the verification result of one file.
+type RestoreReportFile struct {
+	Filename string `json:"filename"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// VerifyLocal checks that the content of the files matching patterns is on
+// disk, e.g. after a full restore with Pull. For each file, the header must
+// be decryptable and match the file's metadata, and the file must have the
+// expected size. With fullHash, the whole file is also decrypted, which
+// authenticates every chunk, and its SHA256 hash is included in the report.
+func (c *Client) VerifyLocal(patterns []string, opt GlobOptions, fullHash bool) (*RestoreReport, error) {
+	list, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return nil, err
+	}
+	r := &RestoreReport{
+		Date:     time.Now().UTC().Format(time.RFC3339),
+		FullHash: fullHash,
+	}
+	if c.Account != nil {
+		r.Account = c.Account.Email
+	}
+	for _, item := range list {
+		if item.IsDir {
+			continue
+		}
+		f := RestoreReportFile{
+			Filename: item.Filename,
+			File:     item.FSFile.File,
+			Size:     item.Size,
+		}
+		hash, err := c.verifyLocalFile(item, fullHash)
+		if err != nil {
+			f.Error = err.Error()
+			c.Printf("FAILED %s: %v\n", item.Filename, err)
+			r.Failed++
+		} else {
+			f.SHA256 = hash
+			r.OK++
+		}
+		r.Total++
+		r.Files = append(r.Files, f)
+	}
+	if err := c.signRestoreReport(r); err != nil {
+		return nil, err
+	}
+	c.Printf("Verified %d files: %d OK, %d failed.\n", r.Total, r.OK, r.Failed)
+	return r, nil
+}
+
+// verifyLocalFile checks the content of one file. It returns the SHA256 hash
+// of the decrypted content, with fullHash.
+func (c *Client) verifyLocalFile(item ListItem, fullHash bool) (string, error) {
+	in, err := os.Open(item.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errors.New("missing")
+	}
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	hdr, err := item.Header(sk)
+	if err != nil {
+		return "", fmt.Errorf("metadata header: %w", err)
+	}
+	defer hdr.Wipe()
+	fileSK := sk
+	if item.Album != nil {
+		ask, err := item.Album.SK(sk)
+		if err != nil {
+			return "", err
+		}
+		defer ask.Wipe()
+		fileSK = ask
+	}
+	blobHdr, err := stingle.DecryptHeader(in, fileSK)
+	if err != nil {
+		return "", fmt.Errorf("header: %w", err)
+	}
+	defer blobHdr.Wipe()
+	if !bytes.Equal(blobHdr.FileID, hdr.FileID) || blobHdr.DataSize != hdr.DataSize {
+		return "", errors.New("header doesn't match the metadata")
+	}
+	hdrSize, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	if want := hdrSize + encryptedSize(hdr); fi.Size() != want {
+		return "", fmt.Errorf("size is %d, expected %d", fi.Size(), want)
+	}
+	if !fullHash {
+		return "", nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, stingle.DecryptFile(bufio.NewReader(in), hdr))
+	if err != nil {
+		return "", fmt.Errorf("decryption failed: %w", err)
+	}
+	if n != hdr.DataSize {
+		return "", fmt.Errorf("decrypted %d bytes, expected %d", n, hdr.DataSize)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encryptedSize returns the size of the encrypted content, without the
+// header.
+func encryptedSize(hdr *stingle.Header) int64 {
+	chunkSize := int64(hdr.ChunkSize)
+	if chunkSize <= 0 {
+		return hdr.DataSize
+	}
+	chunks := (hdr.DataSize + chunkSize - 1) / chunkSize
+	return hdr.DataSize + chunks*encChunkOverhead
+}
+
+// reportSigningKey returns the key used to sign restore reports.
+func (c *Client) reportSigningKey() ed25519.PrivateKey {
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	h := sha256.New()
+	h.Write([]byte("c2FmZQ restore report\x00"))
+	h.Write(sk.ToBytes())
+	return ed25519.NewKeyFromSeed(h.Sum(nil))
+}
+
+func (c *Client) signRestoreReport(r *RestoreReport) error {
+	key := c.reportSigningKey()
+	r.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	r.Signature = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, b))
+	return nil
+}
+
+// CheckRestoreReport checks that a report was created by VerifyLocal with the
+// same account, and that it wasn't modified since.
+func (c *Client) CheckRestoreReport(data []byte) (*RestoreReport, error) {
+	var r RestoreReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	pk := c.reportSigningKey().Public().(ed25519.PublicKey)
+	if r.PublicKey != base64.StdEncoding.EncodeToString(pk) {
+		return nil, errors.New("the report was signed by another account")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := r
+	unsigned.Signature = ""
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pk, b, sig) {
+		return nil, errors.New("invalid signature")
+	}
+	return &r, nil
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestVerifyLocal(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	hashes := make(map[string]string)
+	for _, f := range []struct {
+		name string
+		size int
+	}{{"file1", 100}, {"file2", 3<<20 + 1000}, {"file3", 0}} {
+		content := make([]byte, f.size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatalf("rand.Read: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(testdir, f.name), content, 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		h := sha256.Sum256(content)
+		hashes["album/"+f.name] = hex.EncodeToString(h[:])
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"*"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	if _, err := c.Pull([]string{"*"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.Pull: %v", err)
+	}
+
+	r, err := c.VerifyLocal([]string{"*"}, client.GlobOptions{Recursive: true}, true)
+	if err != nil {
+		t.Fatalf("c.VerifyLocal: %v", err)
+	}
+	if r.Total != 3 || r.OK != 3 || r.Failed != 0 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+	for _, f := range r.Files {
+		if f.SHA256 != hashes[f.Filename] {
+			t.Errorf("%s: SHA256 = %q, want %q", f.Filename, f.SHA256, hashes[f.Filename])
+		}
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if _, err := c.CheckRestoreReport(b); err != nil {
+		t.Errorf("c.CheckRestoreReport: %v", err)
+	}
+	r.OK, r.Failed = 2, 1
+	if b, err = json.Marshal(r); err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if _, err := c.CheckRestoreReport(b); err == nil {
+		t.Error("c.CheckRestoreReport succeeded with a modified report")
+	}
+
+	// Truncate one file, and remove another one.
+	li, err := c.GlobFiles([]string{"album/file2", "album/file3"}, client.GlobOptions{})
+	if err != nil || len(li) != 2 {
+		t.Fatalf("c.GlobFiles: %v, %v", li, err)
+	}
+	fi, err := os.Stat(li[0].FilePath)
+	if err != nil {
+		t.Fatalf("os.Stat: %v", err)
+	}
+	if err := os.Truncate(li[0].FilePath, fi.Size()-1); err != nil {
+		t.Fatalf("os.Truncate: %v", err)
+	}
+	if err := os.Remove(li[1].FilePath); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	for _, fullHash := range []bool{false, true} {
+		r, err := c.VerifyLocal([]string{"*"}, client.GlobOptions{Recursive: true}, fullHash)
+		if err != nil {
+			t.Fatalf("c.VerifyLocal: %v", err)
+		}
+		if r.Total != 3 || r.OK != 1 || r.Failed != 2 {
+			t.Errorf("Unexpected report: %+v", r)
+		}
+	}
+}
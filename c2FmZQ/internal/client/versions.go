@@ -0,0 +1,311 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime/multipart"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// The opcodes of the delta format used by /v2x/sync/uploadDelta.
+const (
+	deltaCopy = 'C'
+	deltaData = 'D'
+)
+
+// encChunkOverhead is the size difference between an encrypted chunk and its
+// plaintext.
+const encChunkOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+// FileVersions is the list of local files that are new versions of files
+// that are already on the server. They use the same key as the old version,
+// and their unchanged chunks are identical, so they are uploaded as deltas.
+type FileVersions struct {
+	Bases map[string]*VersionBase `json:"bases"`
+}
+
+// VersionBase is the old version of a file.
+type VersionBase struct {
+	File      string `json:"file"`
+	Set       string `json:"set"`
+	ChunkSize int32  `json:"chunkSize"`
+}
+
+// UpdateFiles re-imports files that were already imported and that have
+// changed since. Each new version replaces the old one, which is moved to
+// trash. On the next sync, only the chunks that changed are uploaded, when
+// possible. Returns the number of files updated.
+func (c *Client) UpdateFiles(patterns []string, dest string, recursive bool) (int, error) {
+	return c.importFiles(patterns, dest, recursive, true)
+}
+
+// addVersion records that file is a new version of base.
+func (c *Client) addVersion(file string, base *ListItem, chunkSize int32) (retErr error) {
+	var v FileVersions
+	if err := c.storage.CreateEmptyFile(c.fileHash(versionsFile), &FileVersions{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	commit, err := c.storage.OpenForUpdate(c.fileHash(versionsFile), &v)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if v.Bases == nil {
+		v.Bases = make(map[string]*VersionBase)
+	}
+	v.Bases[file] = &VersionBase{
+		File:      base.FSFile.File,
+		Set:       base.Set,
+		ChunkSize: chunkSize,
+	}
+	return commit(true, nil)
+}
+
+// versionBase returns the old version of file, or nil if there isn't one.
+func (c *Client) versionBase(file string) (*VersionBase, error) {
+	var v FileVersions
+	if err := c.storage.ReadDataFile(c.fileHash(versionsFile), &v); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return v.Bases[file], nil
+}
+
+// removeVersion forgets the old version of file, after it is uploaded.
+func (c *Client) removeVersion(file string) (retErr error) {
+	var v FileVersions
+	commit, err := c.storage.OpenForUpdate(c.fileHash(versionsFile), &v)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	delete(v.Bases, file)
+	return commit(true, nil)
+}
+
+// sameContent returns whether the content of file is the same as the content
+// of item. The content of item is downloaded if necessary.
+func (c *Client) sameContent(file string, item ListItem) (bool, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	sk := c.SecretKey()
+	hdr, err := item.Header(sk)
+	sk.Wipe()
+	if err != nil {
+		return false, err
+	}
+	defer hdr.Wipe()
+	if hdr.DataSize != fi.Size() {
+		return false, nil
+	}
+	if _, err := os.Stat(item.FilePath); errors.Is(err, os.ErrNotExist) {
+		if err := c.downloadFile(item); err != nil {
+			return false, err
+		}
+	}
+	in, err := os.Open(item.FilePath)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	if err := stingle.SkipHeader(in); err != nil {
+		return false, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := stingle.DecryptFile(bufio.NewReader(in), hdr)
+	a, b := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(r, a)
+		nb, errB := io.ReadFull(f, b)
+		if !bytes.Equal(a[:na], b[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF && errB == io.EOF {
+			return true, nil
+		}
+		if errA != nil && errA != io.ErrUnexpectedEOF && errA != io.EOF {
+			return false, errA
+		}
+		if errB != nil && errB != io.ErrUnexpectedEOF && errB != io.EOF {
+			return false, errB
+		}
+	}
+}
+
+// uploadDelta uploads a new version of a file as a delta of its old version.
+func (c *Client) uploadDelta(item FileLoc, vb *VersionBase, fingerprint string) error {
+	newBlob, baseBlob := c.blobPath(item.File.File, false), c.blobPath(vb.File, false)
+	if _, err := os.Stat(baseBlob); err != nil {
+		return err
+	}
+	sr, err := c.postMultipartResponse("/v2x/sync/uploadDelta", func(w *multipart.Writer) error {
+		// The token and the base file must come before the delta.
+		if err := writeFormFields(w, []struct{ name, value string }{
+			{"token", c.Account.Token},
+			{"baseSet", vb.Set},
+			{"baseFile", vb.File},
+			{"headers", item.File.Headers},
+			{"set", item.Set},
+			{"albumId", item.AlbumID},
+			{"dateCreated", item.File.DateCreated.String()},
+			{"dateModified", item.File.DateModified.String()},
+			{"version", item.File.Version},
+			{"fingerprint", fingerprint},
+		}); err != nil {
+			return err
+		}
+		if err := writeFormFile(w, "thumb", item.File.File, c.blobPath(item.File.File, true)); err != nil {
+			return err
+		}
+		pw, err := w.CreateFormFile("delta", item.File.File)
+		if err != nil {
+			return err
+		}
+		return writeDelta(pw, newBlob, baseBlob, vb.ChunkSize)
+	})
+	if err != nil {
+		return err
+	}
+	// The server assembles the new version from the delta. A mismatch makes
+	// uploadFile send the whole file instead.
+	return checkUploadDigests(sr, map[string]string{
+		"fileDigest":  newBlob,
+		"thumbDigest": c.blobPath(item.File.File, true),
+	})
+}
+
+// writeDelta writes the delta between two encrypted files. The encrypted
+// chunks of newBlob that are identical to the chunks at the same position in
+// baseBlob are copied from baseBlob. Everything else, including the header,
+// is sent as data.
+func writeDelta(w io.Writer, newBlob, baseBlob string, chunkSize int32) error {
+	nf, err := os.Open(newBlob)
+	if err != nil {
+		return err
+	}
+	defer nf.Close()
+	bf, err := os.Open(baseBlob)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	if err := stingle.SkipHeader(nf); err != nil {
+		return err
+	}
+	hdrSize, err := nf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := stingle.SkipHeader(bf); err != nil {
+		return err
+	}
+	baseOff, err := bf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := nf.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	var copyOff, copyLen, sent int64
+	flushCopy := func() error {
+		if copyLen == 0 {
+			return nil
+		}
+		bw.WriteByte(deltaCopy)
+		binary.Write(bw, binary.BigEndian, uint64(copyOff))
+		err := binary.Write(bw, binary.BigEndian, uint64(copyLen))
+		copyLen = 0
+		return err
+	}
+	writeData := func(b []byte) error {
+		if err := flushCopy(); err != nil {
+			return err
+		}
+		sent += int64(len(b))
+		bw.WriteByte(deltaData)
+		binary.Write(bw, binary.BigEndian, uint64(len(b)))
+		_, err := bw.Write(b)
+		return err
+	}
+
+	hdr := make([]byte, hdrSize)
+	if _, err := io.ReadFull(nf, hdr); err != nil {
+		return err
+	}
+	if err := writeData(hdr); err != nil {
+		return err
+	}
+	nr, br := bufio.NewReader(nf), bufio.NewReader(bf)
+	nc, bc := make([]byte, int(chunkSize)+encChunkOverhead), make([]byte, int(chunkSize)+encChunkOverhead)
+	var total int64
+	for {
+		n, err := io.ReadFull(nr, nc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		total += int64(n)
+		m, err := io.ReadFull(br, bc)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if n == m && bytes.Equal(nc[:n], bc[:m]) {
+			if copyLen > 0 && copyOff+copyLen != baseOff {
+				if err := flushCopy(); err != nil {
+					return err
+				}
+			}
+			if copyLen == 0 {
+				copyOff = baseOff
+			}
+			copyLen += int64(n)
+		} else if err := writeData(nc[:n]); err != nil {
+			return err
+		}
+		baseOff += int64(m)
+	}
+	if err := flushCopy(); err != nil {
+		return err
+	}
+	log.Debugf("Delta: sending %d of %d bytes", sent, hdrSize+total)
+	return bw.Flush()
+}
@@ -0,0 +1,137 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestUpdateFiles(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	fn := filepath.Join(testdir, "data.bin")
+	content := make([]byte, 3<<20+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	if err := os.WriteFile(fn, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{fn}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+
+	// Unchanged files are not updated. The old version is downloaded to
+	// compare.
+	if n, err := c.UpdateFiles([]string{fn}, "gallery", false); err != nil || n != 0 {
+		t.Fatalf("c.UpdateFiles() = %d, %v, want 0, nil", n, err)
+	}
+
+	// Change one byte in the second chunk.
+	content[1<<20+500] ^= 0xff
+	if err := os.WriteFile(fn, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if n, err := c.UpdateFiles([]string{fn}, "gallery", false); err != nil || n != 1 {
+		t.Fatalf("c.UpdateFiles() = %d, %v, want 1, nil", n, err)
+	}
+
+	ct := &countingTransport{rt: hc.Transport, sent: make(map[string]int64)}
+	c.SetHTTPClient(&http.Client{Transport: ct})
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if ct.sent["/v2/sync/upload"] != 0 {
+		t.Errorf("The whole file was uploaded: %v", ct.sent)
+	}
+	if n := ct.sent["/v2x/sync/uploadDelta"]; n == 0 || n > 2<<20 {
+		t.Errorf("Unexpected delta size: %v", ct.sent)
+	}
+	c.SetHTTPClient(hc)
+
+	if li, err := c.GlobFiles([]string{".trash/*"}, client.GlobOptions{}); err != nil || len(li) != 1 {
+		t.Errorf("Old version not in trash: %v, %v", li, err)
+	}
+
+	// Download and export the new version.
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	exportDir := filepath.Join(testdir, "export")
+	if err := os.Mkdir(exportDir, 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, true); err != nil || n != 1 {
+		t.Fatalf("c.ExportFiles() = %d, %v", n, err)
+	}
+	got, err := os.ReadFile(filepath.Join(exportDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("Exported file doesn't match the new version")
+	}
+}
+
+// countingTransport counts the bytes sent to each endpoint.
+type countingTransport struct {
+	rt   http.RoundTripper
+	mu   sync.Mutex
+	sent map[string]int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body = &countingBody{ReadCloser: req.Body, t: t, path: req.URL.Path}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	t    *countingTransport
+	path string
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.t.mu.Lock()
+	b.t.sent[b.path] += int64(n)
+	b.t.mu.Unlock()
+	return n, err
+}
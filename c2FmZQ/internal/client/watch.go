@@ -0,0 +1,244 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// WatchDir is a local directory that Watch monitors. The new files in Dir,
+// and in its subdirectories, are imported into Album. Hidden files, i.e.
+// those whose name starts with a dot, are ignored.
+type WatchDir struct {
+	Dir   string `json:"dir"`
+	Album string `json:"album"`
+}
+
+// WatchOptions contains the options of Watch.
+type WatchOptions struct {
+	// Interval is the time between two scans of the watched directories.
+	Interval time.Duration
+	// Debounce is how long a file must stay unchanged before it is
+	// imported, so that files that are still being written, e.g. by a
+	// camera app, aren't imported too early.
+	Debounce time.Duration
+}
+
+// watchState is the persistent state of Watch. It is the queue of files that
+// were seen but not imported yet, and the files that were already imported.
+type watchState struct {
+	// The files that were already imported, by local path.
+	Imported map[string]watchedFile `json:"imported"`
+	// The files that are waiting to be imported, by local path.
+	Pending map[string]watchedFile `json:"pending"`
+	// SyncNeeded is true when files were imported, but not synced yet,
+	// e.g. because the server was unreachable.
+	SyncNeeded bool `json:"syncNeeded,omitempty"`
+}
+
+// watchedFile is a local file seen by Watch.
+type watchedFile struct {
+	Album   string `json:"album"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	// The time when the file was first seen with this size and ModTime,
+	// in milliseconds.
+	Seen int64 `json:"seen"`
+}
+
+// AddWatchDir adds a local directory to monitor with Watch. The new files in
+// dir are imported into album, which is created if it doesn't exist. It is
+// persisted with Save().
+func (c *Client) AddWatchDir(dir, album string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	album = strings.TrimSuffix(strings.ReplaceAll(album, "\\", "/"), "/")
+	if album == "" || album == ".trash" {
+		return fmt.Errorf("invalid album: %q", album)
+	}
+	for i := range c.WatchDirs {
+		if c.WatchDirs[i].Dir == dir {
+			c.WatchDirs[i].Album = album
+			return nil
+		}
+	}
+	c.WatchDirs = append(c.WatchDirs, WatchDir{Dir: dir, Album: album})
+	return nil
+}
+
+// RemoveWatchDir stops monitoring a local directory. It is persisted with
+// Save().
+func (c *Client) RemoveWatchDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for i := range c.WatchDirs {
+		if c.WatchDirs[i].Dir == dir {
+			c.WatchDirs = append(c.WatchDirs[:i], c.WatchDirs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("not watched: %s", dir)
+}
+
+// Watch monitors the watched directories, and imports and uploads the new
+// files automatically. The directories are scanned every opts.Interval. When
+// the server is unreachable, the imported files stay in the local storage and
+// are uploaded by a later scan. Uploads respect the sync schedule. Watch only
+// returns when there are no watched directories.
+func (c *Client) Watch(opts WatchOptions) error {
+	if len(c.WatchDirs) == 0 {
+		return errors.New("no watched directories")
+	}
+	for {
+		if _, err := c.WatchOnce(opts.Debounce); err != nil {
+			log.Errorf("Watch: %v", err)
+		}
+		time.Sleep(opts.Interval)
+	}
+}
+
+// WatchOnce scans the watched directories once. The files that haven't
+// changed for debounce are imported, and synced. It returns the number of
+// files that were imported.
+func (c *Client) WatchOnce(debounce time.Duration) (int, error) {
+	return c.watchOnce(time.Now(), debounce)
+}
+
+func (c *Client) watchOnce(now time.Time, debounce time.Duration) (n int, retErr error) {
+	var state watchState
+	if err := c.storage.CreateEmptyFile(c.fileHash(watchFile), &watchState{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return 0, err
+	}
+	commit, err := c.storage.OpenForUpdate(c.fileHash(watchFile), &state)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(true, &retErr)
+	if state.Imported == nil {
+		state.Imported = make(map[string]watchedFile)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string]watchedFile)
+	}
+
+	ready := make(map[string][]string)
+	exists := make(map[string]bool)
+	for _, wd := range c.WatchDirs {
+		err := filepath.WalkDir(wd.Dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			exists[p] = true
+			f := watchedFile{Album: wd.Album, Size: fi.Size(), ModTime: fi.ModTime().UnixMilli(), Seen: now.UnixMilli()}
+			if imp, ok := state.Imported[p]; ok && imp.Size == f.Size && imp.ModTime == f.ModTime {
+				return nil
+			}
+			if pf, ok := state.Pending[p]; ok && pf.Size == f.Size && pf.ModTime == f.ModTime {
+				f.Seen = pf.Seen
+			}
+			state.Pending[p] = f
+			// The file is ready when it hasn't changed for debounce,
+			// either according to its modification time, or since it
+			// was first seen.
+			if now.Sub(fi.ModTime()) >= debounce || now.Sub(time.UnixMilli(f.Seen)) >= debounce {
+				ready[wd.Album] = append(ready[wd.Album], p)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Watch %s: %v", wd.Dir, err)
+		}
+	}
+	// Forget the files that don't exist anymore.
+	for p := range state.Pending {
+		if !exists[p] {
+			delete(state.Pending, p)
+		}
+	}
+	for p := range state.Imported {
+		if !exists[p] {
+			delete(state.Imported, p)
+		}
+	}
+
+	var albums []string
+	for album := range ready {
+		albums = append(albums, album)
+	}
+	sort.Strings(albums)
+	for _, album := range albums {
+		di, err := c.mirrorDir(album)
+		if err != nil {
+			return n, err
+		}
+		pk, err := c.dirPK(di)
+		if err != nil {
+			return n, err
+		}
+		files := ready[album]
+		sort.Strings(files)
+		for _, p := range files {
+			c.Printf("Importing %s -> %s\n", p, album)
+			if err := c.importFile(p, di, pk, nil); err != nil {
+				log.Errorf("Import %s: %v", p, err)
+				continue
+			}
+			state.Imported[p] = state.Pending[p]
+			delete(state.Pending, p)
+			state.SyncNeeded = true
+			n++
+		}
+	}
+	if state.SyncNeeded {
+		if err := c.ScheduledSync(); err != nil {
+			return n, err
+		}
+		// When the schedule doesn't allow uploads, the files are
+		// uploaded by a later scan.
+		allowed, _ := c.uploadsAllowed(time.Now())
+		state.SyncNeeded = !allowed
+	}
+	return n, nil
+}
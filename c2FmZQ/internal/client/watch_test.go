@@ -0,0 +1,116 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := c.AddWatchDir(filepath.Join(testdir, "nonexistent"), "camera"); err == nil {
+		t.Error("AddWatchDir(nonexistent) succeeded")
+	}
+	if err := c.AddWatchDir(testdir, ".trash"); err == nil {
+		t.Error("AddWatchDir(.trash) succeeded")
+	}
+	if err := c.AddWatchDir(testdir, "camera"); err != nil {
+		t.Fatalf("AddWatchDir: %v", err)
+	}
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(testdir, ".pending-image"), []byte("partial"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	pendingUploads := func() int {
+		si, err := c.StatusInfo()
+		if err != nil {
+			t.Fatalf("c.StatusInfo: %v", err)
+		}
+		return si.PendingUploads
+	}
+
+	// The new files are too recent.
+	n, err := c.WatchOnce(time.Hour)
+	if err != nil {
+		t.Fatalf("WatchOnce: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("WatchOnce(1h) imported %d files, want 0", n)
+	}
+
+	if n, err = c.WatchOnce(0); err != nil {
+		t.Fatalf("WatchOnce: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("WatchOnce(0) imported %d files, want 2", n)
+	}
+	if got, want := pendingUploads(), 0; got != want {
+		t.Errorf("Pending uploads = %d, want %d", got, want)
+	}
+	want := []string{
+		".trash",
+		"camera",
+		"camera/image000.jpg",
+		"camera/image001.jpg",
+		"gallery",
+	}
+	if got, err := globAll(c); err != nil {
+		t.Fatalf("globAll: %v", err)
+	} else if !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected file list. Want %v, got %v", want, got)
+	}
+
+	// Nothing changed.
+	if n, err = c.WatchOnce(0); err != nil {
+		t.Fatalf("WatchOnce: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("WatchOnce(0) imported %d files, want 0", n)
+	}
+
+	if err := makeImages(testdir, 2, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if n, err = c.WatchOnce(0); err != nil {
+		t.Fatalf("WatchOnce: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("WatchOnce(0) imported %d files, want 1", n)
+	}
+	if got, want := pendingUploads(), 0; got != want {
+		t.Errorf("Pending uploads = %d, want %d", got, want)
+	}
+
+	if err := c.RemoveWatchDir(testdir); err != nil {
+		t.Fatalf("RemoveWatchDir: %v", err)
+	}
+	if err := c.RemoveWatchDir(testdir); err == nil {
+		t.Error("RemoveWatchDir succeeded twice")
+	}
+}
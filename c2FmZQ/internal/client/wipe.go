@@ -55,6 +55,9 @@ func (c *Client) WipeAccount(password string) error {
 	if err := c.wipeFile(filepath.Join(c.storage.Dir(), c.fileHash(contactsFile))); err != nil {
 		errList = append(errList, err)
 	}
+	if err := c.wipeFile(filepath.Join(c.storage.Dir(), c.fileHash(pendingFile))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errList = append(errList, err)
+	}
 	if c.Account != nil {
 		c.Account = nil
 		if err := c.Save(); err != nil {
@@ -88,6 +91,9 @@ func (c *Client) wipeFileSet(name string) (errList []error) {
 		if err := c.wipeFile(c.blobPath(f.File, true)); err != nil && !errors.Is(err, os.ErrNotExist) {
 			errList = append(errList, err)
 		}
+		if err := c.wipeFile(c.blobPath(f.File, false) + "-partial"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errList = append(errList, err)
+		}
 
 	}
 	if err := c.wipeFile(filepath.Join(c.storage.Dir(), fn)); err != nil {
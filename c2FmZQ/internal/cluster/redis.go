@@ -0,0 +1,326 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package cluster implements the backends that let multiple server instances
+// share the same database.
+package cluster
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The lease duration of the locks. Leases are renewed while the locks
+	// are held, so this only matters when a server instance dies while
+	// holding a lock.
+	defaultLockTTL = 30 * time.Second
+
+	// Releases a lock only if it's still held by the caller.
+	unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	// Extends a lease only if the lock is still held by the caller.
+	renewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// RedisLocker implements secure.Locker with leases stored in redis. It lets
+// multiple server instances coordinate their updates to the shared metadata.
+type RedisLocker struct {
+	addr     string
+	useTLS   bool
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration
+
+	pool chan *redisConn
+
+	mu   sync.Mutex
+	held map[string]string
+	stop chan struct{}
+}
+
+// NewRedisLocker returns a RedisLocker that connects to the redis server at
+// rawURL, e.g. redis://:password@host:6379/0, or rediss:// for TLS. The
+// optional prefix query parameter is prepended to the lock keys.
+func NewRedisLocker(rawURL string) (*RedisLocker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	l := &RedisLocker{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		prefix: "c2FmZQ:lock:",
+		ttl:    defaultLockTTL,
+		pool:   make(chan *redisConn, 8),
+		held:   make(map[string]string),
+		stop:   make(chan struct{}),
+	}
+	if _, _, err := net.SplitHostPort(l.addr); err != nil {
+		l.addr = net.JoinHostPort(l.addr, "6379")
+	}
+	if pw, ok := u.User.Password(); ok {
+		l.password = pw
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		if l.db, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid db number %q", p)
+		}
+	}
+	if p := u.Query().Get("prefix"); p != "" {
+		l.prefix = p
+	}
+	if _, err := l.do("PING"); err != nil {
+		return nil, err
+	}
+	go l.renewLoop()
+	return l, nil
+}
+
+// Close stops renewing the leases and closes the connections.
+func (l *RedisLocker) Close() error {
+	close(l.stop)
+	for {
+		select {
+		case c := <-l.pool:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Lock acquires the lock for name, waiting as long as necessary.
+func (l *RedisLocker) Lock(name string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	value := hex.EncodeToString(b)
+	key := l.prefix + name
+	ttl := strconv.FormatInt(l.ttl.Milliseconds(), 10)
+	for {
+		r, err := l.do("SET", key, value, "NX", "PX", ttl)
+		if err != nil {
+			return err
+		}
+		if r == "OK" {
+			break
+		}
+		log.Debugf("waiting for lock %s", name)
+		time.Sleep(time.Duration(100+mrand.Int()%100) * time.Millisecond)
+	}
+	l.mu.Lock()
+	l.held[key] = value
+	l.mu.Unlock()
+	log.Debugf("Locked %s", name)
+	return nil
+}
+
+// Unlock releases the lock for name.
+func (l *RedisLocker) Unlock(name string) error {
+	key := l.prefix + name
+	l.mu.Lock()
+	value, ok := l.held[key]
+	delete(l.held, key)
+	l.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not locked", name)
+	}
+	r, err := l.do("EVAL", unlockScript, "1", key, value)
+	if err != nil {
+		return err
+	}
+	if r != int64(1) {
+		return fmt.Errorf("lock %s was lost", name)
+	}
+	log.Debugf("Unlocked %s", name)
+	return nil
+}
+
+// renewLoop extends the leases of the locks that are held.
+func (l *RedisLocker) renewLoop() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	ttl := strconv.FormatInt(l.ttl.Milliseconds(), 10)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		held := make(map[string]string, len(l.held))
+		for k, v := range l.held {
+			held[k] = v
+		}
+		l.mu.Unlock()
+		for key, value := range held {
+			if r, err := l.do("EVAL", renewScript, "1", key, value, ttl); err != nil || r != int64(1) {
+				log.Errorf("Failed to renew lease on %s: %v %v", key, r, err)
+			}
+		}
+	}
+}
+
+// do sends a command to the redis server and returns the reply.
+func (l *RedisLocker) do(args ...string) (interface{}, error) {
+	c, err := l.conn()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close()
+		return nil, err
+	}
+	select {
+	case l.pool <- c:
+	default:
+		c.Close()
+	}
+	return r, err
+}
+
+func (l *RedisLocker) conn() (*redisConn, error) {
+	select {
+	case c := <-l.pool:
+		return c, nil
+	default:
+	}
+	var nc net.Conn
+	var err error
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if l.useTLS {
+		nc, err = tls.DialWithDialer(d, "tcp", l.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		nc, err = d.Dial("tcp", l.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if l.password != "" {
+		if _, err := c.do("AUTH", l.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if l.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(l.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply from the redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to a redis server that speaks the RESP protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.Write([]byte(sb.String())); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads one RESP reply. Simple strings and bulk strings are
+// returned as string, integers as int64, arrays as []interface{}, and null
+// values as nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements the few redis commands used by RedisLocker.
+type fakeRedis struct {
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (f *fakeRedis) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			for {
+				v, err := readReply(r)
+				if err != nil {
+					return
+				}
+				var args []string
+				for _, a := range v.([]interface{}) {
+					args = append(args, a.(string))
+				}
+				fmt.Fprint(c, f.do(args))
+			}
+		}(c)
+	}
+}
+
+func (f *fakeRedis) do(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		if _, exists := f.keys[args[1]]; exists {
+			return "$-1\r\n"
+		}
+		f.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EVAL":
+		if f.keys[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		if args[1] == unlockScript {
+			delete(f.keys, args[3])
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisLocker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+	fake := &fakeRedis{keys: make(map[string]string)}
+	go fake.serve(ln)
+
+	l, err := NewRedisLocker("redis://" + ln.Addr().String() + "?prefix=test:")
+	if err != nil {
+		t.Fatalf("NewRedisLocker: %v", err)
+	}
+	defer l.Close()
+
+	if err := l.Lock("foo"); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, ok := fake.keys["test:foo"]; !ok {
+		t.Errorf("Unexpected keys: %v", fake.keys)
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		if err := l.Lock("foo"); err != nil {
+			t.Errorf("Lock: %v", err)
+		}
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		t.Fatal("Lock acquired twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := l.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock not acquired after Unlock")
+	}
+	if err := l.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := l.Unlock("foo"); err == nil {
+		t.Error("Unlock of unlocked lock succeeded")
+	}
+}
@@ -0,0 +1,184 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"c2FmZQ/internal/secure"
+)
+
+// NewRemoteStore returns a secure.BlobStore for rawURL. The scheme of the URL
+// selects the implementation:
+//   - s3://bucket/prefix, see NewS3BlobStore.
+//   - webdav://host/path or webdavs://host/path, see NewWebDAVBlobStore.
+//   - scp://user@host/path, see NewSCPBlobStore.
+//   - file:///path, a local directory, e.g. on a mounted network drive.
+func NewRemoteStore(rawURL string) (secure.BlobStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3BlobStore(rawURL)
+	case "webdav", "webdavs":
+		return NewWebDAVBlobStore(rawURL)
+	case "scp":
+		return NewSCPBlobStore(rawURL)
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid file url %q", rawURL)
+		}
+		return &DirBlobStore{dir: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+}
+
+// DirBlobStore implements secure.BlobStore with a local directory.
+type DirBlobStore struct {
+	dir string
+}
+
+// Put stores a new blob with the content of r.
+func (s *DirBlobStore) Put(name string, r io.Reader, size int64) error {
+	fn, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Open opens a blob for reading.
+func (s *DirBlobStore) Open(name string) (io.ReadSeekCloser, error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fn)
+}
+
+// Delete deletes a blob.
+func (s *DirBlobStore) Delete(name string) error {
+	fn, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
+
+func (s *DirBlobStore) path(name string) (string, error) {
+	clean, err := cleanBlobName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+// cleanBlobName returns the clean version of name, a slash-separated path
+// relative to the root of the store. Names that would escape the root are
+// rejected.
+func cleanBlobName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return clean, nil
+}
+
+// rangeReader reads a remote blob with ranged requests. A new request is sent
+// after each Seek.
+type rangeReader struct {
+	size   int64
+	offset int64
+	body   io.ReadCloser
+	// get returns the content of the blob starting at offset.
+	get func(offset int64) (io.ReadCloser, error)
+}
+
+func (r *rangeReader) Read(b []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.get(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(b)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = r.offset + offset
+	case io.SeekEnd:
+		off = r.size + offset
+	default:
+		return r.offset, errors.New("invalid whence")
+	}
+	if off < 0 {
+		return r.offset, errors.New("negative offset")
+	}
+	if off != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = off
+	return off, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"c2FmZQ/internal/secure"
+)
+
+// testBlobStore checks the basic operations of a secure.BlobStore.
+func testBlobStore(t *testing.T, bs secure.BlobStore) {
+	t.Helper()
+	content := []byte("Hello, world!")
+	if err := bs.Put("dir/sub/blob", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	r, err := bs.Open("dir/sub/blob")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadAll() = %q, %v, want %q", got, err, content)
+	}
+	if _, err := r.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "world!" {
+		t.Errorf("ReadAll() after Seek = %q, %v, want %q", got, err, "world!")
+	}
+	r.Close()
+
+	if err := bs.Delete("dir/sub/blob"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := bs.Open("dir/sub/blob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open() after Delete = %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := bs.Delete("dir/sub/blob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete() after Delete = %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := bs.Put("../escape", bytes.NewReader(content), int64(len(content))); err == nil {
+		t.Error("Put(../escape) succeeded")
+	}
+}
+
+func TestDirBlobStore(t *testing.T) {
+	bs, err := NewRemoteStore("file://" + t.TempDir())
+	if err != nil {
+		t.Fatalf("NewRemoteStore: %v", err)
+	}
+	testBlobStore(t, bs)
+}
+
+func TestWebDAVBlobStore(t *testing.T) {
+	dav := &webdav.Handler{
+		FileSystem: webdav.Dir(t.TempDir()),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	bs, err := NewRemoteStore(strings.Replace(srv.URL, "http://", "webdav://alice:secret@", 1) + "/backups")
+	if err != nil {
+		t.Fatalf("NewRemoteStore: %v", err)
+	}
+	testBlobStore(t, bs)
+}
+
+func TestSCPBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := NewSCPBlobStore("scp://user@host:2222/" + filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatalf("NewSCPBlobStore: %v", err)
+	}
+	if bs.target != "user@host" || bs.port != "2222" {
+		t.Errorf("Unexpected target %q and port %q", bs.target, bs.port)
+	}
+	// Run the remote commands locally.
+	bs.run = func(cmd string, stdin io.Reader, stdout io.Writer) error {
+		c := exec.Command("/bin/sh", "-c", cmd)
+		c.Dir = dir
+		var stderr bytes.Buffer
+		c.Stdin = stdin
+		c.Stdout = stdout
+		c.Stderr = &stderr
+		return runErr(c.Run(), stderr.String())
+	}
+	testBlobStore(t, bs)
+}
+
+func TestNewRemoteStoreErrors(t *testing.T) {
+	for _, u := range []string{
+		"ftp://host/path",
+		"file://host/path",
+		"webdav:///path",
+		"scp:///path",
+	} {
+		if _, err := NewRemoteStore(u); err == nil {
+			t.Errorf("NewRemoteStore(%q) succeeded", u)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal in-memory S3 server.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "denied", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch req.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(req.Body)
+		f.objects[req.URL.Path] = b
+	case http.MethodHead, http.MethodGet:
+		b, ok := f.objects[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if r := req.Header.Get("Range"); r != "" {
+			off, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r, "bytes="), "-"))
+			b = b[off:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		}
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(f.objects, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	bs, err := NewS3BlobStore("s3://bucket/prefix?region=test&endpoint=" + srv.URL)
+	if err != nil {
+		t.Fatalf("NewS3BlobStore: %v", err)
+	}
+
+	content := []byte("Hello world, this is a blob.")
+	if err := bs.Put("AB/blob", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := fake.objects["/bucket/prefix/AB/blob"]; !ok {
+		t.Fatalf("Unexpected objects: %v", fake.objects)
+	}
+
+	r, err := bs.Open("AB/blob")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if size, err := r.Seek(0, io.SeekEnd); err != nil || size != int64(len(content)) {
+		t.Errorf("Seek(0, End) = %d, %v", size, err)
+	}
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(b), string(content[6:]); got != want {
+		t.Errorf("Unexpected content. Got %q, want %q", got, want)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if err := bs.Delete("AB/blob"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := bs.Open("AB/blob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open after Delete returned %v, want ErrNotExist", err)
+	}
+}
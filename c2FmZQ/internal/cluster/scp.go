@@ -0,0 +1,174 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// exitNotExist is the exit code of the remote commands when a blob doesn't
+// exist.
+const exitNotExist = 44
+
+var scpNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// SCPBlobStore implements secure.BlobStore on a remote host that is
+// accessible with ssh, i.e. the same hosts that scp can copy files to. The ssh
+// command runs in batch mode, so authentication must not need a prompt, e.g.
+// with ssh-agent or a key without a passphrase. The remote commands are run by
+// the user's login shell, which must be a POSIX shell.
+type SCPBlobStore struct {
+	target string
+	port   string
+	dir    string
+	// run runs cmd on the remote host.
+	run func(cmd string, stdin io.Reader, stdout io.Writer) error
+}
+
+// NewSCPBlobStore returns a SCPBlobStore for rawURL, e.g.
+// scp://user@host:port/path. The path is relative to the user's home
+// directory, unless it starts with //.
+func NewSCPBlobStore(rawURL string) (*SCPBlobStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "scp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid scp url %q", rawURL)
+	}
+	s := &SCPBlobStore{
+		target: u.Hostname(),
+		port:   u.Port(),
+		dir:    strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		s.target = u.User.Username() + "@" + s.target
+	}
+	if s.dir == "" {
+		s.dir = "."
+	}
+	s.run = s.ssh
+	return s, nil
+}
+
+// Put stores a new blob with the content of r.
+func (s *SCPBlobStore) Put(name string, r io.Reader, size int64) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && cat > %s.tmp && mv %s.tmp %s", shellQuote(path.Dir(p)), shellQuote(p), shellQuote(p), shellQuote(p))
+	return s.run(cmd, r, nil)
+}
+
+// Open opens a blob for reading. The blob is copied to a temporary file,
+// which is deleted when it is closed.
+func (s *SCPBlobStore) Open(name string) (io.ReadSeekCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "scp-*")
+	if err != nil {
+		return nil, err
+	}
+	tf := &tempFile{f}
+	cmd := fmt.Sprintf("if [ -f %s ]; then cat %s; else exit %d; fi", shellQuote(p), shellQuote(p), exitNotExist)
+	if err := s.run(cmd, nil, f); err != nil {
+		tf.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Delete deletes a blob.
+func (s *SCPBlobStore) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("if [ -f %s ]; then rm %s; else exit %d; fi", shellQuote(p), shellQuote(p), exitNotExist)
+	if err := s.run(cmd, nil, nil); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *SCPBlobStore) path(name string) (string, error) {
+	if !scpNameRE.MatchString(name) || strings.Contains("/"+name+"/", "/../") {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return path.Join(s.dir, name), nil
+}
+
+func (s *SCPBlobStore) ssh(cmd string, stdin io.Reader, stdout io.Writer) error {
+	args := []string{"-o", "BatchMode=yes"}
+	if s.port != "" {
+		args = append(args, "-p", s.port)
+	}
+	args = append(args, s.target, cmd)
+	c := exec.Command("ssh", args...)
+	var stderr bytes.Buffer
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = &stderr
+	return runErr(c.Run(), stderr.String())
+}
+
+// runErr converts the error of a remote command. The exit code exitNotExist
+// becomes fs.ErrNotExist.
+func runErr(err error, stderr string) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == exitNotExist {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// tempFile is a temporary file that is deleted when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -32,8 +32,8 @@ import (
 	"path/filepath"
 	"runtime"
 
+	"c2FmZQ/internal/crypto/kdf"
 	"c2FmZQ/internal/log"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -108,13 +108,23 @@ func ReadAESMasterKey(passphrase []byte, file string) (MasterKey, error) {
 		return nil, err
 	}
 	version, b := b[0], b[1:]
-	if version != 1 {
+	var dk []byte
+	switch version {
+	case 1: // PBKDF2
+		salt, rest := b[:16], b[16:]
+		numIter := int(binary.BigEndian.Uint32(rest[:4]))
+		dk = kdf.MasterKeyPBKDF2(passphrase, salt, numIter)
+		b = rest[4:]
+	case 3: // Argon2id
+		salt, rest := b[:16], b[16:]
+		time := binary.BigEndian.Uint32(rest[:4])
+		memory := binary.BigEndian.Uint32(rest[4:8])
+		dk = kdf.MasterKeyArgon2(passphrase, salt, time, memory)
+		b = rest[8:]
+	default:
 		log.Debugf("ReadMasterKey: unexpected version: %d", version)
 		return nil, ErrDecryptFailed
 	}
-	salt, b := b[:16], b[16:]
-	numIter, b := int(binary.BigEndian.Uint32(b[:4])), b[4:]
-	dk := pbkdf2.Key(passphrase, salt, numIter, 32, sha256.New)
 	block, err := aes.NewCipher(dk)
 	if err != nil {
 		log.Debug(err)
@@ -137,17 +147,36 @@ func ReadAESMasterKey(passphrase []byte, file string) (MasterKey, error) {
 
 // Save encrypts the key with passphrase and saves it to file.
 func (mk AESMasterKey) Save(passphrase []byte, file string) error {
+	return mk.SaveWithKDF(passphrase, file, KDF{})
+}
+
+// SaveWithKDF encrypts the key with passphrase and saves it to file. The key
+// that encrypts the master key is derived with PBKDF2 or Argon2id.
+func (mk AESMasterKey) SaveWithKDF(passphrase []byte, file string, opts KDF) error {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
-	numIter := 200000
-	if len(passphrase) == 0 {
-		numIter = 10
+	var data, dk []byte
+	switch k := opts.withDefaults(KDFPBKDF2); k.Name {
+	case KDFPBKDF2:
+		numIter := k.Time
+		if len(passphrase) == 0 && opts.Time == 0 {
+			numIter = 10
+		}
+		data = []byte{1} // version
+		data = append(data, salt...)
+		data = binary.BigEndian.AppendUint32(data, numIter)
+		dk = kdf.MasterKeyPBKDF2(passphrase, salt, int(numIter))
+	case KDFArgon2id:
+		data = []byte{3} // version
+		data = append(data, salt...)
+		data = binary.BigEndian.AppendUint32(data, k.Time)
+		data = binary.BigEndian.AppendUint32(data, k.Memory)
+		dk = kdf.MasterKeyArgon2(passphrase, salt, k.Time, k.Memory)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnexpectedAlgo, k.Name)
 	}
-	numIterBin := make([]byte, 4)
-	binary.BigEndian.PutUint32(numIterBin, uint32(numIter))
-	dk := pbkdf2.Key(passphrase, salt, numIter, 32, sha256.New)
 	block, err := aes.NewCipher(dk)
 	if err != nil {
 		log.Debug(err)
@@ -164,9 +193,6 @@ func (mk AESMasterKey) Save(passphrase []byte, file string) error {
 		return ErrEncryptFailed
 	}
 	encMasterKey := gcm.Seal(nonce, nonce, mk.key(), nil)
-	data := []byte{1} // version
-	data = append(data, salt...)
-	data = append(data, numIterBin...)
 	data = append(data, encMasterKey...)
 	dir, _ := filepath.Split(file)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -32,9 +32,9 @@ import (
 	"runtime"
 	"time"
 
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"c2FmZQ/internal/crypto/kdf"
 	"c2FmZQ/internal/log"
 )
 
@@ -116,7 +116,7 @@ func ReadChacha20Poly1305MasterKey(passphrase []byte, file string) (MasterKey, e
 	salt, b := b[:16], b[16:]
 	time, b := uint32(b[0]), b[1:]
 	memory, b := binary.LittleEndian.Uint32(b[:4]), b[4:]
-	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
+	dk := kdf.MasterKeyArgon2(passphrase, salt, time, memory)
 	ccp, err := chacha20poly1305.NewX(dk)
 	if err != nil {
 		log.Debug(err)
@@ -134,13 +134,26 @@ func ReadChacha20Poly1305MasterKey(passphrase []byte, file string) (MasterKey, e
 
 // Save encrypts the key with passphrase and saves it to file.
 func (mk Chacha20Poly1305MasterKey) Save(passphrase []byte, file string) error {
+	return mk.SaveWithKDF(passphrase, file, KDF{})
+}
+
+// SaveWithKDF encrypts the key with passphrase and saves it to file. Only
+// Argon2id is supported, with at most 255 passes.
+func (mk Chacha20Poly1305MasterKey) SaveWithKDF(passphrase []byte, file string, opts KDF) error {
+	k := opts.withDefaults(KDFArgon2id)
+	if k.Name != KDFArgon2id {
+		return fmt.Errorf("%w: %q", ErrUnexpectedAlgo, k.Name)
+	}
+	if k.Time > 255 {
+		return fmt.Errorf("argon2id time is too large: %d", k.Time)
+	}
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
-	time := uint32(2)
-	memory := uint32(128 * 1024)
-	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
+	time := k.Time
+	memory := k.Memory
+	dk := kdf.MasterKeyArgon2(passphrase, salt, time, memory)
 	ccp, err := chacha20poly1305.NewX(dk)
 	if err != nil {
 		log.Debug(err)
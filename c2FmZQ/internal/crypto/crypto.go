@@ -20,17 +20,20 @@
 package crypto
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
+	"strings"
 )
 
 const (
 	AES256           int = iota // AES256-GCM, AES256-CBC+HMAC-SHA256, PBKDF2.
 	Chacha20Poly1305            // Chacha20Poly1305, Argon2.
 
-	DefaultAlgo = AES256
-	PickFastest = -1
+	DefaultAlgo    = AES256
+	PickFastest    = -1 // Run a speedtest, see Fastest.
+	PickByHardware = -2 // Use AES256 only with hardware support, see ForHardware.
 )
 
 var (
@@ -50,15 +53,65 @@ type MasterKey interface {
 
 	// Save encrypted the MasterKey with passphrase and saves it to file.
 	Save(passphrase []byte, file string) error
+	// SaveWithKDF is like Save, with a specific key derivation function.
+	SaveWithKDF(passphrase []byte, file string, opts KDF) error
+}
+
+const (
+	// KDFPBKDF2 is PBKDF2-SHA256. It is the default for AES256 master keys.
+	KDFPBKDF2 = "pbkdf2"
+	// KDFArgon2id is Argon2id. It is the default for Chacha20Poly1305
+	// master keys, and the only one they support.
+	KDFArgon2id = "argon2id"
+)
+
+// KDF contains the parameters of the key derivation function that derives
+// the key that encrypts a master key from its passphrase. They are saved in
+// the header of the master key file.
+type KDF struct {
+	// Name is KDFPBKDF2 or KDFArgon2id. When empty, the default of the
+	// master key's algorithm is used.
+	Name string
+	// Time is the number of iterations of PBKDF2, or the number of passes
+	// of Argon2id. Zero means the default.
+	Time uint32
+	// Memory is the amount of memory used by Argon2id, in KiB. Zero means
+	// the default.
+	Memory uint32
+}
+
+// withDefaults returns a copy of k with the default values for the fields
+// that aren't set.
+func (k KDF) withDefaults(name string) KDF {
+	if k.Name == "" {
+		k.Name = name
+	}
+	switch k.Name {
+	case KDFPBKDF2:
+		if k.Time == 0 {
+			k.Time = 200000
+		}
+	case KDFArgon2id:
+		if k.Time == 0 {
+			k.Time = 2
+		}
+		if k.Memory == 0 {
+			k.Memory = 128 * 1024
+		}
+	}
+	return k
 }
 
 // CreateMasterKey creates a new master key.
 func CreateMasterKey(alg int) (MasterKey, error) {
-	if alg == PickFastest {
+	switch alg {
+	case PickFastest:
 		var err error
 		if alg, err = Fastest(); err != nil {
 			alg = DefaultAlgo
 		}
+	case PickByHardware:
+		alg = ForHardware()
 	}
 	switch alg {
 	case AES256:
@@ -70,6 +123,36 @@ func CreateMasterKey(alg int) (MasterKey, error) {
 	}
 }
 
+// ParseAlgo returns the encryption algorithm with the given name: "aes256",
+// "chacha20poly1305", or one of the automatic selections, "auto" (see
+// ForHardware) and "fastest" (see Fastest).
+func ParseAlgo(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "auto":
+		return PickByHardware, nil
+	case "fastest":
+		return PickFastest, nil
+	case "aes", "aes256":
+		return AES256, nil
+	case "chacha20poly1305", "xchacha20poly1305":
+		return Chacha20Poly1305, nil
+	default:
+		return 0, ErrUnexpectedAlgo
+	}
+}
+
+// KeyAlgo returns the encryption algorithm used by key.
+func KeyAlgo(key EncryptionKey) (int, error) {
+	switch key.(type) {
+	case *AESKey, *AESMasterKey, AESMasterKey:
+		return AES256, nil
+	case *Chacha20Poly1305Key, *Chacha20Poly1305MasterKey, Chacha20Poly1305MasterKey:
+		return Chacha20Poly1305, nil
+	default:
+		return 0, ErrUnexpectedAlgo
+	}
+}
+
 // ReadMasterKey reads an encrypted master key from file and decrypts it.
 func ReadMasterKey(passphrase []byte, file string) (MasterKey, error) {
 	b, err := os.ReadFile(file)
@@ -77,7 +160,7 @@ func ReadMasterKey(passphrase []byte, file string) (MasterKey, error) {
 		return nil, err
 	}
 	switch b[0] {
-	case 1: // AES256
+	case 1, 3: // AES256 with PBKDF2 or Argon2id
 		return ReadAESMasterKey(passphrase, file)
 	case 2: // Chacha20Poly1305
 		return ReadChacha20Poly1305MasterKey(passphrase, file)
@@ -86,6 +169,28 @@ func ReadMasterKey(passphrase []byte, file string) (MasterKey, error) {
 	}
 }
 
+// ReadMasterKeyKDF returns the key derivation function of an encrypted master
+// key file.
+func ReadMasterKeyKDF(file string) (KDF, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return KDF{}, err
+	}
+	if len(b) < 25 {
+		return KDF{}, ErrDecryptFailed
+	}
+	switch b[0] {
+	case 1: // AES256, PBKDF2
+		return KDF{Name: KDFPBKDF2, Time: binary.BigEndian.Uint32(b[17:21])}, nil
+	case 2: // Chacha20Poly1305, Argon2id
+		return KDF{Name: KDFArgon2id, Time: uint32(b[17]), Memory: binary.LittleEndian.Uint32(b[18:22])}, nil
+	case 3: // AES256, Argon2id
+		return KDF{Name: KDFArgon2id, Time: binary.BigEndian.Uint32(b[17:21]), Memory: binary.BigEndian.Uint32(b[21:25])}, nil
+	default:
+		return KDF{}, ErrUnexpectedAlgo
+	}
+}
+
 // EncryptionKey is an encryption key that can be used to encrypt and decrypt
 // data and streams.
 type EncryptionKey interface {
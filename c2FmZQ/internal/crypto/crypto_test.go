@@ -0,0 +1,138 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAlgo(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want int
+		err  error
+	}{
+		{"auto", PickByHardware, nil},
+		{"fastest", PickFastest, nil},
+		{"AES256", AES256, nil},
+		{"aes", AES256, nil},
+		{"chacha20poly1305", Chacha20Poly1305, nil},
+		{"xchacha20poly1305", Chacha20Poly1305, nil},
+		{"des", 0, ErrUnexpectedAlgo},
+	} {
+		got, err := ParseAlgo(tc.name)
+		if got != tc.want || err != tc.err {
+			t.Errorf("ParseAlgo(%q) = %d, %v, want %d, %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestKeyAlgo(t *testing.T) {
+	aes, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	cc, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	for _, tc := range []struct {
+		mk   MasterKey
+		want int
+	}{
+		{aes, AES256},
+		{cc, Chacha20Poly1305},
+	} {
+		if got, err := KeyAlgo(tc.mk); err != nil || got != tc.want {
+			t.Errorf("KeyAlgo(%T) = %d, %v, want %d", tc.mk, got, err, tc.want)
+		}
+		k, err := tc.mk.NewKey()
+		if err != nil {
+			t.Fatalf("NewKey: %v", err)
+		}
+		if got, err := KeyAlgo(k); err != nil || got != tc.want {
+			t.Errorf("KeyAlgo(%T) = %d, %v, want %d", k, got, err, tc.want)
+		}
+		k.Wipe()
+	}
+
+	mk, err := CreateMasterKey(PickByHardware)
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	want := Chacha20Poly1305
+	if HasAESHardware() {
+		want = AES256
+	}
+	if got, _ := KeyAlgo(mk); got != want {
+		t.Errorf("CreateMasterKey(PickByHardware) algo = %d, want %d", got, want)
+	}
+}
+
+func TestSaveWithKDF(t *testing.T) {
+	aes, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	cc, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "master.key")
+	pass := []byte("foo")
+	for _, tc := range []struct {
+		mk   MasterKey
+		opts KDF
+		want KDF
+	}{
+		{aes, KDF{}, KDF{Name: KDFPBKDF2, Time: 200000}},
+		{aes, KDF{Name: KDFPBKDF2, Time: 1000}, KDF{Name: KDFPBKDF2, Time: 1000}},
+		{aes, KDF{Name: KDFArgon2id}, KDF{Name: KDFArgon2id, Time: 2, Memory: 128 * 1024}},
+		{aes, KDF{Name: KDFArgon2id, Time: 3, Memory: 1024}, KDF{Name: KDFArgon2id, Time: 3, Memory: 1024}},
+		{cc, KDF{}, KDF{Name: KDFArgon2id, Time: 2, Memory: 128 * 1024}},
+		{cc, KDF{Name: KDFArgon2id, Time: 3, Memory: 1024}, KDF{Name: KDFArgon2id, Time: 3, Memory: 1024}},
+	} {
+		if err := tc.mk.SaveWithKDF(pass, file, tc.opts); err != nil {
+			t.Fatalf("SaveWithKDF(%T, %+v): %v", tc.mk, tc.opts, err)
+		}
+		if got, err := ReadMasterKeyKDF(file); err != nil || got != tc.want {
+			t.Errorf("ReadMasterKeyKDF(%T, %+v) = %+v, %v, want %+v", tc.mk, tc.opts, got, err, tc.want)
+		}
+		if _, err := ReadMasterKey([]byte("bar"), file); err != ErrDecryptFailed {
+			t.Errorf("ReadMasterKey(%T, %+v) with wrong passphrase: %v, want %v", tc.mk, tc.opts, err, ErrDecryptFailed)
+		}
+		mk, err := ReadMasterKey(pass, file)
+		if err != nil {
+			t.Fatalf("ReadMasterKey(%T, %+v): %v", tc.mk, tc.opts, err)
+		}
+		if got, want := mk.Hash([]byte("x")), tc.mk.Hash([]byte("x")); !bytes.Equal(got, want) {
+			t.Errorf("ReadMasterKey(%T, %+v) returned a different key", tc.mk, tc.opts)
+		}
+		mk.Wipe()
+	}
+	if err := cc.SaveWithKDF(pass, file, KDF{Name: KDFPBKDF2}); !errors.Is(err, ErrUnexpectedAlgo) {
+		t.Errorf("SaveWithKDF(pbkdf2) = %v, want %v", err, ErrUnexpectedAlgo)
+	}
+	if err := aes.SaveWithKDF(pass, file, KDF{Name: "scrypt"}); !errors.Is(err, ErrUnexpectedAlgo) {
+		t.Errorf("SaveWithKDF(scrypt) = %v, want %v", err, ErrUnexpectedAlgo)
+	}
+}
@@ -0,0 +1,56 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+
+	"c2FmZQ/internal/log"
+)
+
+// HasAESHardware returns true if the CPU has the instructions that make
+// AES-GCM fast and constant time, i.e. AES and carry-less multiplication. This
+// is the same test that the go crypto/aes package uses.
+func HasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	case "ppc64", "ppc64le":
+		return true
+	default:
+		return false
+	}
+}
+
+// ForHardware returns the encryption algorithm that is expected to be the
+// fastest on the local computer, without running a speedtest: AES256 when the
+// CPU has AES instructions, Chacha20Poly1305 otherwise.
+func ForHardware() int {
+	if HasAESHardware() {
+		log.Infof("AES hardware support detected. Using AES256 encryption.")
+		return AES256
+	}
+	log.Infof("No AES hardware support. Using Chacha20Poly1305 encryption.")
+	return Chacha20Poly1305
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package kdf derives all the keys that are not random, and all the
+// per-purpose values that are derived from keys. Each purpose has its own
+// versioned context string, and they are all listed here so that domain
+// separation can be verified in one place.
+//
+// The master key, the server's secret keys, the token keys, and the file keys
+// are random. Only the keys that are used for more than one purpose are
+// derived, e.g. the token keys.
+//
+// Some derivations predate this package. They can't change without
+// re-encrypting the data, so they keep their original construction:
+//
+//   - The master key is 64 bytes. The first half is the encryption key. The
+//     second half is the HMAC-SHA256 key of MasterKey.Hash, which is used for
+//     the file names. They are independent random values, not derived keys.
+//   - The stream encryption context of a file is derived from its name with
+//     FileContext. It is used with a new random key for each file.
+//   - The keys that encrypt the master key are derived from the passphrase
+//     with MasterKeyArgon2 or MasterKeyPBKDF2. The random salt is saved with
+//     the encrypted master key.
+//
+// The Stingle key bundles use libsodium's pwhash, as required by the Stingle
+// API. See package pwhash.
+package kdf
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Purpose is the context string of a derived key. Each purpose must have its
+// own unique context string, and its version must change whenever the way
+// the derived key is used changes.
+type Purpose string
+
+const (
+	// TokenKeyID is the key ID that is included in the tokens.
+	TokenKeyID Purpose = "c2FmZQ/token/key-id/v1"
+	// TokenEncryption is the key that encrypts the tokens.
+	TokenEncryption Purpose = "c2FmZQ/token/encryption/v1"
+	// TokenNonce is the key that derives the synthetic nonces of the
+	// tokens.
+	TokenNonce Purpose = "c2FmZQ/token/nonce/v1"
+)
+
+// Purposes returns all the purposes.
+func Purposes() []Purpose {
+	return []Purpose{
+		TokenKeyID,
+		TokenEncryption,
+		TokenNonce,
+	}
+}
+
+// Derive returns a key of length n derived from secret for purpose p, with
+// HKDF-SHA256.
+func Derive(secret []byte, p Purpose, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(p)), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// MasterKeyArgon2 returns the key that encrypts a Chacha20Poly1305 master key.
+func MasterKeyArgon2(passphrase, salt []byte, time, memory uint32) []byte {
+	return argon2.IDKey(passphrase, salt, time, memory, 1, 32)
+}
+
+// MasterKeyPBKDF2 returns the key that encrypts an AES master key.
+func MasterKeyPBKDF2(passphrase, salt []byte, numIter int) []byte {
+	return pbkdf2.Key(passphrase, salt, numIter, 32, sha256.New)
+}
+
+// FileContext returns the stream encryption context of a file, which is
+// bound to its name.
+func FileContext(name string) []byte {
+	h := sha1.Sum([]byte(name))
+	return h[:]
+}
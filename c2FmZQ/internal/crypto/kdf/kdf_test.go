@@ -0,0 +1,56 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package kdf
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestPurposes(t *testing.T) {
+	re := regexp.MustCompile(`^c2FmZQ/[a-z-]+/[a-z-]+/v[0-9]+$`)
+	seen := make(map[Purpose]bool)
+	for _, p := range Purposes() {
+		if !re.MatchString(string(p)) {
+			t.Errorf("Purpose %q doesn't match %s", p, re)
+		}
+		if seen[p] {
+			t.Errorf("Purpose %q is not unique", p)
+		}
+		seen[p] = true
+	}
+}
+
+func TestDerive(t *testing.T) {
+	secret := []byte("secret")
+	keys := make(map[string]Purpose)
+	for _, p := range Purposes() {
+		k := Derive(secret, p, 32)
+		if !bytes.Equal(k, Derive(secret, p, 32)) {
+			t.Errorf("Derive(%q) isn't deterministic", p)
+		}
+		if bytes.Equal(k, Derive([]byte("other secret"), p, 32)) {
+			t.Errorf("Derive(%q) doesn't depend on the secret", p)
+		}
+		if other, exists := keys[string(k)]; exists {
+			t.Errorf("Derive(%q) == Derive(%q)", p, other)
+		}
+		keys[string(k)] = p
+	}
+}
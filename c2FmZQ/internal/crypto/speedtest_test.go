@@ -31,3 +31,42 @@ func TestFastest(t *testing.T) {
 	}
 	t.Logf("Fastest: %d", f)
 }
+
+func benchmarkStreamWriter(b *testing.B, create func() (MasterKey, error), size int) {
+	mk, err := create()
+	if err != nil {
+		b.Fatalf("create: %v", err)
+	}
+	defer mk.Wipe()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := speedTest(mk, size); err != nil {
+			b.Fatalf("speedTest: %v", err)
+		}
+	}
+}
+
+func BenchmarkStreamWriter_4KB_AES256(b *testing.B) {
+	benchmarkStreamWriter(b, CreateAESMasterKey, 4<<10)
+}
+
+func BenchmarkStreamWriter_4KB_Chacha20Poly1305(b *testing.B) {
+	benchmarkStreamWriter(b, CreateChacha20Poly1305MasterKey, 4<<10)
+}
+
+func BenchmarkStreamWriter_1MB_AES256(b *testing.B) {
+	benchmarkStreamWriter(b, CreateAESMasterKey, 1<<20)
+}
+
+func BenchmarkStreamWriter_1MB_Chacha20Poly1305(b *testing.B) {
+	benchmarkStreamWriter(b, CreateChacha20Poly1305MasterKey, 1<<20)
+}
+
+func BenchmarkStreamWriter_10MB_AES256(b *testing.B) {
+	benchmarkStreamWriter(b, CreateAESMasterKey, 10<<20)
+}
+
+func BenchmarkStreamWriter_10MB_Chacha20Poly1305(b *testing.B) {
+	benchmarkStreamWriter(b, CreateChacha20Poly1305MasterKey, 10<<20)
+}
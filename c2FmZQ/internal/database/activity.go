@@ -0,0 +1,112 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	// The logical filename where a user's account activity is stored.
+	activityFile = "activity.dat"
+
+	// Activity entries older than this are discarded.
+	activityRetention = 400 * 24 * time.Hour
+	// The maximum number of activity entries kept per user.
+	maxActivityEntries = 5000
+)
+
+// The types of account activity.
+const (
+	ActivityLogin         = "login"
+	ActivityLoginFailed   = "login-failed"
+	ActivityShare         = "share"
+	ActivityRemoveMember  = "remove-member"
+	ActivityUnshare       = "unshare"
+	ActivityLeave         = "leave"
+	ActivityDeleteFiles   = "delete-files"
+	ActivityEmptyTrash    = "empty-trash"
+	ActivityDeleteAlbum   = "delete-album"
+	ActivityRevokeSession = "revoke-session"
+	ActivityRepairAlbum   = "repair-album"
+)
+
+// ActivityEntry is an event in a user's account activity log.
+type ActivityEntry struct {
+	// The time of the event, in milliseconds.
+	Date int64 `json:"date"`
+	// The type of event, e.g. ActivityLogin.
+	Type string `json:"type"`
+	// A human readable description of the event.
+	Detail string `json:"detail,omitempty"`
+}
+
+// activityLog is the account activity of a user, oldest first.
+type activityLog struct {
+	Entries []ActivityEntry `json:"entries"`
+}
+
+// RecordActivity adds an event to the user's account activity log. Nothing
+// is recorded when the database is read-only.
+func (d *Database) RecordActivity(userID int64, typ, detail string) (retErr error) {
+	if d.readOnly {
+		return nil
+	}
+	fn := d.filePath(homeByUserID(userID, activityFile))
+	if err := d.storage.CreateEmptyFile(fn, activityLog{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var al activityLog
+	commit, err := d.storage.OpenForUpdate(fn, &al)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	now := nowInMS()
+	al.Entries = append(al.Entries, ActivityEntry{Date: now, Type: typ, Detail: detail})
+	horizon := now - activityRetention.Milliseconds()
+	start := 0
+	for start < len(al.Entries) && al.Entries[start].Date < horizon {
+		start++
+	}
+	if n := len(al.Entries) - start; n > maxActivityEntries {
+		start += n - maxActivityEntries
+	}
+	al.Entries = al.Entries[start:]
+	return commit(true, nil)
+}
+
+// Activity returns the user's account activity log, oldest first.
+func (d *Database) Activity(userID int64) ([]ActivityEntry, error) {
+	defer recordLatency("Activity")()
+
+	var al activityLog
+	if err := d.storage.ReadDataFile(d.filePath(homeByUserID(userID, activityFile)), &al); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	horizon := nowInMS() - activityRetention.Milliseconds()
+	entries := make([]ActivityEntry, 0, len(al.Entries))
+	for _, e := range al.Entries {
+		if e.Date >= horizon {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
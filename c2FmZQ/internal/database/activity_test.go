@@ -0,0 +1,67 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestActivity(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser() failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User() failed: %v", err)
+	}
+
+	start := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	database.CurrentTimeForTesting = start.UnixMilli()
+	if err := db.RecordActivity(user.UserID, database.ActivityLogin, "10.0.0.1"); err != nil {
+		t.Fatalf("db.RecordActivity() failed: %v", err)
+	}
+	database.CurrentTimeForTesting = start.Add(300 * 24 * time.Hour).UnixMilli()
+	if err := db.RecordActivity(user.UserID, database.ActivityShare, "album x"); err != nil {
+		t.Fatalf("db.RecordActivity() failed: %v", err)
+	}
+	entries, err := db.Activity(user.UserID)
+	if err != nil {
+		t.Fatalf("db.Activity() failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Type != database.ActivityLogin || entries[1].Type != database.ActivityShare {
+		t.Errorf("Unexpected activity: %+v", entries)
+	}
+
+	// The first entry is now older than the retention period.
+	database.CurrentTimeForTesting = start.Add(500 * 24 * time.Hour).UnixMilli()
+	entries, err = db.Activity(user.UserID)
+	if err != nil {
+		t.Fatalf("db.Activity() failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Detail != "album x" {
+		t.Errorf("Unexpected activity: %+v", entries)
+	}
+}
@@ -0,0 +1,300 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/stingle"
+)
+
+func addTestFile(db *Database, user User, name, content, thumb string) error {
+	spec := FileSpec{
+		Headers:        name + "-headers",
+		DateCreated:    1,
+		Version:        "1",
+		StoreFileSize:  int64(len(content)),
+		StoreThumbSize: int64(len(thumb)),
+	}
+	for _, f := range []struct {
+		name    *string
+		content string
+	}{{&spec.StoreFile, content}, {&spec.StoreThumb, thumb}} {
+		w, fn, err := db.TempFile("uploads")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		*f.name = fn
+	}
+	return db.AddFile(user, spec, name, stingle.GallerySet, "")
+}
+
+// copyDir copies the database directory, like it would be on disk if the
+// process died. The lock files are left out. They would eventually be
+// removed as stale locks.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.WalkDir(src, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0700)
+		}
+		if strings.HasSuffix(rel, ".lock") {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), b, 0600)
+	})
+	if err != nil {
+		t.Fatalf("copyDir: %v", err)
+	}
+}
+
+func TestAddFileCrash(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	db := New(dir, []byte("passphrase"))
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+	userID, err := db.AddUser(User{Email: "alice@", PublicKey: key.PublicKey()})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.UserByID(userID)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if err := addTestFile(db, user, "file0", "hello", "thumb 0"); err != nil {
+		t.Fatalf("addTestFile(file0): %v", err)
+	}
+
+	// file1 has the same content as file0, and a new thumbnail. The commit
+	// changes the gallery, and the reference files of both blobs.
+	before := filepath.Join(t.TempDir(), "before")
+	var txFiles []string
+	addFileCommitHook = func(files []string) {
+		txFiles = files
+		copyDir(t, dir, before)
+	}
+	defer func() { addFileCommitHook = nil }()
+	if err := addTestFile(db, user, "file1", "hello", "thumb 1"); err != nil {
+		t.Fatalf("addTestFile(file1): %v", err)
+	}
+	addFileCommitHook = nil
+	if want, got := 3, len(txFiles); want != got {
+		t.Fatalf("Unexpected number of files in the commit. Want %d, got %d: %v", want, got, txFiles)
+	}
+	after := filepath.Join(t.TempDir(), "after")
+	copyDir(t, dir, after)
+
+	// The process died in the middle of the commit: the file set was saved,
+	// but the reference files weren't. The journal has the original files.
+	during := filepath.Join(t.TempDir(), "during")
+	copyDir(t, after, during)
+	ts := time.Now().Add(-time.Minute)
+	for i, f := range txFiles {
+		b, err := os.ReadFile(filepath.Join(before, f))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if err := os.WriteFile(fmt.Sprintf("%s.bck-%d", filepath.Join(during, f), ts.UnixNano()), b, 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if i > 0 {
+			if err := os.WriteFile(filepath.Join(during, f), b, 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}
+	}
+	pending := struct {
+		TS    time.Time `json:"ts"`
+		Files []string  `json:"files"`
+	}{ts, txFiles}
+	if err := secure.NewStorage(during, db.masterKey).SaveDataFile(filepath.Join("pending", fmt.Sprintf("%d", ts.UnixNano())), pending); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		dir       string
+		wantFile1 bool
+		wantUsed  int64
+		orphans   int
+	}{
+		{"before commit", before, false, 12, 1},
+		{"during commit", during, false, 12, 1},
+		{"after commit", after, true, 24, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.dir == during {
+				if _, err := os.Stat(filepath.Join(during, "pending")); err != nil {
+					t.Fatalf("pending: %v", err)
+				}
+			}
+			db := New(tc.dir, []byte("passphrase"))
+			if tc.dir == during {
+				if m, _ := filepath.Glob(filepath.Join(during, "pending", "*")); len(m) != 0 {
+					t.Errorf("The pending operation wasn't rolled back: %v", m)
+				}
+			}
+			user, err := db.UserByID(userID)
+			if err != nil {
+				t.Fatalf("UserByID: %v", err)
+			}
+			fs, err := db.FileSet(user, stingle.GallerySet, "")
+			if err != nil {
+				t.Fatalf("FileSet: %v", err)
+			}
+			if _, ok := fs.Files["file1"]; ok != tc.wantFile1 {
+				t.Errorf("file1 in gallery = %v, want %v", ok, tc.wantFile1)
+			}
+			if used, err := db.SpaceUsed(user); err != nil || used != tc.wantUsed {
+				t.Errorf("SpaceUsed() = %d, %v, want %d", used, err, tc.wantUsed)
+			}
+			stats, err := db.UpdateStorageMetrics()
+			if err != nil {
+				t.Fatalf("UpdateStorageMetrics: %v", err)
+			}
+			if stats.RefCountAnomalies != 0 {
+				t.Errorf("RefCountAnomalies = %d, want 0", stats.RefCountAnomalies)
+			}
+			gc, err := db.CollectGarbage(0)
+			if err != nil {
+				t.Fatalf("CollectGarbage: %v", err)
+			}
+			if gc.RefCountsFixed != 0 || gc.Missing != 0 || gc.OrphansDeleted != tc.orphans {
+				t.Errorf("CollectGarbage() = %+v, want %d orphan(s) and nothing else to fix", gc, tc.orphans)
+			}
+
+			// The database is still usable after the crash.
+			if err := addTestFile(db, user, "file2", "hello", "thumb 2"); err != nil {
+				t.Fatalf("addTestFile(file2): %v", err)
+			}
+			if stats, err := db.UpdateStorageMetrics(); err != nil || stats.RefCountAnomalies != 0 {
+				t.Errorf("UpdateStorageMetrics() = %+v, %v", stats, err)
+			}
+		})
+	}
+}
+
+func TestAddFileConcurrentQuota(t *testing.T) {
+	db := New(filepath.Join(t.TempDir(), "data"), nil)
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+	userID, err := db.AddUser(User{Email: "bob@", PublicKey: key.PublicKey()})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.UserByID(userID)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	// Each file uses 20 bytes. Only 5 of them fit in the quota.
+	if err := db.storage.SaveDataFile(db.filePath(quotaFile), Quotas{Limits: map[int64]Limit{userID: {Value: 100}}}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+
+	const n = 10
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- addTestFile(db, user, fmt.Sprintf("file%d", i), fmt.Sprintf("content %02d", i), fmt.Sprintf("thumb %04d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	var added, exceeded int
+	for err := range errs {
+		switch {
+		case err == nil:
+			added++
+		case errors.Is(err, ErrQuotaExceeded):
+			exceeded++
+		default:
+			t.Errorf("addTestFile: %v", err)
+		}
+	}
+	if added != 5 || exceeded != 5 {
+		t.Errorf("Got %d file(s) added, %d over quota, want 5 and 5", added, exceeded)
+	}
+	if used, err := db.SpaceUsed(user); err != nil || used != 100 {
+		t.Errorf("SpaceUsed() = %d, %v, want 100", used, err)
+	}
+	if stats, err := db.UpdateStorageMetrics(); err != nil || stats.RefCountAnomalies != 0 {
+		t.Errorf("UpdateStorageMetrics() = %+v, %v", stats, err)
+	}
+}
+
+func TestAddFileRemovesTemps(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	db := New(dir, nil)
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+	userID, err := db.AddUser(User{Email: "carol@", PublicKey: key.PublicKey()})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.UserByID(userID)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	// The quota file can't be read, so the file is rejected before it is
+	// committed.
+	if err := os.WriteFile(filepath.Join(dir, db.filePath(quotaFile)), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := addTestFile(db, user, "file0", "hello", "thumb 0"); err == nil {
+		t.Fatal("addTestFile succeeded with a corrupt quota file")
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "uploads"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Temporary files left after AddFile failed: %v", entries)
+	}
+	if n := len(db.tempHashes); n != 0 {
+		t.Errorf("%d temporary hash(es) left after AddFile failed", n)
+	}
+}
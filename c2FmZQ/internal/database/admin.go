@@ -25,6 +25,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sort"
 )
 
@@ -38,6 +39,9 @@ type AdminData struct {
 	Users            []AdminUser `json:"users,omitempty"`
 	DefaultQuota     *int64      `json:"defaultQuota,omitempty"`
 	DefaultQuotaUnit *string     `json:"defaultQuotaUnit,omitempty"`
+	// Who is charged for the files in shared albums: "owner" or
+	// "contributor".
+	SharedAlbumPolicy *string `json:"sharedAlbumPolicy,omitempty"`
 }
 
 // AdminUser encapsulates the user fields that are displayed on the admin
@@ -48,12 +52,27 @@ type AdminUser struct {
 	Locked    *bool   `json:"locked,omitempty"`
 	Approved  *bool   `json:"approved,omitempty"`
 	Admin     *bool   `json:"admin,omitempty"`
+	Hold      *bool   `json:"hold,omitempty"`
+	Limited   *bool   `json:"limited,omitempty"`
 	Quota     *int64  `json:"quota,omitempty"`
 	QuotaUnit *string `json:"quotaUnit,omitempty"`
+
+	MaxAlbums       *int64 `json:"maxAlbums,omitempty"`
+	MaxAlbumMembers *int64 `json:"maxAlbumMembers,omitempty"`
+
+	// Whether the user must change their password at the next login.
+	ResetPassword *bool `json:"resetPassword,omitempty"`
+
+	// The number of days after which the files in the user's trash are
+	// deleted, when it overrides the server's default. A negative value
+	// removes the override.
+	TrashRetentionDays *int `json:"trashRetentionDays,omitempty"`
 }
 
 // AdminData returns the data to display on the admin console.
 func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error) {
+	defer recordLatency("AdminData")()
+
 	var ul []userList
 	var quotas Quotas
 	files := []string{d.filePath(userListFile), d.filePath(quotaFile)}
@@ -80,27 +99,28 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 	}
 	defer commit(false, &retErr)
 
+	policy := SharedAlbumPolicyOwner
+	if quotas.SharedAlbumPolicy == SharedAlbumPolicyContributor {
+		policy = SharedAlbumPolicyContributor
+	}
 	adminData := &AdminData{
-		DefaultQuota:     &quotas.DefaultLimit,
-		DefaultQuotaUnit: &quotas.DefaultLimitUnit,
+		DefaultQuota:      &quotas.DefaultLimit,
+		DefaultQuotaUnit:  &quotas.DefaultLimitUnit,
+		SharedAlbumPolicy: &policy,
 	}
 	for _, user := range users {
 		approved := !user.NeedApproval
-		var quota *int64
-		var quotaUnit *string
-		if v, ok := quotas.Limits[user.UserID]; ok {
-			quota = &v.Value
-			quotaUnit = &v.Unit
-		}
-		adminData.Users = append(adminData.Users, AdminUser{
-			UserID:    user.UserID,
-			Email:     &user.Email,
-			Locked:    &user.LoginDisabled,
-			Approved:  &approved,
-			Admin:     &user.Admin,
-			Quota:     quota,
-			QuotaUnit: quotaUnit,
-		})
+		au := limitsForUser(*user, &quotas)
+		au.Email = &user.Email
+		au.Locked = &user.LoginDisabled
+		au.Approved = &approved
+		au.Admin = &user.Admin
+		au.Hold = &user.Hold
+		au.ResetPassword = &user.ForcePasswordChange
+		au.TrashRetentionDays = user.TrashRetentionDays
+		limited := user.Limited != nil
+		au.Limited = &limited
+		adminData.Users = append(adminData.Users, au)
 	}
 	sort.Slice(adminData.Users, func(i, j int) bool {
 		return *adminData.Users[i].Email < *adminData.Users[j].Email
@@ -127,11 +147,17 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 	if changes.DefaultQuotaUnit != nil {
 		quotas.DefaultLimitUnit = *changes.DefaultQuotaUnit
 	}
+	if p := changes.SharedAlbumPolicy; p != nil {
+		if *p != SharedAlbumPolicyOwner && *p != SharedAlbumPolicyContributor {
+			return nil, fmt.Errorf("invalid shared album policy %q", *p)
+		}
+		quotas.SharedAlbumPolicy = *p
+	}
 	for _, user := range changes.Users {
 		if user.Locked != nil {
 			users[user.UserID].LoginDisabled = *user.Locked
 			if *user.Locked {
-				users[user.UserID].ValidTokens = make(map[string]bool)
+				users[user.UserID].RevokeAllTokens()
 			}
 		}
 		if user.Approved != nil {
@@ -145,21 +171,33 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 				}
 			}
 		}
-		if user.Quota != nil {
-			if *user.Quota < 0 {
-				delete(quotas.Limits, user.UserID)
+		if user.Hold != nil {
+			users[user.UserID].Hold = *user.Hold
+		}
+		if user.ResetPassword != nil {
+			users[user.UserID].ForcePasswordChange = *user.ResetPassword
+			if *user.ResetPassword {
+				users[user.UserID].RevokeAllTokens()
+			}
+		}
+		if v := user.TrashRetentionDays; v != nil {
+			if *v < 0 {
+				users[user.UserID].TrashRetentionDays = nil
 			} else {
-				l := quotas.Limits[user.UserID]
-				l.Value = *user.Quota
-				if u := user.QuotaUnit; u != nil {
-					l.Unit = *u
-				}
-				quotas.Limits[user.UserID] = l
+				days := *v
+				users[user.UserID].TrashRetentionDays = &days
 			}
-		} else if user.QuotaUnit != nil {
-			l := quotas.Limits[user.UserID]
-			l.Unit = *user.QuotaUnit
-			quotas.Limits[user.UserID] = l
+		}
+		applyLimitChanges(&quotas, user)
+		if v := user.Limited; v != nil && !*v {
+			users[user.UserID].Limited = nil
+		} else if v != nil && users[user.UserID].Limited == nil {
+			users[user.UserID].Limited = &LimitedAccount{}
+		}
+		// The quota of limited accounts stays fixed, even when the
+		// default quota changes.
+		if users[user.UserID].Limited != nil {
+			fixLimitedQuota(&quotas, user.UserID, nil)
 		}
 	}
 
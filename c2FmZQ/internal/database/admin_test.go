@@ -85,13 +85,21 @@ func TestUpdates(t *testing.T) {
 				Admin:     ptr(true),
 				Locked:    ptr(true),
 				Approved:  ptr(false),
+				Hold:      ptr(true),
 				Quota:     ptr(int64(1)),
 				QuotaUnit: ptr("GB"),
 			},
+			{
+				UserID:        userIDs[1],
+				Limited:       ptr(true),
+				ResetPassword: ptr(true),
+			},
 			{
 				UserID:    userIDs[2],
 				Quota:     ptr(int64(100)),
 				QuotaUnit: ptr("MB"),
+
+				TrashRetentionDays: ptr(30),
 			},
 		},
 	}
@@ -99,9 +107,10 @@ func TestUpdates(t *testing.T) {
 		t.Fatalf("db.AdminData: %v", err)
 	}
 	exp := &database.AdminData{
-		Tag:              data.Tag,
-		DefaultQuota:     ptr(int64(10)),
-		DefaultQuotaUnit: ptr("MB"),
+		Tag:               data.Tag,
+		DefaultQuota:      ptr(int64(10)),
+		DefaultQuotaUnit:  ptr("MB"),
+		SharedAlbumPolicy: ptr("owner"),
 		Users: []database.AdminUser{
 			{
 				UserID:    userIDs[0],
@@ -109,15 +118,25 @@ func TestUpdates(t *testing.T) {
 				Admin:     ptr(true),
 				Locked:    ptr(true),
 				Approved:  ptr(false),
+				Hold:      ptr(true),
+				Limited:   ptr(false),
 				Quota:     ptr(int64(1)),
 				QuotaUnit: ptr("GB"),
+
+				ResetPassword: ptr(false),
 			},
 			{
-				UserID:   userIDs[1],
-				Email:    ptr("bob"),
-				Admin:    ptr(false),
-				Locked:   ptr(false),
-				Approved: ptr(true),
+				UserID:    userIDs[1],
+				Email:     ptr("bob"),
+				Admin:     ptr(false),
+				Locked:    ptr(false),
+				Approved:  ptr(true),
+				Hold:      ptr(false),
+				Limited:   ptr(true),
+				Quota:     ptr(int64(10)),
+				QuotaUnit: ptr("MB"),
+
+				ResetPassword: ptr(true),
 			},
 			{
 				UserID:    userIDs[2],
@@ -125,8 +144,13 @@ func TestUpdates(t *testing.T) {
 				Admin:     ptr(false),
 				Locked:    ptr(false),
 				Approved:  ptr(true),
+				Hold:      ptr(false),
+				Limited:   ptr(false),
 				Quota:     ptr(int64(100)),
 				QuotaUnit: ptr("MB"),
+
+				ResetPassword:      ptr(false),
+				TrashRetentionDays: ptr(30),
 			},
 		},
 	}
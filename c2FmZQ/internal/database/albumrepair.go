@@ -0,0 +1,63 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"c2FmZQ/internal/log"
+)
+
+// RepairAlbumRefs removes the references to albums that don't exist anymore
+// from the user's album list. Past bugs could leave them behind when an owner
+// deleted a shared album, and they make the user's updates fail. A delete
+// event is added for each album, so that the clients remove it too, and the
+// repair is recorded in the user's account activity. It returns the IDs of
+// the albums that were removed.
+func (d *Database) RepairAlbumRefs(user User) ([]string, error) {
+	if d.readOnly {
+		return nil, nil
+	}
+	albumRefs, err := d.AlbumRefs(user)
+	if err != nil {
+		return nil, err
+	}
+	var dangling []string
+	for albumID, ref := range albumRefs {
+		// Album files are never re-created, and an album that is being
+		// added already has its file.
+		if _, err := os.Stat(filepath.Join(d.Dir(), ref.File)); errors.Is(err, os.ErrNotExist) {
+			dangling = append(dangling, albumID)
+		}
+	}
+	sort.Strings(dangling)
+	for _, albumID := range dangling {
+		if err := d.removeAlbumRef(user.UserID, albumID); err != nil {
+			return nil, err
+		}
+		log.Infof("RepairAlbumRefs: removed dangling reference to album %q from user %d", albumID, user.UserID)
+		if err := d.RecordActivity(user.UserID, ActivityRepairAlbum, fmt.Sprintf("Removed album %s, which was deleted by its owner", albumID)); err != nil {
+			log.Errorf("RecordActivity: %v", err)
+		}
+	}
+	return dangling, nil
+}
@@ -0,0 +1,106 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestRepairAlbumRefs(t *testing.T) {
+	db := New(filepath.Join(t.TempDir(), "data"), nil)
+	var users []User
+	for _, email := range []string{"alice@", "bob@"} {
+		key := stingle.MakeSecretKeyForTest()
+		defer key.Wipe()
+		userID, err := db.AddUser(User{Email: email, PublicKey: key.PublicKey()})
+		if err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+		user, err := db.UserByID(userID)
+		if err != nil {
+			t.Fatalf("UserByID: %v", err)
+		}
+		users = append(users, user)
+	}
+	alice, bob := users[0], users[1]
+
+	for _, albumID := range []string{"album1", "album2"} {
+		if err := db.AddAlbum(alice, AlbumSpec{AlbumID: albumID, DateCreated: 1, DateModified: 1}); err != nil {
+			t.Fatalf("AddAlbum(%q): %v", albumID, err)
+		}
+	}
+	// bob has a reference to album1, but isn't a member, like after some
+	// past bugs. It is left behind when alice deletes the album.
+	ref, err := db.albumRef(alice, "album1")
+	if err != nil {
+		t.Fatalf("albumRef: %v", err)
+	}
+	if err := db.addAlbumRef(bob.UserID, "album1", ref.File); err != nil {
+		t.Fatalf("addAlbumRef: %v", err)
+	}
+	if err := db.DeleteAlbum(alice, "album1"); err != nil {
+		t.Fatalf("DeleteAlbum: %v", err)
+	}
+	if _, err := db.DeleteUpdates(bob, 0); err == nil {
+		t.Fatal("DeleteUpdates didn't fail with a dangling album reference")
+	}
+
+	for _, tc := range []struct {
+		user User
+		want []string
+	}{
+		{alice, nil},
+		{bob, []string{"album1"}},
+		{bob, nil},
+	} {
+		if got, err := db.RepairAlbumRefs(tc.user); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("RepairAlbumRefs(%q) = %v, %v, want %v", tc.user.Email, got, err, tc.want)
+		}
+	}
+	if _, err := db.albumRef(bob, "album1"); !os.IsNotExist(err) {
+		t.Errorf("albumRef(bob, album1) = %v, want ErrNotExist", err)
+	}
+	if _, err := db.albumRef(alice, "album2"); err != nil {
+		t.Errorf("albumRef(alice, album2): %v", err)
+	}
+	deletes, err := db.DeleteUpdates(bob, 0)
+	if err != nil {
+		t.Fatalf("DeleteUpdates: %v", err)
+	}
+	var found bool
+	for _, e := range deletes {
+		if e.AlbumID == "album1" && e.Type == number(stingle.DeleteEventAlbum) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("DeleteUpdates(bob) = %v, want an album delete event for album1", deletes)
+	}
+	activity, err := db.Activity(bob.UserID)
+	if err != nil {
+		t.Fatalf("Activity: %v", err)
+	}
+	if len(activity) != 1 || activity[0].Type != ActivityRepairAlbum {
+		t.Errorf("Activity(bob) = %+v, want one %q entry", activity, ActivityRepairAlbum)
+	}
+}
@@ -82,6 +82,17 @@ type AlbumSpec struct {
 	Members map[int64]bool `json:"members"`
 	// The private key of the album, encrypted for each member.
 	SharingKeys map[int64]string `json:"sharingKeys"`
+	// The code of the album's invite link, if any.
+	InviteCode string `json:"inviteCode,omitempty"`
+	// The pending requests to join the album, keyed by user ID. The value
+	// is the time of the request.
+	JoinRequests map[int64]int64 `json:"joinRequests,omitempty"`
+	// The time when the album is automatically unshared, in milliseconds.
+	UnshareDate int64 `json:"unshareDate,omitempty"`
+	// The token of the album's public share link, if any.
+	ShareLink string `json:"shareLink,omitempty"`
+	// The time when the share link expires, in milliseconds.
+	ShareLinkExpires int64 `json:"shareLinkExpires,omitempty"`
 }
 
 // Album returns a user's album information.
@@ -116,6 +127,23 @@ func (d *Database) makeAlbumPath() (string, error) {
 func (d *Database) AddAlbum(owner User, album AlbumSpec) (retErr error) {
 	defer recordLatency("AddAlbum")()
 
+	if !validID(album.AlbumID) {
+		return ErrInvalidID
+	}
+	ent, err := d.Entitlements(owner.UserID)
+	if err != nil {
+		return err
+	}
+	var count int64
+	if ent.MaxAlbums > 0 {
+		if count, err = d.ownedAlbumCount(owner); err != nil {
+			return err
+		}
+		if count >= ent.MaxAlbums {
+			log.Errorf("User album limit exceeded: %d >= %d", count, ent.MaxAlbums)
+			return ErrAlbumLimitExceeded
+		}
+	}
 	ap, err := d.makeAlbumPath()
 	if err != nil {
 		log.Errorf("makeAlbumPath() failed: %v", err)
@@ -136,12 +164,27 @@ func (d *Database) AddAlbum(owner User, album AlbumSpec) (retErr error) {
 		album.SharingKeys = make(map[int64]string)
 	}
 	fs.Album = &album
-	return commit(true, &retErr)
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	d.checkThresholds(owner, "albums", count, count+1, ent.MaxAlbums)
+	return nil
 }
 
 // DeleteAlbum deletes an album.
 func (d *Database) DeleteAlbum(owner User, albumID string) error {
 	defer recordLatency("DeleteAlbum")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+
+	if owner.Hold {
+		return ErrOnHold
+	}
+	unlock, err := d.lockFileSets(d.albumUsers(owner, albumID)...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	albumRef, err := d.albumRef(owner, albumID)
 	if err != nil {
@@ -151,6 +194,27 @@ func (d *Database) DeleteAlbum(owner User, albumID string) error {
 	if err != nil {
 		return err
 	}
+	// Limited accounts can only delete empty albums. The files have to be
+	// moved to the trash first.
+	if owner.Limited != nil && len(fs.Files) > 0 {
+		return ErrLimitedAccount
+	}
+	// The invite code, share link, and unshare date are removed after the
+	// album is unlocked.
+	defer func(code, link string, ownerID, unshareDate int64) {
+		if err := d.removeAlbumInvite(code); err != nil {
+			log.Errorf("removeAlbumInvite(%q) failed: %v", albumID, err)
+		}
+		if err := d.removeShareLink(link); err != nil {
+			log.Errorf("removeShareLink(%q) failed: %v", albumID, err)
+		}
+		if unshareDate == 0 {
+			return
+		}
+		if err := d.removeAlbumExpiry(ownerID, albumID); err != nil {
+			log.Errorf("removeAlbumExpiry(%q) failed: %v", albumID, err)
+		}
+	}(fs.Album.InviteCode, fs.Album.ShareLink, fs.Album.OwnerID, fs.Album.UnshareDate)
 	if err := d.storage.Lock(albumRef.File); err != nil {
 		return err
 	}
@@ -168,8 +232,9 @@ func (d *Database) DeleteAlbum(owner User, albumID string) error {
 		}
 	}
 	for _, f := range fs.Files {
-		d.incRefCount(f.StoreFile, -1)
-		d.incRefCount(f.StoreThumb, -1)
+		for _, blob := range f.blobs() {
+			d.incRefCount(blob, -1)
+		}
 	}
 	return nil
 }
@@ -321,6 +386,11 @@ func (d *Database) ShareAlbum(user User, sharing *stingle.Album, sharingKeys map
 		return err
 	}
 	defer commit(true, &retErr)
+	return d.shareAlbum(user, albumRef, fs, sharing, sharingKeys)
+}
+
+// shareAlbum adds members to an album that is already opened for update.
+func (d *Database) shareAlbum(user User, albumRef *AlbumRef, fs *FileSet, sharing *stingle.Album, sharingKeys map[string]string) (retErr error) {
 	if fs.Album.Members == nil {
 		fs.Album.Members = make(map[int64]bool)
 	}
@@ -330,6 +400,46 @@ func (d *Database) ShareAlbum(user User, sharing *stingle.Album, sharingKeys map
 	if fs.Album.OwnerID != user.UserID && (!fs.Album.IsShared || !fs.Album.Members[user.UserID] || !fs.Album.Permissions.AllowShare()) {
 		return fmt.Errorf("user %d is not allowed to share this album", user.UserID)
 	}
+	owner := user
+	if fs.Album.OwnerID != user.UserID {
+		var err error
+		if owner, err = d.UserByID(fs.Album.OwnerID); err != nil {
+			return err
+		}
+	}
+	ent, err := d.Entitlements(owner.UserID)
+	if err != nil {
+		return err
+	}
+	before := int64(len(fs.Album.Members))
+	if fs.Album.Members[owner.UserID] {
+		before--
+	}
+	newMembers := make(map[int64]bool)
+	for _, m := range strings.Split(sharing.Members, ",") {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err == nil && id != owner.UserID && !fs.Album.Members[id] {
+			newMembers[id] = true
+		}
+	}
+	if err := d.checkLimitedShare(user, newMembers); err != nil {
+		return err
+	}
+	if owner.UserID != user.UserID {
+		if err := d.checkLimitedShare(owner, newMembers); err != nil {
+			return err
+		}
+	}
+	after := before + int64(len(newMembers))
+	if ent.MaxAlbumMembers > 0 && after > ent.MaxAlbumMembers {
+		log.Errorf("Album member limit exceeded: %d > %d", after, ent.MaxAlbumMembers)
+		return ErrShareLimitExceeded
+	}
+	defer func() {
+		if retErr == nil {
+			d.checkThresholds(owner, "albumMembers", before, after, ent.MaxAlbumMembers)
+		}
+	}()
 	if fs.Album.OwnerID == user.UserID {
 		fs.Album.IsShared = true
 		fs.Album.IsHidden = sharing.IsHidden == "1"
@@ -376,17 +486,35 @@ func (d *Database) ShareAlbum(user User, sharing *stingle.Album, sharingKeys map
 func (d *Database) UnshareAlbum(owner User, albumID string) (retErr error) {
 	defer recordLatency("UnshareAlbums")()
 
+	// The invite code and unshare date are removed after the album is
+	// unlocked.
+	var inviteCode string
+	var unshareDate int64
+	defer func() {
+		if retErr == nil {
+			retErr = d.removeAlbumInvite(inviteCode)
+		}
+		if retErr == nil && unshareDate != 0 {
+			retErr = d.removeAlbumExpiry(owner.UserID, albumID)
+		}
+	}()
 	commit, fs, err := d.fileSetForUpdate(owner, stingle.AlbumSet, albumID)
 	if err != nil {
 		return err
 	}
 	defer commit(true, &retErr)
 
+	inviteCode, unshareDate = fs.Album.InviteCode, fs.Album.UnshareDate
+	fs.Album.InviteCode = ""
+	fs.Album.UnshareDate = 0
+	fs.Album.JoinRequests = nil
 	fs.Album.IsShared = false
 	for m, _ := range fs.Album.Members {
 		if m == owner.UserID {
 			continue
 		}
+		removeMemberReactions(fs, m)
+		delete(fs.SeenMarkers, m)
 		if err := d.removeAlbumRef(m, albumID); err != nil {
 			log.Errorf("removeAlbumRef(%d, %q) failed: %v", m, albumID, err)
 		}
@@ -495,6 +623,8 @@ func (d *Database) RemoveAlbumMember(user User, albumID string, memberID int64)
 	defer commit(true, &retErr)
 	delete(fs.Album.Members, memberID)
 	delete(fs.Album.SharingKeys, memberID)
+	removeMemberReactions(fs, memberID)
+	delete(fs.SeenMarkers, memberID)
 	fs.Album.DateModified = nowInMS()
 	return d.removeAlbumRef(memberID, albumID)
 }
@@ -0,0 +1,226 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// The maximum number of directory levels for blob files.
+const maxBlobFanOut = 4
+
+// blobPath returns the path where the blob with the given base name is stored,
+// e.g. 3A/F1/<name> with a fan-out of 2. The directory names are derived from
+// the first bytes of the name.
+func (d *Database) blobPath(name string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < d.blobFanOut {
+		return "", fmt.Errorf("blob name too short: %q", name)
+	}
+	elems := make([]string, 0, d.blobFanOut+1)
+	for i := 0; i < d.blobFanOut; i++ {
+		elems = append(elems, fmt.Sprintf("%02X", b[i]))
+	}
+	return filepath.Join(append(elems, name)...), nil
+}
+
+// blobFanOutOf returns the number of directory levels of a blob path.
+func blobFanOutOf(blob string) int {
+	return strings.Count(blob, string(filepath.Separator))
+}
+
+// MigrateBlobsStats contains the results of MigrateBlobs.
+type MigrateBlobsStats struct {
+	// The number of blobs that were copied to their new path.
+	Blobs int
+	// The number of file references that were updated.
+	Refs int
+}
+
+// MigrateBlobs moves the blobs that aren't stored with the database's current
+// fan-out to their new path. It can run while the server is running. Each file
+// set is updated atomically, and the old blob is deleted when the last file
+// that uses it is updated. Files that are added with an old path while the
+// migration runs are left as they are, and a second run will move them.
+//
+// The blobs are encrypted with their path as context, so they are re-encrypted
+// when they are moved.
+func (d *Database) MigrateBlobs() (stats MigrateBlobsStats, retErr error) {
+	uids, err := d.UserIDs()
+	if err != nil {
+		return stats, err
+	}
+	moved := make(map[string]string)
+	for _, uid := range uids {
+		user, err := d.UserByID(uid)
+		if err != nil {
+			return stats, err
+		}
+		albums, err := d.AlbumRefs(user)
+		if err != nil {
+			return stats, err
+		}
+		fileSets := []string{
+			d.fileSetPath(user, stingle.GallerySet),
+			d.fileSetPath(user, stingle.TrashSet),
+		}
+		for _, a := range albums {
+			fileSets = append(fileSets, a.File)
+		}
+		for _, fs := range fileSets {
+			if err := d.migrateFileSetBlobs(fs, moved, &stats); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// migrateFileSetBlobs moves the blobs of one file set. The blobs are copied
+// before the file set is locked so that other updates aren't blocked while
+// large files are copied.
+func (d *Database) migrateFileSetBlobs(fileName string, moved map[string]string, stats *MigrateBlobsStats) (retErr error) {
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+	var fileSet FileSet
+	if err := d.storage.ReadDataFile(fileName, &fileSet); err != nil {
+		return err
+	}
+	var copied []string
+	defer func() {
+		// Delete the copies that aren't used, e.g. because the file was
+		// deleted while it was copied.
+		for _, blob := range copied {
+			if _, err := os.Stat(filepath.Join(d.Dir(), d.blobRef(blob))); err == nil {
+				continue
+			}
+			for k, v := range moved {
+				if v == blob {
+					delete(moved, k)
+				}
+			}
+			if err := d.storage.DeleteBlob(blob); err != nil {
+				log.Errorf("DeleteBlob(%q) failed: %v", blob, err)
+			}
+		}
+	}()
+	for _, file := range fileSet.Files {
+		for _, blob := range file.blobs() {
+			if blobFanOutOf(blob) == d.blobFanOut {
+				continue
+			}
+			if _, ok := moved[blob]; ok {
+				continue
+			}
+			newBlob, err := d.copyBlob(blob)
+			if err != nil {
+				return err
+			}
+			moved[blob] = newBlob
+			copied = append(copied, newBlob)
+			stats.Blobs++
+		}
+	}
+	if !usesBlobs(fileSet, moved) {
+		return nil
+	}
+
+	// Read the file set again while holding the lock.
+	fileSet = FileSet{}
+	commit, err := d.storage.OpenForUpdate(fileName, &fileSet)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	for _, file := range fileSet.Files {
+		for _, blob := range []*string{&file.StoreFile, &file.StoreThumb, &file.StoreMedium} {
+			newBlob, ok := moved[*blob]
+			if !ok {
+				continue
+			}
+			d.storage.CreateEmptyFile(d.blobRef(newBlob), BlobSpec{})
+			d.incRefCount(newBlob, 1)
+			d.incRefCount(*blob, -1)
+			*blob = newBlob
+			stats.Refs++
+		}
+	}
+	return commit(true, nil)
+}
+
+// usesBlobs returns true if any of the files in fileSet use one of the blobs.
+func usesBlobs(fileSet FileSet, blobs map[string]string) bool {
+	for _, file := range fileSet.Files {
+		for _, blob := range file.blobs() {
+			if _, ok := blobs[blob]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyBlob copies a blob to its path with the current fan-out, and returns the
+// new path.
+func (d *Database) copyBlob(blob string) (string, error) {
+	_, name := filepath.Split(blob)
+	newBlob, err := d.blobPath(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(d.Dir(), d.blobRef(newBlob))); err == nil {
+		// Already copied by a previous run.
+		return newBlob, nil
+	}
+	log.Debugf("Moving blob %s to %s", blob, newBlob)
+	r, err := d.storage.OpenBlobRead(blob)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	temp := newBlob + ".tmp"
+	os.Remove(filepath.Join(d.Dir(), temp))
+	w, err := d.storage.OpenBlobWrite(temp, newBlob)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(filepath.Join(d.Dir(), temp))
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(filepath.Join(d.Dir(), temp))
+		return "", err
+	}
+	if err := d.storage.CommitBlob(temp, newBlob); err != nil {
+		return "", err
+	}
+	return newBlob, nil
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestMigrateBlobs(t *testing.T) {
+	dir := t.TempDir()
+	pp := []byte("passphrase")
+	db := database.New(dir, pp)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	files := []string{"file1", "file2", "file3"}
+	for _, f := range files {
+		if err := addFile(db, user, f, stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile(%q) failed: %v", f, err)
+		}
+	}
+	if err := addAlbum(db, user, "album1"); err != nil {
+		t.Fatalf("addAlbum failed: %v", err)
+	}
+	// file1 is in the gallery and in the album. Its blobs are shared.
+	if err := db.MoveFile(user, database.MoveFileParams{
+		SetFrom:   stingle.GallerySet,
+		SetTo:     stingle.AlbumSet,
+		AlbumIDTo: "album1",
+		Filenames: []string{"file1"},
+	}); err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+
+	blobs := func(db *database.Database, set, albumID string) []string {
+		fs, err := db.FileSet(user, set, albumID)
+		if err != nil {
+			t.Fatalf("db.FileSet(%q, %q) failed: %v", set, albumID, err)
+		}
+		var out []string
+		for _, f := range fs.Files {
+			out = append(out, f.StoreFile, f.StoreThumb)
+		}
+		return out
+	}
+	oldBlobs := blobs(db, stingle.GallerySet, "")
+
+	db = database.NewWithOptions(dir, pp, database.Options{BlobFanOut: 2})
+	stats, err := db.MigrateBlobs()
+	if err != nil {
+		t.Fatalf("MigrateBlobs failed: %v", err)
+	}
+	if got, want := stats, (database.MigrateBlobsStats{Blobs: 6, Refs: 8}); got != want {
+		t.Errorf("MigrateBlobs() = %+v, want %+v", got, want)
+	}
+
+	for _, b := range append(blobs(db, stingle.GallerySet, ""), blobs(db, stingle.AlbumSet, "album1")...) {
+		if n := strings.Count(b, string(filepath.Separator)); n != 2 {
+			t.Errorf("Blob %q has %d levels, want 2", b, n)
+		}
+	}
+	for _, b := range oldBlobs {
+		if _, err := os.Stat(filepath.Join(dir, b)); !os.IsNotExist(err) {
+			t.Errorf("Old blob %q still exists: %v", b, err)
+		}
+	}
+	for _, f := range files {
+		for _, want := range []string{"file content " + f, "thumb content " + f} {
+			r, err := db.DownloadFile(user, stingle.GallerySet, f, want == "thumb content "+f)
+			if err != nil {
+				t.Fatalf("DownloadFile(%q) failed: %v", f, err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != want {
+				t.Errorf("DownloadFile(%q) = %q, %v, want %q", f, got, err, want)
+			}
+		}
+	}
+
+	if stats, err := db.MigrateBlobs(); err != nil || stats.Blobs != 0 || stats.Refs != 0 {
+		t.Errorf("Second MigrateBlobs() = %+v, %v, want no changes", stats, err)
+	}
+}
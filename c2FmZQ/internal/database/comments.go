@@ -0,0 +1,167 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"sort"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// The maximum size of the encrypted content of a comment.
+	maxCommentSize = 16 << 10
+)
+
+var (
+	ErrCommentTooLarge = errors.New("comment too large")
+)
+
+// Comment is an end-to-end encrypted comment in an album. The content is
+// encrypted by the client. The server only sees who added the comment, when,
+// and which file it is about.
+type Comment struct {
+	// The file that the comment is about, if any.
+	File string `json:"file,omitempty"`
+	// The user who added the comment.
+	UserID int64 `json:"userId"`
+	// The encrypted content of the comment.
+	Content string `json:"content"`
+	// The time when the comment was added.
+	DateCreated int64 `json:"dateCreated"`
+}
+
+// AddComment adds a comment to an album. The user must be the owner or a
+// member of the album. It returns the ID of the new comment.
+func (d *Database) AddComment(user User, albumID, file, content string) (commentID string, retErr error) {
+	defer recordLatency("AddComment")()
+
+	if len(content) > maxCommentSize {
+		return "", ErrCommentTooLarge
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	commentID = base64.RawURLEncoding.EncodeToString(id)
+
+	commit, fs, err := d.fileSetForUpdate(user, stingle.AlbumSet, albumID)
+	if err != nil {
+		return "", err
+	}
+	defer commit(true, &retErr)
+	if fs.Album == nil || (fs.Album.OwnerID != user.UserID && !fs.Album.Members[user.UserID]) {
+		return "", os.ErrPermission
+	}
+	if fs.Comments == nil {
+		fs.Comments = make(map[string]*Comment)
+	}
+	fs.Comments[commentID] = &Comment{
+		File:        file,
+		UserID:      user.UserID,
+		Content:     content,
+		DateCreated: nowInMS(),
+	}
+	return commentID, nil
+}
+
+// DeleteComment deletes a comment from an album. Only the user who added the
+// comment and the owner of the album can delete it.
+func (d *Database) DeleteComment(user User, albumID, commentID string) (retErr error) {
+	defer recordLatency("DeleteComment")()
+
+	commit, fs, err := d.fileSetForUpdate(user, stingle.AlbumSet, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	c, ok := fs.Comments[commentID]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if fs.Album == nil || (c.UserID != user.UserID && fs.Album.OwnerID != user.UserID) {
+		return os.ErrPermission
+	}
+	delete(fs.Comments, commentID)
+	fs.Deletes = append(fs.Deletes, DeleteEvent{
+		File:    commentID,
+		AlbumID: albumID,
+		Type:    stingle.DeleteEventComment,
+		Date:    nowInMS(),
+	})
+	pruneDeleteEvents(&fs.Deletes, &fs.DeleteHorizon)
+	return nil
+}
+
+// CommentUpdates returns the comments that were added to the user's albums,
+// and the comments that were deleted, since time ts.
+func (d *Database) CommentUpdates(user User, ts int64) ([]stingle.Comment, []stingle.DeleteEvent, error) {
+	defer recordLatency("CommentUpdates")()
+
+	albumRefs, err := d.AlbumRefs(user)
+	if err != nil {
+		log.Errorf("AlbumRefs(%q) failed: %v", user.Email, err)
+		return nil, nil, err
+	}
+	comments := []stingle.Comment{}
+	deletes := []stingle.DeleteEvent{}
+	for albumID := range albumRefs {
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ts > 0 && ts < fs.DeleteHorizon {
+			return nil, nil, ErrUpdateTimestampTooOld
+		}
+		for k, c := range fs.Comments {
+			if c.DateCreated > ts {
+				comments = append(comments, stingle.Comment{
+					CommentID:   k,
+					AlbumID:     albumID,
+					File:        c.File,
+					UserID:      number(c.UserID),
+					Content:     c.Content,
+					DateCreated: number(c.DateCreated),
+				})
+			}
+		}
+		for _, de := range fs.Deletes {
+			if de.Date > ts && de.Type == stingle.DeleteEventComment {
+				deletes = append(deletes, stingle.DeleteEvent{
+					File:    de.File,
+					AlbumID: de.AlbumID,
+					Type:    number(int64(de.Type)),
+					Date:    number(de.Date),
+				})
+			}
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		if comments[i].DateCreated == comments[j].DateCreated {
+			return comments[i].CommentID < comments[j].CommentID
+		}
+		return comments[i].DateCreated < comments[j].DateCreated
+	})
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Date < deletes[j].Date })
+	return comments, deletes, nil
+}
@@ -32,6 +32,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -50,37 +51,160 @@ var (
 	// Set this only for tests.
 	CurrentTimeForTesting int64 = 0
 
+	// ErrReadOnly is returned by the operations that modify the database
+	// when it is in read-only mode.
+	ErrReadOnly = secure.ErrReadOnly
+
+	// funcLatency has one histogram per database operation. Most operations
+	// take only a few milliseconds, so the buckets start at 1ms to make the
+	// percentiles of the fast operations meaningful.
 	funcLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "database_response_time",
-			Help:    "The database's response time",
-			Buckets: []float64{0.01, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20, 30, 45, 60, 90, 120},
+			Help:    "The database's response time in seconds, by operation",
+			Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20, 30, 45, 60, 90, 120},
 		},
 		[]string{"func"},
 	)
+	thumbCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "database_thumbnail_cache_requests_total",
+			Help: "Number of thumbnail cache requests",
+		},
+		[]string{"result"},
+	)
+	prefetchBlobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "database_prefetch_blobs_total",
+			Help: "Number of blobs read ahead, and of downloads served from them",
+		},
+		[]string{"result"},
+	)
+	gcReclaimedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "database_gc_reclaimed_bytes_total",
+			Help: "Number of bytes reclaimed by deleting unreferenced blobs",
+		},
+	)
+	gcInconsistencies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "database_gc_inconsistencies_total",
+			Help: "Number of inconsistencies found by the garbage collector, by type",
+		},
+		[]string{"type"},
+	)
+	dedupBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "database_dedup_bytes_total",
+			Help: "Number of uploaded bytes that weren't stored because an identical blob already existed",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(funcLatency)
+	prometheus.MustRegister(thumbCacheRequests)
+	prometheus.MustRegister(prefetchBlobs)
+	prometheus.MustRegister(gcReclaimedBytes)
+	prometheus.MustRegister(gcInconsistencies)
+	prometheus.MustRegister(dedupBytes)
 
 }
 
+// recordLatency starts a timer for the database operation name. The returned
+// function observes the elapsed time in the operation's histogram.
 func recordLatency(name string) func() time.Duration {
 	timer := prometheus.NewTimer(funcLatency.WithLabelValues(name))
 	return timer.ObserveDuration
 }
 
+// Options contains the optional settings of the database.
+type Options struct {
+	// Locker coordinates updates to the metadata files, e.g. when multiple
+	// server instances share the same database.
+	Locker secure.Locker
+	// BlobStore stores the content of files and thumbnails, e.g. in a blob
+	// store that is shared by multiple server instances.
+	BlobStore secure.BlobStore
+	// DropBlobCache tells the kernel not to keep the blob files in the page
+	// cache after they are written.
+	DropBlobCache bool
+	// BlobFanOut is the number of directory levels under which new blob
+	// files are stored. Each level has 256 directories. The default is 1.
+	// Existing blobs can be moved with MigrateBlobs.
+	BlobFanOut int
+	// CompressMetadata compresses the metadata files when they are written.
+	// Existing files are compressed the next time they are updated.
+	CompressMetadata bool
+	// ReadOnly opens the database in read-only mode, e.g. to serve a replica
+	// or a snapshot. All the operations that modify the database return
+	// ErrReadOnly, and API usage isn't recorded.
+	ReadOnly bool
+	// PurgeDelay is how long the content of the files deleted from the
+	// trash is kept before it is released, so that the files can be
+	// restored with UndeleteFiles. The default is to release it right away.
+	// PurgeDeletedFiles must be called periodically.
+	PurgeDelay time.Duration
+	// TrashRetentionDays is the number of days after which the files in
+	// the trash are deleted automatically. Administrators can override it
+	// for each user. The default, 0, keeps them until the user deletes
+	// them. ExpireTrash must be called periodically.
+	TrashRetentionDays int
+	// PrefetchMemory is the maximum number of bytes of file content that is
+	// read ahead when a user downloads files sequentially, e.g. when
+	// browsing an album one file at a time. The default, 0, disables it.
+	PrefetchMemory int64
+	// EncryptionAlgorithm is the algorithm used by the master key of a new
+	// database, see crypto.ParseAlgo. The default is "auto", i.e. AES256 when
+	// the CPU supports it, Chacha20Poly1305 otherwise. It is ignored when the
+	// master key already exists.
+	EncryptionAlgorithm string
+
+	// reEncrypting is set by ReEncrypt to open the database while a
+	// re-encryption is in progress.
+	reEncrypting bool
+}
+
 // New returns an initialized database that uses dir for storage.
 func New(dir string, passphrase []byte) *Database {
-	db := &Database{dir: dir}
+	return NewWithOptions(dir, passphrase, Options{})
+}
+
+// NewWithOptions returns an initialized database that uses dir for storage,
+// with additional options.
+func NewWithOptions(dir string, passphrase []byte, opts Options) *Database {
+	db := &Database{dir: dir, blobFanOut: opts.BlobFanOut, readOnly: opts.ReadOnly, purgeDelay: opts.PurgeDelay, trashRetentionDays: opts.TrashRetentionDays, remoteBlobs: opts.BlobStore != nil, clustered: opts.Locker != nil}
+	if db.blobFanOut == 0 {
+		db.blobFanOut = 1
+	}
+	if db.blobFanOut < 1 || db.blobFanOut > maxBlobFanOut {
+		log.Fatalf("BlobFanOut must be between 1 and %d", maxBlobFanOut)
+	}
+	if ReEncryptInProgress(dir) && !opts.reEncrypting {
+		log.Fatal("A re-encryption was interrupted. Run 'inspect change-master-key' again to complete it.")
+	}
+	sopts := secure.Options{
+		Locker:            opts.Locker,
+		BlobStore:         opts.BlobStore,
+		DropBlobCache:     opts.DropBlobCache,
+		CompressDataFiles: opts.CompressMetadata,
+		ReadOnly:          opts.ReadOnly,
+	}
 	mkFile := filepath.Join(dir, "master.key")
 	if len(passphrase) > 0 {
 		if _, err := os.Stat(filepath.Join(dir, "metadata", "users.dat")); err == nil {
 			log.Fatal("Passphrase is set, but metadata/users.dat exists.")
 		}
 		var err error
-		if db.masterKey, err = crypto.ReadMasterKey(passphrase, mkFile); errors.Is(err, os.ErrNotExist) {
-			if db.masterKey, err = crypto.CreateMasterKey(crypto.PickFastest); err != nil {
+		if db.masterKey, err = crypto.ReadMasterKey(passphrase, mkFile); errors.Is(err, os.ErrNotExist) && !opts.ReadOnly {
+			if opts.EncryptionAlgorithm == "" {
+				opts.EncryptionAlgorithm = "auto"
+			}
+			alg, perr := crypto.ParseAlgo(opts.EncryptionAlgorithm)
+			if perr != nil {
+				log.Fatalf("Invalid encryption algorithm %q", opts.EncryptionAlgorithm)
+			}
+			if db.masterKey, err = crypto.CreateMasterKey(alg); err != nil {
 				log.Fatal("Failed to create master key")
 			}
 			err = db.masterKey.Save(passphrase, mkFile)
@@ -88,28 +212,49 @@ func New(dir string, passphrase []byte) *Database {
 		if err != nil {
 			log.Fatalf("Failed to decrypt master key: %v", err)
 		}
-		db.storage = secure.NewStorage(dir, db.masterKey)
+		db.storage = secure.NewStorageWithOptions(dir, db.masterKey, sopts)
 	} else {
 		if _, err := os.Stat(mkFile); err == nil {
 			log.Fatal("Passphrase is empty, but master.key exists.")
 		}
-		db.storage = secure.NewStorage(dir, nil)
+		db.storage = secure.NewStorageWithOptions(dir, nil, sopts)
 	}
 
 	if _, err := os.Stat(filepath.Join(dir, "metadata")); err == nil {
 		log.Fatal("Old database format detected. Please read https://github.com/c2FmZQ/c2FmZQ/commit/b55a977c26bdcfec9453d5942c6009a5f80b6d23")
 	}
 
-	// Fail silently if it already exists.
-	db.storage.CreateEmptyFile(db.filePath(userListFile), []userList{})
-	db.CreateEmptyQuotaFile()
-	db.createEmptyPushServiceConfigurationFile()
+	if db.selfTestErr = db.selfTest(); db.selfTestErr != nil {
+		log.Errorf("Database self-test: %v", db.selfTestErr)
+	}
+	if !opts.ReadOnly && db.selfTestErr == nil {
+		// Fail silently if it already exists.
+		db.storage.CreateEmptyFile(db.filePath(userListFile), []userList{})
+		db.CreateEmptyQuotaFile()
+		db.createEmptyPushServiceConfigurationFile()
+		db.createProbeFile()
+	}
 
 	db.fileSetCacheSize = 20
 	db.fileSetCache, _ = simplelru.NewLRU(db.fileSetCacheSize, nil)
 	db.albumRefCacheSize = 20
 	db.albumRefCache, _ = simplelru.NewLRU(db.albumRefCacheSize, nil)
+	db.thumbCache, _ = simplelru.NewLRU(maxThumbCacheBytes/1024, func(_ interface{}, v interface{}) {
+		db.thumbCacheBytes -= len(v.([]byte))
+	})
+	if opts.PrefetchMemory > 0 {
+		db.prefetchMax = opts.PrefetchMemory
+		db.prefetchCache, _ = simplelru.NewLRU(1024, func(_ interface{}, v interface{}) {
+			db.prefetchBytes -= int64(len(v.([]byte)))
+		})
+		db.prefetchInFlight = make(map[string]bool)
+		db.prefetchLast, _ = simplelru.NewLRU(1024, nil)
+		db.prefetchSem = make(chan struct{}, maxConcurrentPrefetch)
+	}
 
+	if db.selfTestErr != nil {
+		return db
+	}
 	if err := db.readPushServiceConfigurationFile(); err != nil {
 		log.Fatalf("pushServices: %v", err)
 	}
@@ -123,9 +268,32 @@ func New(dir string, passphrase []byte) *Database {
 // Database implements all the storage requirements of the c2FmZQ server using
 // encrypted storage on a local filesystem.
 type Database struct {
-	dir       string
-	masterKey crypto.MasterKey
-	storage   *secure.Storage
+	dir        string
+	masterKey  crypto.MasterKey
+	storage    *secure.Storage
+	blobFanOut int
+	readOnly   bool
+	purgeDelay time.Duration
+	// trashRetentionDays is the default number of days after which the
+	// files in the trash are deleted. See ExpireTrash.
+	trashRetentionDays int
+	// remoteBlobs is true when the blobs are stored in a BlobStore.
+	remoteBlobs bool
+	// clustered is true when the database is shared by multiple server
+	// instances, i.e. when a Locker is used.
+	clustered bool
+	// refMutex is held for reading by the operations that change the
+	// references to blobs, and for writing by CollectGarbage while it fixes
+	// the reference counts.
+	refMutex sync.RWMutex
+	// tempHashes contains the content hashes of the temporary files,
+	// keyed by file name. See AddFile. They are only known by the server
+	// instance that wrote the file. When another instance adds it, the
+	// hash is missing and the content isn't deduplicated.
+	tempHashes    map[string]tempHash
+	tempHashMutex sync.Mutex
+	// selfTestErr is the result of the self-test. See SelfTestError.
+	selfTestErr error
 
 	fileSetCache      *simplelru.LRU
 	fileSetCacheSize  int
@@ -135,11 +303,41 @@ type Database struct {
 	albumRefCacheSize  int
 	albumRefCacheMutex sync.Mutex
 
+	thumbCache      *simplelru.LRU
+	thumbCacheBytes int
+	thumbCacheMutex sync.Mutex
+
+	// The content of the files that were read ahead, and the last file
+	// that each user downloaded. See prefetchNext.
+	prefetchMax      int64
+	prefetchCache    *simplelru.LRU
+	prefetchBytes    int64
+	prefetchInFlight map[string]bool
+	prefetchLast     *simplelru.LRU
+	prefetchSem      chan struct{}
+	prefetchMutex    sync.Mutex
+
 	notifyChan   chan notifyItem
 	pushServices webpush.PushServiceConfiguration
+
+	// The usage data that this server instance hasn't saved yet. Each
+	// instance adds its own counts to the saved ones. See FlushUsage.
+	usageMutex   sync.Mutex
+	pendingUsage map[int64]map[string]*DailyUsage
+	// The active devices, keyed by user ID, day, and device ID.
+	pendingDevices map[int64]map[string]map[string]bool
+	usageFlushed   time.Time
+
+	thresholdHook func(ThresholdEvent)
+
+	// userLocks contains a *sync.RWMutex for each user. See Snapshot.
+	userLocks sync.Map
 }
 
 func (d *Database) Wipe() {
+	if err := d.FlushUsage(); err != nil {
+		log.Errorf("FlushUsage: %v", err)
+	}
 	if d.masterKey != nil {
 		d.masterKey.Wipe()
 	}
@@ -154,6 +352,17 @@ func (d *Database) Dir() string {
 	return d.dir
 }
 
+// Clustered returns true when the database is shared by multiple server
+// instances.
+func (d *Database) Clustered() bool {
+	return d.clustered
+}
+
+// ReadOnly returns true when the database is in read-only mode.
+func (d *Database) ReadOnly() bool {
+	return d.readOnly
+}
+
 func (d *Database) Hash(in []byte) []byte {
 	if d.masterKey != nil {
 		return d.masterKey.Hash(in)
@@ -186,6 +395,85 @@ func (d *Database) Decrypt(m string) ([]byte, error) {
 	return d.masterKey.Decrypt(b)
 }
 
+// Snapshot blocks the changes that span multiple file sets of the user, e.g.
+// moving files between the gallery and the trash, until release is called.
+// The reads done in between see a consistent view of the user's files. When
+// the database is shared by multiple server instances, the lock is also
+// acquired from the Locker, so that the changes made by the other instances
+// are blocked too.
+func (d *Database) Snapshot(user User) (release func()) {
+	l := d.userLock(user.UserID)
+	l.RLock()
+	if !d.clustered {
+		return l.RUnlock
+	}
+	unlock, err := d.lock(d.filePath(homeByUserID(user.UserID, fileSetsLockFile)))
+	if err != nil {
+		log.Errorf("Snapshot(%d): %v", user.UserID, err)
+		return l.RUnlock
+	}
+	return func() {
+		unlock()
+		l.RUnlock()
+	}
+}
+
+// lockFileSets blocks the snapshots of the users until unlock is called. It
+// is used by the changes that span multiple file sets. The users are locked in
+// order, so that concurrent calls can't deadlock.
+func (d *Database) lockFileSets(userIDs ...int64) (unlock func(), err error) {
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	var unlocks []func()
+	unlock = func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, userID := range userIDs {
+		if i > 0 && userID == userIDs[i-1] {
+			continue
+		}
+		l := d.userLock(userID)
+		l.Lock()
+		unlocks = append(unlocks, l.Unlock)
+		if !d.clustered {
+			continue
+		}
+		u, err := d.lock(d.filePath(homeByUserID(userID, fileSetsLockFile)))
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+// albumUsers returns the user, and the owners and members of the albums that
+// the user has access to. Changes to these albums are seen by all of them.
+func (d *Database) albumUsers(user User, albumIDs ...string) []int64 {
+	userIDs := []int64{user.UserID}
+	for _, albumID := range albumIDs {
+		if albumID == "" {
+			continue
+		}
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil || fs.Album == nil {
+			continue
+		}
+		userIDs = append(userIDs, fs.Album.OwnerID)
+		for member := range fs.Album.Members {
+			userIDs = append(userIDs, member)
+		}
+	}
+	return userIDs
+}
+
+func (d *Database) userLock(userID int64) *sync.RWMutex {
+	l, _ := d.userLocks.LoadOrStore(userID, &sync.RWMutex{})
+	return l.(*sync.RWMutex)
+}
+
 // filePath returns a cryptographically secure hash of a logical file name.
 func (d *Database) filePath(elems ...string) string {
 	if d.masterKey != nil {
@@ -214,7 +502,7 @@ func boolToNumber(b bool) json.Number {
 
 // number converts an integer to a json.Number.
 func number(n int64) json.Number {
-	return json.Number(fmt.Sprintf("%d", n))
+	return json.Number(strconv.FormatInt(n, 10))
 }
 
 // createParentIfNotExist creates filename's parent directory if it doesn't
@@ -254,38 +542,14 @@ func showCallStack() {
 
 // DumpFile shows the content of a file to stdout.
 func (d *Database) DumpFile(filename string) error {
-	var (
-		user          User
-		blob          BlobSpec
-		userList      []userList
-		albumManifest AlbumManifest
-		contactList   ContactList
-		fileSet       FileSet
-	)
-
 	out := func(obj interface{}) error {
 		enc := json.NewEncoder(os.Stdout)
 		enc.SetIndent("", "  ")
 		return enc.Encode(obj)
 	}
 
-	if err := d.storage.ReadDataFile(filename, &user); err == nil && user.UserID != 0 {
-		return out(user)
-	}
-	if err := d.storage.ReadDataFile(filename, &blob); err == nil && blob.RefCount > 0 {
-		return out(blob)
-	}
-	if err := d.storage.ReadDataFile(filename, &userList); err == nil && userList != nil {
-		return out(userList)
-	}
-	if err := d.storage.ReadDataFile(filename, &albumManifest); err == nil && albumManifest.Albums != nil {
-		return out(albumManifest)
-	}
-	if err := d.storage.ReadDataFile(filename, &contactList); err == nil && contactList.Contacts != nil {
-		return out(contactList)
-	}
-	if err := d.storage.ReadDataFile(filename, &fileSet); err == nil && fileSet.Files != nil {
-		return out(fileSet)
+	if obj, err := d.readMetadataFile(filename); err == nil {
+		return out(obj)
 	}
 	if r, err := d.storage.OpenBlobRead(filename); err == nil {
 		io.Copy(os.Stdout, r)
@@ -417,13 +681,14 @@ func (d *Database) FindOrphanFiles(del bool) error {
 type DFile struct {
 	RelativePath string // Relative path to database directory.
 	LogicalPath  string // Logical path before hashing.
+	IsBlob       bool   // The file contains the data of a file or thumbnail.
 }
 
 // FileIterator returns a channel from which all the database files can be read.
 func (d *Database) FileIterator() <-chan DFile {
 	ch := make(chan DFile)
 	fp := func(f string) DFile {
-		return DFile{d.filePath(f), f}
+		return DFile{RelativePath: d.filePath(f), LogicalPath: f}
 	}
 	fsp := func(u User, set string) DFile {
 		return fp(u.home(fmt.Sprintf(fileSetPattern, set)))
@@ -431,8 +696,16 @@ func (d *Database) FileIterator() <-chan DFile {
 	go func() {
 		defer close(ch)
 		ch <- fp(quotaFile)
-		if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(cacheFile))); err == nil {
-			ch <- fp(cacheFile)
+		for _, f := range []string{cacheFile, usageReportFile, pushServiceConfigFile, probeFile, albumInvitesFile, albumDigestsFile, albumExpiryFile, loginAttemptsFile, albumEscrowFile, shareLinksFile, settingsFile} {
+			if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(f))); err == nil {
+				ch <- fp(f)
+			}
+		}
+		for i := 0; i < blobHashShards; i++ {
+			f := blobHashShardByIndex(i)
+			if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(f))); err == nil {
+				ch <- fp(f)
+			}
 		}
 
 		var ul []userList
@@ -476,17 +749,17 @@ func (d *Database) FileIterator() <-chan DFile {
 					continue
 				}
 				if fs.Album != nil {
-					ch <- DFile{f.file, ""}
+					ch <- DFile{RelativePath: f.file}
 				}
 				for _, file := range fs.Files {
-					for _, blob := range []string{file.StoreFile, file.StoreThumb} {
+					for _, blob := range file.blobs() {
 						if blobs[blob] {
 							continue
 						}
 						blobs[blob] = true
 
-						ch <- DFile{blob, ""}
-						ch <- DFile{d.blobRef(blob), blob + ".ref"}
+						ch <- DFile{RelativePath: blob, IsBlob: true}
+						ch <- DFile{RelativePath: d.blobRef(blob), LogicalPath: blob + ".ref"}
 					}
 				}
 			}
@@ -495,6 +768,11 @@ func (d *Database) FileIterator() <-chan DFile {
 			ch <- fp(user.home(albumManifest))
 			ch <- fsp(user, stingle.TrashSet)
 			ch <- fsp(user, stingle.GallerySet)
+			for _, f := range []string{usageFile, importsFile, purgeQueueFile, activityFile, uploadSessionsFile} {
+				if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(user.home(f)))); err == nil {
+					ch <- fp(user.home(f))
+				}
+			}
 		}
 	}()
 	return ch
@@ -0,0 +1,309 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The logical directory of the index of the blobs by content hash. The
+	// index is split into blobHashShards files by the first two hex digits
+	// of the hash, so that an upload only reads and rewrites a small part
+	// of it.
+	blobHashesDir  = "blob-hashes"
+	blobHashShards = 256
+
+	// The hashes of temporary files that are never added with AddFile are
+	// forgotten after this long.
+	tempHashRetention = 24 * time.Hour
+)
+
+// blobHashIndex maps the content hash of blobs to their names. The keys are
+// returned by blobHashKey.
+type blobHashIndex struct {
+	Blobs map[string]string `json:"blobs"`
+}
+
+// tempHash is the content hash of a temporary file.
+type tempHash struct {
+	key     string
+	created time.Time
+}
+
+// blobHashKey returns the key of a blob in the hash index, i.e. the SHA-256
+// of its content and its size.
+func blobHashKey(sum []byte, size int64) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(sum), size)
+}
+
+// hashingWriter computes the hash of the content of a temporary file as it is
+// written. The hash is saved when the file is closed.
+type hashingWriter struct {
+	io.WriteCloser
+	h    hash.Hash
+	n    int64
+	done func(key string)
+}
+
+func (w *hashingWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.h.Write(b[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *hashingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.done(blobHashKey(w.h.Sum(nil), w.n))
+	return nil
+}
+
+// setTempHash records the content hash of a temporary file.
+func (d *Database) setTempHash(name, key string) {
+	d.tempHashMutex.Lock()
+	defer d.tempHashMutex.Unlock()
+	if d.tempHashes == nil {
+		d.tempHashes = make(map[string]tempHash)
+	}
+	now := time.Now()
+	for n, h := range d.tempHashes {
+		if now.Sub(h.created) > tempHashRetention {
+			delete(d.tempHashes, n)
+		}
+	}
+	d.tempHashes[name] = tempHash{key: key, created: now}
+}
+
+// takeTempHash returns the content hash of a temporary file, and forgets it.
+// It returns an empty string if the hash isn't known.
+func (d *Database) takeTempHash(name string) string {
+	d.tempHashMutex.Lock()
+	defer d.tempHashMutex.Unlock()
+	h, ok := d.tempHashes[name]
+	if !ok {
+		return ""
+	}
+	delete(d.tempHashes, name)
+	return h.key
+}
+
+// blobHashShard returns the logical filename of the part of the hash index
+// that contains key.
+func blobHashShard(key string) string {
+	return blobHashShardByIndex(blobHashShardIndex(key))
+}
+
+// blobHashShardByIndex returns the logical filename of the i-th part of the
+// hash index.
+func blobHashShardByIndex(i int) string {
+	return path.Join(blobHashesDir, fmt.Sprintf("%02x.dat", i))
+}
+
+// blobHashShardIndex returns the part of the hash index that contains key,
+// from its first two hex digits.
+func blobHashShardIndex(key string) int {
+	if len(key) < 2 {
+		return 0
+	}
+	b, err := hex.DecodeString(key[:2])
+	if err != nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+// lookupBlobHash returns the name of a blob with the given hash key, or an
+// empty string if there isn't one. The blob may have been deleted since it
+// was added to the index.
+func (d *Database) lookupBlobHash(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	var index blobHashIndex
+	if err := d.storage.ReadDataFile(d.filePath(blobHashShard(key)), &index); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return index.Blobs[key], nil
+}
+
+// addBlobHashes adds blobs to the hash index. The map is keyed by hash key.
+// Only the parts of the index that contain these keys are updated.
+func (d *Database) addBlobHashes(blobs map[string]string) error {
+	shards := make(map[int]map[string]string)
+	for key, blob := range blobs {
+		i := blobHashShardIndex(key)
+		if shards[i] == nil {
+			shards[i] = make(map[string]string)
+		}
+		shards[i][key] = blob
+	}
+	for i, shard := range shards {
+		if err := d.addBlobHashesToShard(i, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) addBlobHashesToShard(i int, blobs map[string]string) (retErr error) {
+	fn := d.filePath(blobHashShardByIndex(i))
+	if err := d.storage.CreateEmptyFile(fn, blobHashIndex{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var index blobHashIndex
+	commit, err := d.storage.OpenForUpdate(fn, &index)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if index.Blobs == nil {
+		index.Blobs = make(map[string]string)
+	}
+	for key, blob := range blobs {
+		index.Blobs[key] = blob
+	}
+	return commit(true, nil)
+}
+
+// pruneBlobHashes removes the blobs that don't exist anymore from the hash
+// index. It returns the number of entries that were removed.
+func (d *Database) pruneBlobHashes() (int, error) {
+	var total int
+	for i := 0; i < blobHashShards; i++ {
+		n, err := d.pruneBlobHashShard(i)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (d *Database) pruneBlobHashShard(i int) (n int, retErr error) {
+	fn := d.filePath(blobHashShardByIndex(i))
+	if _, err := os.Stat(filepath.Join(d.Dir(), fn)); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	var index blobHashIndex
+	commit, err := d.storage.OpenForUpdate(fn, &index)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, &retErr)
+	for key, blob := range index.Blobs {
+		if _, err := os.Stat(filepath.Join(d.Dir(), d.blobRef(blob))); errors.Is(err, os.ErrNotExist) {
+			delete(index.Blobs, key)
+			n++
+		}
+	}
+	if n == 0 {
+		commit(false, nil)
+		return 0, nil
+	}
+	return n, commit(true, nil)
+}
+
+// IndexBlobHashes adds the existing blobs that aren't in the hash index yet
+// to it, so that new uploads with the same content can reuse them. It reads
+// the content of all these blobs, and can run while the server is running.
+// Existing duplicates are indexed once, but they aren't merged. It returns
+// the number of blobs that were added to the index.
+func (d *Database) IndexBlobHashes() (int, error) {
+	defer recordLatency("IndexBlobHashes")()
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	refs, _, err := d.countBlobRefs()
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[string]bool)
+	indexed := make(map[string]bool)
+	for i := 0; i < blobHashShards; i++ {
+		var index blobHashIndex
+		if err := d.storage.ReadDataFile(d.filePath(blobHashShardByIndex(i)), &index); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		for key, blob := range index.Blobs {
+			keys[key] = true
+			indexed[blob] = true
+		}
+	}
+	var count int
+	batch := make(map[string]string)
+	for blob := range refs {
+		if indexed[blob] {
+			continue
+		}
+		key, err := d.hashBlob(blob)
+		if err != nil {
+			log.Errorf("IndexBlobHashes: %q: %v", blob, err)
+			continue
+		}
+		if keys[key] {
+			continue
+		}
+		if _, exists := batch[key]; exists {
+			continue
+		}
+		batch[key] = blob
+		count++
+		if len(batch) >= 1000 {
+			if err := d.addBlobHashes(batch); err != nil {
+				return count, err
+			}
+			batch = make(map[string]string)
+		}
+	}
+	return count, d.addBlobHashes(batch)
+}
+
+// hashBlob returns the hash key of an existing blob.
+func (d *Database) hashBlob(blob string) (string, error) {
+	r, err := d.storage.OpenBlobRead(blob)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return blobHashKey(h.Sum(nil), n), nil
+}
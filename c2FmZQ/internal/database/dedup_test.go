@@ -0,0 +1,184 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/stingle"
+)
+
+func addFileWithContent(db *database.Database, user database.User, name, set, content string) error {
+	fs := database.FileSpec{
+		Headers:        name + "-headers",
+		DateCreated:    1,
+		Version:        "1",
+		StoreFileSize:  int64(len(content)),
+		StoreThumbSize: int64(len("thumb " + content)),
+	}
+	for _, f := range []struct {
+		name    *string
+		content string
+	}{{&fs.StoreFile, content}, {&fs.StoreThumb, "thumb " + content}} {
+		w, fn, err := db.TempFile("uploads")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		*f.name = fn
+	}
+	return db.AddFile(user, fs, name, set, "")
+}
+
+func TestDeduplicateBlobs(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	storage := secure.NewStorage(dir, nil)
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	refCount := func(blob string) int {
+		t.Helper()
+		var spec database.BlobSpec
+		if err := storage.ReadDataFile(filepath.Join("metadata", blob+".ref"), &spec); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("ReadDataFile: %v", err)
+		}
+		return spec.RefCount
+	}
+	blobOf := func(name string) string {
+		t.Helper()
+		fs, err := db.FileSet(user, stingle.TrashSet, "")
+		if err != nil {
+			t.Fatalf("db.FileSet: %v", err)
+		}
+		return fs.Files[name].StoreFile
+	}
+
+	for _, name := range []string{"file1", "file2"} {
+		if err := addFileWithContent(db, user, name, stingle.TrashSet, "same content"); err != nil {
+			t.Fatalf("addFileWithContent(%q): %v", name, err)
+		}
+	}
+	if err := addFileWithContent(db, user, "file3", stingle.TrashSet, "other content"); err != nil {
+		t.Fatalf("addFileWithContent(file3): %v", err)
+	}
+	blob := blobOf("file1")
+	if got := blobOf("file2"); got != blob {
+		t.Errorf("file2 blob = %q, want %q", got, blob)
+	}
+	if got := blobOf("file3"); got == blob {
+		t.Errorf("file3 uses the same blob as file1")
+	}
+	if got, want := refCount(blob), 2; got != want {
+		t.Errorf("RefCount(%q) = %d, want %d", blob, got, want)
+	}
+	if got, err := filepath.Glob(filepath.Join(dir, "uploads", "*")); err != nil || len(got) != 0 {
+		t.Errorf("Temporary files left behind: %v, %v", got, err)
+	}
+
+	if err := db.DeleteFiles(user, []string{"file1"}); err != nil {
+		t.Fatalf("db.DeleteFiles: %v", err)
+	}
+	if got, want := refCount(blob), 1; got != want {
+		t.Errorf("RefCount(%q) = %d, want %d", blob, got, want)
+	}
+	r, err := db.DownloadFile(user, stingle.TrashSet, "file2", false)
+	if err != nil {
+		t.Fatalf("DownloadFile(file2): %v", err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "same content" {
+		t.Errorf("DownloadFile(file2) = %q, %v", b, err)
+	}
+
+	if err := db.DeleteFiles(user, []string{"file2"}); err != nil {
+		t.Fatalf("db.DeleteFiles: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, blob)); !os.IsNotExist(err) {
+		t.Errorf("Blob %q still exists: %v", blob, err)
+	}
+	if stats, err := db.CollectGarbage(time.Hour); err != nil || stats.HashesPruned != 2 {
+		t.Errorf("CollectGarbage() = %+v, %v", stats, err)
+	}
+	// The content was deleted, so it is stored again.
+	if err := addFileWithContent(db, user, "file4", stingle.TrashSet, "same content"); err != nil {
+		t.Fatalf("addFileWithContent(file4): %v", err)
+	}
+	if got := blobOf("file4"); got == blob {
+		t.Errorf("file4 uses deleted blob %q", blob)
+	}
+}
+
+func TestIndexBlobHashes(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addFileWithContent(db, user, "file1", stingle.GallerySet, "content"); err != nil {
+		t.Fatalf("addFileWithContent(file1): %v", err)
+	}
+	// The index is split by hash prefix. Each upload only updates the
+	// parts that contain its hashes.
+	shards, err := filepath.Glob(filepath.Join(dir, "metadata", "blob-hashes", "*.dat"))
+	if err != nil || len(shards) == 0 || len(shards) > 2 {
+		t.Errorf("Hash index files = %v, %v, want 1 or 2", shards, err)
+	}
+	// Existing stores don't have a hash index.
+	if err := os.RemoveAll(filepath.Join(dir, "metadata", "blob-hashes")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if n, err := db.IndexBlobHashes(); err != nil || n != 2 {
+		t.Errorf("IndexBlobHashes() = %d, %v, want 2", n, err)
+	}
+	if n, err := db.IndexBlobHashes(); err != nil || n != 0 {
+		t.Errorf("IndexBlobHashes() = %d, %v, want 0", n, err)
+	}
+	if err := addFileWithContent(db, user, "file2", stingle.GallerySet, "content"); err != nil {
+		t.Fatalf("addFileWithContent(file2): %v", err)
+	}
+	fs, err := db.FileSet(user, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	if a, b := fs.Files["file1"].StoreFile, fs.Files["file2"].StoreFile; a != b {
+		t.Errorf("file2 blob = %q, want %q", b, a)
+	}
+}
@@ -0,0 +1,229 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// The logical filename where the album digest subscriptions are stored.
+	albumDigestsFile = "album-digests.dat"
+
+	// The shortest and longest periods of album digests.
+	minDigestPeriod = time.Hour
+	maxDigestPeriod = 7 * 24 * time.Hour
+)
+
+var ErrInvalidDigestPeriod = errors.New("invalid digest period")
+
+// albumDigests contains all the album digest subscriptions, keyed by
+// userAlbumKey.
+type albumDigests struct {
+	Digests map[string]*AlbumDigest `json:"digests"`
+}
+
+// AlbumDigest is a member's subscription to a digest of the changes in a shared
+// album. Instead of a notification for each change, the member receives one
+// message per period with the number of changes.
+type AlbumDigest struct {
+	UserID  int64  `json:"userId"`
+	AlbumID string `json:"albumId"`
+	// The digest period, in seconds.
+	Period int64 `json:"period"`
+	// The time when the pending changes are due to be sent, in milliseconds.
+	// Zero when there are no pending changes.
+	DateDue int64 `json:"dateDue,omitempty"`
+	// The number of times new content was added to the album.
+	NewContent int `json:"newContent,omitempty"`
+	// The number of new members.
+	NewMembers int `json:"newMembers,omitempty"`
+}
+
+// SetAlbumDigest subscribes the user to a digest of the changes in an album,
+// or unsubscribes when period is zero.
+func (d *Database) SetAlbumDigest(user User, albumID string, period time.Duration) (retErr error) {
+	defer recordLatency("SetAlbumDigest")()
+
+	if period != 0 && (period < minDigestPeriod || period > maxDigestPeriod) {
+		return ErrInvalidDigestPeriod
+	}
+	album, err := d.Album(user, albumID)
+	if err != nil {
+		return err
+	}
+	if album.OwnerID != user.UserID && !album.Members[user.UserID] {
+		return os.ErrPermission
+	}
+	fn := d.filePath(albumDigestsFile)
+	if err := d.storage.CreateEmptyFile(fn, albumDigests{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var digests albumDigests
+	commit, err := d.storage.OpenForUpdate(fn, &digests)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if digests.Digests == nil {
+		digests.Digests = make(map[string]*AlbumDigest)
+	}
+	key := userAlbumKey(user.UserID, albumID)
+	if period == 0 {
+		delete(digests.Digests, key)
+		return nil
+	}
+	dg, ok := digests.Digests[key]
+	if !ok {
+		dg = &AlbumDigest{UserID: user.UserID, AlbumID: albumID}
+		digests.Digests[key] = dg
+	}
+	dg.Period = int64(period / time.Second)
+	if dg.DateDue > 0 {
+		dg.DateDue = nowInMS() + 1000*dg.Period
+	}
+	return nil
+}
+
+// AlbumDigests returns the user's album digest subscriptions.
+func (d *Database) AlbumDigests(user User) ([]AlbumDigest, error) {
+	defer recordLatency("AlbumDigests")()
+
+	var digests albumDigests
+	if err := d.storage.ReadDataFile(d.filePath(albumDigestsFile), &digests); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	out := []AlbumDigest{}
+	for _, dg := range digests.Digests {
+		if dg.UserID == user.UserID {
+			out = append(out, *dg)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AlbumID < out[j].AlbumID })
+	return out, nil
+}
+
+// addToDigests adds a notification to the digests of the users who are
+// subscribed to them. These users are removed from uids so that they don't
+// also receive the notification immediately.
+func (d *Database) addToDigests(uids map[int64]bool, albumID string, n notification) (retErr error) {
+	fn := d.filePath(albumDigestsFile)
+	var digests albumDigests
+	if err := d.storage.ReadDataFile(fn, &digests); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	found := false
+	for uid := range uids {
+		if _, ok := digests.Digests[userAlbumKey(uid, albumID)]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	commit, err := d.storage.OpenForUpdate(fn, &digests)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	now := nowInMS()
+	for uid := range uids {
+		dg, ok := digests.Digests[userAlbumKey(uid, albumID)]
+		if !ok {
+			continue
+		}
+		delete(uids, uid)
+		switch n.Type {
+		case notifyNewContent:
+			dg.NewContent++
+		case notifyNewMember:
+			dg.NewMembers++
+		}
+		if dg.DateDue == 0 {
+			dg.DateDue = now + 1000*dg.Period
+		}
+	}
+	return nil
+}
+
+// DueDigests returns the album digests that are due to be sent, and resets
+// them.
+func (d *Database) DueDigests() (out []AlbumDigest, retErr error) {
+	defer recordLatency("DueDigests")()
+
+	fn := d.filePath(albumDigestsFile)
+	var digests albumDigests
+	if err := d.storage.ReadDataFile(fn, &digests); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	now := nowInMS()
+	found := false
+	for _, dg := range digests.Digests {
+		if dg.DateDue > 0 && dg.DateDue <= now {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	commit, err := d.storage.OpenForUpdate(fn, &digests)
+	if err != nil {
+		return nil, err
+	}
+	defer commit(true, &retErr)
+	for _, dg := range digests.Digests {
+		if dg.DateDue == 0 || dg.DateDue > now {
+			continue
+		}
+		out = append(out, *dg)
+		dg.DateDue = 0
+		dg.NewContent = 0
+		dg.NewMembers = 0
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].UserID == out[j].UserID {
+			return out[i].AlbumID < out[j].AlbumID
+		}
+		return out[i].UserID < out[j].UserID
+	})
+	return out, nil
+}
+
+// SendDigestNotification sends a push notification with the content of an
+// album digest.
+func (d *Database) SendDigestNotification(dg AlbumDigest) error {
+	if d.notifyChan == nil || !d.pushServices.Enable {
+		return errors.New("push notifications disabled")
+	}
+	d.enqueueNotification(notifyItem{
+		uid: dg.UserID,
+		n:   &notification{Type: notifyDigest, Target: dg.AlbumID, Data: dg},
+	})
+	return nil
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestAlbumDigests(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@", "carol@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob, carol := users["alice@"], users["bob@"], users["carol@"]
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	album := stingle.Album{
+		AlbumID:     "album",
+		IsShared:    "1",
+		Permissions: "1111",
+		Members:     membersString(alice.UserID, bob.UserID),
+	}
+	if err := db.ShareAlbum(alice, &album, map[string]string{fmt.Sprintf("%d", bob.UserID): "key"}); err != nil {
+		t.Fatalf("db.ShareAlbum: %v", err)
+	}
+
+	if err := db.SetAlbumDigest(bob, "album", time.Minute); err != database.ErrInvalidDigestPeriod {
+		t.Errorf("db.SetAlbumDigest(1m) = %v, want ErrInvalidDigestPeriod", err)
+	}
+	if err := db.SetAlbumDigest(carol, "album", time.Hour); err == nil {
+		t.Error("db.SetAlbumDigest(carol) succeeded unexpectedly")
+	}
+	if err := db.SetAlbumDigest(bob, "album", time.Hour); err != nil {
+		t.Fatalf("db.SetAlbumDigest: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 20000
+	for _, f := range []string{"file1", "file2"} {
+		if err := addFile(db, alice, f, stingle.AlbumSet, "album"); err != nil {
+			t.Fatalf("addFile(%q): %v", f, err)
+		}
+	}
+	album.Members = membersString(alice.UserID, bob.UserID, carol.UserID)
+	if err := db.ShareAlbum(alice, &album, map[string]string{fmt.Sprintf("%d", carol.UserID): "key"}); err != nil {
+		t.Fatalf("db.ShareAlbum: %v", err)
+	}
+
+	if dd, err := db.DueDigests(); err != nil || len(dd) != 0 {
+		t.Errorf("db.DueDigests() = %v, %v, want none", dd, err)
+	}
+
+	database.CurrentTimeForTesting = 20000 + 3600*1000
+	dd, err := db.DueDigests()
+	if err != nil {
+		t.Fatalf("db.DueDigests: %v", err)
+	}
+	want := []database.AlbumDigest{{
+		UserID:     bob.UserID,
+		AlbumID:    "album",
+		Period:     3600,
+		DateDue:    20000 + 3600*1000,
+		NewContent: 2,
+		NewMembers: 1,
+	}}
+	if !reflect.DeepEqual(dd, want) {
+		t.Errorf("db.DueDigests() = %+v, want %+v", dd, want)
+	}
+	if dd, err := db.DueDigests(); err != nil || len(dd) != 0 {
+		t.Errorf("db.DueDigests() = %v, %v, want none", dd, err)
+	}
+
+	if err := db.SetAlbumDigest(bob, "album", 0); err != nil {
+		t.Fatalf("db.SetAlbumDigest(0): %v", err)
+	}
+	if got, err := db.AlbumDigests(bob); err != nil || len(got) != 0 {
+		t.Errorf("db.AlbumDigests() = %v, %v, want none", got, err)
+	}
+}
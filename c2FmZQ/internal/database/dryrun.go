@@ -0,0 +1,207 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// MaxReportItems is the maximum number of items listed in a RemovalReport.
+const MaxReportItems = 100
+
+// RemovalReport describes what a destructive operation, e.g. DeleteUser,
+// PurgeDeletedFiles, or CollectGarbage, would remove.
+type RemovalReport struct {
+	// Whether nothing was changed.
+	DryRun bool `json:"dryRun"`
+	// The number of user accounts.
+	Users int `json:"users,omitempty"`
+	// The number of albums.
+	Albums int `json:"albums,omitempty"`
+	// The number of files, in all the file sets and the purge queues.
+	Files int `json:"files"`
+	// The number of blobs whose content is deleted, i.e. that aren't
+	// referenced anymore.
+	Blobs int `json:"blobs"`
+	// The size of these blobs.
+	Bytes int64 `json:"bytes"`
+	// The number of reference counts that are corrected.
+	RefCountsFixed int `json:"refCountsFixed,omitempty"`
+	// The first MaxReportItems files, or blobs, that are removed.
+	Items []string `json:"items,omitempty"`
+	// Whether Items is incomplete.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// addItem adds an item to the report's list, unless it is full.
+func (r *RemovalReport) addItem(item string) {
+	if len(r.Items) >= MaxReportItems {
+		r.Truncated = true
+		return
+	}
+	r.Items = append(r.Items, item)
+}
+
+// addFiles adds the files of a file set, sorted by name, to the report.
+func (r *RemovalReport) addFiles(prefix string, files map[string]*FileSpec, released *[]*FileSpec) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.Files++
+		r.addItem(prefix + name)
+		*released = append(*released, files[name])
+	}
+}
+
+// countReleasedBlobs adds to the report the blobs that would be deleted if the
+// references of files were released, i.e. the blobs whose reference count
+// would drop to zero.
+func (d *Database) countReleasedBlobs(r *RemovalReport, files []*FileSpec) error {
+	released := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		size := []int64{f.StoreFileSize, f.StoreThumbSize, f.StoreMediumSize}
+		for i, blob := range f.blobs() {
+			released[blob]++
+			sizes[blob] = size[i]
+		}
+	}
+	for blob, n := range released {
+		var spec BlobSpec
+		if err := d.storage.ReadDataFile(d.blobRef(blob), &spec); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if spec.RefCount-n > 0 {
+			continue
+		}
+		r.Blobs++
+		r.Bytes += sizes[blob]
+	}
+	return nil
+}
+
+// DeleteUserDryRun reports what DeleteUser would remove, without changing
+// anything: the user's files, the albums that the user owns with their files,
+// the files that are waiting to be purged, and the content of the files that
+// isn't referenced by any other user.
+func (d *Database) DeleteUserDryRun(u User) (*RemovalReport, error) {
+	defer recordLatency("DeleteUserDryRun")()
+
+	if u.Hold {
+		return nil, ErrOnHold
+	}
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+
+	r := &RemovalReport{DryRun: true, Users: 1}
+	var released []*FileSpec
+	for _, set := range []struct {
+		set  string
+		name string
+	}{{stingle.GallerySet, "Gallery"}, {stingle.TrashSet, "Trash"}} {
+		fs, err := d.FileSet(u, set.set, "")
+		if err != nil {
+			return nil, err
+		}
+		r.addFiles(set.name+"/", fs.Files, &released)
+	}
+
+	albumRefs, err := d.AlbumRefs(u)
+	if err != nil {
+		return nil, err
+	}
+	albumIDs := make([]string, 0, len(albumRefs))
+	for albumID := range albumRefs {
+		albumIDs = append(albumIDs, albumID)
+	}
+	sort.Strings(albumIDs)
+	for _, albumID := range albumIDs {
+		fs, err := d.FileSet(u, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, err
+		}
+		// The user is only removed from the albums of other users.
+		if fs.Album == nil || fs.Album.OwnerID != u.UserID {
+			continue
+		}
+		r.Albums++
+		r.addFiles(fmt.Sprintf("Album %s/", albumID), fs.Files, &released)
+	}
+
+	pending, err := d.PendingPurges(u)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pending {
+		r.Files++
+		r.addItem("Deleted/" + pending[i].Name)
+		released = append(released, &pending[i].File)
+	}
+	if err := d.countReleasedBlobs(r, released); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PurgeDeletedFilesDryRun reports what PurgeDeletedFiles would purge now,
+// without changing anything.
+func (d *Database) PurgeDeletedFilesDryRun() (*RemovalReport, error) {
+	defer recordLatency("PurgeDeletedFilesDryRun")()
+
+	uids, err := d.UserIDs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+
+	r := &RemovalReport{DryRun: true}
+	cutoff := nowInMS() - d.purgeDelay.Milliseconds()
+	var released []*FileSpec
+	for _, uid := range uids {
+		u, err := d.UserByID(uid)
+		if err != nil || u.Hold {
+			continue
+		}
+		pending, err := d.PendingPurges(u)
+		if err != nil {
+			return nil, err
+		}
+		for i := range pending {
+			if pending[i].DateDeleted > cutoff {
+				continue
+			}
+			r.Files++
+			r.addItem(fmt.Sprintf("User %d/%s", uid, pending[i].Name))
+			released = append(released, &pending[i].File)
+		}
+	}
+	if err := d.countReleasedBlobs(r, released); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,135 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestDeleteUserDryRun(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	bob, err := db.User("bob@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addAlbum(db, alice, "album1"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	for _, f := range []struct {
+		user    database.User
+		name    string
+		set     string
+		albumID string
+	}{
+		{alice, "file1", stingle.GallerySet, ""},
+		{alice, "file2", stingle.TrashSet, ""},
+		{alice, "file3", stingle.AlbumSet, "album1"},
+		// Bob has the same content as file1.
+		{bob, "file1", stingle.GallerySet, ""},
+	} {
+		if err := addFile(db, f.user, f.name, f.set, f.albumID); err != nil {
+			t.Fatalf("addFile(%q): %v", f.name, err)
+		}
+	}
+	fs, err := db.FileSet(alice, stingle.TrashSet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	file2 := fs.Files["file2"]
+
+	got, err := db.DeleteUserDryRun(alice)
+	if err != nil {
+		t.Fatalf("DeleteUserDryRun: %v", err)
+	}
+	// The content of file1 is still used by bob.
+	want := &database.RemovalReport{
+		DryRun: true,
+		Users:  1,
+		Albums: 1,
+		Files:  3,
+		Blobs:  4,
+		Bytes:  2200,
+		Items:  []string{"Gallery/file1", "Trash/file2", "Album album1/file3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DeleteUserDryRun() = %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file2.StoreFile)); err != nil {
+		t.Errorf("Content of file2 was deleted by the dry run: %v", err)
+	}
+	if _, err := db.User("alice@"); err != nil {
+		t.Errorf("alice was deleted by the dry run: %v", err)
+	}
+
+	if err := db.DeleteUser(alice); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file2.StoreFile)); !os.IsNotExist(err) {
+		t.Errorf("Content of file2 wasn't deleted: %v", err)
+	}
+	if n := numFilesInSet(t, db, bob, stingle.GallerySet, ""); n != 1 {
+		t.Errorf("Bob has %d files, want 1", n)
+	}
+}
+
+func TestRemovalReportItemsCapped(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	n := database.MaxReportItems + 5
+	for i := 0; i < n; i++ {
+		if err := addFile(db, user, fmt.Sprintf("file%03d", i), stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile: %v", err)
+		}
+	}
+	r, err := db.DeleteUserDryRun(user)
+	if err != nil {
+		t.Fatalf("DeleteUserDryRun: %v", err)
+	}
+	if r.Files != n || len(r.Items) != database.MaxReportItems || !r.Truncated {
+		t.Errorf("DeleteUserDryRun() = %d files, %d items, truncated %v, want %d, %d, true", r.Files, len(r.Items), r.Truncated, n, database.MaxReportItems)
+	}
+	if r.Blobs != 2*n || r.Bytes != int64(1100*n) {
+		t.Errorf("DeleteUserDryRun() = %d blobs, %d bytes, want %d, %d", r.Blobs, r.Bytes, 2*n, 1100*n)
+	}
+}
@@ -0,0 +1,230 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+
+	"c2FmZQ/internal/log"
+)
+
+var (
+	ErrAlbumLimitExceeded = errors.New("album limit exceeded")
+	ErrShareLimitExceeded = errors.New("share limit exceeded")
+)
+
+// The percentages of a limit at which a ThresholdEvent is emitted.
+var thresholds = []int64{80, 90, 100}
+
+// Entitlements contains the per-user limits, other than the storage quota,
+// that can be set by an external billing system. A value of zero means no
+// limit.
+type Entitlements struct {
+	// The maximum number of albums that the user can own.
+	MaxAlbums int64 `json:"maxAlbums,omitempty"`
+	// The maximum number of members, other than the owner, that the user's
+	// albums can be shared with.
+	MaxAlbumMembers int64 `json:"maxAlbumMembers,omitempty"`
+}
+
+// ThresholdEvent is emitted when a user's usage crosses a percentage of one of
+// their limits.
+type ThresholdEvent struct {
+	// The type of limit: "space", "albums", or "albumMembers".
+	Type   string `json:"type"`
+	UserID int64  `json:"userId"`
+	Email  string `json:"email"`
+	// The percentage of the limit that was crossed.
+	Threshold int64 `json:"threshold"`
+	Used      int64 `json:"used"`
+	Limit     int64 `json:"limit"`
+	// The time of the event in milliseconds.
+	Time int64 `json:"time"`
+}
+
+// SetThresholdHook sets the function to call when a user's usage crosses a
+// threshold. It should be called before the database is used.
+func (d *Database) SetThresholdHook(f func(ThresholdEvent)) {
+	d.thresholdHook = f
+}
+
+// checkThresholds calls the threshold hook when the usage crosses one or more
+// thresholds going from before to after. Only the highest threshold crossed is
+// reported.
+func (d *Database) checkThresholds(user User, typ string, before, after, limit int64) {
+	if d.thresholdHook == nil || limit <= 0 || after <= before {
+		return
+	}
+	var crossed int64
+	for _, t := range thresholds {
+		if v := limit * t; before*100 < v && after*100 >= v {
+			crossed = t
+		}
+	}
+	if crossed == 0 {
+		return
+	}
+	d.thresholdHook(ThresholdEvent{
+		Type:      typ,
+		UserID:    user.UserID,
+		Email:     user.Email,
+		Threshold: crossed,
+		Used:      after,
+		Limit:     limit,
+		Time:      nowInMS(),
+	})
+}
+
+// Entitlements returns the user's entitlements.
+func (d *Database) Entitlements(userID int64) (Entitlements, error) {
+	defer recordLatency("Entitlements")()
+
+	var quotas Quotas
+	if err := d.storage.ReadDataFile(d.filePath(quotaFile), &quotas); err != nil {
+		return Entitlements{}, err
+	}
+	return quotas.Entitlements[userID], nil
+}
+
+// UserLimits returns the quota and entitlements of a user, as shown on the
+// admin console.
+func (d *Database) UserLimits(userID int64) (AdminUser, error) {
+	defer recordLatency("UserLimits")()
+
+	user, err := d.UserByID(userID)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	var quotas Quotas
+	if err := d.storage.ReadDataFile(d.filePath(quotaFile), &quotas); err != nil {
+		return AdminUser{}, err
+	}
+	return limitsForUser(user, &quotas), nil
+}
+
+// SetUserLimits changes the quota and entitlements of a user. Only the Quota,
+// QuotaUnit, MaxAlbums, and MaxAlbumMembers fields of changes are used. The
+// quota of limited accounts can't be changed this way, see SetLimitedAccount.
+func (d *Database) SetUserLimits(changes AdminUser) (retErr error) {
+	defer recordLatency("SetUserLimits")()
+
+	user, err := d.UserByID(changes.UserID)
+	if err != nil {
+		return err
+	}
+	if user.Limited != nil && (changes.Quota != nil || changes.QuotaUnit != nil) {
+		return ErrLimitedAccount
+	}
+	var quotas Quotas
+	commit, err := d.storage.OpenForUpdate(d.filePath(quotaFile), &quotas)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	applyLimitChanges(&quotas, changes)
+	return commit(true, nil)
+}
+
+// limitsForUser returns an AdminUser with the user's quota and entitlements.
+func limitsForUser(user User, quotas *Quotas) AdminUser {
+	au := AdminUser{
+		UserID: user.UserID,
+		Email:  &user.Email,
+	}
+	if v, ok := quotas.Limits[user.UserID]; ok {
+		au.Quota = &v.Value
+		au.QuotaUnit = &v.Unit
+	}
+	if e, ok := quotas.Entitlements[user.UserID]; ok {
+		if e.MaxAlbums > 0 {
+			au.MaxAlbums = &e.MaxAlbums
+		}
+		if e.MaxAlbumMembers > 0 {
+			au.MaxAlbumMembers = &e.MaxAlbumMembers
+		}
+	}
+	return au
+}
+
+// applyLimitChanges applies the quota and entitlement changes of a user. A
+// negative value removes the limit.
+func applyLimitChanges(quotas *Quotas, user AdminUser) {
+	if quotas.Limits == nil {
+		quotas.Limits = make(map[int64]Limit)
+	}
+	if user.Quota != nil {
+		if *user.Quota < 0 {
+			delete(quotas.Limits, user.UserID)
+		} else {
+			l := quotas.Limits[user.UserID]
+			l.Value = *user.Quota
+			if u := user.QuotaUnit; u != nil {
+				l.Unit = *u
+			}
+			quotas.Limits[user.UserID] = l
+		}
+	} else if user.QuotaUnit != nil {
+		l := quotas.Limits[user.UserID]
+		l.Unit = *user.QuotaUnit
+		quotas.Limits[user.UserID] = l
+	}
+	if user.MaxAlbums == nil && user.MaxAlbumMembers == nil {
+		return
+	}
+	if quotas.Entitlements == nil {
+		quotas.Entitlements = make(map[int64]Entitlements)
+	}
+	e := quotas.Entitlements[user.UserID]
+	if v := user.MaxAlbums; v != nil {
+		e.MaxAlbums = *v
+		if e.MaxAlbums < 0 {
+			e.MaxAlbums = 0
+		}
+	}
+	if v := user.MaxAlbumMembers; v != nil {
+		e.MaxAlbumMembers = *v
+		if e.MaxAlbumMembers < 0 {
+			e.MaxAlbumMembers = 0
+		}
+	}
+	if e == (Entitlements{}) {
+		delete(quotas.Entitlements, user.UserID)
+	} else {
+		quotas.Entitlements[user.UserID] = e
+	}
+}
+
+// ownedAlbumCount returns the number of albums owned by the user.
+func (d *Database) ownedAlbumCount(user User) (int64, error) {
+	refs, err := d.AlbumRefs(user)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for albumID := range refs {
+		album, err := d.Album(user, albumID)
+		if err != nil {
+			log.Errorf("Album(%d, %q) failed: %v", user.UserID, albumID, err)
+			continue
+		}
+		if album.OwnerID == user.UserID {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,127 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestEntitlements(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	database.CurrentTimeForTesting = 10000
+
+	var events []database.ThresholdEvent
+	db.SetThresholdHook(func(e database.ThresholdEvent) {
+		events = append(events, e)
+	})
+
+	var users []database.User
+	for _, email := range []string{"alice", "bob", "carol"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q) failed: %v", email, err)
+		}
+		users = append(users, u)
+	}
+	alice, bob, carol := users[0], users[1], users[2]
+
+	if err := db.SetUserLimits(database.AdminUser{
+		UserID:          alice.UserID,
+		MaxAlbums:       ptr(int64(2)),
+		MaxAlbumMembers: ptr(int64(1)),
+	}); err != nil {
+		t.Fatalf("db.SetUserLimits failed: %v", err)
+	}
+	limits, err := db.UserLimits(alice.UserID)
+	if err != nil {
+		t.Fatalf("db.UserLimits failed: %v", err)
+	}
+	if limits.MaxAlbums == nil || *limits.MaxAlbums != 2 || limits.MaxAlbumMembers == nil || *limits.MaxAlbumMembers != 1 || limits.Quota != nil {
+		t.Errorf("Unexpected limits: %+v", limits)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := addAlbum(db, alice, fmt.Sprintf("album%d", i)); err != nil {
+			t.Fatalf("addAlbum(%d) failed: %v", i, err)
+		}
+	}
+	if err := addAlbum(db, alice, "album2"); err != database.ErrAlbumLimitExceeded {
+		t.Errorf("addAlbum() returned %v, want ErrAlbumLimitExceeded", err)
+	}
+	// Bob has no limits.
+	for i := 0; i < 3; i++ {
+		if err := addAlbum(db, bob, fmt.Sprintf("bob-album%d", i)); err != nil {
+			t.Fatalf("addAlbum(bob, %d) failed: %v", i, err)
+		}
+	}
+
+	share := func(members ...database.User) error {
+		ids := []int64{alice.UserID}
+		keys := make(map[string]string)
+		for _, m := range members {
+			ids = append(ids, m.UserID)
+			keys[fmt.Sprintf("%d", m.UserID)] = "key"
+		}
+		return db.ShareAlbum(alice, &stingle.Album{
+			AlbumID:     "album0",
+			IsShared:    "1",
+			Permissions: "1111",
+			Members:     membersString(ids...),
+		}, keys)
+	}
+	if err := share(bob); err != nil {
+		t.Fatalf("share(bob) failed: %v", err)
+	}
+	if err := share(bob, carol); err != database.ErrShareLimitExceeded {
+		t.Errorf("share(bob, carol) returned %v, want ErrShareLimitExceeded", err)
+	}
+
+	want := []string{"albums:100:2:2", "albumMembers:100:1:1"}
+	var got []string
+	for _, e := range events {
+		if e.UserID != alice.UserID {
+			t.Errorf("Unexpected event for user %d", e.UserID)
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%d:%d", e.Type, e.Threshold, e.Used, e.Limit))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected events. Got %v, want %v", got, want)
+	}
+
+	// Negative values remove the limits.
+	if err := db.SetUserLimits(database.AdminUser{
+		UserID:          alice.UserID,
+		MaxAlbums:       ptr(int64(-1)),
+		MaxAlbumMembers: ptr(int64(-1)),
+	}); err != nil {
+		t.Fatalf("db.SetUserLimits failed: %v", err)
+	}
+	if err := addAlbum(db, alice, "album2"); err != nil {
+		t.Errorf("addAlbum() failed: %v", err)
+	}
+	if err := share(bob, carol); err != nil {
+		t.Errorf("share(bob, carol) failed: %v", err)
+	}
+}
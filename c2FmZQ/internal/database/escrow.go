@@ -0,0 +1,438 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// The logical filename where the album key escrows are stored.
+const albumEscrowFile = "album-escrow.dat"
+
+var ErrNoRecoveryContact = errors.New("no recovery contact")
+
+// albumEscrows maps owner IDs to their escrow.
+type albumEscrows struct {
+	Escrows map[int64]*AlbumEscrow `json:"escrows"`
+}
+
+// AlbumEscrow holds the keys of a user's albums for a recovery contact. The
+// keys are encrypted by the owner's client for the contact, and are opaque to
+// the server. They are only given to the contact when the contact asks to
+// recover the albums, and the owner doesn't deny the request within the
+// recovery delay.
+type AlbumEscrow struct {
+	OwnerID   int64 `json:"ownerId"`
+	ContactID int64 `json:"contactId"`
+	// Whether the contact agreed to be the recovery contact. Keys can only
+	// be added after that.
+	Accepted    bool  `json:"accepted"`
+	DateCreated int64 `json:"dateCreated"`
+	// The albums' private keys encrypted for the contact, by album ID.
+	Keys map[string]string `json:"keys"`
+	// The time when the contact asked to recover the albums, or zero.
+	RecoveryRequested int64 `json:"recoveryRequested,omitempty"`
+	// The number of months without login after which the contact can
+	// recover the albums without waiting for the recovery delay. Zero
+	// disables the inactivity trigger. See CheckInactivity.
+	InactivityMonths int `json:"inactivityMonths,omitempty"`
+	// The time of the owner's last login, when the inactivity trigger is
+	// enabled.
+	LastActivity int64 `json:"lastActivity,omitempty"`
+	// The number of reminders sent to the owner since the last login, and
+	// the time when the last one was sent.
+	Reminders    int   `json:"reminders,omitempty"`
+	LastReminder int64 `json:"lastReminder,omitempty"`
+	// The time when the inactivity trigger fired, or zero.
+	InactivityTriggered int64 `json:"inactivityTriggered,omitempty"`
+	// The most recent events of the escrow, oldest first.
+	Events []EscrowEvent `json:"events,omitempty"`
+}
+
+// RecoveryInfo is what the owner and the contact can see about an escrow.
+type RecoveryInfo struct {
+	OwnerID    int64  `json:"ownerId"`
+	OwnerEmail string `json:"ownerEmail"`
+	ContactID  int64  `json:"contactId"`
+	// The contact's email address and public key, needed to encrypt the
+	// album keys.
+	ContactEmail     string `json:"contactEmail"`
+	ContactPublicKey string `json:"contactPublicKey"`
+	Accepted         bool   `json:"accepted"`
+	DateCreated      int64  `json:"dateCreated"`
+	// The IDs of the albums whose keys are in escrow.
+	Albums []string `json:"albums"`
+	// The time when the contact asked to recover the albums, and the time
+	// when they become available, or zero.
+	RecoveryRequested int64 `json:"recoveryRequested,omitempty"`
+	RecoveryAvailable int64 `json:"recoveryAvailable,omitempty"`
+	// The inactivity trigger, see AlbumEscrow.
+	InactivityMonths    int   `json:"inactivityMonths,omitempty"`
+	LastActivity        int64 `json:"lastActivity,omitempty"`
+	Reminders           int   `json:"reminders,omitempty"`
+	InactivityTriggered int64 `json:"inactivityTriggered,omitempty"`
+	// The audit log of the escrow.
+	Events []EscrowEvent `json:"events"`
+}
+
+// escrowsForUpdate opens the album escrows for update.
+func (d *Database) escrowsForUpdate() (func(bool, *error) error, *albumEscrows, error) {
+	fn := d.filePath(albumEscrowFile)
+	if err := d.storage.CreateEmptyFile(fn, albumEscrows{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, err
+	}
+	var escrows albumEscrows
+	commit, err := d.storage.OpenForUpdate(fn, &escrows)
+	if err != nil {
+		return nil, nil, err
+	}
+	if escrows.Escrows == nil {
+		escrows.Escrows = make(map[int64]*AlbumEscrow)
+	}
+	return commit, &escrows, nil
+}
+
+// SetRecoveryContact designates the user with contactEmail as owner's recovery
+// contact. The contact has to accept before any keys can be added. The keys
+// of the previous contact, if any, are discarded. When contactEmail is empty,
+// the recovery contact is removed.
+func (d *Database) SetRecoveryContact(owner User, contactEmail string) (retErr error) {
+	defer recordLatency("SetRecoveryContact")()
+
+	var contact User
+	if contactEmail != "" {
+		var err error
+		if contact, err = d.User(contactEmail); err != nil {
+			return err
+		}
+		if contact.UserID == owner.UserID {
+			return fmt.Errorf("user %d can't be their own recovery contact", owner.UserID)
+		}
+	}
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if contactEmail == "" {
+		delete(escrows.Escrows, owner.UserID)
+		return nil
+	}
+	if e := escrows.Escrows[owner.UserID]; e != nil && e.ContactID == contact.UserID {
+		return nil
+	}
+	escrows.Escrows[owner.UserID] = &AlbumEscrow{
+		OwnerID:     owner.UserID,
+		ContactID:   contact.UserID,
+		DateCreated: nowInMS(),
+	}
+	if d.notifyChan != nil && d.pushServices.Enable {
+		d.enqueueNotification(notifyItem{
+			uid: contact.UserID,
+			n:   &notification{Type: notifyRecoveryContact, Target: strconv.FormatInt(owner.UserID, 10)},
+		})
+	}
+	return nil
+}
+
+// AnswerRecoveryContact accepts or declines to be the recovery contact of
+// ownerID. A declined escrow is removed.
+func (d *Database) AnswerRecoveryContact(contact User, ownerID int64, accept bool) (retErr error) {
+	defer recordLatency("AnswerRecoveryContact")()
+
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	e := escrows.Escrows[ownerID]
+	if e == nil || e.ContactID != contact.UserID {
+		return ErrNoRecoveryContact
+	}
+	if !accept {
+		delete(escrows.Escrows, ownerID)
+		return nil
+	}
+	e.Accepted = true
+	return nil
+}
+
+// AddEscrowKeys adds the private keys of some of owner's albums to the
+// escrow. The keys are encrypted for the recovery contact. An empty key
+// removes the album from the escrow.
+func (d *Database) AddEscrowKeys(owner User, keys map[string]string) (retErr error) {
+	defer recordLatency("AddEscrowKeys")()
+
+	for albumID, key := range keys {
+		if key == "" {
+			continue
+		}
+		album, err := d.Album(owner, albumID)
+		if err != nil {
+			return err
+		}
+		if album.OwnerID != owner.UserID {
+			return os.ErrPermission
+		}
+	}
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	e := escrows.Escrows[owner.UserID]
+	if e == nil || !e.Accepted {
+		return ErrNoRecoveryContact
+	}
+	if e.Keys == nil {
+		e.Keys = make(map[string]string)
+	}
+	for albumID, key := range keys {
+		if key == "" {
+			delete(e.Keys, albumID)
+			continue
+		}
+		e.Keys[albumID] = key
+	}
+	return nil
+}
+
+// RecoveryStatus returns the escrow where user is the owner, if any, and the
+// escrows where user is the recovery contact.
+func (d *Database) RecoveryStatus(user User, delay time.Duration) (*RecoveryInfo, []RecoveryInfo, error) {
+	defer recordLatency("RecoveryStatus")()
+
+	var escrows albumEscrows
+	if err := d.storage.ReadDataFile(d.filePath(albumEscrowFile), &escrows); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, []RecoveryInfo{}, nil
+		}
+		return nil, nil, err
+	}
+	var owned *RecoveryInfo
+	contact := []RecoveryInfo{}
+	for _, e := range escrows.Escrows {
+		if e.OwnerID != user.UserID && e.ContactID != user.UserID {
+			continue
+		}
+		info, err := d.recoveryInfo(e, delay)
+		if err != nil {
+			log.Errorf("recoveryInfo(%d): %v", e.OwnerID, err)
+			continue
+		}
+		if e.OwnerID == user.UserID {
+			owned = info
+			continue
+		}
+		// The contact doesn't need to know which albums exist until
+		// they are recovered.
+		info.Albums = nil
+		contact = append(contact, *info)
+	}
+	sort.Slice(contact, func(i, j int) bool { return contact[i].OwnerEmail < contact[j].OwnerEmail })
+	return owned, contact, nil
+}
+
+func (d *Database) recoveryInfo(e *AlbumEscrow, delay time.Duration) (*RecoveryInfo, error) {
+	owner, err := d.UserByID(e.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	contact, err := d.UserByID(e.ContactID)
+	if err != nil {
+		return nil, err
+	}
+	info := &RecoveryInfo{
+		OwnerID:             e.OwnerID,
+		OwnerEmail:          owner.Email,
+		ContactID:           e.ContactID,
+		ContactEmail:        contact.Email,
+		ContactPublicKey:    base64.StdEncoding.EncodeToString(contact.PublicKey.ToBytes()),
+		Accepted:            e.Accepted,
+		DateCreated:         e.DateCreated,
+		Albums:              []string{},
+		RecoveryRequested:   e.RecoveryRequested,
+		InactivityMonths:    e.InactivityMonths,
+		LastActivity:        e.LastActivity,
+		Reminders:           e.Reminders,
+		InactivityTriggered: e.InactivityTriggered,
+		Events:              e.Events,
+	}
+	if info.Events == nil {
+		info.Events = []EscrowEvent{}
+	}
+	if e.RecoveryRequested > 0 {
+		info.RecoveryAvailable = e.RecoveryRequested + delay.Milliseconds()
+	}
+	if e.InactivityTriggered > 0 {
+		info.RecoveryAvailable = e.InactivityTriggered
+	}
+	for albumID := range e.Keys {
+		info.Albums = append(info.Albums, albumID)
+	}
+	sort.Strings(info.Albums)
+	return info, nil
+}
+
+// RequestRecovery is used by the recovery contact to recover ownerID's
+// albums. The first request starts the recovery delay, and the owner is
+// notified. A request after the delay shares all the albums in the escrow
+// with the contact, using the escrowed keys. It returns the number of albums
+// that were shared, and the time when they become available.
+func (d *Database) RequestRecovery(contact User, ownerID int64, delay time.Duration) (int, int64, error) {
+	defer recordLatency("RequestRecovery")()
+
+	var keys map[string]string
+	var availableAt int64
+	err := func() (retErr error) {
+		commit, escrows, err := d.escrowsForUpdate()
+		if err != nil {
+			return err
+		}
+		defer commit(true, &retErr)
+		e := escrows.Escrows[ownerID]
+		if e == nil || e.ContactID != contact.UserID || !e.Accepted {
+			return ErrNoRecoveryContact
+		}
+		if e.RecoveryRequested == 0 {
+			e.RecoveryRequested = nowInMS()
+			e.addEvent(EscrowEventRecoveryRequested, "")
+			if d.notifyChan != nil && d.pushServices.Enable {
+				d.enqueueNotification(notifyItem{
+					uid: ownerID,
+					n:   &notification{Type: notifyRecoveryRequest, Target: strconv.FormatInt(contact.UserID, 10)},
+				})
+			}
+		}
+		availableAt = e.RecoveryRequested + delay.Milliseconds()
+		if e.InactivityTriggered > 0 {
+			// The owner didn't answer any of the reminders. There is
+			// no need to wait any longer.
+			availableAt = e.InactivityTriggered
+		}
+		if nowInMS() < availableAt {
+			return nil
+		}
+		keys = e.Keys
+		e.RecoveryRequested = 0
+		if e.InactivityTriggered > 0 {
+			e.InactivityMonths = 0
+			e.InactivityTriggered = 0
+		}
+		e.addEvent(EscrowEventReleased, fmt.Sprintf("%d albums", len(keys)))
+		return nil
+	}()
+	if err != nil || keys == nil {
+		return 0, availableAt, err
+	}
+	owner, err := d.UserByID(ownerID)
+	if err != nil {
+		return 0, availableAt, err
+	}
+	count := 0
+	for albumID, key := range keys {
+		if err := d.releaseEscrowKey(owner, contact, albumID, key); err != nil {
+			log.Errorf("releaseEscrowKey(%d, %d, %q): %v", owner.UserID, contact.UserID, albumID, err)
+			continue
+		}
+		count++
+	}
+	return count, availableAt, nil
+}
+
+// releaseEscrowKey shares an album with the recovery contact.
+func (d *Database) releaseEscrowKey(owner, contact User, albumID, key string) (retErr error) {
+	albumRef, err := d.albumRef(owner, albumID)
+	if err != nil {
+		return err
+	}
+	commit, fs, err := d.fileSetForUpdate(owner, stingle.AlbumSet, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album.OwnerID != owner.UserID {
+		return os.ErrPermission
+	}
+	if fs.Album.Members[contact.UserID] {
+		return nil
+	}
+	perms := fs.Album.Permissions
+	if !fs.Album.IsShared {
+		// The contact must be able to copy the files to recover them.
+		perms = "1001"
+	}
+	uid := strconv.FormatInt(contact.UserID, 10)
+	sharing := &stingle.Album{
+		AlbumID:     albumID,
+		IsHidden:    boolToNumber(fs.Album.IsHidden),
+		IsLocked:    boolToNumber(fs.Album.IsLocked),
+		Permissions: string(perms),
+		Members:     uid,
+	}
+	return d.shareAlbum(owner, albumRef, fs, sharing, map[string]string{uid: key})
+}
+
+// DenyRecovery is used by the owner to deny a pending recovery request.
+func (d *Database) DenyRecovery(owner User) (retErr error) {
+	defer recordLatency("DenyRecovery")()
+
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	e := escrows.Escrows[owner.UserID]
+	if e == nil || e.RecoveryRequested == 0 {
+		return os.ErrNotExist
+	}
+	e.RecoveryRequested = 0
+	e.addEvent(EscrowEventRecoveryDenied, "")
+	// The owner is obviously still active.
+	e.resetInactivity()
+	return nil
+}
+
+// removeEscrows removes the escrows where user is the owner or the recovery
+// contact, e.g. when the user is deleted.
+func (d *Database) removeEscrows(user User) (retErr error) {
+	if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(albumEscrowFile))); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	for ownerID, e := range escrows.Escrows {
+		if e.OwnerID == user.UserID || e.ContactID == user.UserID {
+			delete(escrows.Escrows, ownerID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestAlbumEscrow(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+	defer func() { database.CurrentTimeForTesting = 0 }()
+	const delay = 5 * time.Second
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@", "carol@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob, carol := users["alice@"], users["bob@"], users["carol@"]
+	for _, albumID := range []string{"album1", "album2"} {
+		if err := addAlbum(db, alice, albumID); err != nil {
+			t.Fatalf("addAlbum(%q): %v", albumID, err)
+		}
+	}
+
+	if err := db.SetRecoveryContact(alice, "bob@"); err != nil {
+		t.Fatalf("db.SetRecoveryContact: %v", err)
+	}
+	// Keys can't be added before bob accepts.
+	if err := db.AddEscrowKeys(alice, map[string]string{"album1": "key1"}); !errors.Is(err, database.ErrNoRecoveryContact) {
+		t.Errorf("db.AddEscrowKeys() = %v, want %v", err, database.ErrNoRecoveryContact)
+	}
+	if err := db.AnswerRecoveryContact(carol, alice.UserID, true); !errors.Is(err, database.ErrNoRecoveryContact) {
+		t.Errorf("carol db.AnswerRecoveryContact() = %v, want %v", err, database.ErrNoRecoveryContact)
+	}
+	if err := db.AnswerRecoveryContact(bob, alice.UserID, true); err != nil {
+		t.Fatalf("db.AnswerRecoveryContact: %v", err)
+	}
+	if err := db.AddEscrowKeys(alice, map[string]string{"album1": "key1", "album2": "key2"}); err != nil {
+		t.Fatalf("db.AddEscrowKeys: %v", err)
+	}
+	if err := db.AddEscrowKeys(bob, map[string]string{"album1": "key1"}); err == nil {
+		t.Error("bob db.AddEscrowKeys() succeeded unexpectedly")
+	}
+
+	owned, _, err := db.RecoveryStatus(alice, delay)
+	if err != nil {
+		t.Fatalf("db.RecoveryStatus: %v", err)
+	}
+	if owned == nil || owned.ContactEmail != "bob@" || !owned.Accepted || len(owned.Albums) != 2 {
+		t.Errorf("Unexpected status: %+v", owned)
+	}
+	_, contact, err := db.RecoveryStatus(bob, delay)
+	if err != nil {
+		t.Fatalf("db.RecoveryStatus: %v", err)
+	}
+	if len(contact) != 1 || contact[0].OwnerEmail != "alice@" || contact[0].Albums != nil {
+		t.Errorf("Unexpected status: %+v", contact)
+	}
+
+	// The first request starts the delay. The owner can deny it.
+	n, at, err := db.RequestRecovery(bob, alice.UserID, delay)
+	if err != nil || n != 0 || at != 15000 {
+		t.Fatalf("db.RequestRecovery() = %d, %d, %v", n, at, err)
+	}
+	if err := db.DenyRecovery(alice); err != nil {
+		t.Fatalf("db.DenyRecovery: %v", err)
+	}
+	database.CurrentTimeForTesting = 20000
+	if n, at, err := db.RequestRecovery(bob, alice.UserID, delay); err != nil || n != 0 || at != 25000 {
+		t.Fatalf("db.RequestRecovery() = %d, %d, %v", n, at, err)
+	}
+	database.CurrentTimeForTesting = 24999
+	if n, _, err := db.RequestRecovery(bob, alice.UserID, delay); err != nil || n != 0 {
+		t.Fatalf("db.RequestRecovery() = %d, %v", n, err)
+	}
+	if _, _, err := db.RequestRecovery(carol, alice.UserID, delay); !errors.Is(err, database.ErrNoRecoveryContact) {
+		t.Errorf("carol db.RequestRecovery() = %v, want %v", err, database.ErrNoRecoveryContact)
+	}
+
+	// After the delay, the albums are shared with bob.
+	database.CurrentTimeForTesting = 25000
+	if n, _, err := db.RequestRecovery(bob, alice.UserID, delay); err != nil || n != 2 {
+		t.Fatalf("db.RequestRecovery() = %d, %v", n, err)
+	}
+	for _, albumID := range []string{"album1", "album2"} {
+		album, err := db.Album(bob, albumID)
+		if err != nil {
+			t.Fatalf("db.Album(bob, %q): %v", albumID, err)
+		}
+		if !album.Members[bob.UserID] || album.SharingKeys[bob.UserID] == "" || !album.Permissions.AllowCopy() {
+			t.Errorf("Unexpected album: %+v", album)
+		}
+	}
+
+	// Removing the contact discards the escrow.
+	if err := db.SetRecoveryContact(alice, ""); err != nil {
+		t.Fatalf("db.SetRecoveryContact: %v", err)
+	}
+	if owned, contact, err := db.RecoveryStatus(bob, delay); err != nil || owned != nil || len(contact) != 0 {
+		t.Errorf("db.RecoveryStatus() = %+v, %+v, %v", owned, contact, err)
+	}
+}
+
+func TestInactivityTrigger(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	database.CurrentTimeForTesting = start.UnixMilli()
+	defer func() { database.CurrentTimeForTesting = 0 }()
+	const delay = 30 * 24 * time.Hour
+	week := 7 * 24 * time.Hour
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob := users["alice@"], users["bob@"]
+	if err := addAlbum(db, alice, "album1"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	if err := db.SetRecoveryContact(alice, "bob@"); err != nil {
+		t.Fatalf("db.SetRecoveryContact: %v", err)
+	}
+	if err := db.SetInactivityTrigger(alice, 6); !errors.Is(err, database.ErrNoRecoveryContact) {
+		t.Errorf("db.SetInactivityTrigger() = %v, want %v", err, database.ErrNoRecoveryContact)
+	}
+	if err := db.AnswerRecoveryContact(bob, alice.UserID, true); err != nil {
+		t.Fatalf("db.AnswerRecoveryContact: %v", err)
+	}
+	if err := db.AddEscrowKeys(alice, map[string]string{"album1": "key1"}); err != nil {
+		t.Fatalf("db.AddEscrowKeys: %v", err)
+	}
+	if err := db.SetInactivityTrigger(alice, 1000); !errors.Is(err, database.ErrInvalidInactivityPeriod) {
+		t.Errorf("db.SetInactivityTrigger() = %v, want %v", err, database.ErrInvalidInactivityPeriod)
+	}
+	if err := db.SetInactivityTrigger(alice, 6); err != nil {
+		t.Fatalf("db.SetInactivityTrigger: %v", err)
+	}
+
+	check := func(when time.Time, want []database.InactivityNotice) {
+		t.Helper()
+		database.CurrentTimeForTesting = when.UnixMilli()
+		got, err := db.CheckInactivity()
+		if err != nil {
+			t.Fatalf("db.CheckInactivity: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("db.CheckInactivity() = %+v, want %+v", got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("db.CheckInactivity() = %+v, want %+v", got, want)
+			}
+		}
+	}
+	reminder := func(n int, when time.Time) database.InactivityNotice {
+		return database.InactivityNotice{
+			OwnerID:   alice.UserID,
+			ContactID: bob.UserID,
+			Reminder:  n,
+			Deadline:  when.Add(time.Duration(4-n) * week).UnixMilli(),
+		}
+	}
+
+	// Nothing happens before 6 months.
+	check(start.AddDate(0, 6, -1), nil)
+	t1 := start.AddDate(0, 6, 0)
+	check(t1, []database.InactivityNotice{reminder(1, t1)})
+	check(t1.Add(week-time.Second), nil)
+
+	// Logging in restarts the inactivity period.
+	if err := db.RecordOwnerActivity(alice); err != nil {
+		t.Fatalf("db.RecordOwnerActivity: %v", err)
+	}
+	check(t1.Add(week), nil)
+	t2 := t1.Add(week-time.Second).AddDate(0, 6, 0)
+	check(t2, []database.InactivityNotice{reminder(1, t2)})
+	check(t2.Add(week), []database.InactivityNotice{reminder(2, t2.Add(week))})
+	check(t2.Add(2*week), []database.InactivityNotice{reminder(3, t2.Add(2*week))})
+
+	// Bob can't recover the albums without waiting before the trigger
+	// fires.
+	database.CurrentTimeForTesting = t2.Add(2 * week).UnixMilli()
+	if n, _, err := db.RequestRecovery(bob, alice.UserID, delay); err != nil || n != 0 {
+		t.Fatalf("db.RequestRecovery() = %d, %v", n, err)
+	}
+	t3 := t2.Add(3 * week)
+	check(t3, []database.InactivityNotice{{OwnerID: alice.UserID, ContactID: bob.UserID, Triggered: true, Deadline: t3.UnixMilli()}})
+	check(t3.Add(week), nil)
+
+	_, contact, err := db.RecoveryStatus(bob, delay)
+	if err != nil {
+		t.Fatalf("db.RecoveryStatus: %v", err)
+	}
+	if len(contact) != 1 || contact[0].InactivityTriggered != t3.UnixMilli() || contact[0].RecoveryAvailable != t3.UnixMilli() {
+		t.Errorf("Unexpected status: %+v", contact)
+	}
+	if n, _, err := db.RequestRecovery(bob, alice.UserID, delay); err != nil || n != 1 {
+		t.Fatalf("db.RequestRecovery() = %d, %v", n, err)
+	}
+	if album, err := db.Album(bob, "album1"); err != nil || !album.Members[bob.UserID] {
+		t.Errorf("db.Album(bob) = %+v, %v", album, err)
+	}
+
+	owned, _, err := db.RecoveryStatus(alice, delay)
+	if err != nil {
+		t.Fatalf("db.RecoveryStatus: %v", err)
+	}
+	if owned.InactivityMonths != 0 {
+		t.Errorf("InactivityMonths = %d, want 0", owned.InactivityMonths)
+	}
+	var types []string
+	for _, ev := range owned.Events {
+		types = append(types, ev.Type)
+	}
+	want := []string{
+		database.EscrowEventInactivitySet,
+		database.EscrowEventReminder,
+		database.EscrowEventOwnerActive,
+		database.EscrowEventReminder,
+		database.EscrowEventReminder,
+		database.EscrowEventReminder,
+		database.EscrowEventRecoveryRequested,
+		database.EscrowEventTriggered,
+		database.EscrowEventReleased,
+	}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("Events = %v, want %v", types, want)
+	}
+}
@@ -0,0 +1,155 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"c2FmZQ/internal/log"
+)
+
+// The logical filename where the scheduled album unshares are stored.
+const albumExpiryFile = "album-expiry.dat"
+
+var ErrInvalidUnshareDate = errors.New("invalid unshare date")
+
+// albumExpiry contains the albums that are scheduled to be unshared, keyed by
+// userAlbumKey.
+type albumExpiry struct {
+	Albums map[string]*AlbumExpiry `json:"albums"`
+}
+
+// AlbumExpiry is an album that is scheduled to be unshared.
+type AlbumExpiry struct {
+	OwnerID int64  `json:"ownerId"`
+	AlbumID string `json:"albumId"`
+	// The time when the album is unshared, in milliseconds.
+	Date int64 `json:"date"`
+}
+
+// userAlbumKey returns the key of a user's album in the global indexes.
+func userAlbumKey(userID int64, albumID string) string {
+	return fmt.Sprintf("%d/%s", userID, albumID)
+}
+
+// SetAlbumUnshareDate schedules an album to be unshared automatically at
+// date, in milliseconds. A date of zero cancels it.
+func (d *Database) SetAlbumUnshareDate(owner User, albumID string, date int64) (retErr error) {
+	defer recordLatency("SetAlbumUnshareDate")()
+
+	if date < 0 || (date > 0 && date <= nowInMS()) {
+		return ErrInvalidUnshareDate
+	}
+	albumRef, err := d.albumRef(owner, albumID)
+	if err != nil {
+		return err
+	}
+	fn := d.filePath(albumExpiryFile)
+	if err := d.storage.CreateEmptyFile(fn, albumExpiry{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var fs FileSet
+	var expiry albumExpiry
+	commit, err := d.storage.OpenManyForUpdate([]string{albumRef.File, fn}, []interface{}{&fs, &expiry})
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album == nil || fs.Album.OwnerID != owner.UserID {
+		return os.ErrPermission
+	}
+	if date > 0 && !fs.Album.IsShared {
+		return ErrInvalidUnshareDate
+	}
+	if expiry.Albums == nil {
+		expiry.Albums = make(map[string]*AlbumExpiry)
+	}
+	fs.Album.UnshareDate = date
+	key := userAlbumKey(owner.UserID, albumID)
+	if date == 0 {
+		delete(expiry.Albums, key)
+		return nil
+	}
+	expiry.Albums[key] = &AlbumExpiry{
+		OwnerID: owner.UserID,
+		AlbumID: albumID,
+		Date:    date,
+	}
+	return nil
+}
+
+// removeAlbumExpiry removes an album from the scheduled unshares, e.g. when
+// the album is unshared or deleted.
+func (d *Database) removeAlbumExpiry(ownerID int64, albumID string) (retErr error) {
+	key := userAlbumKey(ownerID, albumID)
+	fn := d.filePath(albumExpiryFile)
+	var expiry albumExpiry
+	if err := d.storage.ReadDataFile(fn, &expiry); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := expiry.Albums[key]; !ok {
+		return nil
+	}
+	commit, err := d.storage.OpenForUpdate(fn, &expiry)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	delete(expiry.Albums, key)
+	return nil
+}
+
+// UnshareExpiredAlbums unshares the albums whose unshare date has passed. It
+// returns the number of albums that were unshared.
+func (d *Database) UnshareExpiredAlbums() (int, error) {
+	var expiry albumExpiry
+	if err := d.storage.ReadDataFile(d.filePath(albumExpiryFile), &expiry); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	now := nowInMS()
+	count := 0
+	for _, e := range expiry.Albums {
+		if e.Date > now {
+			continue
+		}
+		owner, err := d.UserByID(e.OwnerID)
+		if err == nil {
+			err = d.UnshareAlbum(owner, e.AlbumID)
+		}
+		if err == nil {
+			count++
+			continue
+		}
+		log.Errorf("UnshareAlbum(%d, %q): %v", e.OwnerID, e.AlbumID, err)
+		if errors.Is(err, os.ErrNotExist) {
+			// The album or its owner no longer exists.
+			if err := d.removeAlbumExpiry(e.OwnerID, e.AlbumID); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestAlbumUnshareDate(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob := users["alice@"], users["bob@"]
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	if err := db.SetAlbumUnshareDate(alice, "album", 20000); err != database.ErrInvalidUnshareDate {
+		t.Errorf("db.SetAlbumUnshareDate(not shared) = %v, want ErrInvalidUnshareDate", err)
+	}
+	album := stingle.Album{
+		AlbumID:     "album",
+		IsShared:    "1",
+		Permissions: "1111",
+		Members:     membersString(alice.UserID, bob.UserID),
+	}
+	if err := db.ShareAlbum(alice, &album, map[string]string{fmt.Sprintf("%d", bob.UserID): "key"}); err != nil {
+		t.Fatalf("db.ShareAlbum: %v", err)
+	}
+
+	if err := db.SetAlbumUnshareDate(alice, "album", 5000); err != database.ErrInvalidUnshareDate {
+		t.Errorf("db.SetAlbumUnshareDate(past) = %v, want ErrInvalidUnshareDate", err)
+	}
+	if err := db.SetAlbumUnshareDate(bob, "album", 20000); err == nil {
+		t.Error("db.SetAlbumUnshareDate(bob) succeeded unexpectedly")
+	}
+	if err := db.SetAlbumUnshareDate(alice, "album", 20000); err != nil {
+		t.Fatalf("db.SetAlbumUnshareDate: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 15000
+	if n, err := db.UnshareExpiredAlbums(); err != nil || n != 0 {
+		t.Errorf("db.UnshareExpiredAlbums() = %d, %v, want 0", n, err)
+	}
+	if refs, err := db.AlbumRefs(bob); err != nil || refs["album"] == nil {
+		t.Fatalf("bob is not a member of the album: %v %v", refs, err)
+	}
+
+	database.CurrentTimeForTesting = 20000
+	if n, err := db.UnshareExpiredAlbums(); err != nil || n != 1 {
+		t.Errorf("db.UnshareExpiredAlbums() = %d, %v, want 1", n, err)
+	}
+	if refs, err := db.AlbumRefs(bob); err != nil || refs["album"] != nil {
+		t.Errorf("bob is still a member of the album: %v %v", refs, err)
+	}
+	a, err := db.Album(alice, "album")
+	if err != nil {
+		t.Fatalf("db.Album: %v", err)
+	}
+	if a.IsShared || a.UnshareDate != 0 {
+		t.Errorf("album IsShared = %v, UnshareDate = %d", a.IsShared, a.UnshareDate)
+	}
+	if n, err := db.UnshareExpiredAlbums(); err != nil || n != 0 {
+		t.Errorf("db.UnshareExpiredAlbums() = %d, %v, want 0", n, err)
+	}
+}
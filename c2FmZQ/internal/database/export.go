@@ -0,0 +1,136 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+)
+
+// CanonicalJSON returns a canonical JSON encoding of obj: object keys are
+// sorted, there is no insignificant whitespace, numbers are written exactly as
+// they would be by encoding/json, and HTML characters aren't escaped. The
+// delete events of a FileSet are sorted too, so that two copies of the same
+// metadata encode to the same bytes regardless of the order in which they
+// were built. The output ends with a newline.
+func CanonicalJSON(obj interface{}) ([]byte, error) {
+	switch v := obj.(type) {
+	case FileSet:
+		obj = v.canonical()
+	case *FileSet:
+		if v != nil {
+			obj = v.canonical()
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding into interface{} turns all the structs into maps, which
+	// encoding/json always encodes with sorted keys.
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canonical returns a shallow copy of fs with the delete events in a
+// deterministic order.
+func (fs FileSet) canonical() FileSet {
+	deletes := make([]DeleteEvent, len(fs.Deletes))
+	copy(deletes, fs.Deletes)
+	sort.SliceStable(deletes, func(i, j int) bool {
+		a, b := deletes[i], deletes[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.AlbumID != b.AlbumID {
+			return a.AlbumID < b.AlbumID
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.UserID < b.UserID
+	})
+	if fs.Deletes != nil {
+		fs.Deletes = deletes
+	}
+	return fs
+}
+
+// ExportFile writes the content of a metadata file to w with CanonicalJSON,
+// e.g. to compare two replicas, or a backup and a live database, byte for
+// byte. Blob files can't be exported.
+func (d *Database) ExportFile(filename string, w io.Writer) error {
+	obj, err := d.readMetadataFile(filename)
+	if err != nil {
+		return err
+	}
+	b, err := CanonicalJSON(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readMetadataFile reads a metadata file without knowing its type in advance.
+func (d *Database) readMetadataFile(filename string) (interface{}, error) {
+	var (
+		user          User
+		blob          BlobSpec
+		userList      []userList
+		albumManifest AlbumManifest
+		contactList   ContactList
+		fileSet       FileSet
+	)
+	if err := d.storage.ReadDataFile(filename, &user); err == nil && user.UserID != 0 {
+		return user, nil
+	}
+	if err := d.storage.ReadDataFile(filename, &blob); err == nil && blob.RefCount > 0 {
+		return blob, nil
+	}
+	if err := d.storage.ReadDataFile(filename, &userList); err == nil && userList != nil {
+		return userList, nil
+	}
+	if err := d.storage.ReadDataFile(filename, &albumManifest); err == nil && albumManifest.Albums != nil {
+		return albumManifest, nil
+	}
+	if err := d.storage.ReadDataFile(filename, &contactList); err == nil && contactList.Contacts != nil {
+		return contactList, nil
+	}
+	if err := d.storage.ReadDataFile(filename, &fileSet); err == nil && fileSet.Files != nil {
+		return fileSet, nil
+	}
+	return nil, errors.New("not a metadata file")
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	fs1 := database.FileSet{
+		Files: map[string]*database.FileSpec{
+			"b": {Headers: "hb", DateCreated: 2},
+			"a": {Headers: "ha<&>", DateCreated: 1},
+		},
+		Deletes: []database.DeleteEvent{
+			{File: "x", Type: 1, Date: 100},
+			{File: "y", Type: 1, Date: 100},
+			{File: "z", Type: 2, Date: 50},
+		},
+		SeenMarkers: map[int64]*database.SeenMarker{10: {}, 2: {}},
+	}
+	fs2 := database.FileSet{
+		Files: map[string]*database.FileSpec{
+			"a": {Headers: "ha<&>", DateCreated: 1},
+			"b": {Headers: "hb", DateCreated: 2},
+		},
+		Deletes: []database.DeleteEvent{
+			{File: "z", Type: 2, Date: 50},
+			{File: "y", Type: 1, Date: 100},
+			{File: "x", Type: 1, Date: 100},
+		},
+		SeenMarkers: map[int64]*database.SeenMarker{2: {}, 10: {}},
+	}
+	b1, err := database.CanonicalJSON(fs1)
+	if err != nil {
+		t.Fatalf("CanonicalJSON(fs1) failed: %v", err)
+	}
+	b2, err := database.CanonicalJSON(&fs2)
+	if err != nil {
+		t.Fatalf("CanonicalJSON(fs2) failed: %v", err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("CanonicalJSON mismatch:\n%s\n%s", b1, b2)
+	}
+	if want := `{"deletes":[{"date":50,"file":"z","type":2},{"date":100,"file":"x","type":1},{"date":100,"file":"y","type":1}],`; !bytes.HasPrefix(b1, []byte(want)) {
+		t.Errorf("Unexpected encoding. Want prefix %s, got %s", want, b1)
+	}
+	if !bytes.Contains(b1, []byte(`"ha<&>"`)) {
+		t.Errorf("HTML characters should not be escaped: %s", b1)
+	}
+	if fs1.Deletes[0].File != "x" {
+		t.Errorf("CanonicalJSON modified its input: %v", fs1.Deletes)
+	}
+}
+
+func TestExportFile(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	for _, f := range []string{"file1", "file2", "file3"} {
+		if err := addFile(db, user, f, stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile(%q) failed: %v", f, err)
+		}
+	}
+	fs, err := db.FileSet(user, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet failed: %v", err)
+	}
+	want, err := database.CanonicalJSON(fs)
+	if err != nil {
+		t.Fatalf("CanonicalJSON failed: %v", err)
+	}
+	// Without a master key, the file names aren't hashed.
+	fileName := filepath.Join("metadata", "home", fmt.Sprint(user.UserID), "fileset-"+stingle.GallerySet)
+	var got bytes.Buffer
+	if err := db.ExportFile(fileName, &got); err != nil {
+		t.Fatalf("db.ExportFile(%q) failed: %v", fileName, err)
+	}
+	if !bytes.Equal(want, got.Bytes()) {
+		t.Errorf("db.ExportFile(%q) = %s, want %s", fileName, got.Bytes(), want)
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestFileIteratorIsComplete checks that every file name constant that is
+// passed to d.filePath is also used by FileIterator. The files that
+// FileIterator doesn't list are left behind by ReEncrypt, and skipped by the
+// metadata snapshots.
+func TestFileIteratorIsComplete(t *testing.T) {
+	// The names that are passed to d.filePath, but that aren't data files.
+	exempt := map[string]string{
+		"quotaLockFile":       "the name of a lock",
+		"userLockFile":        "the name of a lock",
+		"usageReportLockFile": "the name of a lock",
+		"fileSetsLockFile":    "the name of a lock",
+	}
+
+	names, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatalf("ParseFile: %v", err)
+		}
+		files = append(files, f)
+	}
+
+	consts := make(map[string]bool)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.CONST {
+				for _, spec := range gd.Specs {
+					for _, n := range spec.(*ast.ValueSpec).Names {
+						consts[n.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	// The constants in the arguments of d.filePath, including the
+	// arguments of nested calls, e.g. d.filePath(user.home(userFile)).
+	used := make(map[string]bool)
+	var collect func(ast.Node)
+	collect = func(n ast.Node) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && consts[id.Name] {
+				used[id.Name] = true
+			}
+			return true
+		})
+	}
+	var iterator *ast.FuncDecl
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Name.Name == "FileIterator" {
+					iterator = n
+				}
+			case *ast.CallExpr:
+				if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "filePath" {
+					for _, arg := range n.Args {
+						collect(arg)
+					}
+				}
+			}
+			return true
+		})
+	}
+	if iterator == nil {
+		t.Fatal("FileIterator not found")
+	}
+	listed := make(map[string]bool)
+	ast.Inspect(iterator.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			listed[id.Name] = true
+		}
+		return true
+	})
+
+	var missing []string
+	for name := range used {
+		if _, ok := exempt[name]; ok || listed[name] {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("FileIterator doesn't list these files: %v", missing)
+	}
+	if len(used) < 10 {
+		t.Errorf("Only found %d file names, the test is probably broken: %v", len(used), used)
+	}
+}
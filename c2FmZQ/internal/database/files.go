@@ -18,8 +18,12 @@
 package database
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -29,10 +33,16 @@ import (
 
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/timing"
 )
 
 const (
 	fileSetPattern = "fileset-%s"
+
+	// Thumbnails larger than this are never kept in the thumbnail cache.
+	maxCachedThumbSize = 256 << 10
+	// The maximum total size of the thumbnail cache.
+	maxThumbCacheBytes = 32 << 20
 )
 
 var (
@@ -49,6 +59,15 @@ type FileSet struct {
 	Deletes []DeleteEvent `json:"deletes,omitempty"`
 	// The timestamp before which DeleteEvents were pruned.
 	DeleteHorizon int64 `json:"deleteHorizon,omitempty"`
+	// If the file set is an album, the comments of the album members,
+	// keyed by comment ID.
+	Comments map[string]*Comment `json:"comments,omitempty"`
+	// If the file set is an album, the reactions of the album members,
+	// keyed by file name and user ID.
+	Reactions map[string]map[int64]*Reaction `json:"reactions,omitempty"`
+	// If the file set is an album, the "last seen" markers of the album
+	// members, keyed by user ID.
+	SeenMarkers map[int64]*SeenMarker `json:"seenMarkers,omitempty"`
 }
 
 // FileSpec encapsulates the information of a file.
@@ -69,6 +88,39 @@ type FileSpec struct {
 	StoreThumb string `json:"storeThumb"`
 	// The size of the file thumbnail.
 	StoreThumbSize int64 `json:"storeThumbSize"`
+	// The file path where the medium-resolution variant of the file is
+	// stored, if the client uploaded one.
+	StoreMedium string `json:"storeMedium,omitempty"`
+	// The size of the medium-resolution variant.
+	StoreMediumSize int64 `json:"storeMediumSize,omitempty"`
+	// The ID of the user who added the file to the set. It is used to
+	// charge files in shared albums with the contributor policy.
+	AddedBy int64 `json:"addedBy,omitempty"`
+	// An opaque fingerprint of the file's original content, computed by the
+	// client with a secret key. It is used to detect duplicate uploads.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// blobs returns the blobs that the file uses: its content, its thumbnail, and
+// its medium-resolution variant if it has one.
+func (f *FileSpec) blobs() []string {
+	if f.StoreMedium == "" {
+		return []string{f.StoreFile, f.StoreThumb}
+	}
+	return []string{f.StoreFile, f.StoreThumb, f.StoreMedium}
+}
+
+// hasMedium returns the value of the stingle.File.HasMedium field for f.
+func hasMedium(f *FileSpec) json.Number {
+	if f.StoreMedium == "" {
+		return ""
+	}
+	return "1"
+}
+
+// storeSize returns the total size of the file's blobs.
+func (f *FileSpec) storeSize() int64 {
+	return f.StoreFileSize + f.StoreThumbSize + f.StoreMediumSize
 }
 
 // BlobSpec encapsulated the information of a blob (the content of a file).
@@ -95,41 +147,107 @@ func (d *Database) incRefCount(blob string, delta int) int {
 	}
 	log.Debugf("RefCount(%q)%+d -> %d", blob, delta, blobSpec.RefCount)
 	if blobSpec.RefCount == 0 {
-		if err := os.Remove(filepath.Join(d.dir, blob)); err != nil {
-			log.Errorf("os.Remove(%q) failed: %v", blob, err)
-		}
-		if err := os.Remove(filepath.Join(d.dir, ref)); err != nil {
-			log.Errorf("os.Remove(%q) failed: %v", ref, err)
-		}
+		d.removeBlob(blob, ref)
 	}
 	return blobSpec.RefCount
 }
 
+// removeBlob deletes a blob, and its reference file if ref isn't empty.
+func (d *Database) removeBlob(blob, ref string) {
+	d.thumbCacheMutex.Lock()
+	d.thumbCache.Remove(blob)
+	d.thumbCacheMutex.Unlock()
+	if err := d.storage.DeleteBlob(blob); err != nil {
+		log.Errorf("DeleteBlob(%q) failed: %v", blob, err)
+	}
+	if ref == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(d.dir, ref)); err != nil {
+		log.Errorf("os.Remove(%q) failed: %v", ref, err)
+	}
+}
+
 // fileSetPath returns the path where a file set is stored.
 func (d *Database) fileSetPath(user User, set string) string {
 	return d.filePath(user.home(fmt.Sprintf(fileSetPattern, set)))
 }
 
-// addFileToFileSet adds file to one of user's file sets.
-func (d *Database) addFileToFileSet(user User, file FileSpec, name, set, albumID string) (retErr error) {
+// addFileCommitHook, if set, is called by addFileLocked right before the
+// commit, with the files that are about to be saved. Tests use it to simulate
+// crashes.
+var addFileCommitHook func(files []string)
+
+// addFileLocked adds file to a file set, and increases the reference counts of
+// its blobs, in a single commit. The file set and the blob reference files are
+// opened together with OpenManyForUpdate, which journals the original files
+// before saving the new ones, and rolls them back if the process dies before
+// the commit is complete. So, a file is never in a file set without its blobs
+// being counted, and a blob is never counted for a file that isn't in a file
+// set.
+//
+// The existing blobs that are reused are only counted if they are still
+// referenced by other files. If some aren't, they are returned and the file
+// isn't added. d.refMutex must be held.
+func (d *Database) addFileLocked(user User, file FileSpec, name, set, albumID string, blobs []*addedBlob) (gone []*addedBlob, retErr error) {
 	var fileName string
 	if set == stingle.AlbumSet {
 		albumRef, err := d.albumRef(user, albumID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		fileName = albumRef.File
 	} else {
 		fileName = d.fileSetPath(user, set)
 	}
+	file.StoreFile = blobs[0].name()
+	file.StoreThumb = blobs[1].name()
+	if len(blobs) > 2 {
+		file.StoreMedium = blobs[2].name()
+	}
+
 	var fileSet FileSet
-	commit, err := d.storage.OpenForUpdate(fileName, &fileSet)
+	files := []string{fileName}
+	objects := []interface{}{&fileSet}
+	refs := make(map[string]*BlobSpec)
+	for _, blob := range file.blobs() {
+		ref := d.blobRef(blob)
+		if refs[ref] != nil {
+			continue
+		}
+		refs[ref] = &BlobSpec{}
+		files = append(files, ref)
+		objects = append(objects, refs[ref])
+	}
+	commit, err := d.storage.OpenManyForUpdate(files, objects)
+	if errors.Is(err, os.ErrNotExist) {
+		for _, b := range blobs {
+			if b.dup == "" {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(d.Dir(), d.blobRef(b.dup))); errors.Is(err, os.ErrNotExist) {
+				gone = append(gone, b)
+			}
+		}
+		if gone != nil {
+			return gone, nil
+		}
+	}
 	if err != nil {
-		log.Errorf("d.storage.OpenForUpdate(%q): %v", fileName, err)
-		return err
+		log.Errorf("d.storage.OpenManyForUpdate(%q): %v", fileName, err)
+		return nil, err
 	}
-	defer commit(true, &retErr)
+	defer commit(false, &retErr)
 
+	for _, b := range blobs {
+		if b.dup != "" && refs[d.blobRef(b.dup)].RefCount <= 0 {
+			gone = append(gone, b)
+		}
+	}
+	if gone != nil {
+		commit(false, nil)
+		return gone, nil
+	}
 	if fileSet.Files == nil {
 		fileSet.Files = make(map[string]*FileSpec)
 	}
@@ -137,15 +255,22 @@ func (d *Database) addFileToFileSet(user User, file FileSpec, name, set, albumID
 		fileSet.Deletes = []DeleteEvent{}
 	}
 	fileSet.Files[name] = &file
-	d.storage.CreateEmptyFile(d.blobRef(file.StoreFile), BlobSpec{})
-	d.storage.CreateEmptyFile(d.blobRef(file.StoreThumb), BlobSpec{})
-	d.incRefCount(file.StoreFile, 1)
-	d.incRefCount(file.StoreThumb, 1)
+	for _, blob := range file.blobs() {
+		spec := refs[d.blobRef(blob)]
+		spec.RefCount++
+		log.Debugf("RefCount(%q)+1 -> %d", blob, spec.RefCount)
+	}
+	if addFileCommitHook != nil {
+		addFileCommitHook(files)
+	}
+	if err := commit(true, nil); err != nil {
+		return nil, err
+	}
 
 	if a := fileSet.Album; a != nil {
 		d.notifyAlbum(user.UserID, a, notification{Type: notifyNewContent, Target: a.AlbumID})
 	}
-	return nil
+	return nil, nil
 }
 
 // TempFile returns a temporary file, open for writing in dir, where dir is
@@ -158,7 +283,7 @@ func (d *Database) TempFile(dir string) (io.WriteCloser, string, error) {
 		}
 		temp := filepath.Join(dir, base64.RawURLEncoding.EncodeToString(name))
 		fullTemp := filepath.Join(d.Dir(), temp)
-		final, _ := finalFilename(temp)
+		final, _ := d.finalFilename(temp)
 		if _, err := os.Stat(filepath.Join(d.Dir(), final)); err == nil {
 			log.Debugf("TempFile collision: %s", final)
 			continue
@@ -174,17 +299,21 @@ func (d *Database) TempFile(dir string) (io.WriteCloser, string, error) {
 		if errors.Is(err, fs.ErrExist) {
 			continue
 		}
-		return w, fullTemp, err
+		if err != nil {
+			return nil, "", err
+		}
+		hw := &hashingWriter{
+			WriteCloser: w,
+			h:           sha256.New(),
+			done:        func(key string) { d.setTempHash(fullTemp, key) },
+		}
+		return hw, fullTemp, nil
 	}
 }
 
-func finalFilename(temp string) (string, error) {
+func (d *Database) finalFilename(temp string) (string, error) {
 	_, n := filepath.Split(temp)
-	b, err := base64.RawURLEncoding.DecodeString(n)
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(fmt.Sprintf("%02X", b[0]), n), nil
+	return d.blobPath(n)
 }
 
 func (d *Database) fileSetOwner(user User, set, albumID string) (User, error) {
@@ -201,17 +330,35 @@ func (d *Database) fileSetOwner(user User, set, albumID string) (User, error) {
 	return d.UserByID(fs.Album.OwnerID)
 }
 
-// AddFile adds a new file to the database. The file content and thumbnail are
-// already on disk in temporary files (file.StoreFile and file.StoreThumb). They
-// will be moved to random file names.
-func (d *Database) AddFile(user User, file FileSpec, name, set, albumID string) error {
+// AddFile adds a new file to the database. The file content, thumbnail, and
+// optional medium-resolution variant are already on disk in temporary files
+// (file.StoreFile, file.StoreThumb, and file.StoreMedium). They will be moved
+// to random file names, unless a blob with the same content already exists. In
+// that case, the existing blob is used instead, and the temporary file is
+// deleted.
+func (d *Database) AddFile(user User, file FileSpec, name, set, albumID string) (retErr error) {
 	defer recordLatency("AddFile")()
 
-	// Space is charged to the quota of the owner of the album.
-	owner, err := d.fileSetOwner(user, set, albumID)
+	blobs := []*addedBlob{
+		{temp: file.StoreFile, key: d.takeTempHash(file.StoreFile), size: file.StoreFileSize},
+		{temp: file.StoreThumb, key: d.takeTempHash(file.StoreThumb), size: file.StoreThumbSize},
+	}
+	if file.StoreMedium != "" {
+		blobs = append(blobs, &addedBlob{temp: file.StoreMedium, key: d.takeTempHash(file.StoreMedium), size: file.StoreMediumSize})
+	}
+	defer func() {
+		if retErr != nil {
+			d.abortAddedBlobs(blobs)
+		}
+	}()
+	if !validID(name) || !validHeaders(file.Headers) || checkFileSet(set, albumID) != nil {
+		return ErrInvalidID
+	}
+	owner, err := d.quotaOwner(user, set, albumID)
 	if err != nil {
 		return err
 	}
+	file.AddedBy = user.UserID
 	spaceUsed, err := d.SpaceUsed(owner)
 	if err != nil {
 		return err
@@ -220,49 +367,144 @@ func (d *Database) AddFile(user User, file FileSpec, name, set, albumID string)
 	if err != nil {
 		return err
 	}
-	if total := spaceUsed + file.StoreFileSize + file.StoreThumbSize; total > quota {
+	if total := spaceUsed + file.storeSize(); total > quota {
 		log.Errorf("User quota exceeded: %d > %d", total, quota)
-		os.Remove(file.StoreFile)
-		os.Remove(file.StoreThumb)
 		return ErrQuotaExceeded
 	}
 
-	fn, err := finalFilename(file.StoreFile)
-	if err != nil {
-		log.Errorf("makeFilePath() failed: %v", err)
+	// The blobs that don't have a duplicate are committed before the lock
+	// is acquired, since that can take a while with a BlobStore.
+	for _, b := range blobs {
+		if b.dup, err = d.lookupBlobHash(b.key); err != nil {
+			log.Errorf("lookupBlobHash: %v", err)
+		}
+		if b.dup != "" {
+			continue
+		}
+		if err := d.commitAddedBlob(b); err != nil {
+			return err
+		}
+	}
+
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+	// The quota is checked again while the quota lock is held, so that
+	// concurrent uploads can't exceed it together. The space used is
+	// computed from the file sets, so it changes when the file is added, in
+	// the same commit.
+	quotaLock := d.filePath(owner.home(quotaLockFile))
+	if err := d.storage.Lock(quotaLock); err != nil {
 		return err
 	}
-	tn, err := finalFilename(file.StoreThumb)
-	if err != nil {
-		log.Errorf("makeFilePath() failed: %v", err)
+	defer d.storage.Unlock(quotaLock)
+	if spaceUsed, err = d.SpaceUsed(owner); err != nil {
 		return err
 	}
+	if total := spaceUsed + file.storeSize(); total > quota {
+		log.Errorf("User quota exceeded: %d > %d", total, quota)
+		return ErrQuotaExceeded
+	}
+	file.DateModified = nowInMS()
 
-	if err := createParentIfNotExist(filepath.Join(filepath.Join(d.Dir(), fn))); err != nil {
-		return err
+	for {
+		gone, err := d.addFileLocked(user, file, name, set, albumID, blobs)
+		if err != nil {
+			return err
+		}
+		if gone == nil {
+			break
+		}
+		// The duplicates were deleted after the lookup.
+		for _, b := range gone {
+			b.dup = ""
+			if err := d.commitAddedBlob(b); err != nil {
+				return err
+			}
+		}
 	}
-	if err := os.Rename(file.StoreFile, filepath.Join(d.Dir(), fn)); err != nil {
-		return err
+	newHashes := make(map[string]string)
+	for _, b := range blobs {
+		if b.dup != "" {
+			os.Remove(b.temp)
+			dedupBytes.Add(float64(b.size))
+			continue
+		}
+		if b.key != "" {
+			newHashes[b.key] = b.final
+		}
+	}
+	if err := d.addBlobHashes(newHashes); err != nil {
+		log.Errorf("addBlobHashes: %v", err)
+	}
+	d.checkThresholds(owner, "space", spaceUsed, spaceUsed+file.storeSize(), quota)
+	return nil
+}
+
+// addedBlob is the content, the thumbnail, or the medium-resolution variant of
+// a file that is being added.
+type addedBlob struct {
+	// The temporary file, and its hash key.
+	temp string
+	key  string
+	size int64
+	// An existing blob with the same hash key. It is used instead of the
+	// temporary file.
+	dup string
+	// The final blob name, once it is committed.
+	final string
+}
+
+// name returns the name of the blob that the file uses.
+func (b *addedBlob) name() string {
+	if b.dup != "" {
+		return b.dup
 	}
-	file.StoreFile = fn
-	if err := createParentIfNotExist(filepath.Join(filepath.Join(d.Dir(), tn))); err != nil {
+	return b.final
+}
+
+// commitAddedBlob moves the temporary file of b to its final name, and creates
+// its reference file with a count of zero. The count is increased when the file
+// is added. If that never happens, the blob is deleted by abortAddedBlobs, or
+// by the garbage collector after a crash.
+func (d *Database) commitAddedBlob(b *addedBlob) error {
+	fn, err := d.finalFilename(b.temp)
+	if err != nil {
+		log.Errorf("makeFilePath() failed: %v", err)
 		return err
 	}
-	if err := os.Rename(file.StoreThumb, filepath.Join(d.Dir(), tn)); err != nil {
+	if err := d.commitBlob(b.temp, fn); err != nil {
 		return err
 	}
-	file.StoreThumb = tn
-	file.DateModified = nowInMS()
+	b.final = fn
+	return d.storage.CreateEmptyFile(d.blobRef(fn), BlobSpec{})
+}
 
-	if err := d.addFileToFileSet(user, file, name, set, albumID); err != nil {
-		for _, f := range []string{fn, tn, d.blobRef(fn), d.blobRef(tn)} {
-			if err := os.Remove(filepath.Join(d.Dir(), f)); err != nil {
-				log.Errorf("os.Remove(%q) failed: %v", f, err)
+// abortAddedBlobs undoes the work of AddFile when the file can't be added.
+// The blobs that were committed are deleted, and the temporary files are
+// removed.
+func (d *Database) abortAddedBlobs(blobs []*addedBlob) {
+	for _, b := range blobs {
+		switch {
+		case b.final != "":
+			if err := d.storage.DeleteBlob(b.final); err != nil {
+				log.Errorf("DeleteBlob(%q) failed: %v", b.final, err)
+			}
+			if err := os.Remove(filepath.Join(d.Dir(), d.blobRef(b.final))); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Errorf("os.Remove(%q) failed: %v", d.blobRef(b.final), err)
 			}
+		default:
+			os.Remove(b.temp)
 		}
+	}
+}
+
+// commitBlob moves a temporary blob file, from TempFile, to its final name.
+func (d *Database) commitBlob(temp, final string) error {
+	rel, err := filepath.Rel(d.Dir(), temp)
+	if err != nil {
 		return err
 	}
-	return nil
+	return d.storage.CommitBlob(rel, final)
 }
 
 func (d *Database) stat(f string) (mtime, size int64) {
@@ -277,6 +519,9 @@ func (d *Database) stat(f string) (mtime, size int64) {
 func (d *Database) FileSet(user User, set, albumID string) (*FileSet, error) {
 	defer recordLatency("FileSet")()
 
+	if !validSet(set) {
+		return nil, ErrInvalidID
+	}
 	var fileName string
 	if set == stingle.AlbumSet {
 		albumRef, err := d.albumRef(user, albumID)
@@ -306,7 +551,10 @@ func (d *Database) FileSet(user User, set, albumID string) (*FileSet, error) {
 	log.Debugf("FileSet cache miss %s %d %d", fileName, ts, sz)
 
 	var fileSet FileSet
-	if err := d.storage.ReadDataFile(fileName, &fileSet); err != nil {
+	done := timing.FromContext(user.Context()).Start("db-read")
+	err := d.storage.ReadDataFile(fileName, &fileSet)
+	done()
+	if err != nil {
 		return nil, err
 	}
 	if fileSet.Files == nil {
@@ -334,6 +582,9 @@ func (d *Database) fileSetForUpdate(user User, set, albumID string) (func(bool,
 func (d *Database) fileSetsForUpdate(user User, sets, albumIDs []string) (func(bool, *error) error, []*FileSet, error) {
 	var filenames []string
 	for i := range sets {
+		if !validSet(sets[i]) {
+			return nil, nil, ErrInvalidID
+		}
 		if sets[i] == stingle.AlbumSet {
 			albumRef, err := d.albumRef(user, albumIDs[i])
 			if err != nil {
@@ -349,7 +600,12 @@ func (d *Database) fileSetsForUpdate(user User, sets, albumIDs []string) (func(b
 	for i := range fileSets {
 		fileSets[i] = &FileSet{}
 	}
+	// The time to acquire the locks, and to read the files, is recorded as
+	// the lock wait.
+	timers := timing.FromContext(user.Context())
+	done := timers.Start("db-lock")
 	commit, err := d.storage.OpenManyForUpdate(filenames, fileSets)
+	done()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -361,7 +617,10 @@ func (d *Database) fileSetsForUpdate(user User, sets, albumIDs []string) (func(b
 			fs.Deletes = []DeleteEvent{}
 		}
 	}
-	return commit, fileSets, nil
+	return func(c bool, errp *error) error {
+		defer timers.Start("db-commit")()
+		return commit(c, errp)
+	}, fileSets, nil
 }
 
 // MoveFileParams specifies what a move operation does.
@@ -386,11 +645,30 @@ type MoveFileParams struct {
 // MoveFile moves or copies files between file sets.
 func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 	defer recordLatency("MoveFile")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+
+	if err := checkFileSet(p.SetFrom, p.AlbumIDFrom); err != nil {
+		return err
+	}
+	if err := checkFileSet(p.SetTo, p.AlbumIDTo); err != nil {
+		return err
+	}
+	for _, h := range p.Headers {
+		if !validHeaders(h) {
+			return ErrInvalidID
+		}
+	}
+	// The owners and members of the albums see the change too.
+	unlock, err := d.lockFileSets(d.albumUsers(user, p.AlbumIDFrom, p.AlbumIDTo)...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	var (
 		commit   func(bool, *error) error
 		fileSets []*FileSet
-		err      error
 	)
 	if p.SetTo == p.SetFrom && p.AlbumIDTo == p.AlbumIDFrom {
 		p.IsMoving = false
@@ -407,6 +685,10 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 	defer commit(true, &retErr)
 	fsTo, fsFrom := fileSets[0], fileSets[1]
 
+	policy, err := d.SharedAlbumPolicy()
+	if err != nil {
+		return err
+	}
 	ownerTo, ownerFrom := user.UserID, user.UserID
 	if fsTo.Album != nil {
 		ownerTo = fsTo.Album.OwnerID
@@ -414,8 +696,19 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 	if fsFrom.Album != nil {
 		ownerFrom = fsFrom.Album.OwnerID
 	}
-	if ownerTo != ownerFrom {
-		owner, err := d.UserByID(ownerTo)
+	// The user who will be charged for the files in the destination set.
+	payerTo := ownerTo
+	if policy == SharedAlbumPolicyContributor {
+		payerTo = user.UserID
+	}
+	var newCharges bool
+	for _, fn := range p.Filenames {
+		if f := fsFrom.Files[fn]; f != nil && payer(policy, ownerFrom, f) != payerTo {
+			newCharges = true
+		}
+	}
+	if newCharges {
+		owner, err := d.UserByID(payerTo)
 		if err != nil {
 			return err
 		}
@@ -427,15 +720,21 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 		if err != nil {
 			return err
 		}
+		before := spaceUsed
 		for _, fn := range p.Filenames {
-			if f := fsFrom.Files[fn]; f != nil {
-				spaceUsed += f.StoreFileSize + f.StoreThumbSize
+			if f := fsFrom.Files[fn]; f != nil && payer(policy, ownerFrom, f) != payerTo {
+				spaceUsed += f.storeSize()
 			}
 		}
 		if spaceUsed > quota {
 			log.Errorf("User quota exceeded: %d > %d", spaceUsed, quota)
 			return ErrQuotaExceeded
 		}
+		defer func() {
+			if retErr == nil {
+				d.checkThresholds(owner, "space", before, spaceUsed, quota)
+			}
+		}()
 	}
 
 	for i := range p.Filenames {
@@ -445,6 +744,10 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 			continue
 		}
 		toFile := *fromFile
+		toFile.AddedBy = user.UserID
+		if f := fsTo.Files[fn]; f != nil {
+			toFile.AddedBy = f.AddedBy
+		}
 		if len(p.Headers) == len(p.Filenames) {
 			toFile.Headers = p.Headers[i]
 		}
@@ -462,6 +765,7 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 
 		if p.IsMoving {
 			delete(fsFrom.Files, fn)
+			delete(fsFrom.Reactions, fn)
 			de := DeleteEvent{
 				File:    fn,
 				AlbumID: p.AlbumIDFrom,
@@ -477,8 +781,9 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 			fsFrom.Deletes = append(fsFrom.Deletes, de)
 		}
 		if refCountAdj != 0 {
-			d.incRefCount(toFile.StoreFile, refCountAdj)
-			d.incRefCount(toFile.StoreThumb, refCountAdj)
+			for _, blob := range toFile.blobs() {
+				d.incRefCount(blob, refCountAdj)
+			}
 		}
 	}
 	pruneDeleteEvents(&fsFrom.Deletes, &fsFrom.DeleteHorizon)
@@ -491,21 +796,28 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 }
 
 // EmptyTrash deletes the files in the Trash set that were added up to time t.
+// Their content is released after the purge delay, see PurgeDelay.
 func (d *Database) EmptyTrash(user User, t int64) (retErr error) {
 	defer recordLatency("EmptyTrash")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
 
-	commit, fs, err := d.fileSetForUpdate(user, stingle.TrashSet, "")
+	if user.Hold {
+		return ErrOnHold
+	}
+	if user.Limited != nil {
+		return ErrLimitedAccount
+	}
+	commit, fs, queue, err := d.trashForUpdate(user)
 	if err != nil {
-		log.Errorf("fileSetForUpdate(%q, %q, %q) failed: %v", user.Email, stingle.TrashSet, "", err)
+		log.Errorf("trashForUpdate(%q) failed: %v", user.Email, err)
 		return err
 	}
 	defer commit(true, &retErr)
+	now := nowInMS()
 	for k, v := range fs.Files {
 		if v.DateModified <= t {
-			if file, ok := fs.Files[k]; ok {
-				d.incRefCount(file.StoreFile, -1)
-				d.incRefCount(file.StoreThumb, -1)
-			}
+			d.releaseFile(queue, k, v, now)
 			delete(fs.Files, k)
 			de := DeleteEvent{
 				File: k,
@@ -519,26 +831,35 @@ func (d *Database) EmptyTrash(user User, t int64) (retErr error) {
 	return nil
 }
 
-// DeleteFiles deletes specific files from the Trash set.
+// DeleteFiles deletes specific files from the Trash set. Their content is
+// released after the purge delay, see PurgeDelay.
 func (d *Database) DeleteFiles(user User, files []string) (retErr error) {
 	defer recordLatency("DeleteFiles")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
 
-	commit, fs, err := d.fileSetForUpdate(user, stingle.TrashSet, "")
+	if user.Hold {
+		return ErrOnHold
+	}
+	if user.Limited != nil {
+		return ErrLimitedAccount
+	}
+	commit, fs, queue, err := d.trashForUpdate(user)
 	if err != nil {
-		log.Errorf("fileSetForUpdate(%q, %q, %q) failed: %v", user.Email, stingle.TrashSet, "", err)
+		log.Errorf("trashForUpdate(%q) failed: %v", user.Email, err)
 		return err
 	}
 	defer commit(true, &retErr)
+	now := nowInMS()
 	for _, f := range files {
 		if file, ok := fs.Files[f]; ok {
-			d.incRefCount(file.StoreFile, -1)
-			d.incRefCount(file.StoreThumb, -1)
+			d.releaseFile(queue, f, file, now)
 		}
 		delete(fs.Files, f)
 		de := DeleteEvent{
 			File: f,
 			Type: stingle.DeleteEventTrashDelete,
-			Date: nowInMS(),
+			Date: now,
 		}
 		fs.Deletes = append(fs.Deletes, de)
 	}
@@ -558,24 +879,143 @@ func (d *Database) findFileInSet(user User, set, albumID, filename string) (*Fil
 	return nil, os.ErrNotExist
 }
 
-// downloadFileSpec opens a file for reading.
-func (d *Database) downloadFileSpec(fileSpec *FileSpec, thumb bool) (io.ReadSeekCloser, error) {
+// FileReader is the content or thumbnail of a file, open for reading.
+type FileReader struct {
+	io.ReadSeekCloser
+	// ETag is an opaque identifier of the content. Blobs are never
+	// modified after they are created, so the ETag of a given file never
+	// changes.
+	ETag string
+}
+
+// nopCloser adds a no-op Close method to an io.ReadSeeker.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// blobETag returns the entity tag of a blob. It is derived from the blob's
+// name with the master key so that it doesn't reveal where the blob is stored.
+func (d *Database) blobETag(blob string) string {
+	return fmt.Sprintf("%q", hex.EncodeToString(d.Hash([]byte(blob)))[:32])
+}
+
+// openThumb opens a thumbnail for reading. Small thumbnails are kept in memory
+// so that scrolling through a gallery doesn't have to read them from disk
+// every time.
+func (d *Database) openThumb(blob string) (io.ReadSeekCloser, error) {
+	d.thumbCacheMutex.Lock()
+	v, ok := d.thumbCache.Get(blob)
+	d.thumbCacheMutex.Unlock()
+	if ok {
+		thumbCacheRequests.WithLabelValues("hit").Inc()
+		return nopCloser{bytes.NewReader(v.([]byte))}, nil
+	}
+	thumbCacheRequests.WithLabelValues("miss").Inc()
+	r, err := d.storage.OpenBlobRead(blob)
+	if err != nil {
+		return nil, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil || size > maxCachedThumbSize {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	defer r.Close()
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d.thumbCacheMutex.Lock()
+	defer d.thumbCacheMutex.Unlock()
+	if !d.thumbCache.Contains(blob) {
+		d.thumbCache.Add(blob, b)
+		d.thumbCacheBytes += len(b)
+		for d.thumbCacheBytes > maxThumbCacheBytes {
+			d.thumbCache.RemoveOldest()
+		}
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+// Variant is one of the versions of a file that the clients upload.
+type Variant string
+
+const (
+	// VariantOriginal is the file's content.
+	VariantOriginal Variant = "original"
+	// VariantThumb is the file's thumbnail.
+	VariantThumb Variant = "thumb"
+	// VariantMedium is a medium-resolution version of the file, e.g. an
+	// image that fits a screen. It is optional.
+	VariantMedium Variant = "medium"
+)
+
+// ParseVariant returns the Variant with the given name.
+func ParseVariant(name string) (Variant, error) {
+	switch v := Variant(name); v {
+	case VariantOriginal, VariantThumb, VariantMedium:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid variant %q", name)
+}
+
+// downloadFileSpec opens a file for reading. It returns os.ErrNotExist if the
+// file doesn't have the variant.
+func (d *Database) downloadFileSpec(fileSpec *FileSpec, variant Variant) (*FileReader, error) {
+	blob := fileSpec.StoreFile
+	open := d.openBlob
+	switch variant {
+	case VariantThumb:
+		blob = fileSpec.StoreThumb
+		open = d.openThumb
+	case VariantMedium:
+		if fileSpec.StoreMedium == "" {
+			return nil, os.ErrNotExist
+		}
+		blob = fileSpec.StoreMedium
+	}
+	r, err := open(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &FileReader{ReadSeekCloser: r, ETag: d.blobETag(blob)}, nil
+}
+
+// DownloadFile locates a file and opens its content, or its thumbnail, for
+// reading.
+func (d *Database) DownloadFile(user User, set, filename string, thumb bool) (*FileReader, error) {
+	variant := VariantOriginal
 	if thumb {
-		return d.storage.OpenBlobRead(fileSpec.StoreThumb)
+		variant = VariantThumb
 	}
-	return d.storage.OpenBlobRead(fileSpec.StoreFile)
+	return d.DownloadFileVariant(user, set, filename, variant)
 }
 
-// DownloadFile locates a file and opens it for reading.
-func (d *Database) DownloadFile(user User, set, filename string, thumb bool) (io.ReadSeekCloser, error) {
+// DownloadFileVariant locates a file and opens one of its variants for
+// reading.
+func (d *Database) DownloadFileVariant(user User, set, filename string, variant Variant) (*FileReader, error) {
 	defer recordLatency("DownloadFile")()
 
+	if !validSet(set) {
+		return nil, ErrInvalidID
+	}
 	if set != stingle.AlbumSet {
 		fileSpec, err := d.findFileInSet(user, set, "", filename)
 		if err != nil {
 			return nil, err
 		}
-		return d.downloadFileSpec(fileSpec, thumb)
+		d.prefetchNext(user, set, "", filename, variant)
+		return d.downloadFileSpec(fileSpec, variant)
 	}
 
 	albumRefs, err := d.AlbumRefs(user)
@@ -597,10 +1037,11 @@ func (d *Database) DownloadFile(user User, set, filename string, thumb bool) (io
 			continue
 		}
 		if err != nil {
-			log.Errorf("findFileInSet(%q, %q, %q, %q, %v) failed: %v", user.Email, stingle.AlbumSet, album.AlbumID, filename, thumb, err)
+			log.Errorf("findFileInSet(%q, %q, %q, %q, %v) failed: %v", user.Email, stingle.AlbumSet, album.AlbumID, filename, variant, err)
 			return nil, err
 		}
-		return d.downloadFileSpec(fileSpec, thumb)
+		d.prefetchNext(user, stingle.AlbumSet, album.AlbumID, filename, variant)
+		return d.downloadFileSpec(fileSpec, variant)
 	}
 	return nil, os.ErrNotExist
 }
@@ -28,6 +28,8 @@ import (
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/stingle"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func addFile(db *database.Database, user database.User, name, set, albumID string) error {
@@ -43,7 +45,7 @@ func addFile(db *database.Database, user database.User, name, set, albumID strin
 	if err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte("file content")); err != nil {
+	if _, err := w.Write([]byte("file content " + name)); err != nil {
 		return err
 	}
 	if err := w.Close(); err != nil {
@@ -55,7 +57,7 @@ func addFile(db *database.Database, user database.User, name, set, albumID strin
 	if err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte("thumb content")); err != nil {
+	if _, err := w.Write([]byte("thumb content " + name)); err != nil {
 		return err
 	}
 	if err := w.Close(); err != nil {
@@ -110,7 +112,7 @@ func TestFiles(t *testing.T) {
 		t.Fatalf("io.ReadAll(f) failed: %v", err)
 	}
 	f.Close()
-	if want, got := "file content", string(slurp); want != got {
+	if want, got := "file content file1", string(slurp); want != got {
 		t.Errorf("Unexpected file content: want %q, got %q", want, got)
 	}
 
@@ -177,3 +179,380 @@ func TestFiles(t *testing.T) {
 		t.Errorf("Unexpected number of files in Trash: Want %d, got %d", want, got)
 	}
 }
+
+func TestSharedAlbumPolicy(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	database.CurrentTimeForTesting = 10000
+
+	var users []database.User
+	for _, email := range []string{"alice", "bob"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q) failed: %v", email, err)
+		}
+		users = append(users, u)
+	}
+	alice, bob := users[0], users[1]
+
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum failed: %v", err)
+	}
+	if err := db.ShareAlbum(alice, &stingle.Album{
+		AlbumID:     "album",
+		IsShared:    "1",
+		Permissions: "1111",
+		Members:     membersString(alice.UserID, bob.UserID),
+	}, map[string]string{fmt.Sprintf("%d", bob.UserID): "key"}); err != nil {
+		t.Fatalf("ShareAlbum failed: %v", err)
+	}
+	if err := addFile(db, bob, "file1", stingle.AlbumSet, "album"); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+
+	checkSpace := func(user database.User, wantTotal, wantShared int64) {
+		t.Helper()
+		total, shared, err := db.SpaceUsedDetails(user)
+		if err != nil {
+			t.Fatalf("SpaceUsedDetails(%q) failed: %v", user.Email, err)
+		}
+		if total != wantTotal || shared != wantShared {
+			t.Errorf("SpaceUsedDetails(%q) = %d, %d, want %d, %d", user.Email, total, shared, wantTotal, wantShared)
+		}
+	}
+	checkRemaining := func(user database.User, set, albumID string, owner database.User, used int64) {
+		t.Helper()
+		quota, err := db.Quota(owner.UserID)
+		if err != nil {
+			t.Fatalf("Quota(%q) failed: %v", owner.Email, err)
+		}
+		got, err := db.RemainingQuota(user, set, albumID)
+		if err != nil {
+			t.Fatalf("RemainingQuota(%q, %q, %q) failed: %v", user.Email, set, albumID, err)
+		}
+		if want := quota - used; got != want {
+			t.Errorf("RemainingQuota(%q, %q, %q) = %d, want %d", user.Email, set, albumID, got, want)
+		}
+	}
+	// The default policy charges the owner of the album.
+	checkSpace(alice, 1100, 1100)
+	checkSpace(bob, 0, 0)
+	checkRemaining(bob, stingle.AlbumSet, "album", alice, 1100)
+	checkRemaining(bob, stingle.GallerySet, "", bob, 0)
+
+	data, err := db.AdminData(nil)
+	if err != nil {
+		t.Fatalf("AdminData failed: %v", err)
+	}
+	if got := *data.SharedAlbumPolicy; got != database.SharedAlbumPolicyOwner {
+		t.Errorf("SharedAlbumPolicy = %q, want %q", got, database.SharedAlbumPolicyOwner)
+	}
+	if _, err := db.AdminData(&database.AdminData{Tag: data.Tag, SharedAlbumPolicy: ptr(database.SharedAlbumPolicyContributor)}); err != nil {
+		t.Fatalf("AdminData failed: %v", err)
+	}
+	checkSpace(alice, 0, 0)
+	checkSpace(bob, 1100, 1100)
+	checkRemaining(bob, stingle.AlbumSet, "album", bob, 1100)
+
+	// Bob copies the file to his gallery. It is only counted once.
+	if err := db.MoveFile(bob, database.MoveFileParams{
+		SetFrom:     stingle.AlbumSet,
+		SetTo:       stingle.GallerySet,
+		AlbumIDFrom: "album",
+		Filenames:   []string{"file1"},
+	}); err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+	checkSpace(bob, 1100, 1100)
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	before := latencyCounts(t)
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+	if _, err := db.StorageUsage(user); err != nil {
+		t.Fatalf("StorageUsage failed: %v", err)
+	}
+	after := latencyCounts(t)
+	for _, op := range []string{"AddFile", "StorageUsage"} {
+		if after[op] <= before[op] {
+			t.Errorf("latency count for %q = %d, want > %d", op, after[op], before[op])
+		}
+	}
+}
+
+// latencyCounts returns the number of observations in the database latency
+// histograms, by operation.
+func latencyCounts(t *testing.T) map[string]uint64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	counts := make(map[string]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != "database_response_time" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "func" {
+					counts[l.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+
+	// MoveFile waits until the snapshot is released.
+	release := db.Snapshot(user)
+	done := make(chan error)
+	go func() {
+		done <- db.MoveFile(user, database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.TrashSet,
+			IsMoving:  true,
+			Filenames: []string{"file1"},
+		})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("MoveFile returned during snapshot: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := numFilesInSet(t, db, user, stingle.GallerySet, ""); n != 1 {
+		t.Errorf("Gallery has %d files, want 1", n)
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+	if n := numFilesInSet(t, db, user, stingle.TrashSet, ""); n != 1 {
+		t.Errorf("Trash has %d files, want 1", n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, []byte("passphrase"))
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile(file1) failed: %v", err)
+	}
+
+	ro := database.NewWithOptions(dir, []byte("passphrase"), database.Options{ReadOnly: true})
+	if !ro.ReadOnly() {
+		t.Error("ro.ReadOnly() = false")
+	}
+	if n := numFilesInSet(t, ro, user, stingle.GallerySet, ""); n != 1 {
+		t.Errorf("Unexpected number of files: got %d, want 1", n)
+	}
+	f, err := ro.DownloadFile(user, stingle.GallerySet, "file1", false)
+	if err != nil {
+		t.Fatalf("ro.DownloadFile(file1) failed: %v", err)
+	}
+	f.Close()
+
+	if err := addUser(ro, "bob@", key.PublicKey()); !errors.Is(err, database.ErrReadOnly) {
+		t.Errorf("addUser(bob@) = %v, want %v", err, database.ErrReadOnly)
+	}
+	if err := addFile(ro, user, "file2", stingle.GallerySet, ""); !errors.Is(err, database.ErrReadOnly) {
+		t.Errorf("addFile(file2) = %v, want %v", err, database.ErrReadOnly)
+	}
+	if err := ro.MoveFile(user, database.MoveFileParams{
+		SetFrom:   stingle.GallerySet,
+		SetTo:     stingle.TrashSet,
+		Filenames: []string{"file1"},
+	}); !errors.Is(err, database.ErrReadOnly) {
+		t.Errorf("ro.MoveFile(file1) = %v, want %v", err, database.ErrReadOnly)
+	}
+	if n := numFilesInSet(t, db, user, stingle.GallerySet, ""); n != 1 {
+		t.Errorf("Unexpected number of files: got %d, want 1", n)
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	for _, id := range []string{"", "..", "../album", "a/b"} {
+		if err := addAlbum(db, user, id); err != database.ErrInvalidID {
+			t.Errorf("addAlbum(%q) returned unexpected error: want %v, got %v", id, database.ErrInvalidID, err)
+		}
+		if err := addFile(db, user, id, stingle.GallerySet, ""); err != database.ErrInvalidID {
+			t.Errorf("addFile(%q) returned unexpected error: want %v, got %v", id, database.ErrInvalidID, err)
+		}
+	}
+	for _, set := range []string{"", "3", "../0", "0/../../x"} {
+		if err := addFile(db, user, "file1", set, ""); err != database.ErrInvalidID {
+			t.Errorf("addFile(file1, %q) returned unexpected error: want %v, got %v", set, database.ErrInvalidID, err)
+		}
+		if _, err := db.FileSet(user, set, ""); err != database.ErrInvalidID {
+			t.Errorf("db.FileSet(%q) returned unexpected error: want %v, got %v", set, database.ErrInvalidID, err)
+		}
+		if _, err := db.DownloadFile(user, set, "file1", false); err != database.ErrInvalidID {
+			t.Errorf("db.DownloadFile(%q) returned unexpected error: want %v, got %v", set, database.ErrInvalidID, err)
+		}
+	}
+	p := database.MoveFileParams{
+		SetFrom:   stingle.GallerySet,
+		SetTo:     "../1",
+		Filenames: []string{"file1"},
+	}
+	if err := db.MoveFile(user, p); err != database.ErrInvalidID {
+		t.Errorf("db.MoveFile(%+v) returned unexpected error: want %v, got %v", p, database.ErrInvalidID, err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Errorf("addFile(file1) failed: %v", err)
+	}
+}
+
+// checkBlocked checks that done doesn't receive anything until release is
+// called.
+func checkBlocked(t *testing.T, done <-chan error, release func()) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("MoveFile returned during snapshot: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+}
+
+func TestSnapshotSharedAlbum(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob := users["alice@"], users["bob@"]
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	album := stingle.Album{
+		AlbumID:     "album",
+		IsShared:    "1",
+		Permissions: "1111",
+		Members:     membersString(alice.UserID, bob.UserID),
+	}
+	if err := db.ShareAlbum(alice, &album, map[string]string{fmt.Sprintf("%d", bob.UserID): "key"}); err != nil {
+		t.Fatalf("db.ShareAlbum: %v", err)
+	}
+	if err := addFile(db, bob, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+
+	// Bob's move into the shared album waits for Alice's snapshot.
+	release := db.Snapshot(alice)
+	done := make(chan error)
+	go func() {
+		done <- db.MoveFile(bob, database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.AlbumSet,
+			AlbumIDTo: "album",
+			IsMoving:  true,
+			Filenames: []string{"file1"},
+		})
+	}()
+	checkBlocked(t, done, release)
+	if n := numFilesInSet(t, db, alice, stingle.AlbumSet, "album"); n != 1 {
+		t.Errorf("Album has %d files, want 1", n)
+	}
+}
+
+func TestSnapshotClustered(t *testing.T) {
+	dir := t.TempDir()
+	pp := []byte("passphrase")
+	l := &memLocker{held: make(map[string]chan struct{})}
+	db1 := database.NewWithOptions(dir, pp, database.Options{Locker: l})
+	db2 := database.NewWithOptions(dir, pp, database.Options{Locker: l})
+
+	if err := addUser(db1, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db1.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addFile(db1, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+
+	// A move on one instance waits for a snapshot on the other one.
+	release := db2.Snapshot(user)
+	done := make(chan error)
+	go func() {
+		done <- db1.MoveFile(user, database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.TrashSet,
+			IsMoving:  true,
+			Filenames: []string{"file1"},
+		})
+	}()
+	checkBlocked(t, done, release)
+	if n := numFilesInSet(t, db2, user, stingle.TrashSet, ""); n != 1 {
+		t.Errorf("Trash has %d files, want 1", n)
+	}
+}
@@ -0,0 +1,336 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// GCStats contains the results of CollectGarbage.
+type GCStats struct {
+	// The number of file sets and purge queues that were scanned.
+	FileSets int `json:"fileSets"`
+	// The number of blobs that are referenced by at least one file.
+	Blobs int `json:"blobs"`
+	// The number of reference counts that were corrected.
+	RefCountsFixed int `json:"refCountsFixed"`
+	// The number of unreferenced blobs that were deleted.
+	OrphansDeleted int `json:"orphansDeleted"`
+	// The number of referenced blobs whose content is missing. These can't
+	// be fixed automatically.
+	Missing int `json:"missing"`
+	// The size of the blobs that were deleted. It is always 0 when the blobs
+	// are in a BlobStore.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	// The number of deleted blobs that were removed from the hash index.
+	HashesPruned int `json:"hashesPruned"`
+}
+
+// CollectGarbage recomputes the reference counts of all the blobs from the
+// file sets and the purge queues, fixes the ones that drifted, e.g. after a
+// crash, and deletes the blobs that aren't referenced anymore.
+//
+// The data directory is scanned first without blocking other updates. The
+// blobs that look inconsistent are then checked again, and fixed, while the
+// updates that change references are blocked. Blob files that aren't
+// referenced are deleted only if they are older than minAge, so that uploads
+// that are in progress are left alone. Unreferenced blobs can only be found
+// when they are stored locally, not in a BlobStore.
+func (d *Database) CollectGarbage(minAge time.Duration) (GCStats, error) {
+	defer recordLatency("CollectGarbage")()
+	if d.readOnly {
+		return GCStats{}, ErrReadOnly
+	}
+	return d.collectGarbage(minAge, nil)
+}
+
+// CollectGarbageDryRun reports what CollectGarbage would fix and delete,
+// without changing anything.
+func (d *Database) CollectGarbageDryRun(minAge time.Duration) (*RemovalReport, error) {
+	defer recordLatency("CollectGarbageDryRun")()
+
+	report := &RemovalReport{DryRun: true}
+	stats, err := d.collectGarbage(minAge, report)
+	if err != nil {
+		return nil, err
+	}
+	report.Blobs = stats.OrphansDeleted
+	report.Bytes = stats.ReclaimedBytes
+	report.RefCountsFixed = stats.RefCountsFixed
+	return report, nil
+}
+
+// collectGarbage implements CollectGarbage. When dryRun isn't nil, nothing is
+// changed, and the blobs that would be deleted are added to dryRun instead.
+func (d *Database) collectGarbage(minAge time.Duration, dryRun *RemovalReport) (stats GCStats, retErr error) {
+	refs, n, err := d.countBlobRefs()
+	if err != nil {
+		return stats, err
+	}
+	stats.FileSets = n
+	stats.Blobs = len(refs)
+	if dryRun == nil {
+		if stats.HashesPruned, err = d.pruneBlobHashes(); err != nil {
+			return stats, err
+		}
+	}
+
+	suspects := make(map[string]bool)
+	for blob, count := range refs {
+		var spec BlobSpec
+		if err := d.storage.ReadDataFile(d.blobRef(blob), &spec); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stats, err
+		}
+		if spec.RefCount != count {
+			suspects[blob] = true
+		}
+		if d.remoteBlobs {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.Dir(), blob)); errors.Is(err, os.ErrNotExist) {
+			stats.Missing++
+			if dryRun != nil {
+				continue
+			}
+			log.Errorf("CollectGarbage: blob %q is referenced %d time(s), but it doesn't exist", blob, count)
+			gcInconsistencies.WithLabelValues("missing").Inc()
+		}
+	}
+	if !d.remoteBlobs {
+		orphans, err := d.findOrphanBlobs(refs, minAge)
+		if err != nil {
+			return stats, err
+		}
+		for _, blob := range orphans {
+			suspects[blob] = true
+		}
+	}
+	if len(suspects) == 0 {
+		return stats, nil
+	}
+
+	// The references are counted again while nothing can change them. The
+	// suspects that are still inconsistent are fixed.
+	d.refMutex.Lock()
+	defer d.refMutex.Unlock()
+	if refs, _, err = d.countBlobRefs(); err != nil {
+		return stats, err
+	}
+	blobs := make([]string, 0, len(suspects))
+	for blob := range suspects {
+		blobs = append(blobs, blob)
+	}
+	sort.Strings(blobs)
+	for _, blob := range blobs {
+		count := refs[blob]
+		ref := d.blobRef(blob)
+		var spec BlobSpec
+		hasRef := true
+		if err := d.storage.ReadDataFile(ref, &spec); errors.Is(err, os.ErrNotExist) {
+			hasRef = false
+		} else if err != nil {
+			return stats, err
+		}
+		if count > 0 {
+			if hasRef && spec.RefCount == count {
+				continue
+			}
+			stats.RefCountsFixed++
+			if dryRun != nil {
+				continue
+			}
+			log.Infof("CollectGarbage: RefCount(%q) %d -> %d", blob, spec.RefCount, count)
+			if err := d.storage.SaveDataFile(ref, BlobSpec{RefCount: count}); err != nil {
+				return stats, err
+			}
+			gcInconsistencies.WithLabelValues("refcount").Inc()
+			continue
+		}
+		var size int64
+		if !d.remoteBlobs {
+			fi, err := os.Stat(filepath.Join(d.Dir(), blob))
+			if errors.Is(err, os.ErrNotExist) && !hasRef {
+				continue
+			}
+			if err == nil {
+				size = fi.Size()
+			}
+		}
+		stats.OrphansDeleted++
+		stats.ReclaimedBytes += size
+		if dryRun != nil {
+			dryRun.addItem(blob)
+			continue
+		}
+		log.Infof("CollectGarbage: deleting unreferenced blob %q", blob)
+		if hasRef {
+			d.removeBlob(blob, ref)
+		} else {
+			d.removeBlob(blob, "")
+		}
+		gcInconsistencies.WithLabelValues("orphan").Inc()
+		gcReclaimedBytes.Add(float64(size))
+	}
+	return stats, nil
+}
+
+// countBlobRefs returns the number of times that each blob is referenced by
+// the file sets and the purge queues of all the users, and the number of file
+// sets and queues that were read. Albums are counted only once, even though
+// they appear in the album manifest of all their members.
+func (d *Database) countBlobRefs() (map[string]int, int, error) {
+	refs := make(map[string]int)
+	n, err := d.walkFiles(func(_ string, f *FileSpec) {
+		for _, blob := range f.blobs() {
+			refs[blob]++
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return refs, n, nil
+}
+
+// walkFiles calls visit for each file in the file sets and the purge queues
+// of all the users, with the file's set, or "" for the purge queues. It
+// returns the number of file sets and queues that were read. Albums are
+// visited only once, even though they appear in the album manifest of all
+// their members.
+func (d *Database) walkFiles(visit func(set string, f *FileSpec)) (int, error) {
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		return 0, err
+	}
+	// read reads a data file. Files that don't exist anymore, e.g. because
+	// the user or the album was deleted, are skipped.
+	read := func(file string, obj interface{}) (bool, error) {
+		if err := d.storage.ReadDataFile(file, obj); errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	var n int
+	albums := make(map[string]bool)
+	for _, u := range ul {
+		type fileSetFile struct {
+			set  string
+			file string
+		}
+		files := []fileSetFile{
+			{stingle.GallerySet, d.filePath(homeByUserID(u.UserID, fmt.Sprintf(fileSetPattern, stingle.GallerySet)))},
+			{stingle.TrashSet, d.filePath(homeByUserID(u.UserID, fmt.Sprintf(fileSetPattern, stingle.TrashSet)))},
+		}
+		var manifest AlbumManifest
+		if _, err := read(d.filePath(homeByUserID(u.UserID, albumManifest)), &manifest); err != nil {
+			return 0, err
+		}
+		for _, ar := range manifest.Albums {
+			if albums[ar.File] {
+				continue
+			}
+			albums[ar.File] = true
+			files = append(files, fileSetFile{stingle.AlbumSet, ar.File})
+		}
+		for _, f := range files {
+			var fs FileSet
+			ok, err := read(f.file, &fs)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				continue
+			}
+			n++
+			for _, file := range fs.Files {
+				visit(f.set, file)
+			}
+		}
+		var queue purgeQueue
+		ok, err := read(d.filePath(homeByUserID(u.UserID, purgeQueueFile)), &queue)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			n++
+		}
+		for i := range queue.Files {
+			visit("", &queue.Files[i].File)
+		}
+	}
+	return n, nil
+}
+
+// findOrphanBlobs returns the local blob files that aren't in refs, and that
+// were last modified more than minAge ago.
+func (d *Database) findOrphanBlobs(refs map[string]int, minAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(d.Dir())
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-minAge)
+	var orphans []string
+	for _, e := range entries {
+		if !e.IsDir() || !dataDirRE.MatchString(e.Name()) {
+			continue
+		}
+		err := filepath.WalkDir(filepath.Join(d.Dir(), e.Name()), func(path string, de fs.DirEntry, err error) error {
+			if err != nil || de.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(d.Dir(), path)
+			if err != nil {
+				return err
+			}
+			if refs[rel] > 0 {
+				return nil
+			}
+			fi, err := de.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if fi.ModTime().After(cutoff) {
+				return nil
+			}
+			// With a master key, the metadata files are in the same
+			// directories as the blobs.
+			if ok, err := d.storage.IsBlobFile(rel); err != nil || !ok {
+				return nil
+			}
+			orphans = append(orphans, rel)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
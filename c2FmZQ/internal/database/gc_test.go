@@ -0,0 +1,133 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	storage := secure.NewStorage(dir, nil)
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+	fs, err := db.FileSet(user, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	file1 := fs.Files["file1"]
+
+	if stats, err := db.CollectGarbage(time.Hour); err != nil || stats != (database.GCStats{FileSets: 2, Blobs: 2}) {
+		t.Fatalf("CollectGarbage() = %+v, %v", stats, err)
+	}
+
+	// The reference count of file1 drifted, and some blobs aren't
+	// referenced at all.
+	setRef := func(blob string, n int) {
+		t.Helper()
+		if err := storage.SaveDataFile(filepath.Join("metadata", blob+".ref"), database.BlobSpec{RefCount: n}); err != nil {
+			t.Fatalf("SaveDataFile: %v", err)
+		}
+	}
+	writeBlob := func(blob string, age time.Duration) {
+		t.Helper()
+		w, err := storage.OpenBlobWrite(blob, blob)
+		if err != nil {
+			t.Fatalf("OpenBlobWrite: %v", err)
+		}
+		if _, err := w.Write(make([]byte, 1000)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(dir, blob), mtime, mtime); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	setRef(file1.StoreFile, 3)
+	oldOrphan := filepath.Join("AA", "old-orphan")
+	writeBlob(oldOrphan, 2*time.Hour)
+	setRef(oldOrphan, 1)
+	newOrphan := filepath.Join("AB", "new-orphan")
+	writeBlob(newOrphan, 0)
+
+	report, err := db.CollectGarbageDryRun(time.Hour)
+	if err != nil {
+		t.Fatalf("CollectGarbageDryRun: %v", err)
+	}
+	if report.RefCountsFixed != 1 || report.Blobs != 1 || report.Bytes == 0 || !reflect.DeepEqual(report.Items, []string{oldOrphan}) {
+		t.Errorf("CollectGarbageDryRun() = %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, oldOrphan)); err != nil {
+		t.Errorf("Blob was deleted by the dry run: %v", err)
+	}
+
+	stats, err := db.CollectGarbage(time.Hour)
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if stats.ReclaimedBytes != report.Bytes {
+		t.Errorf("ReclaimedBytes = %d, want %d", stats.ReclaimedBytes, report.Bytes)
+	}
+	if stats.RefCountsFixed != 1 || stats.OrphansDeleted != 1 || stats.Missing != 0 || stats.ReclaimedBytes == 0 {
+		t.Errorf("CollectGarbage() = %+v", stats)
+	}
+	var spec database.BlobSpec
+	if err := storage.ReadDataFile(filepath.Join("metadata", file1.StoreFile+".ref"), &spec); err != nil || spec.RefCount != 1 {
+		t.Errorf("RefCount(file1) = %d, %v, want 1", spec.RefCount, err)
+	}
+	for _, f := range []string{oldOrphan, filepath.Join("metadata", oldOrphan+".ref")} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't deleted: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, newOrphan)); err != nil {
+		t.Errorf("Recent blob was deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file1.StoreFile)); err != nil {
+		t.Errorf("Content of file1 was deleted: %v", err)
+	}
+
+	// The content of file1 is gone.
+	if err := os.Remove(filepath.Join(dir, file1.StoreThumb)); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	if stats, err := db.CollectGarbage(time.Hour); err != nil || stats.Missing != 1 || stats.OrphansDeleted != 0 {
+		t.Errorf("CollectGarbage() = %+v, %v", stats, err)
+	}
+}
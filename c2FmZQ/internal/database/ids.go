@@ -0,0 +1,82 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// maxIDLength is the maximum length of album IDs and file names.
+	maxIDLength = 256
+	// maxHeadersLength is the maximum length of the file headers.
+	maxHeadersLength = 16 << 10
+)
+
+// ErrInvalidID indicates that an album ID, a file name, a set, or the file
+// headers don't have the expected format.
+var ErrInvalidID = errors.New("invalid identifier")
+
+// validID returns true if id can be used as an album ID or a file name. The
+// clients use base64 (URL encoding) for these values, with a file extension
+// for file names. IDs are used as keys in the metadata files and may end up in
+// file paths, so path separators and relative path components are rejected.
+func validID(id string) bool {
+	if len(id) == 0 || len(id) > maxIDLength || id == "." || id == ".." {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == '=', c == '+', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validSet returns true if set is one of the stingle file sets.
+func validSet(set string) bool {
+	return set == stingle.GallerySet || set == stingle.TrashSet || set == stingle.AlbumSet
+}
+
+// validHeaders returns true if the file headers have a reasonable size and
+// contain only printable ASCII characters.
+func validHeaders(h string) bool {
+	if len(h) > maxHeadersLength {
+		return false
+	}
+	for _, c := range []byte(h) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFileSet returns ErrInvalidID if set isn't valid, or if albumID isn't
+// valid when set is the album set.
+func checkFileSet(set, albumID string) error {
+	if !validSet(set) || (set == stingle.AlbumSet && !validID(albumID)) {
+		return ErrInvalidID
+	}
+	return nil
+}
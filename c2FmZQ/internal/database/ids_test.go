@@ -0,0 +1,90 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		want bool
+	}{
+		{"album1", true},
+		{"dGVzdC1hbGJ1bS1pZA", true},
+		{"ab-_CD.sp", true},
+		{"abc=", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../x", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a\x00b", false},
+		{"a b", false},
+		{"é", false},
+		{strings.Repeat("a", maxIDLength), true},
+		{strings.Repeat("a", maxIDLength+1), false},
+	} {
+		if got := validID(tc.id); got != tc.want {
+			t.Errorf("validID(%q) = %v, want %v", tc.id, got, tc.want)
+		}
+	}
+}
+
+func FuzzValidID(f *testing.F) {
+	for _, s := range []string{"album1", "file.sp", "..", "../../etc/passwd", "a/b", `a\b`, "a\x00", "%2e%2e"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		if !validID(id) {
+			return
+		}
+		if len(id) > maxIDLength {
+			t.Fatalf("validID(%q) accepted a long ID", id)
+		}
+		if strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+			t.Fatalf("validID(%q) accepted a path component", id)
+		}
+		if p := filepath.Join("dir", "fileset-"+id); filepath.Dir(p) != "dir" {
+			t.Fatalf("validID(%q) escapes the directory: %q", id, p)
+		}
+	})
+}
+
+func FuzzValidHeaders(f *testing.F) {
+	for _, s := range []string{"", "hdr1*hdr2", "a\nb", "\x7f", strings.Repeat("x", maxHeadersLength+1)} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, h string) {
+		if !validHeaders(h) {
+			return
+		}
+		if len(h) > maxHeadersLength {
+			t.Fatalf("validHeaders accepted %d bytes", len(h))
+		}
+		for _, c := range []byte(h) {
+			if c < 0x20 || c > 0x7e {
+				t.Fatalf("validHeaders(%q) accepted %q", h, c)
+			}
+		}
+	})
+}
@@ -0,0 +1,197 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	importsFile = "imports.dat"
+
+	// Import sessions that are not updated for this long are discarded.
+	importExpiration = 24 * time.Hour
+)
+
+var (
+	// ErrImportNotFound indicates that the import session doesn't exist, or
+	// that it expired.
+	ErrImportNotFound = errors.New("import session not found")
+)
+
+// ImportSession tracks the progress of a bulk upload, e.g. when the web app
+// imports a whole folder.
+type ImportSession struct {
+	// The ID of the session.
+	ID string `json:"id"`
+	// The time when the session was started.
+	DateCreated int64 `json:"dateCreated"`
+	// The last time the session was updated.
+	DateModified int64 `json:"dateModified"`
+	// The number of files and bytes that the client intends to upload.
+	TotalFiles int64 `json:"totalFiles"`
+	TotalBytes int64 `json:"totalBytes"`
+	// The number of files and bytes uploaded so far.
+	DoneFiles int64 `json:"doneFiles"`
+	DoneBytes int64 `json:"doneBytes"`
+	// The number of files that the client skipped because they were
+	// already uploaded.
+	SkippedFiles int64 `json:"skippedFiles"`
+	// The number of files that the client failed to upload.
+	FailedFiles int64 `json:"failedFiles"`
+}
+
+// importList contains all of a user's import sessions.
+type importList struct {
+	Sessions map[string]*ImportSession `json:"sessions"`
+}
+
+// StartImport creates a new import session for the user.
+func (d *Database) StartImport(user User, totalFiles, totalBytes int64) (*ImportSession, error) {
+	defer recordLatency("StartImport")()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := nowInMS()
+	session := &ImportSession{
+		ID:           base64.RawURLEncoding.EncodeToString(id),
+		DateCreated:  now,
+		DateModified: now,
+		TotalFiles:   totalFiles,
+		TotalBytes:   totalBytes,
+	}
+	err := d.mutateImports(user, func(list *importList) error {
+		list.Sessions[session.ID] = session
+		return nil
+	})
+	return session, err
+}
+
+// ImportSession returns the user's import session with the given ID.
+func (d *Database) ImportSession(user User, id string) (*ImportSession, error) {
+	defer recordLatency("ImportSession")()
+
+	var list importList
+	if err := d.storage.ReadDataFile(d.filePath(user.home(importsFile)), &list); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrImportNotFound
+		}
+		return nil, err
+	}
+	session, ok := list.Sessions[id]
+	if !ok || isImportExpired(session) {
+		return nil, ErrImportNotFound
+	}
+	return session, nil
+}
+
+// UpdateImport calls f to update the user's import session with the given ID.
+func (d *Database) UpdateImport(user User, id string, f func(*ImportSession)) (*ImportSession, error) {
+	defer recordLatency("UpdateImport")()
+
+	var session *ImportSession
+	err := d.mutateImports(user, func(list *importList) error {
+		var ok bool
+		if session, ok = list.Sessions[id]; !ok {
+			return ErrImportNotFound
+		}
+		f(session)
+		session.DateModified = nowInMS()
+		return nil
+	})
+	return session, err
+}
+
+// mutateImports calls f to modify the user's import sessions. Expired sessions
+// are removed.
+func (d *Database) mutateImports(user User, f func(*importList) error) (retErr error) {
+	fn := d.filePath(user.home(importsFile))
+	if err := d.storage.CreateEmptyFile(fn, importList{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var list importList
+	commit, err := d.storage.OpenForUpdate(fn, &list)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if list.Sessions == nil {
+		list.Sessions = make(map[string]*ImportSession)
+	}
+	for id, session := range list.Sessions {
+		if isImportExpired(session) {
+			delete(list.Sessions, id)
+		}
+	}
+	if err := f(&list); err != nil {
+		return err
+	}
+	return commit(true, nil)
+}
+
+func isImportExpired(session *ImportSession) bool {
+	return nowInMS()-session.DateModified > importExpiration.Milliseconds()
+}
+
+// FindFingerprints returns the fingerprints that match files already in the
+// user's gallery or albums.
+func (d *Database) FindFingerprints(user User, fingerprints []string) ([]string, error) {
+	defer recordLatency("FindFingerprints")()
+
+	want := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		want[fp] = true
+	}
+	var found []string
+	check := func(fs *FileSet) {
+		for _, f := range fs.Files {
+			if f.Fingerprint != "" && want[f.Fingerprint] {
+				found = append(found, f.Fingerprint)
+				delete(want, f.Fingerprint)
+			}
+		}
+	}
+	fs, err := d.FileSet(user, stingle.GallerySet, "")
+	if err != nil {
+		return nil, err
+	}
+	check(fs)
+	albums, err := d.AlbumRefs(user)
+	if err != nil {
+		return nil, err
+	}
+	for albumID := range albums {
+		if len(want) == 0 {
+			break
+		}
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, err
+		}
+		check(fs)
+	}
+	return found, nil
+}
@@ -0,0 +1,215 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The maximum number of months of inactivity for the inactivity
+	// trigger.
+	maxInactivityMonths = 120
+	// The number of reminders sent to an inactive owner before the
+	// inactivity trigger fires, and the time between them.
+	inactivityReminders        = 3
+	inactivityReminderInterval = 7 * 24 * time.Hour
+	// The maximum number of events kept in an escrow's audit log.
+	maxEscrowEvents = 100
+)
+
+// The types of EscrowEvent.
+const (
+	EscrowEventInactivitySet     = "inactivity-set"
+	EscrowEventReminder          = "reminder"
+	EscrowEventTriggered         = "triggered"
+	EscrowEventOwnerActive       = "owner-active"
+	EscrowEventRecoveryRequested = "recovery-requested"
+	EscrowEventRecoveryDenied    = "recovery-denied"
+	EscrowEventReleased          = "released"
+)
+
+var ErrInvalidInactivityPeriod = errors.New("invalid inactivity period")
+
+// EscrowEvent is an entry in the audit log of an escrow.
+type EscrowEvent struct {
+	Date   int64  `json:"date"`
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// InactivityNotice is sent by the server after CheckInactivity, e.g. by
+// email, in addition to the push notifications.
+type InactivityNotice struct {
+	OwnerID   int64
+	ContactID int64
+	// Whether the trigger fired. Otherwise, this is a reminder for the
+	// owner.
+	Triggered bool
+	// The number of the reminder, starting at 1.
+	Reminder int
+	// When the trigger fires if the owner doesn't log in, or when it fired.
+	Deadline int64
+}
+
+// addEvent adds an event to the escrow's audit log.
+func (e *AlbumEscrow) addEvent(typ, detail string) {
+	log.Infof("Escrow %d->%d: %s %s", e.OwnerID, e.ContactID, typ, detail)
+	e.Events = append(e.Events, EscrowEvent{Date: nowInMS(), Type: typ, Detail: detail})
+	if n := len(e.Events); n > maxEscrowEvents {
+		e.Events = e.Events[n-maxEscrowEvents:]
+	}
+}
+
+// resetInactivity restarts the inactivity period, and cancels the reminders
+// and the trigger.
+func (e *AlbumEscrow) resetInactivity() {
+	if e.InactivityMonths == 0 {
+		return
+	}
+	if e.Reminders > 0 || e.InactivityTriggered > 0 {
+		e.addEvent(EscrowEventOwnerActive, "")
+	}
+	e.LastActivity = nowInMS()
+	e.Reminders = 0
+	e.LastReminder = 0
+	e.InactivityTriggered = 0
+}
+
+// inactiveSince returns the time when the owner is considered inactive.
+func (e *AlbumEscrow) inactiveSince() int64 {
+	return time.UnixMilli(e.LastActivity).AddDate(0, e.InactivityMonths, 0).UnixMilli()
+}
+
+// SetInactivityTrigger enables the inactivity trigger of owner's escrow. If
+// owner doesn't log in for months, they get inactivityReminders reminders,
+// one every inactivityReminderInterval. If they still don't log in, the
+// recovery contact is notified and can recover the albums without waiting
+// for the recovery delay. Zero months disables the trigger.
+func (d *Database) SetInactivityTrigger(owner User, months int) (retErr error) {
+	defer recordLatency("SetInactivityTrigger")()
+
+	if months < 0 || months > maxInactivityMonths {
+		return ErrInvalidInactivityPeriod
+	}
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	e := escrows.Escrows[owner.UserID]
+	if e == nil || !e.Accepted {
+		return ErrNoRecoveryContact
+	}
+	e.InactivityMonths = months
+	e.LastActivity = 0
+	e.Reminders = 0
+	e.LastReminder = 0
+	e.InactivityTriggered = 0
+	if months > 0 {
+		e.LastActivity = nowInMS()
+	}
+	e.addEvent(EscrowEventInactivitySet, strconv.Itoa(months)+" months")
+	return nil
+}
+
+// RecordOwnerActivity records that user logged in. It restarts the
+// inactivity period of their escrow, if the inactivity trigger is enabled.
+func (d *Database) RecordOwnerActivity(user User) (retErr error) {
+	fn := d.filePath(albumEscrowFile)
+	var escrows albumEscrows
+	if err := d.storage.ReadDataFile(fn, &escrows); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if e := escrows.Escrows[user.UserID]; e == nil || e.InactivityMonths == 0 {
+		return nil
+	}
+	commit, locked, err := d.escrowsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if e := locked.Escrows[user.UserID]; e != nil {
+		e.resetInactivity()
+	}
+	return nil
+}
+
+// CheckInactivity sends the reminders to the owners who haven't logged in
+// since the inactivity period of their escrow, and fires the inactivity
+// trigger of those who didn't log in after the last reminder. It returns the
+// notices that were sent.
+func (d *Database) CheckInactivity() (notices []InactivityNotice, retErr error) {
+	defer recordLatency("CheckInactivity")()
+
+	if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(albumEscrowFile))); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	commit, escrows, err := d.escrowsForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	defer commit(true, &retErr)
+
+	now := nowInMS()
+	interval := inactivityReminderInterval.Milliseconds()
+	for _, e := range escrows.Escrows {
+		if e.InactivityMonths == 0 || !e.Accepted || len(e.Keys) == 0 || e.InactivityTriggered > 0 {
+			continue
+		}
+		if now < e.inactiveSince() || now < e.LastReminder+interval {
+			continue
+		}
+		if e.Reminders >= inactivityReminders {
+			e.InactivityTriggered = now
+			e.addEvent(EscrowEventTriggered, "")
+			notices = append(notices, InactivityNotice{OwnerID: e.OwnerID, ContactID: e.ContactID, Triggered: true, Deadline: now})
+			if d.notifyChan != nil && d.pushServices.Enable {
+				d.enqueueNotification(notifyItem{
+					uid: e.ContactID,
+					n:   &notification{Type: notifyInactivityTrigger, Target: strconv.FormatInt(e.OwnerID, 10)},
+				})
+			}
+			continue
+		}
+		e.Reminders++
+		e.LastReminder = now
+		e.addEvent(EscrowEventReminder, strconv.Itoa(e.Reminders)+"/"+strconv.Itoa(inactivityReminders))
+		notices = append(notices, InactivityNotice{
+			OwnerID:   e.OwnerID,
+			ContactID: e.ContactID,
+			Reminder:  e.Reminders,
+			Deadline:  now + int64(inactivityReminders-e.Reminders+1)*interval,
+		})
+		if d.notifyChan != nil && d.pushServices.Enable {
+			d.enqueueNotification(notifyItem{
+				uid: e.OwnerID,
+				n:   &notification{Type: notifyInactivityReminder, Target: strconv.FormatInt(e.ContactID, 10)},
+			})
+		}
+	}
+	return notices, nil
+}
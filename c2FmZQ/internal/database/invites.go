@@ -0,0 +1,275 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// The logical filename where the album invite codes are stored.
+	albumInvitesFile = "album-invites.dat"
+
+	// The maximum number of pending join requests per album.
+	maxJoinRequests = 100
+)
+
+var (
+	ErrInvalidInvite       = errors.New("invalid invite code")
+	ErrTooManyJoinRequests = errors.New("too many join requests")
+)
+
+// albumInvites maps invite codes to albums.
+type albumInvites struct {
+	Invites map[string]*AlbumInvite `json:"invites"`
+}
+
+// AlbumInvite is where an invite link points to.
+type AlbumInvite struct {
+	OwnerID     int64  `json:"ownerId"`
+	AlbumID     string `json:"albumId"`
+	DateCreated int64  `json:"dateCreated"`
+}
+
+// JoinRequest is a pending request to join an album.
+type JoinRequest struct {
+	UserID int64 `json:"userId"`
+	// The user's email address.
+	Email string `json:"email"`
+	// The user's public key, needed to encrypt the album's sharing key.
+	PublicKey string `json:"publicKey"`
+	// The time of the request.
+	Date int64 `json:"date"`
+}
+
+// albumAndInvitesForUpdate opens an album and the invite codes for update.
+func (d *Database) albumAndInvitesForUpdate(owner User, albumID string) (func(bool, *error) error, *AlbumRef, *FileSet, *albumInvites, error) {
+	albumRef, err := d.albumRef(owner, albumID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	fn := d.filePath(albumInvitesFile)
+	if err := d.storage.CreateEmptyFile(fn, albumInvites{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, nil, nil, err
+	}
+	var fs FileSet
+	var invites albumInvites
+	commit, err := d.storage.OpenManyForUpdate([]string{albumRef.File, fn}, []interface{}{&fs, &invites})
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if invites.Invites == nil {
+		invites.Invites = make(map[string]*AlbumInvite)
+	}
+	if fs.Album == nil || fs.Album.OwnerID != owner.UserID {
+		commit(false, nil)
+		return nil, nil, nil, nil, os.ErrPermission
+	}
+	return commit, albumRef, &fs, &invites, nil
+}
+
+// CreateAlbumInvite creates a new invite code for an album. Anyone with the
+// code can ask to join the album. Any previous code for the album stops
+// working.
+func (d *Database) CreateAlbumInvite(owner User, albumID string) (code string, retErr error) {
+	defer recordLatency("CreateAlbumInvite")()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code = base64.RawURLEncoding.EncodeToString(b)
+
+	commit, _, fs, invites, err := d.albumAndInvitesForUpdate(owner, albumID)
+	if err != nil {
+		return "", err
+	}
+	defer commit(true, &retErr)
+	delete(invites.Invites, fs.Album.InviteCode)
+	invites.Invites[code] = &AlbumInvite{
+		OwnerID:     owner.UserID,
+		AlbumID:     albumID,
+		DateCreated: nowInMS(),
+	}
+	fs.Album.InviteCode = code
+	return code, nil
+}
+
+// RevokeAlbumInvite revokes the album's invite code, and discards the pending
+// join requests.
+func (d *Database) RevokeAlbumInvite(owner User, albumID string) (retErr error) {
+	defer recordLatency("RevokeAlbumInvite")()
+
+	commit, _, fs, invites, err := d.albumAndInvitesForUpdate(owner, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	delete(invites.Invites, fs.Album.InviteCode)
+	fs.Album.InviteCode = ""
+	fs.Album.JoinRequests = nil
+	return nil
+}
+
+// removeAlbumInvite removes an invite code, e.g. when the album is deleted.
+func (d *Database) removeAlbumInvite(code string) (retErr error) {
+	if code == "" {
+		return nil
+	}
+	var invites albumInvites
+	commit, err := d.storage.OpenForUpdate(d.filePath(albumInvitesFile), &invites)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	delete(invites.Invites, code)
+	return nil
+}
+
+// RequestToJoinAlbum adds a pending request for user to join the album that
+// the invite code points to. The owner of the album has to approve it.
+func (d *Database) RequestToJoinAlbum(user User, code string) (retErr error) {
+	defer recordLatency("RequestToJoinAlbum")()
+
+	var invites albumInvites
+	if err := d.storage.ReadDataFile(d.filePath(albumInvitesFile), &invites); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrInvalidInvite
+		}
+		return err
+	}
+	inv, ok := invites.Invites[code]
+	if !ok {
+		return ErrInvalidInvite
+	}
+	owner, err := d.UserByID(inv.OwnerID)
+	if err != nil {
+		return err
+	}
+	commit, fs, err := d.fileSetForUpdate(owner, stingle.AlbumSet, inv.AlbumID)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrInvalidInvite
+	}
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album.InviteCode != code {
+		return ErrInvalidInvite
+	}
+	if fs.Album.OwnerID == user.UserID || fs.Album.Members[user.UserID] {
+		return os.ErrExist
+	}
+	if fs.Album.JoinRequests == nil {
+		fs.Album.JoinRequests = make(map[int64]int64)
+	}
+	if _, ok := fs.Album.JoinRequests[user.UserID]; !ok && len(fs.Album.JoinRequests) >= maxJoinRequests {
+		return ErrTooManyJoinRequests
+	}
+	fs.Album.JoinRequests[user.UserID] = nowInMS()
+	if d.notifyChan != nil && d.pushServices.Enable {
+		d.enqueueNotification(notifyItem{
+			uid: owner.UserID,
+			n:   &notification{Type: notifyJoinRequest, Target: inv.AlbumID},
+		})
+	}
+	return nil
+}
+
+// JoinRequests returns the pending requests to join an album.
+func (d *Database) JoinRequests(owner User, albumID string) ([]JoinRequest, error) {
+	defer recordLatency("JoinRequests")()
+
+	album, err := d.Album(owner, albumID)
+	if err != nil {
+		return nil, err
+	}
+	if album.OwnerID != owner.UserID {
+		return nil, os.ErrPermission
+	}
+	out := []JoinRequest{}
+	for uid, date := range album.JoinRequests {
+		u, err := d.UserByID(uid)
+		if err != nil {
+			log.Errorf("UserByID(%d): %v", uid, err)
+			continue
+		}
+		out = append(out, JoinRequest{
+			UserID:    uid,
+			Email:     u.Email,
+			PublicKey: base64.StdEncoding.EncodeToString(u.PublicKey.ToBytes()),
+			Date:      date,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
+	return out, nil
+}
+
+// AnswerJoinRequest approves or denies a pending request to join an album.
+// When the request is approved, sharingKey is the album's private key
+// encrypted for the new member, and the user becomes a member of the album
+// with the same update.
+func (d *Database) AnswerJoinRequest(owner User, albumID string, userID int64, approve bool, sharingKey string) (retErr error) {
+	defer recordLatency("AnswerJoinRequest")()
+
+	albumRef, err := d.albumRef(owner, albumID)
+	if err != nil {
+		return err
+	}
+	commit, fs, err := d.fileSetForUpdate(owner, stingle.AlbumSet, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album.OwnerID != owner.UserID {
+		return os.ErrPermission
+	}
+	if _, ok := fs.Album.JoinRequests[userID]; !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.Album.JoinRequests, userID)
+	if !approve {
+		return nil
+	}
+	if sharingKey == "" {
+		return fmt.Errorf("missing sharing key for %d", userID)
+	}
+	uid := strconv.FormatInt(userID, 10)
+	sharing := &stingle.Album{
+		AlbumID:     albumID,
+		IsHidden:    boolToNumber(fs.Album.IsHidden),
+		IsLocked:    boolToNumber(fs.Album.IsLocked),
+		Permissions: string(fs.Album.Permissions),
+		Members:     uid,
+	}
+	sharingKeys := map[string]string{uid: sharingKey}
+	if err := d.shareAlbum(owner, albumRef, fs, sharing, sharingKeys); err != nil {
+		log.Errorf("shareAlbum(%q, %d): %v", albumID, userID, err)
+		return err
+	}
+	return nil
+}
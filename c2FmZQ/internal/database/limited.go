@@ -0,0 +1,140 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLimitedAccount is returned when a limited account attempts an
+	// operation that isn't allowed for limited accounts.
+	ErrLimitedAccount = errors.New("not allowed for limited accounts")
+)
+
+// LimitedAccount contains the settings of a limited account, e.g. a child's
+// account on a family server. Limited accounts can only share albums with
+// their family, i.e. their parent and the other accounts with the same parent,
+// they can't delete files permanently, and their quota is fixed. Only the
+// administrators and the parent can change it.
+type LimitedAccount struct {
+	// The user ID of the account that manages this one. When it is zero,
+	// the account is managed by the administrators only, and it can't share
+	// albums with anyone.
+	ParentID int64 `json:"parentId,omitempty"`
+}
+
+// SetLimitedAccount makes a user account limited, or a regular account again
+// when limited is nil. The quota is fixed to quota, or to the user's current
+// quota when quota is nil.
+func (d *Database) SetLimitedAccount(userID int64, limited *LimitedAccount, quota *Limit) (retErr error) {
+	defer recordLatency("SetLimitedAccount")()
+
+	if limited != nil && limited.ParentID != 0 {
+		if limited.ParentID == userID {
+			return errors.New("an account can't be its own parent")
+		}
+		parent, err := d.UserByID(limited.ParentID)
+		if err != nil {
+			return err
+		}
+		if parent.Limited != nil {
+			return fmt.Errorf("parent %d is a limited account", parent.UserID)
+		}
+	}
+	var user User
+	var quotas Quotas
+	commit, err := d.storage.OpenManyForUpdate(
+		[]string{d.filePath(homeByUserID(userID, userFile)), d.filePath(quotaFile)},
+		[]interface{}{&user, &quotas},
+	)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if user.UserID != userID {
+		return fmt.Errorf("unexpected user ID %d", user.UserID)
+	}
+	user.Limited = limited
+	if limited != nil {
+		fixLimitedQuota(&quotas, userID, quota)
+	}
+	return commit(true, nil)
+}
+
+// LimitedAccounts returns the limited accounts managed by parentID.
+func (d *Database) LimitedAccounts(parentID int64) ([]User, error) {
+	defer recordLatency("LimitedAccounts")()
+
+	uids, err := d.UserIDs()
+	if err != nil {
+		return nil, err
+	}
+	var out []User
+	for _, uid := range uids {
+		u, err := d.UserByID(uid)
+		if err != nil {
+			return nil, err
+		}
+		if u.Limited != nil && u.Limited.ParentID == parentID && parentID != 0 {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// fixLimitedQuota sets the per-user quota of a limited account. When quota is
+// nil, the current quota of the user is kept, and the default quota is copied
+// if the user doesn't have their own.
+func fixLimitedQuota(quotas *Quotas, userID int64, quota *Limit) {
+	if quotas.Limits == nil {
+		quotas.Limits = make(map[int64]Limit)
+	}
+	if quota != nil {
+		quotas.Limits[userID] = *quota
+		return
+	}
+	if _, ok := quotas.Limits[userID]; !ok {
+		quotas.Limits[userID] = Limit{Value: quotas.DefaultLimit, Unit: quotas.DefaultLimitUnit}
+	}
+}
+
+// checkLimitedShare returns ErrLimitedAccount if user is a limited account and
+// any of the members are outside of their family.
+func (d *Database) checkLimitedShare(user User, members map[int64]bool) error {
+	if user.Limited == nil {
+		return nil
+	}
+	for id := range members {
+		if user.Limited.ParentID == 0 {
+			return ErrLimitedAccount
+		}
+		if id == user.Limited.ParentID {
+			continue
+		}
+		m, err := d.UserByID(id)
+		if err != nil {
+			return err
+		}
+		if m.Limited == nil || m.Limited.ParentID != user.Limited.ParentID {
+			return ErrLimitedAccount
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestLimitedAccounts(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	users := make(map[string]database.User)
+	for _, e := range []string{"parent@", "kid1@", "kid2@", "stranger@"} {
+		if err := addUser(db, e, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", e, err)
+		}
+		u, err := db.User(e)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", e, err)
+		}
+		users[e] = u
+	}
+	parentID := users["parent@"].UserID
+	for _, e := range []string{"kid1@", "kid2@"} {
+		if err := db.SetLimitedAccount(users[e].UserID, &database.LimitedAccount{ParentID: parentID}, &database.Limit{Value: 1, Unit: "MB"}); err != nil {
+			t.Fatalf("db.SetLimitedAccount(%q): %v", e, err)
+		}
+		u, err := db.User(e)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", e, err)
+		}
+		users[e] = u
+	}
+	if err := db.SetLimitedAccount(parentID, &database.LimitedAccount{ParentID: users["kid1@"].UserID}, nil); err == nil {
+		t.Error("db.SetLimitedAccount() with a limited parent succeeded")
+	}
+
+	kid := users["kid1@"]
+	kids, err := db.LimitedAccounts(parentID)
+	if err != nil {
+		t.Fatalf("db.LimitedAccounts: %v", err)
+	}
+	if len(kids) != 2 {
+		t.Errorf("db.LimitedAccounts() returned %d accounts, want 2", len(kids))
+	}
+
+	// Fixed quota.
+	if q, err := db.Quota(kid.UserID); err != nil || q != 1<<20 {
+		t.Errorf("db.Quota() = %d, %v, want %d, nil", q, err, 1<<20)
+	}
+	if err := db.SetUserLimits(database.AdminUser{UserID: kid.UserID, Quota: ptr(int64(5))}); err != database.ErrLimitedAccount {
+		t.Errorf("db.SetUserLimits() = %v, want ErrLimitedAccount", err)
+	}
+
+	// Sharing only within the family.
+	if err := addAlbum(db, kid, "album1"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	share := func(members ...int64) error {
+		album := stingle.Album{
+			AlbumID:     "album1",
+			IsShared:    "1",
+			Permissions: "1111",
+			Members:     membersString(append(members, kid.UserID)...),
+		}
+		return db.ShareAlbum(kid, &album, nil)
+	}
+	if err := share(users["stranger@"].UserID); err != database.ErrLimitedAccount {
+		t.Errorf("share(stranger) = %v, want ErrLimitedAccount", err)
+	}
+	if err := share(parentID, users["kid2@"].UserID); err != nil {
+		t.Errorf("share(parent, kid2) = %v", err)
+	}
+
+	// No permanent deletion.
+	if err := addFile(db, kid, "file1", stingle.AlbumSet, "album1"); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+	if err := addFile(db, kid, "file2", stingle.TrashSet, ""); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+	if err := db.DeleteFiles(kid, []string{"file2"}); err != database.ErrLimitedAccount {
+		t.Errorf("db.DeleteFiles() = %v, want ErrLimitedAccount", err)
+	}
+	if err := db.EmptyTrash(kid, 20000); err != database.ErrLimitedAccount {
+		t.Errorf("db.EmptyTrash() = %v, want ErrLimitedAccount", err)
+	}
+	if err := db.DeleteAlbum(kid, "album1"); err != database.ErrLimitedAccount {
+		t.Errorf("db.DeleteAlbum() = %v, want ErrLimitedAccount", err)
+	}
+
+	// Back to a regular account.
+	if err := db.SetLimitedAccount(kid.UserID, nil, nil); err != nil {
+		t.Fatalf("db.SetLimitedAccount: %v", err)
+	}
+	if kid, err = db.User("kid1@"); err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := db.EmptyTrash(kid, 20000); err != nil {
+		t.Errorf("db.EmptyTrash() = %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The logical filename of the lock that serializes the updates of a
+	// user's data. See LockUser.
+	userLockFile = "user"
+	// The logical filename of the lock that makes sure that the usage
+	// report is only sent by one server instance. See LockUsageReport.
+	usageReportLockFile = "usage-report"
+	// The logical filename of the lock that blocks the changes to a user's
+	// file sets while they are read. See Snapshot.
+	fileSetsLockFile = "file-sets"
+)
+
+// LockUser acquires a lock on the user's data that is shared by all the server
+// instances. The returned function releases it.
+func (d *Database) LockUser(userID int64) (unlock func(), err error) {
+	return d.lock(d.filePath(homeByUserID(userID, userLockFile)))
+}
+
+// LockUsageReport acquires the lock that is held while the monthly usage
+// report is sent. The returned function releases it.
+func (d *Database) LockUsageReport() (unlock func(), err error) {
+	return d.lock(d.filePath(usageReportLockFile))
+}
+
+func (d *Database) lock(name string) (func(), error) {
+	if err := d.storage.Lock(name); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := d.storage.Unlock(name); err != nil {
+			log.Errorf("Unlock(%s): %v", name, err)
+		}
+	}, nil
+}
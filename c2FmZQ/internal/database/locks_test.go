@@ -0,0 +1,102 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+)
+
+// memLocker is a Locker that is shared by the databases in the same process.
+type memLocker struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+func (l *memLocker) Lock(name string) error {
+	for {
+		l.mu.Lock()
+		ch, ok := l.held[name]
+		if !ok {
+			l.held[name] = make(chan struct{})
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+		<-ch
+	}
+}
+
+func (l *memLocker) Unlock(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.held[name])
+	delete(l.held, name)
+	return nil
+}
+
+func TestLockUser(t *testing.T) {
+	if database.New(t.TempDir(), nil).Clustered() {
+		t.Error("Clustered() = true without a Locker")
+	}
+	dir := t.TempDir()
+	pp := []byte("passphrase")
+	l := &memLocker{held: make(map[string]chan struct{})}
+	db1 := database.NewWithOptions(dir, pp, database.Options{Locker: l})
+	db2 := database.NewWithOptions(dir, pp, database.Options{Locker: l})
+	if !db1.Clustered() {
+		t.Error("Clustered() = false with a Locker")
+	}
+
+	unlock, err := db1.LockUser(1)
+	if err != nil {
+		t.Fatalf("LockUser: %v", err)
+	}
+	// Other users aren't affected.
+	unlock2, err := db2.LockUser(2)
+	if err != nil {
+		t.Fatalf("LockUser: %v", err)
+	}
+	unlock2()
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := db2.LockUser(1)
+		if err != nil {
+			t.Errorf("LockUser: %v", err)
+			close(locked)
+			return
+		}
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("LockUser(1) didn't wait for the other instance")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockUser(1) didn't return after unlock")
+	}
+}
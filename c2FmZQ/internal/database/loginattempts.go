@@ -0,0 +1,195 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// The logical filename where the failed logins are stored.
+	loginAttemptsFile = "login-attempts.dat"
+
+	// Failed logins are forgotten after this long, in milliseconds, unless
+	// they caused a lockout that is still in effect.
+	loginFailureWindow = 24 * 3600 * 1000
+	// The maximum duration of a lockout, in milliseconds.
+	maxLoginLockout = 24 * 3600 * 1000
+	// A source IP address can fail this many times more than an account
+	// before it is locked out, since it may be shared by many users.
+	ipLockoutFactor = 10
+	// The maximum number of accounts, and of IP addresses, whose failed
+	// logins are kept. Any email address can be submitted, so this bounds
+	// the size of the file.
+	maxLoginFailureEntries = 10000
+)
+
+// loginAttempts contains the recent failed logins, by email address and by
+// source IP address. Email addresses are used instead of user IDs so that
+// accounts that don't exist behave like those that do.
+type loginAttempts struct {
+	Accounts map[string]*LoginFailures `json:"accounts"`
+	IPs      map[string]*LoginFailures `json:"ips"`
+}
+
+// LoginFailures is the recent failed logins of an account or IP address.
+type LoginFailures struct {
+	// The number of consecutive failed logins.
+	Count int `json:"count"`
+	// The time of the last failed login, in milliseconds.
+	LastFailure int64 `json:"lastFailure"`
+	// The time when the lockout ends, in milliseconds.
+	LockedUntil int64 `json:"lockedUntil,omitempty"`
+}
+
+// LoginLockedUntil returns the time when email can try to log in again from
+// ip, in milliseconds, or zero if it isn't locked out.
+func (d *Database) LoginLockedUntil(email, ip string) (int64, error) {
+	var la loginAttempts
+	if err := d.storage.ReadDataFile(d.filePath(loginAttemptsFile), &la); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	now := nowInMS()
+	var until int64
+	for _, f := range []*LoginFailures{la.Accounts[email], la.IPs[ip]} {
+		if f != nil && f.LockedUntil > now && f.LockedUntil > until {
+			until = f.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// RecordLoginFailure records a failed login for email from ip. After
+// threshold consecutive failures, the account is locked for lockout, and the
+// lockout doubles with each additional failure. The IP address is locked in
+// the same way after ten times as many failures. A zero threshold disables
+// lockouts. Returns the time when the lockout ends, or zero.
+func (d *Database) RecordLoginFailure(email, ip string, threshold int, lockout time.Duration) (until int64, retErr error) {
+	fn := d.filePath(loginAttemptsFile)
+	if err := d.storage.CreateEmptyFile(fn, loginAttempts{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return 0, err
+	}
+	var la loginAttempts
+	commit, err := d.storage.OpenForUpdate(fn, &la)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, &retErr)
+	if la.Accounts == nil {
+		la.Accounts = make(map[string]*LoginFailures)
+	}
+	if la.IPs == nil {
+		la.IPs = make(map[string]*LoginFailures)
+	}
+	now := nowInMS()
+	pruneLoginFailures(la.Accounts, now)
+	pruneLoginFailures(la.IPs, now)
+
+	record := func(m map[string]*LoginFailures, key string, threshold int) {
+		f := m[key]
+		if f == nil {
+			f = &LoginFailures{}
+			m[key] = f
+		}
+		f.Count++
+		f.LastFailure = now
+		if threshold <= 0 || f.Count < threshold {
+			return
+		}
+		dur := lockout.Milliseconds()
+		for i := threshold; i < f.Count && dur < maxLoginLockout; i++ {
+			dur *= 2
+		}
+		if dur > maxLoginLockout {
+			dur = maxLoginLockout
+		}
+		f.LockedUntil = now + dur
+		if f.LockedUntil > until {
+			until = f.LockedUntil
+		}
+	}
+	record(la.Accounts, email, threshold)
+	if ip != "" {
+		record(la.IPs, ip, threshold*ipLockoutFactor)
+	}
+	capLoginFailures(la.Accounts, maxLoginFailureEntries, now)
+	capLoginFailures(la.IPs, maxLoginFailureEntries, now)
+	return until, commit(true, nil)
+}
+
+// ClearLoginFailures forgets the failed logins of email, after a successful
+// login. The failures of the IP address are kept, so that an attacker can't
+// reset them with their own account.
+func (d *Database) ClearLoginFailures(email string) (retErr error) {
+	fn := d.filePath(loginAttemptsFile)
+	var la loginAttempts
+	if err := d.storage.ReadDataFile(fn, &la); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := la.Accounts[email]; !ok {
+		return nil
+	}
+	la = loginAttempts{}
+	commit, err := d.storage.OpenForUpdate(fn, &la)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	delete(la.Accounts, email)
+	return commit(true, nil)
+}
+
+func pruneLoginFailures(m map[string]*LoginFailures, now int64) {
+	for k, f := range m {
+		if f.LastFailure < now-loginFailureWindow && f.LockedUntil < now {
+			delete(m, k)
+		}
+	}
+}
+
+// capLoginFailures removes the oldest entries from m until it has at most max
+// entries. The lockouts that are still in effect are removed last, so that
+// failed logins with made-up email addresses can't be used to end them.
+func capLoginFailures(m map[string]*LoginFailures, max int, now int64) {
+	if len(m) <= max {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m[keys[i]], m[keys[j]]
+		if lockedA, lockedB := a.LockedUntil > now, b.LockedUntil > now; lockedA != lockedB {
+			return lockedB
+		}
+		return a.LastFailure < b.LastFailure
+	})
+	for _, k := range keys[:len(keys)-max] {
+		delete(m, k)
+	}
+}
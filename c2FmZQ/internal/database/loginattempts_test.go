@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+)
+
+func TestLoginLockout(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	now := int64(10000)
+	database.CurrentTimeForTesting = now
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	lockedUntil := func(email, ip string) int64 {
+		until, err := db.LoginLockedUntil(email, ip)
+		if err != nil {
+			t.Fatalf("LoginLockedUntil: %v", err)
+		}
+		return until
+	}
+	fail := func(email, ip string) int64 {
+		until, err := db.RecordLoginFailure(email, ip, 3, time.Minute)
+		if err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		return until
+	}
+
+	if got := lockedUntil("alice@", "10.0.0.1"); got != 0 {
+		t.Fatalf("lockedUntil = %d, want 0", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := fail("alice@", "10.0.0.1"); got != 0 {
+			t.Fatalf("[%d] RecordLoginFailure = %d, want 0", i, got)
+		}
+	}
+	// The lockout starts after 3 failures, and doubles after that.
+	if got, want := fail("alice@", "10.0.0.1"), now+60000; got != want {
+		t.Fatalf("RecordLoginFailure = %d, want %d", got, want)
+	}
+	if got, want := lockedUntil("alice@", "10.0.0.2"), now+60000; got != want {
+		t.Errorf("lockedUntil = %d, want %d", got, want)
+	}
+	if got := lockedUntil("bob@", "10.0.0.1"); got != 0 {
+		t.Errorf("lockedUntil(bob) = %d, want 0", got)
+	}
+	now += 60000
+	database.CurrentTimeForTesting = now
+	if got := lockedUntil("alice@", "10.0.0.1"); got != 0 {
+		t.Errorf("lockedUntil = %d, want 0", got)
+	}
+	if got, want := fail("alice@", "10.0.0.1"), now+120000; got != want {
+		t.Fatalf("RecordLoginFailure = %d, want %d", got, want)
+	}
+
+	// A successful login clears the account's failures.
+	if err := db.ClearLoginFailures("alice@"); err != nil {
+		t.Fatalf("ClearLoginFailures: %v", err)
+	}
+	if got := lockedUntil("alice@", "10.0.0.2"); got != 0 {
+		t.Errorf("lockedUntil = %d, want 0", got)
+	}
+
+	// The IP address is locked after 30 failures, including the 4 above.
+	for i := 0; i < 25; i++ {
+		if got := fail(fmt.Sprintf("user%d@", i), "10.0.0.1"); got != 0 {
+			t.Fatalf("[%d] RecordLoginFailure = %d, want 0", i, got)
+		}
+	}
+	if got, want := fail("carol@", "10.0.0.1"), now+60000; got != want {
+		t.Fatalf("RecordLoginFailure = %d, want %d", got, want)
+	}
+	if got, want := lockedUntil("dave@", "10.0.0.1"), now+60000; got != want {
+		t.Errorf("lockedUntil(dave) = %d, want %d", got, want)
+	}
+	if got := lockedUntil("dave@", "10.0.0.2"); got != 0 {
+		t.Errorf("lockedUntil(dave) = %d, want 0", got)
+	}
+
+	// Old failures are forgotten.
+	now += 25 * 3600 * 1000
+	database.CurrentTimeForTesting = now
+	for i := 0; i < 2; i++ {
+		if got := fail("carol@", "10.0.0.1"); got != 0 {
+			t.Fatalf("[%d] RecordLoginFailure = %d, want 0", i, got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCapLoginFailures(t *testing.T) {
+	const now = 1000000
+	m := map[string]*LoginFailures{
+		"locked":   {Count: 10, LastFailure: 1, LockedUntil: now + 1},
+		"expired":  {Count: 10, LastFailure: 2, LockedUntil: now - 1},
+		"recent":   {Count: 1, LastFailure: 999},
+		"previous": {Count: 1, LastFailure: 998},
+	}
+	for i := 0; i < 10; i++ {
+		m[fmt.Sprintf("old%d", i)] = &LoginFailures{Count: 1, LastFailure: int64(100 + i)}
+	}
+	capLoginFailures(m, 3, now)
+	if len(m) != 3 {
+		t.Errorf("len(m) = %d, want 3", len(m))
+	}
+	for _, k := range []string{"locked", "recent", "previous"} {
+		if m[k] == nil {
+			t.Errorf("%q was removed", k)
+		}
+	}
+
+	capLoginFailures(m, 10, now)
+	if len(m) != 3 {
+		t.Errorf("len(m) = %d, want 3", len(m))
+	}
+}
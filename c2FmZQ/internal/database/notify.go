@@ -50,6 +50,20 @@ const (
 	notifyTest = 4
 	// Request MFA from another device.
 	notifyMFA = 5
+	// A user asked to join an album with an invite link.
+	notifyJoinRequest = 6
+	// A digest of the changes in a shared album.
+	notifyDigest = 7
+	// A user was designated as someone's recovery contact.
+	notifyRecoveryContact = 8
+	// The recovery contact asked to recover the user's albums.
+	notifyRecoveryRequest = 9
+	// The user hasn't logged in for a long time, and their albums will be
+	// released to their recovery contact unless they log in.
+	notifyInactivityReminder = 10
+	// The albums of a user who has been inactive for a long time can be
+	// recovered by their recovery contact.
+	notifyInactivityTrigger = 11
 )
 
 // notification encapsulates the content to be sent with a push notification.
@@ -197,8 +211,10 @@ func (db *Database) notifyAdmins(n notification) {
 }
 
 // notifyAlbum sends a notification to the members of a shared album.
+// Members who are subscribed to a digest of the album get the notification
+// later with the digest.
 func (db *Database) notifyAlbum(originator int64, album *AlbumSpec, n notification) {
-	if db.notifyChan == nil || !db.pushServices.Enable || album == nil || !album.IsShared {
+	if album == nil || !album.IsShared {
 		return
 	}
 	uids := map[int64]bool{
@@ -208,6 +224,12 @@ func (db *Database) notifyAlbum(originator int64, album *AlbumSpec, n notificati
 		uids[id] = true
 	}
 	delete(uids, originator)
+	if err := db.addToDigests(uids, album.AlbumID, n); err != nil {
+		log.Errorf("addToDigests: %v", err)
+	}
+	if db.notifyChan == nil || !db.pushServices.Enable {
+		return
+	}
 
 	for id := range uids {
 		db.enqueueNotification(notifyItem{uid: id, n: &n})
@@ -0,0 +1,200 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The number of files that are read ahead when the downloads look
+	// sequential.
+	prefetchAhead = 3
+	// The maximum number of blobs that are read ahead concurrently.
+	maxConcurrentPrefetch = 4
+)
+
+// downloadPos is the last file that a user downloaded.
+type downloadPos struct {
+	set     string
+	albumID string
+	file    string
+}
+
+// openBlob opens a blob for reading. When the blob was read ahead by
+// prefetchNext, it is served from memory.
+func (d *Database) openBlob(blob string) (io.ReadSeekCloser, error) {
+	if d.prefetchMax > 0 {
+		d.prefetchMutex.Lock()
+		v, ok := d.prefetchCache.Get(blob)
+		d.prefetchMutex.Unlock()
+		if ok {
+			prefetchBlobs.WithLabelValues("hit").Inc()
+			return nopCloser{bytes.NewReader(v.([]byte))}, nil
+		}
+	}
+	return d.storage.OpenBlobRead(blob)
+}
+
+// prefetchNext records that user downloaded a file from a file set. When the
+// downloads look sequential, i.e. the previous download was the file right
+// before or right after this one in the file set, newest first, the same
+// variant of the next few files in that direction is read ahead in the
+// background. This hides the latency of a slow blob store when a user browses
+// an album one file at a time.
+func (d *Database) prefetchNext(user User, set, albumID, filename string, variant Variant) {
+	if d.prefetchMax == 0 || variant == VariantThumb {
+		return
+	}
+	d.prefetchMutex.Lock()
+	v, ok := d.prefetchLast.Get(user.UserID)
+	d.prefetchLast.Add(user.UserID, downloadPos{set: set, albumID: albumID, file: filename})
+	d.prefetchMutex.Unlock()
+	if !ok {
+		return
+	}
+	last := v.(downloadPos)
+	if last.set != set || last.albumID != albumID || last.file == filename {
+		return
+	}
+	fs, err := d.FileSet(user, set, albumID)
+	if err != nil {
+		log.Errorf("prefetchNext: FileSet(%q, %q, %q): %v", user.Email, set, albumID, err)
+		return
+	}
+	var dir int
+	if prev := adjacentFiles(fs.Files, filename, -1, 1); len(prev) == 1 && prev[0] == last.file {
+		dir = 1
+	} else if next := adjacentFiles(fs.Files, filename, 1, 1); len(next) == 1 && next[0] == last.file {
+		dir = -1
+	} else {
+		return
+	}
+	var blobs []string
+	for _, name := range adjacentFiles(fs.Files, filename, dir, prefetchAhead) {
+		f := fs.Files[name]
+		blob, size := f.StoreFile, f.StoreFileSize
+		if variant == VariantMedium {
+			blob, size = f.StoreMedium, f.StoreMediumSize
+		}
+		// A blob that would take more than its share of the memory is
+		// never read ahead.
+		if blob == "" || size > d.prefetchMax/prefetchAhead {
+			continue
+		}
+		blobs = append(blobs, blob)
+	}
+	if len(blobs) > 0 {
+		go d.prefetch(blobs)
+	}
+}
+
+// prefetch reads blobs into the prefetch cache. It gives up right away when
+// too many blobs are already being read ahead.
+func (d *Database) prefetch(blobs []string) {
+	select {
+	case d.prefetchSem <- struct{}{}:
+		defer func() { <-d.prefetchSem }()
+	default:
+		return
+	}
+	for _, blob := range blobs {
+		d.prefetchMutex.Lock()
+		skip := d.prefetchCache.Contains(blob) || d.prefetchInFlight[blob]
+		if !skip {
+			d.prefetchInFlight[blob] = true
+		}
+		d.prefetchMutex.Unlock()
+		if skip {
+			continue
+		}
+		b, err := d.readBlob(blob)
+		d.prefetchMutex.Lock()
+		delete(d.prefetchInFlight, blob)
+		if err == nil && int64(len(b)) <= d.prefetchMax {
+			d.prefetchCache.Add(blob, b)
+			d.prefetchBytes += int64(len(b))
+			for d.prefetchBytes > d.prefetchMax {
+				d.prefetchCache.RemoveOldest()
+			}
+			prefetchBlobs.WithLabelValues("prefetched").Inc()
+		}
+		d.prefetchMutex.Unlock()
+		if err != nil {
+			log.Errorf("prefetch(%q): %v", blob, err)
+		}
+	}
+}
+
+// readBlob reads the whole content of a blob.
+func (d *Database) readBlob(blob string) ([]byte, error) {
+	r, err := d.storage.OpenBlobRead(blob)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// adjacentFiles returns up to n files that come after name in files, newest
+// first, when dir is positive, or before name when dir is negative. The
+// closest files come first.
+func adjacentFiles(files map[string]*FileSpec, name string, dir, n int) []string {
+	cur, ok := files[name]
+	if !ok {
+		return nil
+	}
+	// before returns whether file a comes before file b, newest first.
+	before := func(a string, fa *FileSpec, b string, fb *FileSpec) bool {
+		if fa.DateCreated != fb.DateCreated {
+			return fa.DateCreated > fb.DateCreated
+		}
+		return a < b
+	}
+	var out []string
+	for k, f := range files {
+		if k == name {
+			continue
+		}
+		if (dir > 0 && !before(name, cur, k, f)) || (dir < 0 && !before(k, f, name, cur)) {
+			continue
+		}
+		// The position of k in out, where the files are sorted by
+		// distance from name.
+		i := sort.Search(len(out), func(i int) bool {
+			if dir > 0 {
+				return before(k, f, out[i], files[out[i]])
+			}
+			return before(out[i], files[out[i]], k, f)
+		})
+		if i >= n {
+			continue
+		}
+		out = append(out, "")
+		copy(out[i+1:], out[i:])
+		out[i] = k
+		if len(out) > n {
+			out = out[:n]
+		}
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrefetch(t *testing.T) {
+	db := database.NewWithOptions(t.TempDir(), nil, database.Options{PrefetchMemory: 1 << 20})
+	if err := addUser(db, "alice", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice")
+	if err != nil {
+		t.Fatalf("db.User failed: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := addFile(db, user, fmt.Sprintf("file%d", i), stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile failed: %v", err)
+		}
+	}
+	download := func(name string) {
+		t.Helper()
+		f, err := db.DownloadFile(user, stingle.GallerySet, name, false)
+		if err != nil {
+			t.Fatalf("DownloadFile(%q) failed: %v", name, err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if want, got := "file content "+name, string(b); want != got {
+			t.Errorf("DownloadFile(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	before := prefetchCounts(t)
+	// A single download doesn't look sequential.
+	download("file3")
+	download("file0")
+	download("file1")
+	// The next 3 files are read ahead in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for prefetchCounts(t)["prefetched"]-before["prefetched"] < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := prefetchCounts(t)["prefetched"]-before["prefetched"], 3.0; got != want {
+		t.Fatalf("prefetched = %v, want %v", got, want)
+	}
+	download("file2")
+	download("file3")
+	download("file4")
+	if got, want := prefetchCounts(t)["hit"]-before["hit"], 3.0; got != want {
+		t.Errorf("hit = %v, want %v", got, want)
+	}
+}
+
+// prefetchCounts returns the values of the prefetch counters, by result.
+func prefetchCounts(t *testing.T) map[string]float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	out := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != "database_prefetch_blobs_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" {
+					out[l.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,225 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const purgeQueueFile = "purge-queue.dat"
+
+// PendingPurge is a file that was deleted from the trash, but whose content is
+// kept until the purge delay expires. Until then, it can be restored with
+// UndeleteFiles.
+type PendingPurge struct {
+	// The name of the file.
+	Name string `json:"name"`
+	// The file, as it was in the trash.
+	File FileSpec `json:"file"`
+	// The time when the file was deleted from the trash.
+	DateDeleted int64 `json:"dateDeleted"`
+}
+
+// purgeQueue contains the files that a user deleted from the trash, and that
+// weren't purged yet.
+type purgeQueue struct {
+	Files []PendingPurge `json:"files"`
+}
+
+// PurgeDelay returns how long the content of the files deleted from the trash
+// is kept.
+func (d *Database) PurgeDelay() time.Duration {
+	return d.purgeDelay
+}
+
+// trashForUpdate opens the user's trash for update. When the deleted files are
+// purged later, the user's purge queue is opened too, so that both are
+// updated atomically. Otherwise, the returned queue is nil.
+func (d *Database) trashForUpdate(user User) (func(bool, *error) error, *FileSet, *purgeQueue, error) {
+	if d.purgeDelay <= 0 {
+		commit, fs, err := d.fileSetForUpdate(user, stingle.TrashSet, "")
+		return commit, fs, nil, err
+	}
+	qf := d.filePath(user.home(purgeQueueFile))
+	if err := d.storage.CreateEmptyFile(qf, purgeQueue{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, nil, err
+	}
+	var fs FileSet
+	var queue purgeQueue
+	commit, err := d.storage.OpenManyForUpdate([]string{d.fileSetPath(user, stingle.TrashSet), qf}, []interface{}{&fs, &queue})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if fs.Files == nil {
+		fs.Files = make(map[string]*FileSpec)
+	}
+	if fs.Deletes == nil {
+		fs.Deletes = []DeleteEvent{}
+	}
+	return commit, &fs, &queue, nil
+}
+
+// releaseFile releases the content of a file that was deleted from the trash,
+// now or after the purge delay.
+func (d *Database) releaseFile(queue *purgeQueue, name string, file *FileSpec, date int64) {
+	if queue == nil {
+		for _, blob := range file.blobs() {
+			d.incRefCount(blob, -1)
+		}
+		return
+	}
+	queue.Files = append(queue.Files, PendingPurge{Name: name, File: *file, DateDeleted: date})
+}
+
+// PendingPurges returns the files that the user deleted from the trash, and
+// that weren't purged yet.
+func (d *Database) PendingPurges(user User) ([]PendingPurge, error) {
+	defer recordLatency("PendingPurges")()
+
+	var queue purgeQueue
+	if err := d.storage.ReadDataFile(d.filePath(user.home(purgeQueueFile)), &queue); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return queue.Files, nil
+}
+
+// UndeleteFiles moves the files that were deleted from the user's trash at or
+// after since, and that weren't purged yet, back to the trash. It returns the
+// number of files that were restored.
+func (d *Database) UndeleteFiles(user User, since int64) (int, error) {
+	defer recordLatency("UndeleteFiles")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+
+	qf := d.filePath(user.home(purgeQueueFile))
+	if _, err := os.Stat(filepath.Join(d.dir, qf)); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	var fs FileSet
+	var queue purgeQueue
+	commit, err := d.storage.OpenManyForUpdate([]string{d.fileSetPath(user, stingle.TrashSet), qf}, []interface{}{&fs, &queue})
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, nil)
+	if fs.Files == nil {
+		fs.Files = make(map[string]*FileSpec)
+	}
+	now := nowInMS()
+	var n int
+	var remaining []PendingPurge
+	for _, p := range queue.Files {
+		if p.DateDeleted < since {
+			remaining = append(remaining, p)
+			continue
+		}
+		// A file with the same name is already in the trash. It has its
+		// own reference to the content, so this one can still be purged.
+		if _, exists := fs.Files[p.Name]; exists {
+			remaining = append(remaining, p)
+			continue
+		}
+		f := p.File
+		f.DateModified = now
+		fs.Files[p.Name] = &f
+		n++
+	}
+	queue.Files = remaining
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PurgeDeletedFiles releases the content of the files that were deleted from
+// the trash more than PurgeDelay ago. It returns the number of files that were
+// purged.
+func (d *Database) PurgeDeletedFiles() (int, error) {
+	defer recordLatency("PurgeDeletedFiles")()
+
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	uids, err := d.UserIDs()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := nowInMS() - d.purgeDelay.Milliseconds()
+	var total int
+	for _, uid := range uids {
+		// The deleted files of accounts on hold are kept until the hold
+		// is released.
+		if u, err := d.UserByID(uid); err != nil || u.Hold {
+			continue
+		}
+		n, err := d.purgeUserFiles(uid, cutoff)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// purgeUserFiles releases the content of the files that the user deleted from
+// the trash before cutoff.
+func (d *Database) purgeUserFiles(userID int64, cutoff int64) (int, error) {
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+	qf := d.filePath(homeByUserID(userID, purgeQueueFile))
+	if _, err := os.Stat(filepath.Join(d.dir, qf)); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	var queue purgeQueue
+	commit, err := d.storage.OpenForUpdate(qf, &queue)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, nil)
+	var expired, remaining []PendingPurge
+	for _, p := range queue.Files {
+		if p.DateDeleted <= cutoff {
+			expired = append(expired, p)
+			continue
+		}
+		remaining = append(remaining, p)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	queue.Files = remaining
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	// The references are released after the queue is updated. If this is
+	// interrupted, some content is never deleted, but nothing is deleted
+	// too early.
+	for _, p := range expired {
+		for _, blob := range p.File.blobs() {
+			d.incRefCount(blob, -1)
+		}
+	}
+	log.Debugf("Purged %d files of user %d", len(expired), userID)
+	return len(expired), nil
+}
@@ -0,0 +1,119 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestPurgeDelay(t *testing.T) {
+	dir := t.TempDir()
+	db := database.NewWithOptions(dir, nil, database.Options{PurgeDelay: time.Hour})
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	for _, f := range []string{"file1", "file2"} {
+		if err := addFile(db, user, f, stingle.TrashSet, ""); err != nil {
+			t.Fatalf("addFile(%q): %v", f, err)
+		}
+	}
+	trash := func() *database.FileSet {
+		t.Helper()
+		fs, err := db.FileSet(user, stingle.TrashSet, "")
+		if err != nil {
+			t.Fatalf("db.FileSet: %v", err)
+		}
+		return fs
+	}
+	pending := func() int {
+		t.Helper()
+		p, err := db.PendingPurges(user)
+		if err != nil {
+			t.Fatalf("db.PendingPurges: %v", err)
+		}
+		return len(p)
+	}
+	file1 := *trash().Files["file1"]
+
+	database.CurrentTimeForTesting = 20000
+	if err := db.EmptyTrash(user, 20000); err != nil {
+		t.Fatalf("db.EmptyTrash: %v", err)
+	}
+	if n := len(trash().Files); n != 0 {
+		t.Errorf("Trash has %d files after EmptyTrash, want 0", n)
+	}
+	if got := pending(); got != 2 {
+		t.Errorf("PendingPurges = %d, want 2", got)
+	}
+
+	// Oops. Undo.
+	if n, err := db.UndeleteFiles(user, 0); err != nil || n != 2 {
+		t.Errorf("db.UndeleteFiles = %d, %v, want 2, nil", n, err)
+	}
+	if n := len(trash().Files); n != 2 {
+		t.Errorf("Trash has %d files after UndeleteFiles, want 2", n)
+	}
+	if got := pending(); got != 0 {
+		t.Errorf("PendingPurges = %d, want 0", got)
+	}
+
+	if err := db.DeleteFiles(user, []string{"file1"}); err != nil {
+		t.Fatalf("db.DeleteFiles: %v", err)
+	}
+	if n, err := db.PurgeDeletedFiles(); err != nil || n != 0 {
+		t.Errorf("db.PurgeDeletedFiles = %d, %v, want 0, nil", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file1.StoreFile)); err != nil {
+		t.Errorf("Content of file1 was deleted before the purge delay: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 20000 + time.Hour.Milliseconds()
+	if r, err := db.PurgeDeletedFilesDryRun(); err != nil || r.Files != 1 || r.Blobs != 2 || r.Bytes != 1100 || len(r.Items) != 1 {
+		t.Errorf("db.PurgeDeletedFilesDryRun = %+v, %v, want 1 file, 2 blobs", r, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file1.StoreFile)); err != nil {
+		t.Errorf("Content of file1 was deleted by the dry run: %v", err)
+	}
+	if n, err := db.PurgeDeletedFiles(); err != nil || n != 1 {
+		t.Errorf("db.PurgeDeletedFiles = %d, %v, want 1, nil", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, file1.StoreFile)); !os.IsNotExist(err) {
+		t.Errorf("Content of file1 wasn't deleted after the purge delay: %v", err)
+	}
+	if got := pending(); got != 0 {
+		t.Errorf("PendingPurges = %d, want 0", got)
+	}
+	if n, err := db.UndeleteFiles(user, 0); err != nil || n != 0 {
+		t.Errorf("db.UndeleteFiles = %d, %v, want 0, nil", n, err)
+	}
+	if _, ok := trash().Files["file2"]; !ok {
+		t.Error("file2 is missing from the trash")
+	}
+}
@@ -25,6 +25,16 @@ import (
 
 const (
 	quotaFile = "quotas.dat"
+	// The logical filename of the lock that serializes the files charged to
+	// a user's quota.
+	quotaLockFile = "quota"
+
+	// With the owner policy, files added to a shared album are charged to
+	// the owner of the album. This is the default.
+	SharedAlbumPolicyOwner = "owner"
+	// With the contributor policy, files added to a shared album are charged
+	// to the user who added them, as long as they are members of the album.
+	SharedAlbumPolicyContributor = "contributor"
 )
 
 // Quotas contains the quota limits, keyed by user ID.
@@ -32,6 +42,11 @@ type Quotas struct {
 	Limits           map[int64]Limit `json:"limits"`
 	DefaultLimit     int64           `json:"defaultLimit"`
 	DefaultLimitUnit string          `json:"defaultLimitUnit"`
+	// The other per-user limits, keyed by user ID.
+	Entitlements map[int64]Entitlements `json:"entitlements,omitempty"`
+	// Who is charged for the files in shared albums: "owner" or
+	// "contributor".
+	SharedAlbumPolicy string `json:"sharedAlbumPolicy,omitempty"`
 }
 
 type Limit struct {
@@ -41,6 +56,8 @@ type Limit struct {
 
 // Quota returns the user's quota.
 func (d *Database) Quota(userID int64) (int64, error) {
+	defer recordLatency("Quota")()
+
 	var quotas Quotas
 	if err := d.storage.ReadDataFile(d.filePath(quotaFile), &quotas); err != nil {
 		return 0, err
@@ -51,6 +68,65 @@ func (d *Database) Quota(userID int64) (int64, error) {
 	return applyUnit(quotas.DefaultLimit, quotas.DefaultLimitUnit), nil
 }
 
+// SharedAlbumPolicy returns the quota accounting policy for shared albums.
+func (d *Database) SharedAlbumPolicy() (string, error) {
+	var quotas Quotas
+	if err := d.storage.ReadDataFile(d.filePath(quotaFile), &quotas); err != nil {
+		return "", err
+	}
+	if quotas.SharedAlbumPolicy == SharedAlbumPolicyContributor {
+		return SharedAlbumPolicyContributor, nil
+	}
+	return SharedAlbumPolicyOwner, nil
+}
+
+// payer returns the ID of the user who is charged for file, according to the
+// shared album policy. ownerID is the owner of the file set.
+func payer(policy string, ownerID int64, file *FileSpec) int64 {
+	if policy == SharedAlbumPolicyContributor && file.AddedBy != 0 {
+		return file.AddedBy
+	}
+	return ownerID
+}
+
+// quotaOwner returns the user whose quota is charged when user adds files to
+// a file set. Space is charged to the quota of the owner of the album, or to
+// the user who adds the files, depending on the shared album policy.
+func (d *Database) quotaOwner(user User, set, albumID string) (User, error) {
+	policy, err := d.SharedAlbumPolicy()
+	if err != nil {
+		return User{}, err
+	}
+	if policy != SharedAlbumPolicyOwner {
+		return user, nil
+	}
+	return d.fileSetOwner(user, set, albumID)
+}
+
+// RemainingQuota returns the number of bytes that user can still add to a
+// file set before the quota of the user who is charged for them is exceeded.
+func (d *Database) RemainingQuota(user User, set, albumID string) (int64, error) {
+	if err := checkFileSet(set, albumID); err != nil {
+		return 0, err
+	}
+	owner, err := d.quotaOwner(user, set, albumID)
+	if err != nil {
+		return 0, err
+	}
+	spaceUsed, err := d.SpaceUsed(owner)
+	if err != nil {
+		return 0, err
+	}
+	quota, err := d.Quota(owner.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if spaceUsed > quota {
+		return 0, nil
+	}
+	return quota - spaceUsed, nil
+}
+
 func applyUnit(value int64, unit string) int64 {
 	switch strings.ToLower(unit) {
 	case "k", "kb":
@@ -0,0 +1,170 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// The maximum size of the encrypted content of a reaction.
+	maxReactionSize = 512
+	// The maximum number of reactions to a single file.
+	maxReactionsPerFile = 100
+)
+
+var (
+	ErrReactionTooLarge = errors.New("reaction too large")
+	ErrTooManyReactions = errors.New("too many reactions")
+)
+
+// Reaction is an album member's end-to-end encrypted reaction to a file, e.g.
+// an emoji. Each member has at most one reaction per file.
+type Reaction struct {
+	// The encrypted content of the reaction.
+	Content string `json:"content"`
+	// The time when the reaction was last changed.
+	DateModified int64 `json:"dateModified"`
+}
+
+// SetReaction sets the user's reaction to a file in an album, replacing any
+// previous reaction. An empty content removes the reaction. The user must be
+// the owner or a member of the album.
+func (d *Database) SetReaction(user User, albumID, file, content string) (retErr error) {
+	defer recordLatency("SetReaction")()
+
+	if len(content) > maxReactionSize {
+		return ErrReactionTooLarge
+	}
+	commit, fs, err := d.fileSetForUpdate(user, stingle.AlbumSet, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album == nil || (fs.Album.OwnerID != user.UserID && !fs.Album.Members[user.UserID]) {
+		return os.ErrPermission
+	}
+	if _, ok := fs.Files[file]; !ok {
+		return os.ErrNotExist
+	}
+	now := nowInMS()
+	if content == "" {
+		if _, ok := fs.Reactions[file][user.UserID]; !ok {
+			return nil
+		}
+		removeReaction(fs, file, user.UserID, now)
+		return nil
+	}
+	if fs.Reactions == nil {
+		fs.Reactions = make(map[string]map[int64]*Reaction)
+	}
+	if fs.Reactions[file] == nil {
+		fs.Reactions[file] = make(map[int64]*Reaction)
+	}
+	if _, ok := fs.Reactions[file][user.UserID]; !ok && len(fs.Reactions[file]) >= maxReactionsPerFile {
+		return ErrTooManyReactions
+	}
+	fs.Reactions[file][user.UserID] = &Reaction{
+		Content:      content,
+		DateModified: now,
+	}
+	return nil
+}
+
+// removeReaction removes a member's reaction to a file, and adds a delete
+// event so that the other members' clients remove it too.
+func removeReaction(fs *FileSet, file string, userID, now int64) {
+	delete(fs.Reactions[file], userID)
+	if len(fs.Reactions[file]) == 0 {
+		delete(fs.Reactions, file)
+	}
+	fs.Deletes = append(fs.Deletes, DeleteEvent{
+		File:    file,
+		AlbumID: fs.Album.AlbumID,
+		Type:    stingle.DeleteEventReaction,
+		Date:    now,
+		UserID:  userID,
+	})
+	pruneDeleteEvents(&fs.Deletes, &fs.DeleteHorizon)
+}
+
+// removeMemberReactions removes all the reactions of a member who is removed
+// from an album.
+func removeMemberReactions(fs *FileSet, userID int64) {
+	now := nowInMS()
+	for file, r := range fs.Reactions {
+		if _, ok := r[userID]; ok {
+			removeReaction(fs, file, userID, now)
+		}
+	}
+}
+
+// ReactionUpdates returns the reactions that were added or changed in the
+// user's albums, and the reactions that were removed, since time ts.
+func (d *Database) ReactionUpdates(user User, ts int64) ([]stingle.Reaction, []stingle.DeleteEvent, error) {
+	defer recordLatency("ReactionUpdates")()
+
+	albumRefs, err := d.AlbumRefs(user)
+	if err != nil {
+		log.Errorf("AlbumRefs(%q) failed: %v", user.Email, err)
+		return nil, nil, err
+	}
+	reactions := []stingle.Reaction{}
+	deletes := []stingle.DeleteEvent{}
+	for albumID := range albumRefs {
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ts > 0 && ts < fs.DeleteHorizon {
+			return nil, nil, ErrUpdateTimestampTooOld
+		}
+		for file, r := range fs.Reactions {
+			for uid, v := range r {
+				if v.DateModified > ts {
+					reactions = append(reactions, stingle.Reaction{
+						AlbumID:      albumID,
+						File:         file,
+						UserID:       number(uid),
+						Content:      v.Content,
+						DateModified: number(v.DateModified),
+					})
+				}
+			}
+		}
+		for _, de := range fs.Deletes {
+			if de.Date > ts && de.Type == stingle.DeleteEventReaction {
+				deletes = append(deletes, stingle.DeleteEvent{
+					File:    de.File,
+					AlbumID: de.AlbumID,
+					Type:    number(int64(de.Type)),
+					Date:    number(de.Date),
+					UserID:  number(de.UserID),
+				})
+			}
+		}
+	}
+	sort.Slice(reactions, func(i, j int) bool { return reactions[i].DateModified < reactions[j].DateModified })
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Date < deletes[j].Date })
+	return reactions, deletes, nil
+}
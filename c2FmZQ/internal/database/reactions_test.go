@@ -0,0 +1,150 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestReactions(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		u, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User(%q): %v", email, err)
+		}
+		users[email] = u
+	}
+	alice, bob := users["alice@"], users["bob@"]
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	for _, f := range []string{"file1", "file2"} {
+		if err := addFile(db, alice, f, stingle.AlbumSet, "album"); err != nil {
+			t.Fatalf("addFile(%q): %v", f, err)
+		}
+	}
+	album := stingle.Album{
+		AlbumID:     "album",
+		IsShared:    "1",
+		Permissions: "1111",
+		Members:     membersString(alice.UserID, bob.UserID),
+	}
+	if err := db.ShareAlbum(alice, &album, map[string]string{fmt.Sprintf("%d", bob.UserID): "key"}); err != nil {
+		t.Fatalf("db.ShareAlbum: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 20000
+	for _, f := range []string{"file1", "file2"} {
+		if err := db.SetReaction(alice, "album", f, "alice's reaction"); err != nil {
+			t.Fatalf("alice db.SetReaction(%q): %v", f, err)
+		}
+		if err := db.SetReaction(bob, "album", f, "bob's reaction"); err != nil {
+			t.Fatalf("bob db.SetReaction(%q): %v", f, err)
+		}
+	}
+	if err := db.SetReaction(bob, "album", "nonexistent", "x"); err == nil {
+		t.Error("db.SetReaction(nonexistent) succeeded unexpectedly")
+	}
+	reactions, _, err := db.ReactionUpdates(alice, 0)
+	if err != nil {
+		t.Fatalf("db.ReactionUpdates: %v", err)
+	}
+	if len(reactions) != 4 {
+		t.Errorf("ReactionUpdates returned %d reactions, want 4", len(reactions))
+	}
+
+	// Moving a file out of the album removes its reactions.
+	database.CurrentTimeForTesting = 30000
+	if err := db.MoveFile(alice, database.MoveFileParams{
+		SetFrom:     stingle.AlbumSet,
+		SetTo:       stingle.GallerySet,
+		AlbumIDFrom: "album",
+		IsMoving:    true,
+		Filenames:   []string{"file2"},
+	}); err != nil {
+		t.Fatalf("db.MoveFile: %v", err)
+	}
+	if reactions, _, err = db.ReactionUpdates(alice, 0); err != nil {
+		t.Fatalf("db.ReactionUpdates: %v", err)
+	}
+	if len(reactions) != 2 {
+		t.Errorf("ReactionUpdates returned %d reactions, want 2", len(reactions))
+	}
+
+	// Removing a member removes their reactions.
+	database.CurrentTimeForTesting = 40000
+	if err := db.RemoveAlbumMember(alice, "album", bob.UserID); err != nil {
+		t.Fatalf("db.RemoveAlbumMember: %v", err)
+	}
+	reactions, deletes, err := db.ReactionUpdates(alice, 30000)
+	if err != nil {
+		t.Fatalf("db.ReactionUpdates: %v", err)
+	}
+	if len(reactions) != 0 {
+		t.Errorf("ReactionUpdates returned %d reactions, want 0", len(reactions))
+	}
+	if len(deletes) != 1 || deletes[0].File != "file1" || deletes[0].UserID != json.Number(fmt.Sprintf("%d", bob.UserID)) {
+		t.Errorf("ReactionUpdates returned unexpected deletes %v", deletes)
+	}
+}
+
+func TestReactionLimits(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addAlbum(db, alice, "album"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	if err := addFile(db, alice, "file1", stingle.AlbumSet, "album"); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+	big := make([]byte, 1000)
+	if err := db.SetReaction(alice, "album", "file1", string(big)); err != database.ErrReactionTooLarge {
+		t.Errorf("db.SetReaction() = %v, want ErrReactionTooLarge", err)
+	}
+	if err := db.SetReaction(alice, "album", "file1", "x"); err != nil {
+		t.Errorf("db.SetReaction() = %v", err)
+	}
+	if err := db.SetReaction(alice, "album", "file1", ""); err != nil {
+		t.Errorf("db.SetReaction() = %v", err)
+	}
+	if reactions, deletes, err := db.ReactionUpdates(alice, 0); err != nil || len(reactions) != 0 || len(deletes) != 1 {
+		t.Errorf("db.ReactionUpdates() = %v, %v, %v", reactions, deletes, err)
+	}
+}
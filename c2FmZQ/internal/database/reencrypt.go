@@ -0,0 +1,356 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/secure"
+)
+
+const (
+	// The state of an interrupted re-encryption, in the database directory.
+	reEncryptStateFile = "reencrypt-state.json"
+	// How often the state is saved while the files are re-encrypted.
+	reEncryptCheckpointInterval = 10 * time.Second
+
+	reEncryptPhaseFiles = "files"
+	reEncryptPhaseUsers = "users"
+)
+
+// ReEncryptOptions contains the options of ReEncrypt.
+type ReEncryptOptions struct {
+	// Algorithm is the encryption algorithm of the new master key, e.g.
+	// crypto.AES256 or crypto.PickByHardware. It is ignored when an
+	// interrupted re-encryption is resumed.
+	Algorithm int
+	// BytesPerSecond limits the rate at which the data is re-encrypted.
+	// Zero means no limit.
+	BytesPerSecond int
+	// Workers is the number of files that are re-encrypted concurrently.
+	// The default is 10.
+	Workers int
+}
+
+// reEncryptState is saved in reEncryptStateFile so that an interrupted
+// re-encryption can be resumed. It only contains the relative paths of the
+// files, which are already hashed.
+type reEncryptState struct {
+	// The current phase: reEncryptPhaseFiles while the files are
+	// re-encrypted, then reEncryptPhaseUsers after the new master key is
+	// installed.
+	Phase string          `json:"phase"`
+	Files []reEncryptFile `json:"files"`
+}
+
+type reEncryptFile struct {
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	Done bool   `json:"done,omitempty"`
+}
+
+// ReEncryptInProgress returns true if dir contains an interrupted
+// re-encryption.
+func ReEncryptInProgress(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, reEncryptStateFile))
+	return err == nil
+}
+
+// ReEncrypt re-encrypts all the data in dir with a new master key. The server
+// must not be running. The progress is saved regularly, and when ctx is
+// canceled or when some files can't be re-encrypted, ReEncrypt returns an
+// error. Calling it again resumes from where it stopped.
+//
+// The new master key is saved in master.key.new, and only replaces the old
+// one after all the files are re-encrypted. The old key is kept in
+// master.key.old until the user records are updated.
+//
+// The files are the ones listed by FileIterator. The values in the user
+// records that are encrypted with the master key are re-encrypted too. The
+// metadata snapshots can't be migrated: the existing ones can only be
+// restored with the old master key, and CreateMetadataSnapshot returns
+// ErrSnapshotKeyMismatch until it uses a new location. The ETags of the
+// files change, so the clients download their thumbnails again.
+func ReEncrypt(ctx context.Context, dir string, passphrase []byte, opts ReEncryptOptions) error {
+	if len(passphrase) == 0 {
+		return errors.New("the database isn't encrypted")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 10
+	}
+	mkFile := filepath.Join(dir, "master.key")
+	stateFile := filepath.Join(dir, reEncryptStateFile)
+
+	var state reEncryptState
+	if b, err := os.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return fmt.Errorf("%s: %w", reEncryptStateFile, err)
+		}
+		log.Infof("Resuming re-encryption (%s)", state.Phase)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if err := startReEncrypt(dir, passphrase, opts.Algorithm, &state); err != nil {
+		return err
+	}
+
+	if state.Phase == reEncryptPhaseFiles {
+		oldKey, err := crypto.ReadMasterKey(passphrase, mkFile)
+		if err != nil {
+			return err
+		}
+		defer oldKey.Wipe()
+		newKey, err := crypto.ReadMasterKey(passphrase, mkFile+".new")
+		if err != nil {
+			return err
+		}
+		defer newKey.Wipe()
+		if err := reEncryptFiles(ctx, dir, oldKey, newKey, opts, &state); err != nil {
+			return err
+		}
+		state.Phase = reEncryptPhaseUsers
+		if err := saveReEncryptState(stateFile, &state); err != nil {
+			return err
+		}
+	}
+	if err := installNewMasterKey(mkFile); err != nil {
+		return err
+	}
+	if err := reEncryptUsers(dir, passphrase); err != nil {
+		return err
+	}
+	if err := os.Remove(mkFile + ".old"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Info("All files re-encrypted successfully")
+	return os.Remove(stateFile)
+}
+
+// startReEncrypt creates the new master key, and lists all the files to
+// re-encrypt with their new names.
+func startReEncrypt(dir string, passphrase []byte, alg int, state *reEncryptState) error {
+	newKey, err := crypto.CreateMasterKey(alg)
+	if err != nil {
+		return err
+	}
+	defer newKey.Wipe()
+	if err := newKey.Save(passphrase, filepath.Join(dir, "master.key.new")); err != nil {
+		return err
+	}
+	db := NewWithOptions(dir, passphrase, Options{reEncrypting: true})
+	defer db.Wipe()
+	for f := range db.FileIterator() {
+		rf := reEncryptFile{Old: f.RelativePath, New: f.RelativePath}
+		if f.LogicalPath != "" {
+			h := newKey.Hash([]byte(f.LogicalPath))
+			rf.New = filepath.Join(fmt.Sprintf("%02X", h[0]), base64.RawURLEncoding.EncodeToString(h))
+		}
+		state.Files = append(state.Files, rf)
+	}
+	state.Phase = reEncryptPhaseFiles
+	log.Infof("Re-encrypting %d files", len(state.Files))
+	return saveReEncryptState(filepath.Join(dir, reEncryptStateFile), state)
+}
+
+// reEncryptFiles re-encrypts the files that aren't done yet, and saves the
+// state regularly.
+func reEncryptFiles(ctx context.Context, dir string, oldKey, newKey crypto.EncryptionKey, opts ReEncryptOptions, state *reEncryptState) error {
+	var throttle func(int)
+	if opts.BytesPerSecond > 0 {
+		burst := opts.BytesPerSecond
+		if burst < 64*1024 {
+			burst = 64 * 1024
+		}
+		rl := rate.NewLimiter(rate.Limit(opts.BytesPerSecond), burst)
+		throttle = func(n int) {
+			rl.WaitN(context.Background(), n)
+		}
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+	in := make(chan int)
+	out := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range in {
+				f := state.Files[i]
+				out <- result{i, secure.ReEncryptFile(dir, f.Old, f.New, oldKey, newKey, throttle)}
+			}
+		}()
+	}
+	go func() {
+		defer close(in)
+		for i := range state.Files {
+			if state.Files[i].Done {
+				continue
+			}
+			select {
+			case in <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	stateFile := filepath.Join(dir, reEncryptStateFile)
+	lastSave := time.Now()
+	var errCount, doneCount int
+	for res := range out {
+		if res.err != nil {
+			errCount++
+			log.Errorf("%s: %v", state.Files[res.index].Old, res.err)
+			continue
+		}
+		state.Files[res.index].Done = true
+		if doneCount++; doneCount%100 == 0 {
+			log.Infof("%d done", doneCount)
+		}
+		if time.Since(lastSave) > reEncryptCheckpointInterval {
+			if err := saveReEncryptState(stateFile, state); err != nil {
+				return err
+			}
+			lastSave = time.Now()
+		}
+	}
+	log.Infof("%d done", doneCount)
+	if err := saveReEncryptState(stateFile, state); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if errCount > 0 {
+		return fmt.Errorf("%d file(s) could not be re-encrypted, run again to retry", errCount)
+	}
+	return nil
+}
+
+// installNewMasterKey replaces the master key with the new one, and keeps the
+// old one in master.key.old. It can be called again after an interruption.
+func installNewMasterKey(mkFile string) error {
+	if _, err := os.Stat(mkFile + ".new"); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := os.Stat(mkFile + ".old"); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(mkFile, mkFile+".old"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(mkFile+".new", mkFile)
+}
+
+// reEncryptUsers re-encrypts the keys in the user records, which are encrypted
+// with the master key directly. The values that were already re-encrypted are
+// left alone.
+func reEncryptUsers(dir string, passphrase []byte) error {
+	oldKey, err := crypto.ReadMasterKey(passphrase, filepath.Join(dir, "master.key.old"))
+	if err != nil {
+		return err
+	}
+	defer oldKey.Wipe()
+	db := NewWithOptions(dir, passphrase, Options{reEncrypting: true})
+	defer db.Wipe()
+
+	reEncryptString := func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+		if k, err := db.masterKey.Decrypt(b); err == nil {
+			// Already re-encrypted.
+			for i := range k {
+				k[i] = 0
+			}
+			return s, nil
+		}
+		k, err := oldKey.Decrypt(b)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			for i := range k {
+				k[i] = 0
+			}
+		}()
+		return db.Encrypt(k)
+	}
+	uids, err := db.UserIDs()
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		u, err := db.UserByID(uid)
+		if err != nil {
+			return err
+		}
+		if u.ServerSecretKey, err = reEncryptString(u.ServerSecretKey); err != nil {
+			return err
+		}
+		if u.TokenKey, err = reEncryptString(u.TokenKey); err != nil {
+			return err
+		}
+		for i := range u.PrevTokenKeys {
+			if u.PrevTokenKeys[i], err = reEncryptString(u.PrevTokenKeys[i]); err != nil {
+				return err
+			}
+		}
+		for _, v := range u.Decoys {
+			if v.Password, err = reEncryptString(v.Password); err != nil {
+				return err
+			}
+		}
+		if err := db.UpdateUser(u); err != nil {
+			return err
+		}
+		log.Infof("Updated user %d", uid)
+	}
+	return nil
+}
+
+// saveReEncryptState saves the state atomically.
+func saveReEncryptState(file string, state *reEncryptState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
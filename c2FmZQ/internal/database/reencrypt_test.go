@@ -0,0 +1,140 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/cluster"
+	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestReEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	pp := []byte("passphrase")
+	db := database.NewWithOptions(dir, pp, database.Options{EncryptionAlgorithm: "aes256"})
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	files := []string{"file1", "file2", "file3"}
+	for _, f := range files {
+		if err := addFile(db, user, f, stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile(%q) failed: %v", f, err)
+		}
+	}
+	if err := addAlbum(db, user, "album1"); err != nil {
+		t.Fatalf("addAlbum failed: %v", err)
+	}
+	link, _, err := db.CreateShareLink(user, "album1", 0)
+	if err != nil {
+		t.Fatalf("CreateShareLink failed: %v", err)
+	}
+	remote, err := cluster.NewRemoteStore("file://" + t.TempDir())
+	if err != nil {
+		t.Fatalf("NewRemoteStore: %v", err)
+	}
+	if _, err := db.CreateMetadataSnapshot(remote, 1); err != nil {
+		t.Fatalf("CreateMetadataSnapshot failed: %v", err)
+	}
+	db.Wipe()
+
+	// An interrupted re-encryption is resumed by the next call.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := database.ReEncryptOptions{Algorithm: crypto.Chacha20Poly1305, Workers: 1}
+	if err := database.ReEncrypt(ctx, dir, pp, opts); err != context.Canceled {
+		t.Fatalf("ReEncrypt() = %v, want %v", err, context.Canceled)
+	}
+	if !database.ReEncryptInProgress(dir) {
+		t.Fatal("ReEncryptInProgress() = false")
+	}
+	opts.Algorithm = crypto.AES256
+	opts.BytesPerSecond = 1 << 20
+	if err := database.ReEncrypt(context.Background(), dir, pp, opts); err != nil {
+		t.Fatalf("ReEncrypt() failed: %v", err)
+	}
+	if database.ReEncryptInProgress(dir) {
+		t.Fatal("ReEncryptInProgress() = true")
+	}
+	for _, f := range []string{"master.key.new", "master.key.old"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", f, err)
+		}
+	}
+	mk, err := crypto.ReadMasterKey(pp, filepath.Join(dir, "master.key"))
+	if err != nil {
+		t.Fatalf("ReadMasterKey failed: %v", err)
+	}
+	alg, _ := crypto.KeyAlgo(mk)
+	mk.Wipe()
+	if alg != crypto.Chacha20Poly1305 {
+		t.Errorf("Master key algorithm = %d, want %d", alg, crypto.Chacha20Poly1305)
+	}
+
+	db = database.New(dir, pp)
+	defer db.Wipe()
+	if user, err = db.User(email); err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	tk, err := db.TokenKeyForUser(email)
+	if err != nil {
+		t.Fatalf("TokenKeyForUser failed: %v", err)
+	}
+	tk.Wipe()
+	// The old snapshots can't be updated with the new master key, and they
+	// are left alone.
+	if _, err := db.CreateMetadataSnapshot(remote, 1); err != database.ErrSnapshotKeyMismatch {
+		t.Errorf("CreateMetadataSnapshot() = %v, want %v", err, database.ErrSnapshotKeyMismatch)
+	}
+	if list, err := database.ListMetadataSnapshots(remote, pp); err != nil || len(list) != 1 {
+		t.Errorf("ListMetadataSnapshots() = %v, %v, want 1 snapshot", list, err)
+	}
+	if album, err := db.SharedAlbum(link); err != nil || album.AlbumID != "album1" {
+		t.Errorf("SharedAlbum(%q) = %+v, %v", link, album, err)
+	}
+	if n := numFilesInSet(t, db, user, stingle.AlbumSet, "album1"); n != 0 {
+		t.Errorf("Unexpected number of files in album: %d", n)
+	}
+	for _, f := range files {
+		r, err := db.DownloadFile(user, stingle.GallerySet, f, false)
+		if err != nil {
+			t.Fatalf("DownloadFile(%q) failed: %v", f, err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if got, want := string(b), "file content "+f; got != want {
+			t.Errorf("DownloadFile(%q) = %q, want %q", f, got, want)
+		}
+	}
+}
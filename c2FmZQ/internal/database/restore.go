@@ -0,0 +1,327 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/stingle"
+)
+
+// UserRestoreReport describes the changes made by RestoreUserFromSnapshot.
+type UserRestoreReport struct {
+	// Snapshot is the name of the snapshot that was used.
+	Snapshot string
+	// RestoredFiles is the number of files that were put back in a file
+	// set.
+	RestoredFiles int
+	// RemovedFiles is the number of files that were removed from a file set
+	// where they weren't at the time of the snapshot.
+	RemovedFiles int
+	// RestoredAlbums contains the IDs of the albums that were re-created.
+	RestoredAlbums []string
+	// Unrecoverable lists what couldn't be restored.
+	Unrecoverable []UnrecoverableItem
+}
+
+// UnrecoverableItem is a file, or an album, that couldn't be restored.
+type UnrecoverableItem struct {
+	Set     string
+	AlbumID string
+	File    string
+	Reason  string
+}
+
+// setKey identifies one of the user's file sets.
+type setKey struct {
+	set     string
+	albumID string
+}
+
+// RestoreUserFromSnapshot rolls back the file sets of one user, i.e. the
+// gallery, the trash, and the albums that the user owns, to their state at
+// the time of the metadata snapshot called name. This can be used to recover
+// from an accidental mass delete.
+//
+// Only the files that existed at the time of the snapshot are affected. They
+// are moved back to the file sets where they were, and the files that were
+// added after the snapshot are left alone. The albums that were deleted are
+// re-created. The content of the files must still be present, i.e. referenced
+// by another file, or not yet deleted. Everything that can't be restored is
+// listed in the report. Quotas and album limits aren't enforced.
+//
+// With dryRun, the report is returned without making any changes.
+func (d *Database) RestoreUserFromSnapshot(user User, remote secure.BlobStore, name string, dryRun bool) (*UserRestoreReport, error) {
+	defer recordLatency("RestoreUserFromSnapshot")()
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+	if d.readOnly && !dryRun {
+		return nil, ErrReadOnly
+	}
+	snap, err := d.openMetadataSnapshot(remote, name)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	report := &UserRestoreReport{Snapshot: snap.Name}
+
+	// The user's file sets at the time of the snapshot.
+	old := make(map[setKey]*FileSet)
+	for _, set := range []string{stingle.GallerySet, stingle.TrashSet} {
+		var fs FileSet
+		if err := snap.read(d.fileSetPath(user, set), &fs); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("user %d isn't in snapshot %s", user.UserID, snap.Name)
+			}
+			return nil, err
+		}
+		old[setKey{set: set}] = &fs
+	}
+	var oldManifest AlbumManifest
+	if err := snap.read(d.filePath(user.home(albumManifest)), &oldManifest); err != nil {
+		return nil, err
+	}
+	for albumID, ref := range oldManifest.Albums {
+		var fs FileSet
+		if err := snap.read(ref.File, &fs); err != nil {
+			return nil, fmt.Errorf("album %s: %w", albumID, err)
+		}
+		if fs.Album != nil && fs.Album.OwnerID == user.UserID {
+			old[setKey{stingle.AlbumSet, albumID}] = &fs
+		}
+	}
+	inSnapshot := make(map[string]bool)
+	for _, fs := range old {
+		for name := range fs.Files {
+			inSnapshot[name] = true
+		}
+	}
+
+	unlock, err := d.lockFileSets(user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// The user's file sets now.
+	keys := []setKey{{set: stingle.GallerySet}, {set: stingle.TrashSet}}
+	refs, err := d.AlbumRefs(user)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool)
+	for albumID := range refs {
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, err
+		}
+		if fs.Album != nil && fs.Album.OwnerID == user.UserID {
+			owned[albumID] = true
+			keys = append(keys, setKey{stingle.AlbumSet, albumID})
+		}
+	}
+	sets := make([]string, len(keys))
+	albumIDs := make([]string, len(keys))
+	for i, k := range keys {
+		sets[i], albumIDs[i] = k.set, k.albumID
+	}
+	commit, fileSets, err := d.fileSetsForUpdate(user, sets, albumIDs)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			commit(false, nil)
+		}
+	}()
+	current := make(map[setKey]*FileSet)
+	for i, k := range keys {
+		current[k] = fileSets[i]
+	}
+
+	// The albums that were deleted since the snapshot.
+	now := nowInMS()
+	var newAlbums []setKey
+	for k, fs := range old {
+		if k.set != stingle.AlbumSet || owned[k.albumID] {
+			continue
+		}
+		if _, exists := refs[k.albumID]; exists {
+			report.Unrecoverable = append(report.Unrecoverable, UnrecoverableItem{Set: k.set, AlbumID: k.albumID, Reason: "album ID is used by another album"})
+			continue
+		}
+		album := *fs.Album
+		album.DateModified = now
+		album.Members = make(map[int64]bool)
+		album.SharingKeys = make(map[int64]string)
+		for m := range fs.Album.Members {
+			if _, err := d.UserByID(m); err != nil {
+				report.Unrecoverable = append(report.Unrecoverable, UnrecoverableItem{Set: k.set, AlbumID: k.albumID, Reason: fmt.Sprintf("member %d no longer exists", m)})
+				continue
+			}
+			album.Members[m] = true
+			if sk, ok := fs.Album.SharingKeys[m]; ok {
+				album.SharingKeys[m] = sk
+			}
+		}
+		current[k] = &FileSet{Album: &album, Files: make(map[string]*FileSpec), Deletes: []DeleteEvent{}}
+		newAlbums = append(newAlbums, k)
+	}
+	sort.Slice(newAlbums, func(i, j int) bool { return newAlbums[i].albumID < newAlbums[j].albumID })
+
+	// The changes to the reference counts of the blobs.
+	refCounts := make(map[string]int)
+	for k, fs := range current {
+		var want map[string]*FileSpec
+		if o := old[k]; o != nil {
+			want = o.Files
+		}
+		for name, f := range fs.Files {
+			if _, ok := want[name]; ok || !inSnapshot[name] {
+				continue
+			}
+			delete(fs.Files, name)
+			delete(fs.Reactions, name)
+			fs.Deletes = append(fs.Deletes, restoreDeleteEvent(k, name, now))
+			for _, blob := range f.blobs() {
+				refCounts[blob]--
+			}
+			report.RemovedFiles++
+		}
+		for name, f := range want {
+			cur := fs.Files[name]
+			if cur != nil && cur.StoreFile == f.StoreFile && cur.StoreThumb == f.StoreThumb && cur.StoreMedium == f.StoreMedium {
+				continue
+			}
+			if !d.blobsExist(f.blobs()) {
+				report.Unrecoverable = append(report.Unrecoverable, UnrecoverableItem{Set: k.set, AlbumID: k.albumID, File: name, Reason: "content was deleted"})
+				continue
+			}
+			if cur != nil {
+				for _, blob := range cur.blobs() {
+					refCounts[blob]--
+				}
+			}
+			nf := *f
+			nf.DateModified = now
+			fs.Files[name] = &nf
+			for _, blob := range f.blobs() {
+				refCounts[blob]++
+			}
+			report.RestoredFiles++
+		}
+		pruneDeleteEvents(&fs.Deletes, &fs.DeleteHorizon)
+	}
+	sort.Slice(report.Unrecoverable, func(i, j int) bool {
+		a, b := report.Unrecoverable[i], report.Unrecoverable[j]
+		if a.Set != b.Set {
+			return a.Set < b.Set
+		}
+		if a.AlbumID != b.AlbumID {
+			return a.AlbumID < b.AlbumID
+		}
+		return a.File < b.File
+	})
+	if dryRun {
+		for _, k := range newAlbums {
+			report.RestoredAlbums = append(report.RestoredAlbums, k.albumID)
+		}
+		return report, nil
+	}
+
+	// The reference counts are increased first so that no blob is deleted
+	// while it is moved around. If anything fails after that, the worst
+	// that can happen is that some blobs are never deleted.
+	for blob, n := range refCounts {
+		if n > 0 {
+			d.incRefCount(blob, n)
+		}
+	}
+	for _, k := range newAlbums {
+		fs := current[k]
+		ap, err := d.makeAlbumPath()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.storage.SaveDataFile(ap, fs); err != nil {
+			return nil, err
+		}
+		if err := d.addAlbumRef(user.UserID, k.albumID, ap); err != nil {
+			return nil, err
+		}
+		for m := range fs.Album.Members {
+			if m == user.UserID {
+				continue
+			}
+			if err := d.addAlbumRef(m, k.albumID, ap); err != nil {
+				log.Errorf("addAlbumRef(%d, %q) failed: %v", m, k.albumID, err)
+			}
+		}
+		report.RestoredAlbums = append(report.RestoredAlbums, k.albumID)
+	}
+	committed = true
+	if err := commit(true, nil); err != nil {
+		return nil, err
+	}
+	for blob, n := range refCounts {
+		if n < 0 {
+			d.incRefCount(blob, n)
+		}
+	}
+	log.Infof("Restored user %d from snapshot %s: %d files restored, %d files removed, %d albums re-created, %d unrecoverable", user.UserID, snap.Name, report.RestoredFiles, report.RemovedFiles, len(report.RestoredAlbums), len(report.Unrecoverable))
+	return report, nil
+}
+
+// blobExists returns true if the blob is still referenced, i.e. its content
+// hasn't been deleted.
+func (d *Database) blobExists(blob string) bool {
+	_, err := os.Stat(filepath.Join(d.dir, d.blobRef(blob)))
+	return err == nil
+}
+
+// blobsExist returns true if all the blobs still exist.
+func (d *Database) blobsExist(blobs []string) bool {
+	for _, blob := range blobs {
+		if !d.blobExists(blob) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreDeleteEvent returns the event that tells the clients that a file was
+// removed from a file set.
+func restoreDeleteEvent(k setKey, name string, now int64) DeleteEvent {
+	de := DeleteEvent{File: name, AlbumID: k.albumID, Date: now}
+	switch k.set {
+	case stingle.GallerySet:
+		de.Type = stingle.DeleteEventGallery
+	case stingle.TrashSet:
+		de.Type = stingle.DeleteEventTrash
+	default:
+		de.Type = stingle.DeleteEventAlbumFile
+	}
+	return de
+}
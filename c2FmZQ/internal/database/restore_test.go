@@ -0,0 +1,146 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"c2FmZQ/internal/cluster"
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestRestoreUserFromSnapshot(t *testing.T) {
+	db := database.New(t.TempDir(), []byte("passphrase"))
+	remote, err := cluster.NewRemoteStore("file://" + t.TempDir())
+	if err != nil {
+		t.Fatalf("NewRemoteStore: %v", err)
+	}
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	for _, f := range []string{"file1", "file2", "file3"} {
+		if err := addFile(db, alice, f, stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile(%q): %v", f, err)
+		}
+	}
+	if err := addAlbum(db, alice, "album1"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	move := func(p database.MoveFileParams) {
+		t.Helper()
+		if err := db.MoveFile(alice, p); err != nil {
+			t.Fatalf("db.MoveFile(%+v): %v", p, err)
+		}
+	}
+	move(database.MoveFileParams{SetFrom: stingle.GallerySet, SetTo: stingle.AlbumSet, AlbumIDTo: "album1", Filenames: []string{"file3"}})
+
+	snap, err := db.CreateMetadataSnapshot(remote, 5)
+	if err != nil {
+		t.Fatalf("CreateMetadataSnapshot: %v", err)
+	}
+
+	// Accidents happen.
+	move(database.MoveFileParams{SetFrom: stingle.GallerySet, SetTo: stingle.TrashSet, IsMoving: true, Filenames: []string{"file1", "file2"}})
+	if err := db.DeleteFiles(alice, []string{"file2"}); err != nil {
+		t.Fatalf("db.DeleteFiles: %v", err)
+	}
+	if err := db.DeleteAlbum(alice, "album1"); err != nil {
+		t.Fatalf("db.DeleteAlbum: %v", err)
+	}
+	if err := addFile(db, alice, "file4", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+
+	fileNames := func(set, albumID string) []string {
+		t.Helper()
+		fs, err := db.FileSet(alice, set, albumID)
+		if err != nil {
+			t.Fatalf("db.FileSet(%q, %q): %v", set, albumID, err)
+		}
+		var names []string
+		for n := range fs.Files {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	want := &database.UserRestoreReport{
+		Snapshot:       snap.Name,
+		RestoredFiles:  2,
+		RemovedFiles:   1,
+		RestoredAlbums: []string{"album1"},
+		Unrecoverable: []database.UnrecoverableItem{
+			{Set: stingle.GallerySet, File: "file2", Reason: "content was deleted"},
+		},
+	}
+	report, err := db.RestoreUserFromSnapshot(alice, remote, snap.Name, true)
+	if err != nil {
+		t.Fatalf("RestoreUserFromSnapshot(dryRun): %v", err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("RestoreUserFromSnapshot(dryRun) = %+v, want %+v", report, want)
+	}
+	if got, want := fileNames(stingle.TrashSet, ""), []string{"file1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Trash after dry run = %v, want %v", got, want)
+	}
+
+	if report, err = db.RestoreUserFromSnapshot(alice, remote, snap.Name, false); err != nil {
+		t.Fatalf("RestoreUserFromSnapshot: %v", err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("RestoreUserFromSnapshot = %+v, want %+v", report, want)
+	}
+	for _, tc := range []struct {
+		set, albumID string
+		want         []string
+	}{
+		{stingle.GallerySet, "", []string{"file1", "file3", "file4"}},
+		{stingle.TrashSet, "", nil},
+		{stingle.AlbumSet, "album1", []string{"file3"}},
+	} {
+		if got := fileNames(tc.set, tc.albumID); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("FileSet(%q, %q) = %v, want %v", tc.set, tc.albumID, got, tc.want)
+		}
+	}
+
+	// The content of the restored files is still there.
+	for _, name := range []string{"file1", "file3"} {
+		r, err := db.DownloadFile(alice, stingle.GallerySet, name, false)
+		if err != nil {
+			t.Errorf("DownloadFile(%q): %v", name, err)
+			continue
+		}
+		r.Close()
+	}
+
+	// Restoring again is a no-op.
+	if report, err = db.RestoreUserFromSnapshot(alice, remote, snap.Name, false); err != nil {
+		t.Fatalf("RestoreUserFromSnapshot: %v", err)
+	}
+	if report.RestoredFiles != 0 || report.RemovedFiles != 0 || len(report.RestoredAlbums) != 0 {
+		t.Errorf("Second RestoreUserFromSnapshot = %+v", report)
+	}
+}
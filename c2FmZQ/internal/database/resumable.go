@@ -0,0 +1,329 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	uploadSessionsFile = "upload-sessions.dat"
+
+	// The directory where the chunks of resumable uploads are kept until
+	// the upload is finished.
+	uploadChunkDir = "uploads/resumable"
+
+	// Upload sessions that are not updated for this long are discarded,
+	// along with their chunks.
+	uploadSessionExpiration = 24 * time.Hour
+)
+
+var (
+	// ErrUploadNotFound indicates that the upload session doesn't exist, or
+	// that it expired.
+	ErrUploadNotFound = errors.New("upload session not found")
+	// ErrUploadOffset indicates that a chunk doesn't start where the
+	// previous one ended, e.g. when the client didn't see the response of
+	// the last chunk it sent. The client should ask for the current offset
+	// and resume from there.
+	ErrUploadOffset = errors.New("unexpected upload offset")
+	// ErrUploadSize indicates that the uploaded content is larger than the
+	// size declared when the session was started, or that it is incomplete
+	// when the upload is finished.
+	ErrUploadSize = errors.New("unexpected upload size")
+)
+
+// UploadSession tracks a resumable upload. The file content is sent in
+// chunks, each starting at the offset where the previous one ended, so that
+// an interrupted upload can resume where it stopped instead of starting over.
+type UploadSession struct {
+	// The ID of the session.
+	ID string `json:"id"`
+	// The time when the session was started.
+	DateCreated int64 `json:"dateCreated"`
+	// The last time the session was updated.
+	DateModified int64 `json:"dateModified"`
+	// The total size of the file content.
+	Size int64 `json:"size"`
+	// The number of bytes received so far.
+	Offset int64 `json:"offset"`
+	// The blobs that contain the chunks received so far, in order.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// uploadSessionList contains all of a user's upload sessions.
+type uploadSessionList struct {
+	Sessions map[string]*UploadSession `json:"sessions"`
+}
+
+// StartUpload creates a new resumable upload session for a file of the given
+// size.
+func (d *Database) StartUpload(user User, size int64) (*UploadSession, error) {
+	defer recordLatency("StartUpload")()
+
+	if size < 0 {
+		return nil, ErrUploadSize
+	}
+	spaceUsed, err := d.SpaceUsed(user)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := d.Quota(user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if spaceUsed+size > quota {
+		return nil, ErrQuotaExceeded
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := nowInMS()
+	session := &UploadSession{
+		ID:           base64.RawURLEncoding.EncodeToString(id),
+		DateCreated:  now,
+		DateModified: now,
+		Size:         size,
+	}
+	err = d.mutateUploadSessions(user, func(list *uploadSessionList) error {
+		list.Sessions[session.ID] = session
+		return nil
+	})
+	return session, err
+}
+
+// UploadSession returns the user's upload session with the given ID.
+func (d *Database) UploadSession(user User, id string) (*UploadSession, error) {
+	defer recordLatency("UploadSession")()
+
+	var list uploadSessionList
+	if err := d.storage.ReadDataFile(d.filePath(user.home(uploadSessionsFile)), &list); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	session, ok := list.Sessions[id]
+	if !ok || isUploadSessionExpired(session) {
+		return nil, ErrUploadNotFound
+	}
+	return session, nil
+}
+
+// AppendUpload adds a chunk of content at offset to the user's upload session.
+// The chunk is written by calling write. The offset must be where the previous
+// chunk ended, i.e. the session's current Offset.
+func (d *Database) AppendUpload(user User, id string, offset int64, write func(io.Writer) (int64, error)) (*UploadSession, error) {
+	defer recordLatency("AppendUpload")()
+
+	session, err := d.UploadSession(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return session, ErrUploadOffset
+	}
+	// The chunk name is unique so that concurrent or retried requests for
+	// the same offset don't interfere with each other.
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, err
+	}
+	chunk := filepath.Join(uploadChunkDir, fmt.Sprintf("%s-%d-%x", id, offset, rnd))
+	temp := chunk + ".tmp"
+	if err := createParentIfNotExist(filepath.Join(d.Dir(), temp)); err != nil {
+		return nil, err
+	}
+	w, err := d.storage.OpenBlobWrite(temp, chunk)
+	if err != nil {
+		return nil, err
+	}
+	lw := &limitedWriter{w: w, n: session.Size - offset}
+	n, err := write(lw)
+	if lw.exceeded {
+		err = ErrUploadSize
+	}
+	if err := w.Close(); err != nil {
+		log.Errorf("AppendUpload: Close: %v", err)
+	}
+	if err == nil && n > 0 {
+		err = d.storage.CommitBlob(temp, chunk)
+	} else {
+		os.Remove(filepath.Join(d.Dir(), temp))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return session, nil
+	}
+	err = d.mutateUploadSessions(user, func(list *uploadSessionList) error {
+		var ok bool
+		if session, ok = list.Sessions[id]; !ok {
+			return ErrUploadNotFound
+		}
+		if session.Offset != offset {
+			// Another request for the same offset won the race.
+			return ErrUploadOffset
+		}
+		session.Chunks = append(session.Chunks, chunk)
+		session.Offset += n
+		session.DateModified = nowInMS()
+		return nil
+	})
+	if err != nil {
+		if err := d.storage.DeleteBlob(chunk); err != nil {
+			log.Errorf("DeleteBlob(%q): %v", chunk, err)
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// FinishUpload assembles the chunks of a complete upload session into a
+// temporary file that can be passed to AddFile as FileSpec.StoreFile. The
+// session is removed. It returns the name and size of the temporary file.
+func (d *Database) FinishUpload(user User, id string) (string, int64, error) {
+	defer recordLatency("FinishUpload")()
+
+	session, err := d.UploadSession(user, id)
+	if err != nil {
+		return "", 0, err
+	}
+	if session.Offset != session.Size {
+		return "", 0, ErrUploadSize
+	}
+	// Remove the session first so that it can only be finished once.
+	err = d.mutateUploadSessions(user, func(list *uploadSessionList) error {
+		if _, ok := list.Sessions[id]; !ok {
+			return ErrUploadNotFound
+		}
+		delete(list.Sessions, id)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer d.deleteUploadChunks(session)
+
+	w, name, err := d.TempFile("uploads")
+	if err != nil {
+		return "", 0, err
+	}
+	var size int64
+	for _, chunk := range session.Chunks {
+		r, err := d.storage.OpenBlobRead(chunk)
+		if err != nil {
+			w.Close()
+			os.Remove(name)
+			return "", 0, err
+		}
+		n, err := io.Copy(w, r)
+		r.Close()
+		size += n
+		if err != nil {
+			w.Close()
+			os.Remove(name)
+			return "", 0, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(name)
+		return "", 0, err
+	}
+	if size != session.Size {
+		os.Remove(name)
+		return "", 0, ErrUploadSize
+	}
+	return name, size, nil
+}
+
+// mutateUploadSessions calls f to modify the user's upload sessions. Expired
+// sessions are removed.
+func (d *Database) mutateUploadSessions(user User, f func(*uploadSessionList) error) (retErr error) {
+	fn := d.filePath(user.home(uploadSessionsFile))
+	if err := d.storage.CreateEmptyFile(fn, uploadSessionList{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var list uploadSessionList
+	commit, err := d.storage.OpenForUpdate(fn, &list)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if list.Sessions == nil {
+		list.Sessions = make(map[string]*UploadSession)
+	}
+	var expired []*UploadSession
+	for id, session := range list.Sessions {
+		if isUploadSessionExpired(session) {
+			expired = append(expired, session)
+			delete(list.Sessions, id)
+		}
+	}
+	if err := f(&list); err != nil {
+		return err
+	}
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	for _, session := range expired {
+		d.deleteUploadChunks(session)
+	}
+	return nil
+}
+
+func (d *Database) deleteUploadChunks(session *UploadSession) {
+	for _, chunk := range session.Chunks {
+		if err := d.storage.DeleteBlob(chunk); err != nil {
+			log.Errorf("DeleteBlob(%q): %v", chunk, err)
+		}
+	}
+}
+
+func isUploadSessionExpired(session *UploadSession) bool {
+	return nowInMS()-session.DateModified > uploadSessionExpiration.Milliseconds()
+}
+
+// limitedWriter writes at most n bytes to w. Writing more returns
+// ErrUploadSize.
+type limitedWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > w.n {
+		w.exceeded = true
+		return 0, ErrUploadSize
+	}
+	n, err := w.w.Write(b)
+	w.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,117 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	content := []byte("Hello resumable world!")
+	session, err := db.StartUpload(user, int64(len(content)))
+	if err != nil {
+		t.Fatalf("db.StartUpload failed: %v", err)
+	}
+	appendChunk := func(offset int64, chunk []byte) (*database.UploadSession, error) {
+		return db.AppendUpload(user, session.ID, offset, func(w io.Writer) (int64, error) {
+			n, err := w.Write(chunk)
+			return int64(n), err
+		})
+	}
+	if _, err := appendChunk(0, content[:10]); err != nil {
+		t.Fatalf("appendChunk(0) failed: %v", err)
+	}
+	// The same chunk again, e.g. when the client didn't see the response.
+	if s, err := appendChunk(0, content[:10]); err != database.ErrUploadOffset || s.Offset != 10 {
+		t.Fatalf("appendChunk(0) = %v, %v, want offset 10, %v", s, err, database.ErrUploadOffset)
+	}
+	if _, _, err := db.FinishUpload(user, session.ID); err != database.ErrUploadSize {
+		t.Fatalf("db.FinishUpload() = %v, want %v", err, database.ErrUploadSize)
+	}
+	// More than the declared size.
+	if _, err := appendChunk(10, append(content[10:], 'x')); err != database.ErrUploadSize {
+		t.Fatalf("appendChunk(10) = %v, want %v", err, database.ErrUploadSize)
+	}
+	if s, err := appendChunk(10, content[10:]); err != nil || s.Offset != int64(len(content)) {
+		t.Fatalf("appendChunk(10) = %v, %v", s, err)
+	}
+	if s, err := db.UploadSession(user, session.ID); err != nil || len(s.Chunks) != 2 {
+		t.Fatalf("db.UploadSession() = %v, %v", s, err)
+	}
+
+	name, size, err := db.FinishUpload(user, session.ID)
+	if err != nil {
+		t.Fatalf("db.FinishUpload failed: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("db.FinishUpload() size = %d, want %d", size, len(content))
+	}
+	if _, err := db.UploadSession(user, session.ID); err != database.ErrUploadNotFound {
+		t.Errorf("db.UploadSession() = %v, want %v", err, database.ErrUploadNotFound)
+	}
+	w, thumb, err := db.TempFile("uploads")
+	if err != nil {
+		t.Fatalf("db.TempFile failed: %v", err)
+	}
+	if _, err := w.Write([]byte("thumb content")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs := database.FileSpec{
+		Headers:        "file1-headers",
+		StoreFile:      name,
+		StoreFileSize:  size,
+		StoreThumb:     thumb,
+		StoreThumbSize: 13,
+	}
+	if err := db.AddFile(user, fs, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("db.AddFile failed: %v", err)
+	}
+	r, err := db.DownloadFile(user, stingle.GallerySet, "file1", false)
+	if err != nil {
+		t.Fatalf("db.DownloadFile failed: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("io.ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Unexpected content: got %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// The maximum size of the encrypted content of a seen marker.
+	maxSeenMarkerSize = 512
+)
+
+var (
+	ErrSeenMarkerTooLarge = errors.New("seen marker too large")
+)
+
+// SeenMarker is an album member's end-to-end encrypted "last seen" marker,
+// e.g. the most recent file that they looked at. It lets the owner of a
+// shared album see whether the members have seen the new content.
+type SeenMarker struct {
+	// The encrypted content of the marker.
+	Content string `json:"content"`
+	// The time when the marker was last changed.
+	DateModified int64 `json:"dateModified"`
+}
+
+// SetSeenMarker sets the user's seen marker in an album. The user must be the
+// owner or a member of the album.
+func (d *Database) SetSeenMarker(user User, albumID, content string) (retErr error) {
+	defer recordLatency("SetSeenMarker")()
+
+	if len(content) > maxSeenMarkerSize {
+		return ErrSeenMarkerTooLarge
+	}
+	commit, fs, err := d.fileSetForUpdate(user, stingle.AlbumSet, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if fs.Album == nil || (fs.Album.OwnerID != user.UserID && !fs.Album.Members[user.UserID]) {
+		return os.ErrPermission
+	}
+	if fs.SeenMarkers == nil {
+		fs.SeenMarkers = make(map[int64]*SeenMarker)
+	}
+	fs.SeenMarkers[user.UserID] = &SeenMarker{
+		Content:      content,
+		DateModified: nowInMS(),
+	}
+	return nil
+}
+
+// SeenMarkerUpdates returns the seen markers that changed in the user's
+// albums since time ts.
+func (d *Database) SeenMarkerUpdates(user User, ts int64) ([]stingle.SeenMarker, error) {
+	defer recordLatency("SeenMarkerUpdates")()
+
+	albumRefs, err := d.AlbumRefs(user)
+	if err != nil {
+		log.Errorf("AlbumRefs(%q) failed: %v", user.Email, err)
+		return nil, err
+	}
+	out := []stingle.SeenMarker{}
+	for albumID := range albumRefs {
+		fs, err := d.FileSet(user, stingle.AlbumSet, albumID)
+		if err != nil {
+			return nil, err
+		}
+		for uid, m := range fs.SeenMarkers {
+			if m.DateModified > ts {
+				out = append(out, stingle.SeenMarker{
+					AlbumID:      albumID,
+					UserID:       number(uid),
+					Content:      m.Content,
+					DateModified: number(m.DateModified),
+				})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DateModified < out[j].DateModified })
+	return out, nil
+}
@@ -0,0 +1,128 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"c2FmZQ/internal/webpush"
+)
+
+const (
+	probeFile = "probe.dat"
+	// selfTestSampleSize is the number of user files that are read by the
+	// self-test.
+	selfTestSampleSize = 10
+)
+
+var (
+	// ErrSelfTestFailed indicates that the data directory doesn't match the
+	// master key, or that its metadata can't be read.
+	ErrSelfTestFailed = errors.New("self-test failed")
+
+	dataDirRE = regexp.MustCompile(`^[0-9A-F]{2}$`)
+)
+
+// probe contains a known value. Since it is encrypted with the master key, it
+// can only be read back with the same key. The value itself doesn't depend on
+// the key so that the probe file survives a change of master key.
+type probe struct {
+	Value []byte `json:"value"`
+}
+
+var probeValue = []byte("c2FmZQ self-test probe")
+
+// createProbeFile creates the probe file, if it doesn't already exist.
+func (d *Database) createProbeFile() error {
+	return d.storage.CreateEmptyFile(d.filePath(probeFile), &probe{Value: probeValue})
+}
+
+// SelfTestError returns the error of the self-test that runs when the
+// database is opened, or nil if it passed.
+func (d *Database) SelfTestError() error {
+	return d.selfTestErr
+}
+
+// selfTest checks that the master key matches the data directory, and that
+// the critical metadata files can be read. It runs before any file is created
+// so that a wrong master key, or the wrong data directory, isn't mistaken for
+// a new database.
+func (d *Database) selfTest() error {
+	var p probe
+	err := d.storage.ReadDataFile(d.filePath(probeFile), &p)
+	switch {
+	case err == nil:
+		if !bytes.Equal(p.Value, probeValue) {
+			return fmt.Errorf("%w: unexpected probe value", ErrSelfTestFailed)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// Either this is a new database, or it was created before the probe
+		// file existed. Either way, there must be a user list if there is
+		// any data.
+		if _, err := os.Stat(filepath.Join(d.dir, d.filePath(userListFile))); errors.Is(err, os.ErrNotExist) && d.hasDataFiles() {
+			return fmt.Errorf("%w: the data directory contains data that wasn't created with this master key", ErrSelfTestFailed)
+		}
+	default:
+		return fmt.Errorf("%w: %s: %v", ErrSelfTestFailed, probeFile, err)
+	}
+
+	var ul []userList
+	for _, f := range []struct {
+		name string
+		obj  interface{}
+	}{
+		{userListFile, &ul},
+		{quotaFile, &Quotas{}},
+		{pushServiceConfigFile, &webpush.PushServiceConfiguration{}},
+	} {
+		if err := d.storage.ReadDataFile(d.filePath(f.name), f.obj); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s: %v", ErrSelfTestFailed, f.name, err)
+		}
+	}
+	for i, n := range rand.Perm(len(ul)) {
+		if i >= selfTestSampleSize {
+			break
+		}
+		var u User
+		if err := d.storage.ReadDataFile(d.filePath(homeByUserID(ul[n].UserID, userFile)), &u); err != nil {
+			return fmt.Errorf("%w: user %d: %v", ErrSelfTestFailed, ul[n].UserID, err)
+		}
+	}
+	return nil
+}
+
+// hasDataFiles returns true if the data directory contains any data or blob
+// files.
+func (d *Database) hasDataFiles() bool {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.IsDir() && dataDirRE.MatchString(e.Name()) {
+			return true
+		}
+	}
+	return false
+}
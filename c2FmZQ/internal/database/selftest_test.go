@@ -0,0 +1,74 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := []byte("passphrase")
+	db := database.New(dir, passphrase)
+	if err := db.SelfTestError(); err != nil {
+		t.Fatalf("New database: SelfTestError() = %v", err)
+	}
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	if err := database.New(dir, passphrase).SelfTestError(); err != nil {
+		t.Fatalf("Existing database: SelfTestError() = %v", err)
+	}
+
+	// Replace the master key with one that has the same passphrase.
+	mkFile := filepath.Join(dir, "master.key")
+	origKey, err := os.ReadFile(mkFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	otherDir := t.TempDir()
+	database.New(otherDir, passphrase)
+	otherKey, err := os.ReadFile(filepath.Join(otherDir, "master.key"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if err := os.WriteFile(mkFile, otherKey, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := database.New(dir, passphrase).SelfTestError(); !errors.Is(err, database.ErrSelfTestFailed) {
+		t.Fatalf("Wrong master key: SelfTestError() = %v, want %v", err, database.ErrSelfTestFailed)
+	}
+
+	// The data wasn't modified by the failed attempt.
+	if err := os.WriteFile(mkFile, origKey, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	db = database.New(dir, passphrase)
+	if err := db.SelfTestError(); err != nil {
+		t.Fatalf("Original master key: SelfTestError() = %v", err)
+	}
+	if _, err := db.User("alice@"); err != nil {
+		t.Errorf("db.User(alice@) failed: %v", err)
+	}
+}
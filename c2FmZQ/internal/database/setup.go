@@ -0,0 +1,124 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+)
+
+const settingsFile = "settings.dat"
+
+// ErrSetupDone is returned when the first-run setup is attempted after an
+// account was created.
+var ErrSetupDone = errors.New("setup already done")
+
+// Settings are the instance options that are saved in the database, e.g. by
+// the first-run setup. The options that aren't set use the server's flags.
+type Settings struct {
+	// AllowCreateAccount is whether new accounts can be created.
+	AllowCreateAccount *bool
+	// AutoApproveNewAccounts is whether new accounts can be used without
+	// an admin's approval.
+	AutoApproveNewAccounts *bool
+}
+
+// settings is the content of the settings file. The options are in a map
+// because encoding/gob doesn't distinguish a pointer to false from nil.
+type settings struct {
+	Options map[string]bool `json:"options"`
+}
+
+func (s settings) get(name string) *bool {
+	if v, ok := s.Options[name]; ok {
+		return &v
+	}
+	return nil
+}
+
+// SetupOptions are the instance options of the first-run setup.
+type SetupOptions struct {
+	Settings
+	// DefaultQuota is the quota of the accounts that don't have their own.
+	// When nil, the default quota doesn't change.
+	DefaultQuota *Limit
+}
+
+// HasUsers returns whether any account was ever created.
+func (d *Database) HasUsers() (bool, error) {
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(ul) > 0, nil
+}
+
+// Settings returns the instance settings.
+func (d *Database) Settings() (Settings, error) {
+	var s settings
+	if err := d.storage.ReadDataFile(d.filePath(settingsFile), &s); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Settings{}, err
+	}
+	return Settings{
+		AllowCreateAccount:     s.get("allowCreateAccount"),
+		AutoApproveNewAccounts: s.get("autoApproveNewAccounts"),
+	}, nil
+}
+
+// CompleteSetup creates the first account, which is an admin, and saves the
+// instance options. It fails with ErrSetupDone when any account exists.
+func (d *Database) CompleteSetup(u User, opts SetupOptions) (userID int64, retErr error) {
+	defer recordLatency("CompleteSetup")()
+
+	if userID, retErr = d.addUser(u, true); retErr != nil {
+		return 0, retErr
+	}
+	var s settings
+	if err := d.storage.CreateEmptyFile(d.filePath(settingsFile), &s); err != nil && !errors.Is(err, os.ErrExist) {
+		return userID, err
+	}
+	commit, err := d.storage.OpenForUpdate(d.filePath(settingsFile), &s)
+	if err != nil {
+		return userID, err
+	}
+	if s.Options == nil {
+		s.Options = make(map[string]bool)
+	}
+	if v := opts.AllowCreateAccount; v != nil {
+		s.Options["allowCreateAccount"] = *v
+	}
+	if v := opts.AutoApproveNewAccounts; v != nil {
+		s.Options["autoApproveNewAccounts"] = *v
+	}
+	if err := commit(true, nil); err != nil {
+		return userID, err
+	}
+	if opts.DefaultQuota == nil {
+		return userID, nil
+	}
+	var quotas Quotas
+	if commit, err = d.storage.OpenForUpdate(d.filePath(quotaFile), &quotas); err != nil {
+		return userID, err
+	}
+	quotas.DefaultLimit = opts.DefaultQuota.Value
+	quotas.DefaultLimitUnit = opts.DefaultQuota.Unit
+	return userID, commit(true, nil)
+}
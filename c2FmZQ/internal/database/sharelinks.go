@@ -0,0 +1,242 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"sort"
+
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// The logical filename where the share links are stored.
+	shareLinksFile = "share-links.dat"
+
+	// The default lifetime of a share link, in milliseconds.
+	defaultShareLinkTTL = 7 * 24 * 3600 * 1000
+	// The maximum lifetime of a share link, in milliseconds.
+	maxShareLinkTTL = 365 * 24 * 3600 * 1000
+)
+
+var (
+	ErrInvalidShareLink  = errors.New("invalid share link")
+	ErrInvalidExpiration = errors.New("invalid expiration time")
+)
+
+// shareLinks maps share link tokens to albums.
+type shareLinks struct {
+	Links map[string]*ShareLink `json:"links"`
+}
+
+// ShareLink is where a public share link points to. Anyone with the link can
+// download the album's files, which are still encrypted. The album's secret
+// key is only in the part of the link that isn't sent to the server.
+type ShareLink struct {
+	OwnerID     int64  `json:"ownerId"`
+	AlbumID     string `json:"albumId"`
+	DateCreated int64  `json:"dateCreated"`
+	// The time when the link stops working, in milliseconds.
+	Expires int64 `json:"expires"`
+}
+
+// SharedAlbum is the content of an album that is seen through a share link.
+type SharedAlbum struct {
+	OwnerID      int64                `json:"-"`
+	AlbumID      string               `json:"albumId"`
+	DateCreated  int64                `json:"dateCreated"`
+	DateModified int64                `json:"dateModified"`
+	Metadata     string               `json:"metadata"`
+	PublicKey    string               `json:"publicKey"`
+	Cover        string               `json:"cover"`
+	Expires      int64                `json:"expires"`
+	Files        []stingle.File       `json:"files"`
+	fileSpecs    map[string]*FileSpec `json:"-"`
+}
+
+// albumAndShareLinksForUpdate opens an album and the share links for update.
+func (d *Database) albumAndShareLinksForUpdate(owner User, albumID string) (func(bool, *error) error, *FileSet, *shareLinks, error) {
+	albumRef, err := d.albumRef(owner, albumID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fn := d.filePath(shareLinksFile)
+	if err := d.storage.CreateEmptyFile(fn, shareLinks{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, nil, err
+	}
+	var fs FileSet
+	var links shareLinks
+	commit, err := d.storage.OpenManyForUpdate([]string{albumRef.File, fn}, []interface{}{&fs, &links})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if links.Links == nil {
+		links.Links = make(map[string]*ShareLink)
+	}
+	if fs.Album == nil || fs.Album.OwnerID != owner.UserID {
+		commit(false, nil)
+		return nil, nil, nil, os.ErrPermission
+	}
+	return commit, &fs, &links, nil
+}
+
+// CreateShareLink creates a new share link token for an album. The link stops
+// working at the expiration time, in milliseconds, which is 7 days from now
+// when expires is 0. Any previous link for the album stops working. Returns the
+// token and the expiration time.
+func (d *Database) CreateShareLink(owner User, albumID string, expires int64) (tok string, exp int64, retErr error) {
+	defer recordLatency("CreateShareLink")()
+
+	now := nowInMS()
+	if expires == 0 {
+		expires = now + defaultShareLinkTTL
+	}
+	if expires <= now || expires > now+maxShareLinkTTL {
+		return "", 0, ErrInvalidExpiration
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", 0, err
+	}
+	tok = base64.RawURLEncoding.EncodeToString(b)
+
+	commit, fs, links, err := d.albumAndShareLinksForUpdate(owner, albumID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer commit(true, &retErr)
+	for k, v := range links.Links {
+		if v.Expires < now {
+			delete(links.Links, k)
+		}
+	}
+	delete(links.Links, fs.Album.ShareLink)
+	links.Links[tok] = &ShareLink{
+		OwnerID:     owner.UserID,
+		AlbumID:     albumID,
+		DateCreated: now,
+		Expires:     expires,
+	}
+	fs.Album.ShareLink = tok
+	fs.Album.ShareLinkExpires = expires
+	return tok, expires, nil
+}
+
+// RevokeShareLink revokes the album's share link.
+func (d *Database) RevokeShareLink(owner User, albumID string) (retErr error) {
+	defer recordLatency("RevokeShareLink")()
+
+	commit, fs, links, err := d.albumAndShareLinksForUpdate(owner, albumID)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	delete(links.Links, fs.Album.ShareLink)
+	fs.Album.ShareLink = ""
+	fs.Album.ShareLinkExpires = 0
+	return nil
+}
+
+// removeShareLink removes a share link, e.g. when the album is deleted.
+func (d *Database) removeShareLink(tok string) (retErr error) {
+	if tok == "" {
+		return nil
+	}
+	var links shareLinks
+	commit, err := d.storage.OpenForUpdate(d.filePath(shareLinksFile), &links)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	delete(links.Links, tok)
+	return nil
+}
+
+// SharedAlbum returns the album that a share link points to, with its files.
+// It returns ErrInvalidShareLink if the link doesn't exist or is expired.
+func (d *Database) SharedAlbum(tok string) (*SharedAlbum, error) {
+	defer recordLatency("SharedAlbum")()
+
+	var links shareLinks
+	if err := d.storage.ReadDataFile(d.filePath(shareLinksFile), &links); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrInvalidShareLink
+		}
+		return nil, err
+	}
+	link, ok := links.Links[tok]
+	if !ok || link.Expires < nowInMS() {
+		return nil, ErrInvalidShareLink
+	}
+	owner, err := d.UserByID(link.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := d.FileSet(owner, stingle.AlbumSet, link.AlbumID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrInvalidShareLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fs.Album.ShareLink != tok {
+		return nil, ErrInvalidShareLink
+	}
+	album := &SharedAlbum{
+		OwnerID:      link.OwnerID,
+		AlbumID:      fs.Album.AlbumID,
+		DateCreated:  fs.Album.DateCreated,
+		DateModified: fs.Album.DateModified,
+		Metadata:     fs.Album.Metadata,
+		PublicKey:    fs.Album.PublicKey,
+		Cover:        fs.Album.Cover,
+		Expires:      link.Expires,
+		Files:        []stingle.File{},
+		fileSpecs:    fs.Files,
+	}
+	for name, f := range fs.Files {
+		album.Files = append(album.Files, stingle.File{
+			File:         name,
+			Version:      f.Version,
+			DateCreated:  number(f.DateCreated),
+			DateModified: number(f.DateModified),
+			Headers:      f.Headers,
+			AlbumID:      fs.Album.AlbumID,
+			HasMedium:    hasMedium(f),
+		})
+	}
+	sort.Slice(album.Files, func(i, j int) bool {
+		return album.Files[i].File < album.Files[j].File
+	})
+	return album, nil
+}
+
+// DownloadSharedFile returns a variant of a file of an album that was returned
+// by SharedAlbum.
+func (d *Database) DownloadSharedFile(album *SharedAlbum, filename string, variant Variant) (*FileReader, error) {
+	defer recordLatency("DownloadSharedFile")()
+
+	fileSpec, ok := album.fileSpecs[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return d.downloadFileSpec(fileSpec, variant)
+}
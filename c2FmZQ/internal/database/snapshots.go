@@ -0,0 +1,475 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/secure"
+)
+
+// The layout of the metadata snapshots in the remote store:
+//
+//	master.key          The master key, encrypted with the passphrase.
+//	index               The list of snapshots, encrypted with the master key.
+//	snapshots/<name>    The manifest of each snapshot, encrypted with the
+//	                    master key.
+//	objects/<hash>      The content of the metadata files. The files are
+//	                    already encrypted, and they are copied as is.
+//
+// The objects are named after the hash of their content, so the files that
+// didn't change since the previous snapshot aren't uploaded again.
+const (
+	snapshotMasterKey   = "master.key"
+	snapshotIndex       = "index"
+	snapshotManifestDir = "snapshots"
+	snapshotObjectDir   = "objects"
+	snapshotNameFormat  = "20060102-150405.000"
+)
+
+var (
+	// ErrNoSnapshot indicates that the requested metadata snapshot doesn't
+	// exist.
+	ErrNoSnapshot = errors.New("no such snapshot")
+	// ErrSnapshotKeyMismatch indicates that the snapshots in the remote
+	// store were made with a different master key, e.g. before the
+	// database was re-encrypted. New snapshots must go to a new location.
+	ErrSnapshotKeyMismatch = errors.New("the snapshots were made with a different master key")
+)
+
+// MetadataSnapshot describes a snapshot of the metadata files.
+type MetadataSnapshot struct {
+	// Name is the unique name of the snapshot, derived from its creation
+	// time.
+	Name string `json:"name"`
+	// Time is when the snapshot was created.
+	Time time.Time `json:"time"`
+	// Files is the number of metadata files in the snapshot.
+	Files int `json:"files"`
+	// Bytes is the total size of the metadata files.
+	Bytes int64 `json:"bytes"`
+	// NewFiles is the number of files that weren't already in the remote
+	// store when the snapshot was created.
+	NewFiles int `json:"newFiles"`
+	// NewBytes is the total size of the new files.
+	NewBytes int64 `json:"newBytes"`
+}
+
+type snapshotIndexFile struct {
+	Snapshots []MetadataSnapshot `json:"snapshots"`
+}
+
+type snapshotManifest struct {
+	// Files maps the relative path of the metadata files to the name of
+	// their object.
+	Files map[string]string `json:"files"`
+}
+
+// CreateMetadataSnapshot copies all the metadata files, i.e. everything except
+// the content of the files and thumbnails, to remote. Only the files that
+// changed since the previous snapshot are uploaded. The oldest snapshots are
+// deleted so that at most retain snapshots are kept.
+//
+// Each file is copied in a consistent state, but the snapshot as a whole isn't
+// atomic. Updates that are made while the snapshot is being created may or may
+// not be included.
+func (d *Database) CreateMetadataSnapshot(remote secure.BlobStore, retain int) (*MetadataSnapshot, error) {
+	defer recordLatency("CreateMetadataSnapshot")()
+	if d.masterKey == nil {
+		return nil, errors.New("metadata snapshots require a master key")
+	}
+	if retain < 1 {
+		retain = 1
+	}
+	var index snapshotIndexFile
+	if err := readSnapshotFile(remote, d.masterKey, snapshotIndex, &index); errors.Is(err, crypto.ErrDecryptFailed) || errors.Is(err, crypto.ErrUnexpectedAlgo) {
+		return nil, ErrSnapshotKeyMismatch
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot index: %w", err)
+	}
+	manifests := make(map[string]*snapshotManifest)
+	objects := make(map[string]bool)
+	for _, s := range index.Snapshots {
+		var m snapshotManifest
+		if err := readSnapshotFile(remote, d.masterKey, path.Join(snapshotManifestDir, s.Name), &m); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", s.Name, err)
+		}
+		manifests[s.Name] = &m
+		for _, obj := range m.Files {
+			objects[obj] = true
+		}
+	}
+	if err := d.putSnapshotMasterKey(remote); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	snap := MetadataSnapshot{Name: now.Format(snapshotNameFormat), Time: now}
+	if _, exists := manifests[snap.Name]; exists {
+		return nil, fmt.Errorf("snapshot %s already exists", snap.Name)
+	}
+	manifest := &snapshotManifest{Files: make(map[string]string)}
+	var firstErr error
+	// The iterator must be drained even when there is an error.
+	for f := range d.FileIterator() {
+		if f.IsBlob || firstErr != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(d.dir, f.RelativePath))
+		if errors.Is(err, os.ErrNotExist) {
+			// The file was deleted after it was listed.
+			continue
+		}
+		if err != nil {
+			firstErr = err
+			continue
+		}
+		obj := path.Join(snapshotObjectDir, hex.EncodeToString(d.masterKey.Hash(b)))
+		if !objects[obj] {
+			if err := remote.Put(obj, bytes.NewReader(b), int64(len(b))); err != nil {
+				firstErr = err
+				continue
+			}
+			objects[obj] = true
+			snap.NewFiles++
+			snap.NewBytes += int64(len(b))
+		}
+		manifest.Files[filepath.ToSlash(f.RelativePath)] = obj
+		snap.Files++
+		snap.Bytes += int64(len(b))
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if _, ok := manifest.Files[filepath.ToSlash(d.filePath(userListFile))]; !ok {
+		return nil, errors.New("the user list is missing from the snapshot")
+	}
+	if err := writeSnapshotFile(remote, d.masterKey, path.Join(snapshotManifestDir, snap.Name), manifest); err != nil {
+		return nil, err
+	}
+	manifests[snap.Name] = manifest
+	index.Snapshots = append(index.Snapshots, snap)
+
+	var expired []MetadataSnapshot
+	if n := len(index.Snapshots) - retain; n > 0 {
+		expired = append(expired, index.Snapshots[:n]...)
+		index.Snapshots = index.Snapshots[n:]
+	}
+	if err := writeSnapshotFile(remote, d.masterKey, snapshotIndex, &index); err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		d.deleteExpiredSnapshots(remote, expired, index.Snapshots, manifests)
+	}
+	return &snap, nil
+}
+
+// deleteExpiredSnapshots deletes the manifests of the expired snapshots, and
+// the objects that aren't used by any of the remaining snapshots. Errors are
+// only logged. The worst that can happen is that some unused files remain in
+// the remote store.
+func (d *Database) deleteExpiredSnapshots(remote secure.BlobStore, expired, remaining []MetadataSnapshot, manifests map[string]*snapshotManifest) {
+	inUse := make(map[string]bool)
+	for _, s := range remaining {
+		for _, obj := range manifests[s.Name].Files {
+			inUse[obj] = true
+		}
+	}
+	deleted := make(map[string]bool)
+	for _, s := range expired {
+		for _, obj := range manifests[s.Name].Files {
+			if inUse[obj] || deleted[obj] {
+				continue
+			}
+			deleted[obj] = true
+			if err := remote.Delete(obj); err != nil {
+				log.Errorf("Delete(%q): %v", obj, err)
+			}
+		}
+		if err := remote.Delete(path.Join(snapshotManifestDir, s.Name)); err != nil {
+			log.Errorf("Delete(%q): %v", s.Name, err)
+		}
+		log.Infof("Deleted metadata snapshot %s", s.Name)
+	}
+}
+
+// putSnapshotMasterKey uploads the encrypted master key, which is needed to
+// restore the snapshots.
+func (d *Database) putSnapshotMasterKey(remote secure.BlobStore) error {
+	b, err := os.ReadFile(filepath.Join(d.dir, "master.key"))
+	if err != nil {
+		return err
+	}
+	return remote.Put(snapshotMasterKey, bytes.NewReader(b), int64(len(b)))
+}
+
+// MetadataSnapshots returns the list of metadata snapshots in remote, from
+// oldest to newest.
+func (d *Database) MetadataSnapshots(remote secure.BlobStore) ([]MetadataSnapshot, error) {
+	if d.masterKey == nil {
+		return nil, errors.New("metadata snapshots require a master key")
+	}
+	var index snapshotIndexFile
+	if err := readSnapshotFile(remote, d.masterKey, snapshotIndex, &index); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return index.Snapshots, nil
+}
+
+// FindMetadataSnapshot returns the most recent metadata snapshot in remote
+// that was created at or before t.
+func (d *Database) FindMetadataSnapshot(remote secure.BlobStore, t time.Time) (*MetadataSnapshot, error) {
+	list, err := d.MetadataSnapshots(remote)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if !list[i].Time.After(t) {
+			return &list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: before %s", ErrNoSnapshot, t.Format(time.RFC3339))
+}
+
+// snapshotReader reads the metadata files of a snapshot without restoring the
+// whole snapshot.
+type snapshotReader struct {
+	MetadataSnapshot
+	remote   secure.BlobStore
+	manifest snapshotManifest
+	dir      string
+	storage  *secure.Storage
+}
+
+// openMetadataSnapshot opens the metadata snapshot called name for reading.
+func (d *Database) openMetadataSnapshot(remote secure.BlobStore, name string) (*snapshotReader, error) {
+	if d.masterKey == nil {
+		return nil, errors.New("metadata snapshots require a master key")
+	}
+	list, err := d.MetadataSnapshots(remote)
+	if err != nil {
+		return nil, err
+	}
+	r := &snapshotReader{remote: remote}
+	for _, s := range list {
+		if s.Name == name {
+			r.MetadataSnapshot = s
+			break
+		}
+	}
+	if r.Name == "" {
+		return nil, fmt.Errorf("%w: %q", ErrNoSnapshot, name)
+	}
+	if err := readSnapshotFile(remote, d.masterKey, path.Join(snapshotManifestDir, name), &r.manifest); err != nil {
+		return nil, err
+	}
+	if r.dir, err = os.MkdirTemp("", "snapshot-*"); err != nil {
+		return nil, err
+	}
+	r.storage = secure.NewStorageWithOptions(r.dir, d.masterKey, secure.Options{ReadOnly: true})
+	return r, nil
+}
+
+// read reads the metadata file rel, a path relative to the database
+// directory, as it was at the time of the snapshot.
+func (r *snapshotReader) read(rel string, obj interface{}) error {
+	name, ok := r.manifest.Files[filepath.ToSlash(rel)]
+	if !ok {
+		return fmt.Errorf("%s: %w", rel, os.ErrNotExist)
+	}
+	b, err := readSnapshotObject(r.remote, name)
+	if err != nil {
+		return err
+	}
+	// The file must have the same relative path to be decrypted.
+	fn := filepath.Join(r.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fn, b, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(fn)
+	return r.storage.ReadDataFile(rel, obj)
+}
+
+// Close deletes the temporary files.
+func (r *snapshotReader) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// ListMetadataSnapshots returns the list of metadata snapshots in remote,
+// from oldest to newest. The passphrase is used to decrypt the master key
+// that is stored with the snapshots.
+func ListMetadataSnapshots(remote secure.BlobStore, passphrase []byte) ([]MetadataSnapshot, error) {
+	mk, _, err := readSnapshotMasterKey(remote, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer mk.Wipe()
+	var index snapshotIndexFile
+	if err := readSnapshotFile(remote, mk, snapshotIndex, &index); err != nil {
+		return nil, err
+	}
+	return index.Snapshots, nil
+}
+
+// RestoreMetadataSnapshot restores the metadata snapshot called name, or the
+// most recent one if name is empty, into dir, which must be empty. The master
+// key is restored too. The content of the files and thumbnails isn't part of
+// the snapshots. It must be restored separately, unless it is in a shared
+// BlobStore.
+func RestoreMetadataSnapshot(remote secure.BlobStore, name, dir string, passphrase []byte) (*MetadataSnapshot, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dir)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	mk, mkBytes, err := readSnapshotMasterKey(remote, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer mk.Wipe()
+	var index snapshotIndexFile
+	if err := readSnapshotFile(remote, mk, snapshotIndex, &index); err != nil {
+		return nil, err
+	}
+	var snap *MetadataSnapshot
+	for i := range index.Snapshots {
+		if name == "" || index.Snapshots[i].Name == name {
+			snap = &index.Snapshots[i]
+		}
+	}
+	if snap == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoSnapshot, name)
+	}
+	var manifest snapshotManifest
+	if err := readSnapshotFile(remote, mk, path.Join(snapshotManifestDir, snap.Name), &manifest); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(manifest.Files))
+	for f := range manifest.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		clean := path.Clean(f)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid file name %q in snapshot", f)
+		}
+		obj := manifest.Files[f]
+		b, err := readSnapshotObject(remote, obj)
+		if err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(mk.Hash(b)) != path.Base(obj) {
+			return nil, fmt.Errorf("%s: content doesn't match its hash", obj)
+		}
+		fn := filepath.Join(dir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(fn, b, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master.key"), mkBytes, 0600); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// readSnapshotMasterKey downloads the encrypted master key from remote and
+// decrypts it with passphrase. It returns the master key and its encrypted
+// bytes.
+func readSnapshotMasterKey(remote secure.BlobStore, passphrase []byte) (crypto.MasterKey, []byte, error) {
+	b, err := readSnapshotObject(remote, snapshotMasterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	// crypto.ReadMasterKey only reads from files.
+	f, err := os.CreateTemp("", "master.key-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, nil, err
+	}
+	mk, err := crypto.ReadMasterKey(passphrase, f.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+	return mk, b, nil
+}
+
+func readSnapshotObject(remote secure.BlobStore, name string) ([]byte, error) {
+	r, err := remote.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// readSnapshotFile reads a file from remote, decrypts it with mk, and decodes
+// its JSON content into obj.
+func readSnapshotFile(remote secure.BlobStore, mk crypto.EncryptionKey, name string, obj interface{}) error {
+	b, err := readSnapshotObject(remote, name)
+	if err != nil {
+		return err
+	}
+	if b, err = mk.Decrypt(b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
+
+// writeSnapshotFile encodes obj in JSON, encrypts it with mk, and writes it to
+// remote.
+func writeSnapshotFile(remote secure.BlobStore, mk crypto.EncryptionKey, name string, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if b, err = mk.Encrypt(b); err != nil {
+		return err
+	}
+	return remote.Put(name, bytes.NewReader(b), int64(len(b)))
+}
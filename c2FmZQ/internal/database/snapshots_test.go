@@ -0,0 +1,126 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/cluster"
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestMetadataSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := []byte("passphrase")
+	db := database.New(dir, passphrase)
+	remote, err := cluster.NewRemoteStore("file://" + t.TempDir())
+	if err != nil {
+		t.Fatalf("NewRemoteStore: %v", err)
+	}
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addFile(db, alice, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+
+	snap := func() *database.MetadataSnapshot {
+		t.Helper()
+		// Snapshot names have millisecond granularity.
+		time.Sleep(2 * time.Millisecond)
+		s, err := db.CreateMetadataSnapshot(remote, 2)
+		if err != nil {
+			t.Fatalf("CreateMetadataSnapshot: %v", err)
+		}
+		return s
+	}
+
+	s1 := snap()
+	if s1.Files == 0 || s1.NewFiles != s1.Files || s1.NewBytes != s1.Bytes {
+		t.Errorf("First snapshot: %+v", s1)
+	}
+	s2 := snap()
+	if s2.Files != s1.Files || s2.NewFiles != 0 {
+		t.Errorf("Second snapshot: %+v, want %d files, 0 new", s2, s1.Files)
+	}
+	if err := addUser(db, "bob@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	s3 := snap()
+	if s3.Files <= s2.Files || s3.NewFiles == 0 {
+		t.Errorf("Third snapshot: %+v", s3)
+	}
+
+	// Only the last 2 snapshots are retained.
+	list, err := database.ListMetadataSnapshots(remote, passphrase)
+	if err != nil {
+		t.Fatalf("ListMetadataSnapshots: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != s2.Name || list[1].Name != s3.Name {
+		t.Errorf("ListMetadataSnapshots = %+v, want [%s %s]", list, s2.Name, s3.Name)
+	}
+	if _, err := database.ListMetadataSnapshots(remote, []byte("wrong")); err == nil {
+		t.Error("ListMetadataSnapshots with wrong passphrase succeeded")
+	}
+
+	// Restore the latest snapshot.
+	restoreDir := t.TempDir()
+	if _, err := database.RestoreMetadataSnapshot(remote, "", restoreDir, passphrase); err != nil {
+		t.Fatalf("RestoreMetadataSnapshot: %v", err)
+	}
+	rdb := database.New(restoreDir, passphrase)
+	if err := rdb.SelfTestError(); err != nil {
+		t.Fatalf("Restored database: SelfTestError() = %v", err)
+	}
+	for _, email := range []string{"alice@", "bob@"} {
+		if _, err := rdb.User(email); err != nil {
+			t.Errorf("Restored database: User(%q) failed: %v", email, err)
+		}
+	}
+	fs, err := rdb.FileSet(alice, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("Restored database: FileSet: %v", err)
+	}
+	if _, ok := fs.Files["file1"]; !ok {
+		t.Errorf("Restored database: file1 is missing")
+	}
+
+	// Restore an older snapshot.
+	restoreDir = t.TempDir()
+	if _, err := database.RestoreMetadataSnapshot(remote, s2.Name, restoreDir, passphrase); err != nil {
+		t.Fatalf("RestoreMetadataSnapshot(%q): %v", s2.Name, err)
+	}
+	rdb = database.New(restoreDir, passphrase)
+	if _, err := rdb.User("bob@"); err == nil {
+		t.Errorf("Restored snapshot %s contains bob@", s2.Name)
+	}
+
+	if _, err := database.RestoreMetadataSnapshot(remote, "", restoreDir, passphrase); err == nil {
+		t.Error("RestoreMetadataSnapshot into non-empty directory succeeded")
+	}
+	if _, err := database.RestoreMetadataSnapshot(remote, s1.Name, t.TempDir(), passphrase); !errors.Is(err, database.ErrNoSnapshot) {
+		t.Errorf("RestoreMetadataSnapshot(%q) = %v, want %v", s1.Name, err, database.ErrNoSnapshot)
+	}
+}
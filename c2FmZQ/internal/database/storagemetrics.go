@@ -0,0 +1,147 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/stingle"
+)
+
+var (
+	storageUsers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_users",
+			Help: "Number of user accounts",
+		},
+	)
+	storageFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "database_files",
+			Help: "Number of files, by set",
+		},
+		[]string{"set"},
+	)
+	storageBlobs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_blobs",
+			Help: "Number of distinct blobs referenced by the files",
+		},
+	)
+	storageBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_stored_bytes",
+			Help: "Total size of the distinct blobs referenced by the files",
+		},
+	)
+	storageRefCountAnomalies = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_blob_refcount_anomalies",
+			Help: "Number of blobs whose reference count doesn't match their references",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageUsers)
+	prometheus.MustRegister(storageFiles)
+	prometheus.MustRegister(storageBlobs)
+	prometheus.MustRegister(storageBytes)
+	prometheus.MustRegister(storageRefCountAnomalies)
+}
+
+// StorageStats contains the totals computed by UpdateStorageMetrics.
+type StorageStats struct {
+	// The number of user accounts.
+	Users int `json:"users"`
+	// The number of files in each set: gallery, trash, and album. The files
+	// that were deleted from the trash, but not purged yet, are in "purge".
+	Files map[string]int `json:"files"`
+	// The number of distinct blobs referenced by the files, and their total
+	// size. A blob that is shared by several files is counted once.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// The number of blobs whose reference count doesn't match the number of
+	// files that reference them. The garbage collector fixes them.
+	RefCountAnomalies int `json:"refCountAnomalies"`
+}
+
+// setLabels are the metric labels of the file sets.
+var setLabels = map[string]string{
+	stingle.GallerySet: "gallery",
+	stingle.TrashSet:   "trash",
+	stingle.AlbumSet:   "album",
+	"":                 "purge",
+}
+
+// UpdateStorageMetrics computes the number of users, files, and blobs in the
+// database, and exports them as gauges. It reads all the file sets, like the
+// garbage collector, so it should only be called periodically.
+func (d *Database) UpdateStorageMetrics() (stats StorageStats, retErr error) {
+	defer recordLatency("UpdateStorageMetrics")()
+
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		return stats, err
+	}
+	stats.Users = len(ul)
+	stats.Files = make(map[string]int)
+	for _, label := range setLabels {
+		stats.Files[label] = 0
+	}
+	refs := make(map[string]int)
+	sizes := make(map[string]int64)
+	if _, err := d.walkFiles(func(set string, f *FileSpec) {
+		stats.Files[setLabels[set]]++
+		for _, blob := range f.blobs() {
+			refs[blob]++
+		}
+		sizes[f.StoreFile] = f.StoreFileSize
+		sizes[f.StoreThumb] = f.StoreThumbSize
+		if f.StoreMedium != "" {
+			sizes[f.StoreMedium] = f.StoreMediumSize
+		}
+	}); err != nil {
+		return stats, err
+	}
+	stats.Blobs = len(refs)
+	for _, size := range sizes {
+		stats.Bytes += size
+	}
+	for blob, count := range refs {
+		var spec BlobSpec
+		if err := d.storage.ReadDataFile(d.blobRef(blob), &spec); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stats, err
+		}
+		if spec.RefCount != count {
+			stats.RefCountAnomalies++
+		}
+	}
+
+	storageUsers.Set(float64(stats.Users))
+	for label, n := range stats.Files {
+		storageFiles.WithLabelValues(label).Set(float64(n))
+	}
+	storageBlobs.Set(float64(stats.Blobs))
+	storageBytes.Set(float64(stats.Bytes))
+	storageRefCountAnomalies.Set(float64(stats.RefCountAnomalies))
+	return stats, nil
+}
@@ -0,0 +1,97 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/secure"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestUpdateStorageMetrics(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	storage := secure.NewStorage(dir, nil)
+
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	bob, err := db.User("bob@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	for _, f := range []struct {
+		user database.User
+		name string
+		set  string
+	}{
+		{alice, "file1", stingle.GallerySet},
+		{alice, "file2", stingle.GallerySet},
+		{alice, "file3", stingle.TrashSet},
+		{bob, "file4", stingle.GallerySet},
+	} {
+		if err := addFile(db, f.user, f.name, f.set, ""); err != nil {
+			t.Fatalf("addFile(%q): %v", f.name, err)
+		}
+	}
+
+	want := database.StorageStats{
+		Users: 2,
+		Files: map[string]int{
+			"gallery": 3,
+			"trash":   1,
+			"album":   0,
+			"purge":   0,
+		},
+		Blobs: 8,
+		Bytes: 4400,
+	}
+	stats, err := db.UpdateStorageMetrics()
+	if err != nil {
+		t.Fatalf("UpdateStorageMetrics: %v", err)
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("UpdateStorageMetrics() = %+v, want %+v", stats, want)
+	}
+
+	// The reference count of file1 drifted.
+	fs, err := db.FileSet(alice, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	if err := storage.SaveDataFile(filepath.Join("metadata", fs.Files["file1"].StoreFile+".ref"), database.BlobSpec{RefCount: 5}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	want.RefCountAnomalies = 1
+	if stats, err = db.UpdateStorageMetrics(); err != nil {
+		t.Fatalf("UpdateStorageMetrics: %v", err)
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("UpdateStorageMetrics() = %+v, want %+v", stats, want)
+	}
+}
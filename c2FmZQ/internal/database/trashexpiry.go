@@ -0,0 +1,118 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// TrashRetentionDays returns the number of days after which the files in the
+// user's trash are deleted automatically, or 0 if they are kept until the user
+// deletes them.
+func (d *Database) TrashRetentionDays(user User) int {
+	if user.TrashRetentionDays != nil {
+		return *user.TrashRetentionDays
+	}
+	return d.trashRetentionDays
+}
+
+// ExpireTrash deletes the files that have been in the users' trash for longer
+// than their retention period, see TrashRetentionDays. Delete events are added
+// to the trash so that the clients remove the files too. It returns the number
+// of files that were deleted.
+func (d *Database) ExpireTrash() (int, error) {
+	defer recordLatency("ExpireTrash")()
+
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	uids, err := d.UserIDs()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, uid := range uids {
+		user, err := d.UserByID(uid)
+		if err != nil {
+			return total, err
+		}
+		// Nothing is deleted from accounts on hold, and limited accounts
+		// can't delete files.
+		if user.Hold || user.Limited != nil {
+			continue
+		}
+		days := d.TrashRetentionDays(user)
+		if days <= 0 {
+			continue
+		}
+		n, err := d.expireUserTrash(user, nowInMS()-(time.Duration(days)*24*time.Hour).Milliseconds())
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// expireUserTrash deletes the files that were moved to the user's trash before
+// cutoff. Their content is released after the purge delay, like with
+// DeleteFiles.
+func (d *Database) expireUserTrash(user User, cutoff int64) (n int, retErr error) {
+	fs, err := d.FileSet(user, stingle.TrashSet, "")
+	if err != nil {
+		return 0, err
+	}
+	expired := false
+	for _, f := range fs.Files {
+		if f.DateModified <= cutoff {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return 0, nil
+	}
+
+	d.refMutex.RLock()
+	defer d.refMutex.RUnlock()
+	commit, fs, queue, err := d.trashForUpdate(user)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(true, &retErr)
+	now := nowInMS()
+	for k, v := range fs.Files {
+		if v.DateModified > cutoff {
+			continue
+		}
+		d.releaseFile(queue, k, v, now)
+		delete(fs.Files, k)
+		fs.Deletes = append(fs.Deletes, DeleteEvent{
+			File: k,
+			Type: stingle.DeleteEventTrashDelete,
+			Date: now,
+		})
+		n++
+	}
+	pruneDeleteEvents(&fs.Deletes, &fs.DeleteHorizon)
+	log.Debugf("Expired %d files in the trash of user %d", n, user.UserID)
+	return n, nil
+}
@@ -0,0 +1,132 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestExpireTrash(t *testing.T) {
+	dir := t.TempDir()
+	db := database.NewWithOptions(dir, nil, database.Options{TrashRetentionDays: 30})
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	users := make(map[string]database.User)
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+			t.Fatalf("addUser(%q) failed: %v", email, err)
+		}
+		user, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User: %v", err)
+		}
+		users[email] = user
+		// file1 is moved to the trash on day 1, and file2 on day 20.
+		for _, f := range []string{"file1", "file2"} {
+			if err := addFile(db, user, f, stingle.GallerySet, ""); err != nil {
+				t.Fatalf("addFile: %v", err)
+			}
+		}
+		for i, f := range []string{"file1", "file2"} {
+			database.CurrentTimeForTesting = []int64{1, 20}[i] * (24 * time.Hour).Milliseconds()
+			if err := db.MoveFile(user, database.MoveFileParams{
+				SetFrom:   stingle.GallerySet,
+				SetTo:     stingle.TrashSet,
+				IsMoving:  true,
+				Filenames: []string{f},
+			}); err != nil {
+				t.Fatalf("db.MoveFile: %v", err)
+			}
+		}
+	}
+
+	// Bob keeps the files in his trash longer.
+	data, err := db.AdminData(nil)
+	if err != nil {
+		t.Fatalf("db.AdminData: %v", err)
+	}
+	if _, err := db.AdminData(&database.AdminData{
+		Tag:   data.Tag,
+		Users: []database.AdminUser{{UserID: users["bob@"].UserID, TrashRetentionDays: ptr(100)}},
+	}); err != nil {
+		t.Fatalf("db.AdminData: %v", err)
+	}
+
+	trash := func(email string) []string {
+		t.Helper()
+		user, err := db.User(email)
+		if err != nil {
+			t.Fatalf("db.User: %v", err)
+		}
+		fs, err := db.FileSet(user, stingle.TrashSet, "")
+		if err != nil {
+			t.Fatalf("db.FileSet: %v", err)
+		}
+		var names []string
+		for f := range fs.Files {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, tc := range []struct {
+		day   int64
+		count int
+		alice []string
+		bob   []string
+	}{
+		{day: 25, count: 0, alice: []string{"file1", "file2"}, bob: []string{"file1", "file2"}},
+		{day: 40, count: 1, alice: []string{"file2"}, bob: []string{"file1", "file2"}},
+		{day: 60, count: 1, alice: nil, bob: []string{"file1", "file2"}},
+		{day: 130, count: 2, alice: nil, bob: nil},
+	} {
+		database.CurrentTimeForTesting = tc.day * (24 * time.Hour).Milliseconds()
+		if n, err := db.ExpireTrash(); err != nil || n != tc.count {
+			t.Errorf("Day %d: ExpireTrash() = %d, %v, want %d, nil", tc.day, n, err, tc.count)
+		}
+		if got := trash("alice@"); !reflect.DeepEqual(got, tc.alice) {
+			t.Errorf("Day %d: alice's trash = %v, want %v", tc.day, got, tc.alice)
+		}
+		if got := trash("bob@"); !reflect.DeepEqual(got, tc.bob) {
+			t.Errorf("Day %d: bob's trash = %v, want %v", tc.day, got, tc.bob)
+		}
+	}
+
+	// The clients see the deletions.
+	fs, err := db.FileSet(users["alice@"], stingle.TrashSet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	var deleted []string
+	for _, de := range fs.Deletes {
+		if de.Type == stingle.DeleteEventTrashDelete {
+			deleted = append(deleted, de.File)
+		}
+	}
+	sort.Strings(deleted)
+	if want := []string{"file1", "file2"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Delete events = %v, want %v", deleted, want)
+	}
+}
@@ -18,6 +18,9 @@
 package database
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
@@ -44,8 +47,9 @@ var (
 type DeleteEvent struct {
 	File    string `json:"file,omitempty"`
 	AlbumID string `json:"albumId,omitempty"`
-	Type    int    `json:"type"` // See stingle/types.go
-	Date    int64  `json:"date"` // The time of the deletion.
+	Type    int    `json:"type"`             // See stingle/types.go
+	Date    int64  `json:"date"`             // The time of the deletion.
+	UserID  int64  `json:"userId,omitempty"` // The member, for reactions.
 }
 
 func pruneDeleteEvents(events *[]DeleteEvent, horizonTS *int64) {
@@ -60,27 +64,49 @@ func pruneDeleteEvents(events *[]DeleteEvent, horizonTS *int64) {
 	}
 }
 
+// numberCache interns the json.Number representation of timestamps. Files
+// that are uploaded or moved together share the same dates, so most of the
+// conversions in large file sets are repeats.
+type numberCache map[int64]json.Number
+
+func (c numberCache) number(n int64) json.Number {
+	if v, ok := c[n]; ok {
+		return v
+	}
+	v := number(n)
+	c[n] = v
+	return v
+}
+
 // fileUpdatesForSet finds which files were added to the file set since ts.
-func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64, ch chan<- stingle.File, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64) ([]stingle.File, error) {
 	fs, err := d.FileSet(user, set, albumID)
 	if err != nil {
 		log.Errorf("d.FileSet(%q, %q, %q) failed: %v", user.Email, set, albumID, err)
-		return
+		return nil, err
 	}
 
+	// Incremental updates are usually small, and iterating over a large
+	// map twice to count them costs more than growing the slice.
+	var out []stingle.File
+	if ts <= 0 {
+		out = make([]stingle.File, 0, len(fs.Files))
+	}
+	numbers := make(numberCache)
 	for k, v := range fs.Files {
 		if v.DateModified > ts {
-			ch <- stingle.File{
+			out = append(out, stingle.File{
 				File:         k,
 				Version:      v.Version,
-				DateCreated:  number(v.DateCreated),
-				DateModified: number(v.DateModified),
+				DateCreated:  numbers.number(v.DateCreated),
+				DateModified: numbers.number(v.DateModified),
 				Headers:      v.Headers,
 				AlbumID:      albumID,
-			}
+				HasMedium:    hasMedium(v),
+			})
 		}
 	}
+	return out, nil
 }
 
 // FileUpdates returns all the files that were added to a file set since time
@@ -88,12 +114,11 @@ func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64, c
 func (d *Database) FileUpdates(user User, set string, ts int64) ([]stingle.File, error) {
 	defer recordLatency("FileUpdates")()
 
-	ch := make(chan stingle.File)
-	var wg sync.WaitGroup
-
+	var out []stingle.File
 	if set != stingle.AlbumSet {
-		wg.Add(1)
-		go d.fileUpdatesForSet(user, set, "", ts, ch, &wg)
+		// Errors are logged by fileUpdatesForSet and otherwise ignored,
+		// like for albums below.
+		out, _ = d.fileUpdatesForSet(user, set, "", ts)
 	} else {
 		albumRefs, err := d.AlbumRefs(user)
 		if err != nil {
@@ -101,19 +126,29 @@ func (d *Database) FileUpdates(user User, set string, ts int64) ([]stingle.File,
 			return nil, err
 		}
 
+		results := make([][]stingle.File, len(albumRefs))
+		var wg sync.WaitGroup
+		i := 0
 		for _, album := range albumRefs {
 			wg.Add(1)
-			go d.fileUpdatesForSet(user, stingle.AlbumSet, album.AlbumID, ts, ch, &wg)
+			go func(i int, albumID string) {
+				defer wg.Done()
+				results[i], _ = d.fileUpdatesForSet(user, stingle.AlbumSet, albumID, ts)
+			}(i, album.AlbumID)
+			i++
 		}
-	}
-	go func(ch chan<- stingle.File, wg *sync.WaitGroup) {
 		wg.Wait()
-		close(ch)
-	}(ch, &wg)
-
-	out := []stingle.File{}
-	for sf := range ch {
-		out = append(out, sf)
+		n := 0
+		for _, r := range results {
+			n += len(r)
+		}
+		out = make([]stingle.File, 0, n)
+		for _, r := range results {
+			out = append(out, r...)
+		}
+	}
+	if out == nil {
+		out = []stingle.File{}
 	}
 	sort.Slice(out, func(i, j int) bool {
 		if out[i].DateModified == out[j].DateModified {
@@ -126,28 +161,39 @@ func (d *Database) FileUpdates(user User, set string, ts int64) ([]stingle.File,
 
 // deleteUpdatesForSet finds which files were deleted from the file set since
 // ts.
-func (d *Database) deleteUpdatesForSet(user User, set, albumID string, ts int64, ch chan<- stingle.DeleteEvent, eCh chan<- error) {
+func (d *Database) deleteUpdatesForSet(user User, set, albumID string, ts int64) ([]stingle.DeleteEvent, error) {
 	fs, err := d.FileSet(user, set, albumID)
 	if err != nil {
 		log.Errorf("d.FileSet(%q, %q, %q failed: %v", user.Email, set, albumID, err)
-		eCh <- err
-		return
+		return nil, err
 	}
 	if ts > 0 && ts < fs.DeleteHorizon {
-		eCh <- ErrUpdateTimestampTooOld
-		return
+		return nil, ErrUpdateTimestampTooOld
+	}
+	// Comment and reaction deletions have their own streams. See
+	// CommentUpdates and ReactionUpdates.
+	want := func(d DeleteEvent) bool {
+		return d.Date > ts && d.Type != stingle.DeleteEventComment && d.Type != stingle.DeleteEventReaction
 	}
+	n := 0
 	for _, d := range fs.Deletes {
-		if d.Date > ts {
-			ch <- stingle.DeleteEvent{
+		if want(d) {
+			n++
+		}
+	}
+	out := make([]stingle.DeleteEvent, 0, n)
+	numbers := make(numberCache)
+	for _, d := range fs.Deletes {
+		if want(d) {
+			out = append(out, stingle.DeleteEvent{
 				File:    d.File,
 				AlbumID: d.AlbumID,
-				Type:    number(int64(d.Type)),
-				Date:    number(d.Date),
-			}
+				Type:    numbers.number(int64(d.Type)),
+				Date:    numbers.number(d.Date),
+			})
 		}
 	}
-	eCh <- nil
+	return out, nil
 }
 
 // DeleteUpdates returns all the files that were deleted from a file set since
@@ -192,32 +238,34 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 		}
 	}
 
-	ch := make(chan stingle.DeleteEvent)
-	eCh := make(chan error)
-	count := 0
-	for _, set := range []string{stingle.GallerySet, stingle.TrashSet, stingle.AlbumSet} {
-		if set == stingle.AlbumSet {
-			for _, a := range manifest.Albums {
-				count++
-				go d.deleteUpdatesForSet(user, set, a.AlbumID, ts, ch, eCh)
-			}
-		} else {
-			count++
-			go d.deleteUpdatesForSet(user, set, "", ts, ch, eCh)
-		}
+	type result struct {
+		events []stingle.DeleteEvent
+		err    error
+	}
+	var results []result
+	var wg sync.WaitGroup
+	get := func(i int, set, albumID string) {
+		defer wg.Done()
+		results[i].events, results[i].err = d.deleteUpdatesForSet(user, set, albumID, ts)
 	}
+	results = make([]result, 2+len(manifest.Albums))
+	wg.Add(len(results))
+	go get(0, stingle.GallerySet, "")
+	go get(1, stingle.TrashSet, "")
+	i := 2
+	for _, a := range manifest.Albums {
+		go get(i, stingle.AlbumSet, a.AlbumID)
+		i++
+	}
+	wg.Wait()
+
 	var errorList []error
-	go func() {
-		for i := 0; i < count; i++ {
-			if err := <-eCh; err != nil {
-				errorList = append(errorList, err)
-			}
+	n := len(out)
+	for _, r := range results {
+		if r.err != nil {
+			errorList = append(errorList, r.err)
 		}
-		close(ch)
-	}()
-
-	for de := range ch {
-		out = append(out, de)
+		n += len(r.events)
 	}
 	for _, err := range errorList {
 		if err == ErrUpdateTimestampTooOld {
@@ -227,39 +275,143 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 	if errorList != nil {
 		return nil, fmt.Errorf("%w %v", errorList[0], errorList[1:])
 	}
+	all := make([]stingle.DeleteEvent, 0, n)
+	all = append(all, out...)
+	for _, r := range results {
+		all = append(all, r.events...)
+	}
+	out = all
 	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
 	return out, nil
 }
 
+// UpdatesWatermark returns an opaque value that changes whenever the data
+// returned by FileUpdates, AlbumUpdates, ContactUpdates, DeleteUpdates,
+// CommentUpdates, ReactionUpdates, SeenMarkerUpdates, or StorageUsage might
+// have changed for the user. Only the album manifest is read. For the other
+// files, it uses the modification time and size, like the FileSet cache.
+//
+// The quota file has the quotas, the entitlements, and the shared album
+// policy. With the user record, it covers the changes that administrators
+// make to the user's limits.
+func (d *Database) UpdatesWatermark(user User) (string, error) {
+	defer recordLatency("UpdatesWatermark")()
+
+	manifestFile := d.filePath(user.home(albumManifest))
+	var manifest AlbumManifest
+	if err := d.storage.ReadDataFile(manifestFile, &manifest); err != nil {
+		return "", err
+	}
+	files := []string{
+		manifestFile,
+		d.filePath(user.home(userFile)),
+		d.filePath(user.home(contactListFile)),
+		d.filePath(quotaFile),
+		d.fileSetPath(user, stingle.GallerySet),
+		d.fileSetPath(user, stingle.TrashSet),
+	}
+	albumFiles := make([]string, 0, len(manifest.Albums))
+	for _, a := range manifest.Albums {
+		albumFiles = append(albumFiles, a.File)
+	}
+	sort.Strings(albumFiles)
+	files = append(files, albumFiles...)
+
+	h := sha256.New()
+	for _, f := range files {
+		ts, sz := d.stat(f)
+		fmt.Fprintf(h, "%s %d %d\n", f, ts, sz)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
 type fileSize struct {
-	name string
-	size int64
+	name   string
+	set    string
+	size   int64
+	shared bool
+	// Whether the file is charged to the user.
+	charged bool
 }
 
-func (d *Database) getFileSizes(user User, set, albumID string, ch chan<- fileSize, wg *sync.WaitGroup) {
+func (d *Database) getFileSizes(user User, policy, set, albumID string, ch chan<- fileSize, wg *sync.WaitGroup) {
 	defer wg.Done()
 	fs, err := d.FileSet(user, set, albumID)
 	if err != nil {
 		log.Errorf("d.FileSet(%q, %q, %q failed: %v", user.Email, set, albumID, err)
 		return
 	}
-	if fs.Album != nil && fs.Album.OwnerID != user.UserID {
-		// Only charge file size to owner of the album.
-		return
+	ownerID := user.UserID
+	shared := false
+	if fs.Album != nil {
+		ownerID = fs.Album.OwnerID
+		shared = fs.Album.IsShared
 	}
 	for k, f := range fs.Files {
-		ch <- fileSize{k, f.StoreFileSize + f.StoreThumbSize}
+		// Only charge file size to the payer, i.e. the owner of the album
+		// or the contributor, depending on the policy.
+		charged := payer(policy, ownerID, f) == user.UserID
+		ch <- fileSize{k, set, f.storeSize(), shared, charged}
 	}
 }
 
 // SpaceUsed calculates the sum of all the file sizes in a user's file sets,
 // counting each file only once, even if it is in multiple sets.
 func (d *Database) SpaceUsed(user User) (int64, error) {
-	defer recordLatency("SpaceUsed")()
+	total, _, err := d.SpaceUsedDetails(user)
+	return total, err
+}
+
+// SpaceUsedDetails is like SpaceUsed, and also returns the part of the total
+// that is used by files in shared albums.
+func (d *Database) SpaceUsedDetails(user User) (total, shared int64, retErr error) {
+	su, err := d.storageUsage(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	return su.SpaceUsed, su.SharedSpaceUsed, nil
+}
+
+// StorageUsage is a summary of a user's storage.
+type StorageUsage struct {
+	// The space used by the user's files, in bytes, counting each file
+	// only once.
+	SpaceUsed int64 `json:"spaceUsed"`
+	// The part of SpaceUsed that is used by files in shared albums.
+	SharedSpaceUsed int64 `json:"sharedSpaceUsed"`
+	// The user's quota, in bytes.
+	Quota int64 `json:"quota"`
+	// The number of files in the gallery, the trash, and all the albums.
+	GalleryFiles int `json:"galleryFiles"`
+	TrashFiles   int `json:"trashFiles"`
+	AlbumFiles   int `json:"albumFiles"`
+	// The number of albums, including albums shared with the user.
+	Albums int `json:"albums"`
+}
+
+// StorageUsage returns a summary of the user's storage.
+func (d *Database) StorageUsage(user User) (StorageUsage, error) {
+	su, err := d.storageUsage(user)
+	if err != nil {
+		return su, err
+	}
+	if su.Quota, err = d.Quota(user.UserID); err != nil {
+		return su, err
+	}
+	return su, nil
+}
+
+func (d *Database) storageUsage(user User) (su StorageUsage, retErr error) {
+	defer recordLatency("StorageUsage")()
 
 	var manifest AlbumManifest
 	if err := d.storage.ReadDataFile(d.filePath(user.home(albumManifest)), &manifest); err != nil {
-		return 0, err
+		return su, err
+	}
+	su.Albums = len(manifest.Albums)
+	policy, err := d.SharedAlbumPolicy()
+	if err != nil {
+		return su, err
 	}
 
 	ch := make(chan fileSize)
@@ -268,11 +420,11 @@ func (d *Database) SpaceUsed(user User) (int64, error) {
 		if set == stingle.AlbumSet {
 			for _, a := range manifest.Albums {
 				wg.Add(1)
-				go d.getFileSizes(user, set, a.AlbumID, ch, &wg)
+				go d.getFileSizes(user, policy, set, a.AlbumID, ch, &wg)
 			}
 		} else {
 			wg.Add(1)
-			go d.getFileSizes(user, set, "", ch, &wg)
+			go d.getFileSizes(user, policy, set, "", ch, &wg)
 		}
 	}
 	go func(ch chan<- fileSize, wg *sync.WaitGroup) {
@@ -281,12 +433,29 @@ func (d *Database) SpaceUsed(user User) (int64, error) {
 	}(ch, &wg)
 
 	files := make(map[string]int64)
+	sharedFiles := make(map[string]bool)
 	for fs := range ch {
+		switch fs.set {
+		case stingle.GallerySet:
+			su.GalleryFiles++
+		case stingle.TrashSet:
+			su.TrashFiles++
+		case stingle.AlbumSet:
+			su.AlbumFiles++
+		}
+		if !fs.charged {
+			continue
+		}
 		files[fs.name] = fs.size
+		if fs.shared {
+			sharedFiles[fs.name] = true
+		}
 	}
-	var total int64
-	for _, v := range files {
-		total += v
+	for k, v := range files {
+		su.SpaceUsed += v
+		if sharedFiles[k] {
+			su.SharedSpaceUsed += v
+		}
 	}
-	return total, nil
+	return su, nil
 }
@@ -18,7 +18,12 @@
 package database
 
 import (
+	"fmt"
+	"path/filepath"
+	"runtime"
 	"testing"
+
+	"c2FmZQ/internal/stingle"
 )
 
 func TestPruneDeleteEvents(t *testing.T) {
@@ -70,3 +75,168 @@ func TestPruneDeleteEvents(t *testing.T) {
 		t.Errorf("Unexpected changed to the delete horizon. Want %d, got %d", want, got)
 	}
 }
+
+func TestUpdatesWatermark(t *testing.T) {
+	db := New(filepath.Join(t.TempDir(), "data"), nil)
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+	userID, err := db.AddUser(User{Email: "alice@", PublicKey: key.PublicKey()})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.UserByID(userID)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	watermark := func() string {
+		w, err := db.UpdatesWatermark(user)
+		if err != nil {
+			t.Fatalf("UpdatesWatermark: %v", err)
+		}
+		return w
+	}
+	w1 := watermark()
+	if w2 := watermark(); w1 != w2 {
+		t.Errorf("Watermark changed without changes: %q != %q", w1, w2)
+	}
+	fs := &FileSet{Files: map[string]*FileSpec{"file1": {Headers: "foo", DateModified: 1000}}}
+	if err := db.storage.SaveDataFile(db.fileSetPath(user, stingle.TrashSet), fs); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	w2 := watermark()
+	if w1 == w2 {
+		t.Error("Watermark didn't change after a trash update")
+	}
+	if err := db.AddAlbum(user, AlbumSpec{AlbumID: "album1", DateCreated: 1, DateModified: 1}); err != nil {
+		t.Fatalf("AddAlbum: %v", err)
+	}
+	w3 := watermark()
+	if w3 == w2 {
+		t.Error("Watermark didn't change after a new album")
+	}
+	quota := int64(100)
+	if err := db.SetUserLimits(AdminUser{UserID: userID, Quota: &quota}); err != nil {
+		t.Fatalf("SetUserLimits: %v", err)
+	}
+	w4 := watermark()
+	if w4 == w3 {
+		t.Error("Watermark didn't change after a quota change")
+	}
+	data, err := db.AdminData(nil)
+	if err != nil {
+		t.Fatalf("AdminData: %v", err)
+	}
+	policy := SharedAlbumPolicyContributor
+	if _, err := db.AdminData(&AdminData{Tag: data.Tag, SharedAlbumPolicy: &policy}); err != nil {
+		t.Fatalf("AdminData: %v", err)
+	}
+	w5 := watermark()
+	if w5 == w4 {
+		t.Error("Watermark didn't change after a policy change")
+	}
+	if err := db.MutateUser(userID, func(u *User) error {
+		u.Hold = true
+		return nil
+	}); err != nil {
+		t.Fatalf("MutateUser: %v", err)
+	}
+	if w6 := watermark(); w6 == w5 {
+		t.Error("Watermark didn't change after a user change")
+	}
+}
+
+// benchmarkUser creates a user whose gallery has numFiles files, and an album
+// with numFiles/10 files. The files are added in batches of 100 with the same
+// dates, like when the user uploads many files at once.
+func benchmarkUser(b *testing.B, numFiles int) (*Database, User) {
+	db := New(filepath.Join(b.TempDir(), "data"), nil)
+	key := stingle.MakeSecretKeyForTest()
+	defer key.Wipe()
+	userID, err := db.AddUser(User{Email: "bench@", PublicKey: key.PublicKey()})
+	if err != nil {
+		b.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.UserByID(userID)
+	if err != nil {
+		b.Fatalf("UserByID: %v", err)
+	}
+	makeFileSet := func(n int) *FileSet {
+		fs := &FileSet{Files: make(map[string]*FileSpec, n)}
+		for i := 0; i < n; i++ {
+			ts := int64(1600000000000 + i/100*1000)
+			fs.Files[fmt.Sprintf("file%08d.jpg", i)] = &FileSpec{
+				Headers:      fmt.Sprintf("headers-%0200d", i),
+				DateCreated:  ts,
+				DateModified: ts,
+				Version:      "1",
+			}
+			if i%10 == 0 {
+				fs.Deletes = append(fs.Deletes, DeleteEvent{File: fmt.Sprintf("deleted%08d.jpg", i), Type: stingle.DeleteEventTrashDelete, Date: ts})
+			}
+		}
+		return fs
+	}
+	if err := db.storage.SaveDataFile(db.fileSetPath(user, stingle.GallerySet), makeFileSet(numFiles)); err != nil {
+		b.Fatalf("SaveDataFile: %v", err)
+	}
+	if err := db.AddAlbum(user, AlbumSpec{AlbumID: "album1", DateCreated: 1, DateModified: 1}); err != nil {
+		b.Fatalf("AddAlbum: %v", err)
+	}
+	albumRef, err := db.albumRef(user, "album1")
+	if err != nil {
+		b.Fatalf("albumRef: %v", err)
+	}
+	albumFS := makeFileSet(numFiles / 10)
+	if albumFS.Album, err = db.Album(user, "album1"); err != nil {
+		b.Fatalf("Album: %v", err)
+	}
+	if err := db.storage.SaveDataFile(albumRef.File, albumFS); err != nil {
+		b.Fatalf("SaveDataFile: %v", err)
+	}
+	return db, user
+}
+
+// BenchmarkGetUpdates measures the database side of getUpdates: a full sync
+// (ts=0), and an incremental sync that returns only the last few files. The
+// file sets are in the cache after the first iteration, like on a busy
+// server.
+func BenchmarkGetUpdates(b *testing.B) {
+	for _, numFiles := range []int{10000, 100000, 1000000} {
+		if numFiles > 100000 && testing.Short() {
+			continue
+		}
+		db, user := benchmarkUser(b, numFiles)
+		for _, tc := range []struct {
+			name string
+			ts   int64
+		}{
+			{"full", 0},
+			{"incremental", int64(1600000000000 + (numFiles/100-1)*1000 - 1)},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", tc.name, numFiles), func(b *testing.B) {
+				getUpdates := func() {
+					if _, err := db.FileUpdates(user, stingle.GallerySet, tc.ts); err != nil {
+						b.Fatalf("FileUpdates: %v", err)
+					}
+					if _, err := db.FileUpdates(user, stingle.AlbumSet, tc.ts); err != nil {
+						b.Fatalf("FileUpdates: %v", err)
+					}
+					if _, err := db.DeleteUpdates(user, tc.ts); err != nil {
+						b.Fatalf("DeleteUpdates: %v", err)
+					}
+				}
+				getUpdates()
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					getUpdates()
+				}
+				b.StopTimer()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"encoding/hex"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// FileDigests contains the digests of the variants of a stored file. See
+// StoredFileDigests.
+type FileDigests struct {
+	File   string
+	Thumb  string
+	Medium string
+}
+
+// StoredFileDigests reads back the variants of a file, as they are stored,
+// and returns their BLAKE2b-256 digests, hex encoded. The content is the one
+// that the client uploaded, i.e. encrypted with the client's keys, so that
+// the client can compare the digests with the ones of the content that it
+// sent. Medium is empty when the file doesn't have a medium-resolution
+// variant.
+func (d *Database) StoredFileDigests(user User, set, albumID, filename string) (digests FileDigests, err error) {
+	defer recordLatency("StoredFileDigests")()
+
+	fileSpec, err := d.findFileInSet(user, set, albumID, filename)
+	if err != nil {
+		return digests, err
+	}
+	if digests.File, err = d.blobDigest(fileSpec.StoreFile); err != nil {
+		return digests, err
+	}
+	if digests.Thumb, err = d.blobDigest(fileSpec.StoreThumb); err != nil {
+		return digests, err
+	}
+	if fileSpec.StoreMedium != "" {
+		if digests.Medium, err = d.blobDigest(fileSpec.StoreMedium); err != nil {
+			return digests, err
+		}
+	}
+	return digests, nil
+}
+
+// blobDigest returns the BLAKE2b-256 digest of a blob's content. The blob is
+// read from storage, bypassing the caches.
+func (d *Database) blobDigest(blob string) (string, error) {
+	r, err := d.storage.OpenBlobRead(blob)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
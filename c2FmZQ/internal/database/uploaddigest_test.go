@@ -0,0 +1,61 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestStoredFileDigests(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile: %v", err)
+	}
+
+	digest := func(s string) string {
+		sum := blake2b.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	want := database.FileDigests{
+		File:  digest("file content file1"),
+		Thumb: digest("thumb content file1"),
+	}
+	if got, err := db.StoredFileDigests(user, stingle.GallerySet, "", "file1"); err != nil || got != want {
+		t.Errorf("StoredFileDigests() = %+v, %v, want %+v, nil", got, err, want)
+	}
+	if _, err := db.StoredFileDigests(user, stingle.GallerySet, "", "file2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("StoredFileDigests(file2) = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,368 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	usageFile       = "usage.dat"
+	usageReportFile = "usage-report.dat"
+
+	// Usage data is accumulated in memory and saved at this interval.
+	usageFlushInterval = time.Minute
+	// Daily usage data older than this is discarded.
+	usageRetention = 400 * 24 * time.Hour
+	// The active device IDs are only kept long enough to count the weekly
+	// active devices.
+	deviceRetention = 7 * 24 * time.Hour
+	// The length of the device IDs, which are a prefix of the token hash.
+	deviceIDLength = 12
+)
+
+// DailyUsage is the API usage of a user on a given day.
+type DailyUsage struct {
+	// The number of API requests.
+	Requests int64 `json:"requests"`
+	// The number of bytes uploaded, i.e. file content and thumbnails.
+	BytesUploaded int64 `json:"bytesUploaded"`
+	// The number of bytes downloaded, i.e. file content and thumbnails.
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+}
+
+func (u *DailyUsage) add(o DailyUsage) {
+	u.Requests += o.Requests
+	u.BytesUploaded += o.BytesUploaded
+	u.BytesDownloaded += o.BytesDownloaded
+}
+
+// Usage contains a user's API usage.
+type Usage struct {
+	// The daily usage, keyed by day (YYYY-MM-DD, UTC).
+	Days map[string]*DailyUsage `json:"days"`
+	// The IDs of the devices that were active each day, keyed by day.
+	Devices map[string][]string `json:"devices,omitempty"`
+}
+
+// DeviceActivity is the number of distinct devices, i.e. session tokens, that
+// used an account recently.
+type DeviceActivity struct {
+	// The number of devices that were active today (UTC).
+	Daily int `json:"daily"`
+	// The number of devices that were active in the last 7 days.
+	Weekly int `json:"weekly"`
+}
+
+// UserUsage is a user's API usage over a period of time.
+type UserUsage struct {
+	UserID int64  `json:"userId"`
+	Email  string `json:"email"`
+	Period string `json:"period"`
+	DailyUsage
+	SpaceUsed int64 `json:"spaceUsed"`
+	// The part of SpaceUsed that is used by files in shared albums.
+	SharedSpaceUsed int64 `json:"sharedSpaceUsed"`
+	// The current device activity, regardless of Period.
+	ActiveDevices DeviceActivity `json:"activeDevices"`
+}
+
+// usageReportState records which monthly usage report was sent last.
+type usageReportState struct {
+	LastMonth string `json:"lastMonth"`
+}
+
+func usageDay(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02")
+}
+
+// RecordUsage adds u to the user's API usage for the current day. The data is
+// kept in memory and saved periodically. Nothing is recorded when the database
+// is read-only.
+func (d *Database) RecordUsage(userID int64, u DailyUsage) {
+	if d.readOnly {
+		return
+	}
+	day := usageDay(nowInMS())
+	d.usageMutex.Lock()
+	defer d.usageMutex.Unlock()
+	if d.pendingUsage == nil {
+		d.pendingUsage = make(map[int64]map[string]*DailyUsage)
+	}
+	days := d.pendingUsage[userID]
+	if days == nil {
+		days = make(map[string]*DailyUsage)
+		d.pendingUsage[userID] = days
+	}
+	if days[day] == nil {
+		days[day] = &DailyUsage{}
+	}
+	days[day].add(u)
+	d.maybeFlushUsageLocked()
+}
+
+// RecordActiveDevice records that the device identified by tokenHash used the
+// user's account today. Only a short prefix of the hash is kept, which is
+// enough to count distinct devices without identifying them.
+func (d *Database) RecordActiveDevice(userID int64, tokenHash string) {
+	if d.readOnly || tokenHash == "" {
+		return
+	}
+	if len(tokenHash) > deviceIDLength {
+		tokenHash = tokenHash[:deviceIDLength]
+	}
+	day := usageDay(nowInMS())
+	d.usageMutex.Lock()
+	defer d.usageMutex.Unlock()
+	if d.pendingDevices == nil {
+		d.pendingDevices = make(map[int64]map[string]map[string]bool)
+	}
+	days := d.pendingDevices[userID]
+	if days == nil {
+		days = make(map[string]map[string]bool)
+		d.pendingDevices[userID] = days
+	}
+	if days[day] == nil {
+		days[day] = make(map[string]bool)
+	}
+	days[day][tokenHash] = true
+	d.maybeFlushUsageLocked()
+}
+
+// maybeFlushUsageLocked saves the pending usage data in the background when
+// the flush interval has passed. d.usageMutex must be held.
+func (d *Database) maybeFlushUsageLocked() {
+	if d.usageFlushed.IsZero() {
+		d.usageFlushed = time.Now()
+	}
+	if time.Since(d.usageFlushed) > usageFlushInterval {
+		d.usageFlushed = time.Now()
+		go func() {
+			if err := d.FlushUsage(); err != nil {
+				log.Errorf("FlushUsage: %v", err)
+			}
+		}()
+	}
+}
+
+// FlushUsage saves the API usage data that is accumulated in memory.
+func (d *Database) FlushUsage() error {
+	defer recordLatency("FlushUsage")()
+
+	d.usageMutex.Lock()
+	pending := d.pendingUsage
+	pendingDevices := d.pendingDevices
+	d.pendingUsage = nil
+	d.pendingDevices = nil
+	d.usageMutex.Unlock()
+
+	uids := make(map[int64]bool)
+	for uid := range pending {
+		uids[uid] = true
+	}
+	for uid := range pendingDevices {
+		uids[uid] = true
+	}
+	var errorList []error
+	for uid := range uids {
+		if err := d.mergeUsage(uid, pending[uid], pendingDevices[uid]); err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+	if errorList != nil {
+		return fmt.Errorf("mergeUsage: %w %v", errorList[0], errorList[1:])
+	}
+	return nil
+}
+
+func (d *Database) mergeUsage(userID int64, days map[string]*DailyUsage, devices map[string]map[string]bool) error {
+	fn := d.filePath(homeByUserID(userID, usageFile))
+	if err := d.storage.CreateEmptyFile(fn, Usage{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	var usage Usage
+	commit, err := d.storage.OpenForUpdate(fn, &usage)
+	if err != nil {
+		return err
+	}
+	if usage.Days == nil {
+		usage.Days = make(map[string]*DailyUsage)
+	}
+	for day, u := range days {
+		if usage.Days[day] == nil {
+			usage.Days[day] = &DailyUsage{}
+		}
+		usage.Days[day].add(*u)
+	}
+	horizon := usageDay(nowInMS() - usageRetention.Milliseconds())
+	for day := range usage.Days {
+		if day < horizon {
+			delete(usage.Days, day)
+		}
+	}
+	if usage.Devices == nil {
+		usage.Devices = make(map[string][]string)
+	}
+	for day, ids := range devices {
+		for _, id := range usage.Devices[day] {
+			ids[id] = true
+		}
+		list := make([]string, 0, len(ids))
+		for id := range ids {
+			list = append(list, id)
+		}
+		sort.Strings(list)
+		usage.Devices[day] = list
+	}
+	deviceHorizon := usageDay(nowInMS() - deviceRetention.Milliseconds())
+	for day := range usage.Devices {
+		if day < deviceHorizon {
+			delete(usage.Devices, day)
+		}
+	}
+	return commit(true, nil)
+}
+
+// UsageForPeriod returns the user's API usage for the days that start with
+// period, e.g. "2022-11" for a month, or "2022-11-05" for a single day.
+func (d *Database) UsageForPeriod(userID int64, period string) (DailyUsage, error) {
+	defer recordLatency("UsageForPeriod")()
+
+	var usage Usage
+	if err := d.storage.ReadDataFile(d.filePath(homeByUserID(userID, usageFile)), &usage); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return DailyUsage{}, err
+	}
+	var total DailyUsage
+	for day, u := range usage.Days {
+		if strings.HasPrefix(day, period) {
+			total.add(*u)
+		}
+	}
+	d.usageMutex.Lock()
+	defer d.usageMutex.Unlock()
+	for day, u := range d.pendingUsage[userID] {
+		if strings.HasPrefix(day, period) {
+			total.add(*u)
+		}
+	}
+	return total, nil
+}
+
+// ActiveDevices returns the number of distinct devices that used the user's
+// account today, and in the last 7 days.
+func (d *Database) ActiveDevices(userID int64) (DeviceActivity, error) {
+	defer recordLatency("ActiveDevices")()
+
+	var usage Usage
+	if err := d.storage.ReadDataFile(d.filePath(homeByUserID(userID, usageFile)), &usage); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return DeviceActivity{}, err
+	}
+	now := nowInMS()
+	today := usageDay(now)
+	weekStart := usageDay(now - deviceRetention.Milliseconds() + 24*time.Hour.Milliseconds())
+	daily := make(map[string]bool)
+	weekly := make(map[string]bool)
+	add := func(day, id string) {
+		if day < weekStart || day > today {
+			return
+		}
+		weekly[id] = true
+		if day == today {
+			daily[id] = true
+		}
+	}
+	for day, ids := range usage.Devices {
+		for _, id := range ids {
+			add(day, id)
+		}
+	}
+	d.usageMutex.Lock()
+	defer d.usageMutex.Unlock()
+	for day, ids := range d.pendingDevices[userID] {
+		for id := range ids {
+			add(day, id)
+		}
+	}
+	return DeviceActivity{Daily: len(daily), Weekly: len(weekly)}, nil
+}
+
+// UsageReport returns the API usage of all the users for the given period.
+func (d *Database) UsageReport(period string) ([]UserUsage, error) {
+	defer recordLatency("UsageReport")()
+
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		return nil, err
+	}
+	var out []UserUsage
+	for _, u := range ul {
+		if len(u.Email) > 0 && u.Email[0] == '!' {
+			continue
+		}
+		user, err := d.UserByID(u.UserID)
+		if err != nil {
+			return nil, err
+		}
+		usage, err := d.UsageForPeriod(u.UserID, period)
+		if err != nil {
+			return nil, err
+		}
+		spaceUsed, sharedSpaceUsed, err := d.SpaceUsedDetails(user)
+		if err != nil {
+			return nil, err
+		}
+		devices, err := d.ActiveDevices(u.UserID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, UserUsage{
+			UserID:          u.UserID,
+			Email:           u.Email,
+			Period:          period,
+			DailyUsage:      usage,
+			SpaceUsed:       spaceUsed,
+			SharedSpaceUsed: sharedSpaceUsed,
+			ActiveDevices:   devices,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Email < out[j].Email
+	})
+	return out, nil
+}
+
+// UsageReportSent returns whether the usage report for month was already sent.
+func (d *Database) UsageReportSent(month string) (bool, error) {
+	var state usageReportState
+	if err := d.storage.ReadDataFile(d.filePath(usageReportFile), &state); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return state.LastMonth >= month, nil
+}
+
+// SetUsageReportSent records that the usage report for month was sent.
+func (d *Database) SetUsageReportSent(month string) error {
+	return d.storage.SaveDataFile(d.filePath(usageReportFile), usageReportState{LastMonth: month})
+}
@@ -0,0 +1,150 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestUsage(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser() failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User() failed: %v", err)
+	}
+
+	day1 := time.Date(2022, 11, 30, 12, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+
+	database.CurrentTimeForTesting = day1.UnixMilli()
+	db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesUploaded: 1000})
+	db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesDownloaded: 500})
+	if err := db.FlushUsage(); err != nil {
+		t.Fatalf("db.FlushUsage() failed: %v", err)
+	}
+	database.CurrentTimeForTesting = day2.UnixMilli()
+	db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesDownloaded: 200})
+
+	for _, tc := range []struct {
+		period string
+		want   database.DailyUsage
+	}{
+		{"2022-11", database.DailyUsage{Requests: 2, BytesUploaded: 1000, BytesDownloaded: 500}},
+		{"2022-12", database.DailyUsage{Requests: 1, BytesDownloaded: 200}},
+		{"2022-12-01", database.DailyUsage{Requests: 1, BytesDownloaded: 200}},
+		{"2022", database.DailyUsage{Requests: 3, BytesUploaded: 1000, BytesDownloaded: 700}},
+		{"2021", database.DailyUsage{}},
+	} {
+		got, err := db.UsageForPeriod(user.UserID, tc.period)
+		if err != nil {
+			t.Fatalf("db.UsageForPeriod(%q) failed: %v", tc.period, err)
+		}
+		if got != tc.want {
+			t.Errorf("db.UsageForPeriod(%q) = %+v, want %+v", tc.period, got, tc.want)
+		}
+	}
+
+	if err := db.FlushUsage(); err != nil {
+		t.Fatalf("db.FlushUsage() failed: %v", err)
+	}
+	report, err := db.UsageReport("2022")
+	if err != nil {
+		t.Fatalf("db.UsageReport() failed: %v", err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if want, got := (database.DailyUsage{Requests: 3, BytesUploaded: 1000, BytesDownloaded: 700}), report[0].DailyUsage; want != got {
+		t.Errorf("Unexpected report: want %+v, got %+v", want, got)
+	}
+
+	if sent, err := db.UsageReportSent("2022-11"); err != nil || sent {
+		t.Errorf("db.UsageReportSent() = %v, %v", sent, err)
+	}
+	if err := db.SetUsageReportSent("2022-11"); err != nil {
+		t.Fatalf("db.SetUsageReportSent() failed: %v", err)
+	}
+	if sent, err := db.UsageReportSent("2022-11"); err != nil || !sent {
+		t.Errorf("db.UsageReportSent() = %v, %v", sent, err)
+	}
+}
+
+func TestActiveDevices(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser() failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User() failed: %v", err)
+	}
+
+	day1 := time.Date(2022, 11, 30, 12, 0, 0, 0, time.UTC)
+	database.CurrentTimeForTesting = day1.UnixMilli()
+	db.RecordActiveDevice(user.UserID, "token-hash-phone")
+	db.RecordActiveDevice(user.UserID, "token-hash-laptop")
+	if err := db.FlushUsage(); err != nil {
+		t.Fatalf("db.FlushUsage() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		now  time.Time
+		hash string
+		want database.DeviceActivity
+	}{
+		{day1, "token-hash-phone", database.DeviceActivity{Daily: 2, Weekly: 2}},
+		{day1.Add(24 * time.Hour), "token-hash-phone", database.DeviceActivity{Daily: 1, Weekly: 2}},
+		{day1.Add(3 * 24 * time.Hour), "token-hash-tablet", database.DeviceActivity{Daily: 1, Weekly: 3}},
+		{day1.Add(7 * 24 * time.Hour), "token-hash-tablet", database.DeviceActivity{Daily: 1, Weekly: 2}},
+		{day1.Add(20 * 24 * time.Hour), "", database.DeviceActivity{}},
+	} {
+		database.CurrentTimeForTesting = tc.now.UnixMilli()
+		db.RecordActiveDevice(user.UserID, tc.hash)
+		got, err := db.ActiveDevices(user.UserID)
+		if err != nil {
+			t.Fatalf("db.ActiveDevices() failed: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("db.ActiveDevices() at %s = %+v, want %+v", tc.now.Format("2006-01-02"), got, tc.want)
+		}
+		if err := db.FlushUsage(); err != nil {
+			t.Fatalf("db.FlushUsage() failed: %v", err)
+		}
+	}
+
+	report, err := db.UsageReport("2022")
+	if err != nil {
+		t.Fatalf("db.UsageReport() failed: %v", err)
+	}
+	if len(report) != 1 || report[0].ActiveDevices != (database.DeviceActivity{}) {
+		t.Errorf("db.UsageReport() = %+v", report)
+	}
+}
@@ -18,6 +18,7 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
@@ -41,6 +42,18 @@ const (
 	userListFile    = "users.dat"
 	userFile        = "user.dat"
 	contactListFile = "contact-list.dat"
+
+	// The number of previous TokenKeys that are kept after a rotation.
+	maxPrevTokenKeys = 2
+)
+
+var (
+	// ErrOnHold is returned when a destructive operation is attempted on an
+	// account that is on hold.
+	ErrOnHold = errors.New("account is on hold")
+	// ErrTooManySessions is returned when a user already has the maximum
+	// number of valid sessions.
+	ErrTooManySessions = errors.New("too many sessions")
 )
 
 // This is used internally for the list of all users in the system.
@@ -57,8 +70,24 @@ type User struct {
 	// Whether this user account needs to be approved. Accounts that need
 	// approval can't upload or share files.
 	NeedApproval bool `json:"needApproval"`
+	// Whether the user's email address still needs to be verified. Login
+	// is refused until it is.
+	NeedEmailVerification bool `json:"needEmailVerification,omitempty"`
 	// Whether this user is an administrator of the system.
 	Admin bool `json:"admin"`
+	// Whether this account is on hold. While it is set, nothing can be
+	// deleted from the account, and the account itself can't be deleted.
+	Hold bool `json:"hold,omitempty"`
+	// Whether the user must change their password, and upload a new key
+	// bundle, before doing anything else, e.g. after a suspected
+	// compromise.
+	ForcePasswordChange bool `json:"forcePasswordChange,omitempty"`
+	// The settings of a limited account. It is nil for regular accounts.
+	Limited *LimitedAccount `json:"limited,omitempty"`
+	// The number of days after which the files in the user's trash are
+	// deleted, set by an administrator. It overrides the server's default
+	// when it isn't nil. Zero keeps the files until the user deletes them.
+	TrashRetentionDays *int `json:"trashRetentionDays,omitempty"`
 	// The unique user ID of the user.
 	UserID int64 `json:"userId"`
 	// The unique email address of the user.
@@ -83,19 +112,76 @@ type User struct {
 	// The server's secret key used for encrypting tokens for this user,
 	// encrypted with master key.
 	TokenKey string `json:"serverTokenKey"`
-	// A set of valid tokens. Each Login adds a token. Each logout remove one.
+	// The previous TokenKeys, encrypted with master key, most recent first.
+	// They are still accepted for the tokens that were issued before the
+	// TokenKey was rotated.
+	PrevTokenKeys []string `json:"prevTokenKeys,omitempty"`
+	// A set of valid tokens that were issued before TokenEpoch was
+	// introduced. New tokens are not added here.
 	ValidTokens map[string]bool `json:"validTokens"`
+	// The current token epoch. All the tokens issued with an older epoch are
+	// revoked.
+	TokenEpoch int64 `json:"tokenEpoch,omitempty"`
+	// The tokens that were revoked individually, e.g. with logout. The key is
+	// the token hash and the value is when the entry can be removed.
+	RevokedTokens map[string]int64 `json:"revokedTokens,omitempty"`
+	// The session tokens that were issued in the current token epoch, when
+	// the number of sessions is limited. The key is the token hash and the
+	// value is when the token expires, in nanoseconds since epoch.
+	Sessions map[string]int64 `json:"sessions,omitempty"`
+	// The devices that are logged in, i.e. the session tokens that were
+	// issued in the current token epoch. The key is the token hash.
+	SessionInfo map[string]*SessionInfo `json:"sessionInfo,omitempty"`
 	// Whether multi-factor authentication is required for login and other
 	// sensitive operations.
 	RequireMFA bool `json:"requireMFA"`
 	// The OTP key for this user.
 	OTPKey string `json:"otpKey,omitempty"`
+	// The hashes of the user's unused OTP backup codes. Each one can be
+	// used once instead of an OTP code, e.g. after losing the device.
+	OTPBackupCodes []string `json:"otpBackupCodes,omitempty"`
 	// Decoy accounts that the user can access with different passwords.
 	Decoys []*Decoy `json:"decoys,omitempty"`
 	// PushConfig contains the user's Push API configuration.
 	PushConfig *PushConfig `json:"pushConfig,omitempty"`
 	// WebAuthnConfig contains the user's WebAuthn configuration.
 	WebAuthnConfig *WebAuthnConfig `json:"webAuthNConfig,omitempty"`
+
+	// The context of the request that the user is making, if any. It is
+	// never saved.
+	ctx context.Context
+}
+
+// Context returns the context of the request that the user is making, or
+// context.Background().
+func (u User) Context() context.Context {
+	if u.ctx == nil {
+		return context.Background()
+	}
+	return u.ctx
+}
+
+// WithContext returns a copy of the user with ctx as the context of the request
+// that the user is making. Its timing.Timers record the time spent in the
+// database.
+func (u User) WithContext(ctx context.Context) User {
+	u.ctx = ctx
+	return u
+}
+
+// SessionInfo contains information about a logged-in device.
+type SessionInfo struct {
+	// The name of the device, e.g. its user agent.
+	DeviceName string `json:"deviceName,omitempty"`
+	// The IP address that the device used most recently.
+	IP string `json:"ip,omitempty"`
+	// When the device logged in, in milliseconds.
+	Created int64 `json:"created"`
+	// When the device was last seen, in milliseconds. It is updated at most
+	// once per hour.
+	LastSeen int64 `json:"lastSeen"`
+	// When the session token expires, in milliseconds.
+	Expires int64 `json:"expires"`
 }
 
 // A decoy account's information.
@@ -196,7 +282,12 @@ func homeByUserID(userID int64, elems ...string) string {
 // AddUser creates a new user account for u.
 func (d *Database) AddUser(u User) (userID int64, retErr error) {
 	defer recordLatency("AddUser")()
+	return d.addUser(u, false)
+}
 
+// addUser adds a new user. When firstOnly is true, it fails with
+// ErrSetupDone if any user already exists.
+func (d *Database) addUser(u User, firstOnly bool) (userID int64, retErr error) {
 	var ul []userList
 	commit, err := d.storage.OpenForUpdate(d.filePath(userListFile), &ul)
 	if err != nil {
@@ -204,6 +295,9 @@ func (d *Database) AddUser(u User) (userID int64, retErr error) {
 		return 0, err
 	}
 	defer commit(false, &retErr)
+	if firstOnly && len(ul) > 0 {
+		return 0, ErrSetupDone
+	}
 	uids := make(map[int64]bool)
 	for _, i := range ul {
 		if i.Email == u.Email {
@@ -226,6 +320,7 @@ func (d *Database) AddUser(u User) (userID int64, retErr error) {
 		// First user is an admin.
 		u.Admin = true
 		u.NeedApproval = false
+		u.NeedEmailVerification = false
 	}
 	ul = append(ul, userList{UserID: uid, Email: u.Email, Admin: u.Admin})
 
@@ -245,6 +340,7 @@ func (d *Database) AddUser(u User) (userID int64, retErr error) {
 	u.ServerPublicKey = ssk.PublicKey()
 	tk := token.MakeKey()
 	defer tk.Wipe()
+	u.TokenEpoch = 1
 	if u.TokenKey, err = d.EncryptTokenKey(tk); err != nil {
 		return 0, err
 	}
@@ -403,6 +499,107 @@ func (d *Database) User(email string) (User, error) {
 	return User{}, os.ErrNotExist
 }
 
+// RevokeToken revokes one of the user's tokens, identified by its hash, until
+// exp (in seconds since epoch).
+func (u *User) RevokeToken(hash string, exp int64) {
+	delete(u.ValidTokens, hash)
+	delete(u.Sessions, hash)
+	delete(u.SessionInfo, hash)
+	now := time.Now().Unix()
+	for k, v := range u.RevokedTokens {
+		if v < now {
+			delete(u.RevokedTokens, k)
+		}
+	}
+	if u.RevokedTokens == nil {
+		u.RevokedTokens = make(map[string]int64)
+	}
+	u.RevokedTokens[hash] = exp
+}
+
+// RevokeAllTokens revokes all of the user's tokens by moving to a new token
+// epoch. The tokens issued before token epochs were introduced are accepted
+// with epoch 1, so the new epoch is at least 2.
+func (u *User) RevokeAllTokens() {
+	if u.TokenEpoch < 1 {
+		u.TokenEpoch = 1
+	}
+	u.TokenEpoch++
+	u.ValidTokens = make(map[string]bool)
+	u.RevokedTokens = nil
+	u.PrevTokenKeys = nil
+	u.Sessions = nil
+	u.SessionInfo = nil
+}
+
+// AddSessionInfo records the information about a new session token,
+// identified by its hash. The sessions that expired are forgotten.
+func (u *User) AddSessionInfo(hash string, info SessionInfo) {
+	now := time.Now().UnixMilli()
+	for k, v := range u.SessionInfo {
+		if v.Expires < now {
+			delete(u.SessionInfo, k)
+		}
+	}
+	if u.SessionInfo == nil {
+		u.SessionInfo = make(map[string]*SessionInfo)
+	}
+	u.SessionInfo[hash] = &info
+}
+
+// AddSession records a new session token, identified by its hash, that
+// expires at exp. When the user already has max valid sessions, the oldest
+// ones are revoked if evict is true. Otherwise, ErrTooManySessions is
+// returned. There is no limit when max is 0.
+func (u *User) AddSession(hash string, exp time.Time, max int, evict bool) error {
+	if max <= 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	for k, v := range u.Sessions {
+		if v < now {
+			delete(u.Sessions, k)
+		}
+	}
+	if len(u.Sessions) >= max && !evict {
+		return ErrTooManySessions
+	}
+	for len(u.Sessions) >= max {
+		var oldest string
+		for k, v := range u.Sessions {
+			if oldest == "" || v < u.Sessions[oldest] || (v == u.Sessions[oldest] && k < oldest) {
+				oldest = k
+			}
+		}
+		u.RevokeToken(oldest, time.Unix(0, u.Sessions[oldest]).Unix()+1)
+	}
+	if u.Sessions == nil {
+		u.Sessions = make(map[string]int64)
+	}
+	u.Sessions[hash] = exp.UnixNano()
+	return nil
+}
+
+// RotateTokenKey replaces the user's TokenKey with a new one. The tokens that
+// were issued with the previous keys remain valid, up to maxPrevTokenKeys
+// rotations.
+func (d *Database) RotateTokenKey(userID int64) error {
+	defer recordLatency("RotateTokenKey")()
+
+	return d.MutateUser(userID, func(u *User) error {
+		etk, err := d.NewEncryptedTokenKey()
+		if err != nil {
+			return err
+		}
+		u.PrevTokenKeys = append([]string{u.TokenKey}, u.PrevTokenKeys...)
+		if len(u.PrevTokenKeys) > maxPrevTokenKeys {
+			u.PrevTokenKeys = u.PrevTokenKeys[:maxPrevTokenKeys]
+		}
+		u.TokenKey = etk
+		return nil
+	})
+}
+
 // NewEncryptedTokenKey returns a new encrypted TokenKey.
 func (d *Database) NewEncryptedTokenKey() (string, error) {
 	tk := token.MakeKey()
@@ -424,6 +621,28 @@ func (d *Database) DecryptTokenKey(key string) (*token.Key, error) {
 	return token.KeyFromBytes(k), nil
 }
 
+// TokenKeyForToken returns the user's TokenKey that was used to encrypt tok,
+// the current one or a previous one.
+func (d *Database) TokenKeyForToken(u User, tok string) (*token.Key, error) {
+	id, ok := token.KeyID(tok)
+	if !ok {
+		// Legacy tokens don't have a key ID. They were all issued
+		// before any rotation.
+		return d.DecryptTokenKey(u.TokenKey)
+	}
+	for _, etk := range append([]string{u.TokenKey}, u.PrevTokenKeys...) {
+		tk, err := d.DecryptTokenKey(etk)
+		if err != nil {
+			return nil, err
+		}
+		if tk.ID() == id {
+			return tk, nil
+		}
+		tk.Wipe()
+	}
+	return nil, token.ErrValidationFailed
+}
+
 // EncryptSecretKey encrypts a SecretKey.
 func (d *Database) EncryptSecretKey(sk *stingle.SecretKey) (string, error) {
 	return d.Encrypt(sk.ToBytes())
@@ -453,6 +672,10 @@ func (d *Database) TokenKeyForUser(email string) (*token.Key, error) {
 func (d *Database) DeleteUser(u User) error {
 	defer recordLatency("DeleteUser")()
 
+	if u.Hold {
+		return ErrOnHold
+	}
+
 	var ul []userList
 	commit, err := d.storage.OpenForUpdate(d.filePath(userListFile), &ul)
 	if err != nil {
@@ -472,6 +695,9 @@ func (d *Database) DeleteUser(u User) error {
 	if err := d.removeAllContacts(u); err != nil {
 		return err
 	}
+	if err := d.removeEscrows(u); err != nil {
+		return err
+	}
 
 	albumRefs, err := d.AlbumRefs(u)
 	if err != nil {
@@ -493,17 +719,25 @@ func (d *Database) DeleteUser(u User) error {
 			return err
 		}
 	}
+	d.refMutex.RLock()
 	commit, filesets, err := d.fileSetsForUpdate(u, []string{stingle.GallerySet, stingle.TrashSet}, []string{"", ""})
 	if err != nil {
+		d.refMutex.RUnlock()
 		return err
 	}
 	for _, fs := range filesets {
 		for _, f := range fs.Files {
-			d.incRefCount(f.StoreFile, -1)
-			d.incRefCount(f.StoreThumb, -1)
+			for _, blob := range f.blobs() {
+				d.incRefCount(blob, -1)
+			}
 		}
 	}
-	if err := commit(true, nil); err != nil {
+	err = commit(true, nil)
+	d.refMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if _, err := d.purgeUserFiles(u.UserID, math.MaxInt64); err != nil {
 		return err
 	}
 	for _, f := range []string{
@@ -517,6 +751,14 @@ func (d *Database) DeleteUser(u User) error {
 			return err
 		}
 	}
+	d.usageMutex.Lock()
+	delete(d.pendingUsage, u.UserID)
+	d.usageMutex.Unlock()
+	for _, f := range []string{usageFile, importsFile, purgeQueueFile, activityFile} {
+		if err := os.Remove(filepath.Join(d.Dir(), d.filePath(u.home(f)))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"github.com/go-test/deep"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/stingle/token"
 )
 
 func addUser(db *database.Database, email string, pk stingle.PublicKey) error {
@@ -170,3 +172,127 @@ func TestRenameUser(t *testing.T) {
 	}
 
 }
+
+func TestHold(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User: %v", err)
+	}
+	if err := addAlbum(db, user, "album1"); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	for _, f := range []string{"file1", "file2"} {
+		if err := addFile(db, user, f, stingle.TrashSet, ""); err != nil {
+			t.Fatalf("addFile(%q): %v", f, err)
+		}
+	}
+
+	setHold := func(hold bool) {
+		t.Helper()
+		data, err := db.AdminData(nil)
+		if err != nil {
+			t.Fatalf("db.AdminData: %v", err)
+		}
+		changes := &database.AdminData{
+			Tag:   data.Tag,
+			Users: []database.AdminUser{{UserID: user.UserID, Hold: &hold}},
+		}
+		if _, err := db.AdminData(changes); err != nil {
+			t.Fatalf("db.AdminData: %v", err)
+		}
+		if user, err = db.User("alice@"); err != nil {
+			t.Fatalf("db.User: %v", err)
+		}
+	}
+
+	setHold(true)
+	if err := db.DeleteFiles(user, []string{"file1"}); err != database.ErrOnHold {
+		t.Errorf("db.DeleteFiles() = %v, want ErrOnHold", err)
+	}
+	if err := db.EmptyTrash(user, 20000); err != database.ErrOnHold {
+		t.Errorf("db.EmptyTrash() = %v, want ErrOnHold", err)
+	}
+	if err := db.DeleteAlbum(user, "album1"); err != database.ErrOnHold {
+		t.Errorf("db.DeleteAlbum() = %v, want ErrOnHold", err)
+	}
+	if err := db.DeleteUser(user); err != database.ErrOnHold {
+		t.Errorf("db.DeleteUser() = %v, want ErrOnHold", err)
+	}
+	fs, err := db.FileSet(user, stingle.TrashSet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet: %v", err)
+	}
+	if n := len(fs.Files); n != 2 {
+		t.Errorf("Trash has %d files, want 2", n)
+	}
+
+	setHold(false)
+	if err := db.EmptyTrash(user, 20000); err != nil {
+		t.Errorf("db.EmptyTrash() = %v", err)
+	}
+	if err := db.DeleteUser(user); err != nil {
+		t.Errorf("db.DeleteUser() = %v", err)
+	}
+}
+
+func TestRotateTokenKey(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	key := stingle.MakeSecretKeyForTest()
+	if err := addUser(db, "alice@", key.PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	mint := func() string {
+		tk, err := db.TokenKeyForUser("alice@")
+		if err != nil {
+			t.Fatalf("TokenKeyForUser failed: %v", err)
+		}
+		defer tk.Wipe()
+		u, err := db.User("alice@")
+		if err != nil {
+			t.Fatalf("User failed: %v", err)
+		}
+		return token.Mint(tk, token.Token{Scope: "session", Subject: u.UserID}, time.Hour)
+	}
+	check := func(tok string) error {
+		u, err := db.User("alice@")
+		if err != nil {
+			t.Fatalf("User failed: %v", err)
+		}
+		tk, err := db.TokenKeyForToken(u, tok)
+		if err != nil {
+			return err
+		}
+		defer tk.Wipe()
+		_, err = token.Decrypt(tk, tok)
+		return err
+	}
+
+	var toks []string
+	for i := 0; i < 4; i++ {
+		toks = append(toks, mint())
+		u, err := db.User("alice@")
+		if err != nil {
+			t.Fatalf("User failed: %v", err)
+		}
+		if err := db.RotateTokenKey(u.UserID); err != nil {
+			t.Fatalf("RotateTokenKey failed: %v", err)
+		}
+	}
+	// Only the last 2 keys are kept after 4 rotations.
+	for i, tok := range toks {
+		if err, want := check(tok), i >= 2; (err == nil) != want {
+			t.Errorf("Token %d: check() = %v, want valid=%v", i, err, want)
+		}
+	}
+	if err := check(mint()); err != nil {
+		t.Errorf("check() with current key failed: %v", err)
+	}
+}
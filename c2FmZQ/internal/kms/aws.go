@@ -0,0 +1,162 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsKMS implements KeyWrapper with AWS KMS.
+type awsKMS struct {
+	keyID        string
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newAWSKMS returns an awsKMS for keyID. The credentials are read from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment
+// variables. The default region is the value of AWS_REGION.
+func newAWSKMS(keyID string, q url.Values) (*awsKMS, error) {
+	k := &awsKMS{
+		keyID:        keyID,
+		endpoint:     q.Get("endpoint"),
+		region:       q.Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if k.region == "" {
+		k.region = os.Getenv("AWS_REGION")
+	}
+	if k.region == "" {
+		k.region = "us-east-1"
+	}
+	if k.endpoint == "" {
+		k.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", k.region)
+	}
+	if k.accessKey == "" || k.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return k, nil
+}
+
+// Wrap encrypts key with the KMS Encrypt API.
+func (k *awsKMS) Wrap(key []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	if err := k.call("Encrypt", map[string]interface{}{"KeyId": k.keyID, "Plaintext": key}, &out); err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Unwrap decrypts a key with the KMS Decrypt API.
+func (k *awsKMS) Unwrap(wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	if err := k.call("Decrypt", map[string]interface{}{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func (k *awsKMS) call(action string, in, out interface{}) error {
+	req, body, err := newJSONRequest(k.endpoint, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.sign(req, body, time.Now().UTC())
+	return do(req, out)
+}
+
+// sign adds an AWS Signature Version 4 to the request.
+func (k *awsKMS) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if k.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", k.sessionToken)
+	}
+	headers := map[string]string{
+		"host":         req.URL.Host,
+		"content-type": req.Header.Get("Content-Type"),
+	}
+	for h, v := range req.Header {
+		if lh := strings.ToLower(h); strings.HasPrefix(lh, "x-amz-") {
+			headers[lh] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for h := range headers {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, h := range names {
+		canonicalHeaders.WriteString(h + ":" + headers[h] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := day + "/" + k.region + "/kms/aws4_request"
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+k.secretKey), day)
+	key = hmacSHA256(key, k.region)
+	key = hmacSHA256(key, "kms")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", k.accessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,109 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpKMS implements KeyWrapper with GCP Cloud KMS.
+type gcpKMS struct {
+	name     string
+	endpoint string
+}
+
+// newGCPKMS returns a gcpKMS for the key name, e.g.
+// projects/P/locations/L/keyRings/R/cryptoKeys/K. The access token is the
+// value of GOOGLE_OAUTH_ACCESS_TOKEN, or the token of the instance's service
+// account from the metadata server.
+func newGCPKMS(name string, q url.Values) (*gcpKMS, error) {
+	if !strings.HasPrefix(name, "projects/") || strings.Count(name, "/") != 7 {
+		return nil, errors.New("the GCP KMS key must be projects/P/locations/L/keyRings/R/cryptoKeys/K")
+	}
+	k := &gcpKMS{
+		name:     name,
+		endpoint: strings.TrimSuffix(q.Get("endpoint"), "/"),
+	}
+	if k.endpoint == "" {
+		k.endpoint = "https://cloudkms.googleapis.com"
+	}
+	return k, nil
+}
+
+// Wrap encrypts key with the cryptoKeys.encrypt API.
+func (k *gcpKMS) Wrap(key []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := k.call("encrypt", map[string][]byte{"plaintext": key}, &out); err != nil {
+		return nil, err
+	}
+	return out.Ciphertext, nil
+}
+
+// Unwrap decrypts a key with the cryptoKeys.decrypt API.
+func (k *gcpKMS) Unwrap(wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	if err := k.call("decrypt", map[string][]byte{"ciphertext": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func (k *gcpKMS) call(method string, in, out interface{}) error {
+	token, err := gcpAccessToken()
+	if err != nil {
+		return err
+	}
+	req, _, err := newJSONRequest(k.endpoint+"/v1/"+k.name+":"+method, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return do(req, out)
+}
+
+// gcpAccessToken returns the OAuth2 access token used with the GCP APIs.
+func gcpAccessToken() (string, error) {
+	if t := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := do(req, &out); err != nil {
+		return "", err
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("no access token from the metadata server")
+	}
+	return out.AccessToken, nil
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package kms implements the key management services that can protect the
+// database's master key instead of a passphrase: AWS KMS, GCP KMS, and
+// HashiCorp Vault's transit secrets engine.
+//
+// The master key is still saved in master.key, encrypted with a passphrase.
+// With a key management service, the passphrase is a random secret that is
+// saved in master.key.wrapped, encrypted by the service. The secret is
+// decrypted by the service when the server starts.
+package kms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WrappedFile is the name of the file, in the database directory, that
+// contains the wrapped passphrase of the master key.
+const WrappedFile = "master.key.wrapped"
+
+// KeyWrapper encrypts and decrypts small secrets with a key that never leaves
+// a key management service.
+type KeyWrapper interface {
+	// Wrap encrypts key.
+	Wrap(key []byte) ([]byte, error)
+	// Unwrap decrypts a key that was encrypted with Wrap.
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// New returns the KeyWrapper for rawURL, one of:
+//
+//   - awskms:KEYID, e.g. awskms:alias/c2fmzq or awskms:arn:aws:kms:...
+//   - gcpkms:NAME, e.g. gcpkms:projects/P/locations/L/keyRings/R/cryptoKeys/K
+//   - vault:MOUNT/KEY, e.g. vault:transit/c2fmzq
+//
+// The optional endpoint query parameter overrides the address of the service,
+// e.g. vault:transit/c2fmzq?endpoint=https://vault:8200. The AWS KMS region is
+// set with the region query parameter.
+func New(rawURL string) (KeyWrapper, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	key := u.Opaque
+	if key == "" {
+		return nil, fmt.Errorf("invalid key management service url %q", rawURL)
+	}
+	switch u.Scheme {
+	case "awskms":
+		return newAWSKMS(key, u.Query())
+	case "gcpkms":
+		return newGCPKMS(key, u.Query())
+	case "vault":
+		return newVault(key, u.Query())
+	default:
+		return nil, fmt.Errorf("unknown key management service %q", u.Scheme)
+	}
+}
+
+// Passphrase returns the passphrase of the master key in dir, unwrapped by w.
+// When the database doesn't have a master key yet, a new random passphrase is
+// created and saved, wrapped by w.
+func Passphrase(w KeyWrapper, dir string) ([]byte, error) {
+	file := filepath.Join(dir, WrappedFile)
+	wrapped, err := os.ReadFile(file)
+	if err == nil {
+		return w.Unwrap(wrapped)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "master.key")); err == nil {
+		return nil, errors.New("master.key is protected by a passphrase, use 'inspect change-passphrase --new-masterkey-backend' to change it")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return NewPassphrase(w, file)
+}
+
+// NewPassphrase creates a new random passphrase and saves it to file, wrapped
+// by w.
+func NewPassphrase(w KeyWrapper, file string) ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	pp := []byte(base64.RawStdEncoding.EncodeToString(b))
+	wrapped, err := w.Wrap(pp)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, wrapped, 0600); err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// newJSONRequest returns a POST request to url with in encoded in JSON. The
+// encoded body is also returned, for the request signatures.
+func newJSONRequest(url string, in interface{}) (*http.Request, []byte, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, body, nil
+}
+
+// do sends req and decodes the JSON response in out. Non-2xx responses are
+// returned as errors.
+func do(req *http.Request, out interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
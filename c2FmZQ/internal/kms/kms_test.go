@@ -0,0 +1,183 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeKMS implements the encrypt and decrypt APIs of AWS KMS, GCP KMS, and
+// vault. The "encryption" only adds a prefix to the plaintext.
+type fakeKMS struct{}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var in map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := map[string]interface{}{}
+	switch {
+	case req.Header.Get("X-Amz-Target") != "":
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || in["KeyId"] != "alias/test" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			out["CiphertextBlob"] = []byte("wrapped:" + decode(in["Plaintext"]))
+		case "TrentService.Decrypt":
+			out["Plaintext"] = []byte(strings.TrimPrefix(decode(in["CiphertextBlob"]), "wrapped:"))
+		}
+	case req.Header.Get("X-Vault-Token") != "":
+		if req.Header.Get("X-Vault-Token") != "TOKEN" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/transit/encrypt/test":
+			out["data"] = map[string]string{"ciphertext": "vault:v1:" + decode(in["plaintext"])}
+		case "/v1/transit/decrypt/test":
+			out["data"] = map[string][]byte{"plaintext": []byte(strings.TrimPrefix(in["ciphertext"].(string), "vault:v1:"))}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+	default:
+		if req.Header.Get("Authorization") != "Bearer TOKEN" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/projects/p/locations/l/keyRings/r/cryptoKeys/test:encrypt":
+			out["ciphertext"] = []byte("wrapped:" + decode(in["plaintext"]))
+		case "/v1/projects/p/locations/l/keyRings/r/cryptoKeys/test:decrypt":
+			out["plaintext"] = []byte(strings.TrimPrefix(decode(in["ciphertext"]), "wrapped:"))
+		default:
+			http.NotFound(w, req)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func decode(v interface{}) string {
+	var b []byte
+	s, _ := json.Marshal(v)
+	json.Unmarshal(s, &b)
+	return string(b)
+}
+
+func TestKeyWrappers(t *testing.T) {
+	srv := httptest.NewServer(&fakeKMS{})
+	defer srv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "TOKEN")
+	t.Setenv("VAULT_TOKEN", "TOKEN")
+
+	for _, u := range []string{
+		"awskms:alias/test?region=test&endpoint=" + srv.URL,
+		"gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/test?endpoint=" + srv.URL,
+		"vault:transit/test?endpoint=" + srv.URL,
+	} {
+		w, err := New(u)
+		if err != nil {
+			t.Fatalf("New(%q): %v", u, err)
+		}
+		wrapped, err := w.Wrap([]byte("hello"))
+		if err != nil {
+			t.Fatalf("[%s] Wrap: %v", u, err)
+		}
+		if bytes.Equal(wrapped, []byte("hello")) {
+			t.Errorf("[%s] Wrap returned the plaintext", u)
+		}
+		got, err := w.Unwrap(wrapped)
+		if err != nil {
+			t.Fatalf("[%s] Unwrap: %v", u, err)
+		}
+		if want := "hello"; string(got) != want {
+			t.Errorf("[%s] Unwrap() = %q, want %q", u, got, want)
+		}
+
+		dir := t.TempDir()
+		pp, err := Passphrase(w, dir)
+		if err != nil {
+			t.Fatalf("[%s] Passphrase: %v", u, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, WrappedFile)); err != nil {
+			t.Errorf("[%s] Stat: %v", u, err)
+		}
+		pp2, err := Passphrase(w, dir)
+		if err != nil {
+			t.Fatalf("[%s] Passphrase: %v", u, err)
+		}
+		if len(pp) == 0 || !bytes.Equal(pp, pp2) {
+			t.Errorf("[%s] Passphrase() = %q, then %q", u, pp, pp2)
+		}
+	}
+
+	t.Setenv("VAULT_TOKEN", "WRONG")
+	w, err := New("vault:transit/test?endpoint=" + srv.URL)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := w.Wrap([]byte("hello")); err == nil {
+		t.Error("Wrap with the wrong token didn't fail")
+	}
+}
+
+func TestPassphraseExistingMasterKey(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "TOKEN")
+	w, err := New("vault:transit/test?endpoint=http://127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "master.key"), []byte("key"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := Passphrase(w, dir); err == nil {
+		t.Error("Passphrase didn't fail with an existing master.key")
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	t.Setenv("VAULT_ADDR", "https://vault:8200")
+	t.Setenv("VAULT_TOKEN", "TOKEN")
+	for _, u := range []string{"awskms:alias/foo", "gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/k", "vault:transit/foo"} {
+		if _, err := New(u); err != nil {
+			t.Errorf("New(%q): %v", u, err)
+		}
+	}
+	for _, u := range []string{"", "passphrase", "awskms:", "gcpkms:foo", "vault:foo", "foo:bar"} {
+		if _, err := New(u); err == nil {
+			t.Errorf("New(%q) didn't fail", u)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// vault implements KeyWrapper with the transit secrets engine of HashiCorp
+// Vault.
+type vault struct {
+	mount     string
+	key       string
+	endpoint  string
+	token     string
+	namespace string
+}
+
+// newVault returns a vault for the key mount/key, e.g. transit/c2fmzq. The
+// default endpoint is the value of VAULT_ADDR. The token is read from the
+// VAULT_TOKEN environment variable, and the optional namespace from
+// VAULT_NAMESPACE.
+func newVault(name string, q url.Values) (*vault, error) {
+	name = strings.Trim(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i <= 0 {
+		return nil, errors.New("the vault key must be MOUNT/KEY, e.g. transit/c2fmzq")
+	}
+	v := &vault{
+		mount:     name[:i],
+		key:       name[i+1:],
+		endpoint:  q.Get("endpoint"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
+	if v.endpoint == "" {
+		v.endpoint = os.Getenv("VAULT_ADDR")
+	}
+	if v.endpoint == "" {
+		return nil, errors.New("VAULT_ADDR must be set")
+	}
+	v.endpoint = strings.TrimSuffix(v.endpoint, "/")
+	if v.token == "" {
+		return nil, errors.New("VAULT_TOKEN must be set")
+	}
+	return v, nil
+}
+
+// Wrap encrypts key with the transit encrypt API.
+func (v *vault) Wrap(key []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := v.call("encrypt", map[string]interface{}{"plaintext": key}, &out); err != nil {
+		return nil, err
+	}
+	if out.Data.Ciphertext == "" {
+		return nil, errors.New("no ciphertext from vault")
+	}
+	return []byte(out.Data.Ciphertext), nil
+}
+
+// Unwrap decrypts a key with the transit decrypt API.
+func (v *vault) Unwrap(wrapped []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Plaintext []byte `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.call("decrypt", map[string]string{"ciphertext": string(wrapped)}, &out); err != nil {
+		return nil, err
+	}
+	return out.Data.Plaintext, nil
+}
+
+func (v *vault) call(op string, in, out interface{}) error {
+	req, _, err := newJSONRequest(v.endpoint+"/v1/"+path.Join(v.mount, op, v.key), in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	return do(req, out)
+}
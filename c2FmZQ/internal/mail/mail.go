@@ -0,0 +1,92 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package mail sends email messages with SMTP.
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Config contains the SMTP configuration.
+type Config struct {
+	// The address of the SMTP server, e.g. smtp.example.com:587
+	Server string
+	// The username and password to authenticate with the SMTP server. If
+	// Username is empty, no authentication is used.
+	Username string
+	Password string
+	// The address to use in the From header.
+	From string
+}
+
+// Mailer sends email messages.
+type Mailer struct {
+	cfg  Config
+	from string
+}
+
+// New returns a new Mailer.
+func New(cfg Config) (*Mailer, error) {
+	if cfg.Server == "" || cfg.From == "" {
+		return nil, errors.New("smtp server and from address must be set")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		return nil, err
+	}
+	from, err := netmail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{cfg: cfg, from: from.Address}, nil
+}
+
+// Send sends a plain text message.
+func (m *Mailer) Send(to []string, subject, body string) error {
+	if len(to) == 0 {
+		return nil
+	}
+	for _, t := range append(to, subject) {
+		if strings.ContainsAny(t, "\r\n") {
+			return errors.New("invalid header value")
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(m.cfg.Server)
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+	return smtp.SendMail(m.cfg.Server, auth, m.from, to, buf.Bytes())
+}
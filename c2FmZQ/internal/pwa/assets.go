@@ -0,0 +1,190 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package pwa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Asset is a file of the web app, ready to be served.
+type Asset struct {
+	// Content is the content of the file, with the references to the other
+	// files replaced with their hashed names.
+	Content []byte
+	// Immutable indicates that the name of the file contains the hash of
+	// its content. The browsers and the caches can keep it forever.
+	Immutable bool
+}
+
+// entryPoints are the files that keep their names. The browsers must always
+// fetch them from the server to see new versions of the web app.
+var entryPoints = map[string]bool{
+	"index.html":         true,
+	"service-worker.js":  true,
+	"c2fmzq.webmanifest": true,
+	"sw-tests.html":      true,
+}
+
+var (
+	assetsOnce sync.Once
+	assets     map[string]Asset
+)
+
+// Assets returns the files of the web app, by name. The names of the
+// scripts, stylesheets, and images contain the hash of their content, e.g.
+// main.0123456789abcdef.js, and the references to them are rewritten
+// accordingly. So, a new version of the web app never uses any file of an
+// old version, even when the browsers or the caches have them.
+func Assets() map[string]Asset {
+	assetsOnce.Do(func() {
+		a, err := hashAssets(FS)
+		if err != nil {
+			panic(err)
+		}
+		assets = a
+	})
+	return assets
+}
+
+// hashAssets returns the files of fsys with content-hashed names.
+func hashAssets(fsys fs.FS) (map[string]Asset, error) {
+	content := make(map[string][]byte)
+	var hashable []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		content[p] = b
+		switch path.Ext(p) {
+		case ".js", ".css", ".png":
+			if !entryPoints[p] {
+				hashable = append(hashable, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hashable)
+
+	h := &assetHasher{content: content, hashable: hashable, names: make(map[string]string), visiting: make(map[string]bool)}
+	out := make(map[string]Asset)
+	for p := range content {
+		name, err := h.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = Asset{Content: h.content[p], Immutable: name != p}
+	}
+	return out, nil
+}
+
+type assetHasher struct {
+	content  map[string][]byte
+	hashable []string
+	names    map[string]string
+	visiting map[string]bool
+}
+
+// resolve rewrites the references in the file p, and returns its new name.
+// The files that p references are resolved first, since their names are part
+// of p's content.
+func (h *assetHasher) resolve(p string) (string, error) {
+	if n, ok := h.names[p]; ok {
+		return n, nil
+	}
+	if h.visiting[p] {
+		return "", fmt.Errorf("%s: circular reference", p)
+	}
+	h.visiting[p] = true
+	defer delete(h.visiting, p)
+
+	// The third-party files are used as they are.
+	if !strings.HasPrefix(p, "thirdparty/") && isText(p) {
+		b := h.content[p]
+		for _, ref := range h.hashable {
+			if ref == p || !hasReference(b, ref) {
+				continue
+			}
+			n, err := h.resolve(ref)
+			if err != nil {
+				return "", err
+			}
+			b = replaceReference(b, ref, n)
+		}
+		h.content[p] = b
+	}
+	name := p
+	if !entryPoints[p] && contains(h.hashable, p) {
+		sum := sha256.Sum256(h.content[p])
+		ext := path.Ext(p)
+		name = strings.TrimSuffix(p, ext) + "." + hex.EncodeToString(sum[:8]) + ext
+	}
+	h.names[p] = name
+	return name, nil
+}
+
+func isText(p string) bool {
+	switch path.Ext(p) {
+	case ".html", ".js", ".css", ".webmanifest":
+		return true
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// referenceForms are the ways the files are referenced by the other files,
+// e.g. src="main.js", importScripts('lang.js'), or './c2.png'.
+var referenceForms = []string{`'%s'`, `"%s"`, `'./%s'`, `"./%s"`}
+
+func hasReference(b []byte, name string) bool {
+	for _, f := range referenceForms {
+		if bytes.Contains(b, []byte(fmt.Sprintf(f, name))) {
+			return true
+		}
+	}
+	return false
+}
+
+func replaceReference(b []byte, name, newName string) []byte {
+	for _, f := range referenceForms {
+		b = bytes.ReplaceAll(b, []byte(fmt.Sprintf(f, name)), []byte(fmt.Sprintf(f, newName)))
+	}
+	return b
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package pwa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHashAssets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":        {Data: []byte(`<script src="main.js"></script><img src="./c2.png">`)},
+		"service-worker.js": {Data: []byte(`importScripts('main.js');`)},
+		"main.js":           {Data: []byte(`img.src = 'c2.png'; // not c2.png`)},
+		"c2.png":            {Data: []byte("png")},
+		"thirdparty/lib.js": {Data: []byte(`x = 'main.js';`)},
+	}
+	assets, err := hashAssets(fsys)
+	if err != nil {
+		t.Fatalf("hashAssets: %v", err)
+	}
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:8])
+	}
+	png := "c2." + hash("png") + ".png"
+	mainJS := "main." + hash(`img.src = '`+png+`'; // not c2.png`) + ".js"
+	lib := "thirdparty/lib." + hash(`x = 'main.js';`) + ".js"
+
+	want := map[string]Asset{
+		"index.html":        {Content: []byte(`<script src="` + mainJS + `"></script><img src="./` + png + `">`)},
+		"service-worker.js": {Content: []byte(`importScripts('` + mainJS + `');`)},
+		mainJS:              {Content: []byte(`img.src = '` + png + `'; // not c2.png`), Immutable: true},
+		png:                 {Content: []byte("png"), Immutable: true},
+		lib:                 {Content: []byte(`x = 'main.js';`), Immutable: true},
+	}
+	if len(assets) != len(want) {
+		t.Errorf("hashAssets() returned %d files, want %d", len(assets), len(want))
+	}
+	for name, w := range want {
+		got, ok := assets[name]
+		if !ok {
+			t.Errorf("hashAssets() doesn't have %q", name)
+			continue
+		}
+		if string(got.Content) != string(w.Content) || got.Immutable != w.Immutable {
+			t.Errorf("hashAssets()[%q] = {%q, %v}, want {%q, %v}", name, got.Content, got.Immutable, w.Content, w.Immutable)
+		}
+	}
+
+	// A change in c2.png changes the names of all the files that reference
+	// it, directly or not.
+	fsys["c2.png"] = &fstest.MapFile{Data: []byte("new png")}
+	assets2, err := hashAssets(fsys)
+	if err != nil {
+		t.Fatalf("hashAssets: %v", err)
+	}
+	if _, ok := assets2[mainJS]; ok {
+		t.Errorf("%q still exists after c2.png changed", mainJS)
+	}
+	if _, ok := assets2[lib]; !ok {
+		t.Errorf("%q doesn't exist after c2.png changed", lib)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	assets := Assets()
+	for _, name := range []string{"index.html", "service-worker.js", "c2fmzq.webmanifest"} {
+		a, ok := assets[name]
+		if !ok {
+			t.Fatalf("Assets() doesn't have %q", name)
+		}
+		if a.Immutable {
+			t.Errorf("%q is immutable", name)
+		}
+	}
+	origs, err := fs.Glob(FS, "*.js")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	for name, a := range assets {
+		if _, err := FS.Open(name); err == nil && a.Immutable {
+			t.Errorf("Immutable %q has its original name", name)
+		}
+		if strings.HasPrefix(name, "thirdparty/") || !isText(name) {
+			continue
+		}
+		for _, orig := range origs {
+			if !entryPoints[orig] && hasReference(a.Content, orig) {
+				t.Errorf("%q references %q", name, orig)
+			}
+		}
+	}
+}
@@ -212,9 +212,21 @@ class c2FmZQClient {
     return Promise.resolve({
       usage: this.vars_.spaceUsed,
       quota: this.vars_.spaceQuota,
+      storage: this.vars_.storage,
     });
   }
 
+  // The storage part of the login and getUpdates responses has the space
+  // used and quota in bytes, and the file counts.
+  setStorage_(storage) {
+    if (!storage) {
+      return;
+    }
+    this.vars_.storage = storage;
+    this.vars_.spaceUsed = Math.floor(storage.spaceUsed / 1048576);
+    this.vars_.spaceQuota = Math.floor(storage.quota / 1048576);
+  }
+
   async passwordForLogin_(salt, password) {
     return so.pwhash(64, password, salt,
       so.PWHASH_OPSLIMIT_MODERATE,
@@ -283,6 +295,7 @@ class c2FmZQClient {
         this.vars_.userId = resp.parts.userId;
         this.vars_.isAdmin = resp.parts._admin === '1';
         this.vars_.enableNotifications = args.enableNotifications;
+        this.setStorage_(resp.parts.storage);
 
         console.log('SW save password hash');
         this.vars_.passwordSalt = (await so.randombytes(16)).toString('hex');
@@ -296,6 +309,8 @@ class c2FmZQClient {
           account: email,
           isAdmin: this.vars_.isAdmin,
           needKey: this.vars_.esk === undefined,
+          passwordChangeRequired: resp.parts.passwordChangeRequired === '1',
+          otpRequired: resp.parts.otpRequired === '1',
         };
       });
   }
@@ -541,6 +556,7 @@ class c2FmZQClient {
       await maybeSetMFA();
     }
 
+    let backupCodes;
     if (args.setOTP !== curr.otpEnabled) {
       const params = {
         key: ''+args.otpKey,
@@ -553,6 +569,7 @@ class c2FmZQClient {
       if (resp.status !== 'ok') {
         throw new Error('OTP update failed');
       }
+      backupCodes = resp.parts.backupCodes;
     }
     if (this.vars_.email !== args.email) {
       const resp = await this.sendRequest_(clientId, 'v2/login/changeEmail', {
@@ -601,7 +618,8 @@ class c2FmZQClient {
     if (args.setMFA) {
       await maybeSetMFA();
     }
-    return this.saveVars_();
+    await this.saveVars_();
+    return {backupCodes};
   }
 
   async listSecurityKeys(clientId) {
@@ -762,6 +780,7 @@ class c2FmZQClient {
         // Quota
         this.vars_.spaceUsed = parseInt(resp.parts.spaceUsed);
         this.vars_.spaceQuota = parseInt(resp.parts.spaceQuota);
+        this.setStorage_(resp.parts.storage);
 
         /* contacts */
         for (let c of resp.parts.contacts) {
@@ -1706,6 +1725,21 @@ class c2FmZQClient {
           console.log('SW Remote MFA expired');
         }
         break;
+      case 6: // Request to join album
+        album = this.db_.albums[js.target];
+        await this.#sw.showNotif(album ? await this.#decryptString(album.encName) : _T('collection'), {
+          tag: `join-request:${js.target}`,
+          body: _T('join-request-body'),
+        });
+        break;
+      case 7: // Digest of album changes
+        await this.getUpdates('');
+        album = this.db_.albums[js.target];
+        await this.#sw.showNotif(album ? await this.#decryptString(album.encName) : _T('collection'), {
+          tag: `digest:${js.target}`,
+          body: _T('digest-body', js.data.newContent || 0, js.data.newMembers || 0),
+        });
+        break;
     }
   }
 
@@ -1717,8 +1751,34 @@ class c2FmZQClient {
   }
 
   /*
+   * Returns the CSRF token that the server expects with all the requests
+   * sent by the web app that it serves.
    */
-  async sendRequest_(clientId, endpoint, data) {
+  async csrfToken_() {
+    if (!SAMEORIGIN) {
+      return '';
+    }
+    if (!this.#state.csrfToken) {
+      this.#state.csrfToken = fetch(this.vars_.server + 'v2x/config/csrf', {
+        method: 'GET',
+        mode: 'same-origin',
+        credentials: 'same-origin',
+        redirect: 'error',
+      })
+      .then(resp => resp.ok ? resp.json() : {})
+      .then(resp => resp.parts && resp.parts.csrfToken || '')
+      .catch(() => '');
+    }
+    const token = await this.#state.csrfToken;
+    if (!token) {
+      this.#state.csrfToken = null;
+    }
+    return token;
+  }
+
+  /*
+   */
+  async sendRequest_(clientId, endpoint, data, opt_retry) {
     //console.log('SW', this.vars_.server + endpoint);
     let enc = [];
     for (let n in data) {
@@ -1727,12 +1787,13 @@ class c2FmZQClient {
       }
       enc.push(encodeURIComponent(n) + '=' + encodeURIComponent(await Promise.resolve(data[n])));
     }
-    return fetch(this.vars_.server + endpoint, {
+    const resp = await fetch(this.vars_.server + endpoint, {
       method: 'POST',
       mode: SAMEORIGIN ? 'same-origin' : 'cors',
       headers: {
         'Content-Type': 'application/x-www-form-urlencoded',
         'X-c2FmZQ-capabilities': this.#capabilities.join(','),
+        'X-c2FmZQ-CSRF': await this.csrfToken_(),
       },
       redirect: 'error',
       referrerPolicy: 'no-referrer',
@@ -1743,13 +1804,16 @@ class c2FmZQClient {
         throw new Error(_T('network-error'));
       }
       throw err;
-    })
-    .then(resp => {
-      if (!resp.ok) {
-        throw new Error(`${resp.status} ${resp.statusText}`);
-      }
-      return resp.json();
-    })
+    });
+    if (resp.status === 403 && SAMEORIGIN && !opt_retry) {
+      // The CSRF cookie may have expired. Get a new token and try again.
+      this.#state.csrfToken = null;
+      return this.sendRequest_(clientId, endpoint, data, true);
+    }
+    if (!resp.ok) {
+      throw new Error(`${resp.status} ${resp.statusText}`);
+    }
+    return resp.json()
     .then(resp => {
       if (resp.infos.length > 0) {
         this.#sw.sendMessage(clientId, {type: 'info', msg: resp.infos.join('\n')});
@@ -2096,6 +2160,8 @@ class c2FmZQClient {
           'cachePreference',
           'enableNotifications',
           'mfaStatus',
+          'importStart',
+          'importProgress',
           'ping',
         ];
         if (allowedMethods.includes(func)) {
@@ -2258,10 +2324,77 @@ class c2FmZQClient {
     });
   }
 
-  async upload(clientId, collection, files) {
+  async importStart(clientId, totalFiles, totalBytes) {
+    console.log('SW importStart');
+    const resp = await this.sendRequest_(clientId, 'v2x/import/start', {
+      token: this.#token(),
+      params: this.makeParams_({totalFiles: ''+totalFiles, totalBytes: ''+totalBytes}),
+    });
+    if (resp.status !== 'ok') {
+      throw new Error('error');
+    }
+    return resp.parts;
+  }
+
+  async importProgress(clientId, importId, skipped, failed) {
+    const resp = await this.sendRequest_(clientId, 'v2x/import/progress', {
+      token: this.#token(),
+      params: this.makeParams_({importId: importId, skipped: ''+(skipped || 0), failed: ''+(failed || 0)}),
+    });
+    if (resp.status !== 'ok') {
+      throw new Error('error');
+    }
+    return resp.parts.import;
+  }
+
+  // Returns the files that aren't already uploaded. The fingerprints are keyed
+  // with the user's secret key so that the server can't learn anything about
+  // the content of the files.
+  async precheckImport_(clientId, importId, files) {
+    const MAX = 1000;
+    const key = await self.crypto.subtle.importKey('raw', await this.#sk(), {name: 'HMAC', hash: 'SHA-256'}, false, ['sign']);
+    for (let f of files) {
+      // The first 64 KiB and the size of the file are enough to identify
+      // duplicates without reading whole videos.
+      const head = new Uint8Array(await f.file.slice(0, 65536).arrayBuffer());
+      const size = self.bytesFromString(`${f.file.size}:`);
+      const data = new Uint8Array(size.byteLength + head.byteLength);
+      data.set(size);
+      data.set(head, size.byteLength);
+      const sig = await self.crypto.subtle.sign('HMAC', key, data);
+      f.fingerprint = self.base64RawUrlEncode(new Uint8Array(sig));
+      f.importId = importId;
+    }
+    const dups = new Set();
+    for (let i = 0; i < files.length; i += MAX) {
+      const resp = await this.sendRequest_(clientId, 'v2x/import/precheck', {
+        token: this.#token(),
+        params: this.makeParams_({fingerprints: files.slice(i, i+MAX).map(f => f.fingerprint).join(',')}),
+      });
+      if (resp.status !== 'ok') {
+        throw new Error('error');
+      }
+      resp.parts.duplicates.forEach(fp => dups.add(fp));
+    }
+    const out = files.filter(f => !dups.has(f.fingerprint));
+    if (out.length < files.length) {
+      console.log(`SW skipping ${files.length - out.length} duplicate files`);
+      await this.importProgress(clientId, importId, files.length - out.length, 0);
+    }
+    return out;
+  }
+
+  async upload(clientId, collection, files, opt_import) {
     if (files.length === 0) {
       return;
     }
+    if (opt_import?.importId) {
+      files = await this.precheckImport_(clientId, opt_import.importId, files);
+      if (files.length === 0) {
+        return;
+      }
+    }
+    const parallel = Math.max(1, opt_import?.maxParallelUploads || 1);
     if (this.#state.cancelUpload === undefined) {
       this.#state.cancelUpload = { cancel: false };
     }
@@ -2289,26 +2422,38 @@ class c2FmZQClient {
 
     if (this.#state.uploadData) {
       return new Promise((resolve, reject) => {
-        this.#state.uploadData.push({collection, files, resolve, reject});
+        this.#state.uploadData.push({collection, files, parallel, resolve, reject});
       });
     }
     this.#state.uploadData = [];
 
     const p = new Promise(async (resolve, reject) => {
-      this.#state.uploadData.push({collection, files, resolve, reject});
+      this.#state.uploadData.push({collection, files, parallel, resolve, reject});
 
       for (let b = 0; b < this.#state.uploadData?.length; b++) {
         let batch = this.#state.uploadData[b];
-        for (let i = 0; i < batch.files.length && !batch.err; i++) {
-          try {
-            await this.uploadFile_(clientId, batch.collection, batch.files[i]);
-            delete batch.files[i].tn;
-          } catch (err) {
-            const name = batch.files[i].name || batch.files[i].file.name;
-            console.log(`SW Upload of ${name} failed`, err);
-            batch.err = err;
+        let next = 0;
+        const worker = async () => {
+          while (next < batch.files.length && !batch.err) {
+            const f = batch.files[next++];
+            try {
+              await this.uploadFile_(clientId, batch.collection, f);
+              delete f.tn;
+            } catch (err) {
+              const name = f.name || f.file.name;
+              console.log(`SW Upload of ${name} failed`, err);
+              batch.err = err;
+              if (f.importId) {
+                this.importProgress(clientId, f.importId, 0, 1).catch(() => {});
+              }
+            }
           }
+        };
+        const workers = [];
+        for (let w = 0; w < Math.min(batch.parallel, batch.files.length); w++) {
+          workers.push(worker());
         }
+        await Promise.all(workers);
         if (batch.err) {
           batch.reject(batch.err);
         } else {
@@ -2386,14 +2531,21 @@ class c2FmZQClient {
       mode: SAMEORIGIN ? 'same-origin' : 'cors',
       headers: {
         'Content-Type': 'multipart/form-data; boundary='+boundary,
+        'X-c2FmZQ-CSRF': await this.csrfToken_(),
       },
       redirect: 'error',
       referrerPolicy: 'no-referrer',
-      credentials: 'omit',
+      credentials: 'same-origin',
       body: body,
       duplex: 'half',
     })
     .then(async resp => {
+      if (resp.status === 429) {
+        // Too many parallel uploads. Try again later.
+        await new Promise(r => setTimeout(r, 1000));
+        file.uploadedBytes = 0;
+        return this.uploadFile_(clientId, collection, file, opt_noStreaming);
+      }
       if (!resp.ok) {
         if (!resp.body) {
           throw new Error(`${resp.status} ${resp.statusText}`);
@@ -2600,6 +2752,11 @@ class UploadStream {
       version: '1',
       token: this.token_,
     };
+    if (this.file_.importId) {
+      // The importId must come before the file content.
+      fields.importId = this.file_.importId;
+      fields.fingerprint = this.file_.fingerprint;
+    }
     let s = '';
     for (let k in fields) {
       if (!fields.hasOwnProperty(k)) {
@@ -120,6 +120,7 @@ window.Lang = {
       'caching-disabled': 'Caching disabled',
       'ready': 'Ready',
       'drop-received': 'Processing new files',
+      'import-done': 'Import done: $1 uploaded, $2 already uploaded, $3 failed',
       'upload:': 'Upload: $1',
       'collection': 'collection',
       'collection:': '$1',
@@ -160,6 +161,9 @@ window.Lang = {
       'updating': 'Applying changes',
       'error': 'Error',
       'new-pass-doesnt-match': 'New password doesn\'t match',
+      'password-change-required': 'You must change your password before continuing.',
+      'otp-required': 'You must enable OTP before continuing.',
+      'otp-backup-codes': 'Keep these backup codes in a safe place. Each one can be used once instead of an OTP code: $1',
       'otp-code-required': 'OTP code required',
       'delete-warning': '<p>⚠️ If you delete your account, all your data will be permanently deleted.</p>',
       'delete-account': 'Delete my account',
@@ -192,7 +196,12 @@ window.Lang = {
       'locked': 'Locked',
       'approved': 'Approved',
       'admin': 'Admin',
+      'hold': 'Hold',
+      'reset-password': 'Reset password',
+      'limited': 'Limited',
       'quota': 'Quota',
+      'trash-retention': 'Trash retention (days)',
+      'storage-files': '$1 files in gallery, $2 files in $3 albums, $4 files in trash',
       'open': 'Open',
       'download-doc': 'Download document',
       'copy-selected': 'Copy selected files',
@@ -253,6 +262,8 @@ window.Lang = {
       'new-content-body': 'New files added.',
       'new-collection-body': 'Shared with you.',
       'new-members-body': 'New members joined.',
+      'join-request-body': 'Someone asked to join.',
+      'digest-body': 'Updates with new files: $1, new members: $2',
       'push-notifications-title': 'Push notifications',
       'push-notifications-body': 'Push notifications are enabled.',
       'security-keys:': 'Security devices:',
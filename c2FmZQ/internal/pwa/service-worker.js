@@ -476,6 +476,12 @@ class ServiceWorker {
       );
       return;
     }
+    if (rel === 'v2x/config/branding') {
+      event.respondWith(
+        fetch(event.request).catch(() => new Response('{}', {headers: {'Content-Type': 'application/json'}}))
+      );
+      return;
+    }
     let count = 0;
     event.respondWith(new Promise(async (resolve, reject) => {
       const handler = async () => {
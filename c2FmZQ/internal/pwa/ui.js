@@ -76,7 +76,7 @@ class UI {
     this.trashButton_ = document.querySelector('#trash-button');
     this.loggedInAccount_ = document.querySelector('#loggedin-account');
 
-    document.querySelector('title').textContent = _T('login');
+    this.setTitle_(_T('login'));
     document.querySelector('#login-tab').textContent = _T('login');
     document.querySelector('#register-tab').textContent = _T('register');
     document.querySelector('#recover-tab').textContent = _T('recover');
@@ -218,6 +218,7 @@ class UI {
 
     if (SAMEORIGIN) {
       this.serverUrl_ = window.location.href.replace(/^(.*\/)[^\/]*/, '$1');
+      this.loadBranding_();
     } else {
       document.querySelector('label[for=server]').style.display = '';
       this.serverInput_.style.display = '';
@@ -336,7 +337,7 @@ class UI {
           this.backupKeysCheckbox_.style.display = 'none';
           this.backupKeysCheckboxLabel_.style.display = 'none';
           this.loginButton_.textContent = _T('login');
-          this.title_.textContent = _T('login');
+          this.setTitle_(_T('login'));
         },
       },
       register: {
@@ -352,7 +353,7 @@ class UI {
           this.backupKeysCheckbox_.style.display = '';
           this.backupKeysCheckboxLabel_.style.display = '';
           this.loginButton_.textContent = _T('create-account');
-          this.title_.textContent = _T('register');
+          this.setTitle_(_T('register'));
         },
       },
       recover: {
@@ -368,7 +369,7 @@ class UI {
           this.backupKeysCheckbox_.style.display = '';
           this.backupKeysCheckboxLabel_.style.display = '';
           this.loginButton_.textContent = _T('recover-account');
-          this.title_.textContent = _T('recover-account');
+          this.setTitle_(_T('recover-account'));
         },
       },
     };
@@ -407,9 +408,13 @@ class UI {
 
   showQuota_() {
     main.sendRPC('quota')
-    .then(({usage, quota}) => {
+    .then(({usage, quota, storage}) => {
       const pct = Math.floor(100 * usage / quota) + '%';
-      document.querySelector('#quota').textContent = this.formatSizeMB_(usage) + ' / ' + this.formatSizeMB_(quota) + ' (' + pct + ')';
+      const elem = document.querySelector('#quota');
+      elem.textContent = this.formatSizeMB_(usage) + ' / ' + this.formatSizeMB_(quota) + ' (' + pct + ')';
+      if (storage) {
+        elem.title = _T('storage-files', storage.galleryFiles, storage.albumFiles, storage.albums, storage.trashFiles);
+      }
     });
   }
 
@@ -549,9 +554,43 @@ class UI {
     UI.clearElementById_('popup-content');
   }
 
+  setTitle_(title) {
+    this.titleText_ = title;
+    this.title_.textContent = this.instanceName_ ? `${title} · ${this.instanceName_}` : title;
+  }
+
+  async loadBranding_() {
+    let b;
+    try {
+      const resp = await fetch('v2x/config/branding');
+      if (!resp.ok) return;
+      b = await resp.json();
+    } catch (err) {
+      console.log('Branding', err);
+      return;
+    }
+    if (b.accentColor) {
+      document.documentElement.style.setProperty('--accent-color', b.accentColor);
+    }
+    if (!b.name && !b.logo) {
+      return;
+    }
+    const div = document.querySelector('#branding');
+    UI.clearElement_(div);
+    if (b.logo) {
+      UI.create('img', {src: b.logo, alt: b.name || '', parent: div});
+    }
+    if (b.name) {
+      UI.create('span', {text: b.name, parent: div});
+      this.instanceName_ = b.name;
+      this.setTitle_(this.titleText_);
+    }
+    div.className = '';
+  }
+
   showPassphraseBox_() {
     UI.clearView_();
-    this.title_.textContent = 'c2FmZQ';
+    this.setTitle_('c2FmZQ');
     document.querySelector('#loggedout-div').className = 'hidden';
     document.querySelector('#loggedin-div').className = 'hidden';
     document.querySelector('#passphrase-div').className = '';
@@ -559,7 +598,7 @@ class UI {
   }
 
   showLoggedIn_() {
-    this.title_.textContent = 'Gallery';
+    this.setTitle_('Gallery');
     document.querySelector('#loggedout-div').className = 'hidden';
     document.querySelector('#passphrase-div').className = 'hidden';
     document.querySelector('#loggedin-div').className = '';
@@ -567,7 +606,7 @@ class UI {
   }
 
   showLoggedOut_() {
-    this.title_.textContent = _T('login');
+    this.setTitle_(_T('login'));
     UI.clearView_();
     this.selectedTab_ = 'login';
     this.tabs_[this.selectedTab_].click();
@@ -643,13 +682,21 @@ class UI {
     this.backupPhraseInput_.value = this.backupPhraseInput_.value.replaceAll(/./g, 'X');
     const done = this.bitScroll_();
     return main.sendRPC(this.tabs_[this.selectedTab_].rpc, args).finally(done)
-    .then(({isAdmin, needKey}) => {
+    .then(({isAdmin, needKey, passwordChangeRequired, otpRequired}) => {
       this.accountEmail_ = this.emailInput_.value;
       this.isAdmin_ = isAdmin;
       this.passwordInput_.value = '';
       this.passwordInput2_.value = '';
       this.backupPhraseInput_.value = '';
       this.showLoggedIn_();
+      if (passwordChangeRequired) {
+        this.popupMessage(_T('password-change-required'), 'info');
+        return this.showProfile_();
+      }
+      if (otpRequired) {
+        this.popupMessage(_T('otp-required'), 'info');
+        return this.showProfile_();
+      }
       if (needKey) {
         return this.promptForBackupPhrase_();
       }
@@ -867,7 +914,7 @@ class UI {
         c.name = _T(c.name);
       }
       if (this.galleryState_.collection === c.collection) {
-        this.title_.textContent = c.name;
+        this.setTitle_(c.name);
         this.galleryState_.canDrag = c.isOwner || c.canCopy;
         this.galleryState_.isOwner = c.isOwner;
       }
@@ -1238,6 +1285,14 @@ class UI {
     const moveData = event.dataTransfer.getData('application/json');
     let files = [];
     if (!moveData && collection !== 'trash') {
+      // The entries must be read before the event handler returns.
+      const entries = Array.from(event.dataTransfer.items || [])
+        .filter(item => item.kind === 'file' && item.webkitGetAsEntry)
+        .map(item => item.webkitGetAsEntry())
+        .filter(entry => entry);
+      if (entries.some(entry => entry.isDirectory)) {
+        return this.handleFolderDrop_(collection, entries);
+      }
       if (event.dataTransfer.items) {
         for (let i = 0; i < event.dataTransfer.items.length; i++) {
           if (event.dataTransfer.items[i].kind === 'file') {
@@ -1261,7 +1316,73 @@ class UI {
     this.cancelQueuedThumbnailRequests_();
   }
 
-  async handleDropUpload_(collection, files) {
+  // Imports dropped folders. Each folder is uploaded to the album with the same
+  // name, which is created if needed. Files that aren't in a folder are
+  // uploaded to collection.
+  async handleFolderDrop_(collection, entries) {
+    this.popupMessage(_T('drop-received'), 'progress');
+    const folders = {};
+    const walk = async (entry, path) => {
+      if (entry.isFile) {
+        const file = await new Promise((resolve, reject) => entry.file(resolve, reject));
+        if (file.type.startsWith('image/') || file.type.startsWith('video/')) {
+          (folders[path] = folders[path] || []).push(file);
+        }
+        return;
+      }
+      const dir = path ? `${path}/${entry.name}` : entry.name;
+      const reader = entry.createReader();
+      // readEntries returns the directory content in batches.
+      for (;;) {
+        const children = await new Promise((resolve, reject) => reader.readEntries(resolve, reject));
+        if (children.length === 0) {
+          break;
+        }
+        for (let child of children) {
+          await walk(child, dir);
+        }
+      }
+    };
+    try {
+      for (let entry of entries) {
+        await walk(entry, '');
+      }
+    } catch (err) {
+      return this.showError_(err);
+    }
+    const all = Object.values(folders).flat();
+    if (all.length === 0) {
+      return;
+    }
+    let imp;
+    try {
+      imp = await main.sendRPC('importStart', all.length, all.reduce((n, f) => n + f.size, 0));
+    } catch (err) {
+      // The server doesn't support imports. Upload without it.
+      console.log('importStart failed', err);
+    }
+    for (let path of Object.keys(folders).sort()) {
+      let c = collection;
+      if (path !== '') {
+        const album = (this.collections_ || []).find(a => a.isOwner && a.name === path && !['gallery', 'trash'].includes(a.collection));
+        try {
+          c = album ? album.collection : await main.sendRPC('createCollection', path);
+        } catch (err) {
+          return this.showError_(err);
+        }
+      }
+      if (!await this.handleDropUpload_(c, folders[path], imp)) {
+        break;
+      }
+    }
+    if (imp) {
+      main.sendRPC('importProgress', imp.importId)
+        .then(p => this.popupMessage(_T('import-done', p.doneFiles, p.skippedFiles, p.failedFiles), 'info'))
+        .catch(err => console.log('importProgress failed', err));
+    }
+  }
+
+  async handleDropUpload_(collection, files, opt_import) {
     const MAX = 10;
     const up = [];
     this.cancelQueuedDropUploads_ = false;
@@ -1287,7 +1408,7 @@ class UI {
         if (abort) {
           return Promise.reject(abort);
         }
-        return main.sendRPC('upload', collection, toUpload)
+        return main.sendRPC('upload', collection, toUpload, opt_import)
           .catch(err => {
             abort = err;
             this.cancelQueuedThumbnailRequests_();
@@ -1298,9 +1419,11 @@ class UI {
     return Promise.all(up)
       .then(() => {
         this.refresh_();
+        return true;
       })
       .catch(e => {
         this.showError_(e);
+        return false;
       });
   }
 
@@ -3005,8 +3128,11 @@ class UI {
         otpCode: code ? code.value : '',
         keyChanges: keyChanges,
       }))
-      .then(() => {
+      .then(({backupCodes}) => {
         this.accountEmail_ = email.value;
+        if (backupCodes) {
+          this.popupMessage(_T('otp-backup-codes', backupCodes.join(' ')), 'info', {sticky:true});
+        }
         close();
       })
       .catch(err => {
@@ -3335,6 +3461,24 @@ class UI {
       onchange();
     });
 
+    const policyDiv = UI.create('div', {id:'admin-console-shared-album-policy-div', parent:content});
+    UI.create('label', {htmlFor:'admin-console-shared-album-policy', text:'Shared albums charged to:', parent:policyDiv});
+    const policy = UI.create('select', {id:'admin-console-shared-album-policy', parent:policyDiv});
+    for (let p of ['owner','contributor']) {
+      UI.create('option', {value:p, text:p, selected:p === data.sharedAlbumPolicy, parent:policy});
+    }
+    EL.add(policy, 'change', () => {
+      const v = policy.options[policy.options.selectedIndex].value;
+      if (v === data.sharedAlbumPolicy) {
+        delete data._sharedAlbumPolicy;
+        policy.classList.remove('changed');
+      } else {
+        data._sharedAlbumPolicy = v;
+        policy.classList.add('changed');
+      }
+      onchange();
+    });
+
     const filter = UI.create('input', {id:'admin-console-filter', type:'search', placeholder:_T('filter'), parent:content});
     EL.add(filter, 'keydown', () => {
       showUsers();
@@ -3395,6 +3539,51 @@ class UI {
       });
       view[user.email].push(adminDiv);
 
+      const holdDiv = UI.create('div');
+      const hold = UI.create('input', {type:'checkbox', checked:user.hold, parent:holdDiv});
+      EL.add(hold, 'change', () => {
+        const v = hold.checked;
+        if (v === user.hold) {
+          delete user._hold;
+          hold.classList.remove('changed');
+        } else {
+          user._hold = v;
+          hold.classList.add('changed');
+        }
+        onchange();
+      });
+      view[user.email].push(holdDiv);
+
+      const resetPasswordDiv = UI.create('div');
+      const resetPassword = UI.create('input', {type:'checkbox', checked:user.resetPassword, parent:resetPasswordDiv});
+      EL.add(resetPassword, 'change', () => {
+        const v = resetPassword.checked;
+        if (v === user.resetPassword) {
+          delete user._resetPassword;
+          resetPassword.classList.remove('changed');
+        } else {
+          user._resetPassword = v;
+          resetPassword.classList.add('changed');
+        }
+        onchange();
+      });
+      view[user.email].push(resetPasswordDiv);
+
+      const limitedDiv = UI.create('div');
+      const limited = UI.create('input', {type:'checkbox', checked:user.limited, parent:limitedDiv});
+      EL.add(limited, 'change', () => {
+        const v = limited.checked;
+        if (v === user.limited) {
+          delete user._limited;
+          limited.classList.remove('changed');
+        } else {
+          user._limited = v;
+          limited.classList.add('changed');
+        }
+        onchange();
+      });
+      view[user.email].push(limitedDiv);
+
       const quotaDiv = UI.create('div', {className:'quota-cell'});
       const quotaValue = UI.create('input', {type:'number', size:5, value:user.quota, parent:quotaDiv});
       EL.add(quotaValue, 'change', () => {
@@ -3425,6 +3614,21 @@ class UI {
       });
       quotaDiv.appendChild(quotaUnit);
       view[user.email].push(quotaDiv);
+
+      const trashRetentionDiv = UI.create('div');
+      const trashRetention = UI.create('input', {type:'number', min:0, size:4, value:user.trashRetentionDays, parent:trashRetentionDiv});
+      EL.add(trashRetention, 'change', () => {
+        const v = parseInt(trashRetention.value);
+        if ((trashRetention.value === '' && user.trashRetentionDays === undefined) || v === user.trashRetentionDays) {
+          delete user._trashRetentionDays;
+          trashRetention.classList.remove('changed');
+        } else {
+          user._trashRetentionDays = trashRetention.value === '' ? -1 : v;
+          trashRetention.classList.add('changed');
+        }
+        onchange();
+      });
+      view[user.email].push(trashRetentionDiv);
     }
 
     const table = UI.create('div', {id:'admin-console-table', parent:content});
@@ -3433,7 +3637,7 @@ class UI {
       while(table.firstChild) {
         table.removeChild(table.firstChild);
       }
-      table.innerHTML = `<div class="row"><div>${_T('email')}</div><div>${_T('locked')}</div><div>${_T('approved')}</div><div>${_T('admin')}</div><div>${_T('quota')}</div></div>`;
+      table.innerHTML = `<div class="row"><div>${_T('email')}</div><div>${_T('locked')}</div><div>${_T('approved')}</div><div>${_T('admin')}</div><div>${_T('hold')}</div><div>${_T('reset-password')}</div><div>${_T('limited')}</div><div>${_T('quota')}</div><div>${_T('trash-retention')}</div></div>`;
       for (let user of data.users) {
         if (filter.value === '' || user.email.includes(filter.value) || Object.keys(user).filter(k => k.startsWith('_')).length > 0) {
           const row = UI.create('div', {className:'row', parent:table});
@@ -0,0 +1,111 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package secure
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Locker is used to coordinate updates to the data files. By default, Storage
+// uses lock files in its own directory, which only works when all the server
+// processes share the same file system with reliable O_EXCL semantics. A
+// distributed Locker can be used instead when multiple server instances run in
+// a cluster.
+type Locker interface {
+	// Lock acquires the lock for name, waiting as long as necessary.
+	Lock(name string) error
+	// Unlock releases the lock for name.
+	Unlock(name string) error
+}
+
+// BlobStore stores the blob files, i.e. the content of the files and
+// thumbnails, outside of the storage directory, e.g. in an object store that
+// is shared by multiple server instances. Blobs are immutable once stored.
+type BlobStore interface {
+	// Put stores a new blob with the content of r.
+	Put(name string, r io.Reader, size int64) error
+	// Open opens a blob for reading.
+	Open(name string) (io.ReadSeekCloser, error)
+	// Delete deletes a blob.
+	Delete(name string) error
+}
+
+// Options contains the optional settings of Storage.
+type Options struct {
+	// Locker is used instead of lock files, when set.
+	Locker Locker
+	// BlobStore is used instead of the local directory for blob files, when
+	// set.
+	BlobStore BlobStore
+	// DropBlobCache tells the kernel not to keep the blob files in the page
+	// cache after they are written, so that large uploads don't evict the
+	// metadata files. It is only implemented on linux.
+	DropBlobCache bool
+	// CompressDataFiles compresses the data files, i.e. the metadata, with
+	// zstd when they are written. Each file has a flag in its header, so
+	// compressed and uncompressed files can be mixed. Blob files are never
+	// compressed.
+	CompressDataFiles bool
+	// ReadOnly makes all the functions that modify the storage return
+	// ErrReadOnly, e.g. when the storage directory is a replica or a
+	// snapshot. Pending updates that were interrupted are not rolled back.
+	ReadOnly bool
+}
+
+// CommitBlob moves a blob file that was written with OpenBlobWrite to its
+// final name. Both names are relative to the storage directory. When a
+// BlobStore is used, the blob is uploaded and the local file is removed.
+func (s *Storage) CommitBlob(writeFileName, finalFileName string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	src := filepath.Join(s.dir, writeFileName)
+	if s.blobStore == nil {
+		dst := filepath.Join(s.dir, finalFileName)
+		if err := createParentIfNotExist(dst); err != nil {
+			return err
+		}
+		return os.Rename(src, dst)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := s.blobStore.Put(finalFileName, f, fi.Size()); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// DeleteBlob deletes a blob file.
+func (s *Storage) DeleteBlob(filename string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.blobStore != nil {
+		return s.blobStore.Delete(filename)
+	}
+	return os.Remove(filepath.Join(s.dir, filename))
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package secure
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"c2FmZQ/internal/log"
+)
+
+// dropCacheChunk is the amount of data written between fadvise calls.
+const dropCacheChunk = 8 << 20
+
+// dropCacheWriter writes to a file and tells the kernel that the data won't
+// be needed again soon, so that it doesn't stay in the page cache. The file
+// is opened with O_SYNC, so the pages are already clean when they are
+// advised and they can be evicted right away.
+type dropCacheWriter struct {
+	f       *os.File
+	written int64
+	advised int64
+}
+
+func newDropCacheWriter(f *os.File) *dropCacheWriter {
+	return &dropCacheWriter{f: f}
+}
+
+func (w *dropCacheWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.written += int64(n)
+	if w.written-w.advised >= dropCacheChunk {
+		w.dropCache()
+	}
+	return n, err
+}
+
+func (w *dropCacheWriter) Close() error {
+	w.dropCache()
+	return w.f.Close()
+}
+
+func (w *dropCacheWriter) dropCache() {
+	if w.written == w.advised {
+		return
+	}
+	rc, err := w.f.SyscallConn()
+	if err != nil {
+		log.Debugf("SyscallConn: %v", err)
+		return
+	}
+	if err := rc.Control(func(fd uintptr) {
+		if err := unix.Fadvise(int(fd), w.advised, w.written-w.advised, unix.FADV_DONTNEED); err != nil {
+			log.Debugf("Fadvise(%s): %v", w.f.Name(), err)
+		}
+	}); err != nil {
+		log.Debugf("Control: %v", err)
+	}
+	w.advised = w.written
+}
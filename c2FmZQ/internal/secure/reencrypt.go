@@ -0,0 +1,184 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package secure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/crypto/kdf"
+)
+
+// ReEncryptFile re-encrypts the file oldName with newKey, and saves it as
+// newName. Both names are relative to dir. When throttle is not nil, it is
+// called with the number of bytes before they are written, e.g. to limit the
+// I/O rate.
+//
+// ReEncryptFile can safely be called again for the same file after an
+// interruption. The file is left alone when it was already re-encrypted,
+// i.e. when oldName doesn't exist anymore and newName does, or when the file
+// is already encrypted with newKey.
+func ReEncryptFile(dir, oldName, newName string, oldKey, newKey crypto.EncryptionKey, throttle func(int)) error {
+	oldPath := filepath.Join(dir, oldName)
+	newPath := filepath.Join(dir, newName)
+	if oldPath != newPath {
+		if _, err := os.Stat(newPath); err == nil {
+			// The new file is only renamed into place after it is
+			// complete.
+			if err := os.Remove(oldPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+	}
+
+	in, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(in, hdr); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "KRIN" {
+		return errors.New("wrong file type")
+	}
+	if hdr[4]&optEncrypted == 0 {
+		return errors.New("file isn't encrypted")
+	}
+	k1, err := oldKey.ReadEncryptedKey(in)
+	if err != nil {
+		if _, err2 := in.Seek(int64(len(hdr)), io.SeekStart); err2 != nil {
+			return err2
+		}
+		if k2, err2 := newKey.ReadEncryptedKey(in); err2 == nil {
+			// Already re-encrypted.
+			k2.Wipe()
+			return nil
+		}
+		return err
+	}
+	defer k1.Wipe()
+	r, err := k1.StartReader(kdf.FileContext(oldName), in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Read the header again.
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr, h) {
+		return errors.New("wrong encrypted header")
+	}
+	if hdr[4]&optPadded != 0 {
+		if err := SkipPadding(r); err != nil {
+			return err
+		}
+	}
+	hdr[4] |= optPadded
+	maxPadding := 64 * 1024
+	if hdr[4]&optEncodingMask == optRawBytes {
+		maxPadding = 1024 * 1024
+	}
+
+	if err := createParentIfNotExist(newPath); err != nil {
+		return err
+	}
+	tmpPath := newPath + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := reEncryptStream(out, r, hdr, newName, newKey, maxPadding, throttle); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: %w", oldName, err)
+	}
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		return err
+	}
+	if oldPath != newPath {
+		return os.Remove(oldPath)
+	}
+	return nil
+}
+
+// reEncryptStream writes the header, and the content of r encrypted with a
+// new file key, to out. It always closes out.
+func reEncryptStream(out *os.File, r io.Reader, hdr []byte, name string, newKey crypto.EncryptionKey, maxPadding int, throttle func(int)) (retErr error) {
+	if _, err := out.Write(hdr); err != nil {
+		out.Close()
+		return err
+	}
+	k2, err := newKey.NewKey()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	defer k2.Wipe()
+	if err := k2.WriteEncryptedKey(out); err != nil {
+		out.Close()
+		return err
+	}
+	// From here on, closing w also closes out.
+	w, err := k2.StartWriter(kdf.FileContext(name), out)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	defer func() {
+		if err := w.Close(); retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if err := AddPadding(w, maxPadding); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if throttle != nil {
+				throttle(n)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding"
 	"encoding/binary"
 	"encoding/gob"
@@ -44,9 +43,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/crypto/kdf"
 	"c2FmZQ/internal/log"
 )
 
@@ -69,6 +70,8 @@ var (
 	ErrAlreadyRolledBack = errors.New("already rolled back")
 	// Indicates that the update was already committed by a previous call.
 	ErrAlreadyCommitted = errors.New("already committed")
+	// Indicates that the storage is read-only.
+	ErrReadOnly = errors.New("read-only storage")
 
 	dataFileSizes = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -89,11 +92,24 @@ func init() {
 // EncryptionKey that will be used to encrypt and decrypt per-file encryption
 // keys.
 func NewStorage(dir string, masterKey crypto.EncryptionKey) *Storage {
+	return NewStorageWithOptions(dir, masterKey, Options{})
+}
+
+// NewStorageWithOptions is like NewStorage, with additional options.
+func NewStorageWithOptions(dir string, masterKey crypto.EncryptionKey, opts Options) *Storage {
 	s := &Storage{
 		dir:       dir,
 		masterKey: masterKey,
+		locker:    opts.Locker,
+		blobStore: opts.BlobStore,
+		dropCache: opts.DropBlobCache,
+		compress:  opts.CompressDataFiles,
+		readOnly:  opts.ReadOnly,
 	}
 	s.useGOB = true
+	if s.readOnly {
+		return s
+	}
 	if err := s.rollbackPendingOps(); err != nil {
 		log.Fatalf("s.rollbackPendingOps: %v", err)
 	}
@@ -106,6 +122,10 @@ type Storage struct {
 	masterKey crypto.EncryptionKey
 	compress  bool
 	useGOB    bool
+	locker    Locker
+	blobStore BlobStore
+	dropCache bool
+	readOnly  bool
 }
 
 // Dir returns the root directory of the storage.
@@ -129,6 +149,12 @@ func createParentIfNotExist(filename string) error {
 //
 // There is logic in place to remove stale locks after a while.
 func (s *Storage) Lock(fn string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.locker != nil {
+		return s.locker.Lock(fn)
+	}
 	lockf := filepath.Join(s.dir, fn) + ".lock"
 	if err := createParentIfNotExist(lockf); err != nil {
 		return err
@@ -184,6 +210,9 @@ func (s *Storage) LockMany(filenames []string) error {
 
 // Unlock released the lock file for the given filename.
 func (s *Storage) Unlock(fn string) error {
+	if s.locker != nil {
+		return s.locker.Unlock(fn)
+	}
 	lockf := filepath.Join(s.dir, fn) + ".lock"
 	if err := os.Remove(lockf); err != nil {
 		return err
@@ -262,6 +291,9 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	if len(files) != objValue.Len() {
 		log.Panicf("len(files) != len(objects), %d != %d", len(files), objValue.Len())
 	}
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
 	if err := s.LockMany(files); err != nil {
 		return nil, err
 	}
@@ -352,11 +384,6 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	}, nil
 }
 
-func context(s string) []byte {
-	h := sha1.Sum([]byte(s))
-	return h[:]
-}
-
 // ReadDataFile reads an object from a file.
 func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 	f, err := os.Open(filepath.Join(s.dir, filename))
@@ -392,7 +419,7 @@ func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 		}
 		defer k.Wipe()
 		// Use the file key to decrypt the rest of the file.
-		if r, err = k.StartReader(context(filename), f); err != nil {
+		if r, err = k.StartReader(kdf.FileContext(filename), f); err != nil {
 			return err
 		}
 		// Read the header again.
@@ -412,12 +439,12 @@ func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 	var rc io.Reader = r
 	if flags&optCompressed != 0 {
 		// Decompress the content of the file.
-		gz, err := gzip.NewReader(r)
+		dec, err := newDecompressReader(r)
 		if err != nil {
 			return err
 		}
-		defer gz.Close()
-		rc = gz
+		defer dec.Close()
+		rc = dec
 	}
 
 	switch enc := flags & optEncodingMask; enc {
@@ -478,8 +505,11 @@ func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 
 // SaveDataFile atomically replace an object in a file.
 func (s *Storage) SaveDataFile(filename string, obj interface{}) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	t := fmt.Sprintf("%s.tmp-%d", filename, time.Now().UnixNano())
-	if err := s.writeFile(context(filename), t, obj); err != nil {
+	if err := s.writeFile(kdf.FileContext(filename), t, obj); err != nil {
 		return err
 	}
 	// Atomically replace the file.
@@ -488,7 +518,10 @@ func (s *Storage) SaveDataFile(filename string, obj interface{}) error {
 
 // CreateEmptyFile creates an empty file.
 func (s *Storage) CreateEmptyFile(filename string, empty interface{}) error {
-	return s.writeFile(context(filename), filename, empty)
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.writeFile(kdf.FileContext(filename), filename, empty)
 }
 
 // writeFile writes obj to a file.
@@ -516,7 +549,7 @@ func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retEr
 		flags |= optCompressed
 	}
 
-	w, err := s.openWriteStream(ctx, fn, flags, 64*1024)
+	w, err := s.openWriteStream(ctx, fn, flags, 64*1024, false)
 	if err != nil {
 		return err
 	}
@@ -575,6 +608,9 @@ func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retEr
 // finalFileName is the final name of the file. The caller is expected to rename
 // the file to that name when it is done with writing.
 func (s *Storage) OpenBlobWrite(writeFileName, finalFileName string) (io.WriteCloser, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
 	fn := filepath.Join(s.dir, writeFileName)
 	if err := createParentIfNotExist(fn); err != nil {
 		return nil, err
@@ -584,12 +620,18 @@ func (s *Storage) OpenBlobWrite(writeFileName, finalFileName string) (io.WriteCl
 		flags |= optEncrypted
 		flags |= optPadded
 	}
-	return s.openWriteStream(context(finalFileName), fn, flags, 1024*1024)
+	return s.openWriteStream(kdf.FileContext(finalFileName), fn, flags, 1024*1024, s.dropCache)
 }
 
 // OpenBlobRead opens a blob file for reading.
 func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retErr error) {
-	f, err := os.Open(filepath.Join(s.dir, filename))
+	var f io.ReadSeekCloser
+	var err error
+	if s.blobStore != nil {
+		f, err = s.blobStore.Open(filename)
+	} else {
+		f, err = os.Open(filepath.Join(s.dir, filename))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -626,7 +668,7 @@ func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retEr
 		}
 		defer k.Wipe()
 		// Use the file key to decrypt the rest of the file.
-		if r, err = k.StartReader(context(filename), f); err != nil {
+		if r, err = k.StartReader(kdf.FileContext(filename), f); err != nil {
 			return nil, err
 		}
 		// Read the header again.
@@ -650,6 +692,24 @@ func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retEr
 	return &seekWrapper{r, off}, nil
 }
 
+// IsBlobFile returns true if filename, a local file, was written with
+// OpenBlobWrite, i.e. its header says that it contains raw bytes.
+func (s *Storage) IsBlobFile(filename string) (bool, error) {
+	f, err := os.Open(filepath.Join(s.dir, filename))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(hdr[:4]) == "KRIN" && hdr[4]&optEncodingMask == optRawBytes, nil
+}
+
 // seekWrapper wraps a read stream such that Seek calls are relative to the
 // start offset.
 type seekWrapper struct {
@@ -671,12 +731,17 @@ func (w *seekWrapper) Seek(offset int64, whence int) (newOffset int64, err error
 	return
 }
 
-// openWriteStream opens a write stream.
-func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPadding int) (io.WriteCloser, error) {
-	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+// openWriteStream opens a write stream. When dropCache is true, the data that
+// is written isn't kept in the page cache.
+func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPadding int, dropCache bool) (io.WriteCloser, error) {
+	of, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
 	if err != nil {
 		return nil, err
 	}
+	var f io.WriteCloser = of
+	if dropCache {
+		f = newDropCacheWriter(of)
+	}
 	if _, err := f.Write([]byte{'K', 'R', 'I', 'N', flags}); err != nil {
 		f.Close()
 		return nil, err
@@ -712,25 +777,47 @@ func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPa
 	var wc io.WriteCloser = w
 	if flags&optCompressed != 0 {
 		// Compress the content.
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
 		if err != nil {
 			return nil, err
 		}
-		wc = &gzipWrapper{gz, w}
+		wc = &compressWrapper{enc, w}
 	}
 	return wc, nil
 }
 
-// gzipWrapper wraps a gzip.Writer so that its Close function also closes the
-// underlying stream.
-type gzipWrapper struct {
-	*gzip.Writer
+// zstdMagic is the beginning of a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// newDecompressReader returns a reader that decompresses r. New files are
+// compressed with zstd. The files that were compressed before that use gzip.
+// The two are told apart by the first bytes of the stream.
+func newDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return gzip.NewReader(br)
+	}
+	dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// compressWrapper wraps a compressing writer so that its Close function also
+// closes the underlying stream.
+type compressWrapper struct {
+	io.WriteCloser
 	w io.Closer
 }
 
-func (gz *gzipWrapper) Close() error {
-	err := gz.Writer.Close()
-	if e := gz.w.Close(); err == nil {
+func (c *compressWrapper) Close() error {
+	err := c.WriteCloser.Close()
+	if e := c.w.Close(); err == nil {
 		err = e
 	}
 	return err
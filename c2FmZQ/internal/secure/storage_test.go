@@ -18,8 +18,12 @@
 package secure
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -28,6 +32,7 @@ import (
 	"time"
 
 	"c2FmZQ/internal/crypto"
+	"c2FmZQ/internal/crypto/kdf"
 	"c2FmZQ/internal/log"
 )
 
@@ -328,7 +333,7 @@ func RunBenchmarkOpenForUpdate(b *testing.B, kb int, k crypto.EncryptionKey, com
 		}
 		obj.M[string(key)] = string(value)
 	}
-	if err := s.writeFile(context("testfile"), "testfile", &obj); err != nil {
+	if err := s.writeFile(kdf.FileContext("testfile"), "testfile", &obj); err != nil {
 		b.Fatalf("s.writeFile: %v", err)
 	}
 	fi, err := os.Stat(file)
@@ -459,3 +464,263 @@ func BenchmarkOpenForUpdate_GOB_10MB_PlainText_GZIP(b *testing.B) {
 func BenchmarkOpenForUpdate_GOB_20MB_PlainText_GZIP(b *testing.B) {
 	RunBenchmarkOpenForUpdate(b, 20480, nil, true, true)
 }
+
+func TestBlobsDropCache(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorageWithOptions(dir, aesEncryptionKey(), Options{DropBlobCache: true})
+
+	content := make([]byte, 20<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	w, err := s.OpenBlobWrite("tempfile", "finalfile")
+	if err != nil {
+		t.Fatalf("s.OpenBlobWrite failed: %v", err)
+	}
+	for b := content; len(b) > 0; b = b[1<<20:] {
+		if _, err := w.Write(b[:1<<20]); err != nil {
+			t.Fatalf("w.Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("w.Close failed: %v", err)
+	}
+	if err := s.CommitBlob("tempfile", "finalfile"); err != nil {
+		t.Fatalf("s.CommitBlob failed: %v", err)
+	}
+	r, err := s.OpenBlobRead("finalfile")
+	if err != nil {
+		t.Fatalf("s.OpenBlobRead failed: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("io.ReadAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, content) {
+		t.Errorf("Unexpected content. Got %d bytes, want %d bytes", len(got), len(content))
+	}
+}
+
+// RunBenchmarkReadDuringBlobWrites measures the time to read a metadata file
+// while large blobs are written in the background.
+func RunBenchmarkReadDuringBlobWrites(b *testing.B, dropCache bool) {
+	dir := b.TempDir()
+	s := NewStorageWithOptions(dir, aesEncryptionKey(), Options{DropBlobCache: dropCache})
+
+	obj := struct {
+		M map[string]string `json:"m"`
+	}{M: make(map[string]string)}
+	for i := 0; i < 1024; i++ {
+		obj.M[fmt.Sprintf("key%d", i)] = string(make([]byte, 1024))
+	}
+	if err := s.writeFile(kdf.FileContext("testfile"), "testfile", &obj); err != nil {
+		b.Fatalf("s.writeFile: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1<<20)
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("blob%d", i)
+			w, err := s.OpenBlobWrite(name, name)
+			if err != nil {
+				b.Errorf("s.OpenBlobWrite: %v", err)
+				return
+			}
+			for j := 0; j < 256; j++ {
+				select {
+				case <-stop:
+					w.Close()
+					return
+				default:
+				}
+				if _, err := w.Write(buf); err != nil {
+					b.Errorf("w.Write: %v", err)
+					return
+				}
+			}
+			w.Close()
+			os.Remove(filepath.Join(dir, name))
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.ReadDataFile("testfile", &obj); err != nil {
+			b.Fatalf("s.ReadDataFile: %v", err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkReadDuringBlobWrites_Cache(b *testing.B) {
+	RunBenchmarkReadDuringBlobWrites(b, false)
+}
+
+func BenchmarkReadDuringBlobWrites_DropCache(b *testing.B) {
+	RunBenchmarkReadDuringBlobWrites(b, true)
+}
+
+func TestCompressDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	plain := NewStorage(dir, mk)
+	compressed := NewStorageWithOptions(dir, mk, Options{CompressDataFiles: true})
+
+	obj := struct {
+		M map[string]string `json:"m"`
+	}{M: make(map[string]string)}
+	// Large enough that the random padding, up to 64 KiB, can't make up
+	// the difference.
+	for i := 0; i < 10000; i++ {
+		obj.M[fmt.Sprintf("key%d", i)] = "compressible value"
+	}
+	if err := plain.SaveDataFile("plain", &obj); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	if err := compressed.SaveDataFile("compressed", &obj); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	fiPlain, err := os.Stat(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatalf("os.Stat failed: %v", err)
+	}
+	fiCompressed, err := os.Stat(filepath.Join(dir, "compressed"))
+	if err != nil {
+		t.Fatalf("os.Stat failed: %v", err)
+	}
+	if fiCompressed.Size() >= fiPlain.Size() {
+		t.Errorf("Compressed file size = %d, want < %d", fiCompressed.Size(), fiPlain.Size())
+	}
+
+	// Both files can be read by both storages.
+	for _, s := range []*Storage{plain, compressed} {
+		for _, fn := range []string{"plain", "compressed"} {
+			var got struct {
+				M map[string]string `json:"m"`
+			}
+			if err := s.ReadDataFile(fn, &got); err != nil {
+				t.Fatalf("ReadDataFile(%q) failed: %v", fn, err)
+			}
+			if !reflect.DeepEqual(got, obj) {
+				t.Errorf("ReadDataFile(%q) returned unexpected content", fn)
+			}
+		}
+	}
+}
+
+func TestCompressDataFilesFormat(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorageWithOptions(dir, nil, Options{CompressDataFiles: true})
+
+	want := map[string]string{"foo": "bar"}
+	if err := s.SaveDataFile("zstd", &want); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "zstd"))
+	if err != nil {
+		t.Fatalf("os.ReadFile failed: %v", err)
+	}
+	if len(b) < 9 || !bytes.Equal(b[5:9], zstdMagic) {
+		t.Errorf("File content = %x, want zstd stream", b)
+	}
+
+	// Files that were compressed with gzip can still be read.
+	var buf bytes.Buffer
+	buf.Write([]byte{'K', 'R', 'I', 'N', optJSONEncoded | optCompressed})
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(want); err != nil {
+		t.Fatalf("json.Encode failed: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip.Close failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "gzip"), buf.Bytes(), 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %v", err)
+	}
+	for _, fn := range []string{"zstd", "gzip"} {
+		var got map[string]string
+		if err := s.ReadDataFile(fn, &got); err != nil {
+			t.Fatalf("ReadDataFile(%q) failed: %v", fn, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadDataFile(%q) = %v, want %v", fn, got, want)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	rw := NewStorage(dir, mk)
+	ro := NewStorageWithOptions(dir, mk, Options{ReadOnly: true})
+
+	want := "foo"
+	if err := rw.SaveDataFile("file", &want); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	var got string
+	if err := ro.ReadDataFile("file", &got); err != nil || got != want {
+		t.Errorf("ReadDataFile() = %q, %v, want %q, nil", got, err, want)
+	}
+
+	if err := ro.SaveDataFile("file", &want); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SaveDataFile() = %v, want %v", err, ErrReadOnly)
+	}
+	if err := ro.CreateEmptyFile("new", &want); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("CreateEmptyFile() = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := ro.OpenForUpdate("file", &got); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("OpenForUpdate() = %v, want %v", err, ErrReadOnly)
+	}
+	if err := ro.Lock("file"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Lock() = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := ro.OpenBlobWrite("blob.tmp", "blob"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("OpenBlobWrite() = %v, want %v", err, ErrReadOnly)
+	}
+	if err := ro.CommitBlob("blob.tmp", "blob"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("CommitBlob() = %v, want %v", err, ErrReadOnly)
+	}
+	if err := ro.DeleteBlob("file"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteBlob() = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("os.Stat(new) = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestEncryptionAlgo(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mk   crypto.EncryptionKey
+	}{
+		{"aes", aesEncryptionKey()},
+		{"chacha20poly1305", ccEncryptionKey()},
+	} {
+		dir := t.TempDir()
+		s := NewStorage(dir, tc.mk)
+		want := []byte("Hello world")
+		if err := s.SaveDataFile("file", &want); err != nil {
+			t.Fatalf("%s: s.SaveDataFile() failed: %v", tc.name, err)
+		}
+		var got []byte
+		if err := s.ReadDataFile("file", &got); err != nil {
+			t.Errorf("%s: s.ReadDataFile() failed: %v", tc.name, err)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := NewStorage(dir, ccEncryptionKey()).SaveDataFile("file", []byte("Hello")); err != nil {
+		t.Fatalf("SaveDataFile() failed: %v", err)
+	}
+	var got []byte
+	if err := NewStorage(dir, aesEncryptionKey()).ReadDataFile("file", &got); !errors.Is(err, crypto.ErrDecryptFailed) {
+		t.Errorf("ReadDataFile() with the wrong key = %v, want %v", err, crypto.ErrDecryptFailed)
+	}
+}
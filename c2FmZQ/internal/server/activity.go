@@ -0,0 +1,100 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// recordActivity adds an event to the user's account activity log. Errors
+// are logged, but otherwise ignored.
+func (s *Server) recordActivity(userID int64, typ, detail string) {
+	if err := s.db.RecordActivity(userID, typ, detail); err != nil {
+		log.Errorf("RecordActivity(%d, %q): %v", userID, typ, err)
+	}
+}
+
+// sharedWith returns the sorted user IDs of the sharing keys, for the activity
+// log.
+func sharedWith(sharingKeys map[string]string) string {
+	ids := make([]string, 0, len(sharingKeys))
+	for id := range sharingKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return "user(s) " + strings.Join(ids, ",")
+}
+
+// handleAccountActivity handles the /v2x/config/activity endpoint. It returns
+// the activity log of the user's own account, e.g. logins, shares, and
+// deletions, in JSON or CSV format.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - format: "json" (default) or "csv".
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part("activity", The list of activity entries) with format=json
+//     Part("csv", The activity entries as CSV text) with format=csv
+func (s *Server) handleAccountActivity(user database.User, req *http.Request) *stingle.Response {
+	format := req.PostFormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		return stingle.ResponseNOK().AddError("Invalid format")
+	}
+	entries, err := s.db.Activity(user.UserID)
+	if err != nil {
+		log.Errorf("Activity: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if format != "csv" {
+		return stingle.ResponseOK().AddPart("activity", entries)
+	}
+	b, err := activityCSV(entries)
+	if err != nil {
+		log.Errorf("activityCSV: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("csv", string(b))
+}
+
+// activityCSV encodes the activity entries as CSV with a header row. The
+// dates are in RFC 3339 format, in UTC.
+func activityCSV(entries []database.ActivityEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"date", "type", "detail"})
+	for _, e := range entries {
+		w.Write([]string{time.UnixMilli(e.Date).UTC().Format(time.RFC3339), e.Type, e.Detail})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -20,12 +20,16 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
+	"time"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
+var periodRE = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
 // handleAdminUsers handles the /v2x/admin/users endpoint.
 //
 // Arguments:
@@ -77,3 +81,138 @@ func (s *Server) handleAdminUsers(user database.User, req *http.Request) *stingl
 	return stingle.ResponseOK().
 		AddPart("users", user.PublicKey.SealBox(b))
 }
+
+// handleAdminUsage handles the /v2x/admin/usage endpoint.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - period: The period of the report, e.g. "2022-11" for a month, or
+//     "2022-11-05" for a single day. The default is the current month.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts("usage", encrypted list of per-user usage)
+func (s *Server) handleAdminUsage(user database.User, req *http.Request) *stingle.Response {
+	if !user.Admin {
+		return stingle.ResponseNOK()
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	period := params["period"]
+	if period == "" {
+		period = time.Now().UTC().Format("2006-01")
+	}
+	if !periodRE.MatchString(period) {
+		return stingle.ResponseNOK().AddError("Invalid period")
+	}
+	usage, err := s.db.UsageReport(period)
+	if err != nil {
+		log.Errorf("UsageReport: %v", err)
+		return stingle.ResponseNOK()
+	}
+	b, err := json.Marshal(usage)
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("usage", user.PublicKey.SealBox(b))
+}
+
+// handleAdminCleanup handles the /v2x/admin/cleanup endpoint. It deletes a
+// user account, purges the files deleted from the trash, or runs the garbage
+// collector. With dryRun, nothing is changed, and the response describes what
+// would be removed.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - op: The operation: "deleteUser", "purge", or "gc".
+//   - userId: The user to delete, with "deleteUser".
+//   - dryRun: "1" to only report what would be removed.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts("report", encrypted database.RemovalReport)
+func (s *Server) handleAdminCleanup(user database.User, req *http.Request) *stingle.Response {
+	if !user.Admin {
+		return stingle.ResponseNOK()
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	dryRun := params["dryRun"] == "1"
+	var report *database.RemovalReport
+	switch params["op"] {
+	case "deleteUser":
+		userID := parseInt(params["userId"], 0)
+		if userID == user.UserID {
+			return stingle.ResponseNOK().AddError("Use the account settings to delete your own account")
+		}
+		target, err := s.db.UserByID(userID)
+		if err != nil {
+			return stingle.ResponseNOK().AddError("Unknown user")
+		}
+		if report, err = s.db.DeleteUserDryRun(target); err == nil && !dryRun {
+			log.Infof("Admin %d is deleting user %d", user.UserID, userID)
+			err = s.db.DeleteUser(target)
+		}
+		if err == database.ErrOnHold {
+			return stingle.ResponseNOK().AddError("This account is on hold. Nothing can be deleted.")
+		}
+		if err != nil {
+			log.Errorf("DeleteUser: %v", err)
+			return stingle.ResponseNOK()
+		}
+	case "purge":
+		if report, err = s.db.PurgeDeletedFilesDryRun(); err == nil && !dryRun {
+			var n int
+			n, err = s.db.PurgeDeletedFiles()
+			report.Files = n
+		}
+		if err != nil {
+			log.Errorf("PurgeDeletedFiles: %v", err)
+			return stingle.ResponseNOK()
+		}
+	case "gc":
+		if dryRun {
+			report, err = s.db.CollectGarbageDryRun(gcMinBlobAge)
+		} else {
+			var stats database.GCStats
+			stats, err = s.db.CollectGarbage(gcMinBlobAge)
+			report = &database.RemovalReport{
+				Blobs:          stats.OrphansDeleted,
+				Bytes:          stats.ReclaimedBytes,
+				RefCountsFixed: stats.RefCountsFixed,
+			}
+		}
+		if err != nil {
+			log.Errorf("CollectGarbage: %v", err)
+			return stingle.ResponseNOK()
+		}
+	default:
+		return stingle.ResponseNOK().AddError("Invalid operation")
+	}
+	report.DryRun = dryRun
+	b, err := json.Marshal(report)
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("report", user.PublicKey.SealBox(b))
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestAdminCleanup(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	// The first account is an admin.
+	admin, err := createAccountAndLogin(sock, "admin")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin: %v", err)
+	}
+	bob, err := createAccountAndLogin(sock, "bob")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin: %v", err)
+	}
+	for _, f := range []string{"file1", "file2"} {
+		if _, err := bob.uploadFile(f, stingle.GallerySet, "", 1000); err != nil {
+			t.Fatalf("bob.uploadFile(%q): %v", f, err)
+		}
+	}
+	userID := fmt.Sprintf("%d", bob.userID)
+
+	if _, err := bob.adminCleanup(map[string]string{"op": "gc", "dryRun": "1"}); err == nil {
+		t.Error("bob.adminCleanup should have failed")
+	}
+	if _, err := admin.adminCleanup(map[string]string{"op": "deleteUser", "userId": fmt.Sprintf("%d", admin.userID), "dryRun": "1"}); err == nil {
+		t.Error("admin.adminCleanup(deleteUser admin) should have failed")
+	}
+
+	r, err := admin.adminCleanup(map[string]string{"op": "deleteUser", "userId": userID, "dryRun": "1"})
+	if err != nil {
+		t.Fatalf("admin.adminCleanup(deleteUser, dryRun) failed: %v", err)
+	}
+	if !r.DryRun || r.Users != 1 || r.Files != 2 || r.Blobs != 4 || r.Bytes == 0 || len(r.Items) != 2 {
+		t.Errorf("admin.adminCleanup(deleteUser, dryRun) = %+v", r)
+	}
+	if err := bob.getServerPK(); err != nil {
+		t.Fatalf("bob was deleted by the dry run: %v", err)
+	}
+	for _, op := range []string{"purge", "gc"} {
+		r, err := admin.adminCleanup(map[string]string{"op": op, "dryRun": "1"})
+		if err != nil {
+			t.Fatalf("admin.adminCleanup(%s, dryRun) failed: %v", op, err)
+		}
+		if !r.DryRun || r.Files != 0 || r.Blobs != 0 {
+			t.Errorf("admin.adminCleanup(%s, dryRun) = %+v", op, r)
+		}
+	}
+
+	if r, err = admin.adminCleanup(map[string]string{"op": "deleteUser", "userId": userID}); err != nil {
+		t.Fatalf("admin.adminCleanup(deleteUser) failed: %v", err)
+	}
+	if r.DryRun || r.Files != 2 {
+		t.Errorf("admin.adminCleanup(deleteUser) = %+v", r)
+	}
+	if err := bob.getServerPK(); err == nil {
+		t.Error("bob.getServerPK should have failed after deleteUser")
+	}
+}
+
+func (c *client) adminCleanup(params map[string]string) (*database.RemovalReport, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+	sr, err := c.sendRequest("/v2x/admin/cleanup", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	b, err := c.secretKey.SealBoxOpenBase64(sr.Part("report").(string))
+	if err != nil {
+		return nil, err
+	}
+	var r database.RemovalReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
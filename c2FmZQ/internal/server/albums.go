@@ -19,6 +19,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"c2FmZQ/internal/database"
@@ -60,6 +61,12 @@ func (s *Server) handleAddAlbum(user database.User, req *http.Request) *stingle.
 	}
 	if err := s.db.AddAlbum(user, album); err != nil {
 		log.Errorf("AddAlbum: %v", err)
+		if err == database.ErrAlbumLimitExceeded {
+			return stingle.ResponseNOK().AddError("Album limit exceeded")
+		}
+		if err == database.ErrInvalidID {
+			return stingle.ResponseNOK().AddError("Invalid album ID")
+		}
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -96,8 +103,15 @@ func (s *Server) handleDeleteAlbum(user database.User, req *http.Request) *sting
 
 	if err := s.db.DeleteAlbum(user, albumID); err != nil {
 		log.Errorf("DeleteAlbum: %v", err)
+		if err == database.ErrLimitedAccount {
+			return stingle.ResponseNOK().AddError("Limited accounts can only delete empty albums")
+		}
+		if err == database.ErrOnHold {
+			return stingle.ResponseNOK().AddError("This account is on hold. Nothing can be deleted.")
+		}
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityDeleteAlbum, fmt.Sprintf("album %s", albumID))
 	return stingle.ResponseOK()
 }
 
@@ -264,8 +278,15 @@ func (s *Server) handleShare(user database.User, req *http.Request) *stingle.Res
 	if albumSpec.OwnerID == user.UserID || (albumSpec.Members[user.UserID] && albumSpec.Permissions.AllowShare()) {
 		if err := s.db.ShareAlbum(user, album, sharingKeys); err != nil {
 			log.Errorf("ShareAlbum: %v", err)
+			if err == database.ErrShareLimitExceeded {
+				return stingle.ResponseNOK().AddError("Album member limit exceeded")
+			}
+			if err == database.ErrLimitedAccount {
+				return stingle.ResponseNOK().AddError("Limited accounts can only share albums with their family")
+			}
 			return stingle.ResponseNOK()
 		}
+		s.recordActivity(user.UserID, database.ActivityShare, fmt.Sprintf("album %s with %s", album.AlbumID, sharedWith(sharingKeys)))
 		return stingle.ResponseOK()
 	}
 	return stingle.ResponseNOK().AddError("You are not allow to share the album")
@@ -353,6 +374,7 @@ func (s *Server) handleRemoveAlbumMember(user database.User, req *http.Request)
 		log.Errorf("RemoveAlbumMember(%q, %q): %v", album.AlbumID, memberID, err)
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityRemoveMember, fmt.Sprintf("album %s member %d", album.AlbumID, memberID))
 	return stingle.ResponseOK()
 }
 
@@ -391,6 +413,7 @@ func (s *Server) handleUnshareAlbum(user database.User, req *http.Request) *stin
 		log.Errorf("UnshareAlbum(%q): %v", albumID, err)
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityUnshare, fmt.Sprintf("album %s", albumID))
 	return stingle.ResponseOK()
 }
 
@@ -431,5 +454,6 @@ func (s *Server) handleLeaveAlbum(user database.User, req *http.Request) *stingl
 		log.Errorf("RemoveAlbumMember(%q, %q): %v", albumID, user.UserID, err)
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityLeave, fmt.Sprintf("album %s", albumID))
 	return stingle.ResponseOK()
 }
@@ -24,9 +24,11 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -405,6 +407,39 @@ func TestUnshareAlbumEdits(t *testing.T) {
 	}
 }
 
+func TestSerializeUserUpdates(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.SerializeUserUpdates = true
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.addAlbum(fmt.Sprintf("album%d", i), int64(1000+i)); err != nil {
+				t.Errorf("c.addAlbum failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	sr, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	if got := len(sr.Part("albums").([]interface{})); got != n {
+		t.Errorf("Got %d albums, want %d", got, n)
+	}
+}
+
 func (c *client) addAlbum(albumID string, ts int64) error {
 	params := make(map[string]string)
 	params["albumId"] = albumID
@@ -0,0 +1,55 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// The reasons of the authentication failures in the AuthFailureLog.
+const (
+	authFailureCredentials = "bad-credentials"
+	authFailureLockedOut   = "locked-out"
+	authFailureToken       = "invalid-token"
+	authFailureSetupToken  = "invalid-setup-token"
+	authFailureAPIKey      = "invalid-api-key"
+)
+
+// logAuthFailure writes an authentication failure to the AuthFailureLog. The
+// format is stable so that tools like fail2ban or crowdsec can parse it, e.g.
+//
+//	2022-01-02T15:04:05Z c2FmZQ: authentication failure; reason=bad-credentials rhost=192.0.2.1 user="alice@example.com"
+//
+// A matching fail2ban filter is:
+//
+//	failregex = c2FmZQ: authentication failure; reason=\S+ rhost=<HOST>
+func (s *Server) logAuthFailure(req *http.Request, reason, user string) {
+	if s.AuthFailureLog == nil {
+		return
+	}
+	line := fmt.Sprintf("%s c2FmZQ: authentication failure; reason=%s rhost=%s user=%q\n", time.Now().UTC().Format(time.RFC3339), reason, remoteHost(req), user)
+	s.authFailureMutex.Lock()
+	defer s.authFailureMutex.Unlock()
+	if _, err := s.AuthFailureLog.Write([]byte(line)); err != nil {
+		log.Errorf("AuthFailureLog: %v", err)
+	}
+}
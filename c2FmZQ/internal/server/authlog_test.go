@@ -0,0 +1,77 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+)
+
+func TestAuthFailureLog(t *testing.T) {
+	db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+	s := server.New(db, "", "", "")
+	s.BillingAPIKey = "secret"
+	s.RateLimitPolicy, _ = server.NewRateLimitPolicy("", "127.0.0.0/8,::1/128")
+	var buf bytes.Buffer
+	s.AuthFailureLog = &buf
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().PostForm(srv.URL+"/v2/login/login", url.Values{"email": {"alice@"}, "password": {"foo"}})
+	if err != nil {
+		t.Fatalf("PostForm: %v", err)
+	}
+	resp.Body.Close()
+	resp, err = srv.Client().PostForm(srv.URL+"/v2/sync/getUpdates", url.Values{"token": {"foo"}})
+	if err != nil {
+		t.Fatalf("PostForm: %v", err)
+	}
+	resp.Body.Close()
+	req, err := http.NewRequest("GET", srv.URL+"/v2x/billing/entitlements?email=alice@", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	if resp, err = srv.Client().Do(req); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^\S+ c2FmZQ: authentication failure; reason=bad-credentials rhost=(127\.0\.0\.1|::1) user="alice@"$`),
+		regexp.MustCompile(`^\S+ c2FmZQ: authentication failure; reason=invalid-token rhost=(127\.0\.0\.1|::1) user=""$`),
+		regexp.MustCompile(`^\S+ c2FmZQ: authentication failure; reason=invalid-api-key rhost=(127\.0\.0\.1|::1) user=""$`),
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Got %d lines, want %d: %q", len(lines), len(want), buf.String())
+	}
+	for i, re := range want {
+		if !re.Match(lines[i]) {
+			t.Errorf("Line %d = %q, want match for %q", i, lines[i], re)
+		}
+	}
+}
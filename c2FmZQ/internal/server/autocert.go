@@ -0,0 +1,382 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// The delays between attempts to start the autocert http server.
+	autocertMinBackoff = time.Second
+	autocertMaxBackoff = 5 * time.Minute
+	// The validity of the self-signed fallback certificate.
+	selfSignedValidity = 24 * time.Hour
+	// The maximum number of distinct domain labels in the autocert metrics.
+	// With the 'any' domain policy, the domains come from the clients.
+	maxCertMetricDomains = 100
+)
+
+var (
+	autocertAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "server_autocert_issuance_attempts_total",
+			Help: "Number of times a new certificate had to be requested from the ACME server",
+		},
+		[]string{"domain"},
+	)
+	autocertCertificates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "server_autocert_certificates_total",
+			Help: "Number of certificates obtained from the ACME server, by type (issued or renewed)",
+		},
+		[]string{"domain", "type"},
+	)
+	autocertErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "server_autocert_errors_total",
+			Help: "Number of errors while getting a certificate",
+		},
+		[]string{"domain"},
+	)
+	autocertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "server_autocert_certificate_expiry_seconds",
+			Help: "The expiration time of the certificate of each domain, in seconds since the epoch",
+		},
+		[]string{"domain"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(autocertAttempts)
+	prometheus.MustRegister(autocertCertificates)
+	prometheus.MustRegister(autocertErrors)
+	prometheus.MustRegister(autocertExpiry)
+}
+
+// CertStatus is the status of the server's TLS certificates.
+type CertStatus struct {
+	// Whether the autocert http server, which answers the HTTP-01
+	// challenges, is running. Only used with autocert.
+	ChallengeServer bool `json:"challengeServer,omitempty"`
+	// The last error from the autocert http server, or from getting or
+	// loading a certificate.
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	// The expiration time of the last certificate that was obtained or
+	// loaded.
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	// Whether the self-signed fallback certificate was used since the last
+	// certificate was obtained.
+	SelfSigned bool `json:"selfSigned,omitempty"`
+}
+
+// certManager wraps autocert.Manager to keep track of its status, and to fall
+// back to a self-signed certificate when a certificate can't be obtained.
+type certManager struct {
+	m        *autocert.Manager
+	fallback bool
+
+	mu         sync.Mutex
+	status     CertStatus
+	selfSigned *tls.Certificate
+	domains    map[string]bool
+}
+
+// domainLabel returns the value of the domain label to use in the metrics for
+// name. The number of distinct values is limited.
+func (cm *certManager) domainLabel(name string) string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.domains[name] {
+		return name
+	}
+	if len(cm.domains) >= maxCertMetricDomains {
+		return "other"
+	}
+	if cm.domains == nil {
+		cm.domains = make(map[string]bool)
+	}
+	cm.domains[name] = true
+	return name
+}
+
+// certCache wraps the autocert cache to record the certificate metrics. The
+// autocert manager reads the cache before requesting a new certificate, and
+// saves every certificate that it obtains.
+type certCache struct {
+	autocert.Cache
+	cm *certManager
+}
+
+// certDomain returns the domain of a certificate cache key, or false if key
+// isn't for a certificate, e.g. a challenge token or the ACME account key.
+func certDomain(key string) (string, bool) {
+	if strings.HasPrefix(key, "acme_account") || strings.HasSuffix(key, "+token") || strings.HasSuffix(key, "+http-01") {
+		return "", false
+	}
+	return strings.TrimSuffix(key, "+rsa"), true
+}
+
+// Get implements autocert.Cache.
+func (c certCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.Cache.Get(ctx, key)
+	if domain, ok := certDomain(key); ok && err == autocert.ErrCacheMiss {
+		autocertAttempts.WithLabelValues(c.cm.domainLabel(domain)).Inc()
+	}
+	return data, err
+}
+
+// Put implements autocert.Cache.
+func (c certCache) Put(ctx context.Context, key string, data []byte) error {
+	domain, ok := certDomain(key)
+	if !ok {
+		return c.Cache.Put(ctx, key, data)
+	}
+	typ := "issued"
+	if _, err := c.Cache.Get(ctx, key); err == nil {
+		typ = "renewed"
+	}
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	label := c.cm.domainLabel(domain)
+	autocertCertificates.WithLabelValues(label, typ).Inc()
+	if leaf := leafCert(data); leaf != nil {
+		autocertExpiry.WithLabelValues(label).Set(float64(leaf.NotAfter.Unix()))
+	}
+	log.Infof("autocert: certificate %s for %s", typ, domain)
+	return nil
+}
+
+// leafCert returns the first certificate in PEM data, or nil.
+func leafCert(data []byte) *x509.Certificate {
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			return nil
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil
+		}
+		return cert
+	}
+}
+
+func (cm *certManager) setError(err error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.status.LastError = err.Error()
+	cm.status.LastErrorTime = time.Now().UTC()
+}
+
+func (cm *certManager) setChallengeServer(running bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.status.ChallengeServer = running
+}
+
+func (cm *certManager) certStatus() CertStatus {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.status
+}
+
+// runChallengeServer runs the autocert http server on addr. When it fails, it
+// is restarted with exponential backoff.
+func (cm *certManager) runChallengeServer(addr string) {
+	backoff := autocertMinBackoff
+	for {
+		start := time.Now()
+		cm.setChallengeServer(true)
+		err := http.ListenAndServe(addr, cm.m.HTTPHandler(nil))
+		cm.setChallengeServer(false)
+		log.Errorf("autocert http server failed: %v", err)
+		cm.setError(err)
+		if time.Since(start) > autocertMaxBackoff {
+			backoff = autocertMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > autocertMaxBackoff {
+			backoff = autocertMaxBackoff
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cm *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := cm.m.GetCertificate(hello)
+	if err == nil {
+		cm.mu.Lock()
+		if cert.Leaf != nil {
+			cm.status.NotAfter = cert.Leaf.NotAfter
+			certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+		}
+		cm.status.SelfSigned = false
+		cm.mu.Unlock()
+		if cert.Leaf != nil && hello.ServerName != "" {
+			autocertExpiry.WithLabelValues(cm.domainLabel(hello.ServerName)).Set(float64(cert.Leaf.NotAfter.Unix()))
+		}
+		return cert, nil
+	}
+	log.Errorf("autocert GetCertificate(%q): %v", hello.ServerName, err)
+	cm.setError(err)
+	if cm.hostAllowed(hello) {
+		autocertErrors.WithLabelValues(cm.domainLabel(hello.ServerName)).Inc()
+	}
+	if !cm.fallback {
+		return nil, err
+	}
+	return cm.selfSignedCert()
+}
+
+// hostAllowed returns whether the server name in hello is accepted by the host
+// policy. The errors for other names, e.g. from scanners, aren't counted.
+func (cm *certManager) hostAllowed(hello *tls.ClientHelloInfo) bool {
+	if hello.ServerName == "" {
+		return false
+	}
+	if cm.m.HostPolicy == nil {
+		return true
+	}
+	ctx := context.Background()
+	if c := hello.Context(); c != nil {
+		ctx = c
+	}
+	return cm.m.HostPolicy(ctx, hello.ServerName) == nil
+}
+
+// selfSignedCert returns a self-signed certificate. A new one is created when
+// the previous one is about to expire.
+func (cm *certManager) selfSignedCert() (*tls.Certificate, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.status.SelfSigned = true
+	if c := cm.selfSigned; c != nil && time.Until(c.Leaf.NotAfter) > time.Hour {
+		return c, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	templ := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: "c2FmZQ self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cm.selfSigned = &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	return cm.selfSigned, nil
+}
+
+// RunWithAutocert runs the HTTP server with TLS credentials provided by
+// letsencrypt.org.
+func (s *Server) RunWithAutocert(domain, addr string) error {
+	cm := &certManager{
+		m: &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+		},
+		fallback: s.AutocertFallbackSelfSigned,
+	}
+	cm.m.Cache = certCache{Cache: s.db.AutocertCache(), cm: cm}
+	if domain != "any" && domain != "*" {
+		cm.m.HostPolicy = autocert.HostWhitelist(strings.Split(domain, ",")...)
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	s.certStatus = cm.certStatus
+	go cm.runChallengeServer(addr)
+
+	s.srv = s.httpServer()
+	s.srv.TLSConfig.GetCertificate = cm.GetCertificate
+	return s.srv.ListenAndServeTLS("", "")
+}
+
+// handleHealth handles the /v2x/health endpoint. It can be used by monitoring
+// systems to check that the server is up.
+//
+// Returns:
+//   - A JSON object with "ok" set to true, and "certificate", the status of
+//     the TLS certificates, when TLS is used. When the database self-test
+//     failed, "ok" is false, "selfTest" is the error, and the status code is
+//     503.
+func (s *Server) handleHealth(w http.ResponseWriter, req *http.Request) {
+	resp := struct {
+		OK          bool        `json:"ok"`
+		SelfTest    string      `json:"selfTest,omitempty"`
+		Certificate *CertStatus `json:"certificate,omitempty"`
+	}{OK: true}
+	if s.certStatus != nil {
+		st := s.certStatus()
+		resp.Certificate = &st
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := s.db.SelfTestError(); err != nil {
+		resp.OK = false
+		resp.SelfTest = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("handleHealth: %v", err)
+	}
+}
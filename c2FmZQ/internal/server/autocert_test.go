@@ -0,0 +1,157 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+)
+
+func TestHealthEndpoint(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer{sock: sock}.DialContext}}
+	resp, err := hc.Get("http://unix/v2x/health")
+	if err != nil {
+		t.Fatalf("hc.Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var got map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("json.Decode: %v", err)
+	}
+	if got["ok"] != true {
+		t.Errorf("ok = %v, want true", got["ok"])
+	}
+	if _, ok := got["certificate"]; ok {
+		t.Errorf("certificate = %v, want none without autocert", got["certificate"])
+	}
+}
+
+func TestRunWithTLS(t *testing.T) {
+	notAfter := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	addr := startTLSServer(t, notAfter, nil)
+
+	hc := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := hc.Get("https://" + addr + "/v2x/health")
+	if err != nil {
+		t.Fatalf("hc.Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.TLS.PeerCertificates[0].NotAfter; !got.Equal(notAfter) {
+		t.Errorf("Certificate NotAfter = %v, want %v", got, notAfter)
+	}
+	var got struct {
+		OK          bool               `json:"ok"`
+		Certificate *server.CertStatus `json:"certificate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("json.Decode: %v", err)
+	}
+	if got.Certificate == nil || !got.Certificate.NotAfter.Equal(notAfter) {
+		t.Errorf("certificate = %+v, want NotAfter %v", got.Certificate, notAfter)
+	}
+}
+
+// startTLSServer starts a server with RunWithTLS and a test certificate that
+// expires at notAfter. It returns the server's address when it is ready.
+func startTLSServer(t *testing.T, notAfter time.Time, opts func(*server.Server)) string {
+	testdir := t.TempDir()
+	log.Record = t.Log
+	t.Cleanup(func() { log.Record = nil })
+
+	certFile := filepath.Join(testdir, "cert.pem")
+	keyFile := filepath.Join(testdir, "key.pem")
+	if err := writeTestCert(certFile, keyFile, notAfter); err != nil {
+		t.Fatalf("writeTestCert: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	db := database.New(filepath.Join(testdir, "data"), nil)
+	s := server.New(db, addr, "", "")
+	if opts != nil {
+		opts(s)
+	}
+	go s.RunWithTLS(certFile, keyFile)
+	for i := 0; ; i++ {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Cleanup(func() { s.Shutdown() })
+	return addr
+}
+
+func writeTestCert(certFile, keyFile string, notAfter time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
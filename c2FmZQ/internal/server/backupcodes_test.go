@@ -0,0 +1,54 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOTPBackupCodeHash(t *testing.T) {
+	codes, hashes, err := newOTPBackupCodes()
+	if err != nil {
+		t.Fatalf("newOTPBackupCodes: %v", err)
+	}
+	if len(codes) != numOTPBackupCodes || len(hashes) != numOTPBackupCodes {
+		t.Fatalf("newOTPBackupCodes() returned %d codes and %d hashes", len(codes), len(hashes))
+	}
+	for i, c := range codes {
+		if !matchOTPBackupCode(hashes[i], strings.ToUpper(c)) {
+			t.Errorf("matchOTPBackupCode(%q, %q) = false", hashes[i], c)
+		}
+		if j := (i + 1) % len(codes); matchOTPBackupCode(hashes[j], c) {
+			t.Errorf("matchOTPBackupCode(%q, %q) = true", hashes[j], c)
+		}
+	}
+	h, err := otpBackupCodeHash("abcd-efgh")
+	if err != nil {
+		t.Fatalf("otpBackupCodeHash: %v", err)
+	}
+	if !matchOTPBackupCode(h, "ABCD EFGH") {
+		t.Errorf("matchOTPBackupCode(%q, %q) = false", h, "ABCD EFGH")
+	}
+	if h2, _ := otpBackupCodeHash("abcd-efgh"); h == h2 {
+		t.Errorf("otpBackupCodeHash() = %q twice, want different salts", h)
+	}
+	if matchOTPBackupCode("invalid", "abcd-efgh") {
+		t.Error("matchOTPBackupCode(invalid) = true")
+	}
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+)
+
+// billingRequest is the request body of the /v2x/billing/entitlements
+// endpoint.
+type billingRequest struct {
+	Email           string  `json:"email"`
+	Quota           *int64  `json:"quota,omitempty"`
+	QuotaUnit       *string `json:"quotaUnit,omitempty"`
+	MaxAlbums       *int64  `json:"maxAlbums,omitempty"`
+	MaxAlbumMembers *int64  `json:"maxAlbumMembers,omitempty"`
+}
+
+// handleBillingEntitlements handles the /v2x/billing/entitlements endpoint. It
+// is used by an external billing system to read and set the entitlements of a
+// user, i.e. quota, maximum number of albums, and maximum number of album
+// members. The request must have a "Authorization: Bearer <BillingAPIKey>"
+// header.
+//
+// A GET request with the email query parameter returns the user's current
+// entitlements. A POST request with a JSON-encoded body changes them. Fields
+// that are omitted are left unchanged, and negative values remove the limit.
+//
+//	{
+//	  "email": "user@example.com",
+//	  "quota": 10,
+//	  "quotaUnit": "GB",
+//	  "maxAlbums": 100,
+//	  "maxAlbumMembers": 10
+//	}
+//
+// Returns:
+//   - The JSON-encoded entitlements of the user.
+func (s *Server) handleBillingEntitlements(w http.ResponseWriter, req *http.Request) {
+	if s.BillingAPIKey == "" {
+		http.NotFound(w, req)
+		return
+	}
+	key := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.BillingAPIKey)) != 1 {
+		s.logAuthFailure(req, authFailureAPIKey, "")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var r billingRequest
+	switch req.Method {
+	case http.MethodGet:
+		r.Email = req.URL.Query().Get("email")
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&r); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.db.User(r.Email)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method == http.MethodPost {
+		if err := s.db.SetUserLimits(database.AdminUser{
+			UserID:          user.UserID,
+			Quota:           r.Quota,
+			QuotaUnit:       r.QuotaUnit,
+			MaxAlbums:       r.MaxAlbums,
+			MaxAlbumMembers: r.MaxAlbumMembers,
+		}); err != nil {
+			log.Errorf("SetUserLimits: %v", err)
+			if err == database.ErrLimitedAccount {
+				http.Error(w, "Limited account", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	limits, err := s.db.UserLimits(user.UserID)
+	if err != nil {
+		log.Errorf("UserLimits: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// sendBillingWebhook posts a threshold event to the billing webhook URL. The
+// body is signed with the billing API key and the signature is sent in the
+// X-C2FMZQ-Signature header.
+func (s *Server) sendBillingWebhook(event database.ThresholdEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(s.BillingAPIKey))
+	mac.Write(b)
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	go func() {
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 10 * time.Second)
+			}
+			if err := postWebhook(s.BillingWebhookURL, sig, b); err != nil {
+				log.Errorf("Billing webhook: %v", err)
+				continue
+			}
+			return
+		}
+	}()
+}
+
+func postWebhook(url, sig string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-C2FMZQ-Signature", sig)
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
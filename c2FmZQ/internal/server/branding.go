@@ -0,0 +1,94 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"c2FmZQ/internal/log"
+)
+
+// maxLogoSize is the maximum size of the logo file.
+const maxLogoSize = 256 << 10
+
+var accentColorRE = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Branding customizes the appearance of the web app, so that users can tell
+// instances apart.
+type Branding struct {
+	// Name is the display name of the instance.
+	Name string `json:"name,omitempty"`
+	// Logo is the logo of the instance, as a data URL.
+	Logo string `json:"logo,omitempty"`
+	// AccentColor is a CSS hex color, e.g. #1e90ff.
+	AccentColor string `json:"accentColor,omitempty"`
+}
+
+// NewBranding validates the branding options and returns a Branding. The logo
+// file is optional. It must be a PNG, JPEG, GIF, WebP, or SVG image.
+func NewBranding(name, logoFile, accentColor string) (Branding, error) {
+	b := Branding{Name: strings.TrimSpace(name)}
+	if accentColor != "" {
+		if !accentColorRE.MatchString(accentColor) {
+			return b, fmt.Errorf("invalid accent color %q", accentColor)
+		}
+		b.AccentColor = accentColor
+	}
+	if logoFile == "" {
+		return b, nil
+	}
+	content, err := os.ReadFile(logoFile)
+	if err != nil {
+		return b, err
+	}
+	if len(content) > maxLogoSize {
+		return b, fmt.Errorf("logo is too large: %d > %d", len(content), maxLogoSize)
+	}
+	ctype := http.DetectContentType(content)
+	if strings.ToLower(filepath.Ext(logoFile)) == ".svg" {
+		ctype = "image/svg+xml"
+	}
+	switch ctype {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/svg+xml":
+	default:
+		return b, fmt.Errorf("unsupported logo content type %q", ctype)
+	}
+	b.Logo = "data:" + ctype + ";base64," + base64.StdEncoding.EncodeToString(content)
+	return b, nil
+}
+
+// handleBranding handles the /v2x/config/branding endpoint. It returns the
+// instance's display name, logo, and accent color, which the web app shows on
+// every page.
+//
+// Returns:
+//   - A JSON-encoded Branding object.
+func (s *Server) handleBranding(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(s.Branding); err != nil {
+		log.Errorf("handleBranding: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+)
+
+func TestNewBranding(t *testing.T) {
+	dir := t.TempDir()
+	png := filepath.Join(dir, "logo.png")
+	if err := os.WriteFile(png, []byte("\x89PNG\x0d\x0a\x1a\x0a0000"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	txt := filepath.Join(dir, "logo.txt")
+	if err := os.WriteFile(txt, []byte("hello"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	b, err := server.NewBranding(" Example ", png, "#1e90ff")
+	if err != nil {
+		t.Fatalf("NewBranding: %v", err)
+	}
+	if b.Name != "Example" || b.AccentColor != "#1e90ff" || !strings.HasPrefix(b.Logo, "data:image/png;base64,") {
+		t.Errorf("Unexpected branding: %+v", b)
+	}
+	if _, err := server.NewBranding("", txt, ""); err == nil {
+		t.Error("NewBranding accepted a text logo")
+	}
+	if _, err := server.NewBranding("", "", "red; x"); err == nil {
+		t.Error("NewBranding accepted an invalid color")
+	}
+}
+
+func TestBrandingEndpoint(t *testing.T) {
+	testdir := t.TempDir()
+	sock := filepath.Join(testdir, "server.sock")
+	log.Record = t.Log
+	defer func() { log.Record = nil }()
+	db := database.New(filepath.Join(testdir, "data"), nil)
+	s := server.New(db, "", "", "")
+	s.Branding = server.Branding{Name: "Example", AccentColor: "#abc"}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	go s.RunWithListener(l)
+	defer s.Shutdown()
+
+	dialer := dialer{sock: sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := hc.Get("http://unix/v2x/config/branding")
+	if err != nil {
+		t.Fatalf("hc.Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var got server.Branding
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("json.Decode: %v", err)
+	}
+	if want := s.Branding; got != want {
+		t.Errorf("Unexpected branding. Got %+v, want %+v", got, want)
+	}
+}
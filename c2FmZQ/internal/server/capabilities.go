@@ -0,0 +1,55 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"c2FmZQ/internal/log"
+)
+
+// Capabilities describes the server's features and policies that the apps
+// need to know about.
+type Capabilities struct {
+	// MaxSessions is the maximum number of valid sessions per account. Zero
+	// means no limit.
+	MaxSessions int `json:"maxSessions"`
+	// SessionLimitPolicy is what happens when a user logs in with
+	// MaxSessions valid sessions, "reject" or "evict".
+	SessionLimitPolicy string `json:"sessionLimitPolicy,omitempty"`
+}
+
+// handleCapabilities handles the /v2x/config/capabilities endpoint.
+//
+// Returns:
+//   - A JSON-encoded Capabilities object.
+func (s *Server) handleCapabilities(w http.ResponseWriter, req *http.Request) {
+	c := Capabilities{MaxSessions: s.MaxSessions}
+	if s.MaxSessions > 0 {
+		c.SessionLimitPolicy = s.SessionLimitPolicy
+		if c.SessionLimitPolicy == "" {
+			c.SessionLimitPolicy = SessionLimitReject
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		log.Errorf("handleCapabilities: %v", err)
+	}
+}
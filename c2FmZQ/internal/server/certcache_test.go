@@ -0,0 +1,137 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCertCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	cm := &certManager{}
+	c := certCache{Cache: autocert.DirCache(t.TempDir()), cm: cm}
+
+	attempts := metricValue(t, "server_autocert_issuance_attempts_total", map[string]string{"domain": "example.com"})
+	if _, err := c.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("Get() = %v, want ErrCacheMiss", err)
+	}
+	if _, err := c.Get(ctx, "acme_account+key"); err != autocert.ErrCacheMiss {
+		t.Fatalf("Get() = %v, want ErrCacheMiss", err)
+	}
+	if got := metricValue(t, "server_autocert_issuance_attempts_total", map[string]string{"domain": "example.com"}); got != attempts+1 {
+		t.Errorf("attempts = %v, want %v", got, attempts+1)
+	}
+
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	data := testCertPEM(t, notAfter)
+	for _, typ := range []string{"issued", "renewed"} {
+		labels := map[string]string{"domain": "example.com", "type": typ}
+		before := metricValue(t, "server_autocert_certificates_total", labels)
+		if err := c.Put(ctx, "example.com+rsa", data); err != nil {
+			t.Fatalf("Put() failed: %v", err)
+		}
+		if got := metricValue(t, "server_autocert_certificates_total", labels); got != before+1 {
+			t.Errorf("certificates{type=%s} = %v, want %v", typ, got, before+1)
+		}
+	}
+	if got, want := metricValue(t, "server_autocert_certificate_expiry_seconds", map[string]string{"domain": "example.com"}), float64(notAfter.Unix()); got != want {
+		t.Errorf("expiry = %v, want %v", got, want)
+	}
+}
+
+func TestCertDomainLabel(t *testing.T) {
+	cm := &certManager{}
+	for i := 0; i < maxCertMetricDomains; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		if got := cm.domainLabel(name); got != name {
+			t.Fatalf("domainLabel(%q) = %q", name, got)
+		}
+	}
+	if got := cm.domainLabel("host0.example.com"); got != "host0.example.com" {
+		t.Errorf("domainLabel(host0.example.com) = %q", got)
+	}
+	if got := cm.domainLabel("new.example.com"); got != "other" {
+		t.Errorf("domainLabel(new.example.com) = %q, want other", got)
+	}
+}
+
+func testCertPEM(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+}
+
+// metricValue returns the value of the counter or gauge with the given name
+// and labels.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue next
+				}
+			}
+			if c := m.GetCounter(); c != nil {
+				return c.GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
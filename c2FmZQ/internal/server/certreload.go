@@ -0,0 +1,187 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// How often the certificate files are checked for changes.
+	certReloadInterval = time.Minute
+	// How long before the certificate's expiration to start logging
+	// warnings, and how often.
+	certExpiryWarning         = 14 * 24 * time.Hour
+	certExpiryWarningInterval = 24 * time.Hour
+)
+
+var certExpiry = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "server_tls_certificate_expiry_seconds",
+		Help: "The expiration time of the TLS certificate, in seconds since the epoch",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(certExpiry)
+}
+
+// certReloader loads a TLS certificate from files, and reloads it when the
+// files change, e.g. when certbot renews the certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	ocsp     bool
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	modTime     time.Time
+	status      CertStatus
+	lastWarning time.Time
+	ocspRefresh time.Time
+}
+
+// newCertReloader returns a certReloader for the files. When ocsp is true, an
+// OCSP response is stapled to the certificate.
+func newCertReloader(certFile, keyFile string, ocsp bool) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, ocsp: ocsp}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate again if the files changed since the last
+// time. When the new files can't be loaded, the previous certificate is kept.
+func (r *certReloader) reload() error {
+	var modTime time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			r.setError(err)
+			return err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	r.mu.Lock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		r.setError(err)
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		r.setError(err)
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.status.NotAfter = cert.Leaf.NotAfter
+	r.ocspRefresh = time.Time{}
+	r.mu.Unlock()
+	certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	log.Infof("Loaded TLS certificate %s, expires %s", r.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	r.refreshOCSPStaple(time.Now())
+	return nil
+}
+
+// refreshOCSPStaple gets a new OCSP response for the certificate when the
+// current one is due for a refresh. On failure, it tries again after a few
+// minutes and the certificate is served without a new response.
+func (r *certReloader) refreshOCSPStaple(now time.Time) {
+	r.mu.Lock()
+	if !r.ocsp || now.Before(r.ocspRefresh) {
+		r.mu.Unlock()
+		return
+	}
+	cert := *r.cert
+	r.mu.Unlock()
+
+	staple, refresh, err := fetchOCSPStaple(&cert)
+	if err != nil {
+		log.Errorf("OCSP stapling: %v", err)
+		r.setError(err)
+		refresh = now.Add(5 * time.Minute)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ocspRefresh = refresh
+	if err == nil && r.cert.Leaf == cert.Leaf {
+		cert.OCSPStaple = staple
+		r.cert = &cert
+	}
+}
+
+func (r *certReloader) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.LastError = err.Error()
+	r.status.LastErrorTime = time.Now().UTC()
+}
+
+// checkExpiry logs a warning when the certificate expires soon.
+func (r *certReloader) checkExpiry(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	left := r.cert.Leaf.NotAfter.Sub(now)
+	if left > certExpiryWarning || now.Sub(r.lastWarning) < certExpiryWarningInterval {
+		return
+	}
+	r.lastWarning = now
+	log.Errorf("WARNING: TLS certificate %s expires in %s", r.certFile, left.Truncate(time.Minute))
+}
+
+func (r *certReloader) certStatus() CertStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// loop checks the certificate files periodically.
+func (r *certReloader) loop() {
+	for {
+		r.checkExpiry(time.Now())
+		time.Sleep(certReloadInterval)
+		if err := r.reload(); err != nil {
+			log.Errorf("Reloading TLS certificate: %v", err)
+		}
+		r.refreshOCSPStaple(time.Now())
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
@@ -0,0 +1,94 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleAddComment handles the /v2x/sync/addComment endpoint. It is used to
+// add an encrypted comment to an album.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - file: The file that the comment is about, if any.
+//   - content: The comment, encrypted by the client.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts("commentId", The ID of the new comment)
+func (s *Server) handleAddComment(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	id, err := s.db.AddComment(user, params["albumId"], params["file"], params["content"])
+	if err != nil {
+		log.Errorf("AddComment: %v", err)
+		if err == database.ErrCommentTooLarge {
+			return stingle.ResponseNOK().AddError("Comment too large")
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("You are not a member of the album")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("commentId", id)
+}
+
+// handleDeleteComment handles the /v2x/sync/deleteComment endpoint. It is
+// used to delete a comment from an album.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - commentId: The ID of the comment.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleDeleteComment(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.DeleteComment(user, params["albumId"], params["commentId"]); err != nil {
+		log.Errorf("DeleteComment: %v", err)
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("You are not allowed to delete this comment")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
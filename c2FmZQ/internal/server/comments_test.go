@@ -0,0 +1,178 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestComments(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if err := alice.shareAlbum(stingle.Album{
+		AlbumID:     "album",
+		Permissions: "1111",
+		Members:     fmt.Sprintf("%d,%d", alice.userID, bob.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", bob.userID): "Bob's Sharing Key",
+		},
+	}); err != nil {
+		t.Fatalf("alice.shareAlbum failed: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 2000
+	id, err := bob.addComment("album", "file1", "encrypted comment")
+	if err != nil {
+		t.Fatalf("bob.addComment failed: %v", err)
+	}
+	if _, err := carol.addComment("album", "", "not a member"); err == nil {
+		t.Error("carol.addComment succeeded unexpectedly")
+	}
+
+	comments, deletes, err := alice.getCommentUpdates(0)
+	if err != nil {
+		t.Fatalf("alice.getCommentUpdates failed: %v", err)
+	}
+	want := []interface{}{
+		map[string]interface{}{
+			"commentId":   id,
+			"albumId":     "album",
+			"file":        "file1",
+			"userId":      fmt.Sprintf("%d", bob.userID),
+			"content":     "encrypted comment",
+			"dateCreated": "2000",
+		},
+	}
+	if diff := compareLists(comments, want); diff != nil {
+		t.Errorf("Unexpected comments: %v", diff)
+	}
+	if len(deletes) != 0 {
+		t.Errorf("Unexpected comment deletes: %v", deletes)
+	}
+
+	database.CurrentTimeForTesting = 3000
+	if err := carol.deleteComment("album", id); err == nil {
+		t.Error("carol.deleteComment succeeded unexpectedly")
+	}
+	if err := alice.deleteComment("album", id); err != nil {
+		t.Fatalf("alice.deleteComment failed: %v", err)
+	}
+	comments, deletes, err = bob.getCommentUpdates(2000)
+	if err != nil {
+		t.Fatalf("bob.getCommentUpdates failed: %v", err)
+	}
+	if len(comments) != 0 {
+		t.Errorf("Unexpected comments: %v", comments)
+	}
+	want = []interface{}{
+		map[string]interface{}{
+			"file":    id,
+			"albumId": "album",
+			"type":    "7",
+			"date":    "3000",
+		},
+	}
+	if diff := compareLists(deletes, want); diff != nil {
+		t.Errorf("Unexpected comment deletes: %v", diff)
+	}
+
+	// Clients that don't ask for comments don't see the comment deletions.
+	sr, err := bob.getUpdates(0, 0, 0, 0, 0, 2000)
+	if err != nil {
+		t.Fatalf("bob.getUpdates failed: %v", err)
+	}
+	if d := sr.Parts.(map[string]interface{})["deletes"].([]interface{}); len(d) != 0 {
+		t.Errorf("Unexpected deletes: %v", d)
+	}
+	if _, ok := sr.Parts.(map[string]interface{})["comments"]; ok {
+		t.Error("Unexpected comments part")
+	}
+}
+
+func (c *client) addComment(albumID, file, content string) (string, error) {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["file"] = file
+	params["content"] = content
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/addComment", form)
+	if err != nil {
+		return "", err
+	}
+	if sr.Status != "ok" {
+		return "", sr
+	}
+	id, _ := sr.Parts.(map[string]interface{})["commentId"].(string)
+	return id, nil
+}
+
+func (c *client) deleteComment(albumID, commentID string) error {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["commentId"] = commentID
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/deleteComment", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
+func (c *client) getCommentUpdates(commentsST int64) (comments, deletes []interface{}, err error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("commentsST", fmt.Sprintf("%d", commentsST))
+
+	sr, err := c.sendRequest("/v2/sync/getUpdates", form)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, nil, sr
+	}
+	parts := sr.Parts.(map[string]interface{})
+	comments, _ = parts["comments"].([]interface{})
+	deletes, _ = parts["commentDeletes"].([]interface{})
+	return comments, deletes, nil
+}
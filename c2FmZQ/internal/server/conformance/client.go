@@ -0,0 +1,420 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package conformance
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// client is a minimal Stingle API client. It only sends what the apps send.
+type client struct {
+	baseURL string
+	hc      *http.Client
+
+	email           string
+	password        string
+	salt            string
+	secretKey       *stingle.SecretKey
+	serverPublicKey stingle.PublicKey
+	keyBundle       string
+	userID          int64
+	token           string
+}
+
+func newClient(baseURL string, hc *http.Client) *client {
+	return &client{
+		baseURL:   baseURL,
+		hc:        hc,
+		email:     "conformance-" + randomHex(8) + "@example.com",
+		password:  randomHex(16),
+		salt:      randomHex(16),
+		secretKey: stingle.MakeSecretKey(),
+	}
+}
+
+// newLoggedInClient returns a client with a new account that is deleted when
+// the test ends.
+func newLoggedInClient(t *testing.T, baseURL string, hc *http.Client) *client {
+	c := newClient(baseURL, hc)
+	if err := c.createAccount(); err != nil {
+		t.Fatalf("createAccount: %v", err)
+	}
+	if err := c.login(); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := c.deleteUser(); err != nil {
+			t.Errorf("deleteUser: %v", err)
+		}
+	})
+	return c
+}
+
+func (c *client) encodeParams(params map[string]string) string {
+	j, _ := json.Marshal(params)
+	return stingle.EncryptMessage(j, c.serverPublicKey, c.secretKey)
+}
+
+func (c *client) sendRequest(uri string, form url.Values) (*stingle.Response, error) {
+	resp, err := c.hc.PostForm(c.baseURL+uri, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status code %d", uri, resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	var sr stingle.Response
+	if err := dec.Decode(&sr); err != nil {
+		return nil, fmt.Errorf("%s: %w", uri, err)
+	}
+	if sr.Status != "ok" && sr.Status != "nok" {
+		return nil, fmt.Errorf("%s returned unexpected status %q", uri, sr.Status)
+	}
+	return &sr, nil
+}
+
+// sendOK is like sendRequest, but it also returns an error when the response
+// isn't ok.
+func (c *client) sendOK(uri string, form url.Values) (*stingle.Response, error) {
+	sr, err := c.sendRequest(uri, form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
+
+func (c *client) createAccount() error {
+	c.keyBundle = stingle.MakeKeyBundle(c.secretKey.PublicKey())
+	form := url.Values{}
+	form.Set("email", c.email)
+	form.Set("password", c.password)
+	form.Set("salt", c.salt)
+	form.Set("keyBundle", c.keyBundle)
+	form.Set("isBackup", "0")
+	_, err := c.sendOK("/v2/register/createAccount", form)
+	return err
+}
+
+func (c *client) preLogin() error {
+	form := url.Values{}
+	form.Set("email", c.email)
+	sr, err := c.sendOK("/v2/login/preLogin", form)
+	if err != nil {
+		return err
+	}
+	if want, got := c.salt, sr.Part("salt"); want != got {
+		return fmt.Errorf("unexpected salt: want %q, got %v", want, got)
+	}
+	return nil
+}
+
+func (c *client) login() error {
+	form := url.Values{}
+	form.Set("email", c.email)
+	form.Set("password", c.password)
+	sr, err := c.sendOK("/v2/login/login", form)
+	if err != nil {
+		return err
+	}
+	if want, got := c.keyBundle, sr.Part("keyBundle"); want != got {
+		return fmt.Errorf("unexpected keyBundle: want %q, got %v", want, got)
+	}
+	if want, got := "0", sr.Part("isKeyBackedUp"); want != got {
+		return fmt.Errorf("unexpected isKeyBackedUp: want %q, got %v", want, got)
+	}
+	if _, ok := sr.Part("homeFolder").(string); !ok {
+		return fmt.Errorf("invalid homeFolder: %#v", sr.Part("homeFolder"))
+	}
+	userID, _ := sr.Part("userId").(string)
+	if c.userID, err = strconv.ParseInt(userID, 10, 64); err != nil {
+		return fmt.Errorf("invalid userId: %#v", sr.Part("userId"))
+	}
+	pk, _ := sr.Part("serverPublicKey").(string)
+	b, err := base64.StdEncoding.DecodeString(pk)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid serverPublicKey: %#v", sr.Part("serverPublicKey"))
+	}
+	c.serverPublicKey = stingle.PublicKeyFromBytes(b)
+	token, ok := sr.Part("token").(string)
+	if !ok || token == "" {
+		return fmt.Errorf("invalid token: %#v", sr.Part("token"))
+	}
+	c.token = token
+	return nil
+}
+
+func (c *client) getServerPK() error {
+	form := url.Values{}
+	form.Set("token", c.token)
+	sr, err := c.sendOK("/v2/keys/getServerPK", form)
+	if err != nil {
+		return err
+	}
+	pk, _ := sr.Part("serverPK").(string)
+	if want := base64.StdEncoding.EncodeToString(c.serverPublicKey.ToBytes()); pk != want {
+		return fmt.Errorf("unexpected serverPK: want %q, got %#v", want, sr.Part("serverPK"))
+	}
+	return nil
+}
+
+func (c *client) checkKey() error {
+	form := url.Values{}
+	form.Set("email", c.email)
+	sr, err := c.sendOK("/v2/login/checkKey", form)
+	if err != nil {
+		return err
+	}
+	if want, got := "0", sr.Part("isKeyBackedUp"); want != got {
+		return fmt.Errorf("unexpected isKeyBackedUp: want %q, got %v", want, got)
+	}
+	challenge, _ := sr.Part("challenge").(string)
+	dec, err := c.secretKey.SealBoxOpenBase64(challenge)
+	if err != nil {
+		return fmt.Errorf("invalid challenge: %v", err)
+	}
+	if !bytes.HasPrefix(dec, []byte("validkey_")) {
+		return fmt.Errorf("challenge has unexpected prefix: %q", dec)
+	}
+	return nil
+}
+
+func (c *client) logout() error {
+	form := url.Values{}
+	form.Set("token", c.token)
+	_, err := c.sendOK("/v2/login/logout", form)
+	return err
+}
+
+func (c *client) deleteUser() error {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(map[string]string{"password": c.password}))
+	_, err := c.sendOK("/v2/login/deleteUser", form)
+	return err
+}
+
+func (c *client) getUpdates(filesST, trashST, albumsST, albumFilesST int64) (*updates, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("filesST", strconv.FormatInt(filesST, 10))
+	form.Set("trashST", strconv.FormatInt(trashST, 10))
+	form.Set("albumsST", strconv.FormatInt(albumsST, 10))
+	form.Set("albumFilesST", strconv.FormatInt(albumFilesST, 10))
+	form.Set("cntST", "0")
+	form.Set("delST", "0")
+	sr, err := c.sendOK("/v2/sync/getUpdates", form)
+	if err != nil {
+		return nil, err
+	}
+	var up updates
+	if up.files, err = fileMap(sr, "files"); err != nil {
+		return nil, err
+	}
+	if up.trash, err = fileMap(sr, "trash"); err != nil {
+		return nil, err
+	}
+	if up.albumFiles, err = fileMap(sr, "albumFiles"); err != nil {
+		return nil, err
+	}
+	var albums []stingle.Album
+	if err := decodePart(sr, "albums", &albums); err != nil {
+		return nil, err
+	}
+	up.albums = make(map[string]stingle.Album)
+	for _, a := range albums {
+		up.albums[a.AlbumID] = a
+	}
+	if err := decodePart(sr, "deletes", &up.deletes); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (c *client) uploadFile(file, set, albumID string, ts int64) error {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, f := range []struct {
+		name  string
+		thumb bool
+	}{{"file", false}, {"thumb", true}} {
+		pw, err := w.CreateFormFile(f.name, file)
+		if err != nil {
+			return err
+		}
+		io.WriteString(pw, fileContent(file, f.thumb))
+	}
+	for _, f := range []struct{ name, value string }{
+		{"headers", fileHeaders(file)},
+		{"set", set},
+		{"albumId", albumID},
+		{"dateCreated", strconv.FormatInt(ts, 10)},
+		{"dateModified", strconv.FormatInt(ts, 10)},
+		{"version", "1"},
+		{"token", c.token},
+	} {
+		if err := w.WriteField(f.name, f.value); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	resp, err := c.hc.Post(c.baseURL+"/v2/sync/upload", w.FormDataContentType(), &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload returned status code %d", resp.StatusCode)
+	}
+	var sr stingle.Response
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
+func (c *client) downloadPost(file, set string, thumb bool) (string, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("file", file)
+	form.Set("set", set)
+	form.Set("thumb", "0")
+	if thumb {
+		form.Set("thumb", "1")
+	}
+	resp, err := c.hc.PostForm(c.baseURL+"/v2/sync/download", form)
+	if err != nil {
+		return "", err
+	}
+	return readBody(resp)
+}
+
+func (c *client) downloadGet(u string) (string, error) {
+	resp, err := c.hc.Get(u)
+	if err != nil {
+		return "", err
+	}
+	return readBody(resp)
+}
+
+func readBody(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func (c *client) getURL(file, set string) (string, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("file", file)
+	form.Set("set", set)
+	sr, err := c.sendOK("/v2/sync/getUrl", form)
+	if err != nil {
+		return "", err
+	}
+	u, ok := sr.Part("url").(string)
+	if !ok || !strings.HasPrefix(u, "http") {
+		return "", fmt.Errorf("invalid url: %#v", sr.Part("url"))
+	}
+	return u, nil
+}
+
+// moveFile moves a file from setFrom to setTo. Files are copied, not moved,
+// when they go from the gallery to an album, like the apps do.
+func (c *client) moveFile(file, setFrom, setTo, albumIDFrom, albumIDTo string) error {
+	isMoving := "1"
+	if setFrom == stingle.GallerySet && setTo == stingle.AlbumSet {
+		isMoving = "0"
+	}
+	params := map[string]string{
+		"setFrom":     setFrom,
+		"setTo":       setTo,
+		"albumIdFrom": albumIDFrom,
+		"albumIdTo":   albumIDTo,
+		"isMoving":    isMoving,
+		"count":       "1",
+		"filename0":   file,
+		"headers0":    fileHeaders(file),
+	}
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+	_, err := c.sendOK("/v2/sync/moveFile", form)
+	return err
+}
+
+func (c *client) deleteFile(file string) error {
+	params := map[string]string{
+		"count":     "1",
+		"filename0": file,
+	}
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+	_, err := c.sendOK("/v2/sync/delete", form)
+	return err
+}
+
+func (c *client) addAlbum(albumID string, ts int64) error {
+	params := map[string]string{
+		"albumId":       albumID,
+		"dateCreated":   strconv.FormatInt(ts, 10),
+		"dateModified":  strconv.FormatInt(ts, 10),
+		"encPrivateKey": albumID + " encPrivateKey",
+		"metadata":      albumID + " metadata",
+		"publicKey":     albumID + " publicKey",
+	}
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+	_, err := c.sendOK("/v2/sync/addAlbum", form)
+	return err
+}
+
+func (c *client) deleteAlbum(albumID string) error {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(map[string]string{"albumId": albumID}))
+	_, err := c.sendOK("/v2/sync/deleteAlbum", form)
+	return err
+}
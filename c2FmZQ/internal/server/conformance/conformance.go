@@ -0,0 +1,335 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package conformance implements a black-box test suite for the Stingle API.
+// It only uses the HTTP endpoints that the Stingle Photos apps use, and it can
+// be pointed at any server, e.g. a fork of this server, or a proxy in front of
+// it, to validate that it remains compatible with the apps.
+//
+// The server must allow new accounts to be created, and they must be approved
+// automatically. Every account that the suite creates is deleted at the end.
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// Run runs the conformance suite against the server at baseURL, e.g.
+// https://example.com/ or https://example.com/c2/. If hc is nil,
+// http.DefaultClient is used.
+func Run(t *testing.T, baseURL string, hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	t.Run("Account", func(t *testing.T) { testAccount(t, baseURL, hc) })
+	t.Run("Files", func(t *testing.T) { testFiles(t, baseURL, hc) })
+	t.Run("Albums", func(t *testing.T) { testAlbums(t, baseURL, hc) })
+}
+
+func testAccount(t *testing.T, baseURL string, hc *http.Client) {
+	c := newClient(baseURL, hc)
+	if err := c.createAccount(); err != nil {
+		t.Fatalf("createAccount: %v", err)
+	}
+	if err := c.preLogin(); err != nil {
+		t.Fatalf("preLogin: %v", err)
+	}
+	if err := c.login(); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := c.getServerPK(); err != nil {
+		t.Errorf("getServerPK: %v", err)
+	}
+	if err := c.checkKey(); err != nil {
+		t.Errorf("checkKey: %v", err)
+	}
+
+	oldToken := c.token
+	if err := c.logout(); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	form := url.Values{}
+	form.Set("token", oldToken)
+	sr, err := c.sendRequest("/v2/sync/getUpdates", form)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if sr.Status != "nok" || sr.Part("logout") != "1" {
+		t.Errorf("getUpdates with revoked token: got %#v, want nok with logout=1", sr)
+	}
+
+	if err := c.login(); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := c.deleteUser(); err != nil {
+		t.Fatalf("deleteUser: %v", err)
+	}
+	if err := c.login(); err == nil {
+		t.Errorf("login succeeded after deleteUser")
+	}
+}
+
+func testFiles(t *testing.T, baseURL string, hc *http.Client) {
+	c := newLoggedInClient(t, baseURL, hc)
+	ts := nowInMS()
+
+	file := newFileName()
+	if err := c.uploadFile(file, stingle.GallerySet, "", ts); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	up, err := c.getUpdates(0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	f, ok := up.files[file]
+	if !ok {
+		t.Fatalf("getUpdates: file %q not in files: %v", file, up.files)
+	}
+	if want := (stingle.File{
+		File:         file,
+		Version:      "1",
+		DateCreated:  json.Number(fmt.Sprint(ts)),
+		DateModified: f.DateModified,
+		Headers:      fileHeaders(file),
+	}); !reflect.DeepEqual(f, want) {
+		t.Errorf("getUpdates: got %#v, want %#v", f, want)
+	}
+
+	for _, thumb := range []bool{false, true} {
+		got, err := c.downloadPost(file, stingle.GallerySet, thumb)
+		if err != nil {
+			t.Fatalf("download(thumb=%v): %v", thumb, err)
+		}
+		if want := fileContent(file, thumb); got != want {
+			t.Errorf("download(thumb=%v): got %q, want %q", thumb, got, want)
+		}
+	}
+	u, err := c.getURL(file, stingle.GallerySet)
+	if err != nil {
+		t.Fatalf("getUrl: %v", err)
+	}
+	got, err := c.downloadGet(u)
+	if err != nil {
+		t.Fatalf("GET %s: %v", u, err)
+	}
+	if want := fileContent(file, false); got != want {
+		t.Errorf("GET %s: got %q, want %q", u, got, want)
+	}
+
+	if err := c.moveFile(file, stingle.GallerySet, stingle.TrashSet, "", ""); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	up, err = c.getUpdates(0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if _, ok := up.files[file]; ok {
+		t.Errorf("getUpdates: file %q still in files after move to trash", file)
+	}
+	if _, ok := up.trash[file]; !ok {
+		t.Errorf("getUpdates: file %q not in trash: %v", file, up.trash)
+	}
+	if !up.hasDelete(stingle.DeleteEventGallery, file, "") {
+		t.Errorf("getUpdates: no gallery delete event for %q: %v", file, up.deletes)
+	}
+
+	if err := c.deleteFile(file); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	up, err = c.getUpdates(0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if _, ok := up.trash[file]; ok {
+		t.Errorf("getUpdates: file %q still in trash after delete", file)
+	}
+	if !up.hasDelete(stingle.DeleteEventTrashDelete, file, "") {
+		t.Errorf("getUpdates: no trash delete event for %q: %v", file, up.deletes)
+	}
+}
+
+func testAlbums(t *testing.T, baseURL string, hc *http.Client) {
+	c := newLoggedInClient(t, baseURL, hc)
+	ts := nowInMS()
+
+	albumID := newAlbumID()
+	if err := c.addAlbum(albumID, ts); err != nil {
+		t.Fatalf("addAlbum: %v", err)
+	}
+	file := newFileName()
+	if err := c.uploadFile(file, stingle.AlbumSet, albumID, ts); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	gallery := newFileName()
+	if err := c.uploadFile(gallery, stingle.GallerySet, "", ts); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := c.moveFile(gallery, stingle.GallerySet, stingle.AlbumSet, "", albumID); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+
+	up, err := c.getUpdates(0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	a, ok := up.albums[albumID]
+	if !ok {
+		t.Fatalf("getUpdates: album %q not in albums: %v", albumID, up.albums)
+	}
+	if a.EncPrivateKey != albumID+" encPrivateKey" || a.Metadata != albumID+" metadata" || a.PublicKey != albumID+" publicKey" {
+		t.Errorf("getUpdates: unexpected album: %#v", a)
+	}
+	if a.IsOwner != "1" {
+		t.Errorf("getUpdates: album isOwner = %q, want 1", a.IsOwner)
+	}
+	for _, f := range []string{file, gallery} {
+		af, ok := up.albumFiles[f]
+		if !ok {
+			t.Errorf("getUpdates: file %q not in albumFiles: %v", f, up.albumFiles)
+			continue
+		}
+		if af.AlbumID != albumID {
+			t.Errorf("getUpdates: file %q albumId = %q, want %q", f, af.AlbumID, albumID)
+		}
+	}
+	if _, ok := up.files[gallery]; !ok {
+		t.Errorf("getUpdates: copied file %q not in files anymore", gallery)
+	}
+	got, err := c.downloadPost(file, stingle.AlbumSet, false)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if want := fileContent(file, false); got != want {
+		t.Errorf("download: got %q, want %q", got, want)
+	}
+
+	if err := c.deleteAlbum(albumID); err != nil {
+		t.Fatalf("deleteAlbum: %v", err)
+	}
+	up, err = c.getUpdates(0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if _, ok := up.albums[albumID]; ok {
+		t.Errorf("getUpdates: album %q still in albums after deleteAlbum", albumID)
+	}
+	if !up.hasDelete(stingle.DeleteEventAlbum, "", albumID) {
+		t.Errorf("getUpdates: no album delete event for %q: %v", albumID, up.deletes)
+	}
+}
+
+func nowInMS() int64 {
+	return time.Now().UnixNano() / 1000000
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newFileName returns a random file name, like the ones the apps use.
+func newFileName() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(randomHex(16))) + ".sp"
+}
+
+// newAlbumID returns a random album ID, like the ones the apps use.
+func newAlbumID() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(randomHex(16)))
+}
+
+func fileHeaders(file string) string {
+	return file + " headers"
+}
+
+func fileContent(file string, thumb bool) string {
+	if thumb {
+		return "thumbnail of " + file
+	}
+	return "content of " + file
+}
+
+// updates is the decoded response of getUpdates, indexed by file name or
+// album ID.
+type updates struct {
+	files      map[string]stingle.File
+	trash      map[string]stingle.File
+	albumFiles map[string]stingle.File
+	albums     map[string]stingle.Album
+	deletes    []deleteEvent
+}
+
+type deleteEvent struct {
+	File    string      `json:"file"`
+	AlbumID string      `json:"albumId"`
+	Type    json.Number `json:"type"`
+}
+
+func (u updates) hasDelete(typ int, file, albumID string) bool {
+	for _, d := range u.deletes {
+		if d.Type.String() == fmt.Sprint(typ) && d.File == file && d.AlbumID == albumID {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePart re-encodes a part of the response to decode it into v.
+func decodePart(sr *stingle.Response, name string, v interface{}) error {
+	p := sr.Part(name)
+	if p == nil {
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func fileMap(sr *stingle.Response, name string) (map[string]stingle.File, error) {
+	var files []stingle.File
+	if err := decodePart(sr, name, &files); err != nil {
+		return nil, err
+	}
+	m := make(map[string]stingle.File)
+	for _, f := range files {
+		m[f.File] = f
+	}
+	return m, nil
+}
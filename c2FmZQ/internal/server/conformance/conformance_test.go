@@ -0,0 +1,51 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package conformance_test
+
+import (
+	"flag"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/server/conformance"
+)
+
+var serverURL = flag.String("url", "", "The URL of the server to test. When empty, a local server is started.\nExample: go test ./internal/server/conformance -args -url=https://example.com/")
+
+func TestConformance(t *testing.T) {
+	if *serverURL != "" {
+		conformance.Run(t, *serverURL, nil)
+		return
+	}
+	testdir := t.TempDir()
+	log.Record = t.Log
+	defer func() { log.Record = nil }()
+	db := database.New(filepath.Join(testdir, "data"), nil)
+	s := server.New(db, "", "", "")
+	s.AllowCreateAccount = true
+	s.AutoApproveNewAccounts = true
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	s.BaseURL = ts.URL + "/"
+
+	conformance.Run(t, ts.URL, ts.Client())
+}
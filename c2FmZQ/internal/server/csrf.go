@@ -0,0 +1,184 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// csrfCookie is the cookie that contains the CSRF token of the web app.
+	csrfCookie = "c2FmZQ-csrf"
+	// csrfHeader is the header where the web app sends the CSRF token.
+	csrfHeader = "X-c2FmZQ-CSRF"
+)
+
+// DefaultAllowedOrigins are the origins of the web apps that can connect to
+// any server, e.g. https://c2fmzq.org/pwa/.
+var DefaultAllowedOrigins = []string{"https://c2fmzq.org"}
+
+// ParseAllowedOrigins parses a comma-separated list of origins, e.g.
+// https://c2fmzq.org,https://example.com:8443. "*" allows all origins.
+func ParseAllowedOrigins(list string) ([]string, error) {
+	out := []string{}
+	for _, v := range splitList(list) {
+		if v == "*" {
+			out = append(out, v)
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("invalid origin %q", v)
+		}
+		out = append(out, u.Scheme+"://"+u.Host)
+	}
+	return out, nil
+}
+
+// requestOrigin returns the origin of a request sent by a browser, from the
+// Origin or the Referer header. It returns an empty string when the request
+// has neither, e.g. when it doesn't come from a browser.
+func requestOrigin(req *http.Request) string {
+	if o := req.Header.Get("Origin"); o != "" {
+		return o
+	}
+	if r := req.Header.Get("Referer"); r != "" {
+		u, err := url.Parse(r)
+		if err != nil || u.Host == "" {
+			return "null"
+		}
+		return u.Scheme + "://" + u.Host
+	}
+	return ""
+}
+
+// isSameOrigin returns whether a request sent by a browser comes from the web
+// app served by this server.
+func isSameOrigin(req *http.Request, origin string) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// validCSRFToken returns whether the request has a CSRF token that matches its
+// cookie. Another site can't read the cookie, so it can't send the token.
+func validCSRFToken(req *http.Request) bool {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(req.Header.Get(csrfHeader))) == 1
+}
+
+// originAllowed returns whether the web app at origin is allowed to send
+// requests to this server.
+func (s *Server) originAllowed(origin string) bool {
+	for _, o := range s.AllowedOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSRF wraps a handler to protect the requests sent by browsers against
+// cross-site request forgery. The requests that change anything must have a
+// CSRF token that matches its cookie, like the ones sent by the web app
+// served by this server, or come from one of the AllowedOrigins. The requests that
+// don't come from a browser, i.e. without Origin, Referer, or Sec-Fetch-Site
+// headers, aren't affected.
+func (s *Server) checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+			next.ServeHTTP(w, req)
+			return
+		}
+		origin := requestOrigin(req)
+		if origin == "" && req.Header.Get("Sec-Fetch-Site") == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if validCSRFToken(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if isSameOrigin(req, origin) {
+			log.Infof("CSRF: %s %s with invalid token denied", req.Method, req.URL.Path)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !s.originAllowed(origin) {
+			log.Infof("CSRF: %s %s from origin %q denied", req.Method, req.URL.Path, origin)
+			http.Error(w, "Cross-origin request denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// handleCSRFToken handles the /v2x/config/csrf endpoint. It returns the CSRF
+// token that the web app must send in the X-c2FmZQ-CSRF header, and sets the
+// matching cookie.
+//
+// Arguments:
+//   - req: The http request.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(csrfToken, The CSRF token)
+func (s *Server) handleCSRFToken(w http.ResponseWriter, req *http.Request) {
+	var tok string
+	if c, err := req.Cookie(csrfCookie); err == nil && len(c.Value) == 43 {
+		tok = c.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Errorf("rand.Read: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		tok = base64.RawURLEncoding.EncodeToString(b)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    tok,
+		Path:     s.pathPrefix + "/",
+		Secure:   req.TLS != nil || strings.HasPrefix(s.BaseURL, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	if err := stingle.ResponseOK().AddPart("csrfToken", tok).Send(w); err != nil {
+		log.Errorf("Send: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+)
+
+func TestParseAllowedOrigins(t *testing.T) {
+	got, err := server.ParseAllowedOrigins("https://c2fmzq.org/, http://example.com:8080, *")
+	if err != nil {
+		t.Fatalf("ParseAllowedOrigins: %v", err)
+	}
+	if want := []string{"https://c2fmzq.org", "http://example.com:8080", "*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAllowedOrigins() = %q, want %q", got, want)
+	}
+	for _, v := range []string{"c2fmzq.org", "ftp://c2fmzq.org", "https://c2fmzq.org/pwa/"} {
+		if _, err := server.ParseAllowedOrigins(v); err == nil {
+			t.Errorf("ParseAllowedOrigins(%q) didn't fail", v)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+	s := server.New(db, "", "", "")
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/v2x/config/csrf")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	var sr struct {
+		Parts struct {
+			CSRFToken string `json:"csrfToken"`
+		} `json:"parts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	resp.Body.Close()
+	token := sr.Parts.CSRFToken
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "c2FmZQ-csrf" {
+			cookie = c
+		}
+	}
+	if token == "" || cookie == nil || cookie.Value != token || !cookie.HttpOnly {
+		t.Fatalf("Unexpected token %q, cookie %+v", token, cookie)
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		headers map[string]string
+		cookie  bool
+		want    int
+	}{
+		{"not a browser", nil, false, http.StatusOK},
+		{"same origin with token", map[string]string{"Origin": srv.URL, "X-c2FmZQ-CSRF": token}, true, http.StatusOK},
+		{"same origin without token", map[string]string{"Origin": srv.URL}, true, http.StatusForbidden},
+		{"same origin without cookie", map[string]string{"Origin": srv.URL, "X-c2FmZQ-CSRF": token}, false, http.StatusForbidden},
+		{"same origin with wrong token", map[string]string{"Sec-Fetch-Site": "same-origin", "X-c2FmZQ-CSRF": "foo"}, true, http.StatusForbidden},
+		{"null origin with token", map[string]string{"Origin": "null", "Sec-Fetch-Site": "same-origin", "X-c2FmZQ-CSRF": token}, true, http.StatusOK},
+		{"referer from same origin", map[string]string{"Referer": srv.URL + "/foo"}, true, http.StatusForbidden},
+		{"allowed origin", map[string]string{"Origin": "https://c2fmzq.org", "Sec-Fetch-Site": "cross-site"}, false, http.StatusOK},
+		{"other origin", map[string]string{"Origin": "https://evil.example.com", "Sec-Fetch-Site": "cross-site"}, true, http.StatusForbidden},
+		{"other referer", map[string]string{"Referer": "https://evil.example.com/"}, true, http.StatusForbidden},
+		{"same site", map[string]string{"Origin": "https://c2fmzq.org", "Sec-Fetch-Site": "same-site"}, false, http.StatusOK},
+	} {
+		req, err := http.NewRequest("POST", srv.URL+"/v2/login/preLogin", strings.NewReader(url.Values{"email": {"alice@"}}.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if tc.cookie {
+			req.AddCookie(cookie)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.StatusCode; got != tc.want {
+			t.Errorf("%s: status code = %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+
+	s.AllowedOrigins = nil
+	req, err := http.NewRequest("POST", srv.URL+"/v2/login/preLogin", strings.NewReader(url.Values{"email": {"alice@"}}.Encode()))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://c2fmzq.org")
+	resp, err = srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("No allowed origins: status code = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,141 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// The delta of a new version of a file is a sequence of operations that
+// assemble the new content from the content of an existing file, the base,
+// and new data. Each operation starts with a one-byte opcode.
+const (
+	// deltaCopy is followed by an offset and a length, both big endian
+	// uint64. The bytes are copied from the base file.
+	deltaCopy = 'C'
+	// deltaData is followed by a length, big endian uint64, and that many
+	// bytes of new data.
+	deltaData = 'D'
+)
+
+var errInvalidDelta = errors.New("invalid delta")
+
+// handleUploadDelta handles the /v2x/sync/uploadDelta endpoint. It is used to
+// upload a new version of an existing file without re-uploading the parts
+// of the encrypted content that didn't change. The client encrypts the new
+// version with the same file key, and reuses the encrypted chunks whose
+// plaintext is unchanged. Only the header and the new chunks are sent.
+//
+// The request is the same as /v2/sync/upload, except that the "file" part is
+// replaced with a "delta" part, and two extra form arguments identify the
+// base file. The token and the base file must come before the delta.
+//
+// Form arguments (in addition to those of /v2/sync/upload):
+//   - baseSet: The set of the base file.
+//   - baseFile: The name of the base file, which the user must have access to.
+//   - delta: The delta, see deltaCopy and deltaData.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(fileDigest, thumbDigest, mediumDigest), like /v2/sync/upload. The
+//     fileDigest is the digest of the whole new version.
+func (s *Server) handleUploadDelta(w http.ResponseWriter, req *http.Request) {
+	s.handleFileUpload(w, req, s.applyDelta)
+}
+
+// applyDelta reads a delta and writes the assembled file content to w.
+func (s *Server) applyDelta(ctx context.Context, up *upload, delta io.Reader, w io.Writer) (int64, error) {
+	if up.token == "" || up.baseFile == "" {
+		return 0, fmt.Errorf("%w: token and baseFile must come before the delta", errInvalidDelta)
+	}
+	if up.FileSpec.StoreFile != "" {
+		return 0, fmt.Errorf("%w: request has both file and delta", errInvalidDelta)
+	}
+	_, user, err := s.checkToken(up.token, "session")
+	if err != nil {
+		return 0, err
+	}
+	base, err := s.db.DownloadFile(user, up.baseSet, up.baseFile, false)
+	if err != nil {
+		return 0, err
+	}
+	defer base.Close()
+	baseSize, err := base.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(delta)
+	var n, copied int64
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		var src io.Reader
+		var size int64
+		switch op {
+		case deltaCopy:
+			var args [2]uint64
+			if err := binary.Read(r, binary.BigEndian, &args); err != nil {
+				return n, err
+			}
+			off, sz := args[0], args[1]
+			if off > uint64(baseSize) || sz > uint64(baseSize)-off {
+				return n, fmt.Errorf("%w: copy [%d,+%d] out of range", errInvalidDelta, off, sz)
+			}
+			// A delta should never need more than a full copy of
+			// the base file.
+			if copied += int64(sz); copied > baseSize {
+				return n, fmt.Errorf("%w: copies exceed the base file size", errInvalidDelta)
+			}
+			if _, err := base.Seek(int64(off), io.SeekStart); err != nil {
+				return n, err
+			}
+			src, size = base, int64(sz)
+		case deltaData:
+			var sz uint64
+			if err := binary.Read(r, binary.BigEndian, &sz); err != nil {
+				return n, err
+			}
+			if sz > 1<<40 {
+				return n, fmt.Errorf("%w: data size %d", errInvalidDelta, sz)
+			}
+			src, size = r, int64(sz)
+		default:
+			return n, fmt.Errorf("%w: unexpected opcode %q", errInvalidDelta, op)
+		}
+		nn, err := s.copyWithCtx(ctx, w, io.LimitReader(src, size))
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		if nn != size {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+}
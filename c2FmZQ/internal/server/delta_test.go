@@ -0,0 +1,130 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestUploadDelta(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if _, err := c.uploadFile("file1", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+	// The content of file1 is: Content of "file" filename "file1"
+	var delta bytes.Buffer
+	deltaCopy(&delta, 0, 11)
+	deltaData(&delta, "new")
+	deltaCopy(&delta, 17, 17)
+
+	if code, err := c.uploadDelta("file2", "file1", delta.Bytes()); err != nil || code != http.StatusOK {
+		t.Fatalf("c.uploadDelta() = %d, %v", code, err)
+	}
+	got, err := c.downloadPost("file2", stingle.GallerySet, "0")
+	if err != nil {
+		t.Fatalf("c.downloadPost failed: %v", err)
+	}
+	if want := `Content of new filename "file1"`; got != want {
+		t.Errorf("Unexpected content. Got %q, want %q", got, want)
+	}
+
+	var outOfRange bytes.Buffer
+	deltaCopy(&outOfRange, 30, 100)
+	var tooManyCopies bytes.Buffer
+	for i := 0; i < 3; i++ {
+		deltaCopy(&tooManyCopies, 0, 24)
+	}
+	for _, tc := range []struct {
+		name, base string
+		delta      []byte
+	}{
+		{"no base", "nope", delta.Bytes()},
+		{"out of range", "file1", outOfRange.Bytes()},
+		{"too many copies", "file1", tooManyCopies.Bytes()},
+		{"bad opcode", "file1", []byte("X")},
+	} {
+		if code, err := c.uploadDelta("file3", tc.base, tc.delta); err != nil || code != http.StatusBadRequest {
+			t.Errorf("%s: c.uploadDelta() = %d, %v, want %d", tc.name, code, err, http.StatusBadRequest)
+		}
+	}
+}
+
+func deltaCopy(buf *bytes.Buffer, off, size uint64) {
+	buf.WriteByte('C')
+	binary.Write(buf, binary.BigEndian, off)
+	binary.Write(buf, binary.BigEndian, size)
+}
+
+func deltaData(buf *bytes.Buffer, data string) {
+	buf.WriteByte('D')
+	binary.Write(buf, binary.BigEndian, uint64(len(data)))
+	buf.WriteString(data)
+}
+
+func (c *client) uploadDelta(filename, base string, delta []byte) (int, error) {
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, f := range []struct{ name, value string }{
+		{"token", c.token},
+		{"baseSet", stingle.GallerySet},
+		{"baseFile", base},
+		{"headers", filename + " headers"},
+		{"set", stingle.GallerySet},
+		{"dateCreated", "1000"},
+		{"dateModified", "1000"},
+		{"version", "1"},
+	} {
+		if err := w.WriteField(f.name, f.value); err != nil {
+			return 0, err
+		}
+	}
+	pw, err := w.CreateFormFile("thumb", filename)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(pw, "Content of %q filename %q", "thumb", filename)
+	if pw, err = w.CreateFormFile("delta", filename); err != nil {
+		return 0, err
+	}
+	pw.Write(delta)
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	resp, err := hc.Post("http://unix/v2x/sync/uploadDelta", w.FormDataContentType(), &buf)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,143 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// How often the album digests are checked.
+const digestInterval = 5 * time.Minute
+
+// handleAlbumDigest handles the /v2x/sync/albumDigest endpoint. It is used to
+// subscribe to a periodic digest of the changes in a shared album, instead of
+// a notification for each change.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album. When empty, the subscriptions are only
+//     returned.
+//   - period: The digest period in seconds, or 0 to unsubscribe.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(digests, list of the user's digest subscriptions)
+func (s *Server) handleAlbumDigest(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if albumID := params["albumId"]; albumID != "" {
+		period := time.Duration(parseInt(params["period"], -1)) * time.Second
+		if err := s.db.SetAlbumDigest(user, albumID, period); err != nil {
+			log.Errorf("SetAlbumDigest: %v", err)
+			if err == database.ErrInvalidDigestPeriod {
+				return stingle.ResponseNOK().AddError("Invalid digest period")
+			}
+			if errors.Is(err, os.ErrPermission) {
+				return stingle.ResponseNOK().AddError("You are not a member of the album")
+			}
+			return stingle.ResponseNOK()
+		}
+	}
+	digests, err := s.db.AlbumDigests(user)
+	if err != nil {
+		log.Errorf("AlbumDigests: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("digests", digests)
+}
+
+// digestLoop sends the album digests when they are due.
+func (s *Server) digestLoop() {
+	for {
+		if err := s.sendDigests(); err != nil {
+			log.Errorf("sendDigests: %v", err)
+		}
+		time.Sleep(digestInterval)
+	}
+}
+
+// sendDigests sends the album digests that are due. They are sent with a push
+// notification when the user has enabled them, or by email otherwise.
+func (s *Server) sendDigests() error {
+	digests, err := s.db.DueDigests()
+	if err != nil {
+		return err
+	}
+	byUser := make(map[int64][]database.AlbumDigest)
+	for _, dg := range digests {
+		user, err := s.db.UserByID(dg.UserID)
+		if err != nil {
+			log.Errorf("UserByID(%d): %v", dg.UserID, err)
+			continue
+		}
+		if user.PushConfig != nil && len(user.PushConfig.Endpoints) > 0 {
+			if err := s.db.SendDigestNotification(dg); err == nil {
+				continue
+			}
+		}
+		byUser[dg.UserID] = append(byUser[dg.UserID], dg)
+	}
+	if s.Mailer == nil {
+		return nil
+	}
+	for uid, dd := range byUser {
+		user, err := s.db.UserByID(uid)
+		if err != nil {
+			log.Errorf("UserByID(%d): %v", uid, err)
+			continue
+		}
+		if err := s.Mailer.Send([]string{user.Email}, "c2FmZQ: changes in your shared albums", formatDigest(dd)); err != nil {
+			log.Errorf("Mailer.Send: %v", err)
+		}
+	}
+	return nil
+}
+
+// formatDigest formats the body of a digest email. The album names are
+// encrypted, so only the number of changes can be included.
+func formatDigest(digests []database.AlbumDigest) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "There are changes in %d of your shared albums:\n\n", len(digests))
+	for _, dg := range digests {
+		var changes []string
+		if dg.NewContent > 0 {
+			changes = append(changes, fmt.Sprintf("%d update(s) with new files", dg.NewContent))
+		}
+		if dg.NewMembers > 0 {
+			changes = append(changes, fmt.Sprintf("%d update(s) with new members", dg.NewMembers))
+		}
+		fmt.Fprintf(&sb, "  - %s\n", strings.Join(changes, ", "))
+	}
+	return sb.String()
+}
@@ -0,0 +1,299 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleSetRecoveryContact handles the /v2x/escrow/setContact endpoint. It is
+// used to designate the recovery contact who can recover the user's albums if
+// the user loses access to all their devices. The contact has to accept
+// before the album keys can be added to the escrow.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - email: The email address of the recovery contact. When empty, the
+//     recovery contact and the escrowed keys are removed.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleSetRecoveryContact(user database.User, req *http.Request) *stingle.Response {
+	if user.NeedApproval {
+		return stingle.ResponseNOK().
+			AddError("Account is not approved yet")
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.SetRecoveryContact(user, params["email"]); err != nil {
+		log.Errorf("SetRecoveryContact: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleAnswerRecoveryContact handles the /v2x/escrow/answer endpoint. It is
+// used by a recovery contact to accept or decline.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - ownerId: The user ID of the owner of the escrow.
+//   - accept: "1" to accept, "0" to decline.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleAnswerRecoveryContact(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	ownerID, err := strconv.ParseInt(params["ownerId"], 10, 64)
+	if err != nil {
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.AnswerRecoveryContact(user, ownerID, params["accept"] == "1"); err != nil {
+		log.Errorf("AnswerRecoveryContact: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleAddEscrowKeys handles the /v2x/escrow/addKeys endpoint. It is used to
+// add the private keys of the user's albums to the escrow, encrypted by the
+// client for the recovery contact.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - keys: A JSON-encoded map of AlbumID:Key. The Key is the encPrivateKey
+//     of the album for the recovery contact. An empty key removes the album
+//     from the escrow.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleAddEscrowKeys(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(params["keys"]), &keys); err != nil {
+		log.Errorf("json.Unmarshal keys failed: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.AddEscrowKeys(user, keys); err != nil {
+		log.Errorf("AddEscrowKeys: %v", err)
+		if errors.Is(err, database.ErrNoRecoveryContact) {
+			return stingle.ResponseNOK().AddError("The recovery contact hasn't accepted yet")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleSetInactivityTrigger handles the /v2x/escrow/setInactivity endpoint.
+// It is used by the owner of an escrow to let the recovery contact recover the
+// albums if the owner doesn't log in for a number of months, despite the
+// reminders.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - months: The number of months of inactivity, or 0 to disable.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleSetInactivityTrigger(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.SetInactivityTrigger(user, int(parseInt(params["months"], -1))); err != nil {
+		log.Errorf("SetInactivityTrigger: %v", err)
+		if errors.Is(err, database.ErrInvalidInactivityPeriod) {
+			return stingle.ResponseNOK().AddError("Invalid number of months")
+		}
+		if errors.Is(err, database.ErrNoRecoveryContact) {
+			return stingle.ResponseNOK().AddError("The recovery contact hasn't accepted yet")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleRecoveryStatus handles the /v2x/escrow/status endpoint. It returns
+// the user's recovery contact, and the users for whom the user is the
+// recovery contact.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(escrow, the user's escrow, if any)
+//     Part(contactFor, the escrows where the user is the recovery contact)
+func (s *Server) handleRecoveryStatus(user database.User, req *http.Request) *stingle.Response {
+	owned, contactFor, err := s.db.RecoveryStatus(user, s.RecoveryDelay)
+	if err != nil {
+		log.Errorf("RecoveryStatus: %v", err)
+		return stingle.ResponseNOK()
+	}
+	resp := stingle.ResponseOK().AddPart("contactFor", contactFor)
+	if owned != nil {
+		resp.AddPart("escrow", owned)
+	}
+	return resp
+}
+
+// handleRequestRecovery handles the /v2x/escrow/recover endpoint. It is used
+// by a recovery contact to recover the albums of the owner of an escrow. The
+// first request notifies the owner, who can deny it. When the request isn't
+// denied within the recovery delay, the next request shares the albums with
+// the recovery contact.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - ownerId: The user ID of the owner of the escrow.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(recovered, the number of albums that were shared)
+//     Part(availableAt, when the albums can be recovered, in milliseconds)
+func (s *Server) handleRequestRecovery(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	ownerID, err := strconv.ParseInt(params["ownerId"], 10, 64)
+	if err != nil {
+		return stingle.ResponseNOK()
+	}
+	n, availableAt, err := s.db.RequestRecovery(user, ownerID, s.RecoveryDelay)
+	if err != nil {
+		log.Errorf("RequestRecovery: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("recovered", n).
+		AddPart("availableAt", availableAt)
+}
+
+// handleDenyRecovery handles the /v2x/escrow/deny endpoint. It is used by the
+// owner of an escrow to deny a pending recovery request.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleDenyRecovery(user database.User, req *http.Request) *stingle.Response {
+	if err := s.db.DenyRecovery(user); err != nil {
+		log.Errorf("DenyRecovery: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// How often the inactivity triggers are checked.
+const inactivityCheckInterval = time.Hour
+
+// inactivityLoop sends the reminders to the inactive owners of escrows, and
+// tells the recovery contacts when the inactivity trigger fires.
+func (s *Server) inactivityLoop() {
+	for {
+		if err := s.checkInactivity(); err != nil {
+			log.Errorf("checkInactivity: %v", err)
+		}
+		time.Sleep(inactivityCheckInterval)
+	}
+}
+
+// checkInactivity checks the inactivity triggers, and sends the notices by
+// email. The push notifications are sent by the database.
+func (s *Server) checkInactivity() error {
+	notices, err := s.db.CheckInactivity()
+	if err != nil {
+		return err
+	}
+	if s.Mailer == nil {
+		return nil
+	}
+	for _, n := range notices {
+		owner, err := s.db.UserByID(n.OwnerID)
+		if err != nil {
+			log.Errorf("UserByID(%d): %v", n.OwnerID, err)
+			continue
+		}
+		contact, err := s.db.UserByID(n.ContactID)
+		if err != nil {
+			log.Errorf("UserByID(%d): %v", n.ContactID, err)
+			continue
+		}
+		deadline := time.UnixMilli(n.Deadline).UTC().Format("2006-01-02 15:04 MST")
+		if n.Triggered {
+			body := fmt.Sprintf("%s hasn't logged in for a long time, and didn't answer any of the reminders.\n\n"+
+				"You can now recover the albums that they entrusted to you as their recovery contact.\n", owner.Email)
+			if err := s.Mailer.Send([]string{contact.Email}, "c2FmZQ: albums available for recovery", body); err != nil {
+				log.Errorf("Mailer.Send: %v", err)
+			}
+			continue
+		}
+		body := fmt.Sprintf("You haven't logged in for a long time. This is reminder %d.\n\n"+
+			"If you don't log in before %s, %s, your recovery contact, will be able to recover your albums.\n", n.Reminder, deadline, contact.Email)
+		if err := s.Mailer.Send([]string{owner.Email}, "c2FmZQ: inactive account reminder", body); err != nil {
+			log.Errorf("Mailer.Send: %v", err)
+		}
+	}
+	return nil
+}
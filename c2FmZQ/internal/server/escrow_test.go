@@ -0,0 +1,138 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestAlbumEscrow(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.RecoveryDelay = time.Second
+	})
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if _, err := alice.escrowRequest("setContact", map[string]string{"email": "bob"}); err != nil {
+		t.Fatalf("setContact failed: %v", err)
+	}
+	keys := map[string]string{"album": "Bob's Escrow Key"}
+	if _, err := alice.addEscrowKeys(keys); err == nil {
+		t.Error("alice.addEscrowKeys succeeded before bob accepted")
+	}
+	if _, err := carol.escrowRequest("answer", map[string]string{"ownerId": fmt.Sprint(alice.userID), "accept": "1"}); err == nil {
+		t.Error("carol accepted unexpectedly")
+	}
+	if _, err := bob.escrowRequest("answer", map[string]string{"ownerId": fmt.Sprint(alice.userID), "accept": "1"}); err != nil {
+		t.Fatalf("bob answer failed: %v", err)
+	}
+	if _, err := alice.addEscrowKeys(keys); err != nil {
+		t.Fatalf("alice.addEscrowKeys failed: %v", err)
+	}
+
+	sr, err := alice.escrowRequest("status", nil)
+	if err != nil {
+		t.Fatalf("alice status failed: %v", err)
+	}
+	escrow, _ := sr.Part("escrow").(map[string]interface{})
+	if escrow["contactEmail"] != "bob" || escrow["accepted"] != true || fmt.Sprint(escrow["albums"]) != "[album]" {
+		t.Errorf("Unexpected escrow: %v", escrow)
+	}
+
+	// The first request starts the delay, and alice can deny it.
+	if n, at, err := bob.requestRecovery(alice.userID); err != nil || n != 0 || at != 2000 {
+		t.Fatalf("bob.requestRecovery() = %d, %d, %v", n, at, err)
+	}
+	if _, err := alice.escrowRequest("deny", nil); err != nil {
+		t.Fatalf("alice deny failed: %v", err)
+	}
+	if _, err := alice.escrowRequest("deny", nil); err == nil {
+		t.Error("alice deny succeeded twice")
+	}
+	database.CurrentTimeForTesting = 5000
+	if n, at, err := bob.requestRecovery(alice.userID); err != nil || n != 0 || at != 6000 {
+		t.Fatalf("bob.requestRecovery() = %d, %d, %v", n, at, err)
+	}
+	if err := bob.setSeen("album", "marker"); err == nil {
+		t.Error("bob is a member before the recovery delay")
+	}
+	if _, _, err := carol.requestRecovery(alice.userID); err == nil {
+		t.Error("carol.requestRecovery succeeded unexpectedly")
+	}
+
+	database.CurrentTimeForTesting = 6000
+	if n, _, err := bob.requestRecovery(alice.userID); err != nil || n != 1 {
+		t.Fatalf("bob.requestRecovery() = %d, %v", n, err)
+	}
+	if err := bob.setSeen("album", "marker"); err != nil {
+		t.Errorf("bob is not a member after recovery: %v", err)
+	}
+}
+
+func (c *client) escrowRequest(endpoint string, params map[string]string) (*stingle.Response, error) {
+	if params == nil {
+		params = make(map[string]string)
+	}
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/escrow/"+endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
+
+func (c *client) addEscrowKeys(keys map[string]string) (*stingle.Response, error) {
+	j, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.escrowRequest("addKeys", map[string]string{"keys": string(j)})
+}
+
+func (c *client) requestRecovery(ownerID int64) (int64, int64, error) {
+	sr, err := c.escrowRequest("recover", map[string]string{"ownerId": fmt.Sprint(ownerID)})
+	if err != nil {
+		return 0, 0, err
+	}
+	n, _ := sr.Part("recovered").(json.Number).Int64()
+	at, _ := sr.Part("availableAt").(json.Number).Int64()
+	return n, at, nil
+}
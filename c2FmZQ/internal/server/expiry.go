@@ -0,0 +1,100 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// How often the albums that are scheduled to be unshared are checked.
+	albumExpiryInterval = time.Minute
+	// How often the files in the trash are checked for expiration.
+	trashExpiryInterval = time.Hour
+)
+
+// handleAlbumUnshareDate handles the /v2x/sync/albumUnshareDate endpoint. It
+// is used by the owner of a shared album to schedule the album to be unshared
+// automatically.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - date: The time when the album is unshared, in milliseconds, or 0 to
+//     cancel.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleAlbumUnshareDate(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.SetAlbumUnshareDate(user, params["albumId"], parseInt(params["date"], -1)); err != nil {
+		log.Errorf("SetAlbumUnshareDate: %v", err)
+		if err == database.ErrInvalidUnshareDate {
+			return stingle.ResponseNOK().AddError("Invalid date")
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("You are not the owner of the album")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// albumExpiryLoop unshares the albums when their unshare date passes.
+func (s *Server) albumExpiryLoop() {
+	for {
+		n, err := s.db.UnshareExpiredAlbums()
+		if err != nil {
+			log.Errorf("UnshareExpiredAlbums: %v", err)
+		}
+		if n > 0 {
+			log.Infof("Unshared %d expired album(s)", n)
+		}
+		time.Sleep(albumExpiryInterval)
+	}
+}
+
+// trashExpiryLoop deletes the files that have been in the trash for longer
+// than the retention period.
+func (s *Server) trashExpiryLoop() {
+	for {
+		n, err := s.db.ExpireTrash()
+		if err != nil {
+			log.Errorf("ExpireTrash: %v", err)
+		}
+		if n > 0 {
+			log.Infof("Deleted %d expired file(s) from the trash", n)
+		}
+		time.Sleep(trashExpiryInterval)
+	}
+}
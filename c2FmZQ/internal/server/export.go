@@ -0,0 +1,209 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/timing"
+)
+
+// exportInfo is the content of export.json in the account export.
+type exportInfo struct {
+	UserID int64  `json:"userId"`
+	Email  string `json:"email"`
+	Date   int64  `json:"date"`
+}
+
+// exportedFile is an entry of files.json in the account export.
+type exportedFile struct {
+	stingle.File
+	Set string `json:"set"`
+}
+
+// exportBlobPath returns the path of a file's content in the account export.
+func exportBlobPath(dir string, f exportedFile) string {
+	if f.Set == stingle.AlbumSet {
+		return path.Join(dir, f.Set, f.AlbumID, f.File.File)
+	}
+	return path.Join(dir, f.Set, f.File.File)
+}
+
+// handleExportAccount handles the /v2x/config/exportAccount endpoint. It
+// streams a tar archive with all the user's data, as stored on the server,
+// i.e. encrypted:
+//
+//	export.json     The user ID, the email address, and the export time.
+//	contacts.json   The user's contacts.
+//	albums.json     The user's albums, with their encrypted metadata.
+//	files.json      The files in the gallery, the trash, and the albums,
+//	                with their encrypted headers.
+//	blobs/SET/[ALBUMID/]FILE   The encrypted content of each file.
+//	thumbs/SET/[ALBUMID/]FILE  The encrypted thumbnail of each file.
+//
+// Arguments:
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//
+// Returns:
+//   - The tar archive is streamed.
+func (s *Server) handleExportAccount(w http.ResponseWriter, req *http.Request) {
+	uri := s.uriLabel(req)
+	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, uri))
+	defer timer.ObserveDuration()
+	req.ParseForm()
+
+	timers := timing.FromContext(req.Context())
+	done := timers.Start("auth")
+	_, user, err := s.checkToken(req.PostFormValue("token"), "session")
+	done()
+	if err != nil {
+		log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+		s.logAuthFailure(req, authFailureToken, "")
+		stingle.ResponseOK().AddPart("logout", "1").Send(w)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	log.Infof("%s %s (UserID:%d)", req.Method, req.URL, user.UserID)
+	user = user.WithContext(req.Context())
+
+	contacts, err := s.db.ContactUpdates(user, 0)
+	if err != nil {
+		log.Errorf("ContactUpdates: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	albums, err := s.db.AlbumUpdates(user, 0)
+	if err != nil {
+		log.Errorf("AlbumUpdates: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	var files []exportedFile
+	for _, set := range []string{stingle.GallerySet, stingle.TrashSet, stingle.AlbumSet} {
+		ff, err := s.db.FileUpdates(user, set, 0)
+		if err != nil {
+			log.Errorf("FileUpdates: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+			return
+		}
+		for _, f := range ff {
+			files = append(files, exportedFile{File: f, Set: set})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="c2FmZQ-export.tar"`)
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	var n int64
+	err = func() error {
+		for _, e := range []struct {
+			name string
+			v    interface{}
+		}{
+			{"export.json", exportInfo{UserID: user.UserID, Email: user.Email, Date: now.UnixMilli()}},
+			{"contacts.json", contacts},
+			{"albums.json", albums},
+			{"files.json", files},
+		} {
+			b, err := json.MarshalIndent(e.v, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0600, Size: int64(len(b)), ModTime: now}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(b); err != nil {
+				return err
+			}
+			n += int64(len(b))
+		}
+		done := timers.Start("blob")
+		defer done()
+		for _, f := range files {
+			for _, thumb := range []bool{false, true} {
+				name := exportBlobPath("blobs", f)
+				if thumb {
+					name = exportBlobPath("thumbs", f)
+				}
+				nn, err := s.exportBlob(req, tw, user, f, name, thumb)
+				n += nn
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return tw.Close()
+	}()
+	s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesDownloaded: n})
+	if err != nil {
+		log.Errorf("Export UserID:%d: %v", user.UserID, err)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	reqStatus.WithLabelValues(req.Method, uri, "ok").Inc()
+}
+
+// exportBlob adds the content, or the thumbnail, of a file to the account
+// export. The files whose content can't be opened are logged and skipped.
+func (s *Server) exportBlob(req *http.Request, tw *tar.Writer, user database.User, f exportedFile, name string, thumb bool) (int64, error) {
+	r, err := s.db.DownloadFile(user, f.Set, f.File.File, thumb)
+	if err != nil {
+		log.Errorf("Export UserID:%d %s: %v", user.UserID, name, err)
+		return 0, nil
+	}
+	defer r.Close()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.UnixMilli(parseInt(f.DateModified.String(), 0)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	n, err := s.copyWithCtx(req.Context(), tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("%s: short copy", name)
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleFamilyAccounts handles the /v2x/family/accounts endpoint. It is used
+// by parents to see and change the quota of the limited accounts that they
+// manage.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - changes: A JSON-encoded list of {userId, quota, quotaUnit} to apply
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts("accounts", encrypted list of limited accounts)
+func (s *Server) handleFamilyAccounts(user database.User, req *http.Request) *stingle.Response {
+	if user.Limited != nil {
+		return stingle.ResponseNOK()
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	accounts, err := s.db.LimitedAccounts(user.UserID)
+	if err != nil {
+		log.Errorf("LimitedAccounts: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if v, ok := params["changes"]; ok {
+		var changes []database.AdminUser
+		if err := json.Unmarshal([]byte(v), &changes); err != nil {
+			log.Errorf("json.Unmarshal: %v", err)
+			return stingle.ResponseNOK()
+		}
+		for _, c := range changes {
+			var account *database.User
+			for i := range accounts {
+				if accounts[i].UserID == c.UserID {
+					account = &accounts[i]
+				}
+			}
+			if account == nil {
+				return stingle.ResponseNOK().AddError("Not your account")
+			}
+			if c.Quota == nil || *c.Quota < 0 {
+				return stingle.ResponseNOK().AddError("Invalid quota")
+			}
+			quota := &database.Limit{Value: *c.Quota}
+			if c.QuotaUnit != nil {
+				quota.Unit = *c.QuotaUnit
+			}
+			if err := s.db.SetLimitedAccount(account.UserID, account.Limited, quota); err != nil {
+				log.Errorf("SetLimitedAccount: %v", err)
+				return stingle.ResponseNOK()
+			}
+		}
+	}
+	out := []database.AdminUser{}
+	for _, a := range accounts {
+		limits, err := s.db.UserLimits(a.UserID)
+		if err != nil {
+			log.Errorf("UserLimits: %v", err)
+			return stingle.ResponseNOK()
+		}
+		out = append(out, limits)
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("accounts", user.PublicKey.SealBox(b))
+}
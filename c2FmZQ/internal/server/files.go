@@ -19,12 +19,15 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,11 +36,14 @@ import (
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 	"c2FmZQ/internal/stingle/token"
+	"c2FmZQ/internal/timing"
 )
 
 // handleUpload handles the /v2/sync/upload endpoint. It is used to upload
 // new files. The incoming request is a multipart/form-data with two files:
-// one for the image or video, and one for the thumbnail.
+// one for the image or video, and one for the thumbnail. A third, optional,
+// file is a medium-resolution variant of the image, e.g. one that fits a
+// screen, that the clients can download before the full image.
 //
 // Arguments:
 //  - req: The http request.
@@ -50,29 +56,82 @@ import (
 //  - dateCreated: A timestamp in milliseconds.
 //  - dateModified: A timestamp in milliseconds.
 //  - version: The file format version (opaque to the server).
+//  - uploadId: The ID of a complete resumable upload, used instead of the
+//              file part. See handleUploadChunk.
+//
+// The files are streamed to disk as they are received. When the token, set,
+// and albumId come before the files, the upload is authenticated and checked
+// against the quota before the content is written.
+//
+// Form files
+//  - file: The encrypted image or video.
+//  - thumb: The encrypted thumbnail.
+//  - medium: The encrypted medium-resolution variant (optional).
 //
 // Returns:
 //  - stingle.Response("ok")
+//      Part(fileDigest, thumbDigest, mediumDigest): The BLAKE2b-256 digests,
+//      hex encoded, of the content as it was stored. The client compares them
+//      with the digests of what it sent to detect corruption. mediumDigest
+//      is present only with a medium variant.
 func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
-	up, err := s.receiveUpload("uploads", req)
+	s.handleFileUpload(w, req, nil)
+}
+
+// handleFileUpload receives a new file and adds it to a file set. The file
+// content is either uploaded in full, or as a delta when applyDelta is set.
+func (s *Server) handleFileUpload(w http.ResponseWriter, req *http.Request, applyDelta applyDeltaFunc) {
+	up, err := s.receiveUpload("uploads", req, applyDelta)
 	s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
+	if err == errTooManyUploads {
+		http.Error(w, "Too many parallel uploads", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, errInvalidDelta) || errors.Is(err, errInvalidImport) || errors.Is(err, os.ErrNotExist) {
+		log.Errorf("handleUpload: receiveUpload failed: %v", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrReadOnly) {
+		http.Error(w, "Read-only", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, database.ErrQuotaExceeded) {
+		http.Error(w, "Quota exceeded", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Errorf("handleUpload: receiveUpload failed: %v", err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
+	done := timing.FromContext(req.Context()).Start("auth")
 	_, user, err := s.checkToken(up.token, "session")
-	if err != nil || !user.ValidTokens[token.Hash(up.token)] {
+	done()
+	if err != nil {
 		log.Errorf("handleUpload: checkToken failed: %v", err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 	log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
+	user = user.WithContext(req.Context())
 	if user.NeedApproval {
 		http.Error(w, "Account is not approved yet", http.StatusForbidden)
 		return
 	}
 
+	if up.uploadID != "" {
+		if err := s.finishResumableUpload(user, up); err != nil {
+			log.Errorf("handleUpload: finishResumableUpload failed: %v", err)
+			if err == database.ErrUploadNotFound || err == database.ErrUploadSize {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if up.set == stingle.AlbumSet {
 		albumSpec, err := s.db.Album(user, up.albumID)
 		if err != nil {
@@ -87,16 +146,70 @@ func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	variantsSize := up.FileSpec.StoreThumbSize + up.FileSpec.StoreMediumSize
+	bytesUploaded := up.FileSpec.StoreFileSize + variantsSize
+	if applyDelta != nil {
+		bytesUploaded = up.deltaSize + variantsSize
+	}
+	if up.uploadID != "" {
+		// The chunks were already counted by handleUploadChunk.
+		bytesUploaded = variantsSize
+	}
+	unlock, err := s.lockUser(req.Context(), user.UserID)
+	if err != nil {
+		log.Errorf("lockUser(%d): %v", user.UserID, err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
 	if err := s.db.AddFile(user, up.FileSpec, up.name, up.set, up.albumID); err != nil {
 		log.Errorf("AddFile: %v", err)
 		if err == database.ErrQuotaExceeded {
 			http.Error(w, "Quota exceeded", http.StatusForbidden)
 			return
 		}
+		if err == database.ErrInvalidID {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, database.ErrReadOnly) {
+			http.Error(w, "Read-only", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
-	stingle.ResponseOK().Send(w)
+	// Only the uploads that were actually stored are counted.
+	s.db.RecordUsage(user.UserID, database.DailyUsage{
+		Requests:      1,
+		BytesUploaded: bytesUploaded,
+	})
+	if up.importID != "" {
+		session, err := s.db.UpdateImport(user, up.importID, func(is *database.ImportSession) {
+			is.DoneFiles++
+			is.DoneBytes += up.FileSpec.StoreFileSize + up.FileSpec.StoreThumbSize + up.FileSpec.StoreMediumSize
+		})
+		if err != nil {
+			log.Errorf("UpdateImport: %v", err)
+		} else {
+			s.jobs.update(user.UserID, importJobStatus(session))
+		}
+	}
+	resp := stingle.ResponseOK()
+	done = timing.FromContext(req.Context()).Start("digest")
+	digests, err := s.db.StoredFileDigests(user, up.set, up.albumID, up.name)
+	done()
+	if err != nil {
+		// The file was added. The client can't verify it, but it doesn't
+		// need to upload it again.
+		log.Errorf("StoredFileDigests: %v", err)
+	} else {
+		resp.AddPart("fileDigest", digests.File).AddPart("thumbDigest", digests.Thumb)
+		if digests.Medium != "" {
+			resp.AddPart("mediumDigest", digests.Medium)
+		}
+	}
+	resp.Send(w)
 }
 
 // handleMoveFile handles the /v2/sync/moveFile endpoint. It is used to move
@@ -186,6 +299,9 @@ func (s *Server) handleMoveFile(user database.User, req *http.Request) *stingle.
 		if err == database.ErrQuotaExceeded {
 			return stingle.ResponseNOK().AddError("Quota exceeded")
 		}
+		if err == database.ErrInvalidID {
+			return stingle.ResponseNOK().AddError("Invalid file name or set")
+		}
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -211,10 +327,18 @@ func (s *Server) handleEmptyTrash(user database.User, req *http.Request) *stingl
 		log.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
-	if err := s.db.EmptyTrash(user, parseInt(params["time"], 0)); err != nil {
+	t := parseInt(params["time"], 0)
+	if err := s.db.EmptyTrash(user, t); err != nil {
 		log.Errorf("EmptyTrash: %v", err)
+		if err == database.ErrLimitedAccount {
+			return stingle.ResponseNOK().AddError("Limited accounts can't delete files permanently")
+		}
+		if err == database.ErrOnHold {
+			return stingle.ResponseNOK().AddError("This account is on hold. Nothing can be deleted.")
+		}
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityEmptyTrash, fmt.Sprintf("files added until %s", time.UnixMilli(t).UTC().Format(time.RFC3339)))
 	return stingle.ResponseOK()
 }
 
@@ -245,8 +369,15 @@ func (s *Server) handleDelete(user database.User, req *http.Request) *stingle.Re
 	}
 	if err := s.db.DeleteFiles(user, files); err != nil {
 		log.Errorf("DeleteFiles: %v", err)
+		if err == database.ErrLimitedAccount {
+			return stingle.ResponseNOK().AddError("Limited accounts can't delete files permanently")
+		}
+		if err == database.ErrOnHold {
+			return stingle.ResponseNOK().AddError("This account is on hold. Nothing can be deleted.")
+		}
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(user.UserID, database.ActivityDeleteFiles, fmt.Sprintf("%d file(s)", len(files)))
 	return stingle.ResponseOK()
 }
 
@@ -261,64 +392,142 @@ func (s *Server) handleDelete(user database.User, req *http.Request) *stingle.Re
 //  - file: The filename to download.
 //  - set: The file set where the file is.
 //  - thumb: "1" if downloading the thumbnail, "0" otherwise.
+//  - variant: The variant to download: original, thumb, or medium. It
+//             overrides thumb. The files without a medium-resolution variant
+//             return 404, and the client should download the original.
 //
 // Returns:
 //   - The content of the file is streamed.
 func (s *Server) handleDownload(w http.ResponseWriter, req *http.Request) {
-	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, req.URL.String()))
+	uri := s.uriLabel(req)
+	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, uri))
 	defer timer.ObserveDuration()
 	req.ParseForm()
 
+	timers := timing.FromContext(req.Context())
+	done := timers.Start("auth")
 	_, user, err := s.checkToken(req.PostFormValue("token"), "session")
+	done()
 	if err != nil {
 		log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+		s.logAuthFailure(req, authFailureToken, "")
 		stingle.ResponseOK().AddPart("logout", "1").Send(w)
-		reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
 		return
 	}
 	log.Infof("%s %s (UserID:%d)", req.Method, req.URL, user.UserID)
+	user = user.WithContext(req.Context())
 	filename := req.PostFormValue("file")
 	set := req.PostFormValue("set")
-	thumb := req.PostFormValue("thumb") == "1"
+	variant, err := downloadVariant(req.PostFormValue("variant"), req.PostFormValue("thumb") == "1")
+	if err != nil {
+		log.Errorf("%s %s: %v", req.Method, req.URL, err)
+		w.WriteHeader(http.StatusBadRequest)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
 
-	f, err := s.db.DownloadFile(user, set, filename, thumb)
+	f, err := s.db.DownloadFileVariant(user, set, filename, variant)
 	if err != nil {
 		log.Errorf("DownloadFile failed: %v", err)
 		w.WriteHeader(http.StatusNotFound)
-		reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	if setCacheHeaders(w, req, f.ETag, variant != database.VariantOriginal) {
+		f.Close()
+		s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1})
+		reqStatus.WithLabelValues(req.Method, uri, "ok").Inc()
 		return
 	}
-	if _, err := s.copyWithCtx(req.Context(), w, f); err != nil {
+	done = timers.Start("blob")
+	n, err := s.copyWithCtx(req.Context(), w, f)
+	done()
+	if err != nil {
 		log.Debugf("Copy failed: %v", err)
 	}
+	s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesDownloaded: n})
 	if err := f.Close(); err != nil {
 		log.Errorf("Close failed: %v", err)
 	}
-	reqStatus.WithLabelValues(req.Method, req.URL.String(), "ok").Inc()
+	reqStatus.WithLabelValues(req.Method, uri, "ok").Inc()
 }
 
-// tryToHandleRange implements minimal support for RFC 7233, section 3.1: Range.
-// Streaming videos doesn't work very well without it.
-func (s *Server) tryToHandleRange(w http.ResponseWriter, rangeHdr string, f io.ReadSeekCloser) {
+// downloadVariant returns the variant of a file to download, from the variant
+// and thumb arguments of a request.
+func downloadVariant(variant string, thumb bool) (database.Variant, error) {
+	if variant != "" {
+		return database.ParseVariant(variant)
+	}
+	if thumb {
+		return database.VariantThumb, nil
+	}
+	return database.VariantOriginal, nil
+}
+
+// setCacheHeaders sets the HTTP caching headers of a file download. The
+// content of a file never changes, so thumbnails and other variants can be
+// cached by the client indefinitely. Returns true when the client already has
+// the content, in which case the response is complete.
+func setCacheHeaders(w http.ResponseWriter, req *http.Request, etag string, immutable bool) bool {
+	w.Header().Set("ETag", etag)
+	if immutable {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	}
+	for _, t := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "W/"); t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// tryToHandleRange implements minimal support for RFC 7233, section 3.1: Range,
+// and section 3.2: If-Range. Streaming videos and resuming interrupted
+// downloads don't work very well without it. It returns the reader that the
+// response body should be copied from, or nil if the response is complete.
+func (s *Server) tryToHandleRange(w http.ResponseWriter, req *http.Request, etag string, f io.ReadSeekCloser) io.Reader {
+	rangeHdr := req.Header.Get("Range")
+	if rangeHdr == "" {
+		return f
+	}
 	log.Debugf("Requested range: %s", rangeHdr)
-	m := regexp.MustCompile(`^bytes=(\d+)-$`).FindStringSubmatch(rangeHdr)
-	if len(m) != 2 {
-		return
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		log.Debugf("If-Range %s doesn't match %s", ifRange, etag)
+		return f
+	}
+	m := regexp.MustCompile(`^bytes=(\d+)-(\d*)$`).FindStringSubmatch(rangeHdr)
+	if len(m) != 3 {
+		return f
 	}
 	size, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		log.Errorf("f.Seek(0, SeekEnd) failed: %v", err)
-		return
+		return f
 	}
 	offset := parseInt(m[1], 0)
+	end := size - 1
+	if m[2] != "" {
+		if e := parseInt(m[2], end); e < end {
+			end = e
+		}
+	}
+	if offset >= size || offset > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
 	if _, err := f.Seek(offset, io.SeekStart); err != nil {
 		log.Errorf("f.Seek(%d, SeekStart) failed: %v", offset, err)
-		return
+		return f
 	}
-	cr := fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size)
+	cr := fmt.Sprintf("bytes %d-%d/%d", offset, end, size)
 	log.Debugf("Sending %s", cr)
 	w.Header().Set("Content-Range", cr)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", end-offset+1))
 	w.WriteHeader(http.StatusPartialContent)
+	return io.LimitReader(f, end-offset+1)
 }
 
 // handleTokenDownload handles the /v2/download endpoint. It is used to
@@ -335,39 +544,67 @@ func (s *Server) tryToHandleRange(w http.ResponseWriter, rangeHdr string, f io.R
 //   - The content of the file is streamed.
 func (s *Server) handleTokenDownload(w http.ResponseWriter, req *http.Request) {
 	baseURI, tok := path.Split(req.URL.RequestURI())
-	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, baseURI))
+	uri := s.uriLabel(req)
+	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, uri))
 	defer timer.ObserveDuration()
 
 	token, user, err := s.checkToken(tok, "download")
 	if err != nil {
 		log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+		s.logAuthFailure(req, authFailureToken, "")
 		w.WriteHeader(http.StatusUnauthorized)
-		reqStatus.WithLabelValues(req.Method, baseURI, "nok").Inc()
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
 		return
 	}
 	log.Infof("%s %s %s[...] (UserID:%d)", req.Proto, req.Method, baseURI, user.UserID)
 
-	f, err := s.db.DownloadFile(user, token.Set, token.File, token.Thumb)
+	variant, err := downloadVariant(token.Variant, token.Thumb)
 	if err != nil {
-		log.Errorf("DownloadFile(%q, %q, %q, %v) failed: %v", user.Email, token.Set, token.File, token.Thumb, err)
+		log.Errorf("%s %s[...]: %v", req.Method, baseURI, err)
+		w.WriteHeader(http.StatusBadRequest)
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
+		return
+	}
+	f, err := s.db.DownloadFileVariant(user, token.Set, token.File, variant)
+	if err != nil {
+		log.Errorf("DownloadFile(%q, %q, %q, %v) failed: %v", user.Email, token.Set, token.File, variant, err)
 		w.WriteHeader(http.StatusNotFound)
-		reqStatus.WithLabelValues(req.Method, baseURI, "nok").Inc()
+		reqStatus.WithLabelValues(req.Method, uri, "nok").Inc()
 		return
 	}
-	if r := req.Header.Get("Range"); r != "" {
-		s.tryToHandleRange(w, r, f)
+	if setCacheHeaders(w, req, f.ETag, variant != database.VariantOriginal) {
+		f.Close()
+		s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1})
+		reqStatus.WithLabelValues(req.Method, uri, "ok").Inc()
+		return
 	}
-	if _, err := s.copyWithCtx(req.Context(), w, f); err != nil {
-		log.Debugf("Copy failed: %v", err)
+	w.Header().Set("Accept-Ranges", "bytes")
+	var n int64
+	if r := s.tryToHandleRange(w, req, f.ETag, f); r != nil {
+		if n, err = s.copyWithCtx(req.Context(), w, r); err != nil {
+			log.Debugf("Copy failed: %v", err)
+		}
 	}
+	s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1, BytesDownloaded: n})
 	if err := f.Close(); err != nil {
 		log.Errorf("Close failed: %v", err)
 	}
-	reqStatus.WithLabelValues(req.Method, baseURI, "ok").Inc()
+	reqStatus.WithLabelValues(req.Method, uri, "ok").Inc()
+}
+
+// copyBufPool contains the buffers used by copyWithCtx. They are reused so
+// that many concurrent uploads and downloads don't each allocate their own.
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 64*1024)
+		return &b
+	},
 }
 
 func (s *Server) copyWithCtx(ctx context.Context, dst io.Writer, src io.Reader) (n int64, err error) {
-	buf := make([]byte, 4096)
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	buf := *bufp
 	for {
 		select {
 		case <-ctx.Done():
@@ -403,23 +640,24 @@ func (s *Server) copyWithCtx(ctx context.Context, dst io.Writer, src io.Reader)
 }
 
 // makeDownloadURL creates a signed URL to download a file.
-func (s *Server) makeDownloadURL(user database.User, host, file, set string, isThumb bool) (string, error) {
+func (s *Server) makeDownloadURL(user database.User, host, file, set string, variant database.Variant) (string, error) {
 	tk, err := s.db.DecryptTokenKey(user.TokenKey)
 	if err != nil {
 		return "", err
 	}
 	defer tk.Wipe()
-	tok := token.Mint(
-		tk,
-		token.Token{
-			Scope:   "download",
-			Subject: user.UserID,
-			Set:     set,
-			File:    file,
-			Thumb:   isThumb,
-		},
-		12*time.Hour,
-	)
+	t := token.Token{
+		Scope:   "download",
+		Subject: user.UserID,
+		Set:     set,
+		File:    file,
+		Thumb:   variant == database.VariantThumb,
+		Epoch:   user.TokenEpoch,
+	}
+	if variant == database.VariantMedium {
+		t.Variant = string(variant)
+	}
+	tok := token.Mint(tk, t, 12*time.Hour)
 	b := s.BaseURL
 	if b == "" {
 		b = fmt.Sprintf("https://%s%s/", host, s.pathPrefix)
@@ -436,6 +674,8 @@ func (s *Server) makeDownloadURL(user database.User, host, file, set string, isT
 //
 // Form arguments
 //  - is_thumb: "1" if downloading thumbnails, "0" otherwise.
+//  - variant: The variant to download: original, thumb, or medium. It
+//             overrides is_thumb.
 //  - files[<int>][filename]: The filenames to download.
 //  - files[<int>][set]: The file sets where the files are.
 //
@@ -443,7 +683,10 @@ func (s *Server) makeDownloadURL(user database.User, host, file, set string, isT
 //   - StringleResponse(ok).
 //        Parts("urls", list of signed urls)
 func (s *Server) handleGetDownloadUrls(user database.User, req *http.Request) *stingle.Response {
-	isThumb := req.PostFormValue("is_thumb") == "1"
+	variant, err := downloadVariant(req.PostFormValue("variant"), req.PostFormValue("is_thumb") == "1")
+	if err != nil {
+		return stingle.ResponseNOK().AddError("Invalid variant")
+	}
 	urls := make(map[string]string)
 	re := regexp.MustCompile(`^files\[\d+\]\[filename\]$`)
 
@@ -452,7 +695,7 @@ func (s *Server) handleGetDownloadUrls(user database.User, req *http.Request) *s
 			continue
 		}
 		set := req.PostFormValue(strings.Replace(k, "filename", "set", 1))
-		url, err := s.makeDownloadURL(user, req.Host, v[0], set, isThumb)
+		url, err := s.makeDownloadURL(user, req.Host, v[0], set, variant)
 		if err != nil {
 			return stingle.ResponseNOK()
 		}
@@ -471,12 +714,19 @@ func (s *Server) handleGetDownloadUrls(user database.User, req *http.Request) *s
 // Form arguments
 //  - file: The filename to download.
 //  - set: The file set where the file is.
+//  - thumb: "1" if downloading the thumbnail, "0" otherwise.
+//  - variant: The variant to download: original, thumb, or medium. It
+//             overrides thumb.
 //
 // Returns:
 //   - StringleResponse(ok).
 //        Parts("url", signed url)
 func (s *Server) handleGetURL(user database.User, req *http.Request) *stingle.Response {
-	url, err := s.makeDownloadURL(user, req.Host, req.PostFormValue("file"), req.PostFormValue("set"), req.PostFormValue("thumb") == "1")
+	variant, err := downloadVariant(req.PostFormValue("variant"), req.PostFormValue("thumb") == "1")
+	if err != nil {
+		return stingle.ResponseNOK().AddError("Invalid variant")
+	}
+	url, err := s.makeDownloadURL(user, req.Host, req.PostFormValue("file"), req.PostFormValue("set"), variant)
 	if err != nil {
 		return stingle.ResponseNOK()
 	}
@@ -18,11 +18,18 @@
 package server_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -131,6 +138,135 @@ func TestUploadDownload(t *testing.T) {
 	}
 }
 
+func TestThumbnailCaching(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if _, err := c.uploadFile("filename1", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+	urls, err := c.getDownloadURLs([]string{"filename1"}, []string{stingle.GallerySet}, true)
+	if err != nil {
+		t.Fatalf("c.getDownloadURLs failed: %v", err)
+	}
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	var etag string
+	for i := 0; i < 2; i++ {
+		resp, err := hc.Get(urls["filename1"])
+		if err != nil {
+			t.Fatalf("hc.Get failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll failed: %v", err)
+		}
+		if want, got := `Content of "thumb" filename "filename1"`, string(body); want != got {
+			t.Errorf("Unexpected body: Want %q, got %q", want, got)
+		}
+		if want, got := "private, max-age=31536000, immutable", resp.Header.Get("Cache-Control"); want != got {
+			t.Errorf("Unexpected Cache-Control: Want %q, got %q", want, got)
+		}
+		if etag == "" {
+			etag = resp.Header.Get("ETag")
+		}
+		if want, got := etag, resp.Header.Get("ETag"); want == "" || want != got {
+			t.Errorf("Unexpected ETag: Want %q, got %q", want, got)
+		}
+	}
+
+	req, err := http.NewRequest("GET", urls["filename1"], nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest failed: %v", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatalf("hc.Do failed: %v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusNotModified, resp.StatusCode; want != got {
+		t.Errorf("Unexpected status code: Want %d, got %d", want, got)
+	}
+}
+
+func TestRangeDownload(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if _, err := c.uploadFile("filename1", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+	url, err := c.getURL("filename1", stingle.GallerySet)
+	if err != nil {
+		t.Fatalf("c.getURL failed: %v", err)
+	}
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	content := `Content of "file" filename "filename1"`
+	size := len(content)
+	resp, err := hc.Get(url)
+	if err != nil {
+		t.Fatalf("hc.Get failed: %v", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if want, got := "bytes", resp.Header.Get("Accept-Ranges"); want != got {
+		t.Errorf("Unexpected Accept-Ranges: Want %q, got %q", want, got)
+	}
+
+	for _, tc := range []struct {
+		rangeHdr, ifRange string
+		status            int
+		contentRange      string
+		body              string
+	}{
+		{"bytes=8-", "", http.StatusPartialContent, fmt.Sprintf("bytes 8-%d/%d", size-1, size), content[8:]},
+		{"bytes=8-13", "", http.StatusPartialContent, fmt.Sprintf("bytes 8-13/%d", size), content[8:14]},
+		{"bytes=8-", etag, http.StatusPartialContent, fmt.Sprintf("bytes 8-%d/%d", size-1, size), content[8:]},
+		{"bytes=8-", `"other"`, http.StatusOK, "", content},
+		{fmt.Sprintf("bytes=%d-", size), "", http.StatusRequestedRangeNotSatisfiable, fmt.Sprintf("bytes */%d", size), ""},
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest failed: %v", err)
+		}
+		req.Header.Set("Range", tc.rangeHdr)
+		if tc.ifRange != "" {
+			req.Header.Set("If-Range", tc.ifRange)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatalf("hc.Do failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll failed: %v", err)
+		}
+		if want, got := tc.status, resp.StatusCode; want != got {
+			t.Errorf("[%s %s] Unexpected status code: Want %d, got %d", tc.rangeHdr, tc.ifRange, want, got)
+		}
+		if want, got := tc.contentRange, resp.Header.Get("Content-Range"); want != got {
+			t.Errorf("[%s %s] Unexpected Content-Range: Want %q, got %q", tc.rangeHdr, tc.ifRange, want, got)
+		}
+		if want, got := tc.body, string(body); want != got {
+			t.Errorf("[%s %s] Unexpected body: Want %q, got %q", tc.rangeHdr, tc.ifRange, want, got)
+		}
+	}
+}
+
 func TestEmptyTrash(t *testing.T) {
 	sock, shutdown := startServer(t)
 	defer shutdown()
@@ -442,3 +578,229 @@ func (c *client) moveFiles(p database.MoveFileParams) error {
 	}
 	return nil
 }
+
+func TestUploadConcurrencyLimit(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.MaxConcurrentRequests = 1
+		s.MaxConcurrentUploads = 1
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	// Start a slow upload. It holds the only upload slot until the end of
+	// its body is sent.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	uploadDone := make(chan error)
+	go func() {
+		hc := http.Client{Transport: &http.Transport{DialContext: dialer{sock: sock}.DialContext}}
+		resp, err := hc.Post("http://unix/v2/sync/upload", mw.FormDataContentType(), pr)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status code %d", resp.StatusCode)
+			}
+		}
+		uploadDone <- err
+	}()
+	fw, err := mw.CreateFormFile("file", "filename1")
+	if err != nil {
+		t.Fatalf("CreateFormFile failed: %v", err)
+	}
+	// This write is larger than the socket buffers. It only returns when the
+	// upload handler is running.
+	if _, err := fw.Write(make([]byte, 4<<20)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Other requests aren't blocked by the upload.
+	updatesDone := make(chan error)
+	go func() {
+		_, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+		updatesDone <- err
+	}()
+	select {
+	case err := <-updatesDone:
+		if err != nil {
+			t.Errorf("getUpdates failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("getUpdates blocked by upload")
+	}
+
+	if fw, err = mw.CreateFormFile("thumb", "filename1"); err != nil {
+		t.Fatalf("CreateFormFile failed: %v", err)
+	}
+	fmt.Fprint(fw, "thumbnail")
+	for _, f := range []struct{ name, value string }{
+		{"headers", "filename1 headers"},
+		{"set", stingle.GallerySet},
+		{"dateCreated", "1000"},
+		{"dateModified", "1000"},
+		{"version", "1"},
+		{"token", c.token},
+	} {
+		if err := mw.WriteField(f.name, f.value); err != nil {
+			t.Fatalf("WriteField failed: %v", err)
+		}
+	}
+	mw.Close()
+	pw.Close()
+	if err := <-uploadDone; err != nil {
+		t.Errorf("upload failed: %v", err)
+	}
+}
+
+func TestMediumVariant(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if _, err := c.uploadFileParts("filename1", stingle.GallerySet, "", 1000, []string{"file", "thumb", "medium"}); err != nil {
+		t.Fatalf("c.uploadFileParts failed: %v", err)
+	}
+	if _, err := c.uploadFile("filename2", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+
+	sr, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	hasMedium := make(map[string]json.Number)
+	for _, f := range sr.Part("files").([]interface{}) {
+		m := f.(map[string]interface{})
+		v, _ := m["hasMedium"].(json.Number)
+		hasMedium[m["file"].(string)] = v
+	}
+	if want, got := json.Number("1"), hasMedium["filename1"]; want != got {
+		t.Errorf("Unexpected hasMedium for filename1: Want %q, got %q", want, got)
+	}
+	if want, got := json.Number(""), hasMedium["filename2"]; want != got {
+		t.Errorf("Unexpected hasMedium for filename2: Want %q, got %q", want, got)
+	}
+
+	body, err := c.downloadVariant("filename1", stingle.GallerySet, "medium")
+	if err != nil {
+		t.Fatalf("c.downloadVariant failed: %v", err)
+	}
+	if want, got := `Content of "medium" filename "filename1"`, body; want != got {
+		t.Errorf("Unexpected body: Want %q, got %q", want, got)
+	}
+	if _, err := c.downloadVariant("filename2", stingle.GallerySet, "medium"); err == nil {
+		t.Error("c.downloadVariant(filename2, medium) did not fail")
+	}
+	if _, err := c.downloadVariant("filename1", stingle.GallerySet, "huge"); err == nil {
+		t.Error("c.downloadVariant(filename1, huge) did not fail")
+	}
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("file", "filename1")
+	form.Set("set", stingle.GallerySet)
+	form.Set("variant", "medium")
+	if sr, err = c.sendRequest("/v2/sync/getUrl", form); err != nil {
+		t.Fatalf("c.sendRequest failed: %v", err)
+	}
+	u, ok := sr.Part("url").(string)
+	if !ok {
+		t.Fatalf("server did not return a url: %v", sr.Part("url"))
+	}
+	if body, err = c.downloadGet(u); err != nil {
+		t.Fatalf("c.downloadGet(%q) failed: %v", u, err)
+	}
+	if want, got := `Content of "medium" filename "filename1"`, body; want != got {
+		t.Errorf("Unexpected body: Want %q, got %q", want, got)
+	}
+}
+
+func (c *client) downloadVariant(file, set, variant string) (string, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("file", file)
+	form.Set("set", set)
+	form.Set("variant", variant)
+
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := hc.PostForm("http://unix/v2/sync/download", form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request returned status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func TestUploadTokenFirst(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if code, err := c.uploadTokenFirst("filename1", "invalid"); err != nil || code == http.StatusOK {
+		t.Errorf("c.uploadTokenFirst(invalid) = %d, %v", code, err)
+	}
+	if code, err := c.uploadTokenFirst("filename1", c.token); err != nil || code != http.StatusOK {
+		t.Fatalf("c.uploadTokenFirst = %d, %v", code, err)
+	}
+	body, err := c.downloadPost("filename1", stingle.GallerySet, "0")
+	if err != nil {
+		t.Fatalf("c.downloadPost failed: %v", err)
+	}
+	if want, got := `Content of "file" filename "filename1"`, body; want != got {
+		t.Errorf("c.downloadPost returned unexpected body: Want %q, got %q", want, got)
+	}
+}
+
+// uploadTokenFirst uploads a file to the gallery, with the token and the other
+// form fields before the files, and returns the response's status code.
+func (c *client) uploadTokenFirst(filename, tok string) (int, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, f := range []struct{ name, value string }{
+		{"token", tok},
+		{"headers", filename + " headers"},
+		{"set", stingle.GallerySet},
+		{"dateCreated", "1000"},
+		{"dateModified", "1000"},
+		{"version", "1"},
+	} {
+		if err := w.WriteField(f.name, f.value); err != nil {
+			return 0, err
+		}
+	}
+	for _, f := range []string{"file", "thumb"} {
+		pw, err := w.CreateFormFile(f, filename)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(pw, "Content of %q filename %q", f, filename)
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := hc.Post("http://unix/v2/sync/upload", w.FormDataContentType(), &buf)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
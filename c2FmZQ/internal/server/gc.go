@@ -0,0 +1,43 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// Blob files that aren't referenced are deleted by the garbage collector only
+// if they are older than this, so that uploads in progress are left alone.
+const gcMinBlobAge = time.Hour
+
+// gcLoop runs the database's garbage collector every GCInterval.
+func (s *Server) gcLoop() {
+	for {
+		time.Sleep(s.GCInterval)
+		stats, err := s.db.CollectGarbage(gcMinBlobAge)
+		if err != nil {
+			log.Errorf("CollectGarbage: %v", err)
+			continue
+		}
+		if stats.RefCountsFixed > 0 || stats.OrphansDeleted > 0 || stats.Missing > 0 {
+			log.Infof("Garbage collection: %d reference counts fixed, %d unreferenced blobs deleted (%d bytes), %d blobs missing", stats.RefCountsFixed, stats.OrphansDeleted, stats.ReclaimedBytes, stats.Missing)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// maxPrecheckFingerprints is the maximum number of fingerprints that can be
+// checked in one request.
+const maxPrecheckFingerprints = 1000
+
+var (
+	errTooManyUploads = errors.New("too many parallel uploads")
+	errInvalidImport  = errors.New("invalid import session")
+)
+
+// uploadSlotKey identifies the parallel upload slots of one import session.
+type uploadSlotKey struct {
+	userID   int64
+	importID string
+}
+
+// handleImportStart handles the /v2x/import/start endpoint. It is called by
+// the web app before it imports a batch of files, e.g. a whole folder. It
+// returns the ID of a new import session, which can be used to track the
+// progress of the import, and the number of files that the client is allowed
+// to upload in parallel.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - totalFiles: The number of files to import.
+//   - totalBytes: The total size of the files to import.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - importId: The ID of the import session.
+//   - jobId: The ID of the job, for /v2x/jobs/events.
+//   - maxParallelUploads: The maximum number of parallel uploads.
+func (s *Server) handleImportStart(user database.User, req *http.Request) *stingle.Response {
+	if user.NeedApproval {
+		return stingle.ResponseNOK().AddError("Account is not approved yet")
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	session, err := s.db.StartImport(user, parseInt(params["totalFiles"], 0), parseInt(params["totalBytes"], 0))
+	if err != nil {
+		log.Errorf("StartImport: %v", err)
+		return stingle.ResponseNOK()
+	}
+	s.jobs.update(user.UserID, importJobStatus(session))
+	return stingle.ResponseOK().
+		AddPart("importId", session.ID).
+		AddPart("jobId", session.ID).
+		AddPart("maxParallelUploads", s.MaxParallelUploads)
+}
+
+// handleImportPrecheck handles the /v2x/import/precheck endpoint. The client
+// sends the fingerprints of the files that it is about to upload, and the
+// server returns the ones that match files that are already in the user's
+// gallery or albums, so that they can be skipped.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - fingerprints: A comma-separated list of file fingerprints.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - duplicates: The fingerprints of the files that already exist.
+func (s *Server) handleImportPrecheck(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	var fingerprints []string
+	for _, fp := range strings.Split(params["fingerprints"], ",") {
+		if fp != "" {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	if len(fingerprints) > maxPrecheckFingerprints {
+		return stingle.ResponseNOK().AddError("Too many files")
+	}
+	dups, err := s.db.FindFingerprints(user, fingerprints)
+	if err != nil {
+		log.Errorf("FindFingerprints: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if dups == nil {
+		dups = []string{}
+	}
+	return stingle.ResponseOK().AddPart("duplicates", dups)
+}
+
+// handleImportProgress handles the /v2x/import/progress endpoint. It returns
+// the progress of an import session. The client also uses it to report the
+// files that it skipped or failed to upload.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - importId: The ID of the import session.
+//   - skipped: The number of files skipped since the last report.
+//   - failed: The number of files that failed since the last report.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - import: The import session.
+func (s *Server) handleImportProgress(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	id := params["importId"]
+	skipped, failed := parseInt(params["skipped"], 0), parseInt(params["failed"], 0)
+	var session *database.ImportSession
+	if skipped > 0 || failed > 0 {
+		session, err = s.db.UpdateImport(user, id, func(is *database.ImportSession) {
+			is.SkippedFiles += skipped
+			is.FailedFiles += failed
+		})
+		if err == nil {
+			s.jobs.update(user.UserID, importJobStatus(session))
+		}
+	} else {
+		session, err = s.db.ImportSession(user, id)
+	}
+	if err == database.ErrImportNotFound {
+		return stingle.ResponseNOK().AddError("Import session not found")
+	}
+	if err != nil {
+		log.Errorf("ImportSession: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("import", session)
+}
+
+// acquireUploadSlot reserves one of the import session's parallel upload
+// slots. It returns false if all of them are already in use.
+func (s *Server) acquireUploadSlot(key uploadSlotKey) bool {
+	s.uploadSlotsMutex.Lock()
+	defer s.uploadSlotsMutex.Unlock()
+	if s.uploadSlots[key] >= s.MaxParallelUploads {
+		return false
+	}
+	s.uploadSlots[key]++
+	return true
+}
+
+// releaseUploadSlot releases a slot reserved with acquireUploadSlot.
+func (s *Server) releaseUploadSlot(key uploadSlotKey) {
+	s.uploadSlotsMutex.Lock()
+	defer s.uploadSlotsMutex.Unlock()
+	if s.uploadSlots[key]--; s.uploadSlots[key] <= 0 {
+		delete(s.uploadSlots, key)
+	}
+}
@@ -0,0 +1,188 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestImport(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	importID, maxParallel, err := c.importStart(2, 200)
+	if err != nil {
+		t.Fatalf("c.importStart failed: %v", err)
+	}
+	if maxParallel != 3 {
+		t.Errorf("Unexpected maxParallelUploads. Got %d, want 3", maxParallel)
+	}
+
+	if code, err := c.importFile("file1", "fp1", importID); err != nil || code != http.StatusOK {
+		t.Fatalf("c.importFile failed: %d %v", code, err)
+	}
+	// The importId field can only be sent once per upload.
+	if code, err := c.importFile("file2", "fp2", importID, importID); err != nil || code != http.StatusTooManyRequests {
+		t.Fatalf("c.importFile returned %d %v, want %d", code, err, http.StatusTooManyRequests)
+	}
+	// Unknown import sessions are rejected.
+	if code, err := c.importFile("file3", "fp3", "nonexistent"); err != nil || code != http.StatusBadRequest {
+		t.Fatalf("c.importFile returned %d %v, want %d", code, err, http.StatusBadRequest)
+	}
+	// Import sessions can't be used by other users.
+	bob, err := createAccountAndLogin(sock, "bob")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if code, err := bob.importFile("file4", "fp4", importID); err != nil || code != http.StatusBadRequest {
+		t.Fatalf("bob.importFile returned %d %v, want %d", code, err, http.StatusBadRequest)
+	}
+
+	dups, err := c.importPrecheck("fp1,fp2")
+	if err != nil {
+		t.Fatalf("c.importPrecheck failed: %v", err)
+	}
+	if want := []interface{}{"fp1"}; fmt.Sprint(dups) != fmt.Sprint(want) {
+		t.Errorf("Unexpected duplicates. Got %v, want %v", dups, want)
+	}
+
+	session, err := c.importProgress(importID, 1)
+	if err != nil {
+		t.Fatalf("c.importProgress failed: %v", err)
+	}
+	if got, want := fmt.Sprintf("%v %v %v", session["doneFiles"], session["skippedFiles"], session["totalFiles"]), "1 1 2"; got != want {
+		t.Errorf("Unexpected import session: %v, want done/skipped/total %s", session, want)
+	}
+
+	if _, err := c.importProgress("nonexistent", 0); err == nil {
+		t.Error("c.importProgress succeeded with unknown importId")
+	}
+}
+
+func (c *client) importStart(totalFiles, totalBytes int64) (string, int, error) {
+	params := make(map[string]string)
+	params["totalFiles"] = fmt.Sprintf("%d", totalFiles)
+	params["totalBytes"] = fmt.Sprintf("%d", totalBytes)
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/import/start", form)
+	if err != nil {
+		return "", 0, err
+	}
+	if sr.Status != "ok" {
+		return "", 0, sr
+	}
+	id, _ := sr.Part("importId").(string)
+	max, _ := sr.Part("maxParallelUploads").(json.Number).Int64()
+	return id, int(max), nil
+}
+
+func (c *client) importPrecheck(fingerprints string) ([]interface{}, error) {
+	params := make(map[string]string)
+	params["fingerprints"] = fingerprints
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/import/precheck", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	dups, _ := sr.Part("duplicates").([]interface{})
+	return dups, nil
+}
+
+func (c *client) importProgress(importID string, skipped int) (map[string]interface{}, error) {
+	params := make(map[string]string)
+	params["importId"] = importID
+	params["skipped"] = fmt.Sprintf("%d", skipped)
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/import/progress", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	session, _ := sr.Part("import").(map[string]interface{})
+	return session, nil
+}
+
+// importFile uploads a file to the gallery as part of an import session. The
+// importId field is sent once for each value of importIDs.
+func (c *client) importFile(filename, fingerprint string, importIDs ...string) (int, error) {
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fields := []struct{ name, value string }{
+		{"headers", filename + " headers"},
+		{"set", stingle.GallerySet},
+		{"dateCreated", "1000"},
+		{"dateModified", "1000"},
+		{"version", "1"},
+		{"token", c.token},
+		{"fingerprint", fingerprint},
+	}
+	for _, id := range importIDs {
+		fields = append(fields, struct{ name, value string }{"importId", id})
+	}
+	for _, f := range fields {
+		if err := w.WriteField(f.name, f.value); err != nil {
+			return 0, err
+		}
+	}
+	for _, f := range []string{"file", "thumb"} {
+		pw, err := w.CreateFormFile(f, filename)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(pw, "Content of %q filename %q", f, filename)
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	resp, err := hc.Post("http://unix/v2/sync/upload", w.FormDataContentType(), &buf)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,181 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleAlbumInvite handles the /v2x/sync/albumInvite endpoint. It is used by
+// the owner of an album to create or revoke the album's invite code. The code
+// is the part of the invite link that lets other users ask to join the album.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - revoke: When set to "1", the invite code is revoked.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(code, the new invite code)
+func (s *Server) handleAlbumInvite(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if params["revoke"] == "1" {
+		if err := s.db.RevokeAlbumInvite(user, params["albumId"]); err != nil {
+			log.Errorf("RevokeAlbumInvite: %v", err)
+			return stingle.ResponseNOK()
+		}
+		return stingle.ResponseOK()
+	}
+	if user.NeedApproval {
+		return stingle.ResponseNOK().
+			AddError("Account is not approved yet")
+	}
+	code, err := s.db.CreateAlbumInvite(user, params["albumId"])
+	if err != nil {
+		log.Errorf("CreateAlbumInvite: %v", err)
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("Only the owner of the album can invite new members")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("code", code)
+}
+
+// handleJoinAlbum handles the /v2x/sync/joinAlbum endpoint. It is used to ask
+// to join an album with an invite code. The owner of the album has to approve
+// the request.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - code: The invite code.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleJoinAlbum(user database.User, req *http.Request) *stingle.Response {
+	if user.NeedApproval {
+		return stingle.ResponseNOK().
+			AddError("Account is not approved yet")
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.RequestToJoinAlbum(user, params["code"]); err != nil {
+		log.Errorf("RequestToJoinAlbum: %v", err)
+		if err == database.ErrInvalidInvite {
+			return stingle.ResponseNOK().AddError("Invalid or expired invite")
+		}
+		if err == database.ErrTooManyJoinRequests {
+			return stingle.ResponseNOK().AddError("Too many pending requests for this album")
+		}
+		if errors.Is(err, os.ErrExist) {
+			return stingle.ResponseNOK().AddError("You are already a member of the album")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleJoinRequests handles the /v2x/sync/joinRequests endpoint. It is used
+// by the owner of an album to see the pending requests to join the album.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(requests, list of {userId, email, publicKey, date})
+func (s *Server) handleJoinRequests(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	requests, err := s.db.JoinRequests(user, params["albumId"])
+	if err != nil {
+		log.Errorf("JoinRequests: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("requests", requests)
+}
+
+// handleAnswerJoinRequest handles the /v2x/sync/answerJoinRequest endpoint.
+// It is used by the owner of an album to approve or deny a request to join
+// the album. When the request is approved, the new member is added to the
+// album in the same update.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - userId: The user who asked to join the album.
+//   - approve: "1" to approve the request, "0" to deny it.
+//   - sharingKey: The album's secret key, encrypted for the new member.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleAnswerJoinRequest(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	userID := parseInt(params["userId"], 0)
+	if err := s.db.AnswerJoinRequest(user, params["albumId"], userID, params["approve"] == "1", params["sharingKey"]); err != nil {
+		log.Errorf("AnswerJoinRequest: %v", err)
+		if err == database.ErrShareLimitExceeded {
+			return stingle.ResponseNOK().AddError("Album member limit exceeded")
+		}
+		if err == database.ErrLimitedAccount {
+			return stingle.ResponseNOK().AddError("Limited accounts can only share albums with their family")
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return stingle.ResponseNOK().AddError("No such request")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
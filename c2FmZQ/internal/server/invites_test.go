@@ -0,0 +1,195 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/database"
+)
+
+func TestAlbumInvites(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if _, err := bob.albumInvite("album", false); err == nil {
+		t.Error("bob.albumInvite succeeded unexpectedly")
+	}
+	code, err := alice.albumInvite("album", false)
+	if err != nil {
+		t.Fatalf("alice.albumInvite failed: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 2000
+	if err := bob.joinAlbum("bad code"); err == nil {
+		t.Error("bob.joinAlbum(bad code) succeeded unexpectedly")
+	}
+	if err := bob.joinAlbum(code); err != nil {
+		t.Fatalf("bob.joinAlbum failed: %v", err)
+	}
+	if err := alice.joinAlbum(code); err == nil {
+		t.Error("alice.joinAlbum succeeded unexpectedly")
+	}
+	if err := bob.setSeen("album", "marker"); err == nil {
+		t.Error("bob is a member before approval")
+	}
+
+	got, err := alice.joinRequests("album")
+	if err != nil {
+		t.Fatalf("alice.joinRequests failed: %v", err)
+	}
+	want := []interface{}{
+		map[string]interface{}{
+			"userId":    fmt.Sprintf("%d", bob.userID),
+			"email":     "bob",
+			"publicKey": base64.StdEncoding.EncodeToString(bob.secretKey.PublicKey().ToBytes()),
+			"date":      "2000",
+		},
+	}
+	if diff := compareLists(got, want); diff != nil {
+		t.Errorf("Unexpected join requests: %v", diff)
+	}
+	if _, err := bob.joinRequests("album"); err == nil {
+		t.Error("bob.joinRequests succeeded unexpectedly")
+	}
+
+	if err := alice.answerJoinRequest("album", bob.userID, true, "Bob's Sharing Key"); err != nil {
+		t.Fatalf("alice.answerJoinRequest failed: %v", err)
+	}
+	if err := bob.setSeen("album", "marker"); err != nil {
+		t.Errorf("bob is not a member after approval: %v", err)
+	}
+	if err := alice.answerJoinRequest("album", bob.userID, true, "Bob's Sharing Key"); err == nil {
+		t.Error("alice.answerJoinRequest succeeded twice")
+	}
+
+	if err := carol.joinAlbum(code); err != nil {
+		t.Fatalf("carol.joinAlbum failed: %v", err)
+	}
+	if err := alice.answerJoinRequest("album", carol.userID, false, ""); err != nil {
+		t.Fatalf("alice.answerJoinRequest failed: %v", err)
+	}
+	if err := carol.setSeen("album", "marker"); err == nil {
+		t.Error("carol is a member after denial")
+	}
+	if got, err := alice.joinRequests("album"); err != nil || len(got) != 0 {
+		t.Errorf("alice.joinRequests = %v, %v", got, err)
+	}
+
+	if _, err := alice.albumInvite("album", true); err != nil {
+		t.Fatalf("alice.albumInvite(revoke) failed: %v", err)
+	}
+	if err := carol.joinAlbum(code); err == nil {
+		t.Error("carol.joinAlbum succeeded after revoke")
+	}
+}
+
+func (c *client) albumInvite(albumID string, revoke bool) (string, error) {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	if revoke {
+		params["revoke"] = "1"
+	}
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/albumInvite", form)
+	if err != nil {
+		return "", err
+	}
+	if sr.Status != "ok" {
+		return "", sr
+	}
+	code, _ := sr.Part("code").(string)
+	return code, nil
+}
+
+func (c *client) joinAlbum(code string) error {
+	params := make(map[string]string)
+	params["code"] = code
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/joinAlbum", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
+func (c *client) joinRequests(albumID string) ([]interface{}, error) {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/joinRequests", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	requests, _ := sr.Part("requests").([]interface{})
+	return requests, nil
+}
+
+func (c *client) answerJoinRequest(albumID string, userID int64, approve bool, sharingKey string) error {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["userId"] = fmt.Sprintf("%d", userID)
+	params["approve"] = "0"
+	if approve {
+		params["approve"] = "1"
+	}
+	params["sharingKey"] = sharingKey
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/answerJoinRequest", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"c2FmZQ/internal/log"
+)
+
+// The endpoint groups of the AccessPolicy.
+const (
+	// AccessGroupAll contains all the requests.
+	AccessGroupAll = "all"
+	// AccessGroupCreateAccount contains the endpoints that create
+	// accounts, i.e. createAccount and the first-run setup.
+	AccessGroupCreateAccount = "create-account"
+	// AccessGroupAdmin contains the admin endpoints and the metrics.
+	AccessGroupAdmin = "admin"
+)
+
+// AccessPolicy restricts the networks that can use each group of endpoints.
+type AccessPolicy struct {
+	// Groups are the network filters of each endpoint group. A request is
+	// allowed when all the groups that it belongs to allow it.
+	Groups map[string]IPFilter
+	// TrustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For header is used to find the client's address.
+	TrustedProxies []*net.IPNet
+}
+
+// IPFilter is a list of allowed networks and a list of denied networks. An
+// empty allow list allows all the addresses that aren't denied.
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// NewAccessPolicy parses the access options and returns an AccessPolicy.
+// allow and deny are comma-separated lists of GROUP=NETWORK, where GROUP is
+// all, create-account, or admin, and NETWORK is in CIDR notation, e.g.
+// "admin=10.0.0.0/8,all=192.168.0.0/16". trustedProxies is a comma-separated
+// list of networks in CIDR notation.
+func NewAccessPolicy(allow, deny, trustedProxies string) (AccessPolicy, error) {
+	var p AccessPolicy
+	for _, l := range []struct {
+		value string
+		deny  bool
+	}{{allow, false}, {deny, true}} {
+		for _, v := range splitList(l.value) {
+			group, cidr, ok := strings.Cut(v, "=")
+			if !ok {
+				return p, fmt.Errorf("invalid network %q, want GROUP=NETWORK", v)
+			}
+			group = strings.TrimSpace(group)
+			if group != AccessGroupAll && group != AccessGroupCreateAccount && group != AccessGroupAdmin {
+				return p, fmt.Errorf("invalid endpoint group %q", group)
+			}
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return p, err
+			}
+			if p.Groups == nil {
+				p.Groups = make(map[string]IPFilter)
+			}
+			f := p.Groups[group]
+			if l.deny {
+				f.Deny = append(f.Deny, n)
+			} else {
+				f.Allow = append(f.Allow, n)
+			}
+			p.Groups[group] = f
+		}
+	}
+	for _, v := range splitList(trustedProxies) {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return p, err
+		}
+		p.TrustedProxies = append(p.TrustedProxies, n)
+	}
+	return p, nil
+}
+
+// allows returns whether ip is allowed by the filter.
+func (f IPFilter) allows(ip net.IP) bool {
+	if ip != nil && containsIP(f.Deny, ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || (ip != nil && containsIP(f.Allow, ip))
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent req. When req comes
+// from a trusted proxy, the address is the last one in X-Forwarded-For that
+// isn't a trusted proxy.
+func (p AccessPolicy) clientIP(req *http.Request) net.IP {
+	ip := net.ParseIP(remoteHost(req))
+	if ip == nil || !containsIP(p.TrustedProxies, ip) {
+		return ip
+	}
+	var hops []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(p.TrustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// endpointGroups returns the endpoint groups of a path without the path
+// prefix.
+func endpointGroups(path string) []string {
+	groups := []string{AccessGroupAll}
+	switch {
+	case path == "/v2/register/createAccount" || strings.HasPrefix(path, "/v2x/setup/"):
+		groups = append(groups, AccessGroupCreateAccount)
+	case path == "/metrics" || strings.HasPrefix(path, "/v2x/admin/"):
+		groups = append(groups, AccessGroupAdmin)
+	}
+	return groups
+}
+
+// checkAccess wraps a handler to reject the requests that the AccessPolicy
+// doesn't allow. The client's address, as seen by the other handlers, is
+// the one found with the trusted proxies.
+func (s *Server) checkAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := s.AccessPolicy.clientIP(req)
+		if ip != nil && ip.String() != remoteHost(req) {
+			r := *req
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			req = &r
+		}
+		for _, g := range endpointGroups(strings.TrimPrefix(req.URL.Path, s.pathPrefix)) {
+			if f, ok := s.AccessPolicy.Groups[g]; ok && !f.allows(ip) {
+				log.Infof("Access denied: %s %s (%s)", remoteHost(req), req.URL.Path, g)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
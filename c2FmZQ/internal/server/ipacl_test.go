@@ -0,0 +1,111 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+)
+
+func TestNewAccessPolicy(t *testing.T) {
+	p, err := server.NewAccessPolicy("admin=10.0.0.0/8, admin=2001:db8::/32", "all=203.0.113.0/24", "127.0.0.1/32")
+	if err != nil {
+		t.Fatalf("NewAccessPolicy: %v", err)
+	}
+	_, n1, _ := net.ParseCIDR("10.0.0.0/8")
+	_, n2, _ := net.ParseCIDR("2001:db8::/32")
+	_, n3, _ := net.ParseCIDR("203.0.113.0/24")
+	_, n4, _ := net.ParseCIDR("127.0.0.1/32")
+	want := server.AccessPolicy{
+		Groups: map[string]server.IPFilter{
+			"admin": {Allow: []*net.IPNet{n1, n2}},
+			"all":   {Deny: []*net.IPNet{n3}},
+		},
+		TrustedProxies: []*net.IPNet{n4},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("NewAccessPolicy() = %+v, want %+v", p, want)
+	}
+
+	for _, tc := range []struct{ allow, deny, proxies string }{
+		{"10.0.0.0/8", "", ""},
+		{"api=10.0.0.0/8", "", ""},
+		{"", "all=10.0.0.1", ""},
+		{"", "", "10.0.0.1"},
+	} {
+		if _, err := server.NewAccessPolicy(tc.allow, tc.deny, tc.proxies); err == nil {
+			t.Errorf("NewAccessPolicy(%q, %q, %q) didn't fail", tc.allow, tc.deny, tc.proxies)
+		}
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		allow, deny, proxies string
+		path                 string
+		forwardedFor         string
+		want                 int
+	}{
+		{"", "", "", "/v2/login/preLogin", "", http.StatusOK},
+		{"", "all=127.0.0.0/8,all=::1/128", "", "/v2/login/preLogin", "", http.StatusForbidden},
+		{"admin=10.0.0.0/8", "", "", "/v2/login/preLogin", "", http.StatusOK},
+		{"admin=10.0.0.0/8", "", "", "/v2x/admin/users", "", http.StatusForbidden},
+		{"create-account=10.0.0.0/8", "", "", "/v2/register/createAccount", "", http.StatusForbidden},
+		// The proxy isn't trusted.
+		{"", "all=203.0.113.0/24", "", "/v2/login/preLogin", "203.0.113.5", http.StatusOK},
+		{"", "all=203.0.113.0/24", "127.0.0.0/8,::1/128", "/v2/login/preLogin", "203.0.113.5", http.StatusForbidden},
+		{"", "all=203.0.113.0/24", "127.0.0.0/8,::1/128", "/v2/login/preLogin", "203.0.113.5, 198.51.100.1", http.StatusOK},
+		{"all=10.0.0.0/8", "", "127.0.0.0/8,::1/128", "/v2/login/preLogin", "10.1.2.3", http.StatusOK},
+	} {
+		p, err := server.NewAccessPolicy(tc.allow, tc.deny, tc.proxies)
+		if err != nil {
+			t.Fatalf("NewAccessPolicy: %v", err)
+		}
+		db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+		s := server.New(db, "", "", "")
+		s.AccessPolicy = p
+		srv := httptest.NewServer(s.Handler())
+
+		req, err := http.NewRequest("POST", srv.URL+tc.path, strings.NewReader(url.Values{"email": {"alice@"}}.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.StatusCode; got != tc.want {
+			t.Errorf("[%q %q %q] %s (%q): status code = %d, want %d", tc.allow, tc.deny, tc.proxies, tc.path, tc.forwardedFor, got, tc.want)
+		}
+		srv.Close()
+	}
+}
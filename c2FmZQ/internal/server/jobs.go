@@ -0,0 +1,255 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// maxJobStreams is the maximum number of concurrent event streams per
+	// user.
+	maxJobStreams = 5
+	// Finished jobs are forgotten after this long.
+	jobRetention = time.Hour
+	// Comments are sent on idle event streams at this interval so that
+	// proxies don't close them.
+	jobKeepAlive = 15 * time.Second
+)
+
+var (
+	errTooManyStreams = errors.New("too many event streams")
+	errStreamsClosed  = errors.New("event streams are closed")
+)
+
+// jobStatus is the status of a long-running job, as streamed by the
+// /v2x/jobs/events endpoint.
+type jobStatus struct {
+	// The ID of the job, returned by the endpoint that started it.
+	JobID string `json:"jobId"`
+	// The type of job, e.g. "import".
+	Type string `json:"type"`
+	// One of "running", "done", or "failed".
+	State string `json:"state"`
+	// The number of items processed so far, and the total number of items.
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+
+	updated time.Time
+}
+
+// jobTracker keeps the status of the users' jobs, and the event streams that
+// are waiting for updates. Jobs are tracked in memory. In cluster mode, a
+// stream only sees the updates made by the same server instance.
+type jobTracker struct {
+	mu      sync.Mutex
+	jobs    map[int64]map[string]*jobStatus
+	streams map[int64]map[chan jobStatus]bool
+	closed  bool
+	done    chan struct{}
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		jobs:    make(map[int64]map[string]*jobStatus),
+		streams: make(map[int64]map[chan jobStatus]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// update records the new status of a job and sends it to the user's streams.
+func (t *jobTracker) update(userID int64, js jobStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	js.updated = time.Now()
+	jobs := t.jobs[userID]
+	if jobs == nil {
+		jobs = make(map[string]*jobStatus)
+		t.jobs[userID] = jobs
+	}
+	for id, j := range jobs {
+		if j.State != "running" && time.Since(j.updated) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+	jobs[js.JobID] = &js
+	for ch := range t.streams[userID] {
+		select {
+		case ch <- js:
+		default:
+			// The stream is too slow. The next update will catch
+			// up since each event has the full status.
+		}
+	}
+}
+
+// subscribe returns a channel that receives the user's job updates, and the
+// current status of the user's jobs. The returned func must be called to
+// unsubscribe.
+func (t *jobTracker) subscribe(userID int64) (<-chan jobStatus, []jobStatus, func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, nil, nil, errStreamsClosed
+	}
+	streams := t.streams[userID]
+	if streams == nil {
+		streams = make(map[chan jobStatus]bool)
+		t.streams[userID] = streams
+	}
+	if len(streams) >= maxJobStreams {
+		return nil, nil, nil, errTooManyStreams
+	}
+	ch := make(chan jobStatus, 10)
+	streams[ch] = true
+	var current []jobStatus
+	for _, js := range t.jobs[userID] {
+		current = append(current, *js)
+	}
+	return ch, current, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.streams[userID], ch)
+		if len(t.streams[userID]) == 0 {
+			delete(t.streams, userID)
+		}
+	}, nil
+}
+
+// close ends all the event streams, e.g. when the server shuts down.
+func (t *jobTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// importJobStatus returns the job status of an import session.
+func importJobStatus(is *database.ImportSession) jobStatus {
+	js := jobStatus{
+		JobID: is.ID,
+		Type:  "import",
+		State: "running",
+		Done:  is.DoneFiles + is.SkippedFiles + is.FailedFiles,
+		Total: is.TotalFiles,
+	}
+	if js.Done >= js.Total {
+		js.State = "done"
+		if is.FailedFiles > 0 {
+			js.State = "failed"
+		}
+	}
+	return js
+}
+
+// handleJobEvents handles the /v2x/jobs/events endpoint. It streams the status
+// of the user's long-running jobs as server-sent events. The current status of
+// all the jobs is sent first, followed by updates as they happen. Each event
+// has the type "job", and its data is the JSON-encoded status of one job.
+//
+// Form arguments:
+//   - token: The signed session token.
+func (s *Server) handleJobEvents(w http.ResponseWriter, req *http.Request) {
+	_, user, err := s.checkToken(req.PostFormValue("token"), "session")
+	if err != nil {
+		log.Errorf("handleJobEvents: checkToken failed: %v", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
+	s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1})
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("handleJobEvents: ResponseWriter is not a Flusher")
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	ch, current, cancel, err := s.jobs.subscribe(user.UserID)
+	if err == errTooManyStreams {
+		http.Error(w, "Too many event streams", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+
+	ctx := req.Context()
+	defer s.setDeadline(ctx, time.Time{})
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Compression would buffer the events.
+	h.Set("Content-Encoding", "identity")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// The headers are only sent with the first write. This also tells the
+	// client how long to wait before reconnecting.
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", jobKeepAlive.Milliseconds()); err != nil {
+		return
+	}
+	for _, js := range current {
+		if err := writeJobEvent(w, js); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(jobKeepAlive)
+	defer ticker.Stop()
+	for {
+		s.setDeadline(ctx, time.Now().Add(2*jobKeepAlive))
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.jobs.done:
+			return
+		case js := <-ch:
+			if err := writeJobEvent(w, js); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJobEvent(w io.Writer, js jobStatus) error {
+	b, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: job\ndata: %s\n\n", js.JobID, b)
+	return err
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobEvents(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	form := url.Values{}
+	form.Set("token", c.token)
+	resp, err := hc.PostForm("http://unix/v2x/jobs/events", form)
+	if err != nil {
+		t.Fatalf("hc.PostForm failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Unexpected content type. Got %q, want %q", got, want)
+	}
+
+	type job struct {
+		JobID string `json:"jobId"`
+		Type  string `json:"type"`
+		State string `json:"state"`
+		Done  int64  `json:"done"`
+		Total int64  `json:"total"`
+	}
+	events := make(chan job)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data: ")
+			if data == scanner.Text() {
+				continue
+			}
+			var j job
+			if err := json.Unmarshal([]byte(data), &j); err != nil {
+				t.Errorf("json.Unmarshal(%q): %v", data, err)
+				return
+			}
+			events <- j
+		}
+	}()
+	next := func() job {
+		select {
+		case j := <-events:
+			return j
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for event")
+		}
+		return job{}
+	}
+
+	importID, _, err := c.importStart(2, 200)
+	if err != nil {
+		t.Fatalf("c.importStart failed: %v", err)
+	}
+	if got, want := next(), (job{JobID: importID, Type: "import", State: "running", Done: 0, Total: 2}); got != want {
+		t.Errorf("Unexpected event. Got %+v, want %+v", got, want)
+	}
+	if code, err := c.importFile("file1", "fp1", importID); err != nil || code != http.StatusOK {
+		t.Fatalf("c.importFile failed: %d %v", code, err)
+	}
+	if got, want := next(), (job{JobID: importID, Type: "import", State: "running", Done: 1, Total: 2}); got != want {
+		t.Errorf("Unexpected event. Got %+v, want %+v", got, want)
+	}
+	if _, err := c.importProgress(importID, 1); err != nil {
+		t.Fatalf("c.importProgress failed: %v", err)
+	}
+	if got, want := next(), (job{JobID: importID, Type: "import", State: "done", Done: 2, Total: 2}); got != want {
+		t.Errorf("Unexpected event. Got %+v, want %+v", got, want)
+	}
+}
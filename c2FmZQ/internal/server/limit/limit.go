@@ -87,9 +87,17 @@ func (c *ConnLimiter) Done() {
 	}
 }
 
+// Queued returns the number of requests that are waiting for their turn.
+func (c *ConnLimiter) Queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queue.Len()
+}
+
 // ServeHTTP handles an HTTP request.
 func (c *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasSuffix(r.URL.Path, "/metrics") {
+	// Event streams are long-lived and would hold their ticket forever.
+	if strings.HasSuffix(r.URL.Path, "/metrics") || strings.HasSuffix(r.URL.Path, "/events") {
 		c.next.ServeHTTP(w, r)
 		return
 	}
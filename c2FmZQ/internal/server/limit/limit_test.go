@@ -39,6 +39,9 @@ func TestTicket(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		exp[i] = true
 		t.Logf("Loop %d - Exp %v", i, exp)
+		if got, want := l.Queued(), 4-i; got != want {
+			t.Errorf("%d: Queued() Got %d, want %d", i, got, want)
+		}
 		for j := range ch {
 			if got, want := ready(ch[j]), exp[j]; got != want {
 				t.Errorf("%d: ready(ch[%d]) Got %v, want %v", i, j, got, want)
@@ -0,0 +1,107 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package limit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"golang.org/x/time/rate"
+)
+
+// maxClients is the number of clients whose token bucket is kept. The
+// buckets of the least recently seen clients are dropped.
+const maxClients = 10000
+
+// Rate is the configuration of a RateLimiter.
+type Rate struct {
+	// Global is the number of requests per second, shared by all the
+	// clients. Zero means no limit.
+	Global float64
+	// PerClient is the number of requests per second from each client,
+	// e.g. each IP address. Zero means no limit.
+	PerClient float64
+	// Burst is the number of requests that can be sent at once. The
+	// default is 1.
+	Burst int
+}
+
+// RateLimiter limits the rate of requests with token buckets, one shared by
+// all the clients, and one for each client.
+type RateLimiter struct {
+	r      Rate
+	global *rate.Limiter
+
+	mu      sync.Mutex
+	clients *simplelru.LRU
+}
+
+// NewRateLimiter returns a new RateLimiter.
+func NewRateLimiter(r Rate) *RateLimiter {
+	if r.Burst <= 0 {
+		r.Burst = 1
+	}
+	clients, _ := simplelru.NewLRU(maxClients, nil)
+	return &RateLimiter{
+		r:       r,
+		global:  newLimiter(r.Global, r.Burst),
+		clients: clients,
+	}
+}
+
+func newLimiter(r float64, burst int) *rate.Limiter {
+	if r <= 0 {
+		return rate.NewLimiter(rate.Inf, burst)
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+// Reserve reserves a request from client. It returns how long the caller
+// must wait before sending the request. When that is longer than maxDelay,
+// nothing is reserved, and ok is false.
+func (l *RateLimiter) Reserve(client string, maxDelay time.Duration) (delay time.Duration, ok bool) {
+	now := time.Now()
+	g := l.global.ReserveN(now, 1)
+	delay = g.DelayFrom(now)
+	if l.r.PerClient > 0 {
+		c := l.client(client).ReserveN(now, 1)
+		if d := c.DelayFrom(now); d > delay {
+			delay = d
+		}
+		if delay > maxDelay {
+			c.CancelAt(now)
+		}
+	}
+	if delay > maxDelay {
+		g.CancelAt(now)
+		return delay, false
+	}
+	return delay, true
+}
+
+func (l *RateLimiter) client(client string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.clients.Get(client); ok {
+		return v.(*rate.Limiter)
+	}
+	c := newLimiter(l.r.PerClient, l.r.Burst)
+	l.clients.Add(client, c)
+	return c
+}
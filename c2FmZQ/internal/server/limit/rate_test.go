@@ -0,0 +1,64 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package limit_test
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server/limit"
+)
+
+func TestRateLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		rate    limit.Rate
+		clients []string
+		want    []bool
+	}{
+		{
+			rate:    limit.Rate{PerClient: 1, Burst: 2},
+			clients: []string{"a", "a", "a", "b", "b", "c"},
+			want:    []bool{true, true, false, true, true, true},
+		},
+		{
+			rate:    limit.Rate{Global: 1, PerClient: 1, Burst: 2},
+			clients: []string{"a", "b", "c"},
+			want:    []bool{true, true, false},
+		},
+	} {
+		l := limit.NewRateLimiter(tc.rate)
+		for i, c := range tc.clients {
+			if delay, ok := l.Reserve(c, 0); ok != tc.want[i] {
+				t.Errorf("%+v %d: Reserve(%q) = %s, %v, want %v", tc.rate, i, c, delay, ok, tc.want[i])
+			}
+		}
+		// The rejected requests didn't use any tokens.
+		if delay, ok := l.Reserve("a", 2*time.Second); !ok || delay <= 0 || delay > time.Second {
+			t.Errorf("%+v: Reserve(a, 2s) = %s, %v, want (0, 1s], true", tc.rate, delay, ok)
+		}
+	}
+}
+
+func TestRateLimiterNoLimit(t *testing.T) {
+	l := limit.NewRateLimiter(limit.Rate{})
+	for i := 0; i < 100; i++ {
+		if delay, ok := l.Reserve("a", 0); !ok || delay != 0 {
+			t.Fatalf("%d: Reserve() = %s, %v, want 0, true", i, delay, ok)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// remoteHost returns the IP address of the client.
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return host
+}
+
+// loginLockedUntil returns the time when email can try to log in again from
+// the client's address, in milliseconds, or zero if it isn't locked out.
+func (s *Server) loginLockedUntil(email string, req *http.Request) int64 {
+	if s.LoginLockoutThreshold <= 0 {
+		return 0
+	}
+	until, err := s.db.LoginLockedUntil(email, remoteHost(req))
+	if err != nil {
+		log.Errorf("LoginLockedUntil: %v", err)
+	}
+	return until
+}
+
+// loginFailed records a failed login for email and returns the response to
+// send.
+func (s *Server) loginFailed(email string, req *http.Request) *stingle.Response {
+	s.logAuthFailure(req, authFailureCredentials, email)
+	if s.LoginLockoutThreshold <= 0 {
+		return stingle.ResponseNOK().AddError("Invalid credentials")
+	}
+	until, err := s.db.RecordLoginFailure(email, remoteHost(req), s.LoginLockoutThreshold, s.LoginLockoutDuration)
+	if err != nil {
+		log.Errorf("RecordLoginFailure: %v", err)
+	}
+	if until > 0 {
+		log.Infof("Login locked out: %s from %s until %s", email, remoteHost(req), time.UnixMilli(until).UTC().Format(time.RFC3339))
+		return lockedOutResponse(until)
+	}
+	return stingle.ResponseNOK().AddError("Invalid credentials")
+}
+
+// lockedOutResponse returns the response to a login while the account or the
+// client's address is locked out.
+func lockedOutResponse(until int64) *stingle.Response {
+	wait := time.Until(time.UnixMilli(until)).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return stingle.ResponseNOK().
+		AddPart("lockedUntil", fmt.Sprintf("%d", until)).
+		AddError(fmt.Sprintf("Too many failed login attempts. Try again in %s.", wait))
+}
+
+// clearLoginFailures forgets the failed logins of email after a successful
+// login.
+func (s *Server) clearLoginFailures(email string) {
+	if s.LoginLockoutThreshold <= 0 {
+		return
+	}
+	if err := s.db.ClearLoginFailures(email); err != nil {
+		log.Errorf("ClearLoginFailures: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestLoginLockout(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.RateLimitPolicy = server.RateLimitPolicy{}
+		s.LoginLockoutThreshold = 3
+		s.LoginLockoutDuration = time.Minute
+	})
+	defer shutdown()
+	now := time.Now().UnixNano() / 1000000
+	database.CurrentTimeForTesting = now
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin: %v", err)
+	}
+	preLoginLockedUntil := func(email string) interface{} {
+		form := url.Values{}
+		form.Set("email", email)
+		sr, err := c.sendRequest("/v2/login/preLogin", form)
+		if err != nil || sr.Status != "ok" {
+			t.Fatalf("preLogin failed: %v %v", err, sr)
+		}
+		return sr.Part("lockedUntil")
+	}
+	login := func(email, password string) (*stingle.Response, error) {
+		form := url.Values{}
+		form.Set("email", email)
+		form.Set("password", password)
+		return c.sendRequest("/v2/login/login", form)
+	}
+
+	// Accounts that don't exist are locked out the same way.
+	for _, email := range []string{"alice", "bob"} {
+		for i := 0; i < 3; i++ {
+			sr, err := login(email, "WRONG")
+			if err != nil || sr.Status != "nok" {
+				t.Fatalf("[%s] login: %v %v", email, err, sr)
+			}
+			want := interface{}("")
+			if i == 2 {
+				want = fmt.Sprint(now + 60000)
+			}
+			if got := sr.Part("lockedUntil"); got != want {
+				t.Errorf("[%s] login(%d) lockedUntil = %v, want %v", email, i, got, want)
+			}
+		}
+		if got, want := preLoginLockedUntil(email), fmt.Sprint(now+60000); got != want {
+			t.Errorf("[%s] preLogin lockedUntil = %v, want %v", email, got, want)
+		}
+	}
+	if got := preLoginLockedUntil("carol"); got != nil {
+		t.Errorf("[carol] preLogin lockedUntil = %v, want none", got)
+	}
+
+	// The right password doesn't work while the account is locked.
+	if err := c.login(); err == nil {
+		t.Fatal("login succeeded while locked out")
+	}
+
+	now += 60000
+	database.CurrentTimeForTesting = now
+	if got := preLoginLockedUntil("alice"); got != nil {
+		t.Errorf("preLogin lockedUntil = %v, want none", got)
+	}
+	// The next failure doubles the lockout.
+	if sr, err := login("alice", "WRONG"); err != nil || sr.Part("lockedUntil") != fmt.Sprint(now+120000) {
+		t.Errorf("login: %v %v, want lockedUntil %d", err, sr, now+120000)
+	}
+	now += 120000
+	database.CurrentTimeForTesting = now
+	if err := c.login(); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	// A successful login resets the count.
+	for i := 0; i < 2; i++ {
+		if sr, err := login("alice", "WRONG"); err != nil || sr.Part("lockedUntil") != "" {
+			t.Errorf("login: %v %v, want no lockout", err, sr)
+		}
+	}
+}
@@ -39,8 +39,25 @@ import (
 const (
 	// Login tokens are good for 180 days.
 	tokenDuration = 180 * 24 * time.Hour
+
+	// SessionLimitReject makes the login fail when the user already has
+	// MaxSessions valid sessions.
+	SessionLimitReject = "reject"
+	// SessionLimitEvict revokes the user's oldest session when they log in
+	// with MaxSessions valid sessions.
+	SessionLimitEvict = "evict"
 )
 
+// passwordChangeEndpoints are the endpoints that users can still use when
+// they must change their password. All the others fail with the
+// passwordChangeRequired part.
+var passwordChangeEndpoints = map[string]bool{
+	"/v2/login/changePass":  true,
+	"/v2/login/logout":      true,
+	"/v2/keys/getServerPK":  true,
+	"/v2/keys/reuploadKeys": true,
+}
+
 // handleCreateAccount handles the /v2/register/createAccount endpoint.
 //
 // Argument:
@@ -58,39 +75,68 @@ const (
 //   - stingle.Response(ok)
 func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
 	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
-	pk, _, err := stingle.DecodeKeyBundle(req.PostFormValue("keyBundle"))
-	if err != nil {
-		return stingle.ResponseNOK()
-	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.PostFormValue("password")), 12)
-	if err != nil {
-		log.Errorf("bcrypt.GenerateFromPassword: %v", err)
-		return stingle.ResponseNOK()
+	if s.setupRequired() {
+		return stingle.ResponseNOK().AddError("The server's first-run setup isn't done yet")
 	}
-	email := req.PostFormValue("email")
-	if !validateEmail(email) {
+	u, ok := newUserFromForm(req)
+	if !ok {
 		return stingle.ResponseNOK()
 	}
-	if _, err := s.db.User(email); err == nil {
+	if _, err := s.db.User(u.Email); err == nil {
 		return stingle.ResponseNOK()
 	}
-	if !s.AllowCreateAccount {
+	allow, autoApprove := s.registrationSettings()
+	if !allow {
 		return stingle.ResponseNOK()
 	}
-	if _, err := s.db.AddUser(
-		database.User{
-			Email:          email,
-			HashedPassword: base64.StdEncoding.EncodeToString(hashed),
-			Salt:           req.PostFormValue("salt"),
-			KeyBundle:      req.PostFormValue("keyBundle"),
-			IsBackup:       req.PostFormValue("isBackup"),
-			PublicKey:      pk,
-			NeedApproval:   !s.AutoApproveNewAccounts,
-		}); err != nil {
+	u.NeedApproval = !autoApprove
+	u.NeedEmailVerification = s.RequireEmailVerification && s.Mailer != nil
+	uid, err := s.db.AddUser(u)
+	if err != nil {
 		log.Errorf("AddUser: %v", err)
 		return stingle.ResponseNOK()
 	}
-	return stingle.ResponseOK()
+	if !u.NeedEmailVerification {
+		return stingle.ResponseOK()
+	}
+	// The first account, i.e. the admin, doesn't need to be verified.
+	if u, err = s.db.UserByID(uid); err != nil {
+		log.Errorf("UserByID: %v", err)
+		return stingle.ResponseOK()
+	}
+	if !u.NeedEmailVerification {
+		return stingle.ResponseOK()
+	}
+	if err := s.sendVerificationEmail(u, req.Host); err != nil {
+		log.Errorf("sendVerificationEmail: %v", err)
+	}
+	return stingle.ResponseOK().AddInfo("Check your email to verify your email address.")
+}
+
+// newUserFromForm returns a new user with the email address, password, and
+// keys from the createAccount form arguments.
+func newUserFromForm(req *http.Request) (database.User, bool) {
+	pk, _, err := stingle.DecodeKeyBundle(req.PostFormValue("keyBundle"))
+	if err != nil {
+		return database.User{}, false
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.PostFormValue("password")), 12)
+	if err != nil {
+		log.Errorf("bcrypt.GenerateFromPassword: %v", err)
+		return database.User{}, false
+	}
+	email := req.PostFormValue("email")
+	if !validateEmail(email) {
+		return database.User{}, false
+	}
+	return database.User{
+		Email:          email,
+		HashedPassword: base64.StdEncoding.EncodeToString(hashed),
+		Salt:           req.PostFormValue("salt"),
+		KeyBundle:      req.PostFormValue("keyBundle"),
+		IsBackup:       req.PostFormValue("isBackup"),
+		PublicKey:      pk,
+	}, true
 }
 
 // handlePreLogin handles the /v2/login/preLogin endpoint.
@@ -104,22 +150,34 @@ func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
 // Returns:
 //   - stingle.Response(ok)
 //     Part(salt, The salt used to hash the password)
+//     Part(lockedUntil, When the login is locked out, the time when it ends)
 func (s *Server) handlePreLogin(req *http.Request) *stingle.Response {
 	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
 	email, _ := parseOTP(req.PostFormValue("email"))
+	resp, err := s.preLogin(email)
+	if err != nil {
+		return stingle.ResponseNOK()
+	}
+	if until := s.loginLockedUntil(email, req); until > 0 {
+		resp.AddPart("lockedUntil", fmt.Sprintf("%d", until))
+	}
+	return resp
+}
+
+func (s *Server) preLogin(email string) (*stingle.Response, error) {
 	if u, err := s.db.User(email); err == nil && !u.LoginDisabled {
-		return stingle.ResponseOK().AddPart("salt", u.Salt)
+		return stingle.ResponseOK().AddPart("salt", u.Salt), nil
 	}
 	if v, ok := s.preLoginCache.Get(email); ok {
-		return stingle.ResponseOK().AddPart("salt", v.(string))
+		return stingle.ResponseOK().AddPart("salt", v.(string)), nil
 	}
 	fakeSalt := make([]byte, 16)
 	if _, err := rand.Read(fakeSalt); err != nil {
-		return stingle.ResponseNOK()
+		return nil, err
 	}
 	v := strings.ToUpper(hex.EncodeToString(fakeSalt))
 	s.preLoginCache.Add(email, v)
-	return stingle.ResponseOK().AddPart("salt", v)
+	return stingle.ResponseOK().AddPart("salt", v), nil
 }
 
 // handleLogin handles the /v2/login/login endpoint.
@@ -139,18 +197,26 @@ func (s *Server) handlePreLogin(req *http.Request) *stingle.Response {
 //     Part(token, The session token signed by the server)
 //     Part(isKeyBackedUp, Whether the user's secret key is in keyBundle)
 //     Part(homeFolder, A "Home folder" used on the app's device)
+//     Part(storage, The user's storage usage, quota, and file counts)
+//     Part(otpRequired, "1" when the user must enable OTP, see RequireOTP)
+//   - stingle.Response(nok)
+//     Part(lockedUntil, When the login is locked out, the time when it ends)
 func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 	email, _ := parseOTP(req.PostFormValue("email"))
 	pass := req.PostFormValue("password")
+	if until := s.loginLockedUntil(email, req); until > 0 {
+		s.logAuthFailure(req, authFailureLockedOut, email)
+		return lockedOutResponse(until)
+	}
 	u, err := s.db.User(email)
 	if err != nil {
-		return stingle.ResponseNOK().AddError("Invalid credentials")
+		return s.loginFailed(email, req)
 	}
 	if u.LoginDisabled {
-		return stingle.ResponseNOK().AddError("Invalid credentials")
+		return s.loginFailed(email, req)
 	}
 	var mfaFailed bool
-	if u.RequireMFA {
+	if u.RequireMFA || (s.RequireOTP && u.OTPKey != "") {
 		resp, redirect := s.requireMFA(&u, req, time.Duration(0))
 		if resp != nil && redirect {
 			return resp
@@ -172,23 +238,51 @@ func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 	log.Debugf("UserID:%d pwOK:%v", u.UserID, pwOK)
 	if !pwOK || mfaFailed {
 		if decoyUser == nil {
-			return stingle.ResponseNOK().AddError("Invalid credentials")
+			s.recordActivity(u.UserID, database.ActivityLoginFailed, remoteHost(req))
+			return s.loginFailed(email, req)
 		}
 		u = *decoyUser
 	}
+	s.clearLoginFailures(email)
+	if pwOK && !mfaFailed {
+		if err := s.db.RecordOwnerActivity(u); err != nil {
+			log.Errorf("RecordOwnerActivity: %v", err)
+		}
+	}
+	if u.NeedEmailVerification {
+		if err := s.sendVerificationEmail(u, req.Host); err != nil {
+			log.Errorf("sendVerificationEmail: %v", err)
+		}
+		return stingle.ResponseNOK().AddError("Your email address isn't verified yet. Check your email for a new verification link.")
+	}
 	tk, err := s.db.DecryptTokenKey(u.TokenKey)
 	if err != nil {
 		return stingle.ResponseNOK()
 	}
 	defer tk.Wipe()
-	tok := token.Mint(tk, token.Token{Scope: "session", Subject: u.UserID}, tokenDuration)
-	if err := s.db.MutateUser(u.UserID, func(u *database.User) error {
-		u.ValidTokens[token.Hash(tok)] = true
+	var tok string
+	err = s.db.MutateUser(u.UserID, func(user *database.User) error {
+		if user.TokenEpoch == 0 {
+			user.TokenEpoch = 1
+		}
+		u.TokenEpoch = user.TokenEpoch
+		tok = token.Mint(tk, token.Token{Scope: "session", Subject: u.UserID, Epoch: u.TokenEpoch}, tokenDuration)
+		if err := s.addSession(user, tok); err != nil {
+			return err
+		}
+		user.AddSessionInfo(token.Hash(tok), newSessionInfo(req))
 		return nil
-	}); err != nil {
+	})
+	if err == database.ErrTooManySessions {
+		return stingle.ResponseNOK().
+			AddPart("sessionLimit", "1").
+			AddError("Too many sessions. Log out on another device first.")
+	}
+	if err != nil {
 		log.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
+	s.recordActivity(u.UserID, database.ActivityLogin, remoteHost(req))
 	resp := stingle.ResponseOK().
 		AddPart("keyBundle", u.KeyBundle).
 		AddPart("serverPublicKey", u.ServerPublicKeyForExport()).
@@ -199,12 +293,31 @@ func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 	if u.Admin {
 		resp.AddPart("_admin", "1")
 	}
+	if storage, err := s.db.StorageUsage(u); err != nil {
+		log.Errorf("StorageUsage() failed: %v", err)
+	} else {
+		resp.AddPart("storage", storage)
+	}
 	if u.NeedApproval {
 		resp.AddInfo("Your account hasn't been approved yet. Some features are disabled.")
 	}
+	if u.ForcePasswordChange {
+		resp.AddPart("passwordChangeRequired", "1").
+			AddInfo("You must change your password.")
+	}
+	if s.RequireOTP && u.OTPKey == "" {
+		resp.AddPart("otpRequired", "1").
+			AddInfo("You must enable two-factor authentication.")
+	}
 	return resp
 }
 
+// addSession records a new session token for the user, when the number of
+// sessions is limited.
+func (s *Server) addSession(user *database.User, tok string) error {
+	return user.AddSession(token.Hash(tok), time.Now().Add(tokenDuration), s.MaxSessions, s.SessionLimitPolicy == SessionLimitEvict)
+}
+
 func (s *Server) decoyLogin(user database.User, hash string) *database.User {
 	salt, err := hex.DecodeString(user.Salt)
 	if err != nil {
@@ -254,7 +367,7 @@ func (s *Server) decoyLogin(user database.User, hash string) *database.User {
 //   - StringleResponse(ok)
 func (s *Server) handleLogout(user database.User, req *http.Request) *stingle.Response {
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
-		delete(user.ValidTokens, token.Hash(req.PostFormValue("token")))
+		user.RevokeToken(token.Hash(req.PostFormValue("token")), time.Now().Add(tokenDuration).Unix())
 		return nil
 	}); err != nil {
 		log.Errorf("MutateUser: %v", err)
@@ -305,6 +418,7 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 			return err
 		}
 		user.TokenKey = etk
+		user.ForcePasswordChange = false
 		pk, hasSK, err := stingle.DecodeKeyBundle(user.KeyBundle)
 		if err != nil {
 			log.Errorf("DecodeKeyBundle: %v", err)
@@ -322,8 +436,12 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 			return err
 		}
 		defer tk.Wipe()
-		tok = token.Mint(tk, token.Token{Scope: "session", Subject: user.UserID}, tokenDuration)
-		user.ValidTokens = map[string]bool{token.Hash(tok): true}
+		user.RevokeAllTokens()
+		tok = token.Mint(tk, token.Token{Scope: "session", Subject: user.UserID, Epoch: user.TokenEpoch}, tokenDuration)
+		if err := s.addSession(user, tok); err != nil {
+			return err
+		}
+		user.AddSessionInfo(token.Hash(tok), newSessionInfo(req))
 		return nil
 	}); err != nil {
 		log.Errorf("MutateUser: %v", err)
@@ -457,6 +575,8 @@ func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
 			return err
 		}
 		user.TokenKey = etk
+		user.ForcePasswordChange = false
+		user.RevokeAllTokens()
 		pk, hasSK, err := stingle.DecodeKeyBundle(user.KeyBundle)
 		if err != nil {
 			log.Errorf("DecodeKeyBundle: %v", err)
@@ -505,8 +625,14 @@ func (s *Server) handleDeleteUser(user database.User, req *http.Request) *stingl
 	if err != nil || bcrypt.CompareHashAndPassword(hashed, []byte(pass)) != nil {
 		return stingle.ResponseNOK().AddError("Invalid credentials")
 	}
+	if user.Limited != nil {
+		return stingle.ResponseNOK().AddError("Limited accounts can't be deleted")
+	}
 	if err := s.db.DeleteUser(user); err != nil {
 		log.Errorf("DeleteUser: %v", err)
+		if err == database.ErrOnHold {
+			return stingle.ResponseNOK().AddError("This account is on hold. Nothing can be deleted.")
+		}
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
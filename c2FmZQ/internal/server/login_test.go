@@ -20,12 +20,16 @@ package server_test
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
 	"testing"
 
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -119,6 +123,212 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestTokenRevocation(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c1 := newClient(sock)
+	if err := c1.createAccount("alice"); err != nil {
+		t.Fatalf("c.createAccount failed: %v", err)
+	}
+	if err := c1.login(); err != nil {
+		t.Fatalf("c1.login failed: %v", err)
+	}
+	c2 := *c1
+	if err := c2.login(); err != nil {
+		t.Fatalf("c2.login failed: %v", err)
+	}
+	c3 := *c1
+	if err := c3.login(); err != nil {
+		t.Fatalf("c3.login failed: %v", err)
+	}
+
+	// Logout only revokes one token.
+	if err := c1.logout(); err != nil {
+		t.Fatalf("c1.logout failed: %v", err)
+	}
+	if err := c1.getServerPK(); err == nil {
+		t.Error("c1.getServerPK should have failed after logout")
+	}
+	if err := c2.getServerPK(); err != nil {
+		t.Errorf("c2.getServerPK failed: %v", err)
+	}
+
+	// Changing the password revokes all the other tokens.
+	if err := c2.changePass(); err != nil {
+		t.Fatalf("c2.changePass failed: %v", err)
+	}
+	if err := c2.getServerPK(); err != nil {
+		t.Errorf("c2.getServerPK failed: %v", err)
+	}
+	if err := c3.getServerPK(); err == nil {
+		t.Error("c3.getServerPK should have failed after changePass")
+	}
+}
+
+func TestForcePasswordChange(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	// The first account is an admin.
+	admin, err := createAccountAndLogin(sock, "admin")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin: %v", err)
+	}
+	bob, err := createAccountAndLogin(sock, "bob")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin: %v", err)
+	}
+	data, err := admin.adminUsers(nil)
+	if err != nil {
+		t.Fatalf("admin.adminUsers failed: %v", err)
+	}
+	reset := true
+	changes := &database.AdminData{
+		Tag:   data.Tag,
+		Users: []database.AdminUser{{UserID: bob.userID, ResetPassword: &reset}},
+	}
+	if _, err := admin.adminUsers(changes); err != nil {
+		t.Fatalf("admin.adminUsers failed: %v", err)
+	}
+
+	// Bob's sessions are revoked.
+	if err := bob.getServerPK(); err == nil {
+		t.Error("bob.getServerPK should have failed")
+	}
+	form := url.Values{}
+	form.Set("email", bob.email)
+	form.Set("password", bob.password)
+	sr, err := bob.sendRequest("/v2/login/login", form)
+	if err != nil || sr.Status != "ok" {
+		t.Fatalf("login failed: %v %v", err, sr)
+	}
+	if want, got := "1", sr.Part("passwordChangeRequired"); want != got {
+		t.Errorf("login: passwordChangeRequired = %v, want %q", got, want)
+	}
+	if err := bob.login(); err != nil {
+		t.Fatalf("bob.login failed: %v", err)
+	}
+	// Everything except changing the password fails.
+	_, err = bob.getUpdates(0, 0, 0, 0, 0, 0)
+	if sr, ok := err.(*stingle.Response); !ok || sr.Part("passwordChangeRequired") != "1" {
+		t.Errorf("bob.getUpdates: got %v, want passwordChangeRequired", err)
+	}
+	if err := bob.changePass(); err != nil {
+		t.Fatalf("bob.changePass failed: %v", err)
+	}
+	if _, err := bob.getUpdates(0, 0, 0, 0, 0, 0); err != nil {
+		t.Errorf("bob.getUpdates failed: %v", err)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	for _, policy := range []string{server.SessionLimitReject, server.SessionLimitEvict} {
+		t.Run(policy, func(t *testing.T) {
+			sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+				s.MaxSessions = 2
+				s.SessionLimitPolicy = policy
+			})
+			defer shutdown()
+
+			dialer := dialer{sock: sock}
+			hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+			resp, err := hc.Get("http://unix/v2x/config/capabilities")
+			if err != nil {
+				t.Fatalf("hc.Get: %v", err)
+			}
+			var caps server.Capabilities
+			err = json.NewDecoder(resp.Body).Decode(&caps)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if want := (server.Capabilities{MaxSessions: 2, SessionLimitPolicy: policy}); caps != want {
+				t.Errorf("Capabilities = %+v, want %+v", caps, want)
+			}
+
+			c1, err := createAccountAndLogin(sock, "alice")
+			if err != nil {
+				t.Fatalf("createAccountAndLogin: %v", err)
+			}
+			c2 := *c1
+			if err := c2.login(); err != nil {
+				t.Fatalf("c2.login failed: %v", err)
+			}
+			c3 := *c1
+			err = c3.login()
+			if policy == server.SessionLimitReject {
+				if sr, ok := err.(*stingle.Response); !ok || sr.Part("sessionLimit") != "1" {
+					t.Fatalf("c3.login: got %v, want sessionLimit", err)
+				}
+				// Logging out frees a session.
+				if err := c1.logout(); err != nil {
+					t.Fatalf("c1.logout failed: %v", err)
+				}
+				if err := c3.login(); err != nil {
+					t.Fatalf("c3.login failed: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c3.login failed: %v", err)
+			}
+			// The oldest session was evicted.
+			if err := c1.getServerPK(); err == nil {
+				t.Error("c1.getServerPK should have failed")
+			}
+			for _, c := range []*client{&c2, &c3} {
+				if err := c.getServerPK(); err != nil {
+					t.Errorf("getServerPK failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func (c *client) adminUsers(changes *database.AdminData) (*database.AdminData, error) {
+	params := make(map[string]string)
+	if changes != nil {
+		b, err := json.Marshal(changes)
+		if err != nil {
+			return nil, err
+		}
+		params["changes"] = string(b)
+	}
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+	sr, err := c.sendRequest("/v2x/admin/users", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	b, err := c.secretKey.SealBoxOpenBase64(sr.Part("users").(string))
+	if err != nil {
+		return nil, err
+	}
+	var data database.AdminData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (c *client) logout() error {
+	form := url.Values{}
+	form.Set("token", c.token)
+	sr, err := c.sendRequest("/v2/login/logout", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
 func (c *client) createAccount(email string) error {
 	c.email = email
 	c.password = "PASSWORD"
@@ -0,0 +1,56 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+)
+
+const (
+	// The maximum number of distinct values of the uri label in the request
+	// metrics. Each registered route is one value.
+	maxURILabels = 200
+)
+
+// uriLabel returns the value of the uri label to use in the request metrics
+// for req. It is the pattern of the route that handles the request, e.g.
+// /v2/download/, instead of the full URL, so that URLs with tokens or query
+// strings don't create new time series. The number of distinct values is
+// limited.
+func (s *Server) uriLabel(req *http.Request) string {
+	if s.mux == nil {
+		return "other"
+	}
+	_, pattern := s.mux.Handler(req)
+	if pattern == "" {
+		return "other"
+	}
+	s.uriLabelsMutex.Lock()
+	defer s.uriLabelsMutex.Unlock()
+	if s.uriLabels[pattern] {
+		return pattern
+	}
+	if len(s.uriLabels) >= maxURILabels {
+		return "other"
+	}
+	if s.uriLabels == nil {
+		s.uriLabels = make(map[string]bool)
+	}
+	s.uriLabels[pattern] = true
+	return pattern
+}
@@ -0,0 +1,61 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestURILabel(t *testing.T) {
+	s := &Server{mux: http.NewServeMux()}
+	nop := func(http.ResponseWriter, *http.Request) {}
+	s.mux.HandleFunc("/v2/download/", nop)
+	s.mux.HandleFunc("/v2/sync/upload", nop)
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"/v2/download/c2VjcmV0LXRva2Vu", "/v2/download/"},
+		{"/v2/download/b3RoZXItdG9rZW4?x=1", "/v2/download/"},
+		{"/v2/sync/upload?foo=bar", "/v2/sync/upload"},
+		{"/not/registered", "other"},
+	} {
+		if got := s.uriLabel(httptest.NewRequest("GET", tc.url, nil)); got != tc.want {
+			t.Errorf("uriLabel(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+
+	for i := len(s.uriLabels); i < maxURILabels; i++ {
+		p := fmt.Sprintf("/route%d", i)
+		s.mux.HandleFunc(p, nop)
+		if got := s.uriLabel(httptest.NewRequest("GET", p, nil)); got != p {
+			t.Fatalf("uriLabel(%q) = %q", p, got)
+		}
+	}
+	s.mux.HandleFunc("/new", nop)
+	if got := s.uriLabel(httptest.NewRequest("GET", "/new", nil)); got != "other" {
+		t.Errorf("uriLabel(/new) = %q, want other", got)
+	}
+	if got := s.uriLabel(httptest.NewRequest("GET", "/v2/download/x", nil)); got != "/v2/download/" {
+		t.Errorf("uriLabel(/v2/download/x) = %q, want /v2/download/", got)
+	}
+}
@@ -164,7 +164,7 @@ func (s *Server) handleApproveMFA(user database.User, req *http.Request) *stingl
 
 func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod time.Duration) (*stingle.Response, bool) {
 	if _, passcode := parseOTP(req.PostFormValue("email")); passcode != "" {
-		if !validateOTP(user.OTPKey, passcode) {
+		if !s.checkOTP(user, passcode) {
 			return stingle.ResponseNOK(), false
 		}
 		return nil, false
@@ -244,7 +244,7 @@ func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *sting
 		return failResp
 	}
 	if data.OTP != "" {
-		if !validateOTP(user.OTPKey, data.OTP) {
+		if !s.checkOTP(user, data.OTP) {
 			log.Info("checkMFAResponse: OTP check failed")
 			return failResp
 		}
@@ -374,9 +374,16 @@ func (s *Server) handleMFACheck(user database.User, req *http.Request) *stingle.
 //
 // Returns:
 //   - stingle.Response(ok)
+//     Part(mfaEnabled, Whether MFA is required)
+//     Part(otpEnabled, Whether OTP is enabled)
+//     Part(otpRequired, Whether the server requires OTP)
+//     Part(backupCodes, The number of unused OTP backup codes)
+//     Part(passKey, Whether passkeys are used)
 func (s *Server) handleMFAStatus(user database.User, req *http.Request) *stingle.Response {
 	return stingle.ResponseOK().
 		AddPart("mfaEnabled", user.RequireMFA).
 		AddPart("otpEnabled", user.OTPKey != "").
+		AddPart("otpRequired", s.RequireOTP).
+		AddPart("backupCodes", len(user.OTPBackupCodes)).
 		AddPart("passKey", user.WebAuthnConfig.UsePasskey)
 }
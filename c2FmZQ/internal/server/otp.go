@@ -19,19 +19,37 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"image/png"
 	"net/http"
+	"strings"
 
 	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
+// The number of backup codes that are generated when OTP is enabled.
+const numOTPBackupCodes = 10
+
+// otpEnrollmentEndpoints are the endpoints that users can still use when
+// they must enable OTP, see RequireOTP. All the others fail with the
+// otpRequired part.
+var otpEnrollmentEndpoints = map[string]bool{
+	"/v2x/config/generateOTP": true,
+	"/v2x/config/setOTP":      true,
+	"/v2x/mfa/status":         true,
+	"/v2/login/logout":        true,
+	"/v2/keys/getServerPK":    true,
+}
+
 // handleGenerateOTP handles the /v2x/config/generateOTP endpoint.
 //
 // Arguments:
@@ -84,6 +102,7 @@ func (s *Server) handleGenerateOTP(user database.User, req *http.Request) *sting
 //
 // Returns:
 //   - stingle.Response(ok)
+//     Parts("backupCodes", the one-time backup codes, when OTP is enabled)
 func (s *Server) handleSetOTP(user database.User, req *http.Request) *stingle.Response {
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
@@ -97,8 +116,20 @@ func (s *Server) handleSetOTP(user database.User, req *http.Request) *stingle.Re
 		return stingle.ResponseNOK().
 			AddError("code is invalid")
 	}
+	if key == "" && s.RequireOTP {
+		return stingle.ResponseNOK().
+			AddError("OTP is required on this server")
+	}
+	var codes, hashes []string
+	if key != "" {
+		if codes, hashes, err = newOTPBackupCodes(); err != nil {
+			log.Errorf("newOTPBackupCodes: %v", err)
+			return stingle.ResponseNOK()
+		}
+	}
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
 		user.OTPKey = key
+		user.OTPBackupCodes = hashes
 		if user.RequireMFA && !mfaAvailableForUser(*user) {
 			return errors.New("no MFA method left")
 		}
@@ -111,11 +142,93 @@ func (s *Server) handleSetOTP(user database.User, req *http.Request) *stingle.Re
 	if key == "" {
 		resp.AddInfo("OTP disabled")
 	} else {
-		resp.AddInfo("OTP enabled")
+		resp.AddInfo("OTP enabled").AddPart("backupCodes", codes)
 	}
 	return resp
 }
 
+// newOTPBackupCodes returns new backup codes, and their hashes.
+func newOTPBackupCodes() (codes, hashes []string, err error) {
+	for i := 0; i < numOTPBackupCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		h, err := otpBackupCodeHash(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, c[:4]+"-"+c[4:])
+		hashes = append(hashes, h)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeOTPBackupCode returns code in the form that is hashed. The codes
+// are not case sensitive, and the dashes and spaces are ignored.
+func normalizeOTPBackupCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// otpBackupCodeHash returns the bcrypt hash of a backup code. The hash doesn't
+// depend on the master key, so that the codes still work after the database
+// is re-encrypted.
+func otpBackupCodeHash(code string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(normalizeOTPBackupCode(code)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// matchOTPBackupCode returns true if code matches the hash of a backup code.
+func matchOTPBackupCode(hash, code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalizeOTPBackupCode(code))) == nil
+}
+
+// checkOTP returns true if passcode is the user's current OTP code, or one of
+// the user's backup codes. The backup codes can only be used once.
+func (s *Server) checkOTP(user *database.User, passcode string) bool {
+	if validateOTP(user.OTPKey, passcode) {
+		return true
+	}
+	if passcode == "" || len(user.OTPBackupCodes) == 0 {
+		return false
+	}
+	// The hashes are slow to compare. Find the matching one before
+	// locking the user.
+	var hash string
+	for _, c := range user.OTPBackupCodes {
+		if matchOTPBackupCode(c, passcode) {
+			hash = c
+			break
+		}
+	}
+	if hash == "" {
+		return false
+	}
+	var found bool
+	if err := s.db.MutateUser(user.UserID, func(u *database.User) error {
+		for i, c := range u.OTPBackupCodes {
+			if c == hash {
+				u.OTPBackupCodes = append(u.OTPBackupCodes[:i], u.OTPBackupCodes[i+1:]...)
+				found = true
+				break
+			}
+		}
+		*user = *u
+		return nil
+	}); err != nil {
+		log.Errorf("MutateUser: %v", err)
+		return false
+	}
+	if found {
+		log.Infof("UserID:%d used an OTP backup code, %d left", user.UserID, len(user.OTPBackupCodes))
+	}
+	return found
+}
+
 func validateOTP(key, passcode string) bool {
 	if key == "" && passcode == "" {
 		return true
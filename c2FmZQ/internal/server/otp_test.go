@@ -20,10 +20,14 @@ package server_test
 import (
 	"errors"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pquerna/otp/totp"
+
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
 )
 
 func TestOTP(t *testing.T) {
@@ -38,6 +42,88 @@ func TestOTP(t *testing.T) {
 	if err := c.registerOTP(); err != nil {
 		t.Fatalf("c.registerOTP failed: %v", err)
 	}
+	if got := len(c.otpBackupCodes); got != 10 {
+		t.Errorf("Got %d backup codes, want 10", got)
+	}
+}
+
+func TestOTPBackupCodes(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.registerOTP(); err != nil {
+		t.Fatalf("c.registerOTP failed: %v", err)
+	}
+	if err := c.mfaEnable(true, false); err != nil {
+		t.Fatalf("c.mfaEnable failed: %v", err)
+	}
+
+	loginWithCode := func(code string) string {
+		form := url.Values{}
+		form.Set("email", code+"%"+c.email)
+		form.Set("password", c.password)
+		sr, err := c.sendRequest("/v2/login/login", form)
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		return sr.Status
+	}
+	code := c.otpBackupCodes[0]
+	if got := loginWithCode(strings.ToUpper(code)); got != "ok" {
+		t.Errorf("Login with backup code: status %q, want ok", got)
+	}
+	// The code can only be used once.
+	if got := loginWithCode(code); got != "nok" {
+		t.Errorf("Login with used backup code: status %q, want nok", got)
+	}
+	if got := loginWithCode("aaaa-bbbb"); got != "nok" {
+		t.Errorf("Login with invalid backup code: status %q, want nok", got)
+	}
+	if got := loginWithCode(c.otpBackupCodes[1]); got != "ok" {
+		t.Errorf("Login with backup code: status %q, want ok", got)
+	}
+}
+
+func TestRequireOTP(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.RequireOTP = true
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	// Everything except enabling OTP fails.
+	_, err = c.getUpdates(0, 0, 0, 0, 0, 0)
+	if sr, ok := err.(*stingle.Response); !ok || sr.Part("otpRequired") != "1" {
+		t.Errorf("c.getUpdates: got %v, want otpRequired", err)
+	}
+	if err := c.registerOTP(); err != nil {
+		t.Fatalf("c.registerOTP failed: %v", err)
+	}
+	if _, err := c.getUpdates(0, 0, 0, 0, 0, 0); err != nil {
+		t.Errorf("c.getUpdates failed: %v", err)
+	}
+	// OTP can't be disabled.
+	if err := c.setOTP("", ""); err == nil {
+		t.Error("c.setOTP should have failed")
+	}
+	// The login requires an OTP code.
+	form := url.Values{}
+	form.Set("email", c.email)
+	form.Set("password", c.password)
+	form.Set("mfa", `{"otp":"000000"}`)
+	if sr, err := c.sendRequest("/v2/login/login", form); err != nil || sr.Status != "nok" {
+		t.Errorf("login with invalid OTP: %v, %v", sr, err)
+	}
+	if err := c.login(); err != nil {
+		t.Errorf("c.login failed: %v", err)
+	}
 }
 
 func (c *client) registerOTP() error {
@@ -81,5 +167,10 @@ func (c *client) setOTP(key, code string) error {
 		return errors.New("Expected OTP Enabled")
 	}
 	c.otpKey = key
+	c.otpBackupCodes = nil
+	codes, _ := sr.Part("backupCodes").([]interface{})
+	for _, code := range codes {
+		c.otpBackupCodes = append(c.otpBackupCodes, code.(string))
+	}
 	return nil
 }
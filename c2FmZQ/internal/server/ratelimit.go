@@ -0,0 +1,165 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server/limit"
+)
+
+// maxRateLimitWait is the longest time that a request waits for its turn
+// before it is rejected.
+const maxRateLimitWait = 10 * time.Second
+
+// RateLimitPolicy contains the rate limits of the endpoints that don't
+// require authentication, e.g. createAccount, preLogin, and login.
+type RateLimitPolicy struct {
+	// Default applies to each endpoint that isn't in Endpoints. Each
+	// endpoint has its own buckets.
+	Default limit.Rate
+	// Endpoints are the rates of specific endpoints, by path without the
+	// path prefix, e.g. "/v2/login/login".
+	Endpoints map[string]limit.Rate
+	// Exempt are the networks that aren't rate limited, e.g. a trusted
+	// internal network.
+	Exempt []*net.IPNet
+}
+
+// DefaultRateLimitPolicy returns the default policy: 0.5 request per second
+// for each endpoint, shared by all the clients.
+func DefaultRateLimitPolicy() RateLimitPolicy {
+	return RateLimitPolicy{Default: limit.Rate{Global: 0.5, Burst: 1}}
+}
+
+// NewRateLimitPolicy parses the rate limit options and returns a
+// RateLimitPolicy. rates is a comma-separated list of ENDPOINT=RATE, where
+// ENDPOINT is a path, e.g. /v2/login/login, or "default", and RATE is
+// GLOBAL[:PERIP[:BURST]] in requests per second, e.g. "1:0.2:5". Endpoints
+// that aren't listed use the default rate. exempt is a comma-separated list
+// of networks in CIDR notation, e.g. "10.0.0.0/8,192.168.0.0/16".
+func NewRateLimitPolicy(rates, exempt string) (RateLimitPolicy, error) {
+	p := DefaultRateLimitPolicy()
+	for _, v := range splitList(rates) {
+		endpoint, spec, ok := strings.Cut(v, "=")
+		if !ok {
+			return p, fmt.Errorf("invalid rate limit %q", v)
+		}
+		r, err := parseRate(spec)
+		if err != nil {
+			return p, fmt.Errorf("invalid rate limit %q: %w", v, err)
+		}
+		if endpoint = strings.TrimSpace(endpoint); endpoint == "default" {
+			p.Default = r
+			continue
+		}
+		if !strings.HasPrefix(endpoint, "/") {
+			return p, fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+		if p.Endpoints == nil {
+			p.Endpoints = make(map[string]limit.Rate)
+		}
+		p.Endpoints[endpoint] = r
+	}
+	for _, v := range splitList(exempt) {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return p, err
+		}
+		p.Exempt = append(p.Exempt, n)
+	}
+	return p, nil
+}
+
+func parseRate(s string) (limit.Rate, error) {
+	var r limit.Rate
+	f := strings.Split(strings.TrimSpace(s), ":")
+	if len(f) > 3 {
+		return r, fmt.Errorf("too many fields")
+	}
+	var err error
+	if r.Global, err = strconv.ParseFloat(f[0], 64); err != nil || r.Global < 0 {
+		return r, fmt.Errorf("invalid global rate %q", f[0])
+	}
+	if len(f) > 1 {
+		if r.PerClient, err = strconv.ParseFloat(f[1], 64); err != nil || r.PerClient < 0 {
+			return r, fmt.Errorf("invalid per-IP rate %q", f[1])
+		}
+	}
+	if len(f) > 2 {
+		if r.Burst, err = strconv.Atoi(f[2]); err != nil || r.Burst <= 0 {
+			return r, fmt.Errorf("invalid burst %q", f[2])
+		}
+	}
+	return r, nil
+}
+
+// isExempt returns whether ip is in one of the exempt networks.
+func (p RateLimitPolicy) isExempt(ip net.IP) bool {
+	return containsIP(p.Exempt, ip)
+}
+
+// rateLimiter returns the RateLimiter of an endpoint. The limiters are
+// created when they are first used, after the options are set.
+func (s *Server) rateLimiter(endpoint string) *limit.RateLimiter {
+	if v, ok := s.rateLimiters.Load(endpoint); ok {
+		return v.(*limit.RateLimiter)
+	}
+	r, ok := s.RateLimitPolicy.Endpoints[endpoint]
+	if !ok {
+		r = s.RateLimitPolicy.Default
+	}
+	v, _ := s.rateLimiters.LoadOrStore(endpoint, limit.NewRateLimiter(r))
+	return v.(*limit.RateLimiter)
+}
+
+// checkRateLimit waits until req can proceed. It returns false, after
+// sending an error, when req is rejected.
+func (s *Server) checkRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	host := remoteHost(req)
+	if ip := net.ParseIP(host); ip != nil && s.RateLimitPolicy.isExempt(ip) {
+		return true
+	}
+	// The endpoint is the pattern that matched req, so that the number of
+	// limiters doesn't depend on the requests.
+	_, pattern := s.mux.Handler(req)
+	endpoint := strings.TrimPrefix(pattern, s.pathPrefix)
+	delay, ok := s.rateLimiter(endpoint).Reserve(host, maxRateLimitWait)
+	if !ok {
+		log.Infof("Rate limited: %s %s", host, endpoint)
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay/time.Second)+1))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-req.Context().Done():
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
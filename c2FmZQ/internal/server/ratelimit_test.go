@@ -0,0 +1,100 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/server/limit"
+)
+
+func TestNewRateLimitPolicy(t *testing.T) {
+	p, err := server.NewRateLimitPolicy("default=2, /v2/login/login=1:0.2:5, /v2/login/preLogin=0:1", "10.0.0.0/8, 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("NewRateLimitPolicy: %v", err)
+	}
+	_, n1, _ := net.ParseCIDR("10.0.0.0/8")
+	_, n2, _ := net.ParseCIDR("2001:db8::/32")
+	want := server.RateLimitPolicy{
+		Default: limit.Rate{Global: 2},
+		Endpoints: map[string]limit.Rate{
+			"/v2/login/login":    {Global: 1, PerClient: 0.2, Burst: 5},
+			"/v2/login/preLogin": {PerClient: 1},
+		},
+		Exempt: []*net.IPNet{n1, n2},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("NewRateLimitPolicy() = %+v, want %+v", p, want)
+	}
+
+	for _, tc := range []struct{ rates, exempt string }{
+		{"login=1", ""},
+		{"/v2/login/login", ""},
+		{"/v2/login/login=x", ""},
+		{"/v2/login/login=1:-1", ""},
+		{"/v2/login/login=1:1:0", ""},
+		{"/v2/login/login=1:1:1:1", ""},
+		{"", "10.0.0.1"},
+	} {
+		if _, err := server.NewRateLimitPolicy(tc.rates, tc.exempt); err == nil {
+			t.Errorf("NewRateLimitPolicy(%q, %q) didn't fail", tc.rates, tc.exempt)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		exempt string
+		want   []int
+	}{
+		{"", []int{http.StatusOK, http.StatusTooManyRequests}},
+		{"127.0.0.0/8,::1/128", []int{http.StatusOK, http.StatusOK}},
+	} {
+		p, err := server.NewRateLimitPolicy("/v2/login/preLogin=0:0.001", tc.exempt)
+		if err != nil {
+			t.Fatalf("NewRateLimitPolicy: %v", err)
+		}
+		db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+		s := server.New(db, "", "", "")
+		s.RateLimitPolicy = p
+		srv := httptest.NewServer(s.Handler())
+
+		for i, want := range tc.want {
+			resp, err := srv.Client().PostForm(srv.URL+"/v2/login/preLogin", url.Values{"email": {"alice@"}})
+			if err != nil {
+				t.Fatalf("PostForm: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.StatusCode; got != want {
+				t.Errorf("[%q] %d: status code = %d, want %d", tc.exempt, i, got, want)
+			}
+			if got := resp.Header.Get("Retry-After"); (got != "") != (want == http.StatusTooManyRequests) {
+				t.Errorf("[%q] %d: Retry-After = %q", tc.exempt, i, got)
+			}
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const requestIDKey ctxKey = 2
+
+var reqPanics = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "server_panics_total",
+		Help: "Number of requests that caused a panic",
+	},
+	[]string{"method", "uri"},
+)
+
+func init() {
+	prometheus.MustRegister(reqPanics)
+}
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request with this context.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// recoverPanic wraps a handler to recover from panics. The stack trace is
+// logged with the request ID, which is also sent to the client in the
+// X-Request-Id header, and the client gets an error response instead of a
+// closed connection.
+func (s *Server) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := newRequestID()
+		w.Header().Set("X-Request-Id", id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey, id))
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			reqPanics.WithLabelValues(req.Method, s.uriLabel(req)).Inc()
+			log.Errorf("PANIC [%s] %s %s: %v\n%s", id, req.Method, req.URL, r, log.Stack())
+			if strings.HasPrefix(req.URL.Path, s.pathPrefix+"/v2") {
+				if err := stingle.ResponseNOK().AddError("Internal error. Request ID: " + id).Send(w); err != nil {
+					log.Errorf("Send: %v", err)
+				}
+				return
+			}
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	s := &Server{}
+	h := s.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requestID(req.Context()) == "" {
+			t.Error("missing request ID")
+		}
+		if req.URL.Path == "/ok" {
+			w.Write([]byte("ok"))
+			return
+		}
+		panic("boom")
+	}))
+	before := panicCount(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/ok", nil))
+	if got := w.Body.String(); got != "ok" {
+		t.Errorf("Body = %q, want ok", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v2/sync/getUpdates", nil))
+	id := w.Header().Get("X-Request-Id")
+	if id == "" {
+		t.Error("missing X-Request-Id header")
+	}
+	var sr stingle.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", w.Body.String(), err)
+	}
+	if sr.Status != "nok" || len(sr.Errors) != 1 || !strings.Contains(sr.Errors[0], id) {
+		t.Errorf("Unexpected response: %#v", sr)
+	}
+	if got := panicCount(t); got != before+1 {
+		t.Errorf("panic counter = %v, want %v", got, before+1)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Code = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func panicCount(t *testing.T) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var n float64
+	for _, mf := range mfs {
+		if mf.GetName() != "server_panics_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			n += m.GetCounter().GetValue()
+		}
+	}
+	return n
+}
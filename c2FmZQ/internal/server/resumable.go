@@ -0,0 +1,248 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/timing"
+)
+
+// Resumable uploads let clients upload large files, e.g. videos, over flaky
+// connections. The client starts an upload session with
+// /v2x/upload/create, sends the file content in chunks with
+// /v2x/upload/chunk, and, if a chunk fails, asks for the current offset
+// with /v2x/upload/status and continues from there. When all the content
+// was received, the file is added with /v2/sync/upload, with an uploadId
+// form argument instead of the file part.
+
+// handleUploadCreate handles the /v2x/upload/create endpoint. It starts a new
+// resumable upload session.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - size: The size of the file content.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - uploadId: The ID of the upload session.
+//   - offset: The offset of the first chunk, i.e. 0.
+func (s *Server) handleUploadCreate(user database.User, req *http.Request) *stingle.Response {
+	if user.NeedApproval {
+		return stingle.ResponseNOK().AddError("Account is not approved yet")
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	session, err := s.db.StartUpload(user, parseInt(params["size"], -1))
+	if err == database.ErrQuotaExceeded {
+		return stingle.ResponseNOK().AddError("Quota exceeded")
+	}
+	if err != nil {
+		log.Errorf("StartUpload: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("uploadId", session.ID).
+		AddPart("offset", session.Offset)
+}
+
+// handleUploadStatus handles the /v2x/upload/status endpoint. It returns the
+// offset where the next chunk of a resumable upload must start.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - params: The encrypted parameters
+//   - uploadId: The ID of the upload session.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - offset: The number of bytes received so far.
+//   - size: The size of the file content.
+func (s *Server) handleUploadStatus(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	session, err := s.db.UploadSession(user, params["uploadId"])
+	if err == database.ErrUploadNotFound {
+		return stingle.ResponseNOK().AddPart("notFound", "1")
+	}
+	if err != nil {
+		log.Errorf("UploadSession: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("offset", session.Offset).
+		AddPart("size", session.Size)
+}
+
+// handleUploadChunk handles the /v2x/upload/chunk endpoint. It receives one
+// chunk of a resumable upload. The request is a multipart/form-data. The
+// token, uploadId, and offset must come before the chunk.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - uploadId: The ID of the upload session.
+//   - offset: Where the chunk starts, which must be the end of the previous
+//     chunk.
+//   - chunk: The content of the chunk.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts:
+//   - offset: The number of bytes received so far.
+//   - stingle.Response(nok) when the offset is wrong
+//     Parts:
+//   - offset: The offset where the next chunk must start.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, req *http.Request) {
+	sr := s.receiveChunk(req)
+	if err := sr.Send(w); err != nil {
+		log.Errorf("Send: %v", err)
+	}
+	reqStatus.WithLabelValues(req.Method, s.uriLabel(req), sr.Status).Inc()
+}
+
+func (s *Server) receiveChunk(req *http.Request) *stingle.Response {
+	ctx := req.Context()
+	mr, err := req.MultipartReader()
+	if err != nil {
+		log.Errorf("receiveChunk: %v", err)
+		return stingle.ResponseNOK()
+	}
+	var (
+		user   *database.User
+		id     string
+		offset int64 = -1
+	)
+	for {
+		s.setDeadline(ctx, time.Now().Add(time.Minute))
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			log.Error("receiveChunk: no chunk")
+			return stingle.ResponseNOK()
+		}
+		if err != nil {
+			log.Errorf("receiveChunk: %v", err)
+			return stingle.ResponseNOK()
+		}
+		if p.FormName() == "chunk" {
+			if user == nil || id == "" || offset < 0 {
+				log.Error("receiveChunk: token, uploadId, and offset must come before the chunk")
+				return stingle.ResponseNOK()
+			}
+			done := timing.FromContext(ctx).Start("blob")
+			var n int64
+			session, err := s.db.AppendUpload(*user, id, offset, func(w io.Writer) (int64, error) {
+				var err error
+				n, err = s.copyWithCtx(ctx, w, p)
+				return n, err
+			})
+			done()
+			s.db.RecordUsage(user.UserID, database.DailyUsage{
+				Requests:      1,
+				BytesUploaded: n,
+			})
+			if err == database.ErrUploadOffset {
+				if session == nil {
+					session, err = s.db.UploadSession(*user, id)
+				}
+				if session != nil {
+					return stingle.ResponseNOK().AddPart("offset", session.Offset)
+				}
+			}
+			if err == database.ErrUploadNotFound {
+				return stingle.ResponseNOK().AddPart("notFound", "1")
+			}
+			if err == database.ErrUploadSize {
+				return stingle.ResponseNOK().AddError("Chunk exceeds the upload size")
+			}
+			if err != nil {
+				log.Errorf("AppendUpload: %v", err)
+				return stingle.ResponseNOK()
+			}
+			return stingle.ResponseOK().AddPart("offset", session.Offset)
+		}
+		buf := make([]byte, 2048)
+		sz, err := io.ReadFull(p, buf)
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			log.Errorf("receiveChunk: %q is more than 2KB in size", p.FormName())
+			return stingle.ResponseNOK()
+		}
+		slurp := string(buf[:sz])
+		switch p.FormName() {
+		case "token":
+			done := timing.FromContext(ctx).Start("auth")
+			_, u, err := s.checkToken(slurp, "session")
+			done()
+			if err != nil {
+				log.Errorf("receiveChunk: checkToken failed: %v", err)
+				s.logAuthFailure(req, authFailureToken, "")
+				return stingle.ResponseNOK().AddPart("logout", "1").AddError("You are not logged in")
+			}
+			log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, u.UserID)
+			u = u.WithContext(ctx)
+			user = &u
+		case "uploadId":
+			id = slurp
+		case "offset":
+			if offset, err = strconv.ParseInt(slurp, 10, 64); err != nil || offset < 0 {
+				log.Errorf("receiveChunk: invalid offset %q", slurp)
+				return stingle.ResponseNOK()
+			}
+		default:
+			log.Errorf("receiveChunk: unexpected form input: %q=%q", p.FormName(), slurp)
+		}
+	}
+}
+
+// finishResumableUpload assembles the content of the resumable upload
+// session up.uploadID into up.FileSpec.StoreFile.
+func (s *Server) finishResumableUpload(user database.User, up *upload) error {
+	if up.FileSpec.StoreFile != "" {
+		return errors.New("request has both file and uploadId")
+	}
+	name, size, err := s.db.FinishUpload(user, up.uploadID)
+	if err != nil {
+		return err
+	}
+	up.FileSpec.StoreFile = name
+	up.FileSpec.StoreFileSize = size
+	return nil
+}
@@ -0,0 +1,61 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleSetSeen handles the /v2x/sync/setSeen endpoint. It is used to update
+// the user's "last seen" marker in an album.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - content: The marker, encrypted by the client.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleSetSeen(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if err := s.db.SetSeenMarker(user, params["albumId"], params["content"]); err != nil {
+		log.Errorf("SetSeenMarker: %v", err)
+		if err == database.ErrSeenMarkerTooLarge {
+			return stingle.ResponseNOK().AddError("Marker too large")
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("You are not a member of the album")
+		}
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestSeenMarkers(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if err := alice.shareAlbum(stingle.Album{
+		AlbumID:     "album",
+		Permissions: "1111",
+		Members:     fmt.Sprintf("%d,%d", alice.userID, bob.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", bob.userID): "Bob's Sharing Key",
+		},
+	}); err != nil {
+		t.Fatalf("alice.shareAlbum failed: %v", err)
+	}
+
+	database.CurrentTimeForTesting = 2000
+	if err := bob.setSeen("album", "encrypted marker"); err != nil {
+		t.Fatalf("bob.setSeen failed: %v", err)
+	}
+	if err := carol.setSeen("album", "not a member"); err == nil {
+		t.Error("carol.setSeen succeeded unexpectedly")
+	}
+
+	got, err := alice.getSeenUpdates(0)
+	if err != nil {
+		t.Fatalf("alice.getSeenUpdates failed: %v", err)
+	}
+	want := []interface{}{
+		map[string]interface{}{
+			"albumId":      "album",
+			"userId":       fmt.Sprintf("%d", bob.userID),
+			"content":      "encrypted marker",
+			"dateModified": "2000",
+		},
+	}
+	if diff := compareLists(got, want); diff != nil {
+		t.Errorf("Unexpected seen markers: %v", diff)
+	}
+	if got, err = alice.getSeenUpdates(2000); err != nil || len(got) != 0 {
+		t.Errorf("alice.getSeenUpdates(2000) = %v, %v", got, err)
+	}
+}
+
+func (c *client) setSeen(albumID, content string) error {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["content"] = content
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/setSeen", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
+func (c *client) getSeenUpdates(seenST int64) ([]interface{}, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("seenST", fmt.Sprintf("%d", seenST))
+
+	sr, err := c.sendRequest("/v2/sync/getUpdates", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	seen, _ := sr.Parts.(map[string]interface{})["seen"].([]interface{})
+	return seen, nil
+}
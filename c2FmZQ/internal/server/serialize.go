@@ -0,0 +1,75 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// serialize wraps handlers that change the user's data. When
+// SerializeUserUpdates is set, these requests are handled one at a time for
+// each user, e.g. when the user has multiple devices, including across server
+// instances that share the database. The requests of different users are
+// still handled in parallel.
+func (s *Server) serialize(f func(database.User, *http.Request) *stingle.Response) func(database.User, *http.Request) *stingle.Response {
+	return func(user database.User, req *http.Request) *stingle.Response {
+		unlock, err := s.lockUser(req.Context(), user.UserID)
+		if err != nil {
+			log.Errorf("lockUser(%d): %v", user.UserID, err)
+			return stingle.ResponseNOK()
+		}
+		defer unlock()
+		return f(user, req)
+	}
+}
+
+// lockUser waits until no other update is in progress for the user, or until
+// ctx is done. The returned function must be called when the update is done.
+//
+// When multiple server instances share the database, the lock is also
+// acquired from the database's Locker, so that the updates are serialized
+// across all the instances. ctx is ignored while waiting for that lock.
+func (s *Server) lockUser(ctx context.Context, userID int64) (unlock func(), err error) {
+	if !s.SerializeUserUpdates {
+		return func() {}, nil
+	}
+	v, _ := s.userLocks.LoadOrStore(userID, make(chan struct{}, 1))
+	ch := v.(chan struct{})
+	select {
+	case ch <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !s.db.Clustered() {
+		return func() { <-ch }, nil
+	}
+	unlockDB, err := s.db.LockUser(userID)
+	if err != nil {
+		<-ch
+		return nil, err
+	}
+	return func() {
+		unlockDB()
+		<-ch
+	}, nil
+}
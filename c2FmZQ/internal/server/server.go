@@ -19,13 +19,11 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"io"
 	"net"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,16 +33,15 @@ import (
 	"github.com/hashicorp/golang-lru"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/crypto/acme/autocert"
-	"golang.org/x/time/rate"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
-	"c2FmZQ/internal/pwa"
+	"c2FmZQ/internal/secure"
 	"c2FmZQ/internal/server/basicauth"
 	"c2FmZQ/internal/server/limit"
 	"c2FmZQ/internal/stingle"
 	"c2FmZQ/internal/stingle/token"
+	"c2FmZQ/internal/timing"
 )
 
 type ctxKey int
@@ -96,6 +93,11 @@ func init() {
 	prometheus.MustRegister(respSize)
 }
 
+// Mailer sends email messages, e.g. *mail.Mailer.
+type Mailer interface {
+	Send(to []string, subject, body string) error
+}
+
 // An HTTP server that implements the Stingle server API.
 type Server struct {
 	AllowCreateAccount     bool
@@ -104,6 +106,107 @@ type Server struct {
 	Redirect404            string
 	MaxConcurrentRequests  int
 	EnableWebApp           bool
+	// WebAppDir is a directory from which the web app is served instead of
+	// the embedded files, e.g. a customized or newer build. It requires
+	// EnableWebApp.
+	WebAppDir string
+	// Mailer is used to send email messages. It is optional.
+	Mailer Mailer
+	// RequireEmailVerification makes new accounts verify their email
+	// address, with a link sent by email, before they can log in. It
+	// requires Mailer.
+	RequireEmailVerification bool
+	// EnableUsageReports enables the monthly email of API usage to the
+	// admins. It requires Mailer.
+	EnableUsageReports bool
+	// BillingAPIKey is the shared secret used by an external billing system
+	// to set user entitlements. It is also used to sign webhooks.
+	BillingAPIKey string
+	// BillingWebhookURL receives the events when users cross a threshold of
+	// their limits.
+	BillingWebhookURL string
+	// Branding customizes the appearance of the web app.
+	Branding Branding
+	// MaxParallelUploads is the number of files that a client can upload in
+	// parallel during an import.
+	MaxParallelUploads int
+	// MaxConcurrentUploads is the number of uploads that the server handles
+	// concurrently. Uploads have their own limit, separate from
+	// MaxConcurrentRequests, so that large uploads don't delay the other
+	// requests.
+	MaxConcurrentUploads int
+	// MaxSessions is the maximum number of valid sessions per account. Zero
+	// means no limit.
+	MaxSessions int
+	// SessionLimitPolicy is what happens when a user logs in with
+	// MaxSessions valid sessions: SessionLimitReject or SessionLimitEvict.
+	SessionLimitPolicy string
+	// LoginLockoutThreshold is the number of consecutive failed logins
+	// after which an account is locked out temporarily. Zero disables
+	// lockouts.
+	LoginLockoutThreshold int
+	// LoginLockoutDuration is how long an account is locked out the first
+	// time. It doubles with each additional failed login.
+	LoginLockoutDuration time.Duration
+	// RequireOTP makes OTP mandatory for all the users. The users who
+	// haven't enabled it yet can only enable it after they log in.
+	RequireOTP bool
+	// RecoveryDelay is how long the owner of an album key escrow has to
+	// deny a recovery request before the albums are shared with the
+	// recovery contact.
+	RecoveryDelay time.Duration
+	// GCInterval is the time between two runs of the garbage collector,
+	// which fixes the reference counts of the blobs and deletes the blobs
+	// that aren't referenced anymore. Zero disables it.
+	GCInterval time.Duration
+	// StorageMetricsInterval is the time between two updates of the
+	// storage metrics, e.g. the number of users, files, and bytes stored.
+	// Zero disables them.
+	StorageMetricsInterval time.Duration
+	// SerializeUserUpdates makes the server handle the requests that change
+	// a user's data one at a time for each user.
+	SerializeUserUpdates bool
+	// SlowRequestThreshold is the duration after which a request is logged
+	// with the time spent in each phase. Zero disables the log.
+	SlowRequestThreshold time.Duration
+	// AutocertFallbackSelfSigned makes RunWithAutocert use a self-signed
+	// certificate when a certificate can't be obtained.
+	AutocertFallbackSelfSigned bool
+	// TLSPolicy contains the TLS settings.
+	TLSPolicy TLSPolicy
+	// SnapshotStore receives the encrypted snapshots of the metadata. It is
+	// optional.
+	SnapshotStore secure.BlobStore
+	// SnapshotInterval is the time between metadata snapshots.
+	SnapshotInterval time.Duration
+	// SnapshotRetention is the number of metadata snapshots to keep.
+	SnapshotRetention int
+	// FirstRunSetup enables the first-run setup when no account exists.
+	// Accounts can't be created until the admin account is created with
+	// the setup token.
+	FirstRunSetup bool
+	// SetupToken is the one-time token of the first-run setup. When it is
+	// empty, a random token is generated and logged.
+	SetupToken string
+	// RateLimitPolicy contains the rate limits of the endpoints that don't
+	// require authentication.
+	RateLimitPolicy RateLimitPolicy
+	// AccessPolicy restricts the networks that can use the server, and
+	// contains the trusted reverse proxies.
+	AccessPolicy AccessPolicy
+	// AllowedOrigins are the origins of the web apps, other than the one
+	// served by this server, that can send requests from a browser, e.g.
+	// https://c2fmzq.org. "*" allows all origins.
+	AllowedOrigins []string
+	// MinPollInterval is the minimum time between two calls to getUpdates
+	// that the server suggests to the clients. The suggestion grows when
+	// requests are waiting for their turn. Zero means no suggestion when
+	// the server isn't busy.
+	MinPollInterval time.Duration
+	// AuthFailureLog receives the authentication failures, one per line,
+	// in a format that tools like fail2ban can parse. It is optional.
+	AuthFailureLog io.Writer
+
 	mux                    *http.ServeMux
 	srv                    *http.Server
 	db                     *database.Database
@@ -112,9 +215,37 @@ type Server struct {
 	pathPrefix             string
 	preLoginCache          *lru.Cache
 	checkKeyCache          *lru.Cache
+	updatesCache           *lru.Cache
+	requests               *limit.ConnLimiter
+	rateLimiters           sync.Map
+
+	setupMutex sync.Mutex
+	setupToken string
 
 	remoteMFAMutex sync.Mutex
 	remoteMFA      map[string]remoteMFAReq
+
+	authFailureMutex sync.Mutex
+
+	uploadSlotsMutex sync.Mutex
+	uploadSlots      map[uploadSlotKey]int
+
+	// uriLabels contains the values of the uri label of the request
+	// metrics. See uriLabel.
+	uriLabelsMutex sync.Mutex
+	uriLabels      map[string]bool
+
+	// userLocks contains a chan struct{} for each user. See lockUser.
+	userLocks sync.Map
+
+	jobs       *jobTracker
+	certStatus func() CertStatus
+
+	// bgOnce makes sure that the background jobs are only started once.
+	// bgCtx is cancelled by Shutdown to stop them.
+	bgOnce   sync.Once
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
 }
 
 type remoteMFAReq struct {
@@ -125,13 +256,25 @@ type remoteMFAReq struct {
 // New returns an instance of Server that's fully initialized and ready to run.
 func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	s := &Server{
-		MaxConcurrentRequests: 5,
-		mux:                   http.NewServeMux(),
-		db:                    db,
-		addr:                  addr,
-		pathPrefix:            pathPrefix,
-		remoteMFA:             make(map[string]remoteMFAReq),
+		MaxConcurrentRequests:  5,
+		MaxParallelUploads:     3,
+		MaxConcurrentUploads:   5,
+		LoginLockoutThreshold:  10,
+		LoginLockoutDuration:   time.Minute,
+		RecoveryDelay:          7 * 24 * time.Hour,
+		GCInterval:             24 * time.Hour,
+		StorageMetricsInterval: time.Hour,
+		RateLimitPolicy:        DefaultRateLimitPolicy(),
+		AllowedOrigins:         DefaultAllowedOrigins,
+		mux:                    http.NewServeMux(),
+		db:                     db,
+		addr:                   addr,
+		pathPrefix:             pathPrefix,
+		remoteMFA:              make(map[string]remoteMFAReq),
+		uploadSlots:            make(map[uploadSlotKey]int),
+		jobs:                   newJobTracker(),
 	}
+	s.bgCtx, s.bgCancel = context.WithCancel(context.Background())
 	cache, err := lru.New(10000)
 	if err != nil {
 		log.Fatalf("lru.New: %v", err)
@@ -141,6 +284,10 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 		log.Fatalf("lru.New: %v", err)
 	}
 	s.checkKeyCache = cache
+	if cache, err = lru.New(10000); err != nil {
+		log.Fatalf("lru.New: %v", err)
+	}
+	s.updatesCache = cache
 	if htdigest != "" {
 		var err error
 		if s.basicAuth, err = basicauth.New(htdigest); err != nil {
@@ -154,37 +301,19 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	if pathPrefix != "" {
 		s.mux.HandleFunc("/", s.handleNotFound)
 	}
-	s.mux.HandleFunc(pathPrefix+"/", func(w http.ResponseWriter, req *http.Request) {
-		if !s.EnableWebApp {
-			http.NotFound(w, req)
-			return
-		}
-		log.Infof("%s %s %s", req.Proto, req.Method, req.RequestURI)
-
-		p := strings.TrimPrefix(req.URL.Path, pathPrefix+"/")
-		if p == "" {
-			p = "index.html"
-		}
-		b, err := pwa.FS.ReadFile(p)
-		if err != nil {
-			http.NotFound(w, req)
-			return
-		}
-		switch filepath.Ext(p) {
-		case ".webmanifest":
-			w.Header().Set("Content-Type", "application/manifest+json")
-		}
-		http.ServeContent(w, req, p, startTime, bytes.NewReader(b))
-	})
+	s.mux.HandleFunc(pathPrefix+"/", s.handleWebApp)
 
 	s.mux.HandleFunc(pathPrefix+"/v2/", s.noauth(s.handleNotImplemented))
 	s.mux.HandleFunc(pathPrefix+"/v2/register/createAccount", s.noauth(s.handleCreateAccount))
+	s.mux.HandleFunc(pathPrefix+"/v2/register/verify", s.method("GET", s.handleVerifyEmail))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/preLogin", s.noauth(s.handlePreLogin))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/login", s.noauth(s.handleLogin))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/logout", s.auth(s.handleLogout))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/changePass", s.authMFA(time.Minute, s.handleChangePass))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/checkKey", s.noauth(s.handleCheckKey))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/recoverAccount", s.noauth(s.handleRecoverAccount))
+	s.mux.HandleFunc(pathPrefix+"/v2x/setup/status", s.noauth(s.handleSetupStatus))
+	s.mux.HandleFunc(pathPrefix+"/v2x/setup/complete", s.noauth(s.handleSetupComplete))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/deleteUser", s.authMFA(time.Duration(0), s.handleDeleteUser))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/changeEmail", s.authMFA(time.Minute, s.handleChangeEmail))
 	s.mux.HandleFunc(pathPrefix+"/v2/keys/getServerPK", s.auth(s.handleGetServerPK))
@@ -192,32 +321,73 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getUpdates", s.auth(s.handleGetUpdates))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/upload", s.method("POST", s.handleUpload))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/moveFile", s.auth(s.handleMoveFile))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/emptyTrash", s.auth(s.handleEmptyTrash))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/delete", s.auth(s.handleDelete))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/moveFile", s.auth(s.serialize(s.handleMoveFile)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/emptyTrash", s.auth(s.serialize(s.handleEmptyTrash)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/delete", s.auth(s.serialize(s.handleDelete)))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/download", s.method("POST", s.handleDownload))
 	s.mux.HandleFunc(pathPrefix+"/v2/download/", s.method("GET", s.handleTokenDownload))
+	s.mux.HandleFunc(pathPrefix+"/s/", s.method("GET", s.handleSharedAlbum))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getDownloadUrls", s.auth(s.handleGetDownloadUrls))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getUrl", s.auth(s.handleGetURL))
 
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/addAlbum", s.auth(s.handleAddAlbum))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/deleteAlbum", s.auth(s.handleDeleteAlbum))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/changeAlbumCover", s.auth(s.handleChangeAlbumCover))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/renameAlbum", s.auth(s.handleRenameAlbum))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/addAlbum", s.auth(s.serialize(s.handleAddAlbum)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/deleteAlbum", s.auth(s.serialize(s.handleDeleteAlbum)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/changeAlbumCover", s.auth(s.serialize(s.handleChangeAlbumCover)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/renameAlbum", s.auth(s.serialize(s.handleRenameAlbum)))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getContact", s.auth(s.handleGetContact))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/share", s.auth(s.handleShare))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/editPerms", s.auth(s.handleEditPerms))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/removeAlbumMember", s.auth(s.handleRemoveAlbumMember))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/unshareAlbum", s.auth(s.handleUnshareAlbum))
-	s.mux.HandleFunc(pathPrefix+"/v2/sync/leaveAlbum", s.auth(s.handleLeaveAlbum))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/share", s.auth(s.serialize(s.handleShare)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/editPerms", s.auth(s.serialize(s.handleEditPerms)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/removeAlbumMember", s.auth(s.serialize(s.handleRemoveAlbumMember)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/unshareAlbum", s.auth(s.serialize(s.handleUnshareAlbum)))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/leaveAlbum", s.auth(s.serialize(s.handleLeaveAlbum)))
 
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/generateOTP", s.auth(s.handleGenerateOTP))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/setOTP", s.authMFA(time.Minute, s.handleSetOTP))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/push", s.auth(s.handlePush))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/activeDevices", s.auth(s.handleActiveDevices))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/activity", s.auth(s.handleAccountActivity))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/exportAccount", s.method("POST", s.handleExportAccount))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/sessions/list", s.auth(s.handleSessionsList))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/sessions/revoke", s.authMFA(time.Minute, s.serialize(s.handleSessionsRevoke)))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/webauthn/keys", s.auth(s.handleWebAuthnKeys))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/webauthn/register", s.authMFA(time.Minute, s.handleWebAuthnRegister))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/webauthn/updateKeys", s.authMFA(time.Minute, s.handleWebAuthnUpdateKeys))
 	s.mux.HandleFunc(pathPrefix+"/v2x/admin/users", s.authMFA(5*time.Minute, s.handleAdminUsers))
+	s.mux.HandleFunc(pathPrefix+"/v2x/admin/usage", s.authMFA(5*time.Minute, s.handleAdminUsage))
+	s.mux.HandleFunc(pathPrefix+"/v2x/admin/cleanup", s.authMFA(5*time.Minute, s.handleAdminCleanup))
+	s.mux.HandleFunc(pathPrefix+"/v2x/family/accounts", s.authMFA(5*time.Minute, s.handleFamilyAccounts))
+	s.mux.HandleFunc(pathPrefix+"/v2x/billing/entitlements", s.handleBillingEntitlements)
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/branding", s.method("GET", s.handleBranding))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/csrf", s.method("GET", s.handleCSRFToken))
+	s.mux.HandleFunc(pathPrefix+"/v2x/config/capabilities", s.method("GET", s.handleCapabilities))
+	s.mux.HandleFunc(pathPrefix+"/v2x/health", s.method("GET", s.handleHealth))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/uploadDelta", s.method("POST", s.handleUploadDelta))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/addComment", s.auth(s.serialize(s.handleAddComment)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/deleteComment", s.auth(s.serialize(s.handleDeleteComment)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/setReaction", s.auth(s.serialize(s.handleSetReaction)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/setSeen", s.auth(s.serialize(s.handleSetSeen)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/albumInvite", s.auth(s.serialize(s.handleAlbumInvite)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/shareLink", s.auth(s.serialize(s.handleShareLink)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/joinAlbum", s.auth(s.serialize(s.handleJoinAlbum)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/joinRequests", s.auth(s.serialize(s.handleJoinRequests)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/answerJoinRequest", s.auth(s.serialize(s.handleAnswerJoinRequest)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/albumDigest", s.auth(s.serialize(s.handleAlbumDigest)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/albumUnshareDate", s.auth(s.serialize(s.handleAlbumUnshareDate)))
+	s.mux.HandleFunc(pathPrefix+"/v2x/upload/create", s.auth(s.handleUploadCreate))
+	s.mux.HandleFunc(pathPrefix+"/v2x/upload/status", s.auth(s.handleUploadStatus))
+	s.mux.HandleFunc(pathPrefix+"/v2x/upload/chunk", s.method("POST", s.handleUploadChunk))
+	s.mux.HandleFunc(pathPrefix+"/v2x/import/start", s.auth(s.handleImportStart))
+	s.mux.HandleFunc(pathPrefix+"/v2x/import/precheck", s.auth(s.handleImportPrecheck))
+	s.mux.HandleFunc(pathPrefix+"/v2x/import/progress", s.auth(s.handleImportProgress))
+	s.mux.HandleFunc(pathPrefix+"/v2x/jobs/events", s.method("POST", s.handleJobEvents))
+
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/setContact", s.auth(s.handleSetRecoveryContact))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/answer", s.auth(s.handleAnswerRecoveryContact))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/addKeys", s.auth(s.handleAddEscrowKeys))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/setInactivity", s.auth(s.handleSetInactivityTrigger))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/status", s.auth(s.handleRecoveryStatus))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/recover", s.auth(s.handleRequestRecovery))
+	s.mux.HandleFunc(pathPrefix+"/v2x/escrow/deny", s.auth(s.handleDenyRecovery))
 
 	s.mux.HandleFunc(pathPrefix+"/v2x/mfa/approve", s.strictMFA(s.handleApproveMFA))
 	s.mux.HandleFunc(pathPrefix+"/v2x/mfa/check", s.auth(s.handleMFACheck))
@@ -230,13 +400,39 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 func (s *Server) wrapHandler() http.Handler {
 	handler := http.Handler(s.mux)
 	handler = gziphandler.GzipHandler(handler)
-	handler = limit.New(s.MaxConcurrentRequests, handler)
+	requests := limit.New(s.MaxConcurrentRequests, handler)
+	s.requests = requests
+	uploads := limit.New(s.MaxConcurrentUploads, handler)
+	handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p := req.URL.Path; p == s.pathPrefix+"/v2/sync/upload" || p == s.pathPrefix+"/v2x/sync/uploadDelta" || p == s.pathPrefix+"/v2x/upload/chunk" {
+			uploads.ServeHTTP(w, req)
+			return
+		}
+		requests.ServeHTTP(w, req)
+	})
+	s.initSetup()
+	if err := s.db.SelfTestError(); err != nil {
+		// Refuse to serve anything but the health status when the data
+		// doesn't match the master key.
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == s.pathPrefix+"/v2x/health" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			http.Error(w, "Database self-test failed", http.StatusServiceUnavailable)
+		})
+	}
+	handler = s.checkCSRF(handler)
+	handler = s.checkAccess(handler)
+	handler = s.recoverPanic(handler)
 	handler = promhttp.InstrumentHandlerRequestSize(reqSize, handler)
 	handler = promhttp.InstrumentHandlerResponseSize(respSize, handler)
 	return handler
 }
 
 func (s *Server) httpServer() *http.Server {
+	s.startBackgroundJobs()
 	s.srv = &http.Server{
 		Addr:              s.addr,
 		Handler:           s.wrapHandler(),
@@ -246,47 +442,40 @@ func (s *Server) httpServer() *http.Server {
 			return context.WithValue(ctx, connKey, c)
 		},
 		ErrorLog: log.Logger(),
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
+		TLSConfig: s.TLSPolicy.tlsConfig(),
 	}
 	return s.srv
 }
 
+// Serve runs the HTTP server on a Listener that the caller created, e.g. when
+// the server is embedded in another program.
+func (s *Server) Serve(l net.Listener) error {
+	return s.httpServer().Serve(l)
+}
+
 // Run runs the HTTP server on the configured address.
 func (s *Server) Run() error {
 	return s.httpServer().ListenAndServe()
 }
 
-// RunWithTLS runs the HTTP server with TLS.
+// RunWithTLS runs the HTTP server with TLS. The certificate is reloaded when
+// the files change.
 func (s *Server) RunWithTLS(certFile, keyFile string) error {
-	return s.httpServer().ListenAndServeTLS(certFile, keyFile)
-}
-
-// RunWithAutocert runs the HTTP server with TLS credentials provided by
-// letsencrypt.org.
-func (s *Server) RunWithAutocert(domain, addr string) error {
-	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Cache:  s.db.AutocertCache(),
-	}
-	if domain != "any" && domain != "*" {
-		certManager.HostPolicy = autocert.HostWhitelist(strings.Split(domain, ",")...)
+	r, err := newCertReloader(certFile, keyFile, s.TLSPolicy.OCSPStapling)
+	if err != nil {
+		return err
 	}
-	go func() {
-		if addr == "" {
-			addr = ":http"
-		}
-		log.Fatalf("autocert.Manager failed: %v", http.ListenAndServe(addr, certManager.HTTPHandler(nil)))
-	}()
+	s.certStatus = r.certStatus
+	go r.loop()
 
 	s.srv = s.httpServer()
-	s.srv.TLSConfig.GetCertificate = certManager.GetCertificate
+	s.srv.TLSConfig.GetCertificate = r.GetCertificate
 	return s.srv.ListenAndServeTLS("", "")
 }
 
 // RunWithListener runs the server using a pre-existing Listener. Used for testing.
 func (s *Server) RunWithListener(l net.Listener) error {
+	s.startBackgroundJobs()
 	s.srv = &http.Server{
 		Addr:    s.addr,
 		Handler: s.wrapHandler(),
@@ -299,7 +488,52 @@ func (s *Server) RunWithListener(l net.Listener) error {
 
 // Shutdown cleanly shuts down the http server.
 func (s *Server) Shutdown() error {
-	return s.srv.Shutdown(context.Background())
+	return s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext is like Shutdown, but it gives up waiting for the active
+// connections when ctx is done.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	s.bgCancel()
+	s.jobs.close()
+	err := s.srv.Shutdown(ctx)
+	if e := s.db.FlushUsage(); e != nil {
+		log.Errorf("FlushUsage: %v", e)
+	}
+	return err
+}
+
+// startBackgroundJobs starts the server's periodic background tasks. It is
+// safe to call more than once; the tasks are only started the first time.
+func (s *Server) startBackgroundJobs() {
+	s.bgOnce.Do(s.startBackgroundJobsOnce)
+}
+
+func (s *Server) startBackgroundJobsOnce() {
+	if s.BillingWebhookURL != "" {
+		s.db.SetThresholdHook(s.sendBillingWebhook)
+	}
+	if s.EnableUsageReports && s.Mailer != nil {
+		go s.usageReportLoop(s.bgCtx)
+	}
+	if s.SnapshotStore != nil && s.db.SelfTestError() == nil {
+		go s.snapshotLoop()
+	}
+	if s.db.PurgeDelay() > 0 && !s.db.ReadOnly() && s.db.SelfTestError() == nil {
+		go s.purgeLoop()
+	}
+	if !s.db.ReadOnly() && s.db.SelfTestError() == nil {
+		go s.digestLoop()
+		go s.albumExpiryLoop()
+		go s.inactivityLoop()
+		go s.trashExpiryLoop()
+	}
+	if s.GCInterval > 0 && !s.db.ReadOnly() && s.db.SelfTestError() == nil {
+		go s.gcLoop()
+	}
+	if s.StorageMetricsInterval > 0 && s.db.SelfTestError() == nil {
+		go s.storageMetricsLoop()
+	}
 }
 
 // Handler returns the server's http.Handler. Used for testing.
@@ -311,6 +545,10 @@ func (s *Server) Handler() http.Handler {
 // It is an encrypted json object representing key:value pairs.
 // Returns the decrypted key:value pairs as a map.
 func (s *Server) decodeParams(params string, user database.User) (map[string]string, error) {
+	if p, ok := user.Context().Value(paramsKey).(decodedParams); ok && p.raw == params {
+		return p.params, nil
+	}
+	defer timing.FromContext(user.Context()).Start("params")()
 	sk, err := s.db.DecryptSecretKey(user.ServerSecretKey)
 	if err != nil {
 		return nil, err
@@ -361,35 +599,41 @@ func (s *Server) method(method string, next http.HandlerFunc) http.HandlerFunc {
 
 		}
 		if req.Method != method {
-			reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
+			reqStatus.WithLabelValues(req.Method, s.uriLabel(req), "nok").Inc()
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		if o := req.Header.Get("Origin"); o != "" {
 			w.Header().Set("Access-Control-Allow-Origin", o)
 		}
-		next(w, req)
+		ctx, timers := timing.NewContext(req.Context())
+		next(w, req.WithContext(ctx))
+		if s.SlowRequestThreshold > 0 && timers.Elapsed() > s.SlowRequestThreshold {
+			log.Infof("SLOW REQUEST [%s] %s %s: %s", requestID(req.Context()), req.Method, req.URL, timers)
+		}
 	}
 }
 
 // noauth wraps handlers that don't require authentication.
 func (s *Server) noauth(f func(*http.Request) *stingle.Response) http.HandlerFunc {
-	rl := rate.NewLimiter(rate.Limit(0.5), 1)
 	return s.method("POST", func(w http.ResponseWriter, req *http.Request) {
-		timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, req.URL.String()))
+		uri := s.uriLabel(req)
+		timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, uri))
 		defer timer.ObserveDuration()
 		s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
 		defer s.setDeadline(req.Context(), time.Time{})
 		log.Infof("%s %s %s", req.Proto, req.Method, req.URL)
 		req.ParseForm()
-		if err := rl.Wait(req.Context()); err != nil {
+		if !s.checkRateLimit(w, req) {
 			return
 		}
 		sr := f(req)
+		done := timing.FromContext(req.Context()).Start("write")
 		if err := sr.Send(w); err != nil {
 			log.Errorf("Send: %v", err)
 		}
-		reqStatus.WithLabelValues(req.Method, req.URL.String(), sr.Status).Inc()
+		done()
+		reqStatus.WithLabelValues(req.Method, uri, sr.Status).Inc()
 	})
 }
 
@@ -405,7 +649,7 @@ func (s *Server) checkToken(tok, scope string) (token.Token, database.User, erro
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
-	tk, err := s.db.DecryptTokenKey(user.TokenKey)
+	tk, err := s.db.TokenKeyForToken(user, tok)
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
@@ -414,27 +658,56 @@ func (s *Server) checkToken(tok, scope string) (token.Token, database.User, erro
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
-	if t.Scope != scope {
+	if t.Scope != scope || !tokenValid(user, t, tok) {
 		return token.Token{}, database.User{}, token.ErrValidationFailed
 	}
 	return t, user, nil
 }
 
+// tokenValid returns whether a token that was already decrypted and validated
+// with the user's token key is still valid, i.e. it wasn't revoked. This only
+// depends on the user's record, not on any in-memory state, so that any
+// server instance can validate any token.
+func tokenValid(user database.User, t token.Token, tok string) bool {
+	h := token.Hash(tok)
+	if t.Epoch == 0 && t.Scope == "session" {
+		// Session tokens issued before token epochs were introduced.
+		return user.ValidTokens[h]
+	}
+	epoch := t.Epoch
+	if epoch == 0 && user.TokenEpoch == 1 {
+		// Other tokens issued before token epochs were introduced, e.g.
+		// download URLs, are valid until they expire. The epoch becomes
+		// 1 when the user logs in, and RevokeAllTokens skips it.
+		epoch = 1
+	}
+	if epoch != user.TokenEpoch {
+		return false
+	}
+	_, revoked := user.RevokedTokens[h]
+	return !revoked
+}
+
 // auth wraps handlers that require authentication, checking the token, and
 // passing the authenticated user to the underlying handler.
 func (s *Server) auth(f func(database.User, *http.Request) *stingle.Response) http.HandlerFunc {
 	return s.method("POST", func(w http.ResponseWriter, req *http.Request) {
-		timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, req.URL.String()))
+		uri := s.uriLabel(req)
+		timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, uri))
 		defer timer.ObserveDuration()
 		s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
 		defer s.setDeadline(req.Context(), time.Time{})
 
 		req.ParseForm()
 
+		timers := timing.FromContext(req.Context())
 		tok := req.PostFormValue("token")
+		done := timers.Start("auth")
 		_, user, err := s.checkToken(tok, "session")
-		if err != nil || !user.ValidTokens[token.Hash(tok)] {
+		done()
+		if err != nil {
 			log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+			s.logAuthFailure(req, authFailureToken, "")
 			sr := stingle.ResponseNOK().AddPart("logout", "1").AddError("You are not logged in")
 			if err := sr.Send(w); err != nil {
 				log.Errorf("Send: %v", err)
@@ -442,11 +715,33 @@ func (s *Server) auth(f func(database.User, *http.Request) *stingle.Response) ht
 			return
 		}
 		log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
-		sr := f(user, req)
+		if user.ForcePasswordChange && !passwordChangeEndpoints[strings.TrimPrefix(req.URL.Path, s.pathPrefix)] {
+			sr := stingle.ResponseNOK().AddPart("passwordChangeRequired", "1").AddError("You must change your password")
+			if err := sr.Send(w); err != nil {
+				log.Errorf("Send: %v", err)
+			}
+			return
+		}
+		if s.RequireOTP && user.OTPKey == "" && !otpEnrollmentEndpoints[strings.TrimPrefix(req.URL.Path, s.pathPrefix)] {
+			sr := stingle.ResponseNOK().AddPart("otpRequired", "1").AddError("You must enable two-factor authentication")
+			if err := sr.Send(w); err != nil {
+				log.Errorf("Send: %v", err)
+			}
+			return
+		}
+		s.db.RecordUsage(user.UserID, database.DailyUsage{Requests: 1})
+		s.db.RecordActiveDevice(user.UserID, token.Hash(tok))
+		s.touchSession(user, tok, req)
+		var sr *stingle.Response
+		if req, sr = s.checkParams(user, req); sr == nil {
+			sr = f(user.WithContext(req.Context()), req)
+		}
+		done = timers.Start("write")
 		if err := sr.Send(w); err != nil {
 			log.Errorf("Send: %v", err)
 		}
-		reqStatus.WithLabelValues(req.Method, req.URL.String(), sr.Status).Inc()
+		done()
+		reqStatus.WithLabelValues(req.Method, uri, sr.Status).Inc()
 	})
 }
 
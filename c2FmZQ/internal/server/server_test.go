@@ -45,6 +45,12 @@ import (
 // startServer starts a server listening on a unix socket. Returns the unix socket
 // and a function to shutdown the server.
 func startServer(t *testing.T) (string, func()) {
+	return startServerWithOptions(t, nil)
+}
+
+// startServerWithOptions is like startServer. If opts isn't nil, it is called
+// to change the server's options before it starts.
+func startServerWithOptions(t *testing.T, opts func(*server.Server)) (string, func()) {
 	testdir := t.TempDir()
 	sock := filepath.Join(testdir, "server.sock")
 	log.Record = t.Log
@@ -54,6 +60,9 @@ func startServer(t *testing.T) (string, func()) {
 	s.AllowCreateAccount = true
 	s.AutoApproveNewAccounts = true
 	s.BaseURL = "http://unix/"
+	if opts != nil {
+		opts(s)
+	}
 	l, err := net.Listen("unix", sock)
 	if err != nil {
 		t.Fatalf("net.Listen failed: %v", err)
@@ -92,6 +101,7 @@ type client struct {
 	keyBundle       string
 	token           string
 	otpKey          string
+	otpBackupCodes  []string
 	authenticator   *webauthn.FakeAuthenticator
 }
 
@@ -142,7 +152,7 @@ func (c *client) sendRequest(uri string, form url.Values) (*stingle.Response, er
 	if err := dec.Decode(&sr); err != nil {
 		return nil, err
 	}
-	if sr.Status == "nok" && !form.Has("mfa") && sr.Part("mfa") != "" {
+	if mfa := sr.Part("mfa"); sr.Status == "nok" && !form.Has("mfa") && mfa != nil && mfa != "" {
 		if c.otpKey != "" {
 			code, err := totp.GenerateCode(c.otpKey, time.Now())
 			if err != nil {
@@ -199,12 +209,16 @@ func (c *client) sendRequest(uri string, form url.Values) (*stingle.Response, er
 }
 
 func (c *client) uploadFile(filename, set, albumID string, t int64) (*stingle.Response, error) {
+	return c.uploadFileParts(filename, set, albumID, t, []string{"file", "thumb"})
+}
+
+func (c *client) uploadFileParts(filename, set, albumID string, t int64, parts []string) (*stingle.Response, error) {
 	dialer := dialer{sock: c.sock}
 	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
 
 	var buf bytes.Buffer
 	w := multipart.NewWriter(&buf)
-	for _, f := range []string{"file", "thumb"} {
+	for _, f := range parts {
 		pw, err := w.CreateFormFile(f, filename)
 		if err != nil {
 			return nil, err
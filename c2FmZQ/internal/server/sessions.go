@@ -0,0 +1,165 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/stingle/token"
+)
+
+const (
+	// sessionLastSeenInterval is how often the last seen time of a session
+	// is updated.
+	sessionLastSeenInterval = time.Hour
+	// maxDeviceNameLength is the maximum length of a device name.
+	maxDeviceNameLength = 100
+)
+
+// session is a logged-in device, as returned by the sessions/list endpoint.
+type session struct {
+	ID         string `json:"id"`
+	DeviceName string `json:"deviceName"`
+	IP         string `json:"ip"`
+	Created    int64  `json:"created"`
+	LastSeen   int64  `json:"lastSeen"`
+	Expires    int64  `json:"expires"`
+	Current    bool   `json:"current"`
+}
+
+// newSessionInfo returns the information about a new session created by req.
+// The device name is the deviceName form value, or the user agent.
+func newSessionInfo(req *http.Request) database.SessionInfo {
+	name := req.PostFormValue("deviceName")
+	if name == "" {
+		name = req.UserAgent()
+	}
+	if r := []rune(name); len(r) > maxDeviceNameLength {
+		name = string(r[:maxDeviceNameLength])
+	}
+	now := time.Now()
+	return database.SessionInfo{
+		DeviceName: name,
+		IP:         remoteHost(req),
+		Created:    now.UnixMilli(),
+		LastSeen:   now.UnixMilli(),
+		Expires:    now.Add(tokenDuration).UnixMilli(),
+	}
+}
+
+// touchSession updates the last seen time and the IP address of the session
+// that sent req, at most once per sessionLastSeenInterval.
+func (s *Server) touchSession(user database.User, tok string, req *http.Request) {
+	h := token.Hash(tok)
+	si, ok := user.SessionInfo[h]
+	if !ok || (time.Since(time.UnixMilli(si.LastSeen)) < sessionLastSeenInterval && si.IP == remoteHost(req)) {
+		return
+	}
+	if err := s.db.MutateUser(user.UserID, func(u *database.User) error {
+		if si, ok := u.SessionInfo[h]; ok {
+			si.LastSeen = time.Now().UnixMilli()
+			si.IP = remoteHost(req)
+		}
+		return nil
+	}); err != nil {
+		log.Errorf("MutateUser: %v", err)
+	}
+}
+
+// handleSessionsList handles the /v2x/config/sessions/list endpoint. It
+// returns the devices that are logged in to the account, most recently seen
+// first.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(sessions, The list of sessions, with their ID, device name, IP
+//     address, creation time, last seen time, and expiration time)
+func (s *Server) handleSessionsList(user database.User, req *http.Request) *stingle.Response {
+	current := token.Hash(req.PostFormValue("token"))
+	now := time.Now().UnixMilli()
+	sessions := []session{}
+	for h, si := range user.SessionInfo {
+		if si.Expires < now {
+			continue
+		}
+		sessions = append(sessions, session{
+			ID:         h,
+			DeviceName: si.DeviceName,
+			IP:         si.IP,
+			Created:    si.Created,
+			LastSeen:   si.LastSeen,
+			Expires:    si.Expires,
+			Current:    h == current,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastSeen == sessions[j].LastSeen {
+			return sessions[i].ID < sessions[j].ID
+		}
+		return sessions[i].LastSeen > sessions[j].LastSeen
+	})
+	return stingle.ResponseOK().AddPart("sessions", sessions)
+}
+
+// handleSessionsRevoke handles the /v2x/config/sessions/revoke endpoint. It
+// logs out one of the devices that are logged in to the account.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//   - sessionId: The ID of the session to revoke, from sessions/list.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleSessionsRevoke(user database.User, req *http.Request) *stingle.Response {
+	id := req.PostFormValue("sessionId")
+	var name string
+	if err := s.db.MutateUser(user.UserID, func(u *database.User) error {
+		si, ok := u.SessionInfo[id]
+		if !ok {
+			return os.ErrNotExist
+		}
+		name = si.DeviceName
+		u.RevokeToken(id, si.Expires/1000+1)
+		return nil
+	}); errors.Is(err, os.ErrNotExist) {
+		return stingle.ResponseNOK().AddError("Session not found")
+	} else if err != nil {
+		log.Errorf("MutateUser: %v", err)
+		return stingle.ResponseNOK()
+	}
+	s.recordActivity(user.UserID, database.ActivityRevokeSession, name)
+	return stingle.ResponseOK()
+}
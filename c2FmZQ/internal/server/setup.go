@@ -0,0 +1,193 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+var quotaRE = regexp.MustCompile(`^(\d+)([KkMmGgTt][Bb]?)?$`)
+
+// initSetup enables the first-run setup when FirstRunSetup is true and no
+// account exists. The setup token is logged so that the operator can use it
+// to create the admin account.
+func (s *Server) initSetup() {
+	if !s.FirstRunSetup {
+		return
+	}
+	hasUsers, err := s.db.HasUsers()
+	if err != nil {
+		log.Errorf("HasUsers: %v", err)
+		return
+	}
+	if hasUsers {
+		return
+	}
+	s.setupMutex.Lock()
+	defer s.setupMutex.Unlock()
+	if s.setupToken == "" {
+		s.setupToken = s.SetupToken
+	}
+	if s.setupToken == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Errorf("rand.Read: %v", err)
+			return
+		}
+		s.setupToken = hex.EncodeToString(b)
+	}
+	log.Infof("First-run setup: no accounts exist. Use setup token %s to create the admin account.", s.setupToken)
+}
+
+// setupRequired returns whether the first-run setup is enabled and not done
+// yet.
+func (s *Server) setupRequired() bool {
+	s.setupMutex.Lock()
+	defer s.setupMutex.Unlock()
+	return s.setupToken != ""
+}
+
+// registrationSettings returns whether new accounts can be created, and
+// whether they are approved automatically. The settings saved in the
+// database take precedence over the server's options.
+func (s *Server) registrationSettings() (allow, autoApprove bool) {
+	allow, autoApprove = s.AllowCreateAccount, s.AutoApproveNewAccounts
+	settings, err := s.db.Settings()
+	if err != nil {
+		log.Errorf("Settings: %v", err)
+		return
+	}
+	if v := settings.AllowCreateAccount; v != nil {
+		allow = *v
+	}
+	if v := settings.AutoApproveNewAccounts; v != nil {
+		autoApprove = *v
+	}
+	return
+}
+
+// handleSetupStatus handles the /v2x/setup/status endpoint.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(setupRequired, "1" when the first-run setup isn't done yet)
+func (s *Server) handleSetupStatus(req *http.Request) *stingle.Response {
+	required := "0"
+	if s.setupRequired() {
+		required = "1"
+	}
+	return stingle.ResponseOK().AddPart("setupRequired", required)
+}
+
+// handleSetupComplete handles the /v2x/setup/complete endpoint. It creates the
+// admin account, and sets the instance options. It only works once, when no
+// account exists.
+//
+// Argument:
+//   - req: The http request.
+//
+// The form arguments:
+//   - setupToken: The one-time token that the server logged at startup.
+//   - email, password, salt, keyBundle, isBackup: The same as createAccount.
+//   - allowCreateAccount: Optional. "1" if new accounts can be created.
+//   - autoApproveNewAccounts: Optional. "1" if new accounts don't need an
+//     admin's approval.
+//   - defaultQuota: Optional. The default quota, e.g. "100GB".
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleSetupComplete(req *http.Request) *stingle.Response {
+	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
+	s.setupMutex.Lock()
+	setupToken := s.setupToken
+	s.setupMutex.Unlock()
+	if setupToken == "" {
+		return stingle.ResponseNOK().AddError("Setup already done")
+	}
+	if subtle.ConstantTimeCompare([]byte(req.PostFormValue("setupToken")), []byte(setupToken)) != 1 {
+		log.Infof("Invalid setup token")
+		s.logAuthFailure(req, authFailureSetupToken, "")
+		return stingle.ResponseNOK().AddError("Invalid setup token")
+	}
+	opts, err := setupOptionsFromForm(req)
+	if err != nil {
+		return stingle.ResponseNOK().AddError(err.Error())
+	}
+	u, ok := newUserFromForm(req)
+	if !ok {
+		return stingle.ResponseNOK()
+	}
+	_, err = s.db.CompleteSetup(u, opts)
+	if err != nil && err != database.ErrSetupDone {
+		log.Errorf("CompleteSetup: %v", err)
+		return stingle.ResponseNOK()
+	}
+	s.setupMutex.Lock()
+	s.setupToken = ""
+	s.setupMutex.Unlock()
+	if err == database.ErrSetupDone {
+		return stingle.ResponseNOK().AddError("Setup already done")
+	}
+	log.Infof("First-run setup done. Admin account: %s", u.Email)
+	return stingle.ResponseOK()
+}
+
+// setupOptionsFromForm returns the instance options of the setup form.
+func setupOptionsFromForm(req *http.Request) (database.SetupOptions, error) {
+	var opts database.SetupOptions
+	for _, o := range []struct {
+		name string
+		v    **bool
+	}{
+		{"allowCreateAccount", &opts.AllowCreateAccount},
+		{"autoApproveNewAccounts", &opts.AutoApproveNewAccounts},
+	} {
+		if _, ok := req.PostForm[o.name]; !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(req.PostFormValue(o.name))
+		if err != nil {
+			return opts, fmt.Errorf("Invalid %s", o.name)
+		}
+		*o.v = &b
+	}
+	if v := req.PostFormValue("defaultQuota"); v != "" {
+		m := quotaRE.FindStringSubmatch(v)
+		if m == nil {
+			return opts, fmt.Errorf("Invalid defaultQuota")
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid defaultQuota")
+		}
+		opts.DefaultQuota = &database.Limit{Value: n, Unit: strings.ToUpper(m[2])}
+	}
+	return opts, nil
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestFirstRunSetup(t *testing.T) {
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.FirstRunSetup = true
+		s.SetupToken = "SETUP-TOKEN"
+	})
+	defer shutdown()
+
+	alice := newClient(sock)
+	if required, err := alice.setupStatus(); err != nil || required != "1" {
+		t.Fatalf("alice.setupStatus() = %q, %v, want 1", required, err)
+	}
+	if err := alice.createAccount("alice"); err == nil {
+		t.Fatal("alice.createAccount succeeded before the setup")
+	}
+	opts := url.Values{}
+	opts.Set("allowCreateAccount", "0")
+	opts.Set("defaultQuota", "10gb")
+	if err := alice.completeSetup("alice", "WRONG-TOKEN", opts); err == nil {
+		t.Fatal("alice.completeSetup succeeded with the wrong token")
+	}
+	if err := alice.completeSetup("alice", "SETUP-TOKEN", opts); err != nil {
+		t.Fatalf("alice.completeSetup failed: %v", err)
+	}
+	if required, err := alice.setupStatus(); err != nil || required != "0" {
+		t.Fatalf("alice.setupStatus() = %q, %v, want 0", required, err)
+	}
+	if err := alice.login(); err != nil {
+		t.Fatalf("alice.login failed: %v", err)
+	}
+	data, err := alice.adminUsers(nil)
+	if err != nil {
+		t.Fatalf("alice.adminUsers failed: %v", err)
+	}
+	if got, want := *data.DefaultQuota, int64(10); got != want {
+		t.Errorf("DefaultQuota = %d, want %d", got, want)
+	}
+	if got, want := *data.DefaultQuotaUnit, "GB"; got != want {
+		t.Errorf("DefaultQuotaUnit = %q, want %q", got, want)
+	}
+
+	bob := newClient(sock)
+	if err := bob.createAccount("bob"); err == nil {
+		t.Error("bob.createAccount succeeded with allowCreateAccount=0")
+	}
+	if err := bob.completeSetup("bob", "SETUP-TOKEN", nil); err == nil {
+		t.Error("bob.completeSetup succeeded after the setup")
+	}
+}
+
+func (c *client) setupStatus() (string, error) {
+	sr, err := c.sendRequest("/v2x/setup/status", url.Values{})
+	if err != nil {
+		return "", err
+	}
+	if sr.Status != "ok" {
+		return "", sr
+	}
+	required, _ := sr.Part("setupRequired").(string)
+	return required, nil
+}
+
+func (c *client) completeSetup(email, setupToken string, opts url.Values) error {
+	c.email = email
+	c.password = "PASSWORD"
+	c.salt = "SALT"
+	c.keyBundle = stingle.MakeKeyBundle(c.secretKey.PublicKey())
+	c.isBackup = "0"
+	form := url.Values{}
+	for k, v := range opts {
+		form[k] = v
+	}
+	form.Set("setupToken", setupToken)
+	form.Set("email", c.email)
+	form.Set("password", c.password)
+	form.Set("salt", c.salt)
+	form.Set("keyBundle", c.keyBundle)
+	form.Set("isBackup", c.isBackup)
+
+	sr, err := c.sendRequest("/v2x/setup/complete", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
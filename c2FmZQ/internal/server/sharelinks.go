@@ -0,0 +1,146 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleShareLink handles the /v2x/sync/shareLink endpoint. It is used by the
+// owner of an album to create or revoke the album's public share link. Anyone
+// with the link can download the album's encrypted files, without an account.
+// The album's secret key isn't sent to the server. The client adds it to the
+// fragment of the link.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - expires: The time when the link stops working, in milliseconds. The
+//     default is 7 days from now, and the maximum is one year.
+//   - revoke: When set to "1", the share link is revoked.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(url, the new share link)
+//     Part(expires, the time when the link stops working)
+func (s *Server) handleShareLink(user database.User, req *http.Request) *stingle.Response {
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if params["revoke"] == "1" {
+		if err := s.db.RevokeShareLink(user, params["albumId"]); err != nil {
+			log.Errorf("RevokeShareLink: %v", err)
+			return stingle.ResponseNOK()
+		}
+		return stingle.ResponseOK()
+	}
+	if user.NeedApproval {
+		return stingle.ResponseNOK().
+			AddError("Account is not approved yet")
+	}
+	tok, expires, err := s.db.CreateShareLink(user, params["albumId"], parseInt(params["expires"], 0))
+	if err != nil {
+		log.Errorf("CreateShareLink: %v", err)
+		if errors.Is(err, os.ErrPermission) {
+			return stingle.ResponseNOK().AddError("Only the owner of the album can create a share link")
+		}
+		if err == database.ErrInvalidExpiration {
+			return stingle.ResponseNOK().AddError("Invalid expiration time")
+		}
+		return stingle.ResponseNOK()
+	}
+	b := s.BaseURL
+	if b == "" {
+		b = fmt.Sprintf("https://%s%s/", req.Host, s.pathPrefix)
+	}
+	return stingle.ResponseOK().
+		AddPart("url", b+"s/"+tok).
+		AddPart("expires", fmt.Sprintf("%d", expires))
+}
+
+// handleSharedAlbum handles the /s/ endpoint, i.e. the public share links.
+// No authentication is needed. The token in the URL is the authorization.
+//
+//   - GET /s/<token> returns the album and the list of its files, with their
+//     encrypted headers, as a stingle.Response with Part(album, ...).
+//   - GET /s/<token>/<file> returns the encrypted content of a file, or its
+//     thumbnail with ?thumb=1, or another variant with ?variant=medium.
+//
+// Arguments:
+//   - w: The http response writer.
+//   - req: The http request.
+func (s *Server) handleSharedAlbum(w http.ResponseWriter, req *http.Request) {
+	// The token must not leak to other sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	p := strings.TrimPrefix(req.URL.Path, s.pathPrefix+"/s/")
+	tok, file, isFile := strings.Cut(p, "/")
+	album, err := s.db.SharedAlbum(tok)
+	if err != nil {
+		if err != database.ErrInvalidShareLink {
+			log.Errorf("SharedAlbum: %v", err)
+		}
+		log.Infof("%s %s/s/[...] (INVALID SHARE LINK)", req.Method, s.pathPrefix)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Infof("%s %s/s/[...] (AlbumID:%s)", req.Method, s.pathPrefix, album.AlbumID)
+	if !isFile {
+		w.Header().Set("Cache-Control", "no-store")
+		stingle.ResponseOK().AddPart("album", album).Send(w)
+		s.db.RecordUsage(album.OwnerID, database.DailyUsage{Requests: 1})
+		return
+	}
+	variant, err := downloadVariant(req.URL.Query().Get("variant"), req.URL.Query().Get("thumb") == "1")
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	f, err := s.db.DownloadSharedFile(album, file, variant)
+	if err != nil {
+		log.Errorf("DownloadSharedFile(%q, %q, %v) failed: %v", album.AlbumID, file, variant, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if setCacheHeaders(w, req, f.ETag, variant != database.VariantOriginal) {
+		s.db.RecordUsage(album.OwnerID, database.DailyUsage{Requests: 1})
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	var n int64
+	if r := s.tryToHandleRange(w, req, f.ETag, f); r != nil {
+		if n, err = s.copyWithCtx(req.Context(), w, r); err != nil {
+			log.Debugf("Copy failed: %v", err)
+		}
+	}
+	s.db.RecordUsage(album.OwnerID, database.DailyUsage{Requests: 1, BytesDownloaded: n})
+}
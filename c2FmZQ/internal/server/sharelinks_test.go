@@ -0,0 +1,146 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestShareLinks(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	alice, bob, _, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if sr, err := alice.uploadFile("file1", stingle.AlbumSet, "album", 1000); err != nil || sr.Status != "ok" {
+		t.Fatalf("alice.uploadFile failed: %v %v", sr, err)
+	}
+	if _, _, err := bob.shareLink("album", 0, false); err == nil {
+		t.Error("bob.shareLink succeeded unexpectedly")
+	}
+	if _, _, err := alice.shareLink("album", 500, false); err == nil {
+		t.Error("alice.shareLink succeeded with an expiration time in the past")
+	}
+	link, expires, err := alice.shareLink("album", 0, false)
+	if err != nil {
+		t.Fatalf("alice.shareLink failed: %v", err)
+	}
+	if want := int64(1000 + 7*24*3600*1000); expires != want {
+		t.Errorf("expires = %d, want %d", expires, want)
+	}
+
+	// Anyone with the link can see the album, without an account.
+	body, err := alice.downloadGet(link)
+	if err != nil {
+		t.Fatalf("downloadGet(%q) failed: %v", link, err)
+	}
+	var sr struct {
+		Parts struct {
+			Album database.SharedAlbum `json:"album"`
+		} `json:"parts"`
+	}
+	if err := json.Unmarshal([]byte(body), &sr); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if got := sr.Parts.Album; got.AlbumID != "album" || len(got.Files) != 1 || got.Files[0].File != "file1" || got.Files[0].Headers != "file1 headers album" {
+		t.Errorf("Unexpected shared album: %#v", got)
+	}
+	for _, tc := range []struct {
+		suffix, want string
+	}{
+		{"/file1", `Content of "file" filename "file1"`},
+		{"/file1?thumb=1", `Content of "thumb" filename "file1"`},
+	} {
+		if got, err := bob.downloadGet(link + tc.suffix); err != nil || got != tc.want {
+			t.Errorf("downloadGet(%q) = %q, %v, want %q", tc.suffix, got, err, tc.want)
+		}
+	}
+	if _, err := bob.downloadGet(link + "/nosuchfile"); err == nil {
+		t.Error("downloadGet(nosuchfile) succeeded unexpectedly")
+	}
+	if _, err := bob.downloadGet(link + "x"); err == nil {
+		t.Error("downloadGet(bad link) succeeded unexpectedly")
+	}
+
+	// The link stops working when it expires.
+	database.CurrentTimeForTesting = expires + 1
+	if _, err := bob.downloadGet(link); err == nil {
+		t.Error("downloadGet succeeded after expiration")
+	}
+
+	// The link stops working when it's revoked, or replaced.
+	database.CurrentTimeForTesting = 2000
+	link2, _, err := alice.shareLink("album", 3000, false)
+	if err != nil {
+		t.Fatalf("alice.shareLink failed: %v", err)
+	}
+	if _, err := bob.downloadGet(link); err == nil {
+		t.Error("downloadGet(old link) succeeded unexpectedly")
+	}
+	if _, err := bob.downloadGet(link2); err != nil {
+		t.Errorf("downloadGet(new link) failed: %v", err)
+	}
+	if _, _, err := alice.shareLink("album", 0, true); err != nil {
+		t.Fatalf("alice.shareLink(revoke) failed: %v", err)
+	}
+	if _, err := bob.downloadGet(link2); err == nil {
+		t.Error("downloadGet succeeded after revoke")
+	}
+}
+
+func (c *client) shareLink(albumID string, expires int64, revoke bool) (string, int64, error) {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	if expires != 0 {
+		params["expires"] = strconv.FormatInt(expires, 10)
+	}
+	if revoke {
+		params["revoke"] = "1"
+	}
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/shareLink", form)
+	if err != nil {
+		return "", 0, err
+	}
+	if sr.Status != "ok" {
+		return "", 0, sr
+	}
+	link, _ := sr.Part("url").(string)
+	exp, _ := sr.Part("expires").(string)
+	n, _ := strconv.ParseInt(exp, 10, 64)
+	return strings.TrimSuffix(link, "/"), n, nil
+}
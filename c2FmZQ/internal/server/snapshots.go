@@ -0,0 +1,79 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	defaultSnapshotInterval  = 24 * time.Hour
+	defaultSnapshotRetention = 7
+	// How long to wait before trying again when a snapshot fails.
+	snapshotRetryInterval = time.Hour
+)
+
+var lastSnapshot = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "server_last_metadata_snapshot_seconds",
+		Help: "The time of the last successful metadata snapshot, in seconds since the epoch",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(lastSnapshot)
+}
+
+// snapshotLoop uploads a snapshot of the metadata to SnapshotStore every
+// SnapshotInterval. The schedule continues from the last snapshot in the
+// store, so restarting the server doesn't trigger a new snapshot.
+func (s *Server) snapshotLoop() {
+	interval := s.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	retention := s.SnapshotRetention
+	if retention <= 0 {
+		retention = defaultSnapshotRetention
+	}
+	var last time.Time
+	if list, err := s.db.MetadataSnapshots(s.SnapshotStore); err != nil {
+		log.Errorf("MetadataSnapshots: %v", err)
+	} else if len(list) > 0 {
+		last = list[len(list)-1].Time
+		lastSnapshot.Set(float64(last.Unix()))
+	}
+	for {
+		if wait := time.Until(last.Add(interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+		snap, err := s.db.CreateMetadataSnapshot(s.SnapshotStore, retention)
+		if err != nil {
+			log.Errorf("CreateMetadataSnapshot: %v", err)
+			last = time.Now().Add(snapshotRetryInterval - interval)
+			continue
+		}
+		log.Infof("Metadata snapshot %s: %d files, %d new (%d bytes)", snap.Name, snap.Files, snap.NewFiles, snap.NewBytes)
+		last = snap.Time
+		lastSnapshot.Set(float64(last.Unix()))
+	}
+}
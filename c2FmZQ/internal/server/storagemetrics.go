@@ -0,0 +1,36 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// storageMetricsLoop updates the database's storage metrics every
+// StorageMetricsInterval. The first update happens right away so that the
+// gauges aren't empty after a restart.
+func (s *Server) storageMetricsLoop() {
+	for {
+		if _, err := s.db.UpdateStorageMetrics(); err != nil {
+			log.Errorf("UpdateStorageMetrics: %v", err)
+		}
+		time.Sleep(s.StorageMetricsInterval)
+	}
+}
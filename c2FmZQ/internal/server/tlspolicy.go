@@ -0,0 +1,160 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// TLSPolicy contains the TLS settings of the server.
+type TLSPolicy struct {
+	// MinVersion is the minimum TLS version. The default is TLS 1.2.
+	MinVersion uint16
+	// CipherSuites are the cipher suites that are allowed with TLS 1.2.
+	// The cipher suites of TLS 1.3 are not configurable. When empty, the
+	// Go defaults are used.
+	CipherSuites []uint16
+	// CurvePreferences are the elliptic curves that are allowed, in order
+	// of preference. When empty, the Go defaults are used.
+	CurvePreferences []tls.CurveID
+	// OCSPStapling enables OCSP stapling for the certificates loaded by
+	// RunWithTLS.
+	OCSPStapling bool
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// NewTLSPolicy parses the TLS options and returns a TLSPolicy. minVersion is
+// "1.2" or "1.3". cipherSuites and curves are comma-separated lists of names,
+// e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" and "X25519,P256". Only the
+// cipher suites that Go considers secure are accepted.
+func NewTLSPolicy(minVersion, cipherSuites, curves string, ocspStapling bool) (TLSPolicy, error) {
+	p := TLSPolicy{OCSPStapling: ocspStapling}
+	switch minVersion {
+	case "", "1.2":
+		p.MinVersion = tls.VersionTLS12
+	case "1.3":
+		p.MinVersion = tls.VersionTLS13
+	default:
+		return p, fmt.Errorf("invalid TLS version %q", minVersion)
+	}
+	suites := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+	for _, name := range splitList(cipherSuites) {
+		id, ok := suites[name]
+		if !ok {
+			return p, fmt.Errorf("invalid or insecure cipher suite %q", name)
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[strings.ToLower(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return p, fmt.Errorf("invalid curve %q", name)
+		}
+		p.CurvePreferences = append(p.CurvePreferences, id)
+	}
+	return p, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// tlsConfig returns a tls.Config that implements the policy.
+func (p TLSPolicy) tlsConfig() *tls.Config {
+	c := &tls.Config{
+		MinVersion:       p.MinVersion,
+		CipherSuites:     p.CipherSuites,
+		CurvePreferences: p.CurvePreferences,
+	}
+	if c.MinVersion == 0 {
+		c.MinVersion = tls.VersionTLS12
+	}
+	return c
+}
+
+// fetchOCSPStaple gets an OCSP response for the certificate from its issuer's
+// OCSP server. The certificate file must contain the issuer's certificate
+// after the leaf. It returns the raw response, and the time when it should be
+// refreshed.
+func fetchOCSPStaple(cert *tls.Certificate) ([]byte, time.Time, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, time.Time{}, errors.New("the certificate file has no issuer certificate")
+	}
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return nil, time.Time{}, errors.New("the certificate has no OCSP server")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	hc := http.Client{Timeout: 30 * time.Second}
+	resp, err := hc.Post(cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP server returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r, err := ocsp.ParseResponseForCert(body, cert.Leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if r.Status != ocsp.Good {
+		return nil, time.Time{}, fmt.Errorf("OCSP status is %d", r.Status)
+	}
+	// Refresh halfway through the validity of the response.
+	refresh := r.ThisUpdate.Add(r.NextUpdate.Sub(r.ThisUpdate) / 2)
+	if r.NextUpdate.IsZero() {
+		refresh = time.Now().Add(time.Hour)
+	}
+	return body, refresh, nil
+}
@@ -0,0 +1,77 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server"
+)
+
+func TestNewTLSPolicy(t *testing.T) {
+	p, err := server.NewTLSPolicy("1.3", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "X25519,P-256", true)
+	if err != nil {
+		t.Fatalf("NewTLSPolicy: %v", err)
+	}
+	want := server.TLSPolicy{
+		MinVersion:       tls.VersionTLS13,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		OCSPStapling:     true,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("NewTLSPolicy() = %+v, want %+v", p, want)
+	}
+
+	for _, tc := range []struct{ version, suites, curves string }{
+		{"1.1", "", ""},
+		{"", "TLS_RSA_WITH_RC4_128_SHA", ""},
+		{"", "FOO", ""},
+		{"", "", "P224"},
+	} {
+		if _, err := server.NewTLSPolicy(tc.version, tc.suites, tc.curves, false); err == nil {
+			t.Errorf("NewTLSPolicy(%q, %q, %q) didn't fail", tc.version, tc.suites, tc.curves)
+		}
+	}
+}
+
+func TestTLS13Only(t *testing.T) {
+	addr := startTLSServer(t, time.Now().Add(time.Hour), func(s *server.Server) {
+		p, err := server.NewTLSPolicy("1.3", "", "", false)
+		if err != nil {
+			t.Fatalf("NewTLSPolicy: %v", err)
+		}
+		s.TLSPolicy = p
+	})
+
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake succeeded")
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().Version; got != tls.VersionTLS13 {
+		t.Errorf("Version = %x, want %x", got, tls.VersionTLS13)
+	}
+}
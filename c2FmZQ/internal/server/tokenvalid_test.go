@@ -0,0 +1,75 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle/token"
+)
+
+func TestTokenValidBeforeEpochs(t *testing.T) {
+	tk := token.MakeKey()
+	defer tk.Wipe()
+	mint := func(tok token.Token) (token.Token, string) {
+		s := token.Mint(tk, tok, time.Hour)
+		d, err := token.Decrypt(tk, s)
+		if err != nil {
+			t.Fatalf("token.Decrypt: %v", err)
+		}
+		return d, s
+	}
+	// A download URL that was issued before the upgrade.
+	dl, dlStr := mint(token.Token{Scope: "download", Subject: 1, File: "file"})
+	session, sessionStr := mint(token.Token{Scope: "session", Subject: 1})
+
+	// The user hasn't logged in since the upgrade.
+	user := database.User{ValidTokens: map[string]bool{token.Hash(sessionStr): true}}
+	if !tokenValid(user, dl, dlStr) {
+		t.Error("download token rejected with epoch 0")
+	}
+	if !tokenValid(user, session, sessionStr) {
+		t.Error("session token rejected with epoch 0")
+	}
+
+	// The login moves the user to epoch 1.
+	user.TokenEpoch = 1
+	if !tokenValid(user, dl, dlStr) {
+		t.Error("download token rejected with epoch 1")
+	}
+
+	// Logout revokes the token.
+	user.RevokeToken(token.Hash(dlStr), time.Now().Add(time.Hour).Unix())
+	if tokenValid(user, dl, dlStr) {
+		t.Error("revoked download token accepted")
+	}
+
+	// RevokeAllTokens revokes the old tokens, even before the first login.
+	for _, epoch := range []int64{0, 1} {
+		u := database.User{TokenEpoch: epoch}
+		u.RevokeAllTokens()
+		if tokenValid(u, dl, dlStr) {
+			t.Errorf("download token accepted after RevokeAllTokens from epoch %d", epoch)
+		}
+		if tokenValid(u, session, sessionStr) {
+			t.Errorf("session token accepted after RevokeAllTokens from epoch %d", epoch)
+		}
+	}
+}
@@ -20,6 +20,8 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
@@ -37,6 +39,12 @@ import (
 //     files.
 //   - cntST - The timestamp of the last seen changes to contacts.
 //   - delST - The timestamp of the last seen delete events.
+//   - commentsST - The timestamp of the last seen changes to album comments.
+//     Comments are only returned when this argument is present.
+//   - reactionsST - The timestamp of the last seen changes to reactions.
+//     Reactions are only returned when this argument is present.
+//   - seenST - The timestamp of the last seen changes to "last seen" markers.
+//     Markers are only returned when this argument is present.
 //
 // Returns:
 //   - files: unseen changes in Gallery
@@ -45,8 +53,16 @@ import (
 //   - albumFiles: unseen changes in album files
 //   - contacts: unseen changes in contacts
 //   - deletes: unseen deletions (files, albums, contacts, etc)
+//   - comments: unseen comments in albums
+//   - commentDeletes: unseen deletions of comments
+//   - reactions: unseen reactions to album files
+//   - reactionDeletes: unseen deletions of reactions
+//   - seen: unseen changes to the album members' "last seen" markers
 //   - spacedUsed: the number of megabytes of storage used.
 //   - spaceQuota: the user's quota in megabytes.
+//   - storage: the user's storage usage, quota, and file counts, in bytes.
+//   - pollInterval: the minimum number of seconds before the next call, when
+//     the server wants the clients to poll less often, e.g. under load.
 func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingle.Response {
 	fileST := parseInt(req.PostFormValue("filesST"), 0)
 	trashST := parseInt(req.PostFormValue("trashST"), 0)
@@ -55,6 +71,34 @@ func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingl
 	cntST := parseInt(req.PostFormValue("cntST"), 0)
 	delST := parseInt(req.PostFormValue("delST"), 0)
 
+	// Idle devices keep polling with the same timestamps. When the last
+	// response for these timestamps had no changes, and nothing changed
+	// since, it is sent again without reading all the file sets.
+	cacheKey := updatesCacheKey(user, req)
+	watermark, err := s.db.UpdatesWatermark(user)
+	if err != nil {
+		log.Errorf("UpdatesWatermark() failed: %v", err)
+		watermark = ""
+	}
+	if v, ok := s.updatesCache.Get(cacheKey); ok && watermark != "" {
+		if e := v.(updatesCacheEntry); e.watermark == watermark {
+			return s.withPollHint(e.resp)
+		}
+	}
+
+	// References to albums that were deleted by their owner would make the
+	// updates fail. They are removed, with delete events for the clients.
+	// A deleted album file changes the watermark, so this is never skipped
+	// when it is needed.
+	if _, err := s.db.RepairAlbumRefs(user); err != nil {
+		log.Errorf("RepairAlbumRefs() failed: %v", err)
+	}
+
+	// Files that are moved while the updates are read could otherwise
+	// appear in two sets, or in neither.
+	release := s.db.Snapshot(user)
+	defer release()
+
 	files, err := s.db.FileUpdates(user, stingle.GallerySet, fileST)
 	if err != nil {
 		log.Errorf("FileUpdates() failed: %v", err)
@@ -88,13 +132,43 @@ func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingl
 		log.Errorf("DeleteUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
-	spaceUsed, err := s.db.SpaceUsed(user)
-	if err != nil {
-		log.Errorf("SpaceUSed() failed: %v", err)
+	var comments []stingle.Comment
+	var commentDeletes []stingle.DeleteEvent
+	_, wantComments := req.PostForm["commentsST"]
+	if wantComments {
+		commentsST := parseInt(req.PostFormValue("commentsST"), 0)
+		comments, commentDeletes, err = s.db.CommentUpdates(user, commentsST)
+		if err == database.ErrUpdateTimestampTooOld {
+			outOfSync = true
+		} else if err != nil {
+			log.Errorf("CommentUpdates() failed: %v", err)
+			return stingle.ResponseNOK()
+		}
 	}
-	spaceQuota, err := s.db.Quota(user.UserID)
+	var reactions []stingle.Reaction
+	var reactionDeletes []stingle.DeleteEvent
+	_, wantReactions := req.PostForm["reactionsST"]
+	if wantReactions {
+		reactionsST := parseInt(req.PostFormValue("reactionsST"), 0)
+		reactions, reactionDeletes, err = s.db.ReactionUpdates(user, reactionsST)
+		if err == database.ErrUpdateTimestampTooOld {
+			outOfSync = true
+		} else if err != nil {
+			log.Errorf("ReactionUpdates() failed: %v", err)
+			return stingle.ResponseNOK()
+		}
+	}
+	var seen []stingle.SeenMarker
+	_, wantSeen := req.PostForm["seenST"]
+	if wantSeen {
+		if seen, err = s.db.SeenMarkerUpdates(user, parseInt(req.PostFormValue("seenST"), 0)); err != nil {
+			log.Errorf("SeenMarkerUpdates() failed: %v", err)
+			return stingle.ResponseNOK()
+		}
+	}
+	storage, err := s.db.StorageUsage(user)
 	if err != nil {
-		log.Errorf("Quota() failed: %v", err)
+		log.Errorf("StorageUsage() failed: %v", err)
 	}
 
 	r := stingle.ResponseOK().
@@ -104,10 +178,90 @@ func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingl
 		AddPart("albumFiles", albumFiles).
 		AddPart("contacts", contacts).
 		AddPart("deletes", deletes).
-		AddPart("spaceUsed", fmt.Sprintf("%d", spaceUsed>>20)).
-		AddPart("spaceQuota", fmt.Sprintf("%d", spaceQuota>>20))
+		AddPart("spaceUsed", fmt.Sprintf("%d", storage.SpaceUsed>>20)).
+		AddPart("spaceQuota", fmt.Sprintf("%d", storage.Quota>>20)).
+		AddPart("storage", storage)
+	if wantComments {
+		r.AddPart("comments", comments).
+			AddPart("commentDeletes", commentDeletes)
+	}
+	if wantReactions {
+		r.AddPart("reactions", reactions).
+			AddPart("reactionDeletes", reactionDeletes)
+	}
+	if wantSeen {
+		r.AddPart("seen", seen)
+	}
 	if outOfSync {
 		r.AddError("Your app is too far out of sync. Upload your changes, then wipe your data, and login again.")
 	}
-	return r
+	noChanges := len(files) == 0 && len(trash) == 0 && len(albums) == 0 && len(albumFiles) == 0 &&
+		len(contacts) == 0 && len(deletes) == 0 && len(comments) == 0 && len(commentDeletes) == 0 &&
+		len(reactions) == 0 && len(reactionDeletes) == 0 && len(seen) == 0
+	if watermark != "" && noChanges && !outOfSync {
+		s.updatesCache.Add(cacheKey, updatesCacheEntry{watermark: watermark, resp: r})
+	} else {
+		s.updatesCache.Remove(cacheKey)
+	}
+	return s.withPollHint(r)
+}
+
+// maxPollInterval is the longest poll interval that the server suggests.
+const maxPollInterval = 15 * time.Minute
+
+// pollInterval returns the minimum time that the clients should wait before
+// polling for updates again. It is MinPollInterval, or longer when requests
+// are waiting for their turn. Zero means no suggestion.
+func (s *Server) pollInterval() time.Duration {
+	d := s.MinPollInterval
+	if s.requests == nil {
+		return d
+	}
+	if q := s.requests.Queued(); q > 0 {
+		if d < time.Minute {
+			d = time.Minute
+		}
+		if n := s.MaxConcurrentRequests; n > 0 {
+			d *= time.Duration(1 + q/n)
+		}
+	}
+	if d > maxPollInterval {
+		d = maxPollInterval
+	}
+	return d
+}
+
+// withPollHint returns a copy of r with the pollInterval part, when the
+// server has a suggestion. r itself may be in the updates cache and isn't
+// modified.
+func (s *Server) withPollHint(r *stingle.Response) *stingle.Response {
+	d := s.pollInterval()
+	if d <= 0 {
+		return r
+	}
+	parts := make(map[string]interface{})
+	for k, v := range r.Parts.(map[string]interface{}) {
+		parts[k] = v
+	}
+	parts["pollInterval"] = fmt.Sprintf("%d", int64(d/time.Second))
+	return &stingle.Response{Status: r.Status, Parts: parts, Infos: r.Infos, Errors: r.Errors}
+}
+
+// updatesCacheEntry is a getUpdates response without changes, and the
+// watermark of the user's data when it was computed.
+type updatesCacheEntry struct {
+	watermark string
+	resp      *stingle.Response
+}
+
+// updatesCacheKey returns the key of a getUpdates request in the updates
+// cache, i.e. the user and all the timestamps.
+func updatesCacheKey(user database.User, req *http.Request) string {
+	v := url.Values{}
+	for _, k := range []string{"filesST", "trashST", "albumsST", "albumFilesST", "cntST", "delST", "commentsST", "reactionsST", "seenST"} {
+		if vv, ok := req.PostForm[k]; ok {
+			v[k] = vv
+		}
+	}
+	return fmt.Sprintf("%d?%s", user.UserID, v.Encode())
 }
@@ -18,13 +18,149 @@
 package server_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
+	"testing"
+	"time"
 
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
 	"c2FmZQ/internal/stingle"
 )
 
+func TestStorageUsage(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.addAlbum("album1", 1000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+	var size int64
+	for _, f := range []struct{ name, set, albumID string }{
+		{"file1", stingle.GallerySet, ""},
+		{"file2", stingle.GallerySet, ""},
+		{"file3", stingle.AlbumSet, "album1"},
+	} {
+		if _, err := c.uploadFile(f.name, f.set, f.albumID, 1000); err != nil {
+			t.Fatalf("c.uploadFile(%q) failed: %v", f.name, err)
+		}
+		size += int64(len(fmt.Sprintf("Content of %q filename %q", "file", f.name)))
+		size += int64(len(fmt.Sprintf("Content of %q filename %q", "thumb", f.name)))
+	}
+
+	sr, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	storage, ok := sr.Part("storage").(map[string]interface{})
+	if !ok {
+		t.Fatalf("Unexpected storage part: %#v", sr.Part("storage"))
+	}
+	want := map[string]int64{
+		"spaceUsed":       size,
+		"sharedSpaceUsed": 0,
+		"galleryFiles":    2,
+		"trashFiles":      0,
+		"albumFiles":      1,
+		"albums":          1,
+	}
+	for k, v := range want {
+		if got, _ := storage[k].(json.Number).Int64(); got != v {
+			t.Errorf("storage[%q] = %v, want %d", k, storage[k], v)
+		}
+	}
+	if quota, _ := storage["quota"].(json.Number).Int64(); quota <= 0 {
+		t.Errorf("Unexpected quota: %v", storage["quota"])
+	}
+}
+
+func TestGetUpdatesNoChanges(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	database.CurrentTimeForTesting = 1000
+	if _, err := c.uploadFile("file1", stingle.TrashSet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+	const ts = 1000
+
+	count := func(sr *stingle.Response, part string) int {
+		items, _ := sr.Part(part).([]interface{})
+		return len(items)
+	}
+	// The same request twice without changes. The second response comes
+	// from the cache.
+	for i := 0; i < 2; i++ {
+		sr, err := c.getUpdates(0, ts, ts, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("c.getUpdates failed: %v", err)
+		}
+		if n := count(sr, "trash"); n != 0 {
+			t.Errorf("getUpdates returned %d trash files, want 0", n)
+		}
+	}
+	// New changes must be seen with the same timestamps.
+	database.CurrentTimeForTesting = 2000
+	if _, err := c.uploadFile("file2", stingle.TrashSet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+	sr, err := c.getUpdates(0, ts, ts, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	if n := count(sr, "trash"); n != 1 {
+		t.Errorf("getUpdates returned %d trash files, want 1", n)
+	}
+	if err := c.addAlbum("album1", 2000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+	if sr, err = c.getUpdates(0, ts, ts, 0, 0, 0); err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	if n := count(sr, "albums"); n != 1 {
+		t.Errorf("getUpdates returned %d albums, want 1", n)
+	}
+}
+
+func TestGetUpdatesPollInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		want     interface{}
+	}{
+		{0, nil},
+		{2 * time.Minute, "120"},
+	} {
+		sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+			s.MinPollInterval = tc.interval
+		})
+		c, err := createAccountAndLogin(sock, "alice")
+		if err != nil {
+			t.Fatalf("createAccountAndLogin failed: %v", err)
+		}
+		// The second response comes from the updates cache.
+		for i := 0; i < 2; i++ {
+			sr, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("c.getUpdates failed: %v", err)
+			}
+			if got := sr.Part("pollInterval"); got != tc.want {
+				t.Errorf("[%s] pollInterval = %v, want %v", tc.interval, got, tc.want)
+			}
+		}
+		shutdown()
+	}
+}
+
 func (c *client) getUpdates(fileST, trashST, albumsST, albumFilesST, cntST, delST int64) (*stingle.Response, error) {
 	form := url.Values{}
 	form.Set("token", c.token)
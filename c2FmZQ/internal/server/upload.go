@@ -18,6 +18,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -27,25 +28,57 @@ import (
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/timing"
 )
 
 // The return value of receiveUpload.
 type upload struct {
 	database.FileSpec
-	token   string
-	name    string
-	set     string
-	albumID string
+	token    string
+	name     string
+	set      string
+	albumID  string
+	importID string
+	uploadID string
+	// The upload slot reserved with acquireUploadSlot, if any.
+	slot *uploadSlotKey
+
+	// Only used with deltas. See handleUploadDelta.
+	deltaSize int64
+	baseSet   string
+	baseFile  string
 }
 
-// receiveUpload processes a multipart/form-data.
-func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
+// applyDeltaFunc assembles the file content from a delta, and writes it to w.
+type applyDeltaFunc func(ctx context.Context, up *upload, delta io.Reader, w io.Writer) (int64, error)
+
+// receiveUpload processes a multipart/form-data. When applyDelta is set, the
+// file content can be a delta instead.
+//
+// Each file is streamed to a temporary blob as it is received, and its content
+// hash is computed along the way. When the token comes before the files, the
+// request is authenticated before any content is written to disk, and the
+// files are rejected as soon as they exceed the remaining quota.
+func (s *Server) receiveUpload(dir string, req *http.Request, applyDelta applyDeltaFunc) (_ *upload, retErr error) {
 	ctx := req.Context()
 	mr, err := req.MultipartReader()
 	if err != nil {
 		return nil, err
 	}
 	var upload upload
+	defer func() {
+		if upload.slot != nil {
+			s.releaseUploadSlot(*upload.slot)
+		}
+		if retErr != nil {
+			upload.removeTemps()
+		}
+	}()
+	var (
+		user      *database.User
+		remaining int64 = -1
+		numFiles  int
+	)
 
 	for {
 		s.setDeadline(ctx, time.Now().Add(time.Minute))
@@ -57,12 +90,42 @@ func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
 			return nil, err
 		}
 		if p.FileName() != "" {
+			if numFiles == 0 && user != nil && upload.set != "" {
+				if remaining, err = s.db.RemainingQuota(*user, upload.set, upload.albumID); err != nil {
+					// AddFile will reject the upload later.
+					log.Debugf("receiveUpload: RemainingQuota: %v", err)
+					remaining = -1
+				}
+			}
+			numFiles++
 			f, name, err := s.db.TempFile(dir)
 			if err != nil {
 				return nil, err
 			}
-			size, err := s.copyWithCtx(ctx, f, p)
+			var w io.Writer = f
+			var qw *quotaWriter
+			if remaining >= 0 {
+				qw = &quotaWriter{w: f, n: remaining}
+				w = qw
+			}
+			var size int64
+			done := timing.FromContext(ctx).Start("blob")
+			if p.FormName() == "delta" && applyDelta != nil {
+				cr := &countingReader{r: p}
+				size, err = applyDelta(ctx, &upload, cr, w)
+				upload.deltaSize = cr.n
+			} else {
+				size, err = s.copyWithCtx(ctx, w, p)
+			}
+			done()
+			if qw != nil {
+				remaining = qw.n
+				if qw.exceeded {
+					err = database.ErrQuotaExceeded
+				}
+			}
 			if err != nil {
+				f.Close()
 				if err := os.Remove(name); err != nil {
 					log.Errorf("os.Remove(%q): %v", name, err)
 				}
@@ -70,12 +133,15 @@ func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
 			}
 
 			upload.name = p.FileName()
-			if p.FormName() == "file" {
+			if p.FormName() == "file" || (p.FormName() == "delta" && applyDelta != nil) {
 				upload.FileSpec.StoreFile = name
 				upload.FileSpec.StoreFileSize = size
 			} else if p.FormName() == "thumb" {
 				upload.FileSpec.StoreThumb = name
 				upload.FileSpec.StoreThumbSize = size
+			} else if p.FormName() == "medium" {
+				upload.FileSpec.StoreMedium = name
+				upload.FileSpec.StoreMediumSize = size
 			}
 
 			if err := f.Close(); err != nil {
@@ -111,6 +177,48 @@ func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
 				upload.FileSpec.Version = slurp
 			case "token":
 				upload.token = slurp
+				if numFiles > 0 {
+					break
+				}
+				done := timing.FromContext(ctx).Start("auth")
+				_, u, err := s.checkToken(slurp, "session")
+				done()
+				if err != nil {
+					s.logAuthFailure(req, authFailureToken, "")
+					return nil, fmt.Errorf("checkToken: %w", err)
+				}
+				user = &u
+			case "importId":
+				// The import ID comes after the token and before the
+				// file content, so that the upload can be rejected
+				// early when the client exceeds its parallel upload
+				// limit.
+				if user == nil {
+					return nil, fmt.Errorf("importId before token: %w", errInvalidImport)
+				}
+				if upload.importID != "" {
+					return nil, errTooManyUploads
+				}
+				if _, err := s.db.ImportSession(*user, slurp); err != nil {
+					if err == database.ErrImportNotFound {
+						return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+					}
+					return nil, err
+				}
+				key := uploadSlotKey{userID: user.UserID, importID: slurp}
+				if !s.acquireUploadSlot(key) {
+					return nil, errTooManyUploads
+				}
+				upload.importID = slurp
+				upload.slot = &key
+			case "fingerprint":
+				upload.FileSpec.Fingerprint = slurp
+			case "uploadId":
+				upload.uploadID = slurp
+			case "baseSet":
+				upload.baseSet = slurp
+			case "baseFile":
+				upload.baseFile = slurp
 			default:
 				log.Errorf("receiveUpload: unexpected form input: %q=%q", p.FormName(), slurp)
 			}
@@ -119,3 +227,44 @@ func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
 
 	return &upload, nil
 }
+
+// removeTemps removes the temporary files that were received.
+func (up *upload) removeTemps() {
+	for _, name := range []string{up.FileSpec.StoreFile, up.FileSpec.StoreThumb, up.FileSpec.StoreMedium} {
+		if name == "" {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Errorf("os.Remove(%q): %v", name, err)
+		}
+	}
+}
+
+// quotaWriter writes at most n bytes to w, the remaining quota of the user.
+type quotaWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > w.n {
+		w.exceeded = true
+		return 0, database.ErrQuotaExceeded
+	}
+	n, err := w.w.Write(b)
+	w.n -= int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,135 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// handleActiveDevices handles the /v2x/config/activeDevices endpoint. It
+// returns the number of distinct devices, i.e. session tokens, that used the
+// account recently.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments:
+//   - token: The signed session token.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Parts("daily", number of devices active today)
+//     Parts("weekly", number of devices active in the last 7 days)
+func (s *Server) handleActiveDevices(user database.User, req *http.Request) *stingle.Response {
+	devices, err := s.db.ActiveDevices(user.UserID)
+	if err != nil {
+		log.Errorf("ActiveDevices: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().
+		AddPart("daily", fmt.Sprintf("%d", devices.Daily)).
+		AddPart("weekly", fmt.Sprintf("%d", devices.Weekly))
+}
+
+// usageReportLoop sends the monthly usage report to the admins shortly after
+// the beginning of each month, until ctx is cancelled.
+func (s *Server) usageReportLoop(ctx context.Context) {
+	for {
+		if err := s.sendUsageReport(time.Now().UTC()); err != nil {
+			log.Errorf("sendUsageReport: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// sendUsageReport sends the usage report for the month before now, unless it
+// was already sent. When multiple server instances share the database, only
+// one of them sends it. The usage that the other instances haven't saved yet
+// isn't included.
+func (s *Server) sendUsageReport(now time.Time) error {
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0).Format("2006-01")
+	if s.db.Clustered() {
+		unlock, err := s.db.LockUsageReport()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	sent, err := s.db.UsageReportSent(month)
+	if err != nil || sent {
+		return err
+	}
+	if err := s.db.FlushUsage(); err != nil {
+		return err
+	}
+	usage, err := s.db.UsageReport(month)
+	if err != nil {
+		return err
+	}
+	var to []string
+	for _, u := range usage {
+		user, err := s.db.UserByID(u.UserID)
+		if err != nil {
+			return err
+		}
+		if user.Admin {
+			to = append(to, user.Email)
+		}
+	}
+	if err := s.Mailer.Send(to, "c2FmZQ usage report for "+month, formatUsageReport(month, usage)); err != nil {
+		return err
+	}
+	log.Infof("Sent usage report for %s to %d admin(s)", month, len(to))
+	return s.db.SetUsageReportSent(month)
+}
+
+func formatUsageReport(month string, usage []database.UserUsage) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "API usage for %s\n\n", month)
+	fmt.Fprintf(&sb, "%-40s %10s %12s %12s %12s %12s\n", "Account", "Requests", "Uploaded", "Downloaded", "Storage", "Shared")
+	for _, u := range usage {
+		fmt.Fprintf(&sb, "%-40s %10d %12s %12s %12s %12s\n", u.Email, u.Requests, formatBytes(u.BytesUploaded), formatBytes(u.BytesDownloaded), formatBytes(u.SpaceUsed), formatBytes(u.SharedSpaceUsed))
+	}
+	return sb.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
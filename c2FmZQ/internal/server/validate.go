@@ -0,0 +1,221 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const paramsKey ctxKey = 3
+
+// The type of a form parameter.
+type paramType int
+
+const (
+	paramString paramType = iota
+	paramInt
+	paramBool
+	paramJSON
+)
+
+// paramRule describes what a valid form parameter looks like.
+type paramRule struct {
+	// Whether the parameter must be present and not empty.
+	required bool
+	// The type of the parameter's value.
+	typ paramType
+	// The range of paramInt values.
+	min, max int64
+	// The maximum length of the value, in bytes. Zero means no limit.
+	maxLen int
+}
+
+const (
+	maxIDLen       = 256
+	maxKeyLen      = 4096
+	maxMetadataLen = 64 << 10
+	maxCount       = 100000
+)
+
+var (
+	idParam       = paramRule{required: true, maxLen: maxIDLen}
+	optIDParam    = paramRule{maxLen: maxIDLen}
+	keyParam      = paramRule{required: true, maxLen: maxKeyLen}
+	metadataParam = paramRule{required: true, maxLen: maxMetadataLen}
+	timeParam     = paramRule{typ: paramInt, min: 0, max: 1 << 53}
+	boolParam     = paramRule{typ: paramBool}
+	countParam    = paramRule{required: true, typ: paramInt, min: 0, max: maxCount}
+	jsonParam     = paramRule{required: true, typ: paramJSON, maxLen: 1 << 20}
+)
+
+// paramSpecs are the rules for the parameters of each endpoint. The
+// parameters that aren't listed are not checked.
+var paramSpecs = map[string]map[string]paramRule{
+	"/v2/sync/addAlbum": {
+		"albumId":       idParam,
+		"dateCreated":   timeParam,
+		"dateModified":  timeParam,
+		"encPrivateKey": keyParam,
+		"metadata":      metadataParam,
+		"publicKey":     keyParam,
+	},
+	"/v2/sync/deleteAlbum":       {"albumId": idParam},
+	"/v2/sync/changeAlbumCover":  {"albumId": idParam, "cover": paramRule{maxLen: maxIDLen}},
+	"/v2/sync/renameAlbum":       {"albumId": idParam, "metadata": metadataParam},
+	"/v2/sync/share":             {"album": jsonParam, "sharingKeys": jsonParam},
+	"/v2/sync/editPerms":         {"album": jsonParam},
+	"/v2/sync/removeAlbumMember": {"album": jsonParam, "memberUserId": paramRule{required: true, typ: paramInt, min: 1, max: 1 << 53}},
+	"/v2/sync/unshareAlbum":      {"albumId": idParam},
+	"/v2/sync/leaveAlbum":        {"albumId": idParam},
+	"/v2/sync/moveFile": {
+		"albumIdFrom": optIDParam,
+		"albumIdTo":   optIDParam,
+		"count":       countParam,
+		"isMoving":    boolParam,
+		"setFrom":     paramRule{required: true, maxLen: 1},
+		"setTo":       paramRule{required: true, maxLen: 1},
+	},
+	"/v2/sync/delete":       {"count": countParam},
+	"/v2/sync/emptyTrash":   {"time": timeParam},
+	"/v2x/sync/addComment":  {"albumId": idParam, "file": idParam, "content": metadataParam},
+	"/v2x/sync/setReaction": {"albumId": idParam, "file": idParam, "content": paramRule{maxLen: maxKeyLen}},
+	"/v2x/sync/setSeen":     {"albumId": idParam, "content": paramRule{maxLen: maxKeyLen}},
+	"/v2x/sync/albumInvite": {"albumId": idParam, "revoke": boolParam},
+	"/v2x/sync/joinAlbum":   {"code": idParam},
+	"/v2x/sync/answerJoinRequest": {
+		"albumId":    idParam,
+		"userId":     paramRule{required: true, typ: paramInt, min: 1, max: 1 << 53},
+		"approve":    boolParam,
+		"sharingKey": paramRule{maxLen: maxKeyLen},
+	},
+	"/v2x/sync/albumDigest":      {"albumId": optIDParam, "period": paramRule{typ: paramInt, min: 0, max: 1 << 31}},
+	"/v2x/sync/albumUnshareDate": {"albumId": idParam, "date": paramRule{required: true, typ: paramInt, min: 0, max: 1 << 53}},
+}
+
+// paramError is a parameter that doesn't follow its rule.
+type paramError struct {
+	Param  string `json:"param"`
+	Reason string `json:"reason"`
+}
+
+func (e paramError) String() string {
+	return fmt.Sprintf("%s: %s", e.Param, e.Reason)
+}
+
+// validateParams checks the parameters of a request against the rules of the
+// endpoint. It returns the parameters that are invalid, sorted by name.
+func validateParams(endpoint string, params map[string]string) []paramError {
+	var errs []paramError
+	for name, rule := range paramSpecs[endpoint] {
+		if reason := rule.check(params[name]); reason != "" {
+			errs = append(errs, paramError{Param: name, Reason: reason})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Param < errs[j].Param })
+	return errs
+}
+
+// check returns why value doesn't follow the rule, or an empty string.
+func (r paramRule) check(value string) string {
+	if value == "" {
+		if r.required {
+			return "required"
+		}
+		return ""
+	}
+	if r.maxLen > 0 && len(value) > r.maxLen {
+		return fmt.Sprintf("longer than %d bytes", r.maxLen)
+	}
+	switch r.typ {
+	case paramString:
+		if !utf8.ValidString(value) {
+			return "invalid utf-8"
+		}
+	case paramInt:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "not an integer"
+		}
+		if v < r.min || v > r.max {
+			return fmt.Sprintf("not between %d and %d", r.min, r.max)
+		}
+	case paramBool:
+		if value != "0" && value != "1" {
+			return "not 0 or 1"
+		}
+	case paramJSON:
+		if !json.Valid([]byte(value)) {
+			return "invalid json"
+		}
+	}
+	return ""
+}
+
+// formatParamErrors returns a message for the user about invalid parameters.
+func formatParamErrors(errs []paramError) string {
+	s := make([]string, len(errs))
+	for i, e := range errs {
+		s[i] = e.String()
+	}
+	return "Invalid parameters: " + strings.Join(s, ", ")
+}
+
+// decodedParams are the decoded parameters of a request, kept in the request's
+// context after they are validated, so that they are only decoded once.
+type decodedParams struct {
+	raw    string
+	params map[string]string
+}
+
+func withDecodedParams(ctx context.Context, raw string, params map[string]string) context.Context {
+	return context.WithValue(ctx, paramsKey, decodedParams{raw: raw, params: params})
+}
+
+// checkParams validates the parameters of a request when the endpoint has
+// rules. It returns the request with the decoded parameters in its context, and
+// an error response if the parameters are invalid.
+func (s *Server) checkParams(user database.User, req *http.Request) (*http.Request, *stingle.Response) {
+	endpoint := strings.TrimPrefix(req.URL.Path, s.pathPrefix)
+	if _, ok := paramSpecs[endpoint]; !ok {
+		return req, nil
+	}
+	raw := req.PostFormValue("params")
+	params, err := s.decodeParams(raw, user.WithContext(req.Context()))
+	if err != nil {
+		log.Errorf("decodeParams: %v", err)
+		return req, stingle.ResponseNOK()
+	}
+	if errs := validateParams(endpoint, params); len(errs) > 0 {
+		log.Errorf("%s: invalid params: %v", endpoint, errs)
+		return req, stingle.ResponseNOK().
+			AddError(formatParamErrors(errs)).
+			AddPart("invalidParams", errs)
+	}
+	return req.WithContext(withDecodedParams(req.Context(), raw, params)), nil
+}
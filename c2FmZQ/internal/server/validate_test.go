@@ -0,0 +1,49 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateParams(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		params   map[string]string
+		want     []paramError
+	}{
+		{"/v2/sync/unknown", map[string]string{"x": "y"}, nil},
+		{"/v2/sync/deleteAlbum", map[string]string{"albumId": "foo"}, nil},
+		{"/v2/sync/deleteAlbum", map[string]string{}, []paramError{{"albumId", "required"}}},
+		{"/v2/sync/deleteAlbum", map[string]string{"albumId": strings.Repeat("x", maxIDLen+1)}, []paramError{{"albumId", "longer than 256 bytes"}}},
+		{"/v2/sync/deleteAlbum", map[string]string{"albumId": "\xff"}, []paramError{{"albumId", "invalid utf-8"}}},
+		{
+			"/v2/sync/moveFile",
+			map[string]string{"count": "-1", "isMoving": "yes", "setFrom": "0", "setTo": "2"},
+			[]paramError{{"count", "not between 0 and 100000"}, {"isMoving", "not 0 or 1"}},
+		},
+		{"/v2/sync/share", map[string]string{"album": "{", "sharingKeys": "{}"}, []paramError{{"album", "invalid json"}}},
+		{"/v2x/sync/albumUnshareDate", map[string]string{"albumId": "a", "date": "soon"}, []paramError{{"date", "not an integer"}}},
+	} {
+		if got := validateParams(tc.endpoint, tc.params); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("validateParams(%q, %v) = %v, want %v", tc.endpoint, tc.params, got, tc.want)
+		}
+	}
+}
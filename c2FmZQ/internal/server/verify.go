@@ -0,0 +1,86 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle/token"
+)
+
+// How long an email verification link works.
+const verifyEmailDuration = 24 * time.Hour
+
+// sendVerificationEmail sends a link to verify the user's email address. The
+// link contains a token signed with the user's token key.
+func (s *Server) sendVerificationEmail(user database.User, host string) error {
+	tk, err := s.db.DecryptTokenKey(user.TokenKey)
+	if err != nil {
+		return err
+	}
+	defer tk.Wipe()
+	tok := token.Mint(tk, token.Token{Scope: "verify-email", Subject: user.UserID, Epoch: user.TokenEpoch}, verifyEmailDuration)
+	b := s.BaseURL
+	if b == "" {
+		b = fmt.Sprintf("https://%s%s/", host, s.pathPrefix)
+	}
+	link := fmt.Sprintf("%sv2/register/verify?token=%s", b, url.QueryEscape(tok))
+	body := fmt.Sprintf("Open this link to verify your email address:\n\n%s\n\nThe link expires in %s. If you didn't create an account, ignore this message.\n", link, verifyEmailDuration)
+	return s.Mailer.Send([]string{user.Email}, "c2FmZQ: verify your email address", body)
+}
+
+// handleVerifyEmail handles the /v2/register/verify endpoint. It is the link
+// in the message sent by sendVerificationEmail. The user can log in when their
+// email address is verified.
+//
+// Arguments:
+//   - w: The http response writer.
+//   - req: The http request.
+//
+// Query arguments:
+//   - token: The signed token of the verification link.
+//
+// Returns:
+//   - A text message for the user.
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	_, user, err := s.checkToken(req.URL.Query().Get("token"), "verify-email")
+	if err != nil {
+		log.Infof("%s %s (INVALID TOKEN: %v)", req.Method, req.URL.Path, err)
+		s.logAuthFailure(req, authFailureToken, "")
+		http.Error(w, "This verification link is invalid or expired. Log in to get a new one.", http.StatusBadRequest)
+		return
+	}
+	log.Infof("%s %s (UserID:%d)", req.Method, req.URL.Path, user.UserID)
+	if err := s.db.MutateUser(user.UserID, func(u *database.User) error {
+		u.NeedEmailVerification = false
+		return nil
+	}); err != nil {
+		log.Errorf("MutateUser: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Your email address is verified. You can log in now.")
+}
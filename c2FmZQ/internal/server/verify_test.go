@@ -0,0 +1,88 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/server"
+)
+
+type fakeMailer struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (m *fakeMailer) Send(to []string, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, body)
+	return nil
+}
+
+func (m *fakeMailer) lastLink() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		return ""
+	}
+	return regexp.MustCompile(`http://\S+`).FindString(m.messages[len(m.messages)-1])
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := &fakeMailer{}
+	sock, shutdown := startServerWithOptions(t, func(s *server.Server) {
+		s.RequireEmailVerification = true
+		s.Mailer = mailer
+	})
+	defer shutdown()
+
+	// The first account is the admin. It doesn't need to be verified.
+	if _, err := createAccountAndLogin(sock, "alice"); err != nil {
+		t.Fatalf("createAccountAndLogin(alice) failed: %v", err)
+	}
+	if n := len(mailer.messages); n != 0 {
+		t.Fatalf("%d messages sent, want 0", n)
+	}
+
+	bob := newClient(sock)
+	if err := bob.createAccount("bob"); err != nil {
+		t.Fatalf("bob.createAccount failed: %v", err)
+	}
+	link := mailer.lastLink()
+	if link == "" {
+		t.Fatal("No verification link")
+	}
+	if err := bob.login(); err == nil {
+		t.Fatal("bob.login succeeded before verification")
+	}
+	if n := len(mailer.messages); n != 2 {
+		t.Errorf("%d messages sent, want 2", n)
+	}
+	if _, err := bob.downloadGet(link + "x"); err == nil {
+		t.Error("Verification with a bad link succeeded")
+	}
+	if _, err := bob.downloadGet(link); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	if err := bob.login(); err != nil {
+		t.Fatalf("bob.login failed after verification: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/pwa"
+)
+
+// handleWebApp serves the files of the web app, either the embedded ones, or
+// the ones in WebAppDir. The names of the embedded scripts, stylesheets, and
+// images contain the hash of their content, so they are cached forever.
+func (s *Server) handleWebApp(w http.ResponseWriter, req *http.Request) {
+	if !s.EnableWebApp {
+		http.NotFound(w, req)
+		return
+	}
+	log.Infof("%s %s %s", req.Proto, req.Method, req.RequestURI)
+
+	p := strings.TrimPrefix(req.URL.Path, s.pathPrefix+"/")
+	if p == "" {
+		p = "index.html"
+	}
+	// Only valid relative paths are served, without any hidden file or
+	// directory, so that nothing outside of WebAppDir, and nothing like
+	// .git, is exposed.
+	if !fs.ValidPath(p) || strings.HasPrefix(p, ".") || strings.Contains(p, "/.") {
+		http.NotFound(w, req)
+		return
+	}
+	var b []byte
+	modTime := startTime
+	if s.WebAppDir != "" {
+		fsys := os.DirFS(s.WebAppDir)
+		fi, err := fs.Stat(fsys, p)
+		if err != nil || !fi.Mode().IsRegular() {
+			http.NotFound(w, req)
+			return
+		}
+		if b, err = fs.ReadFile(fsys, p); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		modTime = fi.ModTime()
+		// The files can be replaced at any time. The browsers must
+		// revalidate them before using their cached copy.
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		a, ok := pwa.Assets()[p]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		b = a.Content
+		if a.Immutable {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	}
+	switch path.Ext(p) {
+	case ".webmanifest":
+		w.Header().Set("Content-Type", "application/manifest+json")
+	}
+	http.ServeContent(w, req, p, modTime, bytes.NewReader(b))
+}
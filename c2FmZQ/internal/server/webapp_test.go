@@ -0,0 +1,129 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+)
+
+func TestWebAppDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":    "custom index",
+		"app.js":        "custom app",
+		".git/config":   "secret",
+		"sub/.env":      "secret",
+		"sub/style.css": "custom style",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+	s := server.New(db, "", "", "")
+	s.EnableWebApp = true
+	s.WebAppDir = dir
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/", http.StatusOK, "custom index"},
+		{"/app.js", http.StatusOK, "custom app"},
+		{"/sub/style.css", http.StatusOK, "custom style"},
+		{"/sub", http.StatusNotFound, ""},
+		{"/.git/config", http.StatusNotFound, ""},
+		{"/sub/.env", http.StatusNotFound, ""},
+		{"/%2e%2e/data", http.StatusNotFound, ""},
+		{"/service-worker.js", http.StatusNotFound, ""},
+	} {
+		resp, err := srv.Client().Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", tc.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("Get(%q) status = %d, want %d", tc.path, resp.StatusCode, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if string(body) != tc.body {
+			t.Errorf("Get(%q) = %q, want %q", tc.path, body, tc.body)
+		}
+		if got, want := resp.Header.Get("Cache-Control"), "no-cache"; got != want {
+			t.Errorf("Get(%q) Cache-Control = %q, want %q", tc.path, got, want)
+		}
+		if resp.Header.Get("Last-Modified") == "" {
+			t.Errorf("Get(%q) has no Last-Modified header", tc.path)
+		}
+	}
+}
+
+func TestWebAppHashedAssets(t *testing.T) {
+	db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+	s := server.New(db, "", "", "")
+	s.EnableWebApp = true
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	get := func(path string) (int, string, string) {
+		resp, err := srv.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Cache-Control"), string(body)
+	}
+
+	code, cc, body := get("/")
+	if code != http.StatusOK || cc != "no-cache" {
+		t.Fatalf("Get(/) = %d %q, want 200 no-cache", code, cc)
+	}
+	m := regexp.MustCompile(`src="(main\.[0-9a-f]{16}\.js)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("index.html doesn't reference a hashed main.js: %s", body)
+	}
+	if code, cc, _ := get("/" + m[1]); code != http.StatusOK || cc != "public, max-age=31536000, immutable" {
+		t.Errorf("Get(%q) = %d %q, want 200 immutable", m[1], code, cc)
+	}
+	if code, _, _ := get("/main.js"); code != http.StatusNotFound {
+		t.Errorf("Get(/main.js) = %d, want 404", code)
+	}
+	if code, cc, _ := get("/service-worker.js"); code != http.StatusOK || cc != "no-cache" {
+		t.Errorf("Get(/service-worker.js) = %d %q, want 200 no-cache", code, cc)
+	}
+}
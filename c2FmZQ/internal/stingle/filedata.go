@@ -19,6 +19,7 @@ package stingle
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
@@ -60,11 +61,70 @@ type StreamWriter struct {
 	w   io.Writer
 	c   uint64
 	buf []byte
+
+	base   io.Reader
+	reused int
+}
+
+// ReuseChunks makes the writer reuse the encrypted chunks of base when their
+// plaintext is the same as the chunk being written at the same position.
+// The base stream must have been encrypted with the same key and chunk size,
+// and must be positioned right after its header. The reused chunks are
+// byte-for-byte identical, which lets a new version of a file share them with
+// the old version.
+func (w *StreamWriter) ReuseChunks(base io.Reader) {
+	w.base = base
+}
+
+// ReusedChunks returns the number of chunks that were reused from the base
+// stream.
+func (w *StreamWriter) ReusedChunks() int {
+	return w.reused
+}
+
+// baseChunk reads the next chunk of the base stream, and returns it if its
+// plaintext is b.
+func (w *StreamWriter) baseChunk(ck, b []byte) []byte {
+	enc := make([]byte, int(w.hdr.ChunkSize)+chunkOverhead)
+	n, err := io.ReadFull(w.base, enc)
+	if err == io.EOF || (err != nil && err != io.ErrUnexpectedEOF) || n != len(b)+chunkOverhead {
+		// No more reuse after a mismatched chunk size.
+		w.base = nil
+		return nil
+	}
+	enc = enc[:n]
+	ae, err := chacha20poly1305.NewX(ck)
+	if err != nil {
+		return nil
+	}
+	nonce := enc[:chacha20poly1305.NonceSizeX]
+	dec, err := ae.Open(nil, nonce, enc[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		for i := range dec {
+			dec[i] = 0
+		}
+	}()
+	if subtle.ConstantTimeCompare(dec, b) != 1 {
+		return nil
+	}
+	return enc
 }
 
 func (w *StreamWriter) writeChunk(b []byte) (int, error) {
 	w.c++
 	ck := DeriveKey(w.hdr.SymmetricKey, chacha20poly1305.KeySize, w.c, context)
+	if w.base != nil {
+		if enc := w.baseChunk(ck, b); enc != nil {
+			w.reused++
+			for i := 0; i < len(b); i++ {
+				b[i] = 0
+			}
+			return w.w.Write(enc)
+		}
+	}
 
 	nonce := make([]byte, chacha20poly1305.NonceSizeX)
 	if _, err := rand.Read(nonce); err != nil {
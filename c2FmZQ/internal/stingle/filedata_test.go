@@ -19,6 +19,7 @@ package stingle
 
 import (
 	"bytes"
+	"crypto/rand"
 	"io"
 	"os"
 	"path/filepath"
@@ -115,3 +116,86 @@ func TestFileEncryption(t *testing.T) {
 		t.Errorf("Unexpected read. Want %q, got %q", want, got)
 	}
 }
+
+func TestReuseChunks(t *testing.T) {
+	sk := MakeSecretKeyForTest()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	newHeader := func(size int) *Header {
+		return &Header{
+			FileID:       []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ123456"),
+			Version:      1,
+			ChunkSize:    128,
+			DataSize:     int64(size),
+			SymmetricKey: append([]byte(nil), key...),
+		}
+	}
+	encrypt := func(content []byte, base []byte) ([]byte, int) {
+		var buf bytes.Buffer
+		hdr := newHeader(len(content))
+		if err := EncryptHeader(&buf, hdr, sk.PublicKey()); err != nil {
+			t.Fatalf("EncryptHeader: %v", err)
+		}
+		w := EncryptFile(&buf, hdr)
+		if base != nil {
+			r := bytes.NewReader(base)
+			if err := SkipHeader(r); err != nil {
+				t.Fatalf("SkipHeader: %v", err)
+			}
+			w.ReuseChunks(r)
+		}
+		if _, err := w.Write(append([]byte(nil), content...)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return buf.Bytes(), w.ReusedChunks()
+	}
+	decrypt := func(enc []byte) []byte {
+		r := bytes.NewReader(enc)
+		hdr, err := DecryptHeader(r, sk)
+		if err != nil {
+			t.Fatalf("DecryptHeader: %v", err)
+		}
+		defer hdr.Wipe()
+		out, err := io.ReadAll(DecryptFile(r, hdr))
+		if err != nil {
+			t.Fatalf("DecryptFile: %v", err)
+		}
+		return out
+	}
+
+	// 10 chunks, the last one partial.
+	v1 := make([]byte, 9*128+50)
+	if _, err := rand.Read(v1); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	enc1, reused := encrypt(v1, nil)
+	if reused != 0 {
+		t.Errorf("reused = %d, want 0", reused)
+	}
+
+	// Change the second and the last chunks.
+	v2 := append([]byte(nil), v1...)
+	v2[130] ^= 0xff
+	v2 = append(v2, 'x')
+	enc2, reused := encrypt(v2, enc1)
+	if want := 8; reused != want {
+		t.Errorf("reused = %d, want %d", reused, want)
+	}
+	if got := decrypt(enc2); !bytes.Equal(got, v2) {
+		t.Error("Decrypted content doesn't match")
+	}
+	off1, off2 := len(enc1)-len(v1)-10*chunkOverhead, len(enc2)-len(v2)-10*chunkOverhead
+	encChunk := 128 + chunkOverhead
+	for i := 0; i < 9; i++ {
+		c1 := enc1[off1+i*encChunk : off1+(i+1)*encChunk]
+		c2 := enc2[off2+i*encChunk : off2+(i+1)*encChunk]
+		if want := i != 1; bytes.Equal(c1, c2) != want {
+			t.Errorf("Chunk %d reused = %v, want %v", i, !want, want)
+		}
+	}
+}
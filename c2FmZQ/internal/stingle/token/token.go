@@ -26,14 +26,20 @@
 // // Subject can be used to find the right key for the subject.
 // Subject(encryptedToken) == 44545
 //
+// // KeyID can be used to find the right key when the subject has more than
+// // one, e.g. after a key rotation.
+// KeyID(encryptedToken) == key.ID()
+//
 // // Check returns err=nil iff encryptedToken is valid.
 // tok, err := Check(key, encryptedToken)
 //
 package token
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -43,6 +49,7 @@ import (
 
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"c2FmZQ/internal/crypto/kdf"
 	"c2FmZQ/internal/log"
 )
 
@@ -50,6 +57,26 @@ var (
 	ErrValidationFailed = errors.New("token validation failed")
 )
 
+// The encrypted tokens start with a header that is authenticated, but not
+// encrypted:
+//
+//	version (1 byte) | algorithm (1 byte) | key ID (4 bytes) | subject (8 bytes)
+//
+// followed by the nonce and the ciphertext. Legacy tokens don't have a
+// version, algorithm or key ID. They start with the subject, whose first
+// byte is always 0 because subjects are small positive numbers.
+const (
+	versionLegacy = 0
+	version1      = 1
+
+	// The nonce is derived from the key, the header and the plaintext, in
+	// addition to random bytes, so that a broken random number generator
+	// can't cause a nonce to be reused with different tokens.
+	algXChaCha20Poly1305SIV = 1
+
+	headerSize = 14
+)
+
 // A secret key used to encrypt tokens.
 type Key [chacha20poly1305.KeySize]byte
 
@@ -114,6 +141,36 @@ func (k Key) MarshalJSON() ([]byte, error) {
 	return json.Marshal(base64.RawURLEncoding.EncodeToString(k[:]))
 }
 
+// ID returns the key ID that is included in the tokens encrypted with this
+// key. It doesn't reveal anything about the key itself.
+func (k *Key) ID() uint32 {
+	id := kdf.Derive(k[:], kdf.TokenKeyID, 4)
+	return binary.BigEndian.Uint32(id)
+}
+
+// syntheticNonce returns the nonce to encrypt ser with. Random bytes are
+// mixed in when they are available, so that identical tokens aren't
+// linkable, but uniqueness only depends on hdr and ser.
+func (k *Key) syntheticNonce(hdr, ser []byte) []byte {
+	nk := kdf.Derive(k[:], kdf.TokenNonce, 32)
+	defer wipe(nk)
+	rnd := make([]byte, 16)
+	if _, err := rand.Read(rnd); err != nil {
+		log.Errorf("rand.Read: %v", err)
+	}
+	m := hmac.New(sha256.New, nk)
+	m.Write(rnd)
+	m.Write(hdr)
+	m.Write(ser)
+	return m.Sum(nil)[:chacha20poly1305.NonceSizeX]
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // Holds the information contained in the encrypted token.
 type Token struct {
 	// Who this token was issued to.
@@ -130,6 +187,12 @@ type Token struct {
 	Set string `json:"set,omitempty"`
 	// Whether the access is granted for the thumbnail.
 	Thumb bool `json:"thumb,omitempty"`
+	// The variant of the file, other than the content or the thumbnail,
+	// that the access is granted for, e.g. "medium".
+	Variant string `json:"variant,omitempty"`
+	// The subject's token epoch when the token was issued. The token is
+	// revoked when the subject's epoch changes.
+	Epoch int64 `json:"epoch,omitempty"`
 }
 
 // MakeKey returns a new encryption key.
@@ -147,50 +210,76 @@ func Mint(key *Key, tok Token, exp time.Duration) string {
 	tok.Expiration = time.Now().Add(exp).Unix()
 	ser, _ := json.Marshal(tok)
 
-	cc, err := chacha20poly1305.New(key[:])
+	ek := kdf.Derive(key[:], kdf.TokenEncryption, chacha20poly1305.KeySize)
+	defer wipe(ek)
+	cc, err := chacha20poly1305.NewX(ek)
 	if err != nil {
 		panic(err)
 	}
 
-	enc := make([]byte, 8)
-	binary.BigEndian.PutUint64(enc, uint64(tok.Subject))
+	enc := make([]byte, headerSize)
+	enc[0] = version1
+	enc[1] = algXChaCha20Poly1305SIV
+	binary.BigEndian.PutUint32(enc[2:6], key.ID())
+	binary.BigEndian.PutUint64(enc[6:14], uint64(tok.Subject))
 
-	nonce := make([]byte, cc.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		panic(err)
-	}
+	nonce := key.syntheticNonce(enc, ser)
 	enc = append(enc, nonce...)
-	enc = cc.Seal(enc, nonce, ser, enc[:8])
+	enc = cc.Seal(enc, nonce, ser, enc[:headerSize])
 
 	return base64.RawURLEncoding.EncodeToString(enc)
 }
 
-// Subject returns the plaintext Subject ID from an encrypted token.
-func Subject(t string) (int64, error) {
+// decode returns the decoded token and its subject.
+func decode(t string) ([]byte, int64, error) {
 	enc, err := base64.RawURLEncoding.DecodeString(t)
-	if err != nil {
-		return 0, ErrValidationFailed
+	if err != nil || len(enc) == 0 {
+		return nil, 0, ErrValidationFailed
+	}
+	switch enc[0] {
+	case versionLegacy:
+		if len(enc) <= 8+chacha20poly1305.NonceSize {
+			return nil, 0, ErrValidationFailed
+		}
+		return enc, int64(binary.BigEndian.Uint64(enc[:8])), nil
+	case version1:
+		if len(enc) <= headerSize+chacha20poly1305.NonceSizeX || enc[1] != algXChaCha20Poly1305SIV {
+			return nil, 0, ErrValidationFailed
+		}
+		return enc, int64(binary.BigEndian.Uint64(enc[6:14])), nil
+	default:
+		return nil, 0, ErrValidationFailed
 	}
-	if len(enc) <= 8+chacha20poly1305.NonceSize {
-		return 0, ErrValidationFailed
+}
+
+// Subject returns the plaintext Subject ID from an encrypted token.
+func Subject(t string) (int64, error) {
+	_, sub, err := decode(t)
+	return sub, err
+}
+
+// KeyID returns the ID of the key that was used to encrypt the token. It
+// returns false if the token doesn't have a key ID, e.g. legacy tokens.
+func KeyID(t string) (uint32, bool) {
+	enc, _, err := decode(t)
+	if err != nil || enc[0] == versionLegacy {
+		return 0, false
 	}
-	return int64(binary.BigEndian.Uint64(enc[:8])), nil
+	return binary.BigEndian.Uint32(enc[2:6]), true
 }
 
 // Decrypt returns a decrypted and validated token.
 func Decrypt(key *Key, t string) (Token, error) {
-	enc, err := base64.RawURLEncoding.DecodeString(t)
+	enc, sub, err := decode(t)
 	if err != nil {
-		return Token{}, ErrValidationFailed
+		return Token{}, err
 	}
-	if len(enc) <= 8+chacha20poly1305.NonceSize {
-		return Token{}, ErrValidationFailed
-	}
-	cc, err := chacha20poly1305.New(key[:])
-	if err != nil {
-		return Token{}, ErrValidationFailed
+	var ser []byte
+	if enc[0] == versionLegacy {
+		ser, err = decryptLegacy(key, enc)
+	} else {
+		ser, err = decryptV1(key, enc)
 	}
-	ser, err := cc.Open(nil, enc[8:8+cc.NonceSize()], enc[8+cc.NonceSize():], enc[:8])
 	if err != nil {
 		return Token{}, ErrValidationFailed
 	}
@@ -198,7 +287,7 @@ func Decrypt(key *Key, t string) (Token, error) {
 	if err := json.Unmarshal(ser, &tok); err != nil {
 		return Token{}, ErrValidationFailed
 	}
-	if int64(binary.BigEndian.Uint64(enc[:8])) != tok.Subject {
+	if sub != tok.Subject {
 		return Token{}, ErrValidationFailed
 	}
 	if now := time.Now().Unix(); tok.IssuedAt > now || tok.Expiration < now {
@@ -207,6 +296,28 @@ func Decrypt(key *Key, t string) (Token, error) {
 	return tok, nil
 }
 
+func decryptLegacy(key *Key, enc []byte) ([]byte, error) {
+	cc, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cc.Open(nil, enc[8:8+cc.NonceSize()], enc[8+cc.NonceSize():], enc[:8])
+}
+
+func decryptV1(key *Key, enc []byte) ([]byte, error) {
+	if binary.BigEndian.Uint32(enc[2:6]) != key.ID() {
+		return nil, ErrValidationFailed
+	}
+	ek := kdf.Derive(key[:], kdf.TokenEncryption, chacha20poly1305.KeySize)
+	defer wipe(ek)
+	cc, err := chacha20poly1305.NewX(ek)
+	if err != nil {
+		return nil, err
+	}
+	n := headerSize + cc.NonceSize()
+	return cc.Open(nil, enc[headerSize:n], enc[n:], enc[:headerSize])
+}
+
 // Hash returns a token.
 func Hash(token string) string {
 	h := sha1.Sum([]byte(token))
@@ -18,8 +18,14 @@
 package token
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestTokens(t *testing.T) {
@@ -34,3 +40,75 @@ func TestTokens(t *testing.T) {
 		t.Errorf("Unexpected token. Got %+v, want {'foo', 'blah blah'}", dec)
 	}
 }
+
+func TestKeyID(t *testing.T) {
+	key1, key2 := MakeKey(), MakeKey()
+	defer key1.Wipe()
+	defer key2.Wipe()
+	if key1.ID() == key2.ID() {
+		t.Fatalf("key1.ID() == key2.ID()")
+	}
+	tok := Mint(key1, Token{Scope: "foo", Subject: 44545}, time.Hour)
+	if id, ok := KeyID(tok); !ok || id != key1.ID() {
+		t.Errorf("KeyID() = %d, %v, want %d, true", id, ok, key1.ID())
+	}
+	if sub, err := Subject(tok); err != nil || sub != 44545 {
+		t.Errorf("Subject() = %d, %v, want 44545, nil", sub, err)
+	}
+	if _, err := Decrypt(key2, tok); err != ErrValidationFailed {
+		t.Errorf("Decrypt(key2) = %v, want ErrValidationFailed", err)
+	}
+}
+
+func TestTamperedToken(t *testing.T) {
+	key := MakeKey()
+	defer key.Wipe()
+	tok := Mint(key, Token{Scope: "foo", Subject: 44545}, time.Hour)
+	enc, _ := base64.RawURLEncoding.DecodeString(tok)
+	for i := range enc {
+		b := make([]byte, len(enc))
+		copy(b, enc)
+		b[i] ^= 0x01
+		if _, err := Decrypt(key, base64.RawURLEncoding.EncodeToString(b)); err == nil {
+			t.Errorf("Decrypt succeeded with byte %d modified", i)
+		}
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	key := MakeKey()
+	defer key.Wipe()
+	ser, _ := json.Marshal(Token{
+		Scope:      "foo",
+		Subject:    44545,
+		IssuedAt:   time.Now().Unix(),
+		Expiration: time.Now().Add(time.Hour).Unix(),
+	})
+	cc, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		t.Fatalf("chacha20poly1305.New: %v", err)
+	}
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, 44545)
+	nonce := make([]byte, cc.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	enc = append(enc, nonce...)
+	enc = cc.Seal(enc, nonce, ser, enc[:8])
+	tok := base64.RawURLEncoding.EncodeToString(enc)
+
+	if _, ok := KeyID(tok); ok {
+		t.Errorf("KeyID() returned ok for legacy token")
+	}
+	if sub, err := Subject(tok); err != nil || sub != 44545 {
+		t.Errorf("Subject() = %d, %v, want 44545, nil", sub, err)
+	}
+	dec, err := Decrypt(key, tok)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if dec.Scope != "foo" || dec.Subject != 44545 {
+		t.Errorf("Unexpected token. Got %+v", dec)
+	}
+}
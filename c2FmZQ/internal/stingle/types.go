@@ -47,6 +47,7 @@ type File struct {
 	DateModified json.Number `json:"dateModified"`
 	Headers      string      `json:"headers"`
 	AlbumID      string      `json:"albumId"`
+	HasMedium    json.Number `json:"hasMedium,omitempty"`
 }
 
 // The Stingle API representation of an album.
@@ -68,6 +69,34 @@ type Album struct {
 	SharingKeys   map[string]string `json:"sharingKeys,omitempty"`
 }
 
+// An encrypted comment in an album. This is a c2FmZQ extension.
+type Comment struct {
+	CommentID   string      `json:"commentId"`
+	AlbumID     string      `json:"albumId"`
+	File        string      `json:"file,omitempty"`
+	UserID      json.Number `json:"userId"`
+	Content     string      `json:"content"`
+	DateCreated json.Number `json:"dateCreated"`
+}
+
+// An encrypted reaction of an album member to a file. This is a c2FmZQ
+// extension.
+type Reaction struct {
+	AlbumID      string      `json:"albumId"`
+	File         string      `json:"file"`
+	UserID       json.Number `json:"userId"`
+	Content      string      `json:"content"`
+	DateModified json.Number `json:"dateModified"`
+}
+
+// An album member's encrypted "last seen" marker. This is a c2FmZQ extension.
+type SeenMarker struct {
+	AlbumID      string      `json:"albumId"`
+	UserID       json.Number `json:"userId"`
+	Content      string      `json:"content"`
+	DateModified json.Number `json:"dateModified"`
+}
+
 // PK returns the contact's decoded PublicKey.
 func (c Contact) PK() (pk PublicKey, err error) {
 	b, err := base64.StdEncoding.DecodeString(c.PublicKey)
@@ -168,6 +197,8 @@ const (
 	DeleteEventAlbum       = 4 // An album is deleted.
 	DeleteEventAlbumFile   = 5 // A file is removed from an album.
 	DeleteEventContact     = 6 // A contact is removed.
+	DeleteEventComment     = 7 // A comment is removed from an album (c2FmZQ extension).
+	DeleteEventReaction    = 8 // A reaction is removed from a file (c2FmZQ extension).
 )
 
 // The Stingle API representation of a Delete event.
@@ -176,6 +207,7 @@ type DeleteEvent struct {
 	AlbumID string      `json:"albumId"`
 	Type    json.Number `json:"type"`
 	Date    json.Number `json:"date"`
+	UserID  json.Number `json:"userId,omitempty"`
 }
 
 const (
@@ -0,0 +1,107 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package timing measures how long the phases of a request take.
+package timing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ctxKey struct{}
+
+// Timers accumulates the time spent in each phase of a request. A nil *Timers
+// is valid and doesn't record anything, so that code that runs with and without
+// a request context doesn't need to check.
+type Timers struct {
+	mu     sync.Mutex
+	start  time.Time
+	names  []string
+	phases map[string]time.Duration
+}
+
+// NewContext returns a new context that carries new Timers.
+func NewContext(ctx context.Context) (context.Context, *Timers) {
+	t := &Timers{
+		start:  time.Now(),
+		phases: make(map[string]time.Duration),
+	}
+	return context.WithValue(ctx, ctxKey{}, t), t
+}
+
+// FromContext returns the Timers carried by ctx, or nil.
+func FromContext(ctx context.Context) *Timers {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(ctxKey{}).(*Timers)
+	return t
+}
+
+// Start starts measuring a phase. The returned func must be called at the end
+// of the phase. A phase can be measured more than once, and the durations are
+// added up.
+func (t *Timers) Start(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.Add(name, time.Since(start))
+	}
+}
+
+// Add adds d to the duration of a phase.
+func (t *Timers) Add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.phases[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.phases[name] += d
+}
+
+// Elapsed returns the time since the Timers were created.
+func (t *Timers) Elapsed() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Since(t.start)
+}
+
+// String returns the duration of each phase, in the order in which they were
+// first seen, and the total duration.
+func (t *Timers) String() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var parts []string
+	for _, n := range t.names {
+		parts = append(parts, fmt.Sprintf("%s=%s", n, t.phases[n].Round(time.Microsecond)))
+	}
+	parts = append(parts, fmt.Sprintf("total=%s", time.Since(t.start).Round(time.Microsecond)))
+	return strings.Join(parts, " ")
+}
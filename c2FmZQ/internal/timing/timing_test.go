@@ -0,0 +1,49 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package timing_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/timing"
+)
+
+func TestTimers(t *testing.T) {
+	if timing.FromContext(context.Background()) != nil {
+		t.Fatal("FromContext returned timers for an empty context")
+	}
+	// A nil *Timers must be usable.
+	timing.FromContext(context.Background()).Start("nothing")()
+
+	ctx, timers := timing.NewContext(context.Background())
+	if got := timing.FromContext(ctx); got != timers {
+		t.Fatalf("FromContext() = %p, want %p", got, timers)
+	}
+	timers.Add("auth", 2*time.Millisecond)
+	timers.Add("db-lock", time.Millisecond)
+	timers.Add("auth", 3*time.Millisecond)
+	timers.Start("write")()
+
+	got := timers.String()
+	if !strings.HasPrefix(got, "auth=5ms db-lock=1ms write=") || !strings.Contains(got, " total=") {
+		t.Errorf("String() = %q", got)
+	}
+}